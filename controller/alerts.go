@@ -0,0 +1,63 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+
+	"go.universe.tf/metallb/internal/alert"
+)
+
+// alerter fires and resolves alerts.
+type alerter interface {
+	Set(l log.Logger, a alert.Alert, firing bool)
+}
+
+// poolExhaustedAlert is the alert about pool having no free address.
+func poolExhaustedAlert(pool string, capacity int64) alert.Alert {
+	return alert.Alert{
+		Name:    "MetalLBPoolExhausted",
+		Labels:  map[string]string{"pool": pool},
+		Summary: fmt.Sprintf("address pool %q has no free address left, out of %d", pool, capacity),
+	}
+}
+
+// alertExhaustedPools fires the exhausted pool alerts of the pools
+// whose addresses are all in use, and resolves the others', including
+// the pools that were removed.
+func (c *controller) alertExhaustedPools(l log.Logger) {
+	if c.alerts == nil || c.config == nil || !c.synced {
+		return
+	}
+	for n := range c.config.Pools {
+		inUse, capacity := c.ips.Usage(n)
+		exhausted := capacity > 0 && inUse >= capacity
+		c.alerts.Set(l, poolExhaustedAlert(n, capacity), exhausted)
+		if exhausted {
+			if c.exhausted == nil {
+				c.exhausted = map[string]bool{}
+			}
+			c.exhausted[n] = true
+		} else {
+			delete(c.exhausted, n)
+		}
+	}
+	for n := range c.exhausted {
+		if c.config.Pools[n] == nil {
+			c.alerts.Set(l, poolExhaustedAlert(n, 0), false)
+			delete(c.exhausted, n)
+		}
+	}
+}
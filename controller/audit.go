@@ -0,0 +1,67 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/go-kit/kit/log"
+)
+
+// newAuditLogger returns a logger that appends allocation records to
+// path, as JSON lines. "-" writes them to stdout.
+func newAuditLogger(path string) (log.Logger, error) {
+	w := os.Stdout
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %s", err)
+		}
+		w = f
+	}
+	return log.With(log.NewJSONLogger(log.NewSyncWriter(w)), "ts", log.DefaultTimestampUTC), nil
+}
+
+// auditAllocation records an allocation decision in the audit log,
+// if enabled.
+func (c *controller) auditAllocation(key, event string, ip net.IP, pool, reason string) {
+	if c.audit == nil {
+		return
+	}
+	kvs := []interface{}{"event", event, "service", key, "ip", ip.String(), "pool", pool}
+	if reason != "" {
+		kvs = append(kvs, "reason", reason)
+	}
+	c.audit.Log(kvs...)
+}
+
+// release frees the IP allocated to key, if any, and records it in
+// the audit log. It returns true if an IP was released.
+func (c *controller) release(key, reason string) bool {
+	ip, pool := c.ips.IP(key), c.ips.Pool(key)
+	delete(c.priorities, key)
+	if !c.ips.Unassign(key) {
+		return false
+	}
+	c.released(key, ip, pool, reason)
+	return true
+}
+
+// released deletes the IPClaim of key, whose IP from pool was
+// unassigned, and records the release in the audit log.
+func (c *controller) released(key string, ip net.IP, pool, reason string) {
+	c.releaseClaim(key)
+	c.auditAllocation(key, "ipReleased", ip, pool, reason)
+}
@@ -0,0 +1,83 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+)
+
+// cleanupClient lists and releases the services MetalLB manages.
+type cleanupClient interface {
+	ManagedServices(lbClass string) ([]*v1.Service, error)
+	ReleaseService(svc *v1.Service) error
+}
+
+// cleanup releases all the services this instance manages, before
+// MetalLB is uninstalled: it removes their DNS records and clears
+// their load balancer status, so that nothing keeps pointing at IPs
+// that are no longer announced. The speakers withdraw their
+// announcements when they shut down.
+func (c *controller) cleanup(l log.Logger, client cleanupClient) error {
+	svcs, err := client.ManagedServices(c.lbClass)
+	if err != nil {
+		return fmt.Errorf("listing services: %s", err)
+	}
+	failed := 0
+	for _, svc := range svcs {
+		key := svc.Namespace + "/" + svc.Name
+		sl := log.With(l, "service", key)
+		if err := c.cleanupDNS(sl, key, svc); err != nil {
+			// Keep the status, which has the IPs whose records a
+			// new run must remove.
+			level.Error(sl).Log("op", "cleanup", "error", err, "msg", "failed to remove DNS record")
+			failed++
+			continue
+		}
+		if err := client.ReleaseService(svc); err != nil {
+			level.Error(sl).Log("op", "cleanup", "error", err, "msg", "failed to clear service status")
+			failed++
+			continue
+		}
+		level.Info(sl).Log("event", "serviceReleased", "msg", "cleared service status")
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to release %d of %d services", failed, len(svcs))
+	}
+	level.Info(l).Log("event", "cleanupDone", "services", len(svcs), "msg", "released all services")
+	return nil
+}
+
+// cleanupDNS removes the DNS records of the IPs in the status of the
+// service key, if DNS updates are enabled.
+func (c *controller) cleanupDNS(l log.Logger, key string, svc *v1.Service) error {
+	if c.dns == nil {
+		return nil
+	}
+	name := c.dnsName(key, svc)
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ip := net.ParseIP(ingress.IP)
+		if ip == nil {
+			continue
+		}
+		if err := c.dns.Delete(name, ip); err != nil {
+			return err
+		}
+		level.Info(l).Log("event", "dnsDeleted", "name", name, "ip", ip, "msg", "removed DNS record")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// processName is the name of the controller, and the field manager
+// of its writes.
+const processName = "metallb-controller"
+
+// statusConflict returns the field manager of another controller that
+// overwrote the IP MetalLB published in the status of svc, "" if
+// there is none. The service is in conflict until the other
+// controller no longer manages its status, e.g. once it was
+// uninstalled and the status cleared.
+func (c *controller) statusConflict(l log.Logger, key string, svc *v1.Service) string {
+	ip := c.ips.IP(key)
+	by := k8s.StatusConflict(svc, c.fieldManager, ip)
+	if by == "" {
+		if c.conflicts[key] != "" {
+			level.Info(l).Log("event", "statusConflictResolved", "msg", "no other controller writes the load balancer status anymore, managing the service again")
+			delete(c.conflicts, key)
+		}
+		return ""
+	}
+	if c.conflicts[key] == "" {
+		// Without an IP of ours, MetalLB takes the status over, e.g.
+		// from the load balancer implementation it replaces.
+		if ip == nil {
+			return ""
+		}
+		if c.conflicts == nil {
+			c.conflicts = map[string]string{}
+		}
+		c.conflicts[key] = by
+		level.Warn(l).Log("event", "statusConflict", "manager", by, "msg", "another controller overwrote the load balancer status, not managing the service anymore")
+		c.client.Errorf(svc, "StatusConflict", "Field manager %q overwrote the load balancer status, MetalLB stops managing the service: only one controller may implement it, see spec.loadBalancerClass", by)
+	}
+	return by
+}
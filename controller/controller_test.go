@@ -1,18 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
+	"go.universe.tf/metallb/internal/alert"
 	"go.universe.tf/metallb/internal/allocator"
 	"go.universe.tf/metallb/internal/config"
 	"go.universe.tf/metallb/internal/k8s"
 
 	"github.com/go-kit/kit/log"
 	"github.com/google/go-cmp/cmp"
+	dto "github.com/prometheus/client_model/go"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -61,12 +70,40 @@ func statusAssigned(ip string) v1.ServiceStatus {
 type testK8S struct {
 	updateService       *v1.Service
 	updateServiceStatus *v1.ServiceStatus
+	updateIPMode        string
+	gatewayAddresses    []string
+	ingressAddresses    []string
+	configMaps          map[string]map[string]string
+	changedAt           time.Time
+	syncAfter           map[string]time.Duration
+	defaultPools        map[string]string
+	ipClaims            map[string]string
+	rejectClaims        bool
+	nodeLoopbacks       map[string]string
 	loggedWarning       bool
-	t                   *testing.T
+	// The annotations of the last annotated event.
+	annotations map[string]string
+	t           *testing.T
 }
 
-func (s *testK8S) UpdateStatus(svc *v1.Service) error {
+func (s *testK8S) ChangedAt(key string) time.Time {
+	return s.changedAt
+}
+
+func (s *testK8S) SyncAfter(key string, d time.Duration) {
+	if s.syncAfter == nil {
+		s.syncAfter = map[string]time.Duration{}
+	}
+	s.syncAfter[key] = d
+}
+
+func (s *testK8S) DefaultPool(namespace string) string {
+	return s.defaultPools[namespace]
+}
+
+func (s *testK8S) UpdateStatus(svc *v1.Service, ipMode string) error {
 	s.updateServiceStatus = &svc.Status
+	s.updateIPMode = ipMode
 	return nil
 }
 
@@ -74,14 +111,64 @@ func (s *testK8S) Infof(_ *v1.Service, evtType string, msg string, args ...inter
 	s.t.Logf("k8s Info event %q: %s", evtType, fmt.Sprintf(msg, args...))
 }
 
+func (s *testK8S) AnnotatedInfof(_ *v1.Service, annotations map[string]string, evtType string, msg string, args ...interface{}) {
+	s.t.Logf("k8s Info event %q %v: %s", evtType, annotations, fmt.Sprintf(msg, args...))
+	s.annotations = annotations
+}
+
 func (s *testK8S) Errorf(_ *v1.Service, evtType string, msg string, args ...interface{}) {
 	s.t.Logf("k8s Warning event %q: %s", evtType, fmt.Sprintf(msg, args...))
 	s.loggedWarning = true
 }
 
+func (s *testK8S) UpdateGatewayStatus(gw *k8s.Gateway, ips []string) error {
+	s.gatewayAddresses = ips
+	return nil
+}
+
+func (s *testK8S) ApplyIPClaim(svc *v1.Service, ip, pool string) error {
+	if s.rejectClaims {
+		return errors.New("admission webhook denied the request")
+	}
+	if s.ipClaims == nil {
+		s.ipClaims = map[string]string{}
+	}
+	s.ipClaims[svc.Namespace+"/"+svc.Name] = ip
+	return nil
+}
+
+func (s *testK8S) DeleteIPClaim(namespace, name string) error {
+	delete(s.ipClaims, namespace+"/"+name)
+	return nil
+}
+
+func (s *testK8S) ApplyNodeLoopback(name, ip string) error {
+	if s.nodeLoopbacks == nil {
+		s.nodeLoopbacks = map[string]string{}
+	}
+	s.nodeLoopbacks[name] = ip
+	return nil
+}
+
+func (s *testK8S) UpdateIngressStatus(ing *k8s.Ingress, ips []string) error {
+	s.ingressAddresses = ips
+	return nil
+}
+
+func (s *testK8S) ApplyConfigMap(namespace, name string, data map[string]string) error {
+	if s.configMaps == nil {
+		s.configMaps = map[string]map[string]string{}
+	}
+	s.configMaps[namespace+"/"+name] = data
+	return nil
+}
+
 func (s *testK8S) reset() {
 	s.updateService = nil
 	s.updateServiceStatus = nil
+	s.updateIPMode = ""
+	s.gatewayAddresses = nil
+	s.ingressAddresses = nil
 	s.loggedWarning = false
 }
 
@@ -479,6 +566,198 @@ func TestControllerMutation(t *testing.T) {
 				Status: statusAssigned("1000::"),
 			},
 		},
+
+		{
+			desc: "ignored service",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/ignore": "true",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:           "LoadBalancer",
+					ClusterIP:      "1.2.3.4",
+					LoadBalancerIP: "192.168.0.1",
+				},
+				Status: statusAssigned("192.168.0.1"),
+			},
+		},
+
+		{
+			desc: "service of another load balancer class",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/loadbalancer-class": "example.com/internal",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+			},
+		},
+
+		{
+			desc: "publish hostname",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/hostname": "web.example.com",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+				Status: statusAssigned("1.2.3.0"),
+			},
+			want: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/hostname": "web.example.com",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+				Status: v1.ServiceStatus{
+					LoadBalancer: v1.LoadBalancerStatus{
+						Ingress: []v1.LoadBalancerIngress{
+							{
+								IP:       "1.2.3.0",
+								Hostname: "web.example.com",
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "invalid hostname",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/hostname": "not a hostname",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+				Status: statusAssigned("1.2.3.0"),
+			},
+			wantErr: true,
+		},
+
+		{
+			desc: "request subnet",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool-subnet": "1.2.3.1/32",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+				Status: statusAssigned("1.2.3.0"),
+			},
+			want: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool-subnet": "1.2.3.1/32",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+				Status: statusAssigned("1.2.3.1"),
+			},
+		},
+
+		{
+			desc: "request subnet of pool",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool":        "pool2",
+						"metallb.universe.tf/address-pool-subnet": "3.4.5.0/24",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+			},
+			want: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool":        "pool2",
+						"metallb.universe.tf/address-pool-subnet": "3.4.5.0/24",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+				Status: statusAssigned("3.4.5.6"),
+			},
+		},
+
+		{
+			desc: "request subnet outside of pool",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool":        "pool2",
+						"metallb.universe.tf/address-pool-subnet": "1.2.3.0/31",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+			},
+			wantErr: true,
+		},
+
+		{
+			desc: "request invalid subnet",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool-subnet": "1.2.3.0",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+			},
+			wantErr: true,
+		},
+
+		{
+			desc: "request subnet from wrong ip-family",
+			in: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/address-pool-subnet": "1000::/127",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:      "LoadBalancer",
+					ClusterIP: "1.2.3.4",
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for i := 0; i < 100; i++ {
@@ -701,3 +980,2400 @@ func TestDeleteRecyclesIP(t *testing.T) {
 		t.Fatal("svc2 didn't get an IP")
 	}
 }
+
+func TestReleaseRetriesPending(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc1 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "test", svc1, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer svc1 failed")
+	}
+	svc1 = k.gotService(svc1)
+	k.reset()
+
+	svc2 := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.5",
+		},
+	}
+	if c.SetBalancer(l, "test2", svc2, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer svc2 failed")
+	}
+	if k.gotService(svc2) != nil {
+		t.Fatal("svc2 got an IP even though the pool is exhausted")
+	}
+	k.reset()
+
+	// Turning svc1 into a ClusterIP service frees its IP, which svc2
+	// is waiting for.
+	svc1 = svc1.DeepCopy()
+	svc1.Spec.Type = "ClusterIP"
+	if c.SetBalancer(l, "test", svc1, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("releasing svc1's IP failed")
+	}
+	if d, ok := k.syncAfter["test2"]; !ok || d != 0 || len(k.syncAfter) != 1 {
+		t.Fatalf("releasing svc1's IP didn't requeue just svc2, requeued %v", k.syncAfter)
+	}
+	k.reset()
+
+	if c.SetBalancer(l, "test2", svc2, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer svc2 failed")
+	}
+	gotSvc := k.gotService(svc2)
+	if gotSvc == nil || len(gotSvc.Status.LoadBalancer.Ingress) == 0 || gotSvc.Status.LoadBalancer.Ingress[0].IP != "1.2.3.0" {
+		t.Fatal("svc2 didn't get the released IP")
+	}
+
+	// Now svc1 is the one waiting for an IP.
+	svc1.Spec.Type = "LoadBalancer"
+	c.SetBalancer(l, "test", svc1, k8s.EpsOrSlices{})
+	if len(c.pending) != 1 {
+		t.Fatalf("expected svc1 to be pending, got %v", c.pending)
+	}
+	if c.SetBalancer(l, "test2", nil, k8s.EpsOrSlices{}) != k8s.SyncStateReprocessAll {
+		t.Fatal("deleting svc2 didn't tell us to reprocess all balancers")
+	}
+	if len(c.pending) != 1 || !c.pending["test"] {
+		t.Fatalf("unexpected pending services %v", c.pending)
+	}
+}
+
+func TestAllocationPriority(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	newSvc := func(priority string) *v1.Service {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if priority != "" {
+			svc.Annotations[allocationPriorityAnnotation] = priority
+		}
+		return svc
+	}
+
+	batch := newSvc("")
+	if c.SetBalancer(l, "batch", batch, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer batch failed")
+	}
+	batch = k.gotService(batch)
+	if batch == nil || len(batch.Status.LoadBalancer.Ingress) == 0 {
+		t.Fatal("batch didn't get an IP")
+	}
+	k.reset()
+
+	// A service with the same priority must wait.
+	other := newSvc("0")
+	if c.SetBalancer(l, "other", other, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer other failed")
+	}
+	if k.gotService(other) != nil {
+		t.Fatal("other preempted a service with the same priority")
+	}
+	k.reset()
+
+	// A preemption the allocation policy denies leaves the IP to the
+	// lower priority service.
+	c.policy = fakePolicy(func(req *allocator.PolicyRequest) (*allocator.PolicyDecision, error) {
+		return &allocator.PolicyDecision{Allowed: req.Service != "critical"}, nil
+	})
+	critical := newSvc("10")
+	if c.SetBalancer(l, "critical", critical, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer critical failed")
+	}
+	if k.gotService(critical) != nil {
+		t.Fatal("critical got an IP the allocation policy denied")
+	}
+	if ip := c.ips.IP("batch"); ip == nil || ip.String() != "1.2.3.0" || c.preempted["batch"] != "" {
+		t.Fatal("batch lost its IP to a denied preemption")
+	}
+	c.policy = nil
+	k.reset()
+
+	// A higher priority service takes the IP, and requeues the
+	// service it took it from.
+	k.syncAfter = nil
+	if c.SetBalancer(l, "critical", critical, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer critical failed")
+	}
+	if _, ok := k.syncAfter["batch"]; !ok {
+		t.Fatal("preempting an IP didn't requeue the preempted service")
+	}
+	gotSvc := k.gotService(critical)
+	if gotSvc == nil || len(gotSvc.Status.LoadBalancer.Ingress) == 0 || gotSvc.Status.LoadBalancer.Ingress[0].IP != "1.2.3.0" {
+		t.Fatal("critical didn't get the preempted IP")
+	}
+	critical = gotSvc
+	k.reset()
+
+	// The preempted service loses its IP.
+	if c.SetBalancer(l, "batch", batch, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer batch failed")
+	}
+	gotSvc = k.gotService(batch)
+	if gotSvc == nil || len(gotSvc.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatal("batch kept the preempted IP in its status")
+	}
+	if !k.loggedWarning {
+		t.Error("no warning event for the preempted service")
+	}
+	k.reset()
+
+	// The higher priority service keeps its IP.
+	if c.SetBalancer(l, "critical", critical, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer critical failed")
+	}
+	if k.gotService(critical) != nil {
+		t.Fatal("critical service changed after converging")
+	}
+}
+
+func TestAllocationExport(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:             allocator.New(),
+		client:          k,
+		exportNamespace: "metallb-system",
+		exportName:      "allocations",
+		allocations:     &allocationsHandler{},
+	}
+	get := func(etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/allocations", nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		c.allocations.ServeHTTP(w, r)
+		return w
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+
+	// Existing allocations are only exported once synced.
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"metallb.universe.tf/allow-shared-ip": "share",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+			Ports: []v1.ServicePort{
+				{
+					Protocol: v1.ProtocolTCP,
+					Port:     80,
+				},
+			},
+		},
+		Status: statusAssigned("1.2.3.1"),
+	}
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer failed")
+	}
+	if k.configMaps != nil {
+		t.Fatal("allocations exported before the controller synced")
+	}
+	if w := get(""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d before the controller synced, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	c.MarkSynced(l)
+
+	want := `[
+  {
+    "kind": "Service",
+    "name": "default/web",
+    "ip": "1.2.3.1",
+    "pool": "default",
+    "sharingKey": "share",
+    "ports": [
+      "TCP/80"
+    ]
+  }
+]`
+	if diff := cmp.Diff(want, k.configMaps["metallb-system/allocations"][exportKey]); diff != "" {
+		t.Errorf("wrong export after sync (-want +got)\n%s", diff)
+	}
+	gen := exportedGeneration(c.ips.Epoch(), c.ips.Generation())
+	if got := k.configMaps["metallb-system/allocations"][generationKey]; got != gen {
+		t.Errorf("got exported generation %q, want %q", got, gen)
+	}
+
+	w := get("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	etag := w.Header().Get("ETag")
+	if etag != `"`+gen+`"` {
+		t.Errorf("got ETag %s, want the generation %s", etag, gen)
+	}
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Errorf("got status %d for unchanged allocations, want %d", w.Code, http.StatusNotModified)
+	}
+
+	if c.SetBalancer(l, "default/web", nil, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if diff := cmp.Diff("[]", k.configMaps["metallb-system/allocations"][exportKey]); diff != "" {
+		t.Errorf("wrong export after deletion (-want +got)\n%s", diff)
+	}
+	w = get(etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for changed allocations, want %d", w.Code, http.StatusOK)
+	}
+	want = fmt.Sprintf(`{"generation":"%s","allocations":[]}`, exportedGeneration(c.ips.Epoch(), c.ips.Generation()))
+	if diff := cmp.Diff(want, w.Body.String()); diff != "" {
+		t.Errorf("wrong allocations served after deletion (-want +got)\n%s", diff)
+	}
+	etag = w.Header().Get("ETag")
+
+	// A restarted controller counts its generations from zero again,
+	// but doesn't reuse the ETag of the same generation.
+	k.reset()
+	c2 := &controller{
+		ips:             allocator.New(),
+		client:          k,
+		exportNamespace: "metallb-system",
+		exportName:      "allocations",
+		allocations:     &allocationsHandler{},
+	}
+	if c2.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	svc.Status = statusAssigned("1.2.3.0")
+	for c2.ips.Generation() < c.ips.Generation() {
+		if c2.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if c2.SetBalancer(l, "default/web", nil, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+	}
+	c2.MarkSynced(l)
+	r := httptest.NewRequest("GET", "/allocations", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	c2.allocations.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d for the ETag of the previous controller, want %d", w.Code, http.StatusOK)
+	}
+	if got, old := k.configMaps["metallb-system/allocations"][generationKey], exportedGeneration(c.ips.Epoch(), c2.ips.Generation()); got == old {
+		t.Errorf("restarted controller exported the generation %q of the previous one", got)
+	}
+}
+
+func TestPoolMetadata(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:             allocator.New(),
+		client:          k,
+		exportNamespace: "metallb-system",
+		exportName:      "allocations",
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"public": {
+				AutoAssign:     true,
+				CIDR:           []*net.IPNet{ipnet("198.51.100.0/31")},
+				Description:    "Internet-facing services",
+				ReverseDNSZone: "100.51.198.in-addr.arpa.",
+				Owner:          "netops",
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer failed")
+	}
+	want := map[string]string{
+		"metallb.universe.tf/pool":             "public",
+		"metallb.universe.tf/pool-description": "Internet-facing services",
+		"metallb.universe.tf/reverse-dns-zone": "100.51.198.in-addr.arpa.",
+		"metallb.universe.tf/pool-owner":       "netops",
+	}
+	if diff := cmp.Diff(want, k.annotations); diff != "" {
+		t.Errorf("wrong allocation event annotations (-want +got)\n%s", diff)
+	}
+	export := `[
+  {
+    "kind": "Service",
+    "name": "default/web",
+    "ip": "198.51.100.0",
+    "pool": "public",
+    "poolDescription": "Internet-facing services",
+    "reverseDNSZone": "100.51.198.in-addr.arpa.",
+    "owner": "netops"
+  }
+]`
+	if diff := cmp.Diff(export, k.configMaps["metallb-system/allocations"][exportKey]); diff != "" {
+		t.Errorf("wrong export (-want +got)\n%s", diff)
+	}
+
+	// Changing the metadata of the pool changes the export.
+	gen := c.ips.Generation()
+	cfg = &config.Config{
+		Pools: map[string]*config.Pool{
+			"public": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("198.51.100.0/31")},
+				Owner:      "sre",
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	if c.ips.Generation() == gen {
+		t.Fatal("generation unchanged after the pool metadata changed")
+	}
+	svc.Status = statusAssigned("198.51.100.0")
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer failed")
+	}
+	export = `[
+  {
+    "kind": "Service",
+    "name": "default/web",
+    "ip": "198.51.100.0",
+    "pool": "public",
+    "owner": "sre"
+  }
+]`
+	if diff := cmp.Diff(export, k.configMaps["metallb-system/allocations"][exportKey]); diff != "" {
+		t.Errorf("wrong export after the metadata changed (-want +got)\n%s", diff)
+	}
+}
+
+func TestSCTPSharing(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := func(proto v1.Protocol) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"metallb.universe.tf/allow-shared-ip": "diameter",
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "10.0.0.1",
+				Ports:     []v1.ServicePort{{Protocol: proto, Port: 3868}},
+			},
+		}
+	}
+
+	// SCTP and TCP services on the same port share the IP.
+	for name, proto := range map[string]v1.Protocol{
+		"default/diameter-sctp": v1.ProtocolSCTP,
+		"default/diameter-tcp":  v1.ProtocolTCP,
+	} {
+		k.reset()
+		if c.SetBalancer(l, name, svc(proto), k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer %s failed", name)
+		}
+		if k.loggedWarning {
+			t.Fatalf("%s: warning logged", name)
+		}
+		if got := c.ips.IP(name); got == nil || got.String() != "1.2.3.0" {
+			t.Errorf("%s got IP %v, want 1.2.3.0", name, got)
+		}
+	}
+
+	// A second SCTP service on the same port conflicts.
+	k.reset()
+	c.SetBalancer(l, "default/diameter-sctp2", svc(v1.ProtocolSCTP), k8s.EpsOrSlices{})
+	if c.ips.IP("default/diameter-sctp2") != nil {
+		t.Error("conflicting SCTP service got an IP")
+	}
+	if !k.loggedWarning {
+		t.Error("no warning for the conflicting SCTP service")
+	}
+}
+
+func TestPoolAllowedPorts(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"public": {
+				AutoAssign:   true,
+				CIDR:         []*net.IPNet{ipnet("1.2.3.0/31")},
+				AllowedPorts: []config.PortRange{{Proto: "TCP", First: 443, Last: 443}},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.1",
+			Ports:     []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 443}},
+		},
+	}
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if k.loggedWarning || c.ips.IP("default/web") == nil {
+		t.Fatal("service with allowed ports didn't get an IP")
+	}
+
+	// Exposing another port loses the IP, with a warning.
+	svc = k.gotService(svc)
+	k.reset()
+	svc.Spec.Ports = append(svc.Spec.Ports, v1.ServicePort{Protocol: v1.ProtocolTCP, Port: 22})
+	c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{})
+	if c.ips.IP("default/web") != nil {
+		t.Error("service with a disallowed port kept its IP")
+	}
+	if !k.loggedWarning {
+		t.Error("no warning for the service with a disallowed port")
+	}
+}
+
+// fakeDNS implements dnsUpdater by recording the published records.
+type fakeDNS struct {
+	records map[string]string
+	fail    bool
+}
+
+func (d *fakeDNS) Zone() string {
+	return "lb.example.com."
+}
+
+func (d *fakeDNS) Set(name string, ip net.IP) error {
+	if d.fail {
+		return fmt.Errorf("DNS server unreachable")
+	}
+	d.records[name] = ip.String()
+	return nil
+}
+
+func (d *fakeDNS) Delete(name string, ip net.IP) error {
+	if d.fail {
+		return fmt.Errorf("DNS server unreachable")
+	}
+	if d.records[name] != ip.String() {
+		return fmt.Errorf("no record %s %s", name, ip)
+	}
+	delete(d.records, name)
+	return nil
+}
+
+func TestDNSUpdates(t *testing.T) {
+	k := &testK8S{t: t}
+	d := &fakeDNS{records: map[string]string{}}
+	c := &controller{
+		ips:      allocator.New(),
+		client:   k,
+		dns:      d,
+		dnsStore: "metallb-system/dns-records",
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	check := func(desc string, want map[string]string) {
+		t.Helper()
+		if diff := cmp.Diff(want, d.records); diff != "" {
+			t.Errorf("%s: wrong DNS records (-want +got)\n%s", desc, diff)
+		}
+	}
+
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	check("allocation", map[string]string{"web.default.lb.example.com": "1.2.3.0"})
+
+	svc.Annotations[hostnameAnnotation] = "www.lb.example.com"
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer failed")
+	}
+	check("hostname in zone", map[string]string{"www.lb.example.com": "1.2.3.0"})
+
+	svc.Annotations[hostnameAnnotation] = "www.example.org"
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) != k8s.SyncStateSuccess {
+		t.Fatal("SetBalancer failed")
+	}
+	check("hostname outside of zone", map[string]string{"web.default.lb.example.com": "1.2.3.0"})
+	saved := map[string]string{"default.web": "web.default.lb.example.com 1.2.3.0"}
+	if diff := cmp.Diff(saved, k.configMaps["metallb-system/dns-records"]); diff != "" {
+		t.Errorf("wrong saved DNS records (-want +got)\n%s", diff)
+	}
+
+	// A restarted controller removes the records of the services
+	// deleted while it was down.
+	c2 := &controller{
+		ips:      allocator.New(),
+		client:   k,
+		dns:      d,
+		dnsStore: "metallb-system/dns-records",
+	}
+	c2.loadDNSRecords(l, saved)
+	k.syncAfter = nil
+	c2.MarkSynced(l)
+	if _, ok := k.syncAfter["default/web"]; !ok {
+		t.Fatal("restarted controller didn't reprocess the service with a saved DNS record")
+	}
+
+	// Failing to remove the record doesn't hold up the release of the
+	// IP, the removal is retried later.
+	d.fail = true
+	k.syncAfter = nil
+	if c.SetBalancer(l, "default/web", nil, k8s.EpsOrSlices{}) != k8s.SyncStateReprocessAll {
+		t.Fatal("SetBalancer failed")
+	}
+	if c.ips.IP("default/web") != nil {
+		t.Fatal("IP not released when its DNS record couldn't be removed")
+	}
+	if delay, ok := k.syncAfter["default/web"]; !ok || delay != dnsRetryInterval {
+		t.Fatal("removal of the DNS record not retried")
+	}
+	d.fail = false
+	if c.SetBalancer(l, "default/web", nil, k8s.EpsOrSlices{}) != k8s.SyncStateReprocessAll {
+		t.Fatal("SetBalancer failed")
+	}
+	check("deletion", map[string]string{})
+	if diff := cmp.Diff(map[string]string{}, k.configMaps["metallb-system/dns-records"]); diff != "" {
+		t.Errorf("wrong saved DNS records (-want +got)\n%s", diff)
+	}
+}
+
+func TestGatewayAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	gw := &k8s.Gateway{Namespace: "default", Name: "gw1"}
+	if c.SetGateway(l, "default/gw1", gw) == k8s.SyncStateError {
+		t.Fatalf("SetGateway failed")
+	}
+	if diff := cmp.Diff([]string{"1.2.3.0"}, k.gatewayAddresses); diff != "" {
+		t.Errorf("unexpected gateway addresses (-want +got)\n%s", diff)
+	}
+
+	// Converged gateway, no status write.
+	k.reset()
+	gw.Addresses = []string{"1.2.3.0"}
+	if c.SetGateway(l, "default/gw1", gw) == k8s.SyncStateError {
+		t.Fatalf("SetGateway failed")
+	}
+	if k.gatewayAddresses != nil {
+		t.Errorf("converged gateway updated status to %v", k.gatewayAddresses)
+	}
+
+	// The only IP is taken, a service can't get it.
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{})
+	if gotSvc := k.gotService(svc); gotSvc != nil {
+		t.Errorf("service got an IP held by a gateway (-in +out)\n%s", diffService(svc, gotSvc))
+	}
+
+	// Gateway requests its own address, releasing ours.
+	gw.SpecAddresses = []string{"10.0.0.1"}
+	if c.SetGateway(l, "default/gw1", gw) == k8s.SyncStateError {
+		t.Fatalf("SetGateway failed")
+	}
+	k.reset()
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	gotSvc := k.gotService(svc)
+	if gotSvc == nil || len(gotSvc.Status.LoadBalancer.Ingress) != 1 || gotSvc.Status.LoadBalancer.Ingress[0].IP != "1.2.3.0" {
+		t.Errorf("service didn't get the IP released by the gateway: %v", gotSvc)
+	}
+}
+
+func TestIPv6OnlyCluster(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("2001:db8::/126")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	tests := []struct {
+		desc string
+		spec v1.ServiceSpec
+		want bool
+	}{
+		{
+			desc: "cluster IP",
+			spec: v1.ServiceSpec{ClusterIP: "fd00::1"},
+			want: true,
+		},
+		{
+			desc: "IP families",
+			spec: v1.ServiceSpec{
+				ClusterIP:  "fd00::2",
+				ClusterIPs: []string{"fd00::2"},
+				IPFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			},
+			want: true,
+		},
+		{
+			desc: "IP families without cluster IP",
+			spec: v1.ServiceSpec{
+				ClusterIP:  "None",
+				IPFamilies: []v1.IPFamily{v1.IPv6Protocol},
+			},
+			want: true,
+		},
+		{
+			desc: "no cluster IP",
+			spec: v1.ServiceSpec{ClusterIP: "None"},
+		},
+		{
+			desc: "IPv4 service",
+			spec: v1.ServiceSpec{
+				ClusterIP:  "10.0.0.1",
+				IPFamilies: []v1.IPFamily{v1.IPv4Protocol},
+			},
+		},
+	}
+	for i, test := range tests {
+		k.reset()
+		name := fmt.Sprintf("default/svc%d", i)
+		test.spec.Type = "LoadBalancer"
+		svc := &v1.Service{Spec: test.spec}
+		c.SetBalancer(l, name, svc, k8s.EpsOrSlices{})
+		ip := c.ips.IP(name)
+		if got := ip != nil; got != test.want {
+			t.Errorf("%s: got IP %v, want IP %v", test.desc, ip, test.want)
+			continue
+		}
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			t.Errorf("%s: got IPv4 address %s", test.desc, ip)
+		}
+		// The status is stable across reconciles.
+		svc = k.gotService(svc)
+		if ingress := svc.Status.LoadBalancer.Ingress; len(ingress) != 1 || ingress[0].IP != ip.String() {
+			t.Errorf("%s: got status %v, want %s", test.desc, ingress, ip)
+		}
+		c.SetBalancer(l, name, svc, k8s.EpsOrSlices{})
+		if got := c.ips.IP(name); !ip.Equal(got) {
+			t.Errorf("%s: IP changed from %s to %s on reconcile", test.desc, ip, got)
+		}
+	}
+
+	// Gateways get an IPv6 address from IPv6-only pools.
+	k.reset()
+	gw := &k8s.Gateway{Namespace: "default", Name: "gw1"}
+	if c.SetGateway(l, "default/gw1", gw) == k8s.SyncStateError {
+		t.Fatal("SetGateway failed")
+	}
+	if diff := cmp.Diff([]string{"2001:db8::3"}, k.gatewayAddresses); diff != "" {
+		t.Errorf("unexpected gateway addresses (-want +got)\n%s", diff)
+	}
+}
+
+func TestIngressAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+			"other": {
+				CIDR: []*net.IPNet{ipnet("1.2.4.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	ing := &k8s.Ingress{Namespace: "default", Name: "ing1"}
+	if c.SetIngress(l, "default/ing1", ing) == k8s.SyncStateError {
+		t.Fatalf("SetIngress failed")
+	}
+	if diff := cmp.Diff([]string{"1.2.3.0"}, k.ingressAddresses); diff != "" {
+		t.Errorf("unexpected ingress addresses (-want +got)\n%s", diff)
+	}
+
+	// Converged ingress, no status write.
+	k.reset()
+	ing.Addresses = []string{"1.2.3.0"}
+	if c.SetIngress(l, "default/ing1", ing) == k8s.SyncStateError {
+		t.Fatalf("SetIngress failed")
+	}
+	if k.ingressAddresses != nil {
+		t.Errorf("converged ingress updated status to %v", k.ingressAddresses)
+	}
+
+	// Requesting another pool moves the ingress.
+	ing.Annotations = map[string]string{"metallb.universe.tf/address-pool": "other"}
+	if c.SetIngress(l, "default/ing1", ing) == k8s.SyncStateError {
+		t.Fatalf("SetIngress failed")
+	}
+	if diff := cmp.Diff([]string{"1.2.4.0"}, k.ingressAddresses); diff != "" {
+		t.Errorf("unexpected ingress addresses (-want +got)\n%s", diff)
+	}
+	ing.Addresses = k.ingressAddresses
+
+	// Deleted ingress, or of a class we don't watch anymore.
+	if c.SetIngress(l, "default/ing1", nil) != k8s.SyncStateReprocessAll {
+		t.Errorf("releasing the ingress IP didn't reprocess the services")
+	}
+	if c.ips.IP(ingressAllocKey("default/ing1")) != nil {
+		t.Errorf("deleted ingress kept its IP")
+	}
+}
+
+func TestNodeLoopbacks(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+			"loopbacks": {
+				CIDR:          []*net.IPNet{ipnet("10.255.0.0/30")},
+				NodeLoopbacks: true,
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	// An existing loopback address is kept.
+	node1 := &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:        "node1",
+		Annotations: map[string]string{k8s.NodeLoopbackAnnotation: "10.255.0.1"},
+	}}
+	if c.SetNode(l, "node1", node1) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	if k.nodeLoopbacks != nil {
+		t.Errorf("converged node updated its loopback to %v", k.nodeLoopbacks)
+	}
+
+	node2 := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node2"}}
+	if c.SetNode(l, "node2", node2) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	if diff := cmp.Diff(map[string]string{"node2": "10.255.0.0"}, k.nodeLoopbacks); diff != "" {
+		t.Errorf("unexpected node loopbacks (-want +got)\n%s", diff)
+	}
+
+	// The addresses are exported as the nodes'.
+	export, err := c.allocationsJSON()
+	if err != nil {
+		t.Fatalf("allocationsJSON failed: %s", err)
+	}
+	var exported []exportedAllocation
+	if err := json.Unmarshal([]byte(export), &exported); err != nil {
+		t.Fatalf("parsing exported allocations: %s", err)
+	}
+	wantExported := []exportedAllocation{
+		{Kind: "Node", Name: "node1", IP: "10.255.0.1", Pool: "loopbacks"},
+		{Kind: "Node", Name: "node2", IP: "10.255.0.0", Pool: "loopbacks"},
+	}
+	if diff := cmp.Diff(wantExported, exported); diff != "" {
+		t.Errorf("unexpected exported allocations (-want +got)\n%s", diff)
+	}
+
+	// Services can't use the loopbacks pool.
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{"metallb.universe.tf/address-pool": "loopbacks"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	if k.updateServiceStatus != nil && len(k.updateServiceStatus.LoadBalancer.Ingress) > 0 {
+		t.Errorf("service got an IP of the loopbacks pool: %v", k.updateServiceStatus.LoadBalancer.Ingress)
+	}
+
+	// Deleted nodes release their address.
+	if c.SetNode(l, "node1", nil) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	if c.ips.IP(nodeAllocKey("node1")) != nil {
+		t.Errorf("deleted node kept its loopback address")
+	}
+
+	// Without a loopbacks pool, the annotations go away.
+	k.nodeLoopbacks = nil
+	c = &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+	delete(cfg.Pools, "loopbacks")
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	c.MarkSynced(l)
+	node2.Annotations = map[string]string{k8s.NodeLoopbackAnnotation: "10.255.0.0"}
+	if c.SetNode(l, "node2", node2) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	if diff := cmp.Diff(map[string]string{"node2": ""}, k.nodeLoopbacks); diff != "" {
+		t.Errorf("unexpected node loopbacks (-want +got)\n%s", diff)
+	}
+}
+
+func TestSelfTestPool(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:          allocator.New(),
+		client:       k,
+		selfTestPool: "self-test",
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+			"self-test": {
+				Protocol: config.Layer2,
+				CIDR:     []*net.IPNet{ipnet("192.168.1.250/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	// Services can't get the canary, whether they ask for its pool or
+	// for the address itself.
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{"metallb.universe.tf/address-pool": "self-test"},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "10.0.0.1",
+			},
+		},
+		{
+			Spec: v1.ServiceSpec{
+				Type:           "LoadBalancer",
+				ClusterIP:      "10.0.0.1",
+				LoadBalancerIP: "192.168.1.250",
+			},
+		},
+	} {
+		k.reset()
+		if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer failed")
+		}
+		if k.updateServiceStatus != nil && len(k.updateServiceStatus.LoadBalancer.Ingress) > 0 {
+			t.Errorf("service got an IP of the self-test pool: %v", k.updateServiceStatus.LoadBalancer.Ingress)
+		}
+		if ip := c.ips.IP("test"); ip != nil {
+			t.Errorf("service kept IP %s of the self-test pool", ip)
+		}
+	}
+
+	// Neither can the other objects.
+	if c.SetGateway(l, "default/gw", &k8s.Gateway{Namespace: "default", Name: "gw", Annotations: map[string]string{"metallb.universe.tf/address-pool": "self-test"}}) == k8s.SyncStateError {
+		t.Fatalf("SetGateway failed")
+	}
+	if ip := c.ips.IP(gatewayAllocKey("default/gw")); ip != nil {
+		t.Errorf("gateway got IP %s of the self-test pool", ip)
+	}
+}
+
+func TestIPMode(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+	l := log.NewNopLogger()
+	setPools := func(ipMode string) {
+		cfg := &config.Config{
+			Pools: map[string]*config.Pool{
+				"default": {
+					Protocol:   config.Layer2,
+					AutoAssign: true,
+					IPMode:     ipMode,
+					CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+				},
+			},
+		}
+		if c.SetConfig(l, cfg) == k8s.SyncStateError {
+			t.Fatalf("SetConfig failed")
+		}
+	}
+	setPools("Proxy")
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned("1.2.3.0"),
+	}
+
+	tests := []struct {
+		desc       string
+		ipMode     string
+		wantUpdate bool
+	}{
+		{
+			desc:       "ipMode set, status unchanged",
+			ipMode:     "Proxy",
+			wantUpdate: true,
+		},
+		{
+			desc:   "ipMode already published",
+			ipMode: "Proxy",
+		},
+		{
+			desc:       "ipMode changed",
+			ipMode:     "VIP",
+			wantUpdate: true,
+		},
+		{
+			desc:       "ipMode cleared",
+			wantUpdate: true,
+		},
+		{
+			desc: "default ipMode",
+		},
+	}
+
+	for _, test := range tests {
+		setPools(test.ipMode)
+		k.reset()
+		if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("%q: SetBalancer failed", test.desc)
+		}
+		if gotUpdate := k.updateServiceStatus != nil; gotUpdate != test.wantUpdate {
+			t.Errorf("%q: got status update %v, want %v", test.desc, gotUpdate, test.wantUpdate)
+		}
+		if test.wantUpdate && k.updateIPMode != test.ipMode {
+			t.Errorf("%q: published ipMode %q, want %q", test.desc, k.updateIPMode, test.ipMode)
+		}
+	}
+}
+
+func TestAllocationAudit(t *testing.T) {
+	k := &testK8S{t: t}
+	var got []string
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+		audit: log.LoggerFunc(func(kvs ...interface{}) error {
+			got = append(got, fmt.Sprint(kvs...))
+			return nil
+		}),
+	}
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"pool1": {
+				Protocol:   config.Layer2,
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	l := log.NewNopLogger()
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	svc.Status = statusAssigned("1.2.3.0")
+	// Converging an already allocated service isn't a new decision.
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+	svc.Spec.Type = "ClusterIP"
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+
+	want := []string{
+		fmt.Sprint("event", "ipAllocated", "service", "test", "ip", "1.2.3.0", "pool", "pool1"),
+		fmt.Sprint("event", "ipReleased", "service", "test", "ip", "1.2.3.0", "pool", "pool1", "reason", "notLoadBalancer"),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected audit records (-want +got)\n%s", diff)
+	}
+}
+
+func TestAllocationLatency(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+		synced: true,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+
+	count := func() uint64 {
+		m := &dto.Metric{}
+		if err := allocationLatency.Write(m); err != nil {
+			t.Fatalf("reading histogram: %s", err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+
+	// Services whose change time is unknown aren't measured.
+	before := count()
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := count(); got != before {
+		t.Errorf("latency observed for a service with no change time")
+	}
+
+	k.changedAt = time.Now().Add(-time.Second)
+	svc.Status = *k.updateServiceStatus
+	if c.SetBalancer(l, "test", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := count(); got != before {
+		t.Errorf("latency observed for a service whose IP didn't change")
+	}
+
+	svc2 := svc.DeepCopy()
+	svc2.Status = v1.ServiceStatus{}
+	if c.SetBalancer(l, "test2", svc2, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := count(); got != before+1 {
+		t.Errorf("latency not observed for a new allocation, got %d samples want %d", got, before+1)
+	}
+}
+
+// fakeExpander implements poolExpander by recording the requests.
+type fakeExpander struct {
+	reqs []*expansionRequest
+}
+
+func (e *fakeExpander) RequestExpansion(req *expansionRequest) error {
+	e.reqs = append(e.reqs, req)
+	return nil
+}
+
+func TestPoolExpansion(t *testing.T) {
+	k := &testK8S{t: t}
+	e := &fakeExpander{}
+	c := &controller{
+		ips:                allocator.New(),
+		client:             k,
+		expander:           e,
+		expansionThreshold: 0.75,
+		configMap:          "metallb-system/config",
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/30")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	allocate := func(name string) {
+		t.Helper()
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if c.SetBalancer(l, name, svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer(%q) failed", name)
+		}
+	}
+
+	allocate("default/a")
+	allocate("default/b")
+	if len(e.reqs) != 0 {
+		t.Fatalf("expansion requested below the threshold: %v", e.reqs)
+	}
+	allocate("default/c")
+	allocate("default/d")
+	want := []*expansionRequest{
+		{
+			Pool:      "default",
+			InUse:     3,
+			Capacity:  4,
+			Addresses: []string{"1.2.3.0/30"},
+			ConfigMap: "metallb-system/config",
+			Key:       "expansion.default",
+		},
+	}
+	if diff := cmp.Diff(want, e.reqs); diff != "" {
+		t.Fatalf("wrong expansion requests (-want +got)\n%s", diff)
+	}
+
+	// Once expanded, the pool can request more when it crosses the
+	// threshold again.
+	cfg = &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/30"), ipnet("1.2.4.0/30")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	allocate("default/e")
+	if len(e.reqs) != 1 {
+		t.Fatalf("expansion requested below the threshold: %v", e.reqs)
+	}
+	allocate("default/f")
+	want = append(want, &expansionRequest{
+		Pool:      "default",
+		InUse:     6,
+		Capacity:  8,
+		Addresses: []string{"1.2.3.0/30", "1.2.4.0/30"},
+		ConfigMap: "metallb-system/config",
+		Key:       "expansion.default",
+	})
+	if diff := cmp.Diff(want, e.reqs); diff != "" {
+		t.Errorf("wrong expansion requests (-want +got)\n%s", diff)
+	}
+}
+
+func TestWebhookExpander(t *testing.T) {
+	reqs := make(chan *expansionRequest, 10)
+	var mu sync.Mutex
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req expansionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding request: %s", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		reqs <- &req
+	}))
+	defer srv.Close()
+
+	w := &webhookExpander{
+		url:           srv.URL,
+		client:        srv.Client(),
+		wake:          make(chan struct{}, 1),
+		retryInterval: 10 * time.Millisecond,
+		pending:       map[string]*expansionRequest{},
+	}
+	go w.run(log.NewNopLogger())
+
+	// The request is queued, and retried once the webhook fails.
+	want := &expansionRequest{Pool: "default", InUse: 3, Capacity: 4}
+	if err := w.RequestExpansion(want); err != nil {
+		t.Fatalf("RequestExpansion: %s", err)
+	}
+	select {
+	case got := <-reqs:
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("wrong expansion request (-want +got)\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expansion request not retried")
+	}
+}
+
+type fakeAlerter struct {
+	firing map[string]bool
+}
+
+func (f *fakeAlerter) Set(_ log.Logger, a alert.Alert, firing bool) {
+	f.firing[a.Name+"/"+a.Labels["pool"]] = firing
+}
+
+func TestPoolExhaustedAlert(t *testing.T) {
+	k := &testK8S{t: t}
+	a := &fakeAlerter{firing: map[string]bool{}}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+		alerts: a,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	setBalancer := func(name string, lb bool) {
+		t.Helper()
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if !lb {
+			svc.Spec.Type = "ClusterIP"
+		}
+		if c.SetBalancer(l, name, svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer(%q) failed", name)
+		}
+	}
+	check := func(desc string, want bool) {
+		t.Helper()
+		if got := a.firing["MetalLBPoolExhausted/default"]; got != want {
+			t.Fatalf("%s: got exhausted alert firing %v, want %v", desc, got, want)
+		}
+	}
+
+	setBalancer("default/a", true)
+	check("one free address", false)
+	setBalancer("default/b", true)
+	check("no free address", true)
+	setBalancer("default/b", false)
+	check("address released", false)
+
+	// Removing the pool resolves its alert. Pools in use can't be
+	// removed, so pretend the alert is still firing.
+	setBalancer("default/a", false)
+	a.firing["MetalLBPoolExhausted/default"] = true
+	c.exhausted["default"] = true
+	if c.SetConfig(l, &config.Config{Pools: map[string]*config.Pool{}}) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+	check("pool removed", false)
+}
+
+func TestAllocationTTL(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+			Annotations: map[string]string{
+				allocationTTLAnnotation: "2h",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+
+	// Not expired yet, allocate and check again at expiry.
+	if c.SetBalancer(l, "default/preview", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	if ingressIP(svc) != "1.2.3.0" {
+		t.Fatalf("service didn't get an IP before expiry, status %v", svc.Status)
+	}
+	if d := k.syncAfter["default/preview"]; d < 59*time.Minute || d > time.Hour {
+		t.Errorf("service requeued after %s, want about 1h", d)
+	}
+
+	// Expired, release the IP and set the condition.
+	svc.CreationTimestamp = metav1.NewTime(time.Now().Add(-3 * time.Hour))
+	k.reset()
+	if c.SetBalancer(l, "default/preview", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	if svc == nil {
+		t.Fatal("status not updated on expiry")
+	}
+	if ingressIP(svc) != "" || c.ips.IP("default/preview") != nil {
+		t.Errorf("IP not released on expiry, status %v", svc.Status)
+	}
+	if cond := meta.FindStatusCondition(svc.Status.Conditions, expiredCondition); cond == nil || cond.Status != metav1.ConditionTrue {
+		t.Errorf("expired condition not set, conditions %v", svc.Status.Conditions)
+	}
+	if c.pending["default/preview"] {
+		t.Error("expired service waiting for an IP")
+	}
+
+	// Reprocessing an expired service changes nothing.
+	k.reset()
+	if c.SetBalancer(l, "default/preview", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := k.gotService(svc); got != nil {
+		t.Errorf("expired service updated again, status %v", got.Status)
+	}
+
+	// Removing the TTL revives the service.
+	delete(svc.Annotations, allocationTTLAnnotation)
+	k.reset()
+	if c.SetBalancer(l, "default/preview", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	if ingressIP(svc) == "" {
+		t.Errorf("service without TTL didn't get an IP, status %v", svc.Status)
+	}
+	if len(svc.Status.Conditions) != 0 {
+		t.Errorf("expired condition not cleared, conditions %v", svc.Status.Conditions)
+	}
+}
+
+func TestNamespaceDefaultPool(t *testing.T) {
+	k := &testK8S{
+		t: t,
+		defaultPools: map[string]string{
+			"preview": "cheap",
+		},
+	}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+			},
+			"cheap": {
+				AutoAssign: false,
+				CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+			},
+			"expensive": {
+				AutoAssign: false,
+				CIDR:       []*net.IPNet{ipnet("4.5.6.0/24")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	tests := []struct {
+		desc      string
+		namespace string
+		pool      string
+		wantPool  string
+	}{
+		{
+			desc:      "namespace without a default pool",
+			namespace: "prod",
+			wantPool:  "default",
+		},
+		{
+			desc:      "namespace default pool",
+			namespace: "preview",
+			wantPool:  "cheap",
+		},
+		{
+			desc:      "service overrides the namespace default pool",
+			namespace: "preview",
+			pool:      "expensive",
+			wantPool:  "expensive",
+		},
+	}
+	for i, test := range tests {
+		key := fmt.Sprintf("%s/svc%d", test.namespace, i)
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   test.namespace,
+				Annotations: map[string]string{},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if test.pool != "" {
+			svc.Annotations["metallb.universe.tf/address-pool"] = test.pool
+		}
+		if c.SetBalancer(l, key, svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		if got := c.ips.Pool(key); got != test.wantPool {
+			t.Errorf("%s: got IP from pool %q, want %q", test.desc, got, test.wantPool)
+		}
+	}
+
+	// Changing the default pool doesn't move existing services.
+	k.defaultPools["preview"] = "expensive"
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "preview",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+		Status: statusAssigned(c.ips.IP("preview/svc1").String()),
+	}
+	if c.SetBalancer(l, "preview/svc1", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := c.ips.Pool("preview/svc1"); got != "cheap" {
+		t.Errorf("service moved to pool %q when the namespace default changed", got)
+	}
+}
+
+func TestPrefixAllocation(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/29")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	newSvc := func(prefixLength string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Annotations: map[string]string{
+					prefixLengthAnnotation: prefixLength,
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+	}
+
+	tests := []struct {
+		desc         string
+		svc          string
+		prefixLength string
+		want         string
+		// The address block published for the speakers.
+		wantBlock string
+	}{
+		{
+			desc: "single IP",
+			svc:  "default/single",
+			want: "1.2.3.0",
+		},
+		{
+			desc:         "prefix skips used addresses",
+			svc:          "default/rtp",
+			prefixLength: "31",
+			want:         "1.2.3.2",
+			wantBlock:    "1.2.3.2/31",
+		},
+		{
+			desc: "prefix addresses are reserved",
+			svc:  "default/other",
+			want: "1.2.3.1",
+		},
+		{
+			desc:         "larger prefix",
+			svc:          "default/sip",
+			prefixLength: "30",
+			want:         "1.2.3.4",
+			wantBlock:    "1.2.3.4/30",
+		},
+		{
+			desc:         "no prefix left",
+			svc:          "default/full",
+			prefixLength: "31",
+		},
+	}
+	for _, test := range tests {
+		k.reset()
+		svc := newSvc(test.prefixLength)
+		if c.SetBalancer(l, test.svc, svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		got := ""
+		if ip := c.ips.IP(test.svc); ip != nil {
+			got = ip.String()
+		}
+		if got != test.want {
+			t.Errorf("%s: got IP %q, want %q", test.desc, got, test.want)
+		}
+		gotBlock := ""
+		if gotSvc := k.gotService(svc); gotSvc != nil {
+			if cond := meta.FindStatusCondition(gotSvc.Status.Conditions, k8s.AddressBlockCondition); cond != nil {
+				gotBlock = cond.Message
+			}
+		}
+		if gotBlock != test.wantBlock {
+			t.Errorf("%s: got address block %q, want %q", test.desc, gotBlock, test.wantBlock)
+		}
+	}
+
+	// A single service can't take the other addresses of a prefix.
+	svc := newSvc("")
+	svc.Spec.LoadBalancerIP = "1.2.3.3"
+	c.SetBalancer(l, "default/steal", svc, k8s.EpsOrSlices{})
+	if ip := c.ips.IP("default/steal"); ip != nil {
+		t.Errorf("service got %s, in the prefix of another service", ip)
+	}
+
+	// Conflicting annotations are rejected.
+	svc = newSvc("31")
+	svc.Annotations[blockAnnotation] = "frontend/29"
+	c.SetBalancer(l, "default/conflict", svc, k8s.EpsOrSlices{})
+	if ip := c.ips.IP("default/conflict"); ip != nil {
+		t.Errorf("service with conflicting annotations got %s", ip)
+	}
+}
+
+func TestExtraPrefixes(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/28")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	newSvc := func(ip, extra string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Annotations: map[string]string{extraPrefixesAnnotation: extra},
+			},
+			Spec: v1.ServiceSpec{
+				Type:           "LoadBalancer",
+				ClusterIP:      "1.2.3.4",
+				LoadBalancerIP: ip,
+			},
+		}
+	}
+
+	tests := []struct {
+		desc  string
+		svc   string
+		ip    string
+		extra string
+		// The reserved extra prefixes, "" for none.
+		want string
+	}{
+		{
+			desc:  "free prefixes",
+			svc:   "default/sip",
+			ip:    "1.2.3.0",
+			extra: "1.2.3.8/30, 1.2.3.12/31",
+			want:  "1.2.3.8/30,1.2.3.12/31",
+		},
+		{
+			desc:  "prefix reserved by another service",
+			svc:   "default/other",
+			ip:    "1.2.3.1",
+			extra: "1.2.3.8/29",
+		},
+		{
+			desc:  "prefix outside of the pool",
+			svc:   "default/other",
+			ip:    "1.2.3.1",
+			extra: "1.2.4.0/30",
+		},
+		{
+			desc:  "invalid prefix",
+			svc:   "default/other",
+			ip:    "1.2.3.1",
+			extra: "media",
+		},
+		{
+			desc:  "prefix holding another service's IP",
+			svc:   "default/other",
+			ip:    "1.2.3.1",
+			extra: "1.2.3.0/31",
+		},
+		{
+			desc: "no extra prefixes",
+			svc:  "default/sip",
+			ip:   "1.2.3.0",
+		},
+	}
+	for _, test := range tests {
+		k.reset()
+		svc := newSvc(test.ip, test.extra)
+		if c.SetBalancer(l, test.svc, svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		gotSvc := k.gotService(svc)
+		if gotSvc == nil || k8s.LoadBalancerIP(gotSvc).String() != test.ip {
+			t.Fatalf("%s: service didn't get IP %s", test.desc, test.ip)
+		}
+		got := ""
+		if cond := meta.FindStatusCondition(gotSvc.Status.Conditions, k8s.ExtraPrefixesCondition); cond != nil {
+			got = cond.Message
+		}
+		if got != test.want {
+			t.Errorf("%s: got reserved prefixes %q, want %q", test.desc, got, test.want)
+		}
+		if (test.want == "" && test.extra != "") != k.loggedWarning {
+			t.Errorf("%s: got warning %v", test.desc, k.loggedWarning)
+		}
+	}
+
+	// Once released, the prefixes are free for others.
+	svc := newSvc("1.2.3.9", "")
+	c.SetBalancer(l, "default/third", svc, k8s.EpsOrSlices{})
+	if ip := c.ips.IP("default/third"); ip == nil {
+		t.Error("service didn't get an IP of the released extra prefixes")
+	}
+}
+
+// fakePolicy decides on allocations with a function.
+type fakePolicy func(*allocator.PolicyRequest) (*allocator.PolicyDecision, error)
+
+func (f fakePolicy) Review(req *allocator.PolicyRequest) (*allocator.PolicyDecision, error) {
+	return f(req)
+}
+
+func TestAllocationPolicy(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+			},
+			"finance": {
+				CIDR: []*net.IPNet{ipnet("4.5.6.0/24")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	tests := []struct {
+		desc     string
+		decision *allocator.PolicyDecision
+		err      error
+		want     string
+	}{
+		{
+			desc:     "allowed",
+			decision: &allocator.PolicyDecision{Allowed: true},
+			want:     "1.2.3.0",
+		},
+		{
+			desc:     "denied",
+			decision: &allocator.PolicyDecision{Reason: "no cost center"},
+		},
+		{
+			desc: "policy failure",
+			err:  errors.New("connection refused"),
+		},
+		{
+			desc:     "other IP",
+			decision: &allocator.PolicyDecision{Allowed: true, IP: "1.2.3.42"},
+			want:     "1.2.3.42",
+		},
+		{
+			desc:     "other pool",
+			decision: &allocator.PolicyDecision{Allowed: true, Pool: "finance"},
+			want:     "4.5.6.0",
+		},
+		{
+			desc:     "invalid IP",
+			decision: &allocator.PolicyDecision{Allowed: true, IP: "4.5.6"},
+		},
+	}
+	for i, test := range tests {
+		key := fmt.Sprintf("default/svc%d", i)
+		var got *allocator.PolicyRequest
+		c.policy = fakePolicy(func(req *allocator.PolicyRequest) (*allocator.PolicyDecision, error) {
+			got = req
+			return test.decision, test.err
+		})
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Labels:    map[string]string{"cost-center": "42"},
+			},
+			Spec: v1.ServiceSpec{
+				Type:      "LoadBalancer",
+				ClusterIP: "1.2.3.4",
+			},
+		}
+		if c.SetBalancer(l, key, svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		wantReq := &allocator.PolicyRequest{
+			Service: key,
+			Labels:  map[string]string{"cost-center": "42"},
+			IP:      "1.2.3.0",
+			Pool:    "default",
+		}
+		if diff := cmp.Diff(wantReq, got); diff != "" {
+			t.Errorf("%s: unexpected policy request (-want +got)\n%s", test.desc, diff)
+		}
+		ip := ""
+		if c.ips.IP(key) != nil {
+			ip = c.ips.IP(key).String()
+		}
+		if ip != test.want {
+			t.Errorf("%s: got IP %q, want %q", test.desc, ip, test.want)
+		}
+		if test.want != "" {
+			c.ips.Unassign(key)
+		}
+	}
+}
+
+func TestIPClaims(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:      allocator.New(),
+		client:   k,
+		ipClaims: true,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web",
+		},
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "1.2.3.4",
+		},
+	}
+
+	// Rejected claims fail the allocation.
+	k.rejectClaims = true
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if ip := c.ips.IP("default/web"); ip != nil {
+		t.Errorf("service got %s without an admitted claim", ip)
+	}
+	if k.updateServiceStatus != nil && len(k.updateServiceStatus.LoadBalancer.Ingress) > 0 {
+		t.Errorf("published %v without an admitted claim", k.updateServiceStatus.LoadBalancer.Ingress)
+	}
+
+	// Admitted claims let it through.
+	k.rejectClaims = false
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if diff := cmp.Diff(map[string]string{"default/web": "1.2.3.0"}, k.ipClaims); diff != "" {
+		t.Errorf("unexpected IP claims (-want +got)\n%s", diff)
+	}
+
+	// Releasing the IP deletes the claim.
+	if c.SetBalancer(l, "default/web", nil, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if len(k.ipClaims) != 0 {
+		t.Errorf("IP claims left after deleting the service: %v", k.ipClaims)
+	}
+}
+
+func TestDualStackPrimaryFamily(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:    allocator.New(),
+		client: k,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31"), ipnet("1000::/127")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:       "LoadBalancer",
+			ClusterIP:  "2000::1",
+			ClusterIPs: []string{"2000::1", "10.0.0.1"},
+			IPFamilies: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+		},
+	}
+	if c.SetBalancer(l, "default/dual", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	want := []v1.LoadBalancerIngress{{IP: "1000::"}}
+	if diff := cmp.Diff(want, svc.Status.LoadBalancer.Ingress); diff != "" {
+		t.Fatalf("ingress not of the primary family (-want +got)\n%s", diff)
+	}
+
+	for i := 0; i < 3; i++ {
+		k.reset()
+		if c.SetBalancer(l, "default/dual", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatal("SetBalancer failed")
+		}
+		if got := k.gotService(svc); got != nil {
+			t.Fatalf("ingress changed on reconcile %d: %v", i, got.Status.LoadBalancer.Ingress)
+		}
+	}
+
+	// An extra entry of the other family, listed first, doesn't
+	// change the allocation, and is dropped once.
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "1.2.3.0"}, {IP: "1000::"}}
+	k.reset()
+	if c.SetBalancer(l, "default/dual", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := c.ips.IP("default/dual"); !got.Equal(net.ParseIP("1000::")) {
+		t.Fatalf("allocation changed to %s with reordered ingress", got)
+	}
+	svc = k.gotService(svc)
+	if diff := cmp.Diff(want, svc.Status.LoadBalancer.Ingress); diff != "" {
+		t.Fatalf("extra ingress entry not dropped (-want +got)\n%s", diff)
+	}
+	k.reset()
+	if c.SetBalancer(l, "default/dual", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := k.gotService(svc); got != nil {
+		t.Fatalf("ingress changed after dropping the extra entry: %v", got.Status.LoadBalancer.Ingress)
+	}
+}
+
+type fakeCleanup struct {
+	svcs     []*v1.Service
+	released []string
+}
+
+func (f *fakeCleanup) ManagedServices(lbClass string) ([]*v1.Service, error) {
+	var ret []*v1.Service
+	for _, svc := range f.svcs {
+		if k8s.LoadBalancerClass(svc) == lbClass {
+			ret = append(ret, svc)
+		}
+	}
+	return ret, nil
+}
+
+func (f *fakeCleanup) ReleaseService(svc *v1.Service) error {
+	f.released = append(f.released, svc.Namespace+"/"+svc.Name)
+	return nil
+}
+
+func TestCleanup(t *testing.T) {
+	d := &fakeDNS{records: map[string]string{
+		"web.default.lb.example.com": "1.2.3.0",
+		"db.default.lb.example.com":  "1.2.3.1",
+	}}
+	c := &controller{dns: d}
+	svc := func(name, ip string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: v1.ServiceSpec{
+				Type: "LoadBalancer",
+			},
+			Status: statusAssigned(ip),
+		}
+	}
+	f := &fakeCleanup{svcs: []*v1.Service{svc("web", "1.2.3.0"), svc("db", "1.2.3.1")}}
+
+	l := log.NewNopLogger()
+	d.fail = true
+	if err := c.cleanup(l, f); err == nil {
+		t.Fatal("cleanup didn't fail when the DNS updates failed")
+	}
+	if len(f.released) != 0 {
+		t.Fatalf("services %v released before their DNS records were removed", f.released)
+	}
+
+	d.fail = false
+	if err := c.cleanup(l, f); err != nil {
+		t.Fatalf("cleanup failed: %s", err)
+	}
+	if diff := cmp.Diff([]string{"default/web", "default/db"}, f.released); diff != "" {
+		t.Errorf("wrong released services (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{}, d.records); diff != "" {
+		t.Errorf("DNS records left behind (-want +got)\n%s", diff)
+	}
+}
+
+func TestTypeChangeGrace(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:             allocator.New(),
+		client:          k,
+		typeChangeGrace: time.Hour,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.1",
+		},
+	}
+	setType := func(typ v1.ServiceType) {
+		t.Helper()
+		if got := k.gotService(svc); got != nil {
+			svc = got
+		}
+		k.reset()
+		svc.Spec.Type = typ
+		if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer to %s failed", typ)
+		}
+	}
+
+	// Take the first IP, so that a release would make it the next
+	// one allocated.
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	ip := c.ips.IP("default/web")
+	if ip == nil {
+		t.Fatal("service didn't get an IP")
+	}
+
+	setType("NodePort")
+	if got := k.gotService(svc); got == nil || len(got.Status.LoadBalancer.Ingress) != 0 {
+		t.Fatal("NodePort service kept its status")
+	}
+	if !ip.Equal(c.ips.IP("default/web")) {
+		t.Fatal("IP released during the grace period")
+	}
+	if meta.FindStatusCondition(k.gotService(svc).Status.Conditions, k8s.IPHeldCondition) == nil {
+		t.Error("service holding an IP has no IPHeld condition")
+	}
+	if d := k.syncAfter["default/web"]; d < 59*time.Minute || d > time.Hour {
+		t.Errorf("got resync after %s, want the grace period", d)
+	}
+
+	// Another service can't take the held IP.
+	svc = k.gotService(svc)
+	k.reset()
+	other := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.2",
+		},
+	}
+	if c.SetBalancer(l, "default/other", other, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if got := c.ips.IP("default/other"); got == nil || got.Equal(ip) {
+		t.Fatalf("other service got IP %v, want another one than the held %s", got, ip)
+	}
+	c.SetBalancer(l, "default/other", nil, k8s.EpsOrSlices{})
+	k.reset()
+
+	setType("LoadBalancer")
+	got := k.gotService(svc)
+	if got == nil || len(got.Status.LoadBalancer.Ingress) != 1 || got.Status.LoadBalancer.Ingress[0].IP != ip.String() {
+		t.Fatalf("LoadBalancer service got status %v, want the held IP %s", got, ip)
+	}
+	if _, held := c.held["default/web"]; held {
+		t.Error("IP still held after the service got it back")
+	}
+	if meta.FindStatusCondition(got.Status.Conditions, k8s.IPHeldCondition) != nil {
+		t.Error("IPHeld condition kept after the service got its IP back")
+	}
+
+	// Past the grace period, the IP is released.
+	setType("NodePort")
+	c.held["default/web"] = time.Now().Add(-time.Second)
+	setType("NodePort")
+	if got := c.ips.IP("default/web"); got != nil {
+		t.Errorf("IP %s still allocated after the grace period", got)
+	}
+	if _, held := c.held["default/web"]; held {
+		t.Error("IP still held after the grace period")
+	}
+	if got := k.gotService(svc); got == nil || meta.FindStatusCondition(got.Status.Conditions, k8s.IPHeldCondition) != nil {
+		t.Error("IPHeld condition kept after the grace period")
+	}
+}
+
+func TestStatusConflict(t *testing.T) {
+	k := &testK8S{t: t}
+	c := &controller{
+		ips:          allocator.New(),
+		client:       k,
+		fieldManager: processName,
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"default": {
+				AutoAssign: true,
+				CIDR:       []*net.IPNet{ipnet("1.2.3.0/32")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatal("SetConfig failed")
+	}
+	c.MarkSynced(l)
+
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:      "LoadBalancer",
+			ClusterIP: "10.0.0.1",
+		},
+	}
+	if c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	svc = k.gotService(svc)
+	if c.ips.IP("default/web") == nil || svc == nil {
+		t.Fatal("service didn't get an IP")
+	}
+
+	manager := func(name string, at time.Time) metav1.ManagedFieldsEntry {
+		return metav1.ManagedFieldsEntry{
+			Manager:  name,
+			Time:     &metav1.Time{Time: at},
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:status":{"f:loadBalancer":{"f:ingress":{}}}}`)},
+		}
+	}
+	now := time.Now()
+
+	// Another controller co-owning our status isn't a conflict.
+	k.reset()
+	svc.ManagedFields = []metav1.ManagedFieldsEntry{manager(processName, now), manager("other-lb", now.Add(time.Minute))}
+	c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{})
+	if k.loggedWarning || c.ips.IP("default/web") == nil {
+		t.Fatal("co-owned status treated as a conflict")
+	}
+
+	// It overwrites the IP with an update, which takes the ingress
+	// fields away from our apply: the cache only keeps its entry.
+	k.reset()
+	svc.Status = statusAssigned("5.6.7.8")
+	svc.ManagedFields = []metav1.ManagedFieldsEntry{manager("other-lb", now.Add(2*time.Minute))}
+	svc.ManagedFields[0].Operation = metav1.ManagedFieldsOperationUpdate
+	c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{})
+	if !k.loggedWarning {
+		t.Error("no warning for the conflict")
+	}
+	if got := c.ips.IP("default/web"); got != nil {
+		t.Errorf("service kept IP %s in conflict", got)
+	}
+	if k.gotService(svc) != nil {
+		t.Error("status written in conflict")
+	}
+
+	// Reconciles don't fight, nor warn again.
+	k.reset()
+	c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{})
+	if k.loggedWarning || k.gotService(svc) != nil || c.ips.IP("default/web") != nil {
+		t.Error("service managed again while still in conflict")
+	}
+
+	// The other controller is gone, and its status cleared.
+	k.reset()
+	svc.Status = v1.ServiceStatus{}
+	svc.ManagedFields = []metav1.ManagedFieldsEntry{manager(processName, now)}
+	c.SetBalancer(l, "default/web", svc, k8s.EpsOrSlices{})
+	if got := k.gotService(svc); got == nil || k8s.LoadBalancerIP(got) == nil {
+		t.Error("service not managed again after the conflict")
+	}
+}
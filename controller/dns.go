@@ -0,0 +1,154 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+)
+
+// dnsUpdater publishes DNS records for the allocated IPs.
+type dnsUpdater interface {
+	Zone() string
+	Set(name string, ip net.IP) error
+	Delete(name string, ip net.IP) error
+}
+
+// dnsRecord is the DNS record published for a service.
+type dnsRecord struct {
+	name string
+	ip   net.IP
+}
+
+// dnsRetryInterval is how long to wait before retrying to remove the
+// DNS record of a service that released its IP.
+const dnsRetryInterval = 30 * time.Second
+
+// dnsName returns the DNS name to publish for the service key: its
+// hostname annotation if it is in the zone, <name>.<namespace>.<zone>
+// otherwise.
+func (c *controller) dnsName(key string, svc *v1.Service) string {
+	zone := strings.TrimSuffix(strings.ToLower(c.dns.Zone()), ".")
+	if hostname := strings.ToLower(svc.Annotations[hostnameAnnotation]); hostname == zone || strings.HasSuffix(hostname, "."+zone) {
+		return hostname
+	}
+	namespace, name := "default", key
+	if i := strings.Index(key, "/"); i >= 0 {
+		namespace, name = key[:i], key[i+1:]
+	}
+	return name + "." + namespace + "." + zone
+}
+
+// updateDNS converges the DNS record of the service key to the IP it
+// was allocated, if DNS updates are enabled.
+func (c *controller) updateDNS(l log.Logger, key string, svc *v1.Service) error {
+	if c.dns == nil {
+		return nil
+	}
+	var want dnsRecord
+	// Held IPs aren't published until the service gets them back.
+	if _, held := c.held[key]; !held {
+		if ip := c.ips.IP(key); ip != nil {
+			want = dnsRecord{c.dnsName(key, svc), ip}
+		}
+	}
+	have := c.dnsRecords[key]
+	if have.name == want.name && have.ip.Equal(want.ip) {
+		return nil
+	}
+
+	if have.name != "" {
+		if err := c.deleteDNS(l, key); err != nil {
+			return err
+		}
+	}
+	if want.name == "" {
+		return nil
+	}
+	if err := c.dns.Set(want.name, want.ip); err != nil {
+		return err
+	}
+	if c.dnsRecords == nil {
+		c.dnsRecords = map[string]dnsRecord{}
+	}
+	c.dnsRecords[key] = want
+	c.saveDNSRecords(l)
+	level.Info(l).Log("event", "dnsUpdated", "name", want.name, "ip", want.ip, "msg", "published DNS record")
+	return nil
+}
+
+// deleteDNS removes the DNS record of the service key, if any.
+func (c *controller) deleteDNS(l log.Logger, key string) error {
+	have, ok := c.dnsRecords[key]
+	if c.dns == nil || !ok {
+		return nil
+	}
+	if err := c.dns.Delete(have.name, have.ip); err != nil {
+		return err
+	}
+	delete(c.dnsRecords, key)
+	c.saveDNSRecords(l)
+	level.Info(l).Log("event", "dnsDeleted", "name", have.name, "ip", have.ip, "msg", "removed DNS record")
+	return nil
+}
+
+// retryDeleteDNS removes the DNS record of the service key, if any,
+// and reprocesses the service later to try again if that fails. The
+// IP of the service is released regardless, a stale record is less
+// harmful than a stuck IP.
+func (c *controller) retryDeleteDNS(l log.Logger, key string) {
+	if err := c.deleteDNS(l, key); err != nil {
+		level.Error(l).Log("op", "deleteDNS", "error", err, "msg", "failed to remove DNS record, will retry")
+		c.client.SyncAfter(key, dnsRetryInterval)
+	}
+}
+
+// saveDNSRecords stores the published DNS records in the ConfigMap
+// dnsStore, if set, so that a restarted controller still knows them.
+// Service keys become <namespace>.<name>, namespaces have no dots.
+func (c *controller) saveDNSRecords(l log.Logger) {
+	if c.dnsStore == "" {
+		return
+	}
+	data := map[string]string{}
+	for key, r := range c.dnsRecords {
+		data[strings.Replace(key, "/", ".", 1)] = r.name + " " + r.ip.String()
+	}
+	parts := strings.SplitN(c.dnsStore, "/", 2)
+	if err := c.client.ApplyConfigMap(parts[0], parts[1], data); err != nil {
+		level.Error(l).Log("op", "saveDNSRecords", "error", err, "msg", "failed to save the DNS records")
+	}
+}
+
+// loadDNSRecords restores the DNS records saved by saveDNSRecords,
+// from the data of the ConfigMap dnsStore. The services of the
+// restored records are reprocessed once synced, so that the records
+// of the services deleted in the meantime are removed.
+func (c *controller) loadDNSRecords(l log.Logger, data map[string]string) {
+	for k, v := range data {
+		fields := strings.Fields(v)
+		if len(fields) != 2 || net.ParseIP(fields[1]) == nil {
+			level.Warn(l).Log("op", "loadDNSRecords", "service", k, "record", v, "msg", "ignoring invalid saved DNS record")
+			continue
+		}
+		if c.dnsRecords == nil {
+			c.dnsRecords = map[string]dnsRecord{}
+		}
+		c.dnsRecords[strings.Replace(k, ".", "/", 1)] = dnsRecord{fields[0], net.ParseIP(fields[1])}
+	}
+}
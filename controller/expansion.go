@@ -0,0 +1,189 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// expansionRequest asks an external system to provision more
+// addresses for a pool that is running out.
+type expansionRequest struct {
+	Pool      string   `json:"pool"`
+	InUse     int64    `json:"inUse"`
+	Capacity  int64    `json:"capacity"`
+	Addresses []string `json:"addresses"`
+	// Where to add the new addresses: the config ConfigMap, as
+	// namespace/name, and the key in its data.
+	ConfigMap string `json:"configMap"`
+	Key       string `json:"key"`
+}
+
+// poolExpander sends expansion requests.
+type poolExpander interface {
+	RequestExpansion(req *expansionRequest) error
+}
+
+// expansionRetryInterval is how long the webhookExpander waits to
+// send failed requests again, by default.
+const expansionRetryInterval = 30 * time.Second
+
+// webhookExpander POSTs expansion requests, as JSON, to a URL. The
+// requests are sent in the background, so that a slow webhook
+// doesn't hold up the processing of services, and retried until they
+// succeed.
+type webhookExpander struct {
+	url    string
+	client *http.Client
+	wake   chan struct{}
+	// How long to wait to send failed requests again.
+	retryInterval time.Duration
+
+	mu sync.Mutex
+	// The requests to send, by pool. A new request of a pool
+	// replaces the one waiting to be sent.
+	pending map[string]*expansionRequest
+}
+
+func newWebhookExpander(l log.Logger, url string) *webhookExpander {
+	w := &webhookExpander{
+		url:           url,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		wake:          make(chan struct{}, 1),
+		retryInterval: expansionRetryInterval,
+		pending:       map[string]*expansionRequest{},
+	}
+	go w.run(l)
+	return w
+}
+
+// RequestExpansion queues req to be sent, and returns immediately.
+func (w *webhookExpander) RequestExpansion(req *expansionRequest) error {
+	w.mu.Lock()
+	w.pending[req.Pool] = req
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run sends the queued requests, and retries the failed ones every
+// retryInterval.
+func (w *webhookExpander) run(l log.Logger) {
+	retry := time.NewTimer(w.retryInterval)
+	retry.Stop()
+	for {
+		select {
+		case <-w.wake:
+		case <-retry.C:
+		}
+		w.mu.Lock()
+		reqs := w.pending
+		w.pending = map[string]*expansionRequest{}
+		w.mu.Unlock()
+
+		failed := false
+		for pool, req := range reqs {
+			err := w.post(req)
+			if err == nil {
+				level.Info(l).Log("event", "poolExpansionSent", "pool", pool, "msg", "sent pool expansion request")
+				continue
+			}
+			level.Error(l).Log("op", "requestExpansion", "pool", pool, "error", err, "msg", "failed to request pool expansion, will retry")
+			failed = true
+			w.mu.Lock()
+			if w.pending[pool] == nil {
+				w.pending[pool] = req
+			}
+			w.mu.Unlock()
+		}
+		if failed {
+			retry.Reset(w.retryInterval)
+		}
+	}
+}
+
+// post sends req to the webhook.
+func (w *webhookExpander) post(req *expansionRequest) error {
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", w.url, resp.Status)
+	}
+	return nil
+}
+
+// requestExpansions sends an expansion request for the pools whose
+// usage crossed the expansion threshold. A pool gets one request per
+// capacity: once the new addresses are merged into it, it can
+// request more when it crosses the threshold again. The expander
+// retries the requests it fails to send.
+func (c *controller) requestExpansions(l log.Logger) {
+	if c.expander == nil || c.config == nil || !c.synced {
+		return
+	}
+	names := make([]string, 0, len(c.config.Pools))
+	for n := range c.config.Pools {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		inUse, capacity := c.ips.Usage(n)
+		if capacity == 0 || float64(inUse) < c.expansionThreshold*float64(capacity) {
+			delete(c.expansionRequested, n)
+			continue
+		}
+		if c.expansionRequested[n] == capacity {
+			continue
+		}
+		req := &expansionRequest{
+			Pool:      n,
+			InUse:     inUse,
+			Capacity:  capacity,
+			ConfigMap: c.configMap,
+			Key:       k8s.PoolExpansionKey(n),
+		}
+		for _, cidr := range c.config.Pools[n].CIDR {
+			req.Addresses = append(req.Addresses, cidr.String())
+		}
+		if err := c.expander.RequestExpansion(req); err != nil {
+			level.Error(l).Log("op", "requestExpansion", "pool", n, "error", err, "msg", "failed to request pool expansion")
+			continue
+		}
+		if c.expansionRequested == nil {
+			c.expansionRequested = map[string]int64{}
+		}
+		c.expansionRequested[n] = capacity
+		level.Info(l).Log("event", "poolExpansionRequested", "pool", n, "inUse", inUse, "capacity", capacity, "msg", "pool is running out of addresses, requested an expansion")
+	}
+}
@@ -0,0 +1,223 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// exportKey is the key of the allocations in the export ConfigMap,
+// and generationKey the key of their exported generation.
+const (
+	exportKey     = "allocations.json"
+	generationKey = "generation"
+)
+
+// exportedAllocation is the exported form of an allocation.
+type exportedAllocation struct {
+	Kind       string   `json:"kind"`
+	Name       string   `json:"name"`
+	IP         string   `json:"ip"`
+	Pool       string   `json:"pool"`
+	SharingKey string   `json:"sharingKey,omitempty"`
+	Ports      []string `json:"ports,omitempty"`
+	// The metadata of the pool.
+	PoolDescription string `json:"poolDescription,omitempty"`
+	ReverseDNSZone  string `json:"reverseDNSZone,omitempty"`
+	Owner           string `json:"owner,omitempty"`
+}
+
+// The annotations of the allocation events carrying the pool of the
+// address and its metadata.
+const (
+	poolAnnotation            = "metallb.universe.tf/pool"
+	poolDescriptionAnnotation = "metallb.universe.tf/pool-description"
+	reverseDNSZoneAnnotation  = "metallb.universe.tf/reverse-dns-zone"
+	ownerAnnotation           = "metallb.universe.tf/pool-owner"
+)
+
+// poolAnnotations returns the annotations of the allocation events
+// for addresses of pool name.
+func poolAnnotations(name string, pool *config.Pool) map[string]string {
+	ret := map[string]string{poolAnnotation: name}
+	if pool == nil {
+		return ret
+	}
+	for k, v := range map[string]string{
+		poolDescriptionAnnotation: pool.Description,
+		reverseDNSZoneAnnotation:  pool.ReverseDNSZone,
+		ownerAnnotation:           pool.Owner,
+	} {
+		if v != "" {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// poolSummary returns the metadata of pool for event messages, or ""
+// if it has none.
+func poolSummary(pool *config.Pool) string {
+	if pool == nil {
+		return ""
+	}
+	var parts []string
+	if pool.Description != "" {
+		parts = append(parts, pool.Description)
+	}
+	if pool.ReverseDNSZone != "" {
+		parts = append(parts, "reverse DNS zone "+pool.ReverseDNSZone)
+	}
+	if pool.Owner != "" {
+		parts = append(parts, "owner "+pool.Owner)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, "; ") + ")"
+}
+
+// allocationsJSON returns the allocator state in its exported form.
+func (c *controller) allocationsJSON() (string, error) {
+	allocs := c.ips.Allocations()
+	ret := make([]exportedAllocation, 0, len(allocs))
+	for _, a := range allocs {
+		e := exportedAllocation{
+			Kind:       "Service",
+			Name:       a.Service,
+			IP:         a.IP.String(),
+			Pool:       a.Pool,
+			SharingKey: a.SharingKey,
+		}
+		switch {
+		case strings.HasPrefix(a.Service, gatewayAllocKey("")):
+			e.Kind, e.Name = "Gateway", strings.TrimPrefix(a.Service, gatewayAllocKey(""))
+		case strings.HasPrefix(a.Service, ingressAllocKey("")):
+			e.Kind, e.Name = "Ingress", strings.TrimPrefix(a.Service, ingressAllocKey(""))
+		case strings.HasPrefix(a.Service, nodeAllocKey("")):
+			e.Kind, e.Name = "Node", strings.TrimPrefix(a.Service, nodeAllocKey(""))
+		}
+		for _, p := range a.Ports {
+			e.Ports = append(e.Ports, p.String())
+		}
+		if c.config != nil && c.config.Pools[a.Pool] != nil {
+			pool := c.config.Pools[a.Pool]
+			e.PoolDescription, e.ReverseDNSZone, e.Owner = pool.Description, pool.ReverseDNSZone, pool.Owner
+		}
+		ret = append(ret, e)
+	}
+	bs, err := json.MarshalIndent(ret, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// exportAllocations mirrors the allocator state to the allocations
+// handler, if any, and to the export ConfigMap, if enabled, when the
+// state changed since the last export. It returns st, or an error
+// state if the export failed so that it gets retried.
+func (c *controller) exportAllocations(l log.Logger, st k8s.SyncState) k8s.SyncState {
+	if (c.exportName == "" && c.allocations == nil) || !c.synced {
+		return st
+	}
+	gen := c.ips.Generation()
+	if c.exported != "" && gen == c.exportedGeneration {
+		return st
+	}
+	data, err := c.allocationsJSON()
+	if err != nil {
+		level.Error(l).Log("bug", "true", "error", err, "msg", "failed to serialize allocations")
+		return st
+	}
+	exportedGen := exportedGeneration(c.ips.Epoch(), gen)
+	if c.allocations != nil {
+		c.allocations.set(exportedGen, data)
+	}
+	if c.exportName != "" {
+		if err := c.client.ApplyConfigMap(c.exportNamespace, c.exportName, map[string]string{
+			exportKey:     data,
+			generationKey: exportedGen,
+		}); err != nil {
+			level.Error(l).Log("op", "exportAllocations", "error", err, "msg", "failed to export allocations")
+			if st == k8s.SyncStateSuccess {
+				return k8s.SyncStateError
+			}
+			return st
+		}
+	}
+	c.exported, c.exportedGeneration = data, gen
+	level.Debug(l).Log("event", "allocationsExported", "generation", exportedGen, "msg", "exported allocations")
+	return st
+}
+
+// exportedGeneration returns the exported form of generation gen of
+// the allocator of epoch, which the controllers of later restarts
+// never reuse.
+func exportedGeneration(epoch int64, gen uint64) string {
+	return fmt.Sprintf("%d-%d", epoch, gen)
+}
+
+// allocationsHandler serves the last exported allocations and their
+// generation. The generation is also the ETag of the response, so
+// that clients polling with If-None-Match only get the allocations
+// back once they changed.
+type allocationsHandler struct {
+	mu sync.Mutex
+	// The exported allocations, nil until the controller synced.
+	generation  string
+	allocations json.RawMessage
+}
+
+func (h *allocationsHandler) set(gen string, data string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.generation, h.allocations = gen, json.RawMessage(data)
+}
+
+func (h *allocationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	gen, allocs := h.generation, h.allocations
+	h.mu.Unlock()
+
+	if allocs == nil {
+		http.Error(w, "controller not synced yet", http.StatusServiceUnavailable)
+		return
+	}
+	etag := `"` + gen + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	bs, err := json.Marshal(struct {
+		Generation  string          `json:"generation"`
+		Allocations json.RawMessage `json:"allocations"`
+	}{gen, allocs})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,149 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// gatewayAllocKey returns the allocator key of a Gateway, distinct
+// from any service name.
+func gatewayAllocKey(name string) string {
+	return "gateway:" + name
+}
+
+// SetGateway allocates an address to a Gateway API Gateway of the
+// watched GatewayClasses that requests none, and publishes it in the
+// Gateway's status.
+func (c *controller) SetGateway(l log.Logger, name string, gw *k8s.Gateway) k8s.SyncState {
+	return c.exportAllocations(l, c.setGateway(l, name, gw))
+}
+
+func (c *controller) setGateway(l log.Logger, name string, gw *k8s.Gateway) k8s.SyncState {
+	key := gatewayAllocKey(name)
+	if gw == nil {
+		if c.release(key, "gatewayDeleted") {
+			level.Info(l).Log("event", "gatewayDeleted", "msg", "gateway deleted or not of a watched class")
+			return k8s.SyncStateReprocessAll
+		}
+		return k8s.SyncStateSuccess
+	}
+
+	if c.config == nil {
+		level.Debug(l).Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		return k8s.SyncStateSuccess
+	}
+
+	if len(gw.SpecAddresses) > 0 {
+		// The Gateway picks its own addresses, its implementation is
+		// responsible for them.
+		if c.release(key, "addressesRequested") {
+			level.Info(l).Log("event", "clearAssignment", "reason", "addressesRequested", "msg", "gateway requests its own addresses")
+		}
+		return k8s.SyncStateSuccess
+	}
+
+	ip, st := c.allocateAddress(l, key, gw.Addresses, gw.Annotations["metallb.universe.tf/address-pool"])
+	if ip == nil {
+		return st
+	}
+
+	if len(gw.Addresses) == 1 && gw.Addresses[0] == ip.String() {
+		return k8s.SyncStateSuccess
+	}
+	if err := c.client.UpdateGatewayStatus(gw, []string{ip.String()}); err != nil {
+		level.Error(l).Log("op", "updateGatewayStatus", "error", err, "msg", "failed to update gateway status")
+		return k8s.SyncStateError
+	}
+	level.Info(l).Log("event", "gatewayUpdated", "msg", "updated gateway object")
+	return k8s.SyncStateSuccess
+}
+
+// allocateAddress keeps the address of key, an object other than a
+// service whose status holds addresses, or allocates it one from
+// desiredPool, any pool if empty. It returns nil and the state to
+// return if there's no address to publish.
+func (c *controller) allocateAddress(l log.Logger, key string, addresses []string, desiredPool string) (net.IP, k8s.SyncState) {
+	var ip net.IP
+	if len(addresses) == 1 {
+		ip = net.ParseIP(addresses[0])
+	}
+	if ip != nil {
+		if err := c.ips.Assign(key, ip, nil, "", ""); err != nil {
+			level.Info(l).Log("event", "clearAssignment", "reason", "notAllowedByConfig", "msg", "current IP not allowed by config, clearing")
+			c.release(key, "notAllowedByConfig")
+			ip = nil
+		} else if desiredPool != "" && c.ips.Pool(key) != desiredPool {
+			level.Info(l).Log("event", "clearAssignment", "reason", "differentPoolRequested", "msg", "user requested a different pool than the one currently assigned")
+			c.release(key, "differentPoolRequested")
+			ip = nil
+		} else if c.poolReservation(key, c.ips.Pool(key)) != "" {
+			level.Info(l).Log("event", "clearAssignment", "reason", "notAllowedByConfig", "msg", "current IP not allowed by config, clearing")
+			c.release(key, "notAllowedByConfig")
+			ip = nil
+		}
+	}
+
+	if ip == nil {
+		if !c.synced {
+			level.Error(l).Log("op", "allocateIP", "error", "controller not synced", "msg", "controller not synced yet, cannot allocate IP; will retry after sync")
+			return nil, k8s.SyncStateError
+		}
+		if r := c.poolReservation(key, desiredPool); desiredPool != "" && r != "" {
+			level.Error(l).Log("op", "allocateIP", "pool", desiredPool, "reservedFor", r, "msg", "pool is reserved")
+			return nil, k8s.SyncStateSuccess
+		}
+		var err error
+		// These objects have no IP family of their own, give them
+		// IPv4, unless their pools only have IPv6 addresses, as in
+		// IPv6-only clusters.
+		isIPv6 := !c.poolsHaveIPv4(desiredPool)
+		if desiredPool != "" {
+			ip, err = c.ips.AllocateFromPool(key, isIPv6, desiredPool, nil, "", "")
+		} else {
+			ip, err = c.ips.Allocate(key, isIPv6, nil, "", "")
+		}
+		if err != nil {
+			// Retried when another balancer releases its IP.
+			level.Error(l).Log("op", "allocateIP", "error", err, "msg", "IP allocation failed")
+			return nil, k8s.SyncStateSuccess
+		}
+		level.Info(l).Log("event", "ipAllocated", "ip", ip, "msg", "IP address assigned by controller")
+		c.auditAllocation(key, "ipAllocated", ip, c.ips.Pool(key), "")
+	}
+	return ip, k8s.SyncStateSuccess
+}
+
+// poolsHaveIPv4 returns whether pool, or the auto-assign pools if
+// empty, have IPv4 addresses. It also returns true if there are no
+// such pools, so that the allocation fails as an IPv4 one.
+func (c *controller) poolsHaveIPv4(pool string) bool {
+	found := false
+	for name, p := range c.config.Pools {
+		if (pool != "" && name != pool) || (pool == "" && !p.AutoAssign) {
+			continue
+		}
+		found = true
+		for _, cidr := range p.CIDR {
+			if cidr.IP.To4() != nil {
+				return true
+			}
+		}
+	}
+	return !found
+}
@@ -0,0 +1,113 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// holdIP keeps the IP of key, a service that is no longer a
+// LoadBalancer, allocated until the end of the type change grace
+// period, so that it gets the IP back if it becomes a LoadBalancer
+// again in time. While it does, svc has the IPHeld condition, which
+// keeps it in the informer once its ingress status is cleared. It
+// returns false if there is no grace period or IP to hold, or if the
+// grace period ended and the IP must be released.
+func (c *controller) holdIP(l log.Logger, key string, svc *v1.Service) bool {
+	ip := c.ips.IP(key)
+	if c.typeChangeGrace <= 0 || ip == nil {
+		delete(c.held, key)
+		return false
+	}
+	until, held := c.held[key]
+	if !held {
+		until = time.Now().Add(c.typeChangeGrace)
+		if c.held == nil {
+			c.held = map[string]time.Time{}
+		}
+		c.held[key] = until
+		level.Info(l).Log("event", "ipHeld", "ip", ip, "until", until, "msg", "not a LoadBalancer anymore, holding IP for the type change grace period")
+		c.client.Infof(svc, "IPHeld", "Holding IP %q until %s, in case the service becomes a LoadBalancer again", ip, until.Format(time.RFC3339))
+	}
+	if left := time.Until(until); left > 0 {
+		c.client.SyncAfter(key, left)
+		meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+			Type:               k8s.IPHeldCondition,
+			Status:             metav1.ConditionTrue,
+			ObservedGeneration: svc.Generation,
+			Reason:             "NotLoadBalancer",
+			Message:            fmt.Sprintf("Holding IP %q until %s", ip, until.Format(time.RFC3339)),
+		})
+		return true
+	}
+	delete(c.held, key)
+	level.Info(l).Log("event", "heldIPExpired", "ip", ip, "msg", "type change grace period ended, releasing IP")
+	return false
+}
+
+// reacquireHeldIP gives key, a LoadBalancer service again, the IP
+// held since it stopped being one, by putting it back in its status.
+// The rest of the convergence then checks that the service can still
+// have it.
+func (c *controller) reacquireHeldIP(l log.Logger, key string, svc *v1.Service) {
+	removeCondition(svc, k8s.IPHeldCondition)
+	if _, held := c.held[key]; !held {
+		return
+	}
+	delete(c.held, key)
+	ip := c.ips.IP(key)
+	if ip == nil || k8s.LoadBalancerIP(svc) != nil {
+		return
+	}
+	level.Info(l).Log("event", "heldIPReacquired", "ip", ip, "msg", "LoadBalancer again within the type change grace period, reacquiring held IP")
+	c.client.Infof(svc, "IPReacquired", "Reacquired held IP %q", ip)
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ip.String()}}
+}
+
+// releaseHeldIPs releases the held IPs that pools don't allow, so
+// that they don't prevent applying a new configuration.
+func (c *controller) releaseHeldIPs(l log.Logger, pools map[string]*config.Pool) {
+	for key := range c.held {
+		ip := c.ips.IP(key)
+		if ip != nil && inPools(pools, ip) {
+			continue
+		}
+		delete(c.held, key)
+		if c.release(key, "notAllowedByConfig") {
+			level.Info(l).Log("event", "clearAssignment", "service", key, "ip", ip, "reason", "notAllowedByConfig", "msg", "held IP not allowed by new config, releasing it")
+		}
+	}
+}
+
+// inPools returns whether ip is in one of pools.
+func inPools(pools map[string]*config.Pool, ip net.IP) bool {
+	for _, p := range pools {
+		for _, cidr := range p.CIDR {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
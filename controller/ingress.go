@@ -0,0 +1,65 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// ingressAllocKey returns the allocator key of an Ingress, distinct
+// from any service or Gateway name.
+func ingressAllocKey(name string) string {
+	return "ingress:" + name
+}
+
+// SetIngress allocates an address to an Ingress of the watched
+// IngressClasses, and publishes it in the Ingress's status, for
+// ingress controllers that don't create a LoadBalancer service of
+// their own.
+func (c *controller) SetIngress(l log.Logger, name string, ing *k8s.Ingress) k8s.SyncState {
+	return c.exportAllocations(l, c.setIngress(l, name, ing))
+}
+
+func (c *controller) setIngress(l log.Logger, name string, ing *k8s.Ingress) k8s.SyncState {
+	key := ingressAllocKey(name)
+	if ing == nil {
+		if c.release(key, "ingressDeleted") {
+			level.Info(l).Log("event", "ingressDeleted", "msg", "ingress deleted or not of a watched class")
+			return k8s.SyncStateReprocessAll
+		}
+		return k8s.SyncStateSuccess
+	}
+
+	if c.config == nil {
+		level.Debug(l).Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		return k8s.SyncStateSuccess
+	}
+
+	ip, st := c.allocateAddress(l, key, ing.Addresses, ing.Annotations["metallb.universe.tf/address-pool"])
+	if ip == nil {
+		return st
+	}
+
+	if len(ing.Addresses) == 1 && ing.Addresses[0] == ip.String() {
+		return k8s.SyncStateSuccess
+	}
+	if err := c.client.UpdateIngressStatus(ing, []string{ip.String()}); err != nil {
+		level.Error(l).Log("op", "updateIngressStatus", "error", err, "msg", "failed to update ingress status")
+		return k8s.SyncStateError
+	}
+	level.Info(l).Log("event", "ingressUpdated", "msg", "updated ingress object")
+	return k8s.SyncStateSuccess
+}
@@ -0,0 +1,50 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// claimIP records the new allocation of ip to the service key in an
+// IPClaim, if claims are enabled. Admission policies can reject the
+// claim, in which case the IP is released and the allocation fails,
+// to be retried on the next sync of the service.
+func (c *controller) claimIP(key string, svc *v1.Service, ip net.IP) (net.IP, error) {
+	if !c.ipClaims {
+		return ip, nil
+	}
+	if err := c.client.ApplyIPClaim(svc, ip.String(), c.ips.Pool(key)); err != nil {
+		c.ips.Unassign(key)
+		return nil, fmt.Errorf("IP claim not admitted: %s", err)
+	}
+	return ip, nil
+}
+
+// releaseClaim deletes the IPClaim of key, if it is a service and
+// claims are enabled. A claim that can't be deleted is replaced on
+// the next allocation of the service, and garbage collected with it.
+func (c *controller) releaseClaim(key string) {
+	if !c.ipClaims || strings.HasPrefix(key, gatewayAllocKey("")) || strings.HasPrefix(key, ingressAllocKey("")) || strings.HasPrefix(key, nodeAllocKey("")) {
+		return
+	}
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return
+	}
+	c.client.DeleteIPClaim(parts[0], parts[1])
+}
@@ -0,0 +1,121 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// nodeAllocKey returns the allocator key of the loopback address of
+// a node, distinct from any service, Gateway or Ingress name.
+func nodeAllocKey(name string) string {
+	return "node:" + name
+}
+
+// SetNode gives a node an address of the node loopbacks pool, and
+// records it in the node's loopback annotation, for the node's
+// speaker to advertise.
+func (c *controller) SetNode(l log.Logger, name string, node *v1.Node) k8s.SyncState {
+	return c.exportAllocations(l, c.setNode(l, name, node))
+}
+
+func (c *controller) setNode(l log.Logger, name string, node *v1.Node) k8s.SyncState {
+	key := nodeAllocKey(name)
+	if node == nil {
+		if c.release(key, "nodeDeleted") {
+			level.Info(l).Log("event", "nodeDeleted", "msg", "node deleted, released its loopback address")
+		}
+		return k8s.SyncStateSuccess
+	}
+
+	if c.config == nil {
+		level.Debug(l).Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		return k8s.SyncStateSuccess
+	}
+
+	current := node.Annotations[k8s.NodeLoopbackAnnotation]
+	pool := c.loopbackPool()
+	if pool == "" {
+		c.release(key, "noLoopbackPool")
+		if current == "" {
+			return k8s.SyncStateSuccess
+		}
+		if err := c.client.ApplyNodeLoopback(name, ""); err != nil {
+			level.Error(l).Log("op", "applyNodeLoopback", "error", err, "msg", "failed to remove node loopback address")
+			return k8s.SyncStateError
+		}
+		level.Info(l).Log("event", "nodeLoopbackRemoved", "ip", current, "msg", "no node loopbacks pool, removed node loopback address")
+		return k8s.SyncStateSuccess
+	}
+
+	var addresses []string
+	if current != "" {
+		addresses = []string{current}
+	}
+	ip, st := c.allocateAddress(l, key, addresses, pool)
+	if ip == nil {
+		return st
+	}
+	if current == ip.String() {
+		return k8s.SyncStateSuccess
+	}
+	if err := c.client.ApplyNodeLoopback(name, ip.String()); err != nil {
+		level.Error(l).Log("op", "applyNodeLoopback", "error", err, "msg", "failed to record node loopback address")
+		return k8s.SyncStateError
+	}
+	level.Info(l).Log("event", "nodeLoopbackAssigned", "ip", ip, "msg", "recorded node loopback address")
+	return k8s.SyncStateSuccess
+}
+
+// loopbackPool returns the pool of node loopback addresses, the
+// first by name if there are several, "" if there is none.
+func (c *controller) loopbackPool() string {
+	var pools []string
+	for name, p := range c.config.Pools {
+		if p.NodeLoopbacks {
+			pools = append(pools, name)
+		}
+	}
+	if len(pools) == 0 {
+		return ""
+	}
+	sort.Strings(pools)
+	return pools[0]
+}
+
+// poolReservation returns what pool is reserved for if key may not
+// hold its addresses, "" if it may: the self-test pool is for the
+// speakers' canary only, the node loopbacks pools are for nodes only,
+// and nodes only get addresses from them.
+func (c *controller) poolReservation(key, pool string) string {
+	p := c.config.Pools[pool]
+	isNode := strings.HasPrefix(key, nodeAllocKey(""))
+	switch {
+	case p == nil:
+		return ""
+	case pool == c.selfTestPool:
+		return "the self-test"
+	case p.NodeLoopbacks && !isNode:
+		return "node loopbacks"
+	case !p.NodeLoopbacks && isNode:
+		return "services"
+	}
+	return ""
+}
@@ -15,29 +15,55 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
+	"go.universe.tf/metallb/internal/alert"
 	"go.universe.tf/metallb/internal/allocator"
 	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/configpush"
+	"go.universe.tf/metallb/internal/dnsupdate"
 	"go.universe.tf/metallb/internal/k8s"
 	"go.universe.tf/metallb/internal/logging"
 	"go.universe.tf/metallb/internal/version"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 )
 
+var allocationLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "metallb",
+	Subsystem: "controller",
+	Name:      "allocation_latency_seconds",
+	Help:      "Time from a service change to the publication of its new IP in its status.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+})
+
 // Service offers methods to mutate a Kubernetes service object.
 type service interface {
-	UpdateStatus(svc *v1.Service) error
+	ChangedAt(key string) time.Time
+	SyncAfter(key string, d time.Duration)
+	DefaultPool(namespace string) string
+	UpdateStatus(svc *v1.Service, ipMode string) error
 	Infof(svc *v1.Service, desc, msg string, args ...interface{})
+	AnnotatedInfof(svc *v1.Service, annotations map[string]string, desc, msg string, args ...interface{})
 	Errorf(svc *v1.Service, desc, msg string, args ...interface{})
+	UpdateGatewayStatus(gw *k8s.Gateway, ips []string) error
+	UpdateIngressStatus(ing *k8s.Ingress, ips []string) error
+	ApplyConfigMap(namespace, name string, data map[string]string) error
+	ApplyIPClaim(svc *v1.Service, ip, pool string) error
+	DeleteIPClaim(namespace, name string) error
+	ApplyNodeLoopback(name, ip string) error
 }
 
 type controller struct {
@@ -45,55 +71,233 @@ type controller struct {
 	synced bool
 	config *config.Config
 	ips    *allocator.Allocator
+	// The ipMode last published for each service, when not the
+	// default.
+	ipModes map[string]string
+	// Records allocation decisions, if non-nil.
+	audit log.Logger
+	// LoadBalancer services waiting for an IP.
+	pending map[string]bool
+	// Allocation priority of the services holding an IP, and the
+	// services that lost their IP to a higher priority one.
+	priorities map[string]int
+	preempted  map[string]string // victim -> preemptor
+	// Publishes DNS records for the allocated IPs, if non-nil.
+	dns        dnsUpdater
+	dnsRecords map[string]dnsRecord
+	// The namespace/name of the ConfigMap storing dnsRecords.
+	dnsStore string
+	// Where to export the allocations, if exportName is set and to
+	// allocations if non-nil, and what was last exported, at which
+	// allocator generation.
+	exportNamespace    string
+	exportName         string
+	allocations        *allocationsHandler
+	exported           string
+	exportedGeneration uint64
+	// The load balancer class of the services this instance manages,
+	// "" for the services that don't request one.
+	lbClass string
+	// Asks for more addresses for the pools whose usage reaches
+	// expansionThreshold, if non-nil, and the capacity of the pools
+	// it asked for. configMap is the namespace/name of the config
+	// ConfigMap, where the new addresses go.
+	expander           poolExpander
+	expansionThreshold float64
+	expansionRequested map[string]int64
+	configMap          string
+	// Reviews the new allocations of services, if non-nil.
+	policy allocator.Policy
+	// Whether new allocations of services must be admitted as an
+	// IPClaim.
+	ipClaims bool
+	// Where to send alerts, if non-nil, and the pools whose
+	// exhausted alert fires.
+	alerts    alerter
+	exhausted map[string]bool
+	// How long services that stop being a LoadBalancer keep their
+	// IP, and until when they hold it.
+	typeChangeGrace time.Duration
+	held            map[string]time.Time
+	// The pool of the speakers' self-test canary, whose addresses
+	// are never allocated.
+	selfTestPool string
+	// The field manager of the status writes, and the other
+	// managers writing the status of services over ours.
+	fieldManager string
+	conflicts    map[string]string
+}
+
+func (c *controller) SetBalancer(l log.Logger, name string, svcRo *v1.Service, eps k8s.EpsOrSlices) k8s.SyncState {
+	st := c.exportAllocations(l, c.setBalancer(l, name, svcRo, eps))
+	c.requestExpansions(l)
+	c.alertExhaustedPools(l)
+	return st
 }
 
-func (c *controller) SetBalancer(l log.Logger, name string, svcRo *v1.Service, _ k8s.EpsOrSlices) k8s.SyncState {
+func (c *controller) setBalancer(l log.Logger, name string, svcRo *v1.Service, _ k8s.EpsOrSlices) k8s.SyncState {
 	level.Debug(l).Log("event", "startUpdate", "msg", "start of service update")
 	defer level.Debug(l).Log("event", "endUpdate", "msg", "end of service update")
 
 	if svcRo == nil {
 		c.deleteBalancer(l, name)
+		c.retryDeleteDNS(l, name)
 		// There might be other LBs stuck waiting for an IP, so when
 		// we delete a balancer we should reprocess all of them to
 		// check for newly feasible balancers.
 		return k8s.SyncStateReprocessAll
 	}
 
+	if svcRo.Annotations[ignoreAnnotation] == "true" || k8s.LoadBalancerClass(svcRo) != c.lbClass {
+		// Managed by someone else, possibly another MetalLB
+		// instance. Release the IP we may have allocated in the
+		// past, but don't touch the service.
+		delete(c.pending, name)
+		delete(c.preempted, name)
+		delete(c.held, name)
+		delete(c.conflicts, name)
+		released := c.release(name, "ignored")
+		c.retryDeleteDNS(l, name)
+		if released {
+			level.Info(l).Log("event", "serviceIgnored", "msg", "service ignored, releasing its IP")
+			delete(c.ipModes, name)
+			return k8s.SyncStateReprocessAll
+		}
+		return k8s.SyncStateSuccess
+	}
+
 	if c.config == nil {
 		// Config hasn't been read, nothing we can do just yet.
 		level.Debug(l).Log("event", "noConfig", "msg", "not processing, still waiting for config")
 		return k8s.SyncStateSuccess
 	}
 
+	if c.statusConflict(l, name, svcRo) != "" {
+		// Fighting over the status would make the service flap
+		// between the IPs of both controllers.
+		delete(c.pending, name)
+		delete(c.held, name)
+		released := c.release(name, "statusConflict")
+		c.retryDeleteDNS(l, name)
+		if released {
+			return k8s.SyncStateReprocessAll
+		}
+		return k8s.SyncStateSuccess
+	}
+
 	// Making a copy unconditionally is a bit wasteful, since we don't
 	// always need to update the service. But, making an unconditional
 	// copy makes the code much easier to follow, and we have a GC for
 	// a reason.
 	svc := svcRo.DeepCopy()
+	prevIP := c.ips.IP(name)
 	if !c.convergeBalancer(l, name, svc) {
 		return k8s.SyncStateError
 	}
-	if reflect.DeepEqual(svcRo, svc) {
+	ip := c.ips.IP(name)
+	if svc.Spec.Type == "LoadBalancer" && ip == nil && meta.FindStatusCondition(svc.Status.Conditions, expiredCondition) == nil {
+		if c.pending == nil {
+			c.pending = map[string]bool{}
+		}
+		c.pending[name] = true
+	} else {
+		delete(c.pending, name)
+	}
+	// If the service gave up an IP, e.g. because it is no longer a
+	// LoadBalancer or moved to another pool, services waiting for an
+	// IP may now get one.
+	state := k8s.SyncStateSuccess
+	if prevIP != nil && !prevIP.Equal(ip) {
+		c.retryPending(l, name)
+	}
+	if err := c.updateDNS(l, name, svc); err != nil {
+		level.Error(l).Log("op", "updateDNS", "error", err, "msg", "failed to update DNS record")
+		c.client.Errorf(svc, "DNSUpdateFailed", "Failed to update DNS record: %s", err)
+		if state == k8s.SyncStateSuccess {
+			state = k8s.SyncStateError
+		}
+	}
+	// The ipMode isn't part of the service objects we get, so we
+	// remember what we published. After a restart, services with a
+	// non-default ipMode get their status written once more.
+	ipMode := c.ipMode(name)
+	ipModeChanged := ipMode != c.ipModes[name]
+	if reflect.DeepEqual(svcRo, svc) && !ipModeChanged {
 		level.Debug(l).Log("event", "noChange", "msg", "service converged, no change")
-		return k8s.SyncStateSuccess
+		return state
 	}
 
-	if !reflect.DeepEqual(svcRo.Status, svc.Status) {
+	if !reflect.DeepEqual(svcRo.Status, svc.Status) || ipModeChanged {
 		var st v1.ServiceStatus
 		st, svc = svc.Status, svcRo.DeepCopy()
 		svc.Status = st
-		if err := c.client.UpdateStatus(svc); err != nil {
+		if err := c.client.UpdateStatus(svc, ipMode); err != nil {
 			level.Error(l).Log("op", "updateServiceStatus", "error", err, "msg", "failed to update service status")
 			return k8s.SyncStateError
 		}
+		if changed := c.client.ChangedAt(name); !changed.IsZero() && ingressIP(svc) != "" && ingressIP(svc) != ingressIP(svcRo) {
+			allocationLatency.Observe(time.Since(changed).Seconds())
+		}
+		if ipMode == "" {
+			delete(c.ipModes, name)
+		} else {
+			if c.ipModes == nil {
+				c.ipModes = map[string]string{}
+			}
+			c.ipModes[name] = ipMode
+		}
 	}
 	level.Info(l).Log("event", "serviceUpdated", "msg", "updated service object")
 
-	return k8s.SyncStateSuccess
+	return state
+}
+
+// ingressIP returns the IP published in the status of svc, "" if
+// there is none.
+func ingressIP(svc *v1.Service) string {
+	ip := k8s.LoadBalancerIP(svc)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// ignoreAnnotation makes MetalLB leave a service alone, so that
+// another controller or an operator can manage it.
+const ignoreAnnotation = "metallb.universe.tf/ignore"
+
+// ipMode returns the ipMode of the pool the service's IP was
+// allocated from, "" if the service has no IP or the pool doesn't set
+// one.
+func (c *controller) ipMode(name string) string {
+	if pool := c.config.Pools[c.ips.Pool(name)]; pool != nil {
+		return pool.IPMode
+	}
+	return ""
+}
+
+// retryPending requeues the services waiting for an IP, other than
+// name, rather than all the services, which are unaffected by the
+// release of an IP.
+func (c *controller) retryPending(l log.Logger, name string) {
+	if len(c.pending) == 0 {
+		return
+	}
+	level.Info(l).Log("event", "ipReleased", "pending", len(c.pending), "msg", "IP released, retrying allocation of pending services")
+	for key := range c.pending {
+		if key != name {
+			c.client.SyncAfter(key, 0)
+		}
+	}
 }
 
 func (c *controller) deleteBalancer(l log.Logger, name string) {
-	if c.ips.Unassign(name) {
+	delete(c.held, name)
+	delete(c.conflicts, name)
+	delete(c.ipModes, name)
+	delete(c.pending, name)
+	delete(c.preempted, name)
+	if c.release(name, "serviceDeleted") {
 		level.Info(l).Log("event", "serviceDeleted", "msg", "service deleted")
 	}
 }
@@ -107,28 +311,92 @@ func (c *controller) SetConfig(l log.Logger, cfg *config.Config) k8s.SyncState {
 		return k8s.SyncStateError
 	}
 
+	c.releaseHeldIPs(l, cfg.Pools)
 	if err := c.ips.SetPools(cfg.Pools); err != nil {
 		level.Error(l).Log("op", "setConfig", "error", err, "msg", "applying new configuration failed")
 		return k8s.SyncStateError
 	}
 	c.config = cfg
+	if len(c.pending) > 0 {
+		level.Info(l).Log("event", "retryPending", "pending", len(c.pending), "msg", "retrying allocation of services waiting for an IP")
+	}
 	return k8s.SyncStateReprocessAll
 }
 
 func (c *controller) MarkSynced(l log.Logger) {
 	c.synced = true
 	level.Info(l).Log("event", "stateSynced", "msg", "controller synced, can allocate IPs now")
+	c.exportAllocations(l, k8s.SyncStateSuccess)
+	c.requestExpansions(l)
+	c.alertExhaustedPools(l)
+	// The services deleted while we were down still have DNS
+	// records.
+	for key := range c.dnsRecords {
+		c.client.SyncAfter(key, 0)
+	}
+}
+
+// speakerAuthenticator authenticates the tokens of user, the
+// ServiceAccount of the speakers, with client.
+func speakerAuthenticator(client *k8s.Client, user string) configpush.Authenticator {
+	return func(ctx context.Context, token string) (string, error) {
+		got, node, err := client.ReviewToken(ctx, token)
+		if err != nil {
+			return "", err
+		}
+		if got != user {
+			return "", fmt.Errorf("%q is not the speakers' ServiceAccount", got)
+		}
+		return node, nil
+	}
 }
 
 func main() {
+	prometheus.MustRegister(allocationLatency)
+
 	var (
-		port       = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
-		config     = flag.String("config", "config", "Kubernetes ConfigMap containing MetalLB's configuration")
-		namespace  = flag.String("namespace", os.Getenv("METALLB_NAMESPACE"), "config / memberlist secret namespace")
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file (only needed when running outside of k8s)")
-		mlSecret   = flag.String("ml-secret-name", os.Getenv("METALLB_ML_SECRET_NAME"), "name of the memberlist secret to create")
-		deployName = flag.String("deployment", os.Getenv("METALLB_DEPLOYMENT"), "name of the MetalLB controller Deployment")
-		logLevel   = flag.String("log-level", "info", fmt.Sprintf("log level. must be one of: [%s]", strings.Join(logging.Levels, ", ")))
+		port           = flag.Int("port", 7472, "HTTP listening port for Prometheus metrics")
+		config         = flag.String("config", "config", "Kubernetes ConfigMap containing MetalLB's configuration")
+		namespace      = flag.String("namespace", os.Getenv("METALLB_NAMESPACE"), "config / memberlist secret namespace")
+		kubeconfig     = flag.String("kubeconfig", "", "absolute path to the kubeconfig file (only needed when running outside of k8s)")
+		mlSecret       = flag.String("ml-secret-name", os.Getenv("METALLB_ML_SECRET_NAME"), "name of the memberlist secret to create")
+		deployName     = flag.String("deployment", os.Getenv("METALLB_DEPLOYMENT"), "name of the MetalLB controller Deployment")
+		logLevel       = flag.String("log-level", "info", fmt.Sprintf("log level. must be one of: [%s]", strings.Join(logging.Levels, ", ")))
+		statusInterval = flag.Duration("status-batch-interval", 0, "if non-zero, batch service status writes and flush them at this interval")
+		eventInterval  = flag.Duration("event-interval", 5*time.Minute, "minimum interval between two identical events about a service, unless a different event about it comes in between, 0 to send them all")
+		resyncPeriod   = flag.Duration("resync-period", 0, "if non-zero, reprocess every service at this interval even if it didn't change")
+		resyncJitter   = flag.Float64("resync-jitter", 0.1, "fraction of --resync-period by which to randomly lengthen each period, and over which to spread the reprocessing of the services")
+		retryBackoff   = flag.Duration("retry-backoff", 5*time.Millisecond, "delay before retrying a service whose processing failed, doubled on each failure")
+		maxBackoff     = flag.Duration("max-retry-backoff", 1000*time.Second, "maximum delay before retrying a service whose processing failed")
+		gatewayClasses = flag.String("gateway-classes", "", "comma-separated GatewayClasses whose Gateway API Gateways get an address allocated (requires the Gateway API CRDs)")
+		ingressClasses = flag.String("ingress-classes", "", "comma-separated IngressClasses whose Ingresses get an address allocated, for ingress controllers without a LoadBalancer service")
+		auditLog       = flag.String("audit-log", "", "if set, append a JSON record of every IP allocation and release to this file, or to stdout if \"-\"")
+		dnsServer      = flag.String("dns-update-server", "", "if set, publish the allocated IPs with RFC 2136 dynamic DNS updates sent to this server")
+		dnsZone        = flag.String("dns-update-zone", "", "DNS zone to publish the allocated IPs in")
+		dnsTTL         = flag.Duration("dns-update-ttl", 5*time.Minute, "TTL of the published DNS records")
+		dnsKey         = flag.String("dns-update-tsig-key", "", "name of the TSIG key signing the DNS updates")
+		dnsAlgorithm   = flag.String("dns-update-tsig-algorithm", "hmac-sha256", "algorithm of the TSIG key, one of hmac-sha256, hmac-sha512, hmac-sha1, hmac-md5")
+		dnsSecret      = flag.String("dns-update-tsig-secret", os.Getenv("METALLB_DNS_TSIG_SECRET"), "base64 encoded secret of the TSIG key")
+		dnsStore       = flag.String("dns-update-records-configmap", "metallb-dns-records", "ConfigMap in the namespace of the controller where the published DNS records are kept across restarts")
+		exportCM       = flag.String("allocations-configmap", "", "if set, mirror all the IP allocations to this ConfigMap, in the controller's namespace")
+		lbClass        = flag.String("lb-class", "", "only manage the services of this load balancer class, instead of the services without one")
+		selfTestPool   = flag.String("self-test-pool", "", "pool of the speakers' self-test canary, like their --self-test-pool, whose addresses are never allocated")
+		configStatus   = flag.Bool("config-status", true, "record in annotations of the config ConfigMap whether the config was accepted")
+		nsDefaultPools = flag.Bool("namespace-default-pools", true, "give services without a pool annotation the default pool of their namespace (requires permission to watch namespaces)")
+		expansionHook  = flag.String("pool-expansion-webhook", "", "if set, POST a JSON request for more addresses to this URL when a pool's usage reaches --pool-expansion-threshold")
+		expansionLevel = flag.Float64("pool-expansion-threshold", 0.9, "fraction of a pool's addresses in use at which to request an expansion")
+		policyHook     = flag.String("allocation-policy-webhook", "", "if set, POST every new service allocation as JSON to this URL, which can deny it or pick another pool or IP")
+		policyTimeout  = flag.Duration("allocation-policy-timeout", 5*time.Second, "how long to wait for the allocation policy webhook, before failing the allocation")
+		nodeLoopbacks  = flag.Bool("node-loopbacks", false, "give every node an address of the node-loopbacks pool, for its speaker to advertise (requires permission to watch and patch nodes)")
+		configServe    = flag.String("config-distribution-address", "", "if set, serve the accepted config to the speakers started with --config-server on this address, e.g. :7473, over TLS")
+		configCert     = flag.String("config-distribution-cert", "", "TLS certificate file of --config-distribution-address")
+		configKey      = flag.String("config-distribution-key", "", "TLS key file of --config-distribution-address")
+		configSA       = flag.String("config-distribution-service-account", "speaker", "ServiceAccount of the speakers, in the controller's namespace, the only one --config-distribution-address serves")
+		alertWebhook   = flag.String("alert-webhook", "", "if set, send alerts about critical conditions, e.g. exhausted pools, to this URL")
+		alertFormat    = flag.String("alert-format", alert.FormatGeneric, "format of the alerts sent to --alert-webhook: generic, or alertmanager to send them to the Alertmanager v2 API")
+		typeGrace      = flag.Duration("type-change-grace-period", 0, "if non-zero, a service that stops being a LoadBalancer keeps its IP this long, and gets it back if it becomes a LoadBalancer again in time")
+		ipClaims       = flag.Bool("ip-claims", false, "record every new service allocation in an IPClaim, and only publish it once the claim is admitted (requires the IPClaim CRD)")
+		cleanup        = flag.Bool("cleanup", false, "clear the status of all the services MetalLB manages and remove their DNS records, then exit, before uninstalling MetalLB")
 	)
 	flag.Parse()
 
@@ -149,27 +417,127 @@ func main() {
 		*namespace = string(bs)
 	}
 
+	if *resyncJitter < 0 || *resyncJitter > 1 {
+		level.Error(logger).Log("op", "startup", "error", fmt.Sprintf("invalid resync jitter %v, must be in [0, 1]", *resyncJitter), "msg", "invalid resync jitter")
+		os.Exit(1)
+	}
+	if *retryBackoff <= 0 || *maxBackoff < *retryBackoff {
+		level.Error(logger).Log("op", "startup", "error", fmt.Sprintf("invalid retry backoff from %s to %s", *retryBackoff, *maxBackoff), "msg", "invalid retry backoff")
+		os.Exit(1)
+	}
+
 	c := &controller{
-		ips: allocator.New(),
+		ips:             allocator.New(),
+		exportNamespace: *namespace,
+		exportName:      *exportCM,
+		allocations:     &allocationsHandler{},
+		lbClass:         *lbClass,
+		ipClaims:        *ipClaims,
+		typeChangeGrace: *typeGrace,
+		selfTestPool:    *selfTestPool,
+		fieldManager:    processName,
+	}
+	prometheus.MustRegister(c.ips.Collector())
+	if *expansionHook != "" {
+		if *expansionLevel <= 0 || *expansionLevel > 1 {
+			level.Error(logger).Log("op", "startup", "error", fmt.Sprintf("invalid pool expansion threshold %v, must be in (0, 1]", *expansionLevel), "msg", "invalid pool expansion threshold")
+			os.Exit(1)
+		}
+		c.expander = newWebhookExpander(logger, *expansionHook)
+		c.expansionThreshold = *expansionLevel
+		c.configMap = *namespace + "/" + *config
+	}
+	if *alertWebhook != "" {
+		sink, err := alert.New(logger, *alertWebhook, *alertFormat, "controller", nil)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "invalid alert configuration")
+			os.Exit(1)
+		}
+		c.alerts = sink
+	}
+	if *policyHook != "" {
+		c.policy = allocator.NewWebhookPolicy(*policyHook, *policyTimeout)
+	}
+	if *auditLog != "" {
+		if c.audit, err = newAuditLogger(*auditLog); err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to open audit log")
+			os.Exit(1)
+		}
+	}
+	if *dnsServer != "" {
+		dns, err := dnsupdate.New(dnsupdate.Config{
+			Server:    *dnsServer,
+			Zone:      *dnsZone,
+			TTL:       *dnsTTL,
+			KeyName:   *dnsKey,
+			Algorithm: *dnsAlgorithm,
+			Secret:    *dnsSecret,
+		})
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to configure DNS updates")
+			os.Exit(1)
+		}
+		c.dns = dns
+		c.dnsStore = *namespace + "/" + *dnsStore
 	}
 
-	client, err := k8s.New(&k8s.Config{
-		ProcessName:   "metallb-controller",
+	cfg := &k8s.Config{
+		ProcessName:   processName,
 		ConfigMapName: *config,
 		ConfigMapNS:   *namespace,
 		MetricsPort:   *port,
 		Logger:        logger,
 		Kubeconfig:    *kubeconfig,
 
+		StatusBatchInterval: *statusInterval,
+		EventInterval:       *eventInterval,
+		ReportConfigStatus:  *configStatus,
+		ResyncPeriod:        *resyncPeriod,
+		ResyncJitter:        *resyncJitter,
+		RetryBackoff:        *retryBackoff,
+		MaxRetryBackoff:     *maxBackoff,
+
+		NamespaceDefaultPools: *nsDefaultPools,
+
 		ServiceChanged: c.SetBalancer,
 		ConfigChanged:  c.SetConfig,
 		Synced:         c.MarkSynced,
-	})
+	}
+	if *gatewayClasses != "" {
+		cfg.GatewayChanged = c.SetGateway
+		cfg.GatewayClasses = strings.Split(*gatewayClasses, ",")
+	}
+	if *ingressClasses != "" {
+		cfg.IngressChanged = c.SetIngress
+		cfg.IngressClasses = strings.Split(*ingressClasses, ",")
+	}
+	if *nodeLoopbacks {
+		cfg.NodesChanged = c.SetNode
+	}
+	var pushServer *configpush.Server
+	if *configServe != "" {
+		if *configCert == "" || *configKey == "" {
+			level.Error(logger).Log("op", "startup", "msg", "--config-distribution-address requires --config-distribution-cert and --config-distribution-key")
+			os.Exit(1)
+		}
+		pushServer = configpush.NewServer(logger)
+		cfg.ConfigAccepted = pushServer.Publish
+	}
+	http.Handle("/allocations", c.allocations)
+	client, err := k8s.New(cfg)
 	if err != nil {
 		level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to create k8s client")
 		os.Exit(1)
 	}
 
+	if *cleanup {
+		if err := c.cleanup(logger, client); err != nil {
+			level.Error(logger).Log("op", "cleanup", "error", err, "msg", "cleanup failed")
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *mlSecret != "" {
 		err = client.CreateMlSecret(*namespace, *deployName, *mlSecret)
 		if err != nil {
@@ -179,6 +547,23 @@ func main() {
 	}
 
 	c.client = client
+	if pushServer != nil {
+		auth := speakerAuthenticator(client, "system:serviceaccount:"+*namespace+":"+*configSA)
+		go func() {
+			if err := pushServer.ListenAndServeTLS(*configServe, *configCert, *configKey, auth); err != nil {
+				level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to serve the config to the speakers")
+				os.Exit(1)
+			}
+		}()
+	}
+	if c.dns != nil {
+		data, err := client.ConfigMapData(*namespace, *dnsStore)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to load the published DNS records")
+			os.Exit(1)
+		}
+		c.loadDNSRecords(logger, data)
+	}
 	if err := client.Run(nil); err != nil {
 		level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to run k8s client")
 	}
@@ -0,0 +1,80 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/allocator/k8salloc"
+)
+
+// reviewAllocation submits the new allocation of ip to the service
+// key to the allocation policy, if any, and returns the IP the
+// service ends up with. If the policy denies the allocation, or can't
+// be reached, the IP is released and the allocation fails, to be
+// retried on the next sync of the service.
+func (c *controller) reviewAllocation(l log.Logger, key string, svc *v1.Service, ip net.IP) (net.IP, error) {
+	if c.policy == nil {
+		return ip, nil
+	}
+	pool := c.ips.Pool(key)
+	d, err := c.policy.Review(&allocator.PolicyRequest{
+		Service:     key,
+		Labels:      svc.Labels,
+		Annotations: svc.Annotations,
+		IP:          ip.String(),
+		Pool:        pool,
+	})
+	if err != nil {
+		c.ips.Unassign(key)
+		return nil, fmt.Errorf("allocation policy failed: %s", err)
+	}
+	if !d.Allowed {
+		c.ips.Unassign(key)
+		if d.Reason == "" {
+			return nil, errors.New("denied by the allocation policy")
+		}
+		return nil, fmt.Errorf("denied by the allocation policy: %s", d.Reason)
+	}
+
+	switch {
+	case d.IP != "" && d.IP != ip.String():
+		override := net.ParseIP(d.IP)
+		if override == nil || (override.To4() == nil) != (ip.To4() == nil) {
+			c.ips.Unassign(key)
+			return nil, fmt.Errorf("allocation policy chose invalid IP %q", d.IP)
+		}
+		c.ips.Unassign(key)
+		if err := c.assignIP(key, svc, override); err != nil {
+			return nil, fmt.Errorf("assigning IP %s chosen by the allocation policy: %s", override, err)
+		}
+		level.Info(l).Log("event", "allocationOverridden", "ip", ip, "newIP", override, "msg", "allocation policy chose another IP")
+		return override, nil
+	case d.IP == "" && d.Pool != "" && d.Pool != pool:
+		c.ips.Unassign(key)
+		override, err := c.ips.AllocateFromPool(key, ip.To4() == nil, d.Pool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+		if err != nil {
+			return nil, fmt.Errorf("allocating from pool %q chosen by the allocation policy: %s", d.Pool, err)
+		}
+		level.Info(l).Log("event", "allocationOverridden", "ip", ip, "newIP", override, "pool", d.Pool, "msg", "allocation policy chose another pool")
+		return override, nil
+	}
+	return ip, nil
+}
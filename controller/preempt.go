@@ -0,0 +1,147 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// allocationPriorityAnnotation sets the allocation priority of a
+// service. When its pool is exhausted, a service can take the IP of
+// a service with a lower priority.
+const allocationPriorityAnnotation = "metallb.universe.tf/allocation-priority"
+
+// allocationPriority returns the allocation priority of svc, 0 if it
+// has none.
+func allocationPriority(svc *v1.Service) (int, error) {
+	a := svc.Annotations[allocationPriorityAnnotation]
+	if a == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(a)
+	if err != nil {
+		return 0, fmt.Errorf("invalid allocation priority %q", a)
+	}
+	return p, nil
+}
+
+// preemptionVictim returns the service with the lowest priority below
+// priority whose IP svc could use, "" if there is none. Services
+// sharing their IP are never preempted, since releasing one of them
+// doesn't free the IP.
+func (c *controller) preemptionVictim(key string, svc *v1.Service, priority int) string {
+	isIPv6 := k8s.IPFamily(svc) == v1.IPv6Protocol
+	requestedIP := net.ParseIP(svc.Spec.LoadBalancerIP)
+	desiredPool := c.desiredPool(svc)
+	subnet, _ := requestedSubnet(svc)
+
+	var candidates []string
+	for name, p := range c.priorities {
+		if name == key || p >= priority || c.ips.IPShared(name) {
+			continue
+		}
+		ip := c.ips.IP(name)
+		if ip == nil || (ip.To4() == nil) != isIPv6 {
+			continue
+		}
+		if subnet != nil && !subnet.Contains(ip) {
+			continue
+		}
+		pool := c.ips.Pool(name)
+		switch {
+		case requestedIP != nil:
+			if !requestedIP.Equal(ip) {
+				continue
+			}
+		case desiredPool != "":
+			if pool != desiredPool {
+				continue
+			}
+		default:
+			if c.config.Pools[pool] == nil || !c.config.Pools[pool].AutoAssign {
+				continue
+			}
+		}
+		candidates = append(candidates, name)
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		pi, pj := c.priorities[candidates[i]], c.priorities[candidates[j]]
+		if pi != pj {
+			return pi < pj
+		}
+		return candidates[i] < candidates[j]
+	})
+	return candidates[0]
+}
+
+// preempt takes the IP of the lowest priority service that holds an
+// IP svc could use, and allocates svc again. The victim only loses
+// its IP once the new allocation is made and admitted, otherwise it
+// keeps it. It returns the error of the original allocation if there
+// is nothing to preempt.
+func (c *controller) preempt(l log.Logger, key string, svc *v1.Service, priority int, allocErr error) (net.IP, error) {
+	victim := c.preemptionVictim(key, svc, priority)
+	if victim == "" {
+		return nil, allocErr
+	}
+	var saved allocator.Allocation
+	for _, al := range c.ips.Allocations() {
+		if al.Service == victim {
+			saved = al
+			break
+		}
+	}
+	c.ips.Unassign(victim)
+
+	ip, err := c.allocateIP(key, svc)
+	if err == nil {
+		ip, err = c.admitAllocation(l, key, svc, ip)
+	}
+	if err != nil {
+		c.ips.Unassign(key)
+		if rerr := c.ips.Assign(victim, saved.IP, saved.Ports, saved.SharingKey, saved.BackendKey); rerr != nil {
+			// Can't happen short of a bug, the IP was the victim's
+			// a moment ago. Let the victim allocate again.
+			level.Error(l).Log("bug", "true", "victim", victim, "ip", saved.IP, "error", rerr, "msg", "failed to give the IP back to the service we tried to preempt")
+			delete(c.priorities, victim)
+			c.released(victim, saved.IP, saved.Pool, "preempted")
+			c.client.SyncAfter(victim, 0)
+		}
+		return nil, err
+	}
+
+	delete(c.priorities, victim)
+	c.released(victim, saved.IP, saved.Pool, "preempted")
+	if c.preempted == nil {
+		c.preempted = map[string]string{}
+	}
+	c.preempted[victim] = key
+	// The victim must update its status.
+	c.client.SyncAfter(victim, 0)
+	level.Info(l).Log("event", "ipPreempted", "victim", victim, "ip", saved.IP, "msg", "preempted the IP of a lower priority service")
+	c.client.Infof(svc, "IPPreempted", "Preempted IP %q from lower priority service %q", saved.IP, victim)
+	return ip, nil
+}
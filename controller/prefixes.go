@@ -0,0 +1,100 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// extraPrefixesAnnotation lists prefixes for the speakers to
+// advertise along with the service's IP, for services that own a
+// whole prefix.
+const extraPrefixesAnnotation = "metallb.universe.tf/extra-prefixes"
+
+// requestedExtraPrefixes returns the prefixes requested by svc's
+// extra prefixes annotation, a comma-separated list of CIDRs.
+func requestedExtraPrefixes(svc *v1.Service) ([]*net.IPNet, error) {
+	a := svc.Annotations[extraPrefixesAnnotation]
+	if a == "" {
+		return nil, nil
+	}
+	var ret []*net.IPNet
+	for _, s := range strings.Split(a, ",") {
+		_, pfx, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid extra prefix %q: %s", s, err)
+		}
+		ret = append(ret, pfx)
+	}
+	return ret, nil
+}
+
+// reserveExtraPrefixes reserves the extra prefixes requested by key,
+// which has an IP, and publishes them in the status of svc for the
+// speakers to advertise. Invalid requests, or prefixes in use by
+// others, reserve nothing.
+func (c *controller) reserveExtraPrefixes(l log.Logger, key string, svc *v1.Service) {
+	prefixes, err := requestedExtraPrefixes(svc)
+	if err == nil {
+		err = c.ips.ReserveExtraPrefixes(key, prefixes)
+	}
+	if err != nil {
+		level.Error(l).Log("op", "reserveExtraPrefixes", "error", err, "msg", "not reserving extra prefixes")
+		c.client.Errorf(svc, "InvalidExtraPrefixes", "Not advertising extra prefixes: %s", err)
+		prefixes = nil
+		c.ips.ReserveExtraPrefixes(key, nil) // nolint:errcheck
+	}
+	setReservedPrefixes(svc, k8s.ExtraPrefixesCondition, prefixes)
+}
+
+// setAddressBlock publishes in the status of svc the prefix reserved
+// for key, if it requests a whole prefix.
+func (c *controller) setAddressBlock(key string, svc *v1.Service) {
+	var prefixes []*net.IPNet
+	if block, _, err := requestedBlock(key, svc); err == nil && block == "service:"+key {
+		if pfx := c.ips.Block(block); pfx != nil {
+			prefixes = append(prefixes, pfx)
+		}
+	}
+	setReservedPrefixes(svc, k8s.AddressBlockCondition, prefixes)
+}
+
+// setReservedPrefixes records in the condition cond of svc the
+// prefixes reserved for it.
+func setReservedPrefixes(svc *v1.Service, cond string, prefixes []*net.IPNet) {
+	if len(prefixes) == 0 {
+		removeCondition(svc, cond)
+		return
+	}
+	s := make([]string, 0, len(prefixes))
+	for _, pfx := range prefixes {
+		s = append(s, pfx.String())
+	}
+	meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+		Type:               cond,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: svc.Generation,
+		Reason:             "Reserved",
+		Message:            strings.Join(s, ","),
+	})
+}
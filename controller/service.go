@@ -17,50 +17,99 @@ package main
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	"go.universe.tf/metallb/internal/allocator/k8salloc"
+	"go.universe.tf/metallb/internal/k8s"
 )
 
 func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service) bool {
 	var lbIP net.IP
 
+	// A higher priority service took our IP, the status is stale.
+	if by := c.preempted[key]; by != "" {
+		delete(c.preempted, key)
+		level.Info(l).Log("event", "clearAssignment", "reason", "preempted", "by", by, "msg", "IP preempted by a higher priority service")
+		c.client.Errorf(svc, "IPPreempted", "IP preempted by higher priority service %q", by)
+		c.clearServiceState(key, svc, "preempted")
+	}
+
 	// Not a LoadBalancer, early exit. It might have been a balancer
 	// in the past, so we still need to clear LB state.
 	if svc.Spec.Type != "LoadBalancer" {
+		if c.holdIP(l, key, svc) {
+			svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+			return true
+		}
 		level.Debug(l).Log("event", "clearAssignment", "reason", "notLoadBalancer", "msg", "not a LoadBalancer")
-		c.clearServiceState(key, svc)
+		c.clearServiceState(key, svc, "notLoadBalancer")
 		// Early return, we explicitly do *not* want to reallocate
 		// an IP.
 		return true
 	}
+	c.reacquireHeldIP(l, key, svc)
 
-	// If the ClusterIP is malformed or not set we can't determine the
-	// ipFamily to use.
-	clusterIP := net.ParseIP(svc.Spec.ClusterIP)
-	if clusterIP == nil {
+	expiry, err := allocationExpiry(svc)
+	if err != nil {
+		level.Error(l).Log("op", "allocationExpiry", "error", err, "msg", "ignoring invalid allocation TTL")
+		c.client.Errorf(svc, "InvalidAllocationTTL", "Ignoring allocation TTL: %s", err)
+	}
+	if !expiry.IsZero() {
+		if left := time.Until(expiry); left > 0 {
+			c.client.SyncAfter(key, left)
+			expiry = time.Time{}
+		} else {
+			if c.ips.IP(key) != nil {
+				level.Info(l).Log("event", "clearAssignment", "reason", "expired", "msg", "allocation TTL expired, releasing IP")
+				c.client.Infof(svc, "AllocationExpired", "Allocation TTL %s expired, released IP", svc.Annotations[allocationTTLAnnotation])
+			}
+			c.clearServiceState(key, svc, "expired")
+			setExpired(svc, expiry)
+			return true
+		}
+	}
+	setExpired(svc, expiry)
+
+	priority, err := allocationPriority(svc)
+	if err != nil {
+		level.Error(l).Log("op", "allocationPriority", "error", err, "msg", "ignoring invalid allocation priority")
+		c.client.Errorf(svc, "InvalidAllocationPriority", "Ignoring allocation priority: %s", err)
+	}
+
+	// Without spec.ipFamilies nor a valid ClusterIP we can't
+	// determine the ipFamily to use.
+	//
+	// Dual-stack services get a single IP too, of the first of
+	// spec.ipFamilies. So the one ingress entry is always of the
+	// primary family, and doesn't change between reconciles.
+	family := k8s.IPFamily(svc)
+	if family == "" {
 		level.Info(l).Log("event", "clearAssignment", "reason", "noClusterIP", "msg", "No ClusterIP")
-		c.clearServiceState(key, svc)
+		c.clearServiceState(key, svc, "noClusterIP")
 		return true
 	}
 
 	// The assigned LB IP is the end state of convergence. If there's
 	// none or a malformed one, nuke all controlled state so that we
-	// start converging from a clean slate.
-	if len(svc.Status.LoadBalancer.Ingress) == 1 {
-		lbIP = net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
-	}
+	// start converging from a clean slate. Extra ingress entries, or
+	// their order, don't change the IP, they are just dropped from
+	// the status below.
+	lbIP = k8s.LoadBalancerIP(svc)
 	if lbIP == nil {
-		c.clearServiceState(key, svc)
+		c.clearServiceState(key, svc, "noIPInStatus")
 	}
 
 	// Clear the lbIP if it has a different ipFamily compared to the clusterIP.
 	// (this should not happen since the "ipFamily" of a service is immutable)
-	if (clusterIP.To4() == nil) != (lbIP.To4() == nil) {
-		c.clearServiceState(key, svc)
+	if lbIP != nil && (lbIP.To4() == nil) != (family == v1.IPv6Protocol) {
+		c.clearServiceState(key, svc, "wrongIPFamily")
 		lbIP = nil
 	}
 
@@ -70,19 +119,27 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 	if lbIP != nil {
 		// This assign is idempotent if the config is consistent,
 		// otherwise it'll fail and tell us why.
-		if err := c.ips.Assign(key, lbIP, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc)); err != nil {
+		if err := c.assignIP(key, svc, lbIP); err != nil {
 			level.Info(l).Log("event", "clearAssignment", "reason", "notAllowedByConfig", "msg", "current IP not allowed by config, clearing")
-			c.clearServiceState(key, svc)
+			c.clearServiceState(key, svc, "notAllowedByConfig")
 			lbIP = nil
 		}
 
 		// The user might also have changed the pool annotation, and
 		// requested a different pool than the one that is currently
-		// allocated.
+		// allocated. The default pool of the namespace only applies
+		// to new allocations, changing it doesn't move services.
 		desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
 		if lbIP != nil && desiredPool != "" && c.ips.Pool(key) != desiredPool {
 			level.Info(l).Log("event", "clearAssignment", "reason", "differentPoolRequested", "msg", "user requested a different pool than the one currently assigned")
-			c.clearServiceState(key, svc)
+			c.clearServiceState(key, svc, "differentPoolRequested")
+			lbIP = nil
+		}
+
+		// Same for the subnet of the pool.
+		if subnet, err := requestedSubnet(svc); lbIP != nil && err == nil && subnet != nil && !subnet.Contains(lbIP) {
+			level.Info(l).Log("event", "clearAssignment", "reason", "differentSubnetRequested", "msg", "user requested a different subnet than the one currently assigned")
+			c.clearServiceState(key, svc, "differentSubnetRequested")
 			lbIP = nil
 		}
 	}
@@ -92,7 +149,7 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 	// to meet the user's demands.
 	if svc.Spec.LoadBalancerIP != "" && svc.Spec.LoadBalancerIP != lbIP.String() {
 		level.Info(l).Log("event", "clearAssignment", "reason", "differentIPRequested", "msg", "user requested a different IP than the one currently assigned")
-		c.clearServiceState(key, svc)
+		c.clearServiceState(key, svc, "differentIPRequested")
 		lbIP = nil
 	}
 
@@ -103,23 +160,31 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 			return false
 		}
 		ip, err := c.allocateIP(key, svc)
+		if err == nil {
+			ip, err = c.admitAllocation(l, key, svc, ip)
+		} else if priority > 0 {
+			ip, err = c.preempt(l, key, svc, priority, err)
+		}
 		if err != nil {
 			level.Error(l).Log("op", "allocateIP", "error", err, "msg", "IP allocation failed")
 			c.client.Errorf(svc, "AllocationFailed", "Failed to allocate IP for %q: %s", key, err)
 			// The outer controller loop will retry converging this
-			// service when another service gets deleted, so there's
-			// nothing to do here but wait to get called again later.
+			// service when another service releases its IP or the
+			// pools change, so there's nothing to do here but wait to
+			// get called again later.
 			return true
 		}
 		lbIP = ip
 		level.Info(l).Log("event", "ipAllocated", "ip", lbIP, "msg", "IP address assigned by controller")
-		c.client.Infof(svc, "IPAllocated", "Assigned IP %q", lbIP)
+		c.auditAllocation(key, "ipAllocated", lbIP, c.ips.Pool(key), "")
+		pool := c.ips.Pool(key)
+		c.client.AnnotatedInfof(svc, poolAnnotations(pool, c.config.Pools[pool]), "IPAllocated", "Assigned IP %q from pool %q%s", lbIP, pool, poolSummary(c.config.Pools[pool]))
 	}
 
 	if lbIP == nil {
 		level.Error(l).Log("bug", "true", "msg", "internal error: failed to allocate an IP, but did not exit convergeService early!")
 		c.client.Errorf(svc, "InternalError", "didn't allocate an IP but also did not fail")
-		c.clearServiceState(key, svc)
+		c.clearServiceState(key, svc, "internalError")
 		return true
 	}
 
@@ -127,30 +192,158 @@ func (c *controller) convergeBalancer(l log.Logger, key string, svc *v1.Service)
 	if pool == "" || c.config.Pools[pool] == nil {
 		level.Error(l).Log("bug", "true", "ip", lbIP, "msg", "internal error: allocated IP has no matching address pool")
 		c.client.Errorf(svc, "InternalError", "allocated an IP that has no pool")
-		c.clearServiceState(key, svc)
+		c.clearServiceState(key, svc, "internalError")
+		return true
+	}
+	if r := c.poolReservation(key, pool); r != "" {
+		level.Error(l).Log("op", "allocateIP", "pool", pool, "reservedFor", r, "msg", "pool is reserved")
+		c.client.Errorf(svc, "AllocationFailed", "Failed to allocate IP for %q: pool %q is reserved for %s", key, pool, r)
+		c.clearServiceState(key, svc, "reservedPool")
 		return true
 	}
 
+	if c.priorities == nil {
+		c.priorities = map[string]int{}
+	}
+	c.priorities[key] = priority
+	c.reserveExtraPrefixes(l, key, svc)
+	c.setAddressBlock(key, svc)
+
 	// At this point, we have an IP selected somehow, all that remains
 	// is to program the data plane.
-	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: lbIP.String()}}
+	ingress := v1.LoadBalancerIngress{IP: lbIP.String()}
+	if hostname := svc.Annotations[hostnameAnnotation]; hostname != "" {
+		if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+			level.Error(l).Log("op", "setHostname", "error", strings.Join(errs, ", "), "msg", "invalid hostname requested, not publishing it")
+			c.client.Errorf(svc, "InvalidHostname", "Ignoring invalid hostname %q: %s", hostname, strings.Join(errs, ", "))
+		} else {
+			ingress.Hostname = hostname
+		}
+	}
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{ingress}
 	return true
 }
 
+// admitAllocation submits the new allocation of ip to key to the
+// allocation policy and the IPClaim admission, which may change the
+// IP. On error, key is left without an IP.
+func (c *controller) admitAllocation(l log.Logger, key string, svc *v1.Service, ip net.IP) (net.IP, error) {
+	ip, err := c.reviewAllocation(l, key, svc, ip)
+	if err != nil {
+		return nil, err
+	}
+	return c.claimIP(key, svc, ip)
+}
+
+// hostnameAnnotation requests a DNS name to publish in the service's
+// load balancer status, alongside the allocated IP. MetalLB does not
+// manage the DNS record itself.
+const hostnameAnnotation = "metallb.universe.tf/hostname"
+
+// desiredPool returns the pool svc requests with its pool
+// annotation, or else the default pool of its namespace, "" if
+// neither is set.
+func (c *controller) desiredPool(svc *v1.Service) string {
+	if pool := svc.Annotations["metallb.universe.tf/address-pool"]; pool != "" {
+		return pool
+	}
+	return c.client.DefaultPool(svc.Namespace)
+}
+
+// subnetAnnotation restricts the allocation of a service to a subnet
+// of its pool.
+const subnetAnnotation = "metallb.universe.tf/address-pool-subnet"
+
+// requestedSubnet returns the subnet requested by svc, nil if it
+// doesn't request one.
+func requestedSubnet(svc *v1.Service) (*net.IPNet, error) {
+	s := svc.Annotations[subnetAnnotation]
+	if s == "" {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", subnetAnnotation, s)
+	}
+	return subnet, nil
+}
+
+// blockAnnotation reserves a contiguous block of addresses for the
+// services that name it, e.g. "frontend/29", so that they get
+// adjacent IPs. Blocks are scoped to the namespace.
+const blockAnnotation = "metallb.universe.tf/address-block"
+
+// prefixLengthAnnotation allocates a whole prefix of the given length
+// to the service, e.g. "31", for applications that need a range of
+// addresses. The service's IP is the first usable address of the
+// prefix, and the speakers advertise the prefix with BGP.
+const prefixLengthAnnotation = "metallb.universe.tf/address-prefix-length"
+
+// requestedBlock returns the namespaced name and the prefix length
+// of the address block requested by the service key, "" if it
+// requests none. A service requesting a whole prefix gets a block of
+// its own.
+func requestedBlock(key string, svc *v1.Service) (string, int, error) {
+	s := svc.Annotations[blockAnnotation]
+	if l := svc.Annotations[prefixLengthAnnotation]; l != "" {
+		if s != "" {
+			return "", 0, fmt.Errorf("%s and %s are mutually exclusive", blockAnnotation, prefixLengthAnnotation)
+		}
+		size, err := strconv.Atoi(l)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid %s %q", prefixLengthAnnotation, l)
+		}
+		return "service:" + key, size, nil
+	}
+	if s == "" {
+		return "", 0, nil
+	}
+	i := strings.LastIndex(s, "/")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("invalid %s %q, must be <name>/<prefix length>", blockAnnotation, s)
+	}
+	size, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid %s %q, must be <name>/<prefix length>", blockAnnotation, s)
+	}
+	return svc.Namespace + "/" + s[:i], size, nil
+}
+
+// svcBlockAnnotation returns the annotation requesting svc's address
+// block.
+func svcBlockAnnotation(svc *v1.Service) string {
+	if svc.Annotations[prefixLengthAnnotation] != "" {
+		return prefixLengthAnnotation
+	}
+	return blockAnnotation
+}
+
+// assignIP assigns ip to the service key, in its address block if it
+// requests a valid one. Invalid requests are reported by allocateIP.
+func (c *controller) assignIP(key string, svc *v1.Service, ip net.IP) error {
+	if block, size, err := requestedBlock(key, svc); err == nil && block != "" {
+		return c.ips.AssignInBlock(key, ip, block, size, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+	}
+	return c.ips.Assign(key, ip, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+}
+
 // clearServiceState clears all fields that are actively managed by
 // this controller.
-func (c *controller) clearServiceState(key string, svc *v1.Service) {
-	c.ips.Unassign(key)
+func (c *controller) clearServiceState(key string, svc *v1.Service, reason string) {
+	c.release(key, reason)
 	svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+	setReservedPrefixes(svc, k8s.ExtraPrefixesCondition, nil)
+	setReservedPrefixes(svc, k8s.AddressBlockCondition, nil)
+	removeCondition(svc, k8s.IPHeldCondition)
 }
 
 func (c *controller) allocateIP(key string, svc *v1.Service) (net.IP, error) {
-	clusterIP := net.ParseIP(svc.Spec.ClusterIP)
-	if clusterIP == nil {
-		// (we should never get here because the caller ensured that Spec.ClusterIP != nil)
+	family := k8s.IPFamily(svc)
+	if family == "" {
+		// (we should never get here because the caller ensured that the family is known)
 		return nil, fmt.Errorf("invalid ClusterIP [%s], can't determine family", svc.Spec.ClusterIP)
 	}
-	isIPv6 := clusterIP.To4() == nil
+	isIPv6 := family == v1.IPv6Protocol
 
 	// If the user asked for a specific IP, try that.
 	if svc.Spec.LoadBalancerIP != "" {
@@ -161,14 +354,37 @@ func (c *controller) allocateIP(key string, svc *v1.Service) (net.IP, error) {
 		if (ip.To4() == nil) != isIPv6 {
 			return nil, fmt.Errorf("requested spec.loadBalancerIP %q does not match the ipFamily of the service", svc.Spec.LoadBalancerIP)
 		}
-		if err := c.ips.Assign(key, ip, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc)); err != nil {
+		if err := c.assignIP(key, svc, ip); err != nil {
 			return nil, err
 		}
 		return ip, nil
 	}
 
-	// Otherwise, did the user ask for a specific pool?
-	desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
+	// Otherwise, did the user ask for a specific subnet, possibly of
+	// a specific pool?
+	desiredPool := c.desiredPool(svc)
+	subnet, err := requestedSubnet(svc)
+	if err != nil {
+		return nil, err
+	}
+	block, size, err := requestedBlock(key, svc)
+	if err != nil {
+		return nil, err
+	}
+	if block != "" {
+		if subnet != nil {
+			return nil, fmt.Errorf("%s and %s are mutually exclusive", svcBlockAnnotation(svc), subnetAnnotation)
+		}
+		return c.ips.AllocateInBlock(key, isIPv6, block, size, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+	}
+	if subnet != nil {
+		if (subnet.IP.To4() == nil) != isIPv6 {
+			return nil, fmt.Errorf("requested subnet %q does not match the ipFamily of the service", subnet)
+		}
+		return c.ips.AllocateFromSubnet(key, subnet, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
+	}
+
+	// Or a specific pool?
 	if desiredPool != "" {
 		ip, err := c.ips.AllocateFromPool(key, isIPv6, desiredPool, k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc))
 		if err != nil {
@@ -0,0 +1,69 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// allocationTTLAnnotation limits how long a service keeps its IP
+// after its creation, for ephemeral services that may be abandoned.
+const allocationTTLAnnotation = "metallb.universe.tf/allocation-ttl"
+
+// expiredCondition is the condition of the services whose allocation
+// TTL expired.
+const expiredCondition = "metallb.universe.tf/AllocationExpired"
+
+// allocationExpiry returns when the allocation of svc expires, or the
+// zero time if it doesn't.
+func allocationExpiry(svc *v1.Service) (time.Time, error) {
+	a := svc.Annotations[allocationTTLAnnotation]
+	if a == "" || svc.CreationTimestamp.IsZero() {
+		return time.Time{}, nil
+	}
+	ttl, err := time.ParseDuration(a)
+	if err != nil || ttl <= 0 {
+		return time.Time{}, fmt.Errorf("invalid allocation TTL %q, must be a positive duration like 72h", a)
+	}
+	return svc.CreationTimestamp.Add(ttl), nil
+}
+
+// setExpired records in the conditions of svc whether its allocation
+// expired.
+func setExpired(svc *v1.Service, expiry time.Time) {
+	if expiry.IsZero() {
+		removeCondition(svc, expiredCondition)
+		return
+	}
+	meta.SetStatusCondition(&svc.Status.Conditions, metav1.Condition{
+		Type:               expiredCondition,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: svc.Generation,
+		LastTransitionTime: metav1.NewTime(expiry),
+		Reason:             "TTLExpired",
+		Message:            fmt.Sprintf("The IP allocation expired, %s after the service's creation", svc.Annotations[allocationTTLAnnotation]),
+	})
+}
+
+// removeCondition removes the condition cond of svc, if it has it.
+func removeCondition(svc *v1.Service, cond string) {
+	// RemoveStatusCondition panics on empty lists.
+	if meta.FindStatusCondition(svc.Status.Conditions, cond) != nil {
+		meta.RemoveStatusCondition(&svc.Status.Conditions, cond)
+	}
+}
@@ -0,0 +1,237 @@
+// Package alert sends alerts about the critical conditions MetalLB
+// detects to an HTTP receiver, either Alertmanager or a generic
+// webhook, for clusters without a Prometheus stack alerting on
+// MetalLB's metrics.
+package alert // import "go.universe.tf/metallb/internal/alert"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+const (
+	// FormatAlertmanager posts alerts to the Alertmanager v2 API,
+	// e.g. http://alertmanager:9093/api/v2/alerts.
+	FormatAlertmanager = "alertmanager"
+	// FormatGeneric posts each alert change as a JSON object.
+	FormatGeneric = "generic"
+
+	// How often firing alerts are sent again to Alertmanager, which
+	// resolves the alerts that aren't.
+	resendInterval = time.Minute
+	// How long Alertmanager keeps an alert firing without hearing
+	// from it again.
+	firingTimeout = 5 * resendInterval
+)
+
+// Alert is a critical condition.
+type Alert struct {
+	// The name of the condition, e.g. MetalLBPoolExhausted.
+	Name string
+	// What the condition is about, e.g. the pool. Together with
+	// Name, identifies the alert.
+	Labels map[string]string
+	// A human readable description.
+	Summary string
+}
+
+// key returns the identity of the alert.
+func (a Alert) key() string {
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := []string{a.Name}
+	for _, k := range keys {
+		ret = append(ret, k+"="+a.Labels[k])
+	}
+	return strings.Join(ret, ",")
+}
+
+// event is an alert change to post.
+type event struct {
+	alert    Alert
+	startsAt time.Time
+	// Zero while the alert is firing.
+	endsAt time.Time
+}
+
+// Sink sends alerts to a receiver. Only the changes of the alerts
+// are sent, in the background so that a slow receiver doesn't hold
+// back the caller.
+type Sink struct {
+	url    string
+	format string
+	source string
+	client *http.Client
+	queue  chan event
+
+	mu sync.Mutex
+	// The firing alerts, by key, with when they started.
+	firing map[string]*event
+}
+
+// New creates a Sink posting to url in format, one of FormatGeneric
+// or FormatAlertmanager, until stopCh is closed. source identifies the
+// sender, e.g. the node of a speaker, and is added to the alerts'
+// descriptions.
+func New(l log.Logger, url, format, source string, stopCh <-chan struct{}) (*Sink, error) {
+	if format != FormatGeneric && format != FormatAlertmanager {
+		return nil, fmt.Errorf("unknown alert format %q, must be %s or %s", format, FormatGeneric, FormatAlertmanager)
+	}
+	s := &Sink{
+		url:    url,
+		format: format,
+		source: source,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan event, 100),
+		firing: map[string]*event{},
+	}
+	go s.run(l, stopCh)
+	return s, nil
+}
+
+// Set fires a if firing, or resolves it if it was firing.
+func (s *Sink) Set(l log.Logger, a Alert, firing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := a.key()
+	ev := s.firing[k]
+	switch {
+	case firing && ev == nil:
+		ev = &event{alert: a, startsAt: time.Now()}
+		s.firing[k] = ev
+		level.Warn(l).Log("event", "alertFiring", "alert", a.Name, "msg", a.Summary)
+	case !firing && ev != nil:
+		delete(s.firing, k)
+		ev = &event{alert: ev.alert, startsAt: ev.startsAt, endsAt: time.Now()}
+		level.Info(l).Log("event", "alertResolved", "alert", a.Name, "msg", "alert resolved")
+	default:
+		return
+	}
+	s.send(l, *ev)
+}
+
+// send queues ev for posting, dropping it if the queue is full.
+func (s *Sink) send(l log.Logger, ev event) {
+	select {
+	case s.queue <- ev:
+	default:
+		level.Error(l).Log("op", "alert", "alert", ev.alert.Name, "error", "queue full", "msg", "dropped alert")
+	}
+}
+
+func (s *Sink) run(l log.Logger, stopCh <-chan struct{}) {
+	resend := time.NewTicker(resendInterval)
+	defer resend.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case ev := <-s.queue:
+			if err := s.post(ev, time.Now()); err != nil {
+				level.Error(l).Log("op", "alert", "alert", ev.alert.Name, "error", err, "msg", "failed to post alert")
+			}
+		case <-resend.C:
+			if s.format != FormatAlertmanager {
+				continue
+			}
+			s.mu.Lock()
+			evs := make([]event, 0, len(s.firing))
+			for _, ev := range s.firing {
+				evs = append(evs, *ev)
+			}
+			s.mu.Unlock()
+			for _, ev := range evs {
+				if err := s.post(ev, time.Now()); err != nil {
+					level.Error(l).Log("op", "alert", "alert", ev.alert.Name, "error", err, "msg", "failed to post alert")
+				}
+			}
+		}
+	}
+}
+
+// genericAlert is an alert change, as posted in FormatGeneric.
+type genericAlert struct {
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Labels   map[string]string `json:"labels"`
+	Summary  string            `json:"summary"`
+	Source   string            `json:"source,omitempty"`
+	StartsAt time.Time         `json:"startsAt"`
+	EndsAt   *time.Time        `json:"endsAt,omitempty"`
+}
+
+// alertmanagerAlert is an alert, as posted in FormatAlertmanager.
+type alertmanagerAlert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// body returns the body to post for ev at now.
+func (s *Sink) body(ev event, now time.Time) ([]byte, error) {
+	if s.format == FormatGeneric {
+		ga := genericAlert{
+			Name:     ev.alert.Name,
+			Status:   "firing",
+			Labels:   ev.alert.Labels,
+			Summary:  ev.alert.Summary,
+			Source:   s.source,
+			StartsAt: ev.startsAt,
+		}
+		if !ev.endsAt.IsZero() {
+			ga.Status = "resolved"
+			ga.EndsAt = &ev.endsAt
+		}
+		return json.Marshal(ga)
+	}
+
+	labels := map[string]string{
+		"alertname": ev.alert.Name,
+		"severity":  "critical",
+	}
+	for k, v := range ev.alert.Labels {
+		labels[k] = v
+	}
+	am := alertmanagerAlert{
+		Labels:      labels,
+		Annotations: map[string]string{"summary": ev.alert.Summary},
+		StartsAt:    ev.startsAt,
+		EndsAt:      ev.endsAt,
+	}
+	if s.source != "" {
+		am.Annotations["source"] = s.source
+	}
+	if am.EndsAt.IsZero() {
+		am.EndsAt = now.Add(firingTimeout)
+	}
+	return json.Marshal([]alertmanagerAlert{am})
+}
+
+func (s *Sink) post(ev event, now time.Time) error {
+	bs, err := s.body(ev, now)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
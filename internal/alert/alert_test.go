@@ -0,0 +1,97 @@
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestSink(t *testing.T) {
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		bodies <- bs
+	}))
+	defer srv.Close()
+
+	next := func() []byte {
+		t.Helper()
+		select {
+		case bs := <-bodies:
+			return bs
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for alert")
+			return nil
+		}
+	}
+
+	l := log.NewNopLogger()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	a := Alert{
+		Name:    "MetalLBPoolExhausted",
+		Labels:  map[string]string{"pool": "default"},
+		Summary: "pool default has no free address",
+	}
+
+	generic, err := New(l, srv.URL, FormatGeneric, "controller", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generic.Set(l, a, true)
+	// Already firing, not sent again.
+	generic.Set(l, a, true)
+	generic.Set(l, a, false)
+	// Not firing, nothing to resolve.
+	generic.Set(l, a, false)
+	for _, want := range []string{"firing", "resolved"} {
+		var got genericAlert
+		if err := json.Unmarshal(next(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != a.Name || got.Status != want || got.Labels["pool"] != "default" || got.Source != "controller" {
+			t.Fatalf("got alert %+v, want %s %s", got, want, a.Name)
+		}
+		if (got.EndsAt != nil) != (want == "resolved") {
+			t.Fatalf("got endsAt %v for %s alert", got.EndsAt, want)
+		}
+	}
+	select {
+	case bs := <-bodies:
+		t.Fatalf("got unexpected alert %s", bs)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	am, err := New(l, srv.URL, FormatAlertmanager, "", stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.Set(l, a, true)
+	var got []alertmanagerAlert
+	if err := json.Unmarshal(next(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Labels["alertname"] != a.Name || got[0].Labels["pool"] != "default" || got[0].Annotations["summary"] != a.Summary {
+		t.Fatalf("got Alertmanager alerts %+v", got)
+	}
+	// Firing alerts expire unless resent.
+	if !got[0].EndsAt.After(time.Now()) {
+		t.Fatalf("firing alert ends at %s, in the past", got[0].EndsAt)
+	}
+	am.Set(l, a, false)
+	if err := json.Unmarshal(next(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got[0].EndsAt.After(time.Now()) {
+		t.Fatalf("resolved alert ends at %s, in the future", got[0].EndsAt)
+	}
+
+	if _, err := New(l, srv.URL, "pagerduty", "", stopCh); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"math/big"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"go.universe.tf/metallb/internal/config"
 
@@ -21,6 +26,28 @@ type Allocator struct {
 	portsInUse      map[string]map[Port]string // ip.String() -> Port -> svc
 	servicesOnIP    map[string]map[string]bool // ip.String() -> svc -> allocated?
 	poolIPsInUse    map[string]map[string]int  // poolName -> ip.String() -> number of users
+	sharingKeyIPs   map[string]map[string]bool // sharing key -> ip.String() -> in use?
+	blocks          map[string]*addressBlock   // block name -> block
+	extraPrefixes   map[string][]*net.IPNet    // svc -> reserved extra prefixes
+
+	// Guards the pools and their addresses in use against the
+	// freeBlockCollector, and its cache of the largest free block of
+	// each pool. Pools missing from freeBlocks changed since the last
+	// scrape.
+	statsMu    sync.Mutex
+	freeBlocks map[string]float64
+
+	stats *metrics
+
+	// Incremented on every change of an allocation, so that
+	// consumers of the allocations can tell whether they changed.
+	// The generations restart with every allocator, which epoch
+	// tells apart.
+	generation uint64
+	epoch      int64
+
+	// Picks pools for weighted allocation.
+	rand *rand.Rand
 }
 
 // Port represents one port in use by a service.
@@ -43,6 +70,8 @@ type alloc struct {
 	pool  string
 	ip    net.IP
 	ports []Port
+	// The address block the IP is in, if any.
+	block string
 	key
 }
 
@@ -56,6 +85,14 @@ func New() *Allocator {
 		portsInUse:      map[string]map[Port]string{},
 		servicesOnIP:    map[string]map[string]bool{},
 		poolIPsInUse:    map[string]map[string]int{},
+		sharingKeyIPs:   map[string]map[string]bool{},
+		blocks:          map[string]*addressBlock{},
+		extraPrefixes:   map[string][]*net.IPNet{},
+		freeBlocks:      map[string]float64{},
+		stats:           newMetrics(),
+
+		epoch: time.Now().UnixNano(),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
@@ -73,30 +110,52 @@ func (a *Allocator) SetPools(pools map[string]*config.Pool) error {
 
 	for n := range a.pools {
 		if pools[n] == nil {
-			stats.poolCapacity.DeleteLabelValues(n)
-			stats.poolActive.DeleteLabelValues(n)
-			stats.poolAllocated.DeleteLabelValues(n)
+			a.stats.poolCapacity.DeleteLabelValues(n)
+			a.stats.poolActive.DeleteLabelValues(n)
+			a.stats.poolAllocated.DeleteLabelValues(n)
 		}
 	}
 
+	// The allocations are exported with the metadata of their pool,
+	// so changing it changes them.
+	for n, p := range pools {
+		if old := a.pools[n]; old != nil && len(a.poolIPsInUse[n]) > 0 && (old.Description != p.Description || old.ReverseDNSZone != p.ReverseDNSZone || old.Owner != p.Owner) {
+			defer a.changed()
+			break
+		}
+	}
+
+	a.statsMu.Lock()
 	a.pools = pools
+	a.freeBlocks = map[string]float64{}
+	a.statsMu.Unlock()
 
 	// Need to rearrange existing pool mappings and counts
 	for svc, alloc := range a.allocated {
 		pool := poolFor(a.pools, alloc.ip)
 		if pool != alloc.pool {
-			a.Unassign(svc)
+			a.unassign(svc)
 			alloc.pool = pool
 			// Use the internal assign, we know for a fact the IP is
 			// still usable.
 			a.assign(svc, alloc)
 		}
 	}
+	// The controller reserves them again if they are still valid.
+	for svc, reserved := range a.extraPrefixes {
+		alloc := a.allocated[svc]
+		for _, pfx := range reserved {
+			if alloc == nil || !cidrsContain(a.pools[alloc.pool].CIDR, pfx) {
+				delete(a.extraPrefixes, svc)
+				break
+			}
+		}
+	}
 
 	// Refresh or initiate stats
 	for n, p := range a.pools {
-		stats.poolCapacity.WithLabelValues(n).Set(float64(poolCount(p)))
-		stats.poolActive.WithLabelValues(n).Set(float64(len(a.poolIPsInUse[n])))
+		a.stats.poolCapacity.WithLabelValues(n).Set(float64(poolCount(p)))
+		a.stats.poolActive.WithLabelValues(n).Set(float64(len(a.poolIPsInUse[n])))
 	}
 
 	return nil
@@ -105,7 +164,13 @@ func (a *Allocator) SetPools(pools map[string]*config.Pool) error {
 // assign unconditionally updates internal state to reflect svc's
 // allocation of alloc. Caller must ensure that this call is safe.
 func (a *Allocator) assign(svc string, alloc *alloc) {
-	a.Unassign(svc)
+	// Unassigning the last member of a block releases it, keep it.
+	block := a.blocks[alloc.block]
+	prev := a.allocated[svc]
+	a.unassign(svc)
+	if block != nil {
+		a.blocks[alloc.block] = block
+	}
 	a.allocated[svc] = alloc
 	a.sharingKeyForIP[alloc.ip.String()] = &alloc.key
 	if a.portsInUse[alloc.ip.String()] == nil {
@@ -118,22 +183,87 @@ func (a *Allocator) assign(svc string, alloc *alloc) {
 		a.servicesOnIP[alloc.ip.String()] = map[string]bool{}
 	}
 	a.servicesOnIP[alloc.ip.String()][svc] = true
+	a.statsMu.Lock()
 	if a.poolIPsInUse[alloc.pool] == nil {
 		a.poolIPsInUse[alloc.pool] = map[string]int{}
 	}
 	a.poolIPsInUse[alloc.pool][alloc.ip.String()]++
+	delete(a.freeBlocks, alloc.pool)
+	a.statsMu.Unlock()
+	if block != nil {
+		block.members[svc] = true
+	}
+
+	a.stats.poolCapacity.WithLabelValues(alloc.pool).Set(float64(poolCount(a.pools[alloc.pool])))
+	a.stats.poolActive.WithLabelValues(alloc.pool).Set(float64(len(a.poolIPsInUse[alloc.pool])))
+	a.sharingStats(alloc.ip.String(), alloc.sharing)
+	if !sameAlloc(prev, alloc) {
+		a.changed()
+	}
+}
+
+// sameAlloc returns whether a and b allocate the same IP and ports
+// from the same pool, with the same keys.
+func sameAlloc(a, b *alloc) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.pool != b.pool || !a.ip.Equal(b.ip) || a.block != b.block || a.key != b.key || len(a.ports) != len(b.ports) {
+		return false
+	}
+	for i := range a.ports {
+		if a.ports[i] != b.ports[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// changed records a change of the allocations.
+func (a *Allocator) changed() {
+	a.generation++
+	a.stats.generation.Set(float64(a.generation))
+}
+
+// Generation returns the number of changes to the allocations since
+// the allocator was created. It only grows, consumers of the
+// allocations can skip rereading them while it stays the same.
+func (a *Allocator) Generation() uint64 {
+	return a.generation
+}
 
-	stats.poolCapacity.WithLabelValues(alloc.pool).Set(float64(poolCount(a.pools[alloc.pool])))
-	stats.poolActive.WithLabelValues(alloc.pool).Set(float64(len(a.poolIPsInUse[alloc.pool])))
+// Epoch returns when the allocator was created, in nanoseconds since
+// the Unix epoch. Generations are only comparable within an epoch,
+// e.g. across the restarts of the controller.
+func (a *Allocator) Epoch() int64 {
+	return a.epoch
 }
 
 // Assign assigns the requested ip to svc, if the assignment is
 // permissible by sharingKey and backendKey.
 func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, backendKey string) error {
+	return a.assignInBlock(svc, ip, "", ports, sharingKey, backendKey)
+}
+
+// assignInBlock assigns ip to svc as a member of the address block
+// named block, or of none if empty.
+func (a *Allocator) assignInBlock(svc string, ip net.IP, block string, ports []Port, sharingKey, backendKey string) error {
 	pool := poolFor(a.pools, ip)
 	if pool == "" {
 		return fmt.Errorf("%q is not allowed in config", ip)
 	}
+	if err := checkPorts(pool, a.pools[pool], ports); err != nil {
+		return err
+	}
+	if other := a.blockOf(ip); other != block {
+		if other == "" {
+			return fmt.Errorf("%q is not in address block %q", ip, block)
+		}
+		return fmt.Errorf("%q is reserved for address block %q", ip, other)
+	}
+	if owner := a.extraPrefixOwner(ip); owner != "" && owner != svc {
+		return fmt.Errorf("%q is reserved by the extra prefixes of %q", ip, owner)
+	}
 	sk := &key{
 		sharing: sharingKey,
 		backend: backendKey,
@@ -154,13 +284,19 @@ func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, back
 				}
 			}
 			if len(otherSvcs) > 0 {
-				return fmt.Errorf("can't change sharing key for %q, address also in use by %s: %w", svc, strings.Join(otherSvcs, ","), err)
+				sort.Strings(otherSvcs)
+				if a.servicesOnIP[ip.String()][svc] {
+					return fmt.Errorf("can't change sharing key for %q, address also in use by %s: %w", svc, strings.Join(otherSvcs, ","), err)
+				}
+				return fmt.Errorf("%q can't share %q with %s: %w", svc, ip, strings.Join(otherSvcs, ","), err)
 			}
 		}
 
+		// Ports only conflict on the same protocol, e.g. DNS services
+		// can share an IP for TCP and UDP port 53.
 		for _, port := range ports {
 			if curSvc, ok := a.portsInUse[ip.String()][port]; ok && curSvc != svc {
-				return fmt.Errorf("port %s is already in use on %q", port, ip)
+				return fmt.Errorf("port %s is already in use on %q by %q", port, ip, curSvc)
 			}
 		}
 	}
@@ -174,6 +310,7 @@ func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, back
 		pool:  pool,
 		ip:    ip,
 		ports: make([]Port, len(ports)),
+		block: block,
 		key:   *sk,
 	}
 	for i, port := range ports {
@@ -184,8 +321,20 @@ func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, back
 	return nil
 }
 
-// Unassign frees the IP associated with service, if any.
+// Unassign frees the IP associated with service, and its extra
+// prefixes, if any.
 func (a *Allocator) Unassign(svc string) bool {
+	delete(a.extraPrefixes, svc)
+	if !a.unassign(svc) {
+		return false
+	}
+	a.changed()
+	return true
+}
+
+// unassign frees the IP associated with service, if any, without
+// recording a change.
+func (a *Allocator) unassign(svc string) bool {
 	if a.allocated[svc] == nil {
 		return false
 	}
@@ -199,20 +348,54 @@ func (a *Allocator) Unassign(svc string) bool {
 		delete(a.portsInUse[al.ip.String()], port)
 	}
 	delete(a.servicesOnIP[al.ip.String()], svc)
+	if b := a.blocks[al.block]; b != nil {
+		delete(b.members, svc)
+		if len(b.members) == 0 {
+			delete(a.blocks, al.block)
+		}
+	}
 	if len(a.portsInUse[al.ip.String()]) == 0 {
 		delete(a.portsInUse, al.ip.String())
 		delete(a.sharingKeyForIP, al.ip.String())
 	}
+	a.statsMu.Lock()
 	a.poolIPsInUse[al.pool][al.ip.String()]--
 	if a.poolIPsInUse[al.pool][al.ip.String()] == 0 {
 		// Explicitly delete unused IPs from the pool, so that len()
 		// is an accurate count of IPs in use.
 		delete(a.poolIPsInUse[al.pool], al.ip.String())
 	}
-	stats.poolActive.WithLabelValues(al.pool).Set(float64(len(a.poolIPsInUse[al.pool])))
+	delete(a.freeBlocks, al.pool)
+	a.statsMu.Unlock()
+	a.stats.poolActive.WithLabelValues(al.pool).Set(float64(len(a.poolIPsInUse[al.pool])))
+	a.sharingStats(al.ip.String(), al.sharing)
 	return true
 }
 
+// sharingStats updates the sharing metrics of ip, whose services
+// use sharingKey.
+func (a *Allocator) sharingStats(ip, sharingKey string) {
+	if sharingKey == "" {
+		return
+	}
+	if a.sharingKeyIPs[sharingKey] == nil {
+		a.sharingKeyIPs[sharingKey] = map[string]bool{}
+	}
+	if n := len(a.servicesOnIP[ip]); n > 0 {
+		a.sharingKeyIPs[sharingKey][ip] = true
+		a.stats.ipServices.WithLabelValues(ip, sharingKey).Set(float64(n))
+	} else {
+		delete(a.sharingKeyIPs[sharingKey], ip)
+		a.stats.ipServices.DeleteLabelValues(ip, sharingKey)
+	}
+	if n := len(a.sharingKeyIPs[sharingKey]); n > 0 {
+		a.stats.sharingKeyIPs.WithLabelValues(sharingKey).Set(float64(n))
+	} else {
+		delete(a.sharingKeyIPs, sharingKey)
+		a.stats.sharingKeyIPs.DeleteLabelValues(sharingKey)
+	}
+}
+
 func cidrIsIPv6(cidr *net.IPNet) bool {
 	return cidr.IP.To4() == nil
 }
@@ -238,7 +421,11 @@ func (a *Allocator) AllocateFromPool(svc string, isIPv6 bool, poolName string, p
 	if pool == nil {
 		return nil, fmt.Errorf("unknown pool %q", poolName)
 	}
+	if err := checkPorts(poolName, pool, ports); err != nil {
+		return nil, err
+	}
 
+	var sharingErr error
 	for _, cidr := range pool.CIDR {
 		if cidrIsIPv6(cidr) != isIPv6 {
 			// Not the right ip-family
@@ -252,16 +439,78 @@ func (a *Allocator) AllocateFromPool(svc string, isIPv6 bool, poolName string, p
 			}
 			// Somewhat inefficiently brute-force by invoking the
 			// IP-specific allocator.
-			if err := a.Assign(svc, ip, ports, sharingKey, backendKey); err == nil {
+			err := a.Assign(svc, ip, ports, sharingKey, backendKey)
+			if err == nil {
 				return ip, nil
 			}
+			if sharingErr == nil && a.sharesKey(ip, sharingKey) {
+				sharingErr = err
+			}
 		}
 	}
 
 	// Woops, run out of IPs :( Fail.
+	if sharingErr != nil {
+		return nil, &sharingError{pool: poolName, key: sharingKey, err: sharingErr}
+	}
 	return nil, fmt.Errorf("no available IPs in pool %q", poolName)
 }
 
+// sharingError is the error of an allocation that found no free IP,
+// nor an IP it could share with the services of its sharing key.
+type sharingError struct {
+	pool string
+	key  string
+	err  error
+}
+
+func (e *sharingError) Error() string {
+	return fmt.Sprintf("no available IPs in pool %q, and can't share an IP with sharing key %q: %s", e.pool, e.key, e.err)
+}
+
+func (e *sharingError) Unwrap() error {
+	return e.err
+}
+
+// portsError is the error of an allocation from a pool that doesn't
+// allow one of the service's ports.
+type portsError struct {
+	pool string
+	port Port
+}
+
+func (e *portsError) Error() string {
+	return fmt.Sprintf("pool %q doesn't allow port %s", e.pool, e.port)
+}
+
+// checkPorts returns an error if pool, named name, doesn't allow all
+// of ports.
+func checkPorts(name string, pool *config.Pool, ports []Port) error {
+	if len(pool.AllowedPorts) == 0 {
+		return nil
+	}
+	for _, port := range ports {
+		allowed := false
+		for _, r := range pool.AllowedPorts {
+			if r.Contains(port.Proto, port.Port) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &portsError{pool: name, port: port}
+		}
+	}
+	return nil
+}
+
+// sharesKey returns true if the services using ip allow sharing it
+// with sharingKey.
+func (a *Allocator) sharesKey(ip net.IP, sharingKey string) bool {
+	k := a.sharingKeyForIP[ip.String()]
+	return sharingKey != "" && k != nil && k.sharing == sharingKey
+}
+
 // Allocate assigns any available and assignable IP to service.
 func (a *Allocator) Allocate(svc string, isIPv6 bool, ports []Port, sharingKey, backendKey string) (net.IP, error) {
 	if alloc := a.allocated[svc]; alloc != nil {
@@ -271,18 +520,185 @@ func (a *Allocator) Allocate(svc string, isIPv6 bool, ports []Port, sharingKey,
 		return alloc.ip, nil
 	}
 
-	for poolName := range a.pools {
-		if !a.pools[poolName].AutoAssign {
+	var (
+		sharingErr *sharingError
+		portsErr   error
+		allowed    bool
+	)
+	for _, poolName := range a.autoAssignOrder() {
+		if err := checkPorts(poolName, a.pools[poolName], ports); err != nil {
+			if portsErr == nil {
+				portsErr = err
+			}
 			continue
 		}
-		if ip, err := a.AllocateFromPool(svc, isIPv6, poolName, ports, sharingKey, backendKey); err == nil {
+		allowed = true
+		ip, err := a.AllocateFromPool(svc, isIPv6, poolName, ports, sharingKey, backendKey)
+		if err == nil {
 			return ip, nil
 		}
+		if sharingErr == nil {
+			errors.As(err, &sharingErr)
+		}
 	}
 
+	if sharingErr != nil {
+		return nil, sharingErr
+	}
+	if !allowed && portsErr != nil {
+		return nil, fmt.Errorf("no pool allows all the ports of the service: %w", portsErr)
+	}
 	return nil, errors.New("no available IPs")
 }
 
+// autoAssignOrder returns the auto-assign pools in the order
+// Allocate should try them. Weighted pools come first, in a random
+// order where each pool's chance to come before the others is
+// proportional to its weight. Unweighted pools follow, in no
+// particular order.
+func (a *Allocator) autoAssignOrder() []string {
+	var weighted, unweighted []string
+	total := 0
+	for n, p := range a.pools {
+		switch {
+		case !p.AutoAssign:
+		case p.Weight > 0:
+			weighted = append(weighted, n)
+			total += p.Weight
+		default:
+			unweighted = append(unweighted, n)
+		}
+	}
+	// Map iteration order is random, sort so that the weighted draw
+	// only depends on a.rand.
+	sort.Strings(weighted)
+
+	ret := make([]string, 0, len(weighted)+len(unweighted))
+	for len(weighted) > 0 {
+		r := a.rand.Intn(total)
+		for i, n := range weighted {
+			w := a.pools[n].Weight
+			if r < w {
+				ret = append(ret, n)
+				weighted = append(weighted[:i], weighted[i+1:]...)
+				total -= w
+				break
+			}
+			r -= w
+		}
+	}
+	return append(ret, unweighted...)
+}
+
+// AllocateFromSubnet assigns an available IP from subnet to
+// service. The IP must belong to poolName if set, or to any pool
+// otherwise.
+func (a *Allocator) AllocateFromSubnet(svc string, subnet *net.IPNet, poolName string, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	if alloc := a.allocated[svc]; alloc != nil && subnet.Contains(alloc.ip) && (poolName == "" || alloc.pool == poolName) {
+		if err := a.Assign(svc, alloc.ip, ports, sharingKey, backendKey); err != nil {
+			return nil, err
+		}
+		return alloc.ip, nil
+	}
+
+	var poolNames []string
+	if poolName != "" {
+		if a.pools[poolName] == nil {
+			return nil, fmt.Errorf("unknown pool %q", poolName)
+		}
+		poolNames = []string{poolName}
+	} else {
+		for n := range a.pools {
+			poolNames = append(poolNames, n)
+		}
+		sort.Strings(poolNames)
+	}
+
+	subnetOnes, _ := subnet.Mask.Size()
+	overlaps, allowed := false, false
+	var portsErr error
+	for _, n := range poolNames {
+		pool := a.pools[n]
+		for _, cidr := range pool.CIDR {
+			if cidrIsIPv6(cidr) != cidrIsIPv6(subnet) || (!subnet.Contains(cidr.IP) && !cidr.Contains(subnet.IP)) {
+				continue
+			}
+			overlaps = true
+			if err := checkPorts(n, pool, ports); err != nil {
+				portsErr = err
+				continue
+			}
+			allowed = true
+			// Prefixes either nest or don't overlap, only walk the
+			// smaller one.
+			prefix := cidr
+			if cidrOnes, _ := cidr.Mask.Size(); cidrOnes < subnetOnes {
+				prefix = subnet
+			}
+			c := ipaddr.NewCursor([]ipaddr.Prefix{*ipaddr.NewPrefix(prefix)})
+			for pos := c.First(); pos != nil; pos = c.Next() {
+				ip := pos.IP
+				if pool.AvoidBuggyIPs && ipConfusesBuggyFirmwares(ip) {
+					continue
+				}
+				if err := a.Assign(svc, ip, ports, sharingKey, backendKey); err == nil {
+					return ip, nil
+				}
+			}
+		}
+	}
+
+	if !overlaps {
+		if poolName != "" {
+			return nil, fmt.Errorf("subnet %q is not part of pool %q", subnet, poolName)
+		}
+		return nil, fmt.Errorf("subnet %q is not part of any pool", subnet)
+	}
+	if !allowed {
+		return nil, portsErr
+	}
+	return nil, fmt.Errorf("no available IPs in subnet %q", subnet)
+}
+
+// Allocation describes the IP allocated to a service.
+type Allocation struct {
+	Service    string
+	IP         net.IP
+	Pool       string
+	Ports      []Port
+	SharingKey string
+	BackendKey string
+}
+
+// Usage returns the number of IPs of pool in use, and the number of
+// IPs in the pool.
+func (a *Allocator) Usage(pool string) (inUse, capacity int64) {
+	p := a.pools[pool]
+	if p == nil {
+		return 0, 0
+	}
+	return int64(len(a.poolIPsInUse[pool])), poolCount(p)
+}
+
+// Allocations returns all the allocated IPs, sorted by service.
+func (a *Allocator) Allocations() []Allocation {
+	ret := make([]Allocation, 0, len(a.allocated))
+	for svc, alloc := range a.allocated {
+		ret = append(ret, Allocation{
+			Service:    svc,
+			IP:         alloc.ip,
+			Pool:       alloc.pool,
+			Ports:      append([]Port(nil), alloc.ports...),
+			SharingKey: alloc.sharing,
+			BackendKey: alloc.backend,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Service < ret[j].Service
+	})
+	return ret
+}
+
 // IP returns the IP address allocated to service, or nil if none are allocated.
 func (a *Allocator) IP(svc string) net.IP {
 	if alloc := a.allocated[svc]; alloc != nil {
@@ -301,6 +717,16 @@ func (a *Allocator) Pool(svc string) string {
 	return poolFor(a.pools, ip)
 }
 
+// IPShared returns true if the IP allocated to service is also in use
+// by other services.
+func (a *Allocator) IPShared(svc string) bool {
+	ip := a.IP(svc)
+	if ip == nil {
+		return false
+	}
+	return len(a.servicesOnIP[ip.String()]) > 1
+}
+
 func sharingOK(existing, new *key) error {
 	if existing.sharing == "" {
 		return errors.New("existing service does not allow sharing")
@@ -355,6 +781,109 @@ func poolCount(p *config.Pool) int64 {
 	return total
 }
 
+// largestFreeBlock returns the number of addresses in the largest
+// block of contiguous free addresses of pool. Adjacent CIDRs of the
+// pool form one block, so that ranges count as a whole.
+func (a *Allocator) largestFreeBlock(pool string) float64 {
+	p := a.pools[pool]
+	if p == nil {
+		return 0
+	}
+	one := big.NewInt(1)
+	largest := new(big.Int)
+	for _, v6 := range []bool{false, true} {
+		var ranges [][2]*big.Int
+		for _, cidr := range p.CIDR {
+			if cidrIsIPv6(cidr) != v6 {
+				continue
+			}
+			c := ipaddr.NewCursor([]ipaddr.Prefix{*ipaddr.NewPrefix(cidr)})
+			ranges = append(ranges, [2]*big.Int{ipInt(c.First().IP), ipInt(c.Last().IP)})
+		}
+		sort.Slice(ranges, func(i, j int) bool { return ranges[i][0].Cmp(ranges[j][0]) < 0 })
+		var used []*big.Int
+		for ip := range a.poolIPsInUse[pool] {
+			if parsed := net.ParseIP(ip); ipIsIPv6(parsed) == v6 {
+				used = append(used, ipInt(parsed))
+			}
+		}
+		sort.Slice(used, func(i, j int) bool { return used[i].Cmp(used[j]) < 0 })
+
+		var merged [][2]*big.Int
+		for _, r := range ranges {
+			if n := len(merged); n > 0 && new(big.Int).Add(merged[n-1][1], one).Cmp(r[0]) >= 0 {
+				if r[1].Cmp(merged[n-1][1]) > 0 {
+					merged[n-1][1] = r[1]
+				}
+				continue
+			}
+			merged = append(merged, r)
+		}
+
+		avoidBuggyIPs := p.AvoidBuggyIPs && !v6
+		for _, r := range merged {
+			lo := r[0]
+			for _, ip := range used {
+				if ip.Cmp(r[0]) < 0 || ip.Cmp(r[1]) > 0 {
+					continue
+				}
+				if n := freeRun(lo, new(big.Int).Sub(ip, one), avoidBuggyIPs); n.Cmp(largest) > 0 {
+					largest = n
+				}
+				lo = new(big.Int).Add(ip, one)
+			}
+			if n := freeRun(lo, r[1], avoidBuggyIPs); n.Cmp(largest) > 0 {
+				largest = n
+			}
+		}
+	}
+	ret, _ := new(big.Float).SetInt(largest).Float64()
+	return ret
+}
+
+// freeRun returns the number of addresses in the largest run of
+// usable addresses between lo and hi included.
+func freeRun(lo, hi *big.Int, avoidBuggyIPs bool) *big.Int {
+	if hi.Cmp(lo) < 0 {
+		return new(big.Int)
+	}
+	if !avoidBuggyIPs {
+		n := new(big.Int).Sub(hi, lo)
+		return n.Add(n, big.NewInt(1))
+	}
+	// The .0 and .255 addresses split IPv4 ranges in blocks of at
+	// most 254 addresses.
+	l, h := lo.Uint64(), hi.Uint64()
+	if l>>8 == h>>8 {
+		if l&0xff == 0 {
+			l++
+		}
+		if h&0xff == 0xff {
+			h--
+		}
+		if h < l {
+			return new(big.Int)
+		}
+		return new(big.Int).SetUint64(h - l + 1)
+	}
+	ret := freeRun(lo, new(big.Int).SetUint64(l|0xff), true)
+	if n := freeRun(new(big.Int).SetUint64(h&^0xff), hi, true); n.Cmp(ret) > 0 {
+		ret = n
+	}
+	if h>>8-l>>8 >= 2 {
+		ret = big.NewInt(254)
+	}
+	return ret
+}
+
+// ipInt returns ip as an integer, of 32 bits for IPv4 addresses.
+func ipInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		return new(big.Int).SetBytes(ip4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
+
 // poolFor returns the pool that owns the requested IP, or "" if none.
 func poolFor(pools map[string]*config.Pool, ip net.IP) string {
 	for pname, p := range pools {
@@ -1,14 +1,22 @@
 package allocator
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"go.universe.tf/metallb/internal/config"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
 	ptu "github.com/prometheus/client_golang/prometheus/testutil"
 )
 
@@ -1178,6 +1186,658 @@ func TestAutoAssign(t *testing.T) {
 	}
 }
 
+func TestWeightedAllocation(t *testing.T) {
+	alloc := New()
+	alloc.rand = rand.New(rand.NewSource(1))
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"isp-a": {
+			AutoAssign: true,
+			Weight:     80,
+			CIDR:       []*net.IPNet{ipnet("10.1.0.0/16")},
+		},
+		"isp-b": {
+			AutoAssign: true,
+			Weight:     20,
+			CIDR:       []*net.IPNet{ipnet("10.2.0.0/16")},
+		},
+		"fallback": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.3.0.0/30")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	got := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		svc := fmt.Sprintf("s%d", i)
+		if _, err := alloc.Allocate(svc, false, nil, "", ""); err != nil {
+			t.Fatalf("Allocate(%q): %s", svc, err)
+		}
+		got[alloc.Pool(svc)]++
+	}
+	if got["isp-a"] < 750 || got["isp-a"] > 850 || got["isp-b"] < 150 || got["isp-b"] > 250 {
+		t.Errorf("allocations not split 80/20 between weighted pools: %v", got)
+	}
+	if got["fallback"] != 0 {
+		t.Errorf("unweighted pool used before weighted pools were full: %v", got)
+	}
+
+	// Once the weighted pools are full, unweighted pools take over.
+	alloc = New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"weighted": {
+			AutoAssign: true,
+			Weight:     100,
+			CIDR:       []*net.IPNet{ipnet("10.1.0.0/32")},
+		},
+		"fallback": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.3.0.0/32")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	for _, test := range []struct{ svc, want string }{{"s1", "weighted"}, {"s2", "fallback"}} {
+		svc, want := test.svc, test.want
+		if _, err := alloc.Allocate(svc, false, nil, "", ""); err != nil {
+			t.Fatalf("Allocate(%q): %s", svc, err)
+		}
+		if got := alloc.Pool(svc); got != want {
+			t.Errorf("%s got an IP from pool %q, want %q", svc, got, want)
+		}
+	}
+}
+
+func TestSubnetAllocation(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.0.0.0/24"), ipnet("10.1.0.0/30")},
+		},
+		"test2": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.2.0.0/24")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	tests := []struct {
+		desc    string
+		svc     string
+		subnet  string
+		pool    string
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:   "subnet inside a pool CIDR",
+			svc:    "s1",
+			subnet: "10.0.0.64/31",
+			want:   "10.0.0.64",
+		},
+		{
+			desc:   "second IP of the subnet",
+			svc:    "s2",
+			subnet: "10.0.0.64/31",
+			want:   "10.0.0.65",
+		},
+		{
+			desc:    "subnet exhausted",
+			svc:     "s3",
+			subnet:  "10.0.0.64/31",
+			wantErr: true,
+		},
+		{
+			desc:   "subnet larger than a pool CIDR",
+			svc:    "s3",
+			subnet: "10.1.0.0/16",
+			want:   "10.1.0.0",
+		},
+		{
+			desc:   "subnet in the requested pool",
+			svc:    "s4",
+			subnet: "10.2.0.128/25",
+			pool:   "test2",
+			want:   "10.2.0.128",
+		},
+		{
+			desc:    "subnet outside the requested pool",
+			svc:     "s5",
+			subnet:  "10.0.0.0/24",
+			pool:    "test2",
+			wantErr: true,
+		},
+		{
+			desc:    "subnet outside all pools",
+			svc:     "s5",
+			subnet:  "192.168.0.0/24",
+			wantErr: true,
+		},
+		{
+			desc:   "existing allocation in the subnet",
+			svc:    "s1",
+			subnet: "10.0.0.0/24",
+			want:   "10.0.0.64",
+		},
+	}
+
+	for _, test := range tests {
+		ip, err := alloc.AllocateFromSubnet(test.svc, ipnet(test.subnet), test.pool, nil, "", "")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: should have caused an error, but did not", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: AllocateFromSubnet(%q, %q, %q): %s", test.desc, test.svc, test.subnet, test.pool, err)
+			continue
+		}
+		if ip.String() != test.want {
+			t.Errorf("%s: got IP %q, want %q", test.desc, ip, test.want)
+		}
+	}
+}
+
+func TestAddressBlocks(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.0.0.0/28")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	// A service outside of any block takes the first address.
+	if _, err := alloc.Allocate("other", false, nil, "", ""); err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+
+	tests := []struct {
+		desc    string
+		svc     string
+		block   string
+		size    int
+		want    string
+		wantErr bool
+	}{
+		{
+			desc:  "new block",
+			svc:   "s1",
+			block: "a",
+			size:  30,
+			want:  "10.0.0.4",
+		},
+		{
+			desc:  "second member",
+			svc:   "s2",
+			block: "a",
+			size:  30,
+			want:  "10.0.0.5",
+		},
+		{
+			desc:  "another block",
+			svc:   "s3",
+			block: "b",
+			size:  29,
+			want:  "10.0.0.8",
+		},
+		{
+			desc:    "size mismatch",
+			svc:     "s4",
+			block:   "a",
+			size:    29,
+			wantErr: true,
+		},
+		{
+			desc:    "no room left",
+			svc:     "s4",
+			block:   "c",
+			size:    29,
+			wantErr: true,
+		},
+		{
+			desc:  "existing allocation",
+			svc:   "s1",
+			block: "a",
+			size:  30,
+			want:  "10.0.0.4",
+		},
+	}
+	for _, test := range tests {
+		ip, err := alloc.AllocateInBlock(test.svc, false, test.block, test.size, "", nil, "", "")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: should have caused an error, but did not", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: AllocateInBlock(%q, %q, %d): %s", test.desc, test.svc, test.block, test.size, err)
+			continue
+		}
+		if ip.String() != test.want {
+			t.Errorf("%s: got IP %q, want %q", test.desc, ip, test.want)
+		}
+	}
+
+	// Services outside of the blocks get what's left.
+	ip, err := alloc.Allocate("s5", false, nil, "", "")
+	if err != nil || ip.String() != "10.0.0.1" {
+		t.Errorf("Allocate outside of blocks: got %q, %v, want 10.0.0.1", ip, err)
+	}
+	if err := alloc.Assign("s6", net.ParseIP("10.0.0.6"), nil, "", ""); err == nil {
+		t.Errorf("Assign of a free IP of a block outside of it should have failed")
+	}
+
+	// Existing allocations rebuild their block, unless other services
+	// use it.
+	if err := alloc.AssignInBlock("s7", net.ParseIP("10.0.0.2"), "d", 30, nil, "", ""); err == nil {
+		t.Errorf("AssignInBlock in a prefix used outside of the block should have failed")
+	}
+	alloc.Unassign("s1")
+	alloc.Unassign("s2")
+	if err := alloc.AssignInBlock("s1", net.ParseIP("10.0.0.6"), "e", 31, nil, "", ""); err != nil {
+		t.Errorf("AssignInBlock in a released block: %s", err)
+	}
+	if err := alloc.Assign("s6", net.ParseIP("10.0.0.4"), nil, "", ""); err != nil {
+		t.Errorf("Assign of an IP of a released block: %s", err)
+	}
+}
+
+func TestExtraPrefixes(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("10.0.0.0/28")},
+		},
+		"other": {
+			CIDR: []*net.IPNet{ipnet("10.0.1.0/28")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	for svc, ip := range map[string]string{"s1": "10.0.0.0", "s2": "10.0.0.9"} {
+		if err := alloc.Assign(svc, net.ParseIP(ip), nil, "", ""); err != nil {
+			t.Fatalf("Assign(%q): %s", svc, err)
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		svc      string
+		prefixes []*net.IPNet
+		wantErr  bool
+	}{
+		{
+			desc:     "no IP",
+			svc:      "s3",
+			prefixes: []*net.IPNet{ipnet("10.0.0.4/30")},
+			wantErr:  true,
+		},
+		{
+			desc:     "outside of the pool",
+			svc:      "s1",
+			prefixes: []*net.IPNet{ipnet("10.0.1.0/30")},
+			wantErr:  true,
+		},
+		{
+			desc:     "holds another service's IP",
+			svc:      "s1",
+			prefixes: []*net.IPNet{ipnet("10.0.0.8/30")},
+			wantErr:  true,
+		},
+		{
+			desc:     "overlapping prefixes",
+			svc:      "s1",
+			prefixes: []*net.IPNet{ipnet("10.0.0.4/30"), ipnet("10.0.0.4/31")},
+			wantErr:  true,
+		},
+		{
+			desc:     "holds its own IP",
+			svc:      "s1",
+			prefixes: []*net.IPNet{ipnet("10.0.0.0/30"), ipnet("10.0.0.4/31")},
+		},
+		{
+			desc:     "reserved by another service",
+			svc:      "s2",
+			prefixes: []*net.IPNet{ipnet("10.0.0.4/30")},
+			wantErr:  true,
+		},
+		{
+			desc:     "free prefix",
+			svc:      "s2",
+			prefixes: []*net.IPNet{ipnet("10.0.0.12/30")},
+		},
+	}
+	for _, test := range tests {
+		err := alloc.ReserveExtraPrefixes(test.svc, test.prefixes)
+		if test.wantErr != (err != nil) {
+			t.Errorf("%s: got error %v, want error: %v", test.desc, err, test.wantErr)
+		}
+	}
+
+	// Reserved addresses are skipped by the allocation, and by the
+	// address blocks.
+	if err := alloc.Assign("s3", net.ParseIP("10.0.0.5"), nil, "", ""); err == nil {
+		t.Error("Assign of a reserved IP should have failed")
+	}
+	ip, err := alloc.Allocate("s3", false, nil, "", "")
+	if err != nil || ip.String() != "10.0.0.6" {
+		t.Errorf("Allocate: got %q, %v, want 10.0.0.6", ip, err)
+	}
+	if _, err := alloc.AllocateInBlock("s4", false, "a", 30, "", nil, "", ""); err == nil {
+		t.Error("AllocateInBlock should have found no free block")
+	}
+
+	// Releasing the service's IP releases its extra prefixes.
+	alloc.Unassign("s2")
+	if err := alloc.Assign("s4", net.ParseIP("10.0.0.13"), nil, "", ""); err != nil {
+		t.Errorf("Assign of a released extra prefix: %s", err)
+	}
+	if err := alloc.ReserveExtraPrefixes("s1", nil); err != nil {
+		t.Errorf("ReserveExtraPrefixes(nil): %s", err)
+	}
+	if err := alloc.Assign("s5", net.ParseIP("10.0.0.1"), nil, "", ""); err != nil {
+		t.Errorf("Assign of a released extra prefix: %s", err)
+	}
+}
+
+func TestAllocations(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.4/31")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	if err := alloc.Assign("s2", net.ParseIP("1.2.3.4"), ports("tcp/80"), "share", "backend"); err != nil {
+		t.Fatalf("Assign s2: %s", err)
+	}
+	if err := alloc.Assign("s1", net.ParseIP("1.2.3.5"), nil, "", ""); err != nil {
+		t.Fatalf("Assign s1: %s", err)
+	}
+
+	want := []Allocation{
+		{
+			Service: "s1",
+			IP:      net.ParseIP("1.2.3.5"),
+			Pool:    "test",
+		},
+		{
+			Service:    "s2",
+			IP:         net.ParseIP("1.2.3.4"),
+			Pool:       "test",
+			Ports:      ports("tcp/80"),
+			SharingKey: "share",
+			BackendKey: "backend",
+		},
+	}
+	if diff := cmp.Diff(want, alloc.Allocations()); diff != "" {
+		t.Errorf("wrong allocations (-want +got)\n%s", diff)
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	alloc := New()
+	pools := map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.4/31")},
+		},
+	}
+	if err := alloc.SetPools(pools); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	gen := alloc.Generation()
+	tests := []struct {
+		desc    string
+		change  func() error
+		changed bool
+	}{
+		{
+			desc:    "new allocation",
+			change:  func() error { return alloc.Assign("s1", net.ParseIP("1.2.3.4"), ports("tcp/80"), "", "") },
+			changed: true,
+		},
+		{
+			desc:   "same allocation",
+			change: func() error { return alloc.Assign("s1", net.ParseIP("1.2.3.4"), ports("tcp/80"), "", "") },
+		},
+		{
+			desc:    "new ports",
+			change:  func() error { return alloc.Assign("s1", net.ParseIP("1.2.3.4"), ports("tcp/443"), "", "") },
+			changed: true,
+		},
+		{
+			desc:    "new IP",
+			change:  func() error { return alloc.Assign("s1", net.ParseIP("1.2.3.5"), ports("tcp/443"), "", "") },
+			changed: true,
+		},
+		{
+			desc:   "unchanged pools",
+			change: func() error { return alloc.SetPools(pools) },
+		},
+		{
+			desc: "renamed pool",
+			change: func() error {
+				return alloc.SetPools(map[string]*config.Pool{"renamed": pools["test"]})
+			},
+			changed: true,
+		},
+		{
+			desc: "release",
+			change: func() error {
+				alloc.Unassign("s1")
+				return nil
+			},
+			changed: true,
+		},
+		{
+			desc: "release of unallocated service",
+			change: func() error {
+				alloc.Unassign("s1")
+				return nil
+			},
+		},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		next := alloc.Generation()
+		if got := next != gen; got != test.changed {
+			t.Errorf("%s: got generation change %v, want %v", test.desc, got, test.changed)
+		}
+		if next < gen {
+			t.Errorf("%s: generation went back from %d to %d", test.desc, gen, next)
+		}
+		gen = next
+	}
+}
+
+func TestAllowedPorts(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"public": {
+			AutoAssign: true,
+			Weight:     1,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.0/31")},
+			AllowedPorts: []config.PortRange{
+				{Proto: "TCP", First: 80, Last: 80},
+				{Proto: "TCP", First: 443, Last: 443},
+			},
+		},
+		"private": {
+			CIDR: []*net.IPNet{ipnet("10.0.0.0/31")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	tests := []struct {
+		desc     string
+		ports    []Port
+		allocate func(svc string, ports []Port) (net.IP, error)
+		wantErr  bool
+	}{
+		{
+			desc:  "allowed ports",
+			ports: ports("TCP/80", "TCP/443"),
+			allocate: func(svc string, ports []Port) (net.IP, error) {
+				return alloc.Allocate(svc, false, ports, "", "")
+			},
+		},
+		{
+			desc:  "disallowed protocol",
+			ports: ports("UDP/443"),
+			allocate: func(svc string, ports []Port) (net.IP, error) {
+				return alloc.AllocateFromPool(svc, false, "public", ports, "", "")
+			},
+			wantErr: true,
+		},
+		{
+			desc:  "disallowed port",
+			ports: ports("TCP/80", "TCP/22"),
+			allocate: func(svc string, ports []Port) (net.IP, error) {
+				return alloc.Allocate(svc, false, ports, "", "")
+			},
+			wantErr: true,
+		},
+		{
+			desc:  "disallowed requested IP",
+			ports: ports("TCP/22"),
+			allocate: func(svc string, ports []Port) (net.IP, error) {
+				ip := net.ParseIP("1.2.3.1")
+				return ip, alloc.Assign(svc, ip, ports, "", "")
+			},
+			wantErr: true,
+		},
+		{
+			desc:  "disallowed subnet",
+			ports: ports("TCP/22"),
+			allocate: func(svc string, ports []Port) (net.IP, error) {
+				return alloc.AllocateFromSubnet(svc, ipnet("1.2.3.0/31"), "", ports, "", "")
+			},
+			wantErr: true,
+		},
+		{
+			desc:  "pool without policy",
+			ports: ports("TCP/22"),
+			allocate: func(svc string, ports []Port) (net.IP, error) {
+				return alloc.AllocateFromPool(svc, false, "private", ports, "", "")
+			},
+		},
+	}
+	for i, test := range tests {
+		svc := fmt.Sprintf("s%d", i)
+		_, err := test.allocate(svc, test.ports)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: allocation of ports %v succeeded, want error", test.desc, test.ports)
+			}
+			if alloc.IP(svc) != nil {
+				t.Errorf("%s: service got IP %s despite the error", test.desc, alloc.IP(svc))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: allocation of ports %v failed: %s", test.desc, test.ports, err)
+		}
+	}
+
+	// Existing allocations are checked again when their ports change.
+	if err := alloc.Assign("s0", alloc.IP("s0"), ports("TCP/80", "TCP/22"), "", ""); err == nil {
+		t.Error("new disallowed port of existing allocation accepted")
+	}
+}
+
+func TestIPShared(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"test": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.4/31")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	if alloc.IPShared("s1") {
+		t.Error("service without an IP reported as shared")
+	}
+	if err := alloc.Assign("s1", net.ParseIP("1.2.3.4"), ports("tcp/80"), "share", ""); err != nil {
+		t.Fatalf("Assign s1: %s", err)
+	}
+	if alloc.IPShared("s1") {
+		t.Error("s1 reported as shared with no other user")
+	}
+	if err := alloc.Assign("s2", net.ParseIP("1.2.3.4"), ports("tcp/443"), "share", ""); err != nil {
+		t.Fatalf("Assign s2: %s", err)
+	}
+	if !alloc.IPShared("s1") || !alloc.IPShared("s2") {
+		t.Error("s1 and s2 not reported as shared")
+	}
+	alloc.Unassign("s2")
+	if alloc.IPShared("s1") {
+		t.Error("s1 still reported as shared after s2 released the IP")
+	}
+}
+
+func TestSharingConflicts(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"dns": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("1.2.3.4/32")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	// The same port on different protocols doesn't conflict.
+	ip, err := alloc.Allocate("dns-tcp", false, ports("TCP/53"), "dns", "")
+	if err != nil {
+		t.Fatalf("Allocate dns-tcp: %s", err)
+	}
+	got, err := alloc.Allocate("dns-udp", false, ports("UDP/53"), "dns", "")
+	if err != nil {
+		t.Fatalf("Allocate dns-udp: %s", err)
+	}
+	if !got.Equal(ip) {
+		t.Errorf("dns-udp got %s, want to share %s with dns-tcp", got, ip)
+	}
+
+	// Conflicts name the port and the service using it.
+	_, err = alloc.Allocate("dns-tcp2", false, ports("TCP/53"), "dns", "")
+	if err == nil {
+		t.Fatal("dns-tcp2 got an IP with a conflicting port")
+	}
+	if want := `no available IPs in pool "dns", and can't share an IP with sharing key "dns": port TCP/53 is already in use on "1.2.3.4" by "dns-tcp"`; err.Error() != want {
+		t.Errorf("wrong error for conflicting port\ngot:  %s\nwant: %s", err, want)
+	}
+	err = alloc.Assign("web", net.ParseIP("1.2.3.4"), ports("TCP/80"), "web", "")
+	if err == nil {
+		t.Fatal("web got an IP with a different sharing key")
+	}
+	if want := `"web" can't share "1.2.3.4" with dns-tcp,dns-udp: sharing key "web" does not match existing sharing key "dns"`; err.Error() != want {
+		t.Errorf("wrong error for sharing key mismatch\ngot:  %s\nwant: %s", err, want)
+	}
+	// Without a sharing key, there is nothing to explain.
+	if _, err := alloc.Allocate("other", false, ports("TCP/53"), "", ""); err == nil || err.Error() != "no available IPs" {
+		t.Errorf("wrong error without a sharing key: %v", err)
+	}
+}
+
 func TestPoolCount(t *testing.T) {
 	tests := []struct {
 		desc string
@@ -1319,7 +1979,7 @@ func TestPoolMetrics(t *testing.T) {
 
 	// The "test" pool contains two ranges; 1.2.3.4/30, 1000::4/126
 	// All bits can be used for lb-addresses which gives a total capacity of; 4+4=8
-	value := ptu.ToFloat64(stats.poolCapacity.WithLabelValues("test"))
+	value := ptu.ToFloat64(alloc.stats.poolCapacity.WithLabelValues("test"))
 	if int(value) != 8 {
 		t.Errorf("stats.poolCapacity invalid %f. Expected 8", value)
 	}
@@ -1327,7 +1987,7 @@ func TestPoolMetrics(t *testing.T) {
 	for _, test := range tests {
 		if test.ip == "" {
 			alloc.Unassign(test.svc)
-			value := ptu.ToFloat64(stats.poolActive.WithLabelValues("test"))
+			value := ptu.ToFloat64(alloc.stats.poolActive.WithLabelValues("test"))
 			if value != test.ipsInUse {
 				t.Errorf("%v; in-use %v. Expected %v", test.desc, value, test.ipsInUse)
 			}
@@ -1346,15 +2006,178 @@ func TestPoolMetrics(t *testing.T) {
 		if a := assigned(alloc, test.svc); a != test.ip {
 			t.Errorf("%q: ran Assign(%q, %q), but allocator has recorded allocation of %q", test.desc, test.svc, test.ip, a)
 		}
-		value := ptu.ToFloat64(stats.poolActive.WithLabelValues("test"))
+		value := ptu.ToFloat64(alloc.stats.poolActive.WithLabelValues("test"))
 		if value != test.ipsInUse {
 			t.Errorf("%v; in-use %v. Expected %v", test.desc, value, test.ipsInUse)
 		}
 	}
 }
 
+func TestLargestFreeBlock(t *testing.T) {
+	tests := []struct {
+		desc  string
+		pool  *config.Pool
+		inUse []string
+		want  float64
+	}{
+		{
+			desc: "empty pool",
+			pool: &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.3.0/24")}},
+			want: 256,
+		},
+		{
+			desc:  "split in the middle",
+			pool:  &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.3.0/28")}},
+			inUse: []string{"1.2.3.5"},
+			want:  10,
+		},
+		{
+			desc:  "adjacent CIDRs of a range",
+			pool:  &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.3.8/29"), ipnet("1.2.3.0/29"), ipnet("1.2.3.16/32")}},
+			inUse: []string{"1.2.3.1"},
+			want:  15,
+		},
+		{
+			desc:  "full pool",
+			pool:  &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.3.0/31")}},
+			inUse: []string{"1.2.3.0", "1.2.3.1"},
+			want:  0,
+		},
+		{
+			desc: "buggy IPs split blocks",
+			pool: &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.0.0/16")}, AvoidBuggyIPs: true},
+			want: 254,
+		},
+		{
+			desc:  "buggy IPs at the edges",
+			pool:  &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.3.0/24")}, AvoidBuggyIPs: true},
+			inUse: []string{"1.2.3.100"},
+			want:  154,
+		},
+		{
+			desc:  "IPv6",
+			pool:  &config.Pool{CIDR: []*net.IPNet{ipnet("1.2.3.0/30"), ipnet("1000::/120")}},
+			inUse: []string{"1000::7f"},
+			want:  128,
+		},
+	}
+
+	for _, test := range tests {
+		alloc := New()
+		if err := alloc.SetPools(map[string]*config.Pool{"fragmented": test.pool}); err != nil {
+			t.Fatalf("%s: SetPools: %s", test.desc, err)
+		}
+		for i, ip := range test.inUse {
+			if err := alloc.Assign(fmt.Sprintf("s%d", i), net.ParseIP(ip), nil, "", ""); err != nil {
+				t.Fatalf("%s: Assign(%s): %s", test.desc, ip, err)
+			}
+		}
+		if got := alloc.largestFreeBlock("fragmented"); got != test.want {
+			t.Errorf("%s: largest free block has %v addresses, want %v", test.desc, got, test.want)
+		}
+		if got := ptu.ToFloat64(freeBlockCollector{alloc}); got != test.want {
+			t.Errorf("%s: largest free block metric is %v, want %v", test.desc, got, test.want)
+		}
+	}
+
+	// The metric follows the changes since the last scrape.
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{"fragmented": {CIDR: []*net.IPNet{ipnet("1.2.3.0/28")}}}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	c := freeBlockCollector{alloc}
+	if got := ptu.ToFloat64(c); got != 16 {
+		t.Errorf("largest free block metric of an empty pool is %v, want 16", got)
+	}
+	if err := alloc.Assign("s", net.ParseIP("1.2.3.3"), nil, "", ""); err != nil {
+		t.Fatalf("Assign: %s", err)
+	}
+	if got := ptu.ToFloat64(c); got != 12 {
+		t.Errorf("largest free block metric after Assign is %v, want 12", got)
+	}
+	alloc.Unassign("s")
+	if got := ptu.ToFloat64(c); got != 16 {
+		t.Errorf("largest free block metric after Unassign is %v, want 16", got)
+	}
+}
+
+func TestSharingMetrics(t *testing.T) {
+	alloc := New()
+	if err := alloc.SetPools(map[string]*config.Pool{
+		"sharing": {
+			AutoAssign: true,
+			CIDR:       []*net.IPNet{ipnet("4.3.2.0/30")},
+		},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+
+	assign := func(svc, ip, port string) {
+		if err := alloc.Assign(svc, net.ParseIP(ip), ports(port), "web", ""); err != nil {
+			t.Fatalf("Assign(%s, %s): %s", svc, ip, err)
+		}
+	}
+	assign("s1", "4.3.2.0", "tcp/80")
+	assign("s2", "4.3.2.0", "tcp/443")
+	assign("s3", "4.3.2.1", "tcp/80")
+
+	if got := ptu.ToFloat64(alloc.stats.ipServices.WithLabelValues("4.3.2.0", "web")); got != 2 {
+		t.Errorf("4.3.2.0 has %v services, want 2", got)
+	}
+	if got := ptu.ToFloat64(alloc.stats.sharingKeyIPs.WithLabelValues("web")); got != 2 {
+		t.Errorf("sharing key uses %v addresses, want 2", got)
+	}
+
+	alloc.Unassign("s3")
+	if got := ptu.ToFloat64(alloc.stats.sharingKeyIPs.WithLabelValues("web")); got != 1 {
+		t.Errorf("sharing key uses %v addresses after unassigning s3, want 1", got)
+	}
+	alloc.Unassign("s1")
+	alloc.Unassign("s2")
+	if n := countMetrics(alloc.stats.sharingKeyIPs); n != 0 {
+		t.Errorf("%d sharing keys left after unassigning all services, want 0", n)
+	}
+	if n := countMetrics(alloc.stats.ipServices); n != 0 {
+		t.Errorf("%d addresses left after unassigning all services, want 0", n)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	// Each Allocator has its own metrics, exported once its collector
+	// is registered.
+	reg := prometheus.NewPedanticRegistry()
+	for _, cidr := range []string{"1.2.3.0/30", "1.2.4.0/29"} {
+		alloc := New()
+		if err := alloc.SetPools(map[string]*config.Pool{"test": {CIDR: []*net.IPNet{ipnet(cidr)}}}); err != nil {
+			t.Fatalf("SetPools: %s", err)
+		}
+		if cidr == "1.2.3.0/30" {
+			if err := reg.Register(alloc.Collector()); err != nil {
+				t.Fatalf("Register: %s", err)
+			}
+		}
+	}
+	if err := ptu.GatherAndCompare(reg, strings.NewReader(`
+# HELP metallb_allocator_addresses_total Number of usable IP addresses, per pool
+# TYPE metallb_allocator_addresses_total gauge
+metallb_allocator_addresses_total{pool="test"} 4
+# HELP metallb_allocator_largest_free_block_addresses Number of addresses in the largest block of contiguous free addresses, per pool
+# TYPE metallb_allocator_largest_free_block_addresses gauge
+metallb_allocator_largest_free_block_addresses{pool="test"} 4
+`), "metallb_allocator_addresses_total", "metallb_allocator_largest_free_block_addresses"); err != nil {
+		t.Error(err)
+	}
+}
+
 // Some helpers.
 
+func countMetrics(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
 func assigned(a *Allocator, svc string) string {
 	ip := a.IP(svc)
 	if ip == nil {
@@ -1383,3 +2206,41 @@ func ports(ports ...string) []Port {
 	}
 	return ret
 }
+
+func TestWebhookPolicy(t *testing.T) {
+	var got PolicyRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decoding request: %s", err)
+		}
+		if got.Pool == "broken" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"allowed": true, "pool": "finance"}`)
+	}))
+	defer srv.Close()
+
+	p := NewWebhookPolicy(srv.URL, time.Second)
+	req := &PolicyRequest{
+		Service: "default/svc",
+		Labels:  map[string]string{"cost-center": "42"},
+		IP:      "1.2.3.4",
+		Pool:    "default",
+	}
+	d, err := p.Review(req)
+	if err != nil {
+		t.Fatalf("Review: %s", err)
+	}
+	if diff := cmp.Diff(req, &got); diff != "" {
+		t.Errorf("unexpected request (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff(&PolicyDecision{Allowed: true, Pool: "finance"}, d); diff != "" {
+		t.Errorf("unexpected decision (-want +got)\n%s", diff)
+	}
+
+	req.Pool = "broken"
+	if _, err := p.Review(req); err == nil {
+		t.Error("Review succeeded with a failing webhook")
+	}
+}
@@ -0,0 +1,194 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mikioh/ipaddr"
+)
+
+// An addressBlock is a prefix reserved for a set of related services,
+// so that they get adjacent IPs. Only its members can get IPs in it.
+type addressBlock struct {
+	prefix  *net.IPNet
+	members map[string]bool
+}
+
+// blockOf returns the name of the address block holding ip, "" if
+// none does.
+func (a *Allocator) blockOf(ip net.IP) string {
+	for name, b := range a.blocks {
+		if b.prefix.Contains(ip) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Block returns the address block named block, nil if it isn't
+// reserved.
+func (a *Allocator) Block(block string) *net.IPNet {
+	if b := a.blocks[block]; b != nil {
+		return b.prefix
+	}
+	return nil
+}
+
+// AssignInBlock assigns ip to svc, as a member of the address block
+// named block, whose prefixes are size bits long. If the block
+// doesn't exist yet, it is reserved around ip, provided no other
+// service uses its addresses.
+func (a *Allocator) AssignInBlock(svc string, ip net.IP, block string, size int, ports []Port, sharingKey, backendKey string) error {
+	if err := checkBlockSize(ipIsIPv6(ip), size); err != nil {
+		return err
+	}
+	created, err := a.reserveBlock(svc, block, size, blockPrefix(ip, size))
+	if err != nil {
+		return err
+	}
+	if err := a.assignInBlock(svc, ip, block, ports, sharingKey, backendKey); err != nil {
+		if created {
+			delete(a.blocks, block)
+		}
+		return err
+	}
+	return nil
+}
+
+// AllocateInBlock assigns an available IP of the address block named
+// block to svc. If the block doesn't exist yet, the first free prefix
+// of size bits is reserved for it, in poolName if set, or in any
+// auto-assign pool otherwise.
+func (a *Allocator) AllocateInBlock(svc string, isIPv6 bool, block string, size int, poolName string, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	if err := checkBlockSize(isIPv6, size); err != nil {
+		return nil, err
+	}
+	if alloc := a.allocated[svc]; alloc != nil && alloc.block == block {
+		if err := a.assignInBlock(svc, alloc.ip, block, ports, sharingKey, backendKey); err != nil {
+			return nil, err
+		}
+		return alloc.ip, nil
+	}
+
+	created := false
+	b := a.blocks[block]
+	if b == nil {
+		prefix, err := a.freeBlock(svc, isIPv6, size, poolName)
+		if err != nil {
+			return nil, err
+		}
+		if created, err = a.reserveBlock(svc, block, size, prefix); err != nil {
+			return nil, err
+		}
+		b = a.blocks[block]
+	} else if ones, _ := b.prefix.Mask.Size(); ones != size {
+		return nil, fmt.Errorf("address block %q is %s, not a /%d", block, b.prefix, size)
+	}
+	if cidrIsIPv6(b.prefix) != isIPv6 {
+		return nil, fmt.Errorf("address block %q is %s, not of the service's family", block, b.prefix)
+	}
+
+	c := ipaddr.NewCursor([]ipaddr.Prefix{*ipaddr.NewPrefix(b.prefix)})
+	for pos := c.First(); pos != nil; pos = c.Next() {
+		ip := pos.IP
+		pool := poolFor(a.pools, ip)
+		if pool == "" || (poolName != "" && pool != poolName) || (a.pools[pool].AvoidBuggyIPs && ipConfusesBuggyFirmwares(ip)) {
+			continue
+		}
+		if err := a.assignInBlock(svc, ip, block, ports, sharingKey, backendKey); err == nil {
+			return ip, nil
+		}
+	}
+	if created {
+		delete(a.blocks, block)
+	}
+	return nil, fmt.Errorf("no available IPs in address block %q (%s)", block, b.prefix)
+}
+
+// reserveBlock creates the address block named block at prefix for
+// svc, and returns true, unless it exists. An existing block must
+// have the same size.
+func (a *Allocator) reserveBlock(svc, block string, size int, prefix *net.IPNet) (bool, error) {
+	if b := a.blocks[block]; b != nil {
+		if ones, _ := b.prefix.Mask.Size(); ones != size {
+			return false, fmt.Errorf("address block %q is %s, not a /%d", block, b.prefix, size)
+		}
+		return false, nil
+	}
+	if !a.blockFree(svc, prefix) {
+		return false, fmt.Errorf("addresses of %s are in use outside of address block %q", prefix, block)
+	}
+	a.blocks[block] = &addressBlock{prefix: prefix, members: map[string]bool{}}
+	return true, nil
+}
+
+// blockFree returns true if no block and no service other than svc
+// uses or reserves the addresses of prefix.
+func (a *Allocator) blockFree(svc string, prefix *net.IPNet) bool {
+	for _, b := range a.blocks {
+		if b.prefix.Contains(prefix.IP) || prefix.Contains(b.prefix.IP) {
+			return false
+		}
+	}
+	for other, alloc := range a.allocated {
+		if other != svc && prefix.Contains(alloc.ip) {
+			return false
+		}
+	}
+	return !a.extraPrefixesOverlap(svc, prefix)
+}
+
+// freeBlock returns the first prefix of size bits that is free for
+// svc, inside the CIDRs of poolName if set, or of the auto-assign
+// pools otherwise.
+func (a *Allocator) freeBlock(svc string, isIPv6 bool, size int, poolName string) (*net.IPNet, error) {
+	pools := []string{poolName}
+	if poolName == "" {
+		pools = a.autoAssignOrder()
+	} else if a.pools[poolName] == nil {
+		return nil, fmt.Errorf("unknown pool %q", poolName)
+	}
+	for _, n := range pools {
+		for _, cidr := range a.pools[n].CIDR {
+			ones, bits := cidr.Mask.Size()
+			if cidrIsIPv6(cidr) != isIPv6 || ones > size || size > bits {
+				continue
+			}
+			p := ipaddr.NewPrefix(cidr)
+			c := ipaddr.NewCursor([]ipaddr.Prefix{*p})
+			for pos := c.First(); pos != nil; pos = c.Next() {
+				prefix := blockPrefix(pos.IP, size)
+				if a.blockFree(svc, prefix) {
+					return prefix, nil
+				}
+				// Skip to the next block.
+				last := ipaddr.NewCursor([]ipaddr.Prefix{*ipaddr.NewPrefix(prefix)}).Last()
+				if err := c.Set(&ipaddr.Position{IP: last.IP, Prefix: *p}); err != nil {
+					break
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no free /%d block", size)
+}
+
+func checkBlockSize(isIPv6 bool, size int) error {
+	bits := 32
+	if isIPv6 {
+		bits = 128
+	}
+	if size < 0 || size > bits {
+		return fmt.Errorf("invalid address block size /%d", size)
+	}
+	return nil
+}
+
+// blockPrefix returns the prefix of size bits holding ip.
+func blockPrefix(ip net.IP, size int) *net.IPNet {
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	mask := net.CIDRMask(size, bits)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
@@ -0,0 +1,95 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+)
+
+// ReserveExtraPrefixes reserves prefixes for svc, on top of its IP,
+// replacing its previous reservation. The prefixes must be within
+// the pool of svc's IP, and no other service, address block or
+// reservation may use their addresses. An empty list releases the
+// reservation.
+func (a *Allocator) ReserveExtraPrefixes(svc string, prefixes []*net.IPNet) error {
+	if len(prefixes) == 0 {
+		delete(a.extraPrefixes, svc)
+		return nil
+	}
+	alloc := a.allocated[svc]
+	if alloc == nil {
+		return fmt.Errorf("%q has no IP to reserve extra prefixes with", svc)
+	}
+	for i, pfx := range prefixes {
+		if !cidrsContain(a.pools[alloc.pool].CIDR, pfx) {
+			return fmt.Errorf("extra prefix %s is not within pool %q", pfx, alloc.pool)
+		}
+		for _, other := range prefixes[:i] {
+			if other.Contains(pfx.IP) || pfx.Contains(other.IP) {
+				return fmt.Errorf("extra prefixes %s and %s overlap", other, pfx)
+			}
+		}
+		for name, b := range a.blocks {
+			if b.prefix.Contains(pfx.IP) || pfx.Contains(b.prefix.IP) {
+				return fmt.Errorf("extra prefix %s overlaps address block %q", pfx, name)
+			}
+		}
+		for other, al := range a.allocated {
+			if other != svc && pfx.Contains(al.ip) {
+				return fmt.Errorf("extra prefix %s holds %q, in use by %q", pfx, al.ip, other)
+			}
+		}
+		for other, reserved := range a.extraPrefixes {
+			if other == svc {
+				continue
+			}
+			for _, r := range reserved {
+				if r.Contains(pfx.IP) || pfx.Contains(r.IP) {
+					return fmt.Errorf("extra prefix %s overlaps %s, reserved by %q", pfx, r, other)
+				}
+			}
+		}
+	}
+	a.extraPrefixes[svc] = prefixes
+	return nil
+}
+
+// extraPrefixOwner returns the service that reserved ip as part of
+// its extra prefixes, "" if none did.
+func (a *Allocator) extraPrefixOwner(ip net.IP) string {
+	for svc, reserved := range a.extraPrefixes {
+		for _, pfx := range reserved {
+			if pfx.Contains(ip) {
+				return svc
+			}
+		}
+	}
+	return ""
+}
+
+// extraPrefixesOverlap returns true if a service other than svc
+// reserved addresses of prefix.
+func (a *Allocator) extraPrefixesOverlap(svc string, prefix *net.IPNet) bool {
+	for other, reserved := range a.extraPrefixes {
+		if other == svc {
+			continue
+		}
+		for _, r := range reserved {
+			if r.Contains(prefix.IP) || prefix.Contains(r.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cidrsContain returns true if pfx is entirely within one of cidrs.
+func cidrsContain(cidrs []*net.IPNet, pfx *net.IPNet) bool {
+	pfxOnes, pfxBits := pfx.Mask.Size()
+	for _, cidr := range cidrs {
+		ones, bits := cidr.Mask.Size()
+		if bits == pfxBits && ones <= pfxOnes && cidr.Contains(pfx.IP) {
+			return true
+		}
+	}
+	return false
+}
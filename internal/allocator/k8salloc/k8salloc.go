@@ -10,8 +10,14 @@ import (
 func Ports(svc *v1.Service) []allocator.Port {
 	var ret []allocator.Port
 	for _, port := range svc.Spec.Ports {
+		proto := port.Protocol
+		if proto == "" {
+			// The API server defaults it, but not in the services
+			// we make up, e.g. for Gateways.
+			proto = v1.ProtocolTCP
+		}
 		ret = append(ret, allocator.Port{
-			Proto: string(port.Protocol),
+			Proto: string(proto),
 			Port:  int(port.Port),
 		})
 	}
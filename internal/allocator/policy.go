@@ -0,0 +1,76 @@
+package allocator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A Policy reviews new allocations before they are final, to enforce
+// rules that pools can't express, e.g. which cost centers may use
+// which addresses. It can deny an allocation, or pick another pool
+// or IP for it.
+type Policy interface {
+	Review(req *PolicyRequest) (*PolicyDecision, error)
+}
+
+// PolicyRequest describes an allocation for a Policy to review.
+type PolicyRequest struct {
+	// The object getting the IP, as namespace/name.
+	Service     string            `json:"service"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// The IP the allocator chose, and its pool.
+	IP   string `json:"ip"`
+	Pool string `json:"pool"`
+}
+
+// PolicyDecision is a Policy's verdict on an allocation.
+type PolicyDecision struct {
+	Allowed bool `json:"allowed"`
+	// Why the allocation was denied, for the service's events.
+	Reason string `json:"reason,omitempty"`
+	// If Allowed, the IP to assign instead of the chosen one, or the
+	// pool to allocate an IP from instead. IP takes precedence.
+	IP   string `json:"ip,omitempty"`
+	Pool string `json:"pool,omitempty"`
+}
+
+// WebhookPolicy is a Policy that POSTs the requests, as JSON, to a
+// URL, which replies with a JSON decision.
+type WebhookPolicy struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookPolicy returns a WebhookPolicy posting to url, that gives
+// up on replies slower than timeout.
+func NewWebhookPolicy(url string, timeout time.Duration) *WebhookPolicy {
+	return &WebhookPolicy{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Review implements Policy.
+func (w *WebhookPolicy) Review(req *PolicyRequest) (*PolicyDecision, error) {
+	bs, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned %s", w.url, resp.Status)
+	}
+	var ret PolicyDecision
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("decoding the reply of %s: %s", w.url, err)
+	}
+	return &ret, nil
+}
@@ -2,39 +2,127 @@ package allocator
 
 import "github.com/prometheus/client_golang/prometheus"
 
-var stats = struct {
+var freeBlockDesc = prometheus.NewDesc(
+	prometheus.BuildFQName("metallb", "allocator", "largest_free_block_addresses"),
+	"Number of addresses in the largest block of contiguous free addresses, per pool",
+	[]string{"pool"},
+	nil,
+)
+
+// metrics are the metrics of an Allocator, which its Collector
+// exports.
+type metrics struct {
 	poolCapacity  *prometheus.GaugeVec
 	poolActive    *prometheus.GaugeVec
 	poolAllocated *prometheus.GaugeVec
-}{
-	poolCapacity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "metallb",
-		Subsystem: "allocator",
-		Name:      "addresses_total",
-		Help:      "Number of usable IP addresses, per pool",
-	}, []string{
-		"pool",
-	}),
-	poolActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "metallb",
-		Subsystem: "allocator",
-		Name:      "addresses_in_use_total",
-		Help:      "Number of IP addresses in use, per pool",
-	}, []string{
-		"pool",
-	}),
-	poolAllocated: prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "metallb",
-		Subsystem: "allocator",
-		Name:      "services_allocated_total",
-		Help:      "Number of services allocated, per pool",
-	}, []string{
-		"pool",
-	}),
-}
-
-func init() {
-	prometheus.MustRegister(stats.poolCapacity)
-	prometheus.MustRegister(stats.poolActive)
-	prometheus.MustRegister(stats.poolAllocated)
+	ipServices    *prometheus.GaugeVec
+	sharingKeyIPs *prometheus.GaugeVec
+	generation    prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		poolCapacity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "metallb",
+			Subsystem: "allocator",
+			Name:      "addresses_total",
+			Help:      "Number of usable IP addresses, per pool",
+		}, []string{
+			"pool",
+		}),
+		poolActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "metallb",
+			Subsystem: "allocator",
+			Name:      "addresses_in_use_total",
+			Help:      "Number of IP addresses in use, per pool",
+		}, []string{
+			"pool",
+		}),
+		poolAllocated: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "metallb",
+			Subsystem: "allocator",
+			Name:      "services_allocated_total",
+			Help:      "Number of services allocated, per pool",
+		}, []string{
+			"pool",
+		}),
+		ipServices: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "metallb",
+			Subsystem: "allocator",
+			Name:      "address_services",
+			Help:      "Number of services sharing an IP address, per address with a sharing key",
+		}, []string{
+			"ip",
+			"sharing_key",
+		}),
+		sharingKeyIPs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "metallb",
+			Subsystem: "allocator",
+			Name:      "sharing_key_addresses",
+			Help:      "Number of IP addresses in use by the services of a sharing key. More than one means some of them couldn't share an address",
+		}, []string{
+			"sharing_key",
+		}),
+		generation: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "metallb",
+			Subsystem: "allocator",
+			Name:      "generation",
+			Help:      "Number of changes to the IP allocations since the controller started",
+		}),
+	}
+}
+
+func (m *metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.poolCapacity, m.poolActive, m.poolAllocated, m.ipServices, m.sharingKeyIPs, m.generation}
+}
+
+// collector exports the metrics of an Allocator.
+type collector struct {
+	a *Allocator
+}
+
+// Collector returns a collector of the metallb_allocator_* metrics
+// of a, for the caller to register. The metrics of an Allocator are
+// only exported once its collector is registered.
+func (a *Allocator) Collector() prometheus.Collector {
+	return collector{a}
+}
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c.a.stats.collectors() {
+		m.Describe(ch)
+	}
+	freeBlockCollector(c).Describe(ch)
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.a.stats.collectors() {
+		m.Collect(ch)
+	}
+	freeBlockCollector(c).Collect(ch)
+}
+
+// freeBlockCollector exports the largest free block of the pools of
+// an Allocator. Finding it means sorting the addresses in use, so it
+// is only done when the metrics are scraped, for the pools whose
+// addresses changed since the last scrape.
+type freeBlockCollector struct {
+	a *Allocator
+}
+
+func (c freeBlockCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- freeBlockDesc
+}
+
+func (c freeBlockCollector) Collect(ch chan<- prometheus.Metric) {
+	c.a.statsMu.Lock()
+	defer c.a.statsMu.Unlock()
+	for n := range c.a.pools {
+		v, ok := c.a.freeBlocks[n]
+		if !ok {
+			v = c.a.largestFreeBlock(n)
+			c.a.freeBlocks[n] = v
+		}
+		ch <- prometheus.MustNewConstMetric(freeBlockDesc, prometheus.GaugeValue, v, n)
+	}
 }
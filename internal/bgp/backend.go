@@ -0,0 +1,158 @@
+package bgp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+)
+
+// BackendSession is a BGP session to one peer, as implemented by a
+// Backend.
+type BackendSession interface {
+	io.Closer
+	// Set replaces the advertisements the peer should receive.
+	// Changes may be propagated asynchronously.
+	Set(advs ...*Advertisement) error
+	// Reconnect makes a session that is down retry connecting to its
+	// peer right away.
+	Reconnect()
+	// AddrsChanged tells the session that the node's addresses
+	// changed, isLocal reporting which addresses it still has.
+	AddrsChanged(isLocal func(net.IP) bool)
+}
+
+// Capabilities are the optional features a Backend supports.
+type Capabilities struct {
+	// FlowSpec rules (RFC 8955).
+	FlowSpec bool
+	// IPv4 routes with IPv6 next hops (RFC 8950).
+	ExtendedNextHop bool
+	// TCP MD5 signatures (RFC 2385).
+	MD5 bool
+	// Binding sessions to a network interface.
+	SourceInterface bool
+	// Accepting sessions from a range of peers.
+	DynamicNeighbors bool
+	// EVPN IP prefix routes (RFC 9136).
+	EVPN bool
+	// Sessions to iBGP route reflectors (RFC 4456), whose next hops
+	// must be usable by the reflector's other clients.
+	RouteReflector bool
+	// BGP confederations (RFC 5065).
+	Confederation bool
+}
+
+// A Backend implements BGP sessions. The native backend is always
+// available, others register themselves with Register.
+type Backend interface {
+	// Name identifies the backend, e.g. on the speaker command line.
+	Name() string
+	Capabilities() Capabilities
+	// NewSession starts a session with the given parameters. It
+	// returns an error if the parameters require a capability the
+	// backend doesn't have.
+	NewSession(l log.Logger, p SessionParameters) (BackendSession, error)
+}
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Backend{}
+)
+
+// Native is the BGP implementation of this package.
+var Native Backend = nativeBackend{}
+
+func init() {
+	Register(Native)
+}
+
+// Register makes b selectable by its name. It panics if another
+// backend has the same name.
+func Register(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[b.Name()]; ok {
+		panic(fmt.Sprintf("BGP backend %q registered twice", b.Name()))
+	}
+	backends[b.Name()] = b
+}
+
+// Lookup returns the backend named name.
+func Lookup(name string) (Backend, error) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	b, ok := backends[name]
+	if !ok {
+		names := make([]string, 0, len(backends))
+		for n := range backends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown BGP backend %q, must be one of: %s", name, strings.Join(names, ", "))
+	}
+	return b, nil
+}
+
+// CheckCapabilities returns an error if the session parameters p
+// require a capability missing from caps.
+func CheckCapabilities(caps Capabilities, p SessionParameters) error {
+	switch {
+	case p.FlowSpec && !caps.FlowSpec:
+		return errors.New("FlowSpec is not supported")
+	case p.NextHop != nil && p.NextHop.To4() == nil && !caps.ExtendedNextHop:
+		return errors.New("IPv6 next hops are not supported")
+	case p.Password != "" && !caps.MD5:
+		return errors.New("TCP MD5 passwords are not supported")
+	case p.SrcInterface != "" && !caps.SourceInterface:
+		return errors.New("source interfaces are not supported")
+	case p.PeerRange != nil && !caps.DynamicNeighbors:
+		return errors.New("dynamic neighbors are not supported")
+	case p.EVPN != nil && !caps.EVPN:
+		return errors.New("EVPN is not supported")
+	case p.RouteReflector && !caps.RouteReflector:
+		return errors.New("route reflector peers are not supported")
+	case p.ConfederationID != 0 && !caps.Confederation:
+		return errors.New("confederations are not supported")
+	}
+	return nil
+}
+
+// nativeBackend creates the sessions implemented by this package.
+type nativeBackend struct{}
+
+func (nativeBackend) Name() string {
+	return "native"
+}
+
+func (nativeBackend) Capabilities() Capabilities {
+	return Capabilities{
+		FlowSpec:         true,
+		ExtendedNextHop:  true,
+		MD5:              true,
+		SourceInterface:  true,
+		DynamicNeighbors: true,
+		EVPN:             true,
+		RouteReflector:   true,
+		Confederation:    true,
+	}
+}
+
+func (b nativeBackend) NewSession(l log.Logger, p SessionParameters) (BackendSession, error) {
+	if err := CheckCapabilities(b.Capabilities(), p); err != nil {
+		return nil, err
+	}
+	if p.PeerRange != nil {
+		return newDynamic(l, p)
+	}
+	s, err := New(l, p)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,111 @@
+package bgp_test
+
+import (
+	"net"
+	"testing"
+
+	"go.universe.tf/metallb/internal/bgp"
+	"go.universe.tf/metallb/internal/bgp/bgptest"
+)
+
+func TestNativeConformance(t *testing.T) {
+	bgptest.Conformance(t, bgp.Native)
+}
+
+func TestLookup(t *testing.T) {
+	b, err := bgp.Lookup("native")
+	if err != nil {
+		t.Fatalf("looking up native backend: %s", err)
+	}
+	if b != bgp.Native {
+		t.Errorf("Lookup(native) returned %v, want the native backend", b)
+	}
+	if _, err := bgp.Lookup("gobgp"); err == nil {
+		t.Error("unregistered backend found")
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	tests := []struct {
+		desc    string
+		caps    bgp.Capabilities
+		p       bgp.SessionParameters
+		wantErr bool
+	}{
+		{
+			desc: "no optional features",
+		},
+		{
+			desc:    "FlowSpec unsupported",
+			p:       bgp.SessionParameters{FlowSpec: true},
+			wantErr: true,
+		},
+		{
+			desc: "FlowSpec supported",
+			caps: bgp.Capabilities{FlowSpec: true},
+			p:    bgp.SessionParameters{FlowSpec: true},
+		},
+		{
+			desc: "IPv4 next hop",
+			p:    bgp.SessionParameters{NextHop: net.ParseIP("1.2.3.4")},
+		},
+		{
+			desc:    "IPv6 next hop unsupported",
+			p:       bgp.SessionParameters{NextHop: net.ParseIP("2001:db8::1")},
+			wantErr: true,
+		},
+		{
+			desc:    "MD5 unsupported",
+			p:       bgp.SessionParameters{Password: "hunter2"},
+			wantErr: true,
+		},
+		{
+			desc:    "source interface unsupported",
+			p:       bgp.SessionParameters{SrcInterface: "vlan100"},
+			wantErr: true,
+		},
+		{
+			desc: "everything supported",
+			caps: bgp.Native.Capabilities(),
+			p: bgp.SessionParameters{
+				FlowSpec:        true,
+				NextHop:         net.ParseIP("2001:db8::1"),
+				Password:        "hunter2",
+				SrcInterface:    "vlan100",
+				EVPN:            &bgp.EVPN{VNI: 10100},
+				RouteReflector:  true,
+				ConfederationID: 65000,
+			},
+		},
+		{
+			desc:    "EVPN unsupported",
+			p:       bgp.SessionParameters{EVPN: &bgp.EVPN{VNI: 10100}},
+			wantErr: true,
+		},
+		{
+			desc:    "dynamic neighbors unsupported",
+			p:       bgp.SessionParameters{PeerRange: &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(24, 32)}},
+			wantErr: true,
+		},
+		{
+			desc: "dynamic neighbors supported",
+			caps: bgp.Native.Capabilities(),
+			p:    bgp.SessionParameters{PeerRange: &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(24, 32)}},
+		},
+		{
+			desc:    "route reflector unsupported",
+			p:       bgp.SessionParameters{RouteReflector: true},
+			wantErr: true,
+		},
+		{
+			desc:    "confederation unsupported",
+			p:       bgp.SessionParameters{ConfederationID: 65000},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		if err := bgp.CheckCapabilities(test.caps, test.p); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.desc, err, test.wantErr)
+		}
+	}
+}
@@ -3,26 +3,39 @@ package bgp
 import "time"
 
 const (
-	backoffMax    = 2 * time.Minute
-	backoffFactor = 2
+	backoffInitial = time.Second
+	backoffMax     = 2 * time.Minute
+	backoffFactor  = 2
 )
 
 // backoff implements multiplicative backoff for retrying failing
 // operations.
 type backoff struct {
+	// Zero values mean backoffInitial and backoffMax respectively.
+	initial time.Duration
+	max     time.Duration
+
 	nextDelay time.Duration
 }
 
 // Duration returns how long to wait before the next retry.
 func (b *backoff) Duration() time.Duration {
+	initial, max := b.initial, b.max
+	if initial == 0 {
+		initial = backoffInitial
+	}
+	if max == 0 {
+		max = backoffMax
+	}
+
 	ret := b.nextDelay
 	if b.nextDelay == 0 {
-		b.nextDelay = time.Second
+		b.nextDelay = initial
 	} else {
 		b.nextDelay *= backoffFactor
-		if b.nextDelay > backoffMax {
-			b.nextDelay = backoffMax
-		}
+	}
+	if b.nextDelay > max {
+		b.nextDelay = max
 	}
 	return ret
 }
@@ -24,6 +24,63 @@ import (
 
 var errClosed = errors.New("session closed")
 
+// SessionParameters are the settings of a BGP session.
+type SessionParameters struct {
+	// Address of the peer, as host:port.
+	Addr string
+	// Local address to bind to. May be nil.
+	SrcAddr net.IP
+	// Network interface the session must leave through, regardless
+	// of the routing table. May be empty.
+	SrcInterface string
+	// Local ASN.
+	ASN uint32
+	// BGP router ID. May be nil, meaning "derive from context".
+	RouterID net.IP
+	// Expected ASN of the peer.
+	PeerASN uint32
+	// Next-hop to advertise for routes that don't specify one. May be
+	// nil, meaning the local address of the session.
+	NextHop net.IP
+	// Requested hold time.
+	HoldTime time.Duration
+	// Interval between KEEPALIVE messages. If zero, or not smaller
+	// than the negotiated hold time, a third of the negotiated hold
+	// time is used.
+	KeepaliveTime time.Duration
+	// Delay before the first reconnection attempt that follows a
+	// failed connection. Subsequent attempts back off
+	// exponentially. Defaults to 1s.
+	InitialBackoff time.Duration
+	// Maximum delay between connection attempts. Defaults to 2m.
+	ConnectRetryTime time.Duration
+	// If true, negotiate IPv4 FlowSpec (RFC 8955) with the peer, so
+	// that FlowSpec advertisements can be sent to it.
+	FlowSpec bool
+	// If set, negotiate L2VPN EVPN with the peer, and send it the
+	// unicast advertisements as EVPN IP prefix routes instead of IPv4
+	// unicast routes.
+	EVPN *EVPN
+	// TCP MD5 password. May be empty.
+	Password string
+	// Name of the node the session runs on.
+	MyNode string
+	// If set, the session is passive: instead of dialing Addr, it
+	// listens on Addr and accepts connections from any router in
+	// PeerRange (BGP dynamic neighbors), with one session per router.
+	PeerRange *net.IPNet
+	// If true, the peer is an iBGP route reflector, which passes the
+	// routes on to its other clients without rewriting their next
+	// hops. Link-local next hops, which these clients can't reach,
+	// are then never sent.
+	RouteReflector bool
+	// If not zero, ASN is a member AS of this confederation (RFC
+	// 5065), whose other member ASes are ConfederationMembers. Peers
+	// outside of the confederation see it as a single AS.
+	ConfederationID      uint32
+	ConfederationMembers []uint32
+}
+
 // Session represents one BGP session to an external router.
 type Session struct {
 	asn              uint32
@@ -31,14 +88,27 @@ type Session struct {
 	myNode           string
 	addr             string
 	srcAddr          net.IP
+	srcInterface     string
 	peerASN          uint32
 	peerFBASNSupport bool
+	flowSpec         bool
+	peerFlowSpec     bool
+	evpn             *EVPN
+	peerEVPN         bool
+	peerExtNextHop   bool
+	peerIPv6         bool
+	routeReflector   bool
+	confedID         uint32
+	confedMembers    map[uint32]bool
+	nextHop          net.IP // May be nil, meaning the local address
 	holdTime         time.Duration
+	keepaliveTime    time.Duration
 	logger           log.Logger
 	password         string
 
 	newHoldTime chan bool
 	backoff     backoff
+	retry       chan struct{}
 
 	mu             sync.Mutex
 	cond           *sync.Cond
@@ -46,8 +116,20 @@ type Session struct {
 	conn           net.Conn
 	actualHoldTime time.Duration
 	defaultNextHop net.IP
+	linkLocal      net.IP // Local address if IPv6 link-local, sent as link-local next hop
 	advertised     map[string]*Advertisement
 	new            map[string]*Advertisement
+	// The peer can send ORFs, and the prefix list it sent.
+	peerORF bool
+	orf     orfFilter
+	// Whether we're waiting for the peer's ORFs before sending our
+	// routes, and the timer that stops waiting.
+	orfPending bool
+	orfTimer   *time.Timer
+	// Whether the peer asked for all our routes again.
+	refresh bool
+	// Route distinguisher of the EVPN routes.
+	evpnRD uint64
 }
 
 // run tries to stay connected to the peer, and pumps route updates to it.
@@ -60,7 +142,10 @@ func (s *Session) run() {
 			}
 			level.Error(s.logger).Log("op", "connect", "error", err, "msg", "failed to connect to peer")
 			backoff := s.backoff.Duration()
-			time.Sleep(backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.retry:
+			}
 			continue
 		}
 		stats.SessionUp(s.addr)
@@ -89,25 +174,40 @@ func (s *Session) sendUpdates() bool {
 		return true
 	}
 
-	ibgp := s.asn == s.peerASN
+	pt := s.peering()
 	fbasn := s.peerFBASNSupport
 
 	if s.new != nil {
 		s.advertised, s.new = s.new, nil
 	}
 
-	for c, adv := range s.advertised {
-		if err := sendUpdate(s.conn, s.asn, ibgp, fbasn, s.defaultNextHop, adv); err != nil {
-			s.abort()
-			level.Error(s.logger).Log("op", "sendUpdate", "ip", c, "error", err, "msg", "failed to send BGP update")
-			return true
+	if s.peerORF {
+		// Hold our routes until the peer pushes its ORFs, so that we
+		// don't send it routes it doesn't want.
+		s.orfPending = true
+		conn := s.conn
+		s.orfTimer = time.AfterFunc(orfWait, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.conn == conn && s.orfPending {
+				s.refresh = true
+				s.cond.Broadcast()
+			}
+		})
+	} else {
+		for c, adv := range s.advertised {
+			if err := s.sendAdvertisement(pt, fbasn, adv); err != nil {
+				s.abort()
+				level.Error(s.logger).Log("op", "sendUpdate", "ip", c, "error", err, "msg", "failed to send BGP update")
+				return true
+			}
+			stats.UpdateSent(s.addr)
 		}
-		stats.UpdateSent(s.addr)
 	}
 	stats.AdvertisedPrefixes(s.addr, len(s.advertised))
 
 	for {
-		for s.new == nil && s.conn != nil {
+		for (s.new == nil || s.orfPending) && !s.refresh && s.conn != nil {
 			s.cond.Wait()
 		}
 
@@ -117,46 +217,197 @@ func (s *Session) sendUpdates() bool {
 		if s.conn == nil {
 			return true
 		}
-		if s.new == nil {
-			// nil is "no pending updates", contrast to a non-nil
-			// empty map which means "withdraw all".
+		if s.orfPending && s.new != nil {
+			// None of our routes were sent yet.
+			s.advertised, s.new = s.new, nil
+		}
+		if s.new != nil && !s.sendNew(pt, fbasn) {
+			return true
+		}
+		if s.refresh {
+			s.refresh, s.orfPending = false, false
+			if !s.resend(pt, fbasn) {
+				return true
+			}
+		}
+		stats.AdvertisedPrefixes(s.addr, len(s.advertised))
+	}
+}
+
+// sendNew pushes the changes from the advertised routes to the new
+// ones out to the peer. It returns false if the session failed.
+func (s *Session) sendNew(pt peering, fbasn bool) bool {
+	for c, adv := range s.new {
+		if adv2, ok := s.advertised[c]; ok && adv.Equal(adv2) {
+			// Peer already has correct state for this
+			// advertisement, nothing to do.
 			continue
 		}
 
-		for c, adv := range s.new {
-			if adv2, ok := s.advertised[c]; ok && adv.Equal(adv2) {
-				// Peer already has correct state for this
-				// advertisement, nothing to do.
-				continue
-			}
+		if err := s.sendAdvertisement(pt, fbasn, adv); err != nil {
+			s.abort()
+			level.Error(s.logger).Log("op", "sendUpdate", "prefix", c, "error", err, "msg", "failed to send BGP update")
+			return false
+		}
+		stats.UpdateSent(s.addr)
+	}
 
-			if err := sendUpdate(s.conn, s.asn, ibgp, fbasn, s.defaultNextHop, adv); err != nil {
-				s.abort()
-				level.Error(s.logger).Log("op", "sendUpdate", "prefix", c, "error", err, "msg", "failed to send BGP update")
-				return true
+	wdr, fsWdr := []*net.IPNet{}, []*net.IPNet{}
+	for c, adv := range s.advertised {
+		if s.new[c] != nil {
+			continue
+		}
+		if adv.FlowSpec != nil {
+			fsWdr = append(fsWdr, adv.Prefix)
+		} else {
+			wdr = append(wdr, adv.Prefix)
+		}
+	}
+	if len(fsWdr) > 0 && s.peerFlowSpec {
+		if err := sendFlowSpecWithdraw(s.conn, fsWdr); err != nil {
+			s.abort()
+			for _, pfx := range fsWdr {
+				level.Error(s.logger).Log("op", "sendFlowSpecWithdraw", "prefix", pfx, "error", err, "msg", "failed to send BGP FlowSpec withdraw")
 			}
-			stats.UpdateSent(s.addr)
+			return false
 		}
-
-		wdr := []*net.IPNet{}
-		for c, adv := range s.advertised {
-			if s.new[c] == nil {
-				wdr = append(wdr, adv.Prefix)
+		stats.UpdateSent(s.addr)
+	}
+	if len(wdr) > 0 {
+		if err := s.withdraw(wdr); err != nil {
+			s.abort()
+			for _, pfx := range wdr {
+				level.Error(s.logger).Log("op", "sendWithdraw", "prefix", pfx, "error", err, "msg", "failed to send BGP withdraw")
 			}
+			return false
 		}
-		if len(wdr) > 0 {
-			if err := sendWithdraw(s.conn, wdr); err != nil {
-				s.abort()
-				for _, pfx := range wdr {
-					level.Error(s.logger).Log("op", "sendWithdraw", "prefix", pfx, "error", err, "msg", "failed to send BGP withdraw")
-				}
-				return true
+		stats.UpdateSent(s.addr)
+	}
+	s.advertised, s.new = s.new, nil
+	return true
+}
+
+// resend sends all the advertised routes the peer's ORFs permit, and
+// withdraws the ones they deny. It returns false if the session
+// failed.
+func (s *Session) resend(pt peering, fbasn bool) bool {
+	wdr := []*net.IPNet{}
+	for c, adv := range s.advertised {
+		if adv.FlowSpec == nil && adv.Prefix.IP.To4() != nil && !s.orf.permits(adv.Prefix) {
+			wdr = append(wdr, adv.Prefix)
+			continue
+		}
+		if err := s.sendAdvertisement(pt, fbasn, adv); err != nil {
+			s.abort()
+			level.Error(s.logger).Log("op", "sendUpdate", "prefix", c, "error", err, "msg", "failed to send BGP update")
+			return false
+		}
+		stats.UpdateSent(s.addr)
+	}
+	if len(wdr) > 0 {
+		if err := s.withdraw(wdr); err != nil {
+			s.abort()
+			for _, pfx := range wdr {
+				level.Error(s.logger).Log("op", "sendWithdraw", "prefix", pfx, "error", err, "msg", "failed to send BGP withdraw")
 			}
-			stats.UpdateSent(s.addr)
+			return false
 		}
-		s.advertised, s.new = s.new, nil
-		stats.AdvertisedPrefixes(s.addr, len(s.advertised))
+		stats.UpdateSent(s.addr)
 	}
+	return true
+}
+
+// sendAdvertisement sends adv to the peer. FlowSpec advertisements,
+// EVPN routes and IPv6 routes are silently skipped if the peer did
+// not negotiate FlowSpec, EVPN, respectively IPv6 unicast. So are the
+// IPv4 routes the peer's ORFs deny, and IPv6 routes on EVPN sessions.
+// IPv4 routes with an IPv6 next hop are skipped with an error if the
+// session has no extended next hops.
+func (s *Session) sendAdvertisement(pt peering, fbasn bool, adv *Advertisement) error {
+	if adv.FlowSpec != nil {
+		if !s.peerFlowSpec {
+			return nil
+		}
+		return sendFlowSpecUpdate(s.conn, s.localASN(), pt, fbasn, adv)
+	}
+	v6 := adv.Prefix.IP.To4() == nil
+	if s.evpn != nil {
+		if !s.peerEVPN || v6 {
+			return nil
+		}
+		return sendEVPNUpdate(s.conn, s.localASN(), pt, fbasn, s.defaultNextHop, s.evpnRD, s.evpn, adv)
+	}
+	if v6 && !s.peerIPv6 {
+		return nil
+	}
+	if !v6 && !s.orf.permits(adv.Prefix) {
+		return nil
+	}
+	nextHop := adv.NextHop
+	if nextHop == nil {
+		nextHop = s.defaultNextHop
+	}
+	if !v6 && nextHop.To4() == nil && !s.peerExtNextHop {
+		level.Error(s.logger).Log("op", "sendUpdate", "prefix", adv.Prefix, "nextHop", nextHop, "msg", "IPv6 next hop without extended next hops (RFC 8950) on this session, not sending route")
+		return nil
+	}
+	if s.routeReflector && nextHop.IsLinkLocalUnicast() {
+		return nil
+	}
+	return sendUpdate(s.conn, s.localASN(), pt, fbasn, s.defaultNextHop, s.linkLocal, adv)
+}
+
+// peering returns how the local AS relates to the peer's.
+func (s *Session) peering() peering {
+	switch {
+	case s.asn == s.peerASN:
+		return peeringInternal
+	case s.confedMembers[s.peerASN]:
+		return peeringConfed
+	default:
+		return peeringExternal
+	}
+}
+
+// localASN returns the ASN the peer knows the local end by: the
+// confederation's for peers outside of it, the member AS's otherwise.
+func (s *Session) localASN() uint32 {
+	if s.confedID != 0 && s.peering() == peeringExternal {
+		return s.confedID
+	}
+	return s.asn
+}
+
+// withdraw withdraws the unicast routes for prefixes, which are EVPN
+// routes if the session has EVPN. IPv6 routes, which were never sent
+// on EVPN sessions or to peers without IPv6 unicast, are left out
+// there.
+func (s *Session) withdraw(prefixes []*net.IPNet) error {
+	if s.evpn != nil {
+		prefixes = ipv4Only(prefixes)
+		if !s.peerEVPN || len(prefixes) == 0 {
+			return nil
+		}
+		return sendEVPNWithdraw(s.conn, s.evpnRD, s.evpn, prefixes)
+	}
+	if !s.peerIPv6 {
+		prefixes = ipv4Only(prefixes)
+		if len(prefixes) == 0 {
+			return nil
+		}
+	}
+	return sendWithdraw(s.conn, prefixes)
+}
+
+// ipv4Only returns the IPv4 prefixes of prefixes.
+func ipv4Only(prefixes []*net.IPNet) []*net.IPNet {
+	var ret []*net.IPNet
+	for _, pfx := range prefixes {
+		if pfx.IP.To4() != nil {
+			ret = append(ret, pfx)
+		}
+	}
+	return ret
 }
 
 // connect establishes the BGP session with the peer.
@@ -172,12 +423,19 @@ func (s *Session) connect() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	deadline, _ := ctx.Deadline()
-	conn, err := dialMD5(ctx, s.addr, s.srcAddr, s.password)
+	conn, err := dialMD5(ctx, s.addr, s.srcAddr, s.srcInterface, s.password)
 	if err != nil {
 		return fmt.Errorf("dial %q: %s", s.addr, err)
 	}
+	return s.handshake(conn, deadline)
+}
 
-	if err = conn.SetDeadline(deadline); err != nil {
+// handshake exchanges OPENs with the peer on conn, which must
+// complete before deadline, and makes conn the session's connection.
+// s.mu must be held.
+func (s *Session) handshake(conn net.Conn, deadline time.Time) error {
+	err := conn.SetDeadline(deadline)
+	if err != nil {
 		conn.Close()
 		return fmt.Errorf("setting deadline on conn to %q: %s", s.addr, err)
 	}
@@ -188,6 +446,10 @@ func (s *Session) connect() error {
 		return fmt.Errorf("getting local addr for default nexthop to %q: %s", s.addr, err)
 	}
 	s.defaultNextHop = addr.IP
+	s.linkLocal = nil
+	if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+		s.linkLocal = addr.IP
+	}
 
 	routerID := s.routerID
 	if routerID == nil {
@@ -196,23 +458,68 @@ func (s *Session) connect() error {
 			return err
 		}
 	}
+	if s.nextHop != nil {
+		s.defaultNextHop = s.nextHop
+	}
+	if s.routeReflector {
+		// The reflector doesn't rewrite next hops, so only a global
+		// next hop is usable by its other clients.
+		s.linkLocal = nil
+		if s.defaultNextHop.IsLinkLocalUnicast() {
+			level.Warn(s.logger).Log("event", "linkLocalNextHop", "nextHop", s.defaultNextHop, "msg", "next hop to route reflector is link-local, routes without an explicit next hop will not be sent, set a global next-hop")
+		}
+	}
 
-	if err = sendOpen(conn, s.asn, routerID, s.holdTime); err != nil {
+	caps := [][]byte{routeRefreshCapability(), orfCapability()}
+	if s.flowSpec {
+		caps = append(caps, mpCapability(afiIPv4, safiFlowSpec))
+	}
+	if s.evpn != nil {
+		caps = append(caps, mpCapability(afiL2VPN, safiEVPN))
+		s.evpnRD = s.evpn.RouteDistinguisher
+		if s.evpnRD == 0 {
+			s.evpnRD = autoRouteDistinguisher(routerID, s.evpn.VNI)
+		}
+	}
+	// Over IPv6, the IPv4 routes need IPv6 next hops.
+	extNextHop := s.defaultNextHop.To4() == nil
+	if extNextHop {
+		caps = append(caps, extendedNextHopCapability())
+	}
+	if err = sendOpen(conn, s.localASN(), routerID, s.holdTime, caps...); err != nil {
 		conn.Close()
 		return fmt.Errorf("send OPEN to %q: %s", s.addr, err)
 	}
+	stats.MessageSent(s.addr, 1)
 
 	op, err := readOpen(conn)
 	if err != nil {
 		conn.Close()
 		return fmt.Errorf("read OPEN from %q: %s", s.addr, err)
 	}
+	stats.MessageReceived(s.addr, 1)
+	stats.PeerCapabilities(s.addr, op.capabilities())
 	if op.asn != s.peerASN {
 		conn.Close()
 		return fmt.Errorf("unexpected peer ASN %d, want %d", op.asn, s.peerASN)
 	}
 	s.peerFBASNSupport = op.fbasn
-	if s.asn > 65536 && !s.peerFBASNSupport {
+	s.peerFlowSpec = s.flowSpec && op.flowSpec4
+	if s.flowSpec && !s.peerFlowSpec {
+		level.Warn(s.logger).Log("event", "flowSpecUnsupported", "msg", "peer did not negotiate FlowSpec, FlowSpec rules will not be sent")
+	}
+	s.peerEVPN = s.evpn != nil && op.evpn
+	if s.evpn != nil && !s.peerEVPN {
+		level.Warn(s.logger).Log("event", "evpnUnsupported", "msg", "peer did not negotiate L2VPN EVPN, routes will not be sent")
+	}
+	s.peerORF = op.orfSend4
+	s.orf, s.orfPending, s.refresh = nil, false, false
+	s.peerIPv6 = op.mp6
+	s.peerExtNextHop = extNextHop && op.extNextHop4
+	if extNextHop && !s.peerExtNextHop {
+		level.Warn(s.logger).Log("event", "extendedNextHopUnsupported", "msg", "peer did not negotiate IPv6 next hops for IPv4 routes (RFC 8950), routes with an IPv6 next hop will not be sent")
+	}
+	if s.localASN() > 65536 && !s.peerFBASNSupport {
 		conn.Close()
 		return fmt.Errorf("peer does not support 4-byte ASNs")
 	}
@@ -231,6 +538,7 @@ func (s *Session) connect() error {
 		conn.Close()
 		return fmt.Errorf("accepting peer OPEN from %q: %s", s.addr, err)
 	}
+	stats.MessageSent(s.addr, 4)
 
 	// Set up regular keepalives from now on.
 	s.actualHoldTime = s.holdTime
@@ -322,7 +630,11 @@ func (s *Session) sendKeepalives() {
 				ch = nil
 			}
 			if ht != 0 {
-				t = time.NewTicker(ht / 3)
+				interval := ht / 3
+				if s.keepaliveTime != 0 && s.keepaliveTime < ht {
+					interval = s.keepaliveTime
+				}
+				t = time.NewTicker(interval)
 				ch = t.C
 			}
 
@@ -352,6 +664,7 @@ func (s *Session) sendKeepalive() error {
 		level.Error(s.logger).Log("op", "sendKeepalive", "error", err, "msg", "failed to send keepalive")
 		return fmt.Errorf("sending keepalive to %q: %s", s.addr, err)
 	}
+	stats.MessageSent(s.addr, 4)
 	return nil
 }
 
@@ -359,21 +672,8 @@ func (s *Session) sendKeepalive() error {
 //
 // The session will immediately try to connect and synchronize its
 // local state with the peer.
-func New(l log.Logger, addr string, srcAddr net.IP, asn uint32, routerID net.IP, peerASN uint32, holdTime time.Duration, password string, myNode string) (*Session, error) {
-	ret := &Session{
-		addr:        addr,
-		srcAddr:     srcAddr,
-		asn:         asn,
-		routerID:    routerID.To4(),
-		myNode:      myNode,
-		peerASN:     peerASN,
-		holdTime:    holdTime,
-		logger:      log.With(l, "peer", addr, "localASN", asn, "peerASN", peerASN),
-		newHoldTime: make(chan bool, 1),
-		advertised:  map[string]*Advertisement{},
-		password:    password,
-	}
-	ret.cond = sync.NewCond(&ret.mu)
+func New(l log.Logger, p SessionParameters) (*Session, error) {
+	ret := newSession(l, p)
 	go ret.sendKeepalives()
 	go ret.run()
 
@@ -383,6 +683,52 @@ func New(l log.Logger, addr string, srcAddr net.IP, asn uint32, routerID net.IP,
 	return ret, nil
 }
 
+// newSession returns a session with parameters p, which doesn't run
+// yet.
+func newSession(l log.Logger, p SessionParameters) *Session {
+	ret := &Session{
+		addr:           p.Addr,
+		srcAddr:        p.SrcAddr,
+		srcInterface:   p.SrcInterface,
+		asn:            p.ASN,
+		routerID:       p.RouterID.To4(),
+		nextHop:        nextHop(p.NextHop),
+		routeReflector: p.RouteReflector,
+		confedID:       p.ConfederationID,
+		myNode:         p.MyNode,
+		peerASN:        p.PeerASN,
+		holdTime:       p.HoldTime,
+		keepaliveTime:  p.KeepaliveTime,
+		flowSpec:       p.FlowSpec,
+		evpn:           p.EVPN,
+		logger:         log.With(l, "peer", p.Addr, "localASN", p.ASN, "peerASN", p.PeerASN),
+		newHoldTime:    make(chan bool, 1),
+		retry:          make(chan struct{}, 1),
+		advertised:     map[string]*Advertisement{},
+		password:       p.Password,
+		backoff: backoff{
+			initial: p.InitialBackoff,
+			max:     p.ConnectRetryTime,
+		},
+	}
+	if p.ConfederationID != 0 {
+		ret.confedMembers = map[uint32]bool{}
+		for _, asn := range p.ConfederationMembers {
+			ret.confedMembers[asn] = true
+		}
+	}
+	ret.cond = sync.NewCond(&ret.mu)
+	return ret
+}
+
+// nextHop returns ip in its 4-byte form if it is an IPv4 address.
+func nextHop(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 // consumeBGP receives BGP messages from the peer, and ignores
 // them. It does minimal checks for the well-formedness of messages,
 // and terminates the connection if something looks wrong.
@@ -411,12 +757,24 @@ func (s *Session) consumeBGP(conn io.ReadCloser) {
 			// TODO: propagate
 			return
 		}
+		stats.MessageReceived(s.addr, hdr.Type)
 		if hdr.Type == 3 {
 			// TODO: propagate better than just logging directly.
 			err := readNotification(conn)
 			level.Error(s.logger).Log("event", "peerNotification", "error", err, "msg", "peer sent notification, closing session")
 			return
 		}
+		if hdr.Type == msgRouteRefresh {
+			rr, err := readRouteRefresh(io.LimitReader(conn, int64(hdr.Len)-19))
+			if err != nil {
+				level.Error(s.logger).Log("op", "routeRefresh", "error", err, "msg", "peer sent malformed ROUTE-REFRESH, closing session")
+				return
+			}
+			if rr != nil {
+				s.routeRefresh(conn, rr)
+			}
+			continue
+		}
 		if _, err := io.Copy(ioutil.Discard, io.LimitReader(conn, int64(hdr.Len)-19)); err != nil {
 			// TODO: propagate
 			return
@@ -424,33 +782,67 @@ func (s *Session) consumeBGP(conn io.ReadCloser) {
 	}
 }
 
+// routeRefresh applies the ORFs of a ROUTE-REFRESH the peer sent on
+// conn, and sends our routes again if it asks for them.
+func (s *Session) routeRefresh(conn io.ReadCloser, rr *routeRefresh) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	for _, e := range rr.orf {
+		s.orf = s.orf.apply(e)
+	}
+	if len(rr.orf) > 0 {
+		level.Info(s.logger).Log("event", "orfUpdated", "entries", len(s.orf), "msg", "peer updated its outbound route filter")
+	}
+	if rr.immediate {
+		if s.orfTimer != nil {
+			s.orfTimer.Stop()
+		}
+		s.refresh = true
+		s.cond.Broadcast()
+	}
+}
+
 // Set updates the set of Advertisements that this session's peer should receive.
 //
 // Changes are propagated to the peer asynchronously, Set may return
 // before the peer learns about the changes.
 func (s *Session) Set(advs ...*Advertisement) error {
+	newAdvs, err := advertisementMap(advs)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	newAdvs := map[string]*Advertisement{}
+	s.new = newAdvs
+	stats.PendingPrefixes(s.addr, len(s.new))
+	s.cond.Broadcast()
+	return nil
+}
+
+// advertisementMap validates advs, and returns them keyed by what
+// they advertise.
+func advertisementMap(advs []*Advertisement) (map[string]*Advertisement, error) {
+	ret := map[string]*Advertisement{}
 	for _, adv := range advs {
-		if adv.Prefix.IP.To4() == nil {
-			return fmt.Errorf("cannot advertise non-v4 prefix %q", adv.Prefix)
+		if adv.FlowSpec != nil && adv.Prefix.IP.To4() == nil {
+			return nil, fmt.Errorf("cannot send FlowSpec rule for non-v4 prefix %q", adv.Prefix)
 		}
 
-		if adv.NextHop != nil && adv.NextHop.To4() == nil {
-			return fmt.Errorf("next-hop must be IPv4, got %q", adv.NextHop)
-		}
 		if len(adv.Communities) > 63 {
-			return fmt.Errorf("max supported communities is 63, got %d", len(adv.Communities))
+			return nil, fmt.Errorf("max supported communities is 63, got %d", len(adv.Communities))
+		}
+		if adv.FlowSpec != nil {
+			ret["flowspec/"+adv.Prefix.String()] = adv
+		} else {
+			ret[adv.Prefix.String()] = adv
 		}
-		newAdvs[adv.Prefix.String()] = adv
 	}
-
-	s.new = newAdvs
-	stats.PendingPrefixes(s.addr, len(s.new))
-	s.cond.Broadcast()
-	return nil
+	return ret, nil
 }
 
 // abort closes any existing connection, updates stats, and cleans up
@@ -470,6 +862,45 @@ func (s *Session) abort() {
 	s.cond.Broadcast()
 }
 
+// Reconnect makes a session that is down retry connecting to its peer
+// right away, instead of when its backoff expires. It does nothing to
+// an established session.
+func (s *Session) Reconnect() {
+	s.mu.Lock()
+	connected := s.conn != nil
+	s.mu.Unlock()
+	if connected {
+		return
+	}
+	select {
+	case s.retry <- struct{}{}:
+	default:
+	}
+}
+
+// AddrsChanged resets the session if its connection is from an
+// address the node no longer has, as isLocal reports, so that it
+// reconnects from a current address and advertises it as next hop. A
+// session that is down retries connecting right away, a new address
+// may reach its peer.
+func (s *Session) AddrsChanged(isLocal func(net.IP) bool) {
+	s.mu.Lock()
+	if s.conn != nil {
+		addr, ok := s.conn.LocalAddr().(*net.TCPAddr)
+		if ok && !isLocal(addr.IP) {
+			level.Info(s.logger).Log("event", "localAddressRemoved", "localAddress", addr.IP, "msg", "node no longer has the session's local address, resetting BGP session")
+			s.abort()
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	select {
+	case s.retry <- struct{}{}:
+	default:
+	}
+}
+
 // Close shuts down the BGP session.
 func (s *Session) Close() error {
 	s.mu.Lock()
@@ -485,11 +916,29 @@ type Advertisement struct {
 	Prefix *net.IPNet
 	// The address of the router to which the peer should forward traffic.
 	NextHop net.IP
+	// The MULTI_EXIT_DISC of this route, lower is preferred. Not
+	// sent if zero.
+	MED uint32
 	// The local preference of this route. Only propagated to IBGP
 	// peers (i.e. where the peer ASN matches the local ASN).
 	LocalPref uint32
 	// BGP communities to attach to the path.
 	Communities []uint32
+	// If non-zero, the bandwidth in bytes per second to signal with
+	// the link bandwidth extended community, for routers that weigh
+	// ECMP paths by it.
+	LinkBandwidth float32
+	// If non-nil, this is a FlowSpec rule (RFC 8955) matching all
+	// traffic destined to Prefix, rather than a unicast route. It is
+	// only sent to peers that negotiated FlowSpec support.
+	FlowSpec *FlowSpecAction
+}
+
+// FlowSpecAction is the traffic filtering action of a FlowSpec rule.
+type FlowSpecAction struct {
+	// Maximum rate, in bytes per second, of traffic matching the
+	// rule. Zero discards all matching traffic.
+	RateLimit float32
 }
 
 // Equal returns true if a and b are equivalent advertisements.
@@ -503,6 +952,15 @@ func (a *Advertisement) Equal(b *Advertisement) bool {
 	if a.LocalPref != b.LocalPref {
 		return false
 	}
+	if a.MED != b.MED {
+		return false
+	}
+	if a.LinkBandwidth != b.LinkBandwidth {
+		return false
+	}
+	if !reflect.DeepEqual(a.FlowSpec, b.FlowSpec) {
+		return false
+	}
 	return reflect.DeepEqual(a.Communities, b.Communities)
 }
 
@@ -528,7 +986,7 @@ type tcpmd5sig struct {
 // proper TCP MD5 options when the password is not empty. Works by manupulating
 // the low level FD's, skipping the net.Conn API as it has not hooks to set
 // the neccessary sockopts for TCP MD5.
-func dialMD5(ctx context.Context, addr string, srcAddr net.IP, password string) (net.Conn, error) {
+func dialMD5(ctx context.Context, addr string, srcAddr net.IP, srcInterface, password string) (net.Conn, error) {
 	// If srcAddr exists on any of the local network interfaces, use it as the
 	// source address of the TCP socket. Otherwise, use the IPv6 unspecified
 	// address ("::") to let the kernel figure out the source address.
@@ -569,16 +1027,21 @@ func dialMD5(ctx context.Context, addr string, srcAddr net.IP, password string)
 		la = lsockaddr
 	} else {
 		family = unix.AF_INET6
-		rsockaddr := &unix.SockaddrInet6{Port: raddr.Port}
+		// Link-local peers are only reachable through the interface
+		// of their zone, and so is a link-local source address.
+		rzone, err := zoneIndex(raddr.Zone)
+		if err != nil {
+			return nil, err
+		}
+		rsockaddr := &unix.SockaddrInet6{Port: raddr.Port, ZoneId: rzone}
 		copy(rsockaddr.Addr[:], raddr.IP.To16())
 		ra = rsockaddr
-		var zone uint32
-		if laddr.Zone != "" {
-			intf, errs := net.InterfaceByName(laddr.Zone)
-			if errs != nil {
-				return nil, errs
-			}
-			zone = uint32(intf.Index)
+		zone, err := zoneIndex(laddr.Zone)
+		if err != nil {
+			return nil, err
+		}
+		if zone == 0 && laddr.IP.IsLinkLocalUnicast() {
+			zone = rzone
 		}
 		lsockaddr := &unix.SockaddrInet6{ZoneId: zone}
 		copy(lsockaddr.Addr[:], laddr.IP.To16())
@@ -611,6 +1074,12 @@ func dialMD5(ctx context.Context, addr string, srcAddr net.IP, password string)
 		}
 	}
 
+	if srcInterface != "" {
+		if err = os.NewSyscallError("setsockopt", unix.BindToDevice(fd, srcInterface)); err != nil {
+			return nil, err
+		}
+	}
+
 	if err = unix.Bind(fd, la); err != nil {
 		return nil, os.NewSyscallError("bind", err)
 	}
@@ -693,6 +1162,19 @@ func buildTCPMD5Sig(addr net.IP, key string) tcpmd5sig {
 	return t
 }
 
+// zoneIndex returns the index of the interface named by an IPv6
+// address zone, or 0 for no zone.
+func zoneIndex(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	intf, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(intf.Index), nil
+}
+
 // localAddressExists returns true if the address addr exists on any of the
 // network interfaces in the ifs slice.
 func localAddressExists(ifs []net.Interface, addr net.IP) bool {
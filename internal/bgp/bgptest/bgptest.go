@@ -0,0 +1,315 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bgptest is a conformance suite for BGP backends. It runs a
+// backend's sessions against a minimal fake peer, and checks what the
+// peer receives.
+package bgptest // import "go.universe.tf/metallb/internal/bgp/bgptest"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"go.universe.tf/metallb/internal/bgp"
+)
+
+const (
+	localASN = 64500
+	peerASN  = 64501
+
+	msgOpen      = 1
+	msgUpdate    = 2
+	msgKeepalive = 4
+)
+
+// Conformance checks that sessions of backend b establish, advertise,
+// withdraw and close as the speaker expects.
+func Conformance(t *testing.T, b bgp.Backend) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listening for the session: %s", err)
+	}
+	defer ln.Close()
+	if err := ln.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatalf("setting accept deadline: %s", err)
+	}
+
+	s, err := b.NewSession(log.NewNopLogger(), bgp.SessionParameters{
+		Addr:             ln.Addr().String(),
+		ASN:              localASN,
+		RouterID:         net.ParseIP("10.0.0.1"),
+		PeerASN:          peerASN,
+		HoldTime:         90 * time.Second,
+		InitialBackoff:   100 * time.Millisecond,
+		ConnectRetryTime: time.Second,
+		MyNode:           "bgptest",
+	})
+	if err != nil {
+		t.Fatalf("%s: creating session: %s", b.Name(), err)
+	}
+	defer s.Close()
+
+	conn := establish(t, b, ln)
+	defer conn.Close()
+
+	// Advertise.
+	adv := &bgp.Advertisement{
+		Prefix:  &net.IPNet{IP: net.ParseIP("192.0.2.10").To4(), Mask: net.CIDRMask(32, 32)},
+		NextHop: net.ParseIP("198.51.100.1"),
+	}
+	if err := s.Set(adv); err != nil {
+		t.Fatalf("%s: setting advertisements: %s", b.Name(), err)
+	}
+	u, err := readUpdate(conn)
+	if err != nil {
+		t.Fatalf("%s: reading advertisement: %s", b.Name(), err)
+	}
+	if got, want := fmt.Sprint(u.nlri), "[192.0.2.10/32]"; got != want {
+		t.Errorf("%s: advertised %s, want %s", b.Name(), got, want)
+	}
+	if !u.nextHop.Equal(adv.NextHop) {
+		t.Errorf("%s: advertised next hop %s, want %s", b.Name(), u.nextHop, adv.NextHop)
+	}
+
+	// Withdraw.
+	if err := s.Set(); err != nil {
+		t.Fatalf("%s: clearing advertisements: %s", b.Name(), err)
+	}
+	if u, err = readUpdate(conn); err != nil {
+		t.Fatalf("%s: reading withdrawal: %s", b.Name(), err)
+	}
+	if got, want := fmt.Sprint(u.withdrawn), "[192.0.2.10/32]"; got != want {
+		t.Errorf("%s: withdrew %s, want %s", b.Name(), got, want)
+	}
+
+	// The node loses the session's local address, e.g. to DHCP
+	// renumbering. The session reconnects.
+	s.AddrsChanged(func(net.IP) bool { return false })
+	for {
+		if _, _, err := readMessage(conn); err != nil {
+			break
+		}
+	}
+	conn = establish(t, b, ln)
+	defer conn.Close()
+
+	// Close.
+	if err := s.Close(); err != nil {
+		t.Fatalf("%s: closing session: %s", b.Name(), err)
+	}
+	for {
+		if _, _, err := readMessage(conn); err != nil {
+			if err != io.EOF {
+				t.Errorf("%s: session not closed cleanly: %s", b.Name(), err)
+			}
+			break
+		}
+	}
+}
+
+// establish accepts the connection of a session on ln, and exchanges
+// OPENs with it.
+func establish(t *testing.T, b bgp.Backend, ln *net.TCPListener) net.Conn {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("%s: session didn't connect: %s", b.Name(), err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		conn.Close()
+		t.Fatalf("setting session deadline: %s", err)
+	}
+
+	typ, body, err := readMessage(conn)
+	if err != nil {
+		t.Fatalf("%s: reading OPEN: %s", b.Name(), err)
+	}
+	if typ != msgOpen {
+		t.Fatalf("%s: got message type %d, want OPEN", b.Name(), typ)
+	}
+	if len(body) < 10 || body[0] != 4 {
+		t.Fatalf("%s: malformed OPEN % x", b.Name(), body)
+	}
+	if asn := binary.BigEndian.Uint16(body[1:3]); asn != localASN {
+		t.Errorf("%s: OPEN has ASN %d, want %d", b.Name(), asn, localASN)
+	}
+	if err := sendOpen(conn); err != nil {
+		t.Fatalf("sending OPEN: %s", err)
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		t.Fatalf("sending KEEPALIVE: %s", err)
+	}
+	if typ, _, err = readMessage(conn); err != nil || typ != msgKeepalive {
+		t.Fatalf("%s: session didn't accept OPEN, got message type %d, error %v", b.Name(), typ, err)
+	}
+	return conn
+}
+
+// readMessage reads one BGP message, and returns its type and body.
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	var hdr [19]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	l := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if l < len(hdr) {
+		return 0, nil, fmt.Errorf("invalid message length %d", l)
+	}
+	body := make([]byte, l-len(hdr))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[18], body, nil
+}
+
+// writeMessage writes a BGP message of type typ.
+func writeMessage(w io.Writer, typ uint8, body []byte) error {
+	msg := make([]byte, 19, 19+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:18], uint16(19+len(body)))
+	msg[18] = typ
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// sendOpen sends the OPEN of the fake peer. Its only capability is
+// 4-byte ASNs, which every peer supports in practice.
+func sendOpen(w io.Writer) error {
+	body := []byte{
+		4,    // version
+		0, 0, // ASN
+		0, 90, // hold time
+		10, 0, 0, 2, // router ID
+		8,           // options length
+		2, 6, 65, 4, // capability: 4-byte ASN
+		0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint16(body[1:3], peerASN)
+	binary.BigEndian.PutUint32(body[14:18], peerASN)
+	return writeMessage(w, msgOpen, body)
+}
+
+// update is the content of an UPDATE message that matters to the
+// suite.
+type update struct {
+	withdrawn []string
+	nlri      []string
+	nextHop   net.IP
+}
+
+// readUpdate reads messages until it gets an UPDATE, and decodes it.
+func readUpdate(r io.Reader) (*update, error) {
+	for {
+		typ, body, err := readMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ == msgUpdate {
+			return parseUpdate(body)
+		}
+	}
+}
+
+func parseUpdate(body []byte) (*update, error) {
+	ret := &update{}
+	if len(body) < 2 {
+		return nil, fmt.Errorf("truncated UPDATE % x", body)
+	}
+	wl := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < wl+2 {
+		return nil, fmt.Errorf("truncated UPDATE withdrawn routes % x", body)
+	}
+	var err error
+	if ret.withdrawn, err = parsePrefixes(body[:wl], 4); err != nil {
+		return nil, err
+	}
+	body = body[wl:]
+	al := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < al {
+		return nil, fmt.Errorf("truncated UPDATE attributes % x", body)
+	}
+	attrs := body[:al]
+	if ret.nlri, err = parsePrefixes(body[al:], 4); err != nil {
+		return nil, err
+	}
+
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return nil, fmt.Errorf("truncated attribute % x", attrs)
+		}
+		flags, code := attrs[0], attrs[1]
+		var l int
+		if flags&0x10 != 0 {
+			if len(attrs) < 4 {
+				return nil, fmt.Errorf("truncated attribute % x", attrs)
+			}
+			l, attrs = int(binary.BigEndian.Uint16(attrs[2:4])), attrs[4:]
+		} else {
+			l, attrs = int(attrs[2]), attrs[3:]
+		}
+		if len(attrs) < l {
+			return nil, fmt.Errorf("truncated attribute %d % x", code, attrs)
+		}
+		val := attrs[:l]
+		attrs = attrs[l:]
+
+		switch code {
+		case 3: // NEXT_HOP
+			ret.nextHop = net.IP(val)
+		case 14: // MP_REACH_NLRI
+			if len(val) < 4 || binary.BigEndian.Uint16(val) != 1 || val[2] != 1 {
+				continue
+			}
+			nhl := int(val[3])
+			if len(val) < 5+nhl {
+				return nil, fmt.Errorf("truncated MP_REACH_NLRI % x", val)
+			}
+			ret.nextHop = net.IP(val[4 : 4+nhl])
+			pfxs, err := parsePrefixes(val[5+nhl:], 4)
+			if err != nil {
+				return nil, err
+			}
+			ret.nlri = append(ret.nlri, pfxs...)
+		}
+	}
+	sort.Strings(ret.withdrawn)
+	sort.Strings(ret.nlri)
+	return ret, nil
+}
+
+// parsePrefixes parses a list of prefixes of the given address
+// length.
+func parsePrefixes(b []byte, addrLen int) ([]string, error) {
+	var ret []string
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+		if bits > addrLen*8 || len(b) < 1+n {
+			return nil, fmt.Errorf("malformed prefix % x", b)
+		}
+		ip := make(net.IP, addrLen)
+		copy(ip, b[1:1+n])
+		ret = append(ret, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, addrLen*8)}).String())
+		b = b[1+n:]
+	}
+	return ret, nil
+}
@@ -0,0 +1,231 @@
+package bgp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Dynamic neighbors: routers in a range connect to us, rather than us
+// to them. All the ranges listening on an address share a listener,
+// which hands each connection to the range it comes from.
+
+// dynamicSession is the set of passive sessions with the routers in a
+// range. Each router gets the same advertisements.
+type dynamicSession struct {
+	logger log.Logger
+	params SessionParameters
+	ln     *listener
+
+	mu       sync.Mutex
+	closed   bool
+	advs     []*Advertisement
+	sessions map[string]*Session
+}
+
+// newDynamic starts accepting sessions from the routers in p.PeerRange
+// on p.Addr.
+func newDynamic(l log.Logger, p SessionParameters) (*dynamicSession, error) {
+	if p.Password != "" {
+		return nil, errors.New("TCP MD5 passwords are not supported for peer ranges")
+	}
+	d := &dynamicSession{
+		logger:   log.With(l, "peerRange", p.PeerRange, "localASN", p.ASN, "peerASN", p.PeerASN),
+		params:   p,
+		sessions: map[string]*Session{},
+	}
+	ln, err := listen(l, p.Addr, d)
+	if err != nil {
+		return nil, err
+	}
+	d.ln = ln
+	return d, nil
+}
+
+// accept runs a passive session on conn, replacing any previous
+// session with the same router.
+func (d *dynamicSession) accept(conn net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		conn.Close()
+		return
+	}
+	ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	if old := d.sessions[ip]; old != nil {
+		old.Close()
+	}
+	p := d.params
+	p.Addr = conn.RemoteAddr().String()
+	s := newSession(d.logger, p)
+	// Can't fail, Set validated the advertisements.
+	s.Set(d.advs...) // nolint:errcheck
+	d.sessions[ip] = s
+	stats.NewSession(p.Addr)
+	go s.sendKeepalives()
+	go func() {
+		s.runPassive(conn)
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.sessions[ip] == s {
+			delete(d.sessions, ip)
+		}
+	}()
+}
+
+// Set sets the advertisements of the sessions with all the routers in
+// the range, present and future.
+func (d *dynamicSession) Set(advs ...*Advertisement) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Validate now, rather than when a router connects.
+	if _, err := advertisementMap(advs); err != nil {
+		return err
+	}
+	d.advs = advs
+	for _, s := range d.sessions {
+		if err := s.Set(advs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reconnect does nothing, the routers reconnect by themselves.
+func (d *dynamicSession) Reconnect() {}
+
+// AddrsChanged resets the sessions accepted on an address the node no
+// longer has. The routers reconnect by themselves.
+func (d *dynamicSession) AddrsChanged(isLocal func(net.IP) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.sessions {
+		s.AddrsChanged(isLocal)
+	}
+}
+
+// Close closes the sessions with all the routers, and stops accepting
+// new ones.
+func (d *dynamicSession) Close() error {
+	d.ln.remove(d)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for _, s := range d.sessions {
+		s.Close()
+	}
+	d.sessions = map[string]*Session{}
+	return nil
+}
+
+// runPassive runs the session on conn, accepted from the peer, until
+// the connection fails or the session is closed.
+func (s *Session) runPassive(conn net.Conn) {
+	defer stats.DeleteSession(s.addr)
+	// Closing the session also stops sendKeepalives.
+	defer s.Close()
+
+	s.mu.Lock()
+	err := s.handshake(conn, time.Now().Add(10*time.Second))
+	s.mu.Unlock()
+	if err != nil {
+		conn.Close()
+		level.Error(s.logger).Log("op", "acceptSession", "error", err, "msg", "failed to establish BGP session with dynamic neighbor")
+		return
+	}
+	stats.SessionUp(s.addr)
+	level.Info(s.logger).Log("event", "sessionUp", "msg", "BGP session established")
+	if s.sendUpdates() {
+		level.Warn(s.logger).Log("event", "sessionDown", "msg", "BGP session down")
+	}
+}
+
+// listener accepts the connections of the dynamic neighbors on one
+// address.
+type listener struct {
+	logger log.Logger
+	addr   string
+	ln     net.Listener
+
+	// Guarded by listenersMu.
+	ranges []*dynamicSession
+}
+
+var (
+	listenersMu sync.Mutex
+	listeners   = map[string]*listener{}
+)
+
+// listen adds d to the listener on addr, creating it if needed.
+func listen(l log.Logger, addr string, d *dynamicSession) (*listener, error) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	ln := listeners[addr]
+	if ln == nil {
+		tl, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		ln = &listener{logger: l, addr: addr, ln: tl}
+		listeners[addr] = ln
+		go ln.serve()
+	}
+	ln.ranges = append(ln.ranges, d)
+	return ln, nil
+}
+
+// remove removes d from the listener, and closes the listener if no
+// range uses it anymore.
+func (ln *listener) remove(d *dynamicSession) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for i, r := range ln.ranges {
+		if r == d {
+			ln.ranges = append(ln.ranges[:i], ln.ranges[i+1:]...)
+			break
+		}
+	}
+	if len(ln.ranges) == 0 && listeners[ln.addr] == ln {
+		delete(listeners, ln.addr)
+		ln.ln.Close()
+	}
+}
+
+func (ln *listener) serve() {
+	for {
+		conn, err := ln.ln.Accept()
+		if err != nil {
+			listenersMu.Lock()
+			closed := listeners[ln.addr] != ln
+			listenersMu.Unlock()
+			if closed {
+				return
+			}
+			level.Error(ln.logger).Log("op", "acceptSession", "addr", ln.addr, "error", err, "msg", "failed to accept BGP connection")
+			time.Sleep(time.Second)
+			continue
+		}
+		if d := ln.rangeFor(conn.RemoteAddr().(*net.TCPAddr).IP); d != nil {
+			d.accept(conn)
+		} else {
+			level.Warn(ln.logger).Log("op", "acceptSession", "peer", conn.RemoteAddr(), "msg", "rejecting BGP connection from outside the peer ranges")
+			conn.Close()
+		}
+	}
+}
+
+// rangeFor returns the range that ip belongs to, nil if none.
+func (ln *listener) rangeFor(ip net.IP) *dynamicSession {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for _, d := range ln.ranges {
+		if d.params.PeerRange.Contains(ip) {
+			return d
+		}
+	}
+	return nil
+}
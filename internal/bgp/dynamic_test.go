@@ -0,0 +1,107 @@
+package bgp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// dialDynamic connects to the dynamic neighbor listener on addr from
+// the local address src.
+func dialDynamic(t *testing.T, addr, src string) net.Conn {
+	listenersMu.Lock()
+	ln := listeners[addr]
+	listenersMu.Unlock()
+	if ln == nil {
+		t.Fatalf("no listener on %s", addr)
+	}
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(src)}}
+	conn, err := d.Dial("tcp", ln.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("connecting to dynamic neighbor listener: %s", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatalf("setting session deadline: %s", err)
+	}
+	return conn
+}
+
+func TestDynamicNeighbors(t *testing.T) {
+	s, err := Native.NewSession(log.NewNopLogger(), SessionParameters{
+		Addr:      "127.0.0.1:0",
+		ASN:       64500,
+		RouterID:  net.ParseIP("10.0.0.1"),
+		PeerASN:   64501,
+		HoldTime:  90 * time.Second,
+		MyNode:    "test",
+		PeerRange: cidr("127.0.0.1/32"),
+	})
+	if err != nil {
+		t.Fatalf("creating dynamic session: %s", err)
+	}
+	defer s.Close()
+	adv := &Advertisement{Prefix: cidr("192.0.2.10/32")}
+	if err := s.Set(adv); err != nil {
+		t.Fatalf("setting advertisements: %s", err)
+	}
+
+	// Routers outside the range are turned away.
+	conn := dialDynamic(t, "127.0.0.1:0", "127.0.0.2")
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection from outside the range not closed, got error %v", err)
+	}
+	conn.Close()
+
+	// Routers in the range get the advertisements.
+	conn = dialDynamic(t, "127.0.0.1:0", "127.0.0.1")
+	defer conn.Close()
+	if _, err := readOpen(conn); err != nil {
+		t.Fatalf("reading OPEN: %s", err)
+	}
+	if err := sendOpen(conn, 64501, net.ParseIP("10.0.0.2"), 90*time.Second); err != nil {
+		t.Fatalf("sending OPEN: %s", err)
+	}
+	if err := sendKeepalive(conn); err != nil {
+		t.Fatalf("sending KEEPALIVE: %s", err)
+	}
+	var want bytes.Buffer
+	if err := sendUpdate(&want, 64500, peeringExternal, true, net.ParseIP("127.0.0.1").To4(), nil, adv); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestUpdates(t, conn, 1); got[0] != want.String() {
+		t.Errorf("wrong advertisement\ngot:  %x\nwant: %x", got[0], want.Bytes())
+	}
+
+	if err := s.Set(); err != nil {
+		t.Fatalf("clearing advertisements: %s", err)
+	}
+	want.Reset()
+	if err := sendWithdraw(&want, []*net.IPNet{adv.Prefix}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestUpdates(t, conn, 1); got[0] != want.String() {
+		t.Errorf("wrong withdrawal\ngot:  %x\nwant: %x", got[0], want.Bytes())
+	}
+
+	// Closing ends the sessions, and the listener.
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing dynamic session: %s", err)
+	}
+	for {
+		if _, err := conn.Read(make([]byte, 4096)); err != nil {
+			if err != io.EOF {
+				t.Errorf("session not closed cleanly: %s", err)
+			}
+			break
+		}
+	}
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if listeners["127.0.0.1:0"] != nil {
+		t.Error("listener still open after closing the last range")
+	}
+}
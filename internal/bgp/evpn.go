@@ -0,0 +1,214 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// EVPN IP prefix routes (RFC 9136): instead of IPv4 unicast routes,
+// the session sends its routes as type-5 routes of the L2VPN EVPN
+// address family (RFC 7432), so that they go straight into an IP VRF
+// of an EVPN/VXLAN fabric.
+
+const (
+	afiL2VPN = 25
+	safiEVPN = 70
+
+	evpnIPPrefixRoute = 5
+	// VXLAN tunnel type of the encapsulation extended community (RFC
+	// 9012).
+	tunnelVXLAN = 8
+)
+
+// EVPN are the parameters of the EVPN routes of a session.
+type EVPN struct {
+	// VXLAN network identifier of the IP VRF the routes go in, sent as
+	// the routes' label.
+	VNI uint32
+	// Route distinguisher, in its 8-byte encoding (RFC 4364). Zero
+	// means <router ID>:<VNI>.
+	RouteDistinguisher uint64
+	// Route targets, as 8-byte extended communities.
+	RouteTargets []uint64
+	// MAC address of the node for the router's MAC extended community
+	// (RFC 9135), which symmetric IRB fabrics require. May be nil.
+	RouterMAC net.HardwareAddr
+}
+
+// autoRouteDistinguisher returns the type 1 route distinguisher
+// <routerID>:<vni>, keeping the low 16 bits of the VNI.
+func autoRouteDistinguisher(routerID net.IP, vni uint32) uint64 {
+	return 1<<48 | uint64(binary.BigEndian.Uint32(routerID.To4()))<<16 | uint64(vni&0xffff)
+}
+
+// encodeEVPNNLRI writes the IP prefix route for pfx.
+func encodeEVPNNLRI(b *bytes.Buffer, rd uint64, vni uint32, pfx *net.IPNet) {
+	o, _ := pfx.Mask.Size()
+	b.Write([]byte{
+		evpnIPPrefixRoute,
+		34, // len, with IPv4 prefix and gateway
+	})
+	binary.Write(b, binary.BigEndian, rd) // nolint:errcheck
+	b.Write(make([]byte, 10))             // ESI
+	b.Write(make([]byte, 4))              // ethernet tag
+	b.WriteByte(byte(o))
+	b.Write(pfx.IP.To4())
+	b.Write(make([]byte, 4)) // gateway, unused with the router's MAC
+	b.Write([]byte{byte(vni >> 16), byte(vni >> 8), byte(vni)})
+}
+
+// sendEVPNUpdate sends an UPDATE that announces adv.Prefix as an
+// EVPN IP prefix route, with nextHop as the VTEP address.
+func sendEVPNUpdate(w io.Writer, asn uint32, pt peering, fbasn bool, nextHop net.IP, rd uint64, evpn *EVPN, adv *Advertisement) error {
+	var b bytes.Buffer
+
+	hdr := struct {
+		M1, M2  uint64
+		Len     uint16
+		Type    uint8
+		WdrLen  uint16
+		AttrLen uint16
+	}{
+		M1:   uint64(0xffffffffffffffff),
+		M2:   uint64(0xffffffffffffffff),
+		Type: 2,
+	}
+	if err := binary.Write(&b, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+	l := b.Len()
+	if err := encodeOriginASPath(&b, asn, pt, fbasn); err != nil {
+		return err
+	}
+	if adv.MED > 0 {
+		b.Write([]byte{
+			0x80, 4, // optional non-transitive, MED
+			4, // len
+		})
+		if err := binary.Write(&b, binary.BigEndian, adv.MED); err != nil {
+			return err
+		}
+	}
+	if err := encodeLocalPrefCommunities(&b, pt, adv); err != nil {
+		return err
+	}
+
+	var ext bytes.Buffer
+	for _, rt := range evpn.RouteTargets {
+		if err := binary.Write(&ext, binary.BigEndian, rt); err != nil {
+			return err
+		}
+	}
+	ext.Write([]byte{
+		0x03, 0x0c, // encapsulation
+		0, 0, 0, 0, // reserved
+		0, tunnelVXLAN,
+	})
+	if evpn.RouterMAC != nil {
+		ext.Write([]byte{
+			0x06, 0x03, // router's MAC
+		})
+		ext.Write(evpn.RouterMAC)
+	}
+	if adv.LinkBandwidth > 0 {
+		ext.Write([]byte{
+			0x40, 0x04, // link bandwidth, non-transitive
+		})
+		if err := binary.Write(&ext, binary.BigEndian, twoByteASN(asn)); err != nil {
+			return err
+		}
+		if err := binary.Write(&ext, binary.BigEndian, adv.LinkBandwidth); err != nil {
+			return err
+		}
+	}
+	b.Write([]byte{
+		0xd0, 16, // optional transitive, extended length, extended communities
+	})
+	if err := binary.Write(&b, binary.BigEndian, uint16(ext.Len())); err != nil {
+		return err
+	}
+	if _, err := io.Copy(&b, &ext); err != nil {
+		return err
+	}
+
+	if adv.NextHop != nil {
+		nextHop = adv.NextHop
+	}
+	if ip4 := nextHop.To4(); ip4 != nil {
+		nextHop = ip4
+	}
+	var nlri bytes.Buffer
+	encodeEVPNNLRI(&nlri, rd, evpn.VNI, adv.Prefix)
+	b.Write([]byte{
+		0x90, 14, // optional, extended length, MP_REACH_NLRI
+	})
+	if err := binary.Write(&b, binary.BigEndian, uint16(5+len(nextHop)+nlri.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(&b, binary.BigEndian, uint16(afiL2VPN)); err != nil {
+		return err
+	}
+	b.Write([]byte{
+		safiEVPN,
+		byte(len(nextHop)),
+	})
+	b.Write(nextHop)
+	b.WriteByte(0) // reserved
+	if _, err := io.Copy(&b, &nlri); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-l))
+	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
+
+	if _, err := io.Copy(w, &b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sendEVPNWithdraw sends an UPDATE that withdraws the EVPN IP prefix
+// routes for prefixes.
+func sendEVPNWithdraw(w io.Writer, rd uint64, evpn *EVPN, prefixes []*net.IPNet) error {
+	var b bytes.Buffer
+
+	hdr := struct {
+		M1, M2  uint64
+		Len     uint16
+		Type    uint8
+		WdrLen  uint16
+		AttrLen uint16
+	}{
+		M1:   uint64(0xffffffffffffffff),
+		M2:   uint64(0xffffffffffffffff),
+		Type: 2,
+	}
+	if err := binary.Write(&b, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+	var nlri bytes.Buffer
+	for _, pfx := range prefixes {
+		encodeEVPNNLRI(&nlri, rd, evpn.VNI, pfx)
+	}
+	b.Write([]byte{
+		0x90, 15, // optional, extended length, MP_UNREACH_NLRI
+	})
+	if err := binary.Write(&b, binary.BigEndian, uint16(3+nlri.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(&b, binary.BigEndian, uint16(afiL2VPN)); err != nil {
+		return err
+	}
+	b.WriteByte(safiEVPN)
+	if _, err := io.Copy(&b, &nlri); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-23))
+	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
+
+	if _, err := io.Copy(w, &b); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package bgp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestEVPNUpdate(t *testing.T) {
+	evpn := &EVPN{
+		VNI:          10100,
+		RouteTargets: []uint64{0x0002fbf400002774},
+	}
+	rd := autoRouteDistinguisher(net.ParseIP("10.0.0.1"), evpn.VNI)
+	adv := &Advertisement{Prefix: cidr("192.0.2.10/32")}
+
+	var b bytes.Buffer
+	if err := sendEVPNUpdate(&b, 64500, peeringExternal, true, net.ParseIP("10.0.0.1"), rd, evpn, adv); err != nil {
+		t.Fatalf("encoding EVPN update: %s", err)
+	}
+	marker := bytes.Repeat([]byte{0xff}, 16)
+	nlri := []byte{
+		5, 34, // IP prefix route
+		0, 1, 10, 0, 0, 1, 0x27, 0x74, // RD
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, // ESI
+		0, 0, 0, 0, // ethernet tag
+		32, 192, 0, 2, 10, // prefix
+		0, 0, 0, 0, // gateway
+		0, 0x27, 0x74, // VNI
+	}
+	want := append(marker, []byte{
+		0, 105, 2, // len, UPDATE
+		0, 0, // withdrawn len
+		0, 82, // attributes len
+		0x40, 1, 1, 2, // origin
+		0x40, 2, 6, 2, 1, 0, 0, 0xfb, 0xf4, // AS path
+		0xd0, 16, 0, 16, // extended communities
+		0, 2, 0xfb, 0xf4, 0, 0, 0x27, 0x74, // route target
+		3, 0x0c, 0, 0, 0, 0, 0, 8, // VXLAN encapsulation
+		0x90, 14, 0, 45, // MP_REACH_NLRI
+		0, 25, 70, // L2VPN EVPN
+		4, 10, 0, 0, 1, // next hop
+		0, // reserved
+	}...)
+	want = append(want, nlri...)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("wrong EVPN update\ngot:  %x\nwant: %x", b.Bytes(), want)
+	}
+
+	b.Reset()
+	if err := sendEVPNWithdraw(&b, rd, evpn, []*net.IPNet{adv.Prefix}); err != nil {
+		t.Fatalf("encoding EVPN withdraw: %s", err)
+	}
+	want = append(marker, []byte{
+		0, 66, 2, // len, UPDATE
+		0, 0, // withdrawn len
+		0, 43, // attributes len
+		0x90, 15, 0, 39, // MP_UNREACH_NLRI
+		0, 25, 70, // L2VPN EVPN
+	}...)
+	want = append(want, nlri...)
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("wrong EVPN withdraw\ngot:  %x\nwant: %x", b.Bytes(), want)
+	}
+}
@@ -10,7 +10,23 @@ import (
 	"time"
 )
 
-func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration) error {
+// mpCapability returns a multiprotocol extensions capability (RFC
+// 4760) advertising support for afi/safi.
+func mpCapability(afi uint16, safi uint8) []byte {
+	return []byte{1, 4, byte(afi >> 8), byte(afi), 0, safi}
+}
+
+// extendedNextHopCapability returns an extended next hop encoding
+// capability (RFC 8950) advertising support for IPv4 unicast routes
+// with IPv6 next hops.
+func extendedNextHopCapability() []byte {
+	return []byte{5, 6, 0, afiIPv4, 0, safiUnicast, 0, afiIPv6}
+}
+
+// sendOpen sends an OPEN message. The message always advertises IPv4
+// and IPv6 unicast and 4-byte ASN support, extraCaps are appended to
+// those capabilities.
+func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration, extraCaps ...[]byte) error {
 	if routerID.To4() == nil {
 		panic("non-ipv4 address used as RouterID")
 	}
@@ -77,13 +93,27 @@ func sendOpen(w io.Writer, asn uint32, routerID net.IP, holdTime time.Duration)
 		CapLen:  4,
 		ASN32:   asn,
 	}
-	msg.Len = uint16(binary.Size(msg))
 	if asn > 65535 {
 		msg.ASN16 = 23456
 	}
 	copy(msg.RouterID[:], routerID.To4())
+	for _, c := range extraCaps {
+		msg.OptsLen += uint8(len(c))
+		msg.OptLen += uint8(len(c))
+	}
+	msg.Len = uint16(binary.Size(msg))
 
-	return binary.Write(w, binary.BigEndian, msg)
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.BigEndian, msg); err != nil {
+		return err
+	}
+	for _, c := range extraCaps {
+		b.Write(c)
+	}
+	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
+
+	_, err := io.Copy(w, &b)
+	return err
 }
 
 type openResult struct {
@@ -91,8 +121,50 @@ type openResult struct {
 	holdTime time.Duration
 	mp4      bool
 	mp6      bool
+	// IPv4 FlowSpec supported
+	flowSpec4 bool
+	// L2VPN EVPN supported
+	evpn bool
+	// IPv4 unicast routes with IPv6 next hops supported
+	extNextHop4 bool
 	// Four-byte ASN supported
 	fbasn bool
+	// Peer can send address prefix ORFs for IPv4 unicast
+	orfSend4 bool
+	// Route refresh supported
+	routeRefresh bool
+	// Graceful restart supported
+	gracefulRestart bool
+}
+
+// capabilityNames are the names of the capabilities that
+// openResult.capabilities reports.
+var capabilityNames = []string{
+	"ipv4-unicast",
+	"ipv6-unicast",
+	"ipv4-flowspec",
+	"l2vpn-evpn",
+	"extended-nexthop",
+	"4-byte-asn",
+	"orf",
+	"route-refresh",
+	"graceful-restart",
+}
+
+// capabilities returns whether the OPEN advertised each of the
+// capabilities of capabilityNames.
+func (o *openResult) capabilities() map[string]bool {
+	return map[string]bool{
+		"ipv4-unicast":     o.mp4,
+		"ipv6-unicast":     o.mp6,
+		"ipv4-flowspec":    o.flowSpec4,
+		"l2vpn-evpn":       o.evpn,
+		"extended-nexthop": o.extNextHop4,
+		"4-byte-asn":       o.fbasn,
+		"orf":              o.orfSend4,
+		"route-refresh":    o.routeRefresh,
+		"graceful-restart": o.gracefulRestart,
+	}
 }
 
 var notificationCodes = map[uint16]string{
@@ -271,6 +343,53 @@ func readCapabilities(r io.Reader, ret *openResult) error {
 				ret.mp4 = true
 			case af.AFI == 2 && af.SAFI == 1:
 				ret.mp6 = true
+			case af.AFI == 1 && af.SAFI == safiFlowSpec:
+				ret.flowSpec4 = true
+			case af.AFI == afiL2VPN && af.SAFI == safiEVPN:
+				ret.evpn = true
+			}
+		case 2:
+			ret.routeRefresh = true
+		case 64:
+			// We don't restart gracefully, only record that the peer
+			// can.
+			ret.gracefulRestart = true
+			if _, err := io.Copy(ioutil.Discard, &lr); err != nil {
+				return err
+			}
+		case 5:
+			for lr.N > 0 {
+				enc := struct {
+					AFI, SAFI, NextHopAFI uint16
+				}{}
+				if err := binary.Read(&lr, binary.BigEndian, &enc); err != nil {
+					return err
+				}
+				if enc.AFI == afiIPv4 && enc.SAFI == safiUnicast && enc.NextHopAFI == afiIPv6 {
+					ret.extNextHop4 = true
+				}
+			}
+		case 3:
+			for lr.N > 0 {
+				af := struct {
+					AFI       uint16
+					_         uint8
+					SAFI, Num uint8
+				}{}
+				if err := binary.Read(&lr, binary.BigEndian, &af); err != nil {
+					return err
+				}
+				for i := 0; i < int(af.Num); i++ {
+					orf := struct{ Type, SendReceive uint8 }{}
+					if err := binary.Read(&lr, binary.BigEndian, &orf); err != nil {
+						return err
+					}
+					// Send/Receive is 1 for receive, 2 for send, 3 for
+					// both.
+					if af.AFI == afiIPv4 && af.SAFI == safiUnicast && orf.Type == orfTypePrefix && orf.SendReceive&2 != 0 {
+						ret.orfSend4 = true
+					}
+				}
 			}
 		default:
 			// TODO: only ignore capabilities that we know are fine to
@@ -285,7 +404,10 @@ func readCapabilities(r io.Reader, ret *openResult) error {
 	}
 }
 
-func sendUpdate(w io.Writer, asn uint32, ibgp, fbasn bool, defaultNextHop net.IP, adv *Advertisement) error {
+// sendUpdate sends adv, with the next hop defaultNextHop unless adv
+// has one. linkLocal, if not nil, is the link-local address of the
+// session, sent alongside defaultNextHop as IPv6 next hops (RFC 2545).
+func sendUpdate(w io.Writer, asn uint32, pt peering, fbasn bool, defaultNextHop, linkLocal net.IP, adv *Advertisement) error {
 	var b bytes.Buffer
 
 	hdr := struct {
@@ -303,11 +425,31 @@ func sendUpdate(w io.Writer, asn uint32, ibgp, fbasn bool, defaultNextHop net.IP
 		return err
 	}
 	l := b.Len()
-	if err := encodePathAttrs(&b, asn, ibgp, fbasn, defaultNextHop, adv); err != nil {
+	if err := encodePathAttrs(&b, asn, pt, fbasn, defaultNextHop, adv); err != nil {
 		return err
 	}
+	nextHop := adv.NextHop
+	if nextHop == nil {
+		nextHop = defaultNextHop
+	} else {
+		linkLocal = nil
+	}
+	// IPv6 routes, and IPv4 routes with an IPv6 next hop (RFC 8950),
+	// go in MP_REACH_NLRI rather than in the NLRI field.
+	afi := uint16(afiIPv4)
+	if adv.Prefix.IP.To4() == nil {
+		afi = afiIPv6
+	}
+	mpReach := afi == afiIPv6 || nextHop.To4() == nil
+	if mpReach {
+		if err := encodeMPReach(&b, afi, nextHop, linkLocal, adv.Prefix); err != nil {
+			return err
+		}
+	}
 	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-l))
-	encodePrefixes(&b, []*net.IPNet{adv.Prefix})
+	if !mpReach {
+		encodePrefixes(&b, []*net.IPNet{adv.Prefix})
+	}
 	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
 
 	if _, err := io.Copy(w, &b); err != nil {
@@ -316,11 +458,53 @@ func sendUpdate(w io.Writer, asn uint32, ibgp, fbasn bool, defaultNextHop net.IP
 	return nil
 }
 
+// encodeMPReach writes an MP_REACH_NLRI attribute announcing the
+// prefix pfx of the address family afi with the IPv6 next hop
+// nextHop, followed by the link-local next hop linkLocal if not nil.
+// IPv4 next hops, only valid for IPv6 prefixes, are sent as
+// IPv4-mapped IPv6 addresses.
+//
+// A link-local next hop always comes after a global one, so with
+// only a link-local address, e.g. on sessions with link-local peers
+// of nodes without a global IPv6 address, it is sent as both.
+func encodeMPReach(b *bytes.Buffer, afi uint16, nextHop, linkLocal net.IP, pfx *net.IPNet) error {
+	if linkLocal == nil && nextHop.To4() == nil && nextHop.IsLinkLocalUnicast() {
+		linkLocal = nextHop
+	}
+	nextHops := nextHop.To16()
+	if linkLocal != nil {
+		nextHops = append(append([]byte{}, nextHops...), linkLocal.To16()...)
+	}
+	var nlri bytes.Buffer
+	encodePrefixes(&nlri, []*net.IPNet{pfx})
+	b.Write([]byte{
+		0x90, 14, // optional, extended length, MP_REACH_NLRI
+	})
+	if err := binary.Write(b, binary.BigEndian, uint16(5+len(nextHops)+nlri.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(b, binary.BigEndian, afi); err != nil {
+		return err
+	}
+	b.Write([]byte{
+		safiUnicast,
+		byte(len(nextHops)), // next-hop len
+	})
+	b.Write(nextHops)
+	b.WriteByte(0) // reserved
+	_, err := io.Copy(b, &nlri)
+	return err
+}
+
 func encodePrefixes(b *bytes.Buffer, pfxs []*net.IPNet) {
 	for _, pfx := range pfxs {
 		o, _ := pfx.Mask.Size()
+		ip := pfx.IP.To4()
+		if ip == nil {
+			ip = pfx.IP.To16()
+		}
 		b.WriteByte(byte(o))
-		b.Write(pfx.IP.To4()[:bytesForBits(o)])
+		b.Write(ip[:bytesForBits(o)])
 	}
 }
 
@@ -331,7 +515,76 @@ func bytesForBits(n int) int {
 	return ((n + 7) &^ 7) / 8
 }
 
-func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp, fbasn bool, defaultNextHop net.IP, adv *Advertisement) error {
+func encodePathAttrs(b *bytes.Buffer, asn uint32, pt peering, fbasn bool, defaultNextHop net.IP, adv *Advertisement) error {
+	if err := encodeOriginASPath(b, asn, pt, fbasn); err != nil {
+		return err
+	}
+	nextHop := adv.NextHop
+	if nextHop == nil {
+		nextHop = defaultNextHop
+	}
+	// IPv6 next hops, and the next hops of IPv6 routes, are sent in
+	// MP_REACH_NLRI instead.
+	if nextHop.To4() != nil && adv.Prefix.IP.To4() != nil {
+		b.Write([]byte{
+			0x40, 3, // mandatory, next-hop
+			4, // len
+		})
+		b.Write(nextHop.To4())
+	}
+	if adv.MED > 0 {
+		b.Write([]byte{
+			0x80, 4, // optional non-transitive, MED
+			4, // len
+		})
+		if err := binary.Write(b, binary.BigEndian, adv.MED); err != nil {
+			return err
+		}
+	}
+	if err := encodeLocalPrefCommunities(b, pt, adv); err != nil {
+		return err
+	}
+	if adv.LinkBandwidth > 0 {
+		b.Write([]byte{
+			0xc0, 16, // optional transitive, extended communities
+			8,          // len
+			0x40, 0x04, // link bandwidth, non-transitive
+		})
+		if err := binary.Write(b, binary.BigEndian, twoByteASN(asn)); err != nil {
+			return err
+		}
+		if err := binary.Write(b, binary.BigEndian, adv.LinkBandwidth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// twoByteASN returns asn for use in extended communities that only
+// have room for 2-byte ASNs, 0 if it does not fit.
+func twoByteASN(asn uint32) uint16 {
+	if asn > 65535 {
+		return 0
+	}
+	return uint16(asn)
+}
+
+// peering is how the local AS of a session relates to the peer's,
+// which decides the AS_PATH and LOCAL_PREF of the routes.
+type peering uint8
+
+const (
+	// eBGP, between different ASes.
+	peeringExternal peering = iota
+	// iBGP, within the same AS.
+	peeringInternal
+	// Between two member ASes of a confederation (RFC 5065), which
+	// is iBGP except for the AS_PATH.
+	peeringConfed
+)
+
+// encodeOriginASPath writes the ORIGIN and AS_PATH attributes.
+func encodeOriginASPath(b *bytes.Buffer, asn uint32, pt peering, fbasn bool) error {
 	b.Write([]byte{
 		0x40, 1, // mandatory, origin
 		1, // len
@@ -339,13 +592,17 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp, fbasn bool, defaultNextH
 
 		0x40, 2, // mandatory, as-path
 	})
-	if ibgp {
+	if pt == peeringInternal {
 		b.WriteByte(0) // empty AS path
 	} else {
+		segType := byte(2) // AS_SEQUENCE
+		if pt == peeringConfed {
+			segType = 3 // AS_CONFED_SEQUENCE
+		}
 		if fbasn {
 			b.Write([]byte{
 				6, // len (1x 4-byte ASN)
-				2, // AS_SEQUENCE
+				segType,
 				1, // len (in number of ASes)
 			})
 			if err := binary.Write(b, binary.BigEndian, asn); err != nil {
@@ -354,7 +611,7 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp, fbasn bool, defaultNextH
 		} else {
 			b.Write([]byte{
 				4, // len (1x 2-byte ASN)
-				2, // AS_SEQUENCE
+				segType,
 				1, // len (in number of ASes)
 			})
 			if err := binary.Write(b, binary.BigEndian, uint16(asn)); err != nil {
@@ -362,16 +619,13 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp, fbasn bool, defaultNextH
 			}
 		}
 	}
-	b.Write([]byte{
-		0x40, 3, // mandatory, next-hop
-		4, // len
-	})
-	if adv.NextHop != nil {
-		b.Write(adv.NextHop.To4())
-	} else {
-		b.Write(defaultNextHop)
-	}
-	if ibgp {
+	return nil
+}
+
+// encodeLocalPrefCommunities writes the LOCAL_PREF (for IBGP and
+// confederation sessions) and COMMUNITIES attributes of adv.
+func encodeLocalPrefCommunities(b *bytes.Buffer, pt peering, adv *Advertisement) error {
+	if pt != peeringExternal {
 		b.Write([]byte{
 			0x40, 5, // well-known, localpref
 			4, // len
@@ -398,6 +652,8 @@ func encodePathAttrs(b *bytes.Buffer, asn uint32, ibgp, fbasn bool, defaultNextH
 	return nil
 }
 
+// sendWithdraw withdraws prefixes, the IPv4 ones in the withdrawn
+// routes field, the IPv6 ones in an MP_UNREACH_NLRI attribute.
 func sendWithdraw(w io.Writer, prefixes []*net.IPNet) error {
 	var b bytes.Buffer
 
@@ -414,10 +670,39 @@ func sendWithdraw(w io.Writer, prefixes []*net.IPNet) error {
 	if err := binary.Write(&b, binary.BigEndian, hdr); err != nil {
 		return err
 	}
+	var v4, v6 []*net.IPNet
+	for _, pfx := range prefixes {
+		if pfx.IP.To4() != nil {
+			v4 = append(v4, pfx)
+		} else {
+			v6 = append(v6, pfx)
+		}
+	}
 	l := b.Len()
-	encodePrefixes(&b, prefixes)
+	encodePrefixes(&b, v4)
 	binary.BigEndian.PutUint16(b.Bytes()[19:21], uint16(b.Len()-l))
-	if err := binary.Write(&b, binary.BigEndian, uint16(0)); err != nil {
+	var attrs bytes.Buffer
+	if len(v6) > 0 {
+		var nlri bytes.Buffer
+		encodePrefixes(&nlri, v6)
+		attrs.Write([]byte{
+			0x90, 15, // optional, extended length, MP_UNREACH_NLRI
+		})
+		if err := binary.Write(&attrs, binary.BigEndian, uint16(3+nlri.Len())); err != nil {
+			return err
+		}
+		if err := binary.Write(&attrs, binary.BigEndian, uint16(afiIPv6)); err != nil {
+			return err
+		}
+		attrs.WriteByte(safiUnicast)
+		if _, err := io.Copy(&attrs, &nlri); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(&b, binary.BigEndian, uint16(attrs.Len())); err != nil {
+		return err
+	}
+	if _, err := io.Copy(&b, &attrs); err != nil {
 		return err
 	}
 	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
@@ -441,3 +726,135 @@ func sendKeepalive(w io.Writer) error {
 	}
 	return binary.Write(w, binary.BigEndian, msg)
 }
+
+const (
+	afiIPv4      = 1
+	afiIPv6      = 2
+	safiUnicast  = 1
+	safiFlowSpec = 133
+)
+
+// encodeFlowSpecNLRI encodes a FlowSpec NLRI (RFC 8955) that matches
+// all traffic destined to pfx.
+func encodeFlowSpecNLRI(b *bytes.Buffer, pfx *net.IPNet) {
+	o, _ := pfx.Mask.Size()
+	n := bytesForBits(o)
+	b.WriteByte(byte(2 + n)) // NLRI length
+	b.WriteByte(1)           // destination prefix component
+	b.WriteByte(byte(o))
+	b.Write(pfx.IP.To4()[:n])
+}
+
+// sendFlowSpecUpdate sends an UPDATE that installs a FlowSpec rule
+// matching traffic to adv.Prefix, with adv.FlowSpec as the traffic
+// filtering action.
+func sendFlowSpecUpdate(w io.Writer, asn uint32, pt peering, fbasn bool, adv *Advertisement) error {
+	var b bytes.Buffer
+
+	hdr := struct {
+		M1, M2  uint64
+		Len     uint16
+		Type    uint8
+		WdrLen  uint16
+		AttrLen uint16
+	}{
+		M1:   uint64(0xffffffffffffffff),
+		M2:   uint64(0xffffffffffffffff),
+		Type: 2,
+	}
+	if err := binary.Write(&b, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+	l := b.Len()
+	if err := encodeOriginASPath(&b, asn, pt, fbasn); err != nil {
+		return err
+	}
+	if err := encodeLocalPrefCommunities(&b, pt, adv); err != nil {
+		return err
+	}
+
+	// Traffic-rate extended community. A rate of zero means discard.
+	b.Write([]byte{
+		0xc0, 16, // optional transitive, extended communities
+		8,          // len
+		0x80, 0x06, // traffic-rate
+	})
+	if err := binary.Write(&b, binary.BigEndian, twoByteASN(asn)); err != nil {
+		return err
+	}
+	if err := binary.Write(&b, binary.BigEndian, adv.FlowSpec.RateLimit); err != nil {
+		return err
+	}
+
+	var nlri bytes.Buffer
+	encodeFlowSpecNLRI(&nlri, adv.Prefix)
+	b.Write([]byte{
+		0x90, 14, // optional, extended length, MP_REACH_NLRI
+	})
+	if err := binary.Write(&b, binary.BigEndian, uint16(5+nlri.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(&b, binary.BigEndian, uint16(afiIPv4)); err != nil {
+		return err
+	}
+	b.Write([]byte{
+		safiFlowSpec,
+		0, // next-hop len, FlowSpec routes have no next-hop
+		0, // reserved
+	})
+	if _, err := io.Copy(&b, &nlri); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-l))
+	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
+
+	if _, err := io.Copy(w, &b); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sendFlowSpecWithdraw sends an UPDATE that removes the FlowSpec rules
+// matching traffic to prefixes.
+func sendFlowSpecWithdraw(w io.Writer, prefixes []*net.IPNet) error {
+	var b bytes.Buffer
+
+	hdr := struct {
+		M1, M2  uint64
+		Len     uint16
+		Type    uint8
+		WdrLen  uint16
+		AttrLen uint16
+	}{
+		M1:   uint64(0xffffffffffffffff),
+		M2:   uint64(0xffffffffffffffff),
+		Type: 2,
+	}
+	if err := binary.Write(&b, binary.BigEndian, hdr); err != nil {
+		return err
+	}
+	var nlri bytes.Buffer
+	for _, pfx := range prefixes {
+		encodeFlowSpecNLRI(&nlri, pfx)
+	}
+	b.Write([]byte{
+		0x90, 15, // optional, extended length, MP_UNREACH_NLRI
+	})
+	if err := binary.Write(&b, binary.BigEndian, uint16(3+nlri.Len())); err != nil {
+		return err
+	}
+	if err := binary.Write(&b, binary.BigEndian, uint16(afiIPv4)); err != nil {
+		return err
+	}
+	b.WriteByte(safiFlowSpec)
+	if _, err := io.Copy(&b, &nlri); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(b.Bytes()[21:23], uint16(b.Len()-23))
+	binary.BigEndian.PutUint16(b.Bytes()[16:18], uint16(b.Len()))
+
+	if _, err := io.Copy(w, &b); err != nil {
+		return err
+	}
+	return nil
+}
@@ -7,6 +7,8 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/go-kit/kit/log"
 )
 
 // Just test that sendOpen and readOpen can at least talk to each other.
@@ -92,3 +94,375 @@ func TestOpenFourByteASN(t *testing.T) {
 		}
 	}
 }
+
+func TestOpenCapabilities(t *testing.T) {
+	// BGP OPEN from Arista EOS 4.13.10M: IPv4 unicast, route refresh
+	// and graceful restart.
+	b := bytes.NewBuffer([]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x2b, 0x01, 0x04, 0xfd, 0xe9, 0x00, 0xb4, 0xb9, 0xec, 0xf0, 0x40, 0x0e, 0x02,
+		0x0c, 0x01, 0x04, 0x00, 0x01, 0x00, 0x01, 0x02, 0x00, 0x40, 0x02, 0x00, 0xb4,
+	})
+	op, err := readOpen(b)
+	if err != nil {
+		t.Fatalf("readOpen: %s", err)
+	}
+	want := map[string]bool{
+		"ipv4-unicast":     true,
+		"ipv6-unicast":     false,
+		"ipv4-flowspec":    false,
+		"l2vpn-evpn":       false,
+		"extended-nexthop": false,
+		"4-byte-asn":       false,
+		"orf":              false,
+		"route-refresh":    true,
+		"graceful-restart": true,
+	}
+	got := op.capabilities()
+	if len(got) != len(capabilityNames) {
+		t.Errorf("got %d capabilities, want %d", len(got), len(capabilityNames))
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("capability %q is %v, want %v", name, got[name], w)
+		}
+	}
+}
+
+func TestOpenFlowSpec(t *testing.T) {
+	for _, flowSpec := range []bool{false, true} {
+		var b bytes.Buffer
+		var caps [][]byte
+		if flowSpec {
+			caps = append(caps, mpCapability(afiIPv4, safiFlowSpec))
+		}
+		if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 4*time.Second, caps...); err != nil {
+			t.Fatalf("Send open: %s", err)
+		}
+		op, err := readOpen(&b)
+		if err != nil {
+			t.Fatalf("Read open: %s", err)
+		}
+		if !op.mp4 || !op.mp6 || !op.fbasn {
+			t.Errorf("Lost default capabilities with flowspec=%v: %#v", flowSpec, op)
+		}
+		if op.flowSpec4 != flowSpec {
+			t.Errorf("Wrong FlowSpec capability, want %v, got %v", flowSpec, op.flowSpec4)
+		}
+	}
+}
+
+func TestFlowSpecUpdate(t *testing.T) {
+	var b bytes.Buffer
+	adv := &Advertisement{
+		Prefix:   &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+		FlowSpec: &FlowSpecAction{RateLimit: 0},
+	}
+	if err := sendFlowSpecUpdate(&b, 65000, peeringExternal, true, adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x3f, // len
+		0x02,       // UPDATE
+		0x00, 0x00, // withdrawn len
+		0x00, 0x28, // attrs len
+		0x40, 0x01, 0x01, 0x02, // origin INCOMPLETE
+		0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8, // AS_PATH 65000
+		0xc0, 0x10, 0x08, 0x80, 0x06, 0xfd, 0xe8, 0x00, 0x00, 0x00, 0x00, // traffic-rate 0
+		0x90, 0x0e, 0x00, 0x0c, 0x00, 0x01, 0x85, 0x00, 0x00, // MP_REACH_NLRI, IPv4 FlowSpec
+		0x06, 0x01, 0x20, 0x01, 0x02, 0x03, 0x04, // dst 1.2.3.4/32
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong FlowSpec update\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+
+	b.Reset()
+	if err := sendFlowSpecWithdraw(&b, []*net.IPNet{adv.Prefix}); err != nil {
+		t.Fatalf("Send withdraw: %s", err)
+	}
+	want = []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x25, // len
+		0x02,       // UPDATE
+		0x00, 0x00, // withdrawn len
+		0x00, 0x0e, // attrs len
+		0x90, 0x0f, 0x00, 0x0a, 0x00, 0x01, 0x85, // MP_UNREACH_NLRI, IPv4 FlowSpec
+		0x06, 0x01, 0x20, 0x01, 0x02, 0x03, 0x04, // dst 1.2.3.4/32
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong FlowSpec withdraw\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+}
+
+func TestUpdatePathAttrs(t *testing.T) {
+	var b bytes.Buffer
+	adv := &Advertisement{
+		Prefix:        &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+		MED:           10,
+		LinkBandwidth: 2,
+	}
+	if err := sendUpdate(&b, 65000, peeringExternal, true, net.ParseIP("10.0.0.1").To4(), nil, adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x42, // len
+		0x02,       // UPDATE
+		0x00, 0x00, // withdrawn len
+		0x00, 0x26, // attrs len
+		0x40, 0x01, 0x01, 0x02, // origin INCOMPLETE
+		0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8, // AS_PATH 65000
+		0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01, // next-hop 10.0.0.1
+		0x80, 0x04, 0x04, 0x00, 0x00, 0x00, 0x0a, // MED 10
+		0xc0, 0x10, 0x08, 0x40, 0x04, 0xfd, 0xe8, 0x40, 0x00, 0x00, 0x00, // link bandwidth 2.0
+		0x20, 0x01, 0x02, 0x03, 0x04, // 1.2.3.4/32
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong update\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+}
+
+func TestUpdateConfedPathAttrs(t *testing.T) {
+	var b bytes.Buffer
+	adv := &Advertisement{
+		Prefix:    &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+		LocalPref: 200,
+	}
+	if err := sendUpdate(&b, 64512, peeringConfed, true, net.ParseIP("10.0.0.1").To4(), nil, adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x37, // len
+		0x02,       // UPDATE
+		0x00, 0x00, // withdrawn len
+		0x00, 0x1b, // attrs len
+		0x40, 0x01, 0x01, 0x02, // origin INCOMPLETE
+		0x40, 0x02, 0x06, 0x03, 0x01, 0x00, 0x00, 0xfc, 0x00, // AS_PATH (64512), confederation
+		0x40, 0x03, 0x04, 0x0a, 0x00, 0x00, 0x01, // next-hop 10.0.0.1
+		0x40, 0x05, 0x04, 0x00, 0x00, 0x00, 0xc8, // LOCAL_PREF 200
+		0x20, 0x01, 0x02, 0x03, 0x04, // 1.2.3.4/32
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong update\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+}
+
+func TestConfederationPeering(t *testing.T) {
+	tests := []struct {
+		peerASN uint32
+		wantPT  peering
+		wantASN uint32
+	}{
+		{64512, peeringInternal, 64512},
+		{64513, peeringConfed, 64512},
+		{64600, peeringExternal, 65000},
+	}
+	for _, test := range tests {
+		s := newSession(log.NewNopLogger(), SessionParameters{
+			ASN:                  64512,
+			PeerASN:              test.peerASN,
+			ConfederationID:      65000,
+			ConfederationMembers: []uint32{64513},
+		})
+		if pt, asn := s.peering(), s.localASN(); pt != test.wantPT || asn != test.wantASN {
+			t.Errorf("peer AS %d: got peering %d with local AS %d, want %d with %d", test.peerASN, pt, asn, test.wantPT, test.wantASN)
+		}
+	}
+}
+
+func TestOpenExtendedNextHop(t *testing.T) {
+	for _, extNextHop := range []bool{false, true} {
+		var b bytes.Buffer
+		var caps [][]byte
+		if extNextHop {
+			caps = append(caps, extendedNextHopCapability())
+		}
+		if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 4*time.Second, caps...); err != nil {
+			t.Fatalf("Send open: %s", err)
+		}
+		op, err := readOpen(&b)
+		if err != nil {
+			t.Fatalf("Read open: %s", err)
+		}
+		if !op.mp4 || !op.mp6 || !op.fbasn {
+			t.Errorf("Lost default capabilities with extended next hop=%v: %#v", extNextHop, op)
+		}
+		if op.extNextHop4 != extNextHop {
+			t.Errorf("Wrong extended next hop capability, want %v, got %v", extNextHop, op.extNextHop4)
+		}
+	}
+}
+
+func TestUpdateIPv6NextHop(t *testing.T) {
+	var b bytes.Buffer
+	adv := &Advertisement{
+		Prefix: &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+	}
+	if err := sendUpdate(&b, 65000, peeringExternal, true, net.ParseIP("2001:db8::1"), nil, adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x42, // len
+		0x02,       // UPDATE
+		0x00, 0x00, // withdrawn len
+		0x00, 0x2b, // attrs len
+		0x40, 0x01, 0x01, 0x02, // origin INCOMPLETE
+		0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8, // AS_PATH 65000
+		0x90, 0x0e, 0x00, 0x1a, 0x00, 0x01, 0x01, 0x10, // MP_REACH_NLRI, IPv4 unicast, 16 byte next-hop
+		0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // next-hop 2001:db8::1
+		0x00,                         // reserved
+		0x20, 0x01, 0x02, 0x03, 0x04, // 1.2.3.4/32
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong update\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+}
+
+func TestUpdateIPv6Prefix(t *testing.T) {
+	var b bytes.Buffer
+	adv := &Advertisement{
+		Prefix: &net.IPNet{IP: net.ParseIP("2001:db8:1::"), Mask: net.CIDRMask(48, 128)},
+	}
+	if err := sendUpdate(&b, 65000, peeringExternal, true, net.ParseIP("10.0.0.1").To4(), nil, adv); err != nil {
+		t.Fatalf("Send update: %s", err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x44, // len
+		0x02,       // UPDATE
+		0x00, 0x00, // withdrawn len
+		0x00, 0x2d, // attrs len
+		0x40, 0x01, 0x01, 0x02, // origin INCOMPLETE
+		0x40, 0x02, 0x06, 0x02, 0x01, 0x00, 0x00, 0xfd, 0xe8, // AS_PATH 65000
+		0x90, 0x0e, 0x00, 0x1c, 0x00, 0x02, 0x01, 0x10, // MP_REACH_NLRI, IPv6 unicast, 16 byte next-hop
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x0a, 0x00, 0x00, 0x01, // next-hop ::ffff:10.0.0.1
+		0x00,                                     // reserved
+		0x30, 0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, // 2001:db8:1::/48
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong update\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+}
+
+func TestWithdrawIPv6(t *testing.T) {
+	var b bytes.Buffer
+	prefixes := []*net.IPNet{
+		{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)},
+	}
+	if err := sendWithdraw(&b, prefixes); err != nil {
+		t.Fatalf("Send withdraw: %s", err)
+	}
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x27, // len
+		0x02,       // UPDATE
+		0x00, 0x04, // withdrawn len
+		0x18, 0x0a, 0x00, 0x00, // 10.0.0.0/24
+		0x00, 0x0c, // attrs len
+		0x90, 0x0f, 0x00, 0x08, 0x00, 0x02, 0x01, // MP_UNREACH_NLRI, IPv6 unicast
+		0x20, 0x20, 0x01, 0x0d, 0xb8, // 2001:db8::/32
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("Wrong withdraw\nwant: % x\ngot:  % x", want, b.Bytes())
+	}
+}
+
+func TestUpdateLinkLocalNextHop(t *testing.T) {
+	tests := []struct {
+		desc           string
+		defaultNextHop string
+		linkLocal      string
+		nextHop        string
+		want           []byte
+	}{
+		{
+			desc:           "global and link-local",
+			defaultNextHop: "2001:db8::1",
+			linkLocal:      "fe80::1",
+			want: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+				0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+			},
+		},
+		{
+			desc:           "link-local only",
+			defaultNextHop: "fe80::1",
+			linkLocal:      "fe80::1",
+			want: []byte{
+				0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+				0xfe, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+			},
+		},
+		{
+			desc:           "advertisement next hop",
+			defaultNextHop: "fe80::1",
+			linkLocal:      "fe80::1",
+			nextHop:        "2001:db8::2",
+			want: []byte{
+				0x20, 0x01, 0x0d, 0xb8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+			},
+		},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		adv := &Advertisement{
+			Prefix: &net.IPNet{IP: net.ParseIP("1.2.3.4").To4(), Mask: net.CIDRMask(32, 32)},
+		}
+		if test.nextHop != "" {
+			adv.NextHop = net.ParseIP(test.nextHop)
+		}
+		if err := sendUpdate(&b, 65000, peeringExternal, true, net.ParseIP(test.defaultNextHop), net.ParseIP(test.linkLocal), adv); err != nil {
+			t.Fatalf("%s: send update: %s", test.desc, err)
+		}
+		// Header, origin and AS_PATH, then MP_REACH_NLRI.
+		bs := b.Bytes()[23+4+9:]
+		if bs[1] != 14 {
+			t.Fatalf("%s: no MP_REACH_NLRI: % x", test.desc, b.Bytes())
+		}
+		if got := bs[4+3]; int(got) != len(test.want) {
+			t.Errorf("%s: wrong next-hop len, want %d, got %d", test.desc, len(test.want), got)
+			continue
+		}
+		if got := bs[4+4 : 4+4+len(test.want)]; !bytes.Equal(got, test.want) {
+			t.Errorf("%s: wrong next hops\nwant: % x\ngot:  % x", test.desc, test.want, got)
+		}
+	}
+}
+
+func TestOpenORF(t *testing.T) {
+	tests := []struct {
+		desc string
+		cap  []byte
+		want bool
+	}{
+		{"no ORF", nil, false},
+		{"receive only", orfCapability(), false},
+		{"send", []byte{3, 7, 0, afiIPv4, 0, safiUnicast, 1, orfTypePrefix, 2}, true},
+		{"send and receive", []byte{3, 7, 0, afiIPv4, 0, safiUnicast, 1, orfTypePrefix, 3}, true},
+		{"IPv6", []byte{3, 7, 0, afiIPv6, 0, safiUnicast, 1, orfTypePrefix, 2}, false},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		caps := [][]byte{routeRefreshCapability()}
+		if test.cap != nil {
+			caps = append(caps, test.cap)
+		}
+		if err := sendOpen(&b, 12345, net.ParseIP("1.2.3.4"), 4*time.Second, caps...); err != nil {
+			t.Fatalf("%s: send open: %s", test.desc, err)
+		}
+		op, err := readOpen(&b)
+		if err != nil {
+			t.Fatalf("%s: read open: %s", test.desc, err)
+		}
+		if !op.mp4 || !op.mp6 || !op.fbasn {
+			t.Errorf("%s: lost default capabilities: %#v", test.desc, op)
+		}
+		if op.orfSend4 != test.want {
+			t.Errorf("%s: wrong ORF send capability, want %v, got %v", test.desc, test.want, op.orfSend4)
+		}
+	}
+}
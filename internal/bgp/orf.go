@@ -0,0 +1,214 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+)
+
+// Outbound route filtering (RFC 5291) with address prefix ORFs (RFC
+// 5292): the peer pushes a prefix list to the session, and the
+// session only advertises the routes the list permits.
+
+const (
+	// ROUTE-REFRESH message type (RFC 2918).
+	msgRouteRefresh = 5
+	// Address prefix ORF type.
+	orfTypePrefix = 64
+
+	orfAdd       = 0
+	orfRemove    = 1
+	orfRemoveAll = 2
+
+	refreshImmediate = 1
+	refreshDefer     = 2
+)
+
+// orfWait is how long a session whose peer can send ORFs waits for
+// them before sending its routes.
+var orfWait = 10 * time.Second
+
+// routeRefreshCapability returns a route refresh capability (RFC
+// 2918).
+func routeRefreshCapability() []byte {
+	return []byte{2, 0}
+}
+
+// orfCapability returns an outbound route filtering capability
+// advertising that we accept address prefix ORFs for IPv4 unicast.
+func orfCapability() []byte {
+	return []byte{3, 7, 0, afiIPv4, 0, safiUnicast, 1, orfTypePrefix, 1}
+}
+
+// orfEntry is an address prefix ORF entry.
+type orfEntry struct {
+	action uint8
+	deny   bool
+	seq    uint32
+	prefix *net.IPNet
+	// Prefix lengths the entry matches. Zero means unset.
+	minLen, maxLen int
+}
+
+func (e orfEntry) same(o orfEntry) bool {
+	return e.seq == o.seq && e.deny == o.deny && e.prefix.String() == o.prefix.String() && e.minLen == o.minLen && e.maxLen == o.maxLen
+}
+
+// matches returns true if pfx is within the entry's prefix, and its
+// length within the entry's bounds. Like in router prefix lists, an
+// entry without bounds matches the prefix exactly, and an entry with
+// one bound matches up to /32, respectively from its own length.
+func (e orfEntry) matches(pfx *net.IPNet) bool {
+	l, _ := pfx.Mask.Size()
+	el, _ := e.prefix.Mask.Size()
+	if l < el || !e.prefix.Contains(pfx.IP) {
+		return false
+	}
+	lo, hi := e.minLen, e.maxLen
+	switch {
+	case lo == 0 && hi == 0:
+		lo, hi = el, el
+	case lo == 0:
+		lo = el
+	case hi == 0:
+		hi = 32
+	}
+	return l >= lo && l <= hi
+}
+
+// orfFilter is the prefix list a peer pushed with ORFs, sorted by
+// sequence number.
+type orfFilter []orfEntry
+
+// permits returns true if the peer wants to receive pfx. The first
+// matching entry decides, and prefixes that match no entry are
+// denied. An empty filter permits everything.
+func (f orfFilter) permits(pfx *net.IPNet) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, e := range f {
+		if e.matches(pfx) {
+			return !e.deny
+		}
+	}
+	return false
+}
+
+// apply returns the filter updated by e.
+func (f orfFilter) apply(e orfEntry) orfFilter {
+	switch e.action {
+	case orfRemoveAll:
+		return nil
+	case orfRemove:
+		var ret orfFilter
+		for _, o := range f {
+			if !o.same(e) {
+				ret = append(ret, o)
+			}
+		}
+		return ret
+	default:
+		ret := append(orfFilter{}, f...)
+		ret = append(ret, e)
+		sort.SliceStable(ret, func(i, j int) bool { return ret[i].seq < ret[j].seq })
+		return ret
+	}
+}
+
+// routeRefresh is a ROUTE-REFRESH message.
+type routeRefresh struct {
+	afi  uint16
+	safi uint8
+	// Whether the peer wants its routes sent again now. False if it
+	// only updated its ORFs, and will ask for the routes later.
+	immediate bool
+	// The address prefix ORF entries of the message, in order.
+	orf []orfEntry
+}
+
+// readRouteRefresh reads the body of a ROUTE-REFRESH message (header
+// has already been consumed). It returns nil for the messages of
+// enhanced route refresh (RFC 7313), which we don't negotiate.
+func readRouteRefresh(r io.Reader) (*routeRefresh, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, fmt.Errorf("ROUTE-REFRESH too short (%d bytes)", len(b))
+	}
+	if b[2] != 0 {
+		return nil, nil
+	}
+	ret := &routeRefresh{
+		afi:       binary.BigEndian.Uint16(b),
+		safi:      b[3],
+		immediate: true,
+	}
+	b = b[4:]
+	if len(b) == 0 {
+		return ret, nil
+	}
+	switch b[0] {
+	case refreshImmediate:
+	case refreshDefer:
+		ret.immediate = false
+	default:
+		return nil, fmt.Errorf("unknown ORF when-to-refresh %d", b[0])
+	}
+	b = b[1:]
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("truncated ORF % x", b)
+		}
+		typ, l := b[0], int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, fmt.Errorf("truncated ORF % x", b)
+		}
+		entries := b[3 : 3+l]
+		b = b[3+l:]
+		if typ != orfTypePrefix || ret.afi != afiIPv4 || ret.safi != safiUnicast {
+			continue
+		}
+		for len(entries) > 0 {
+			e, n, err := parseORFEntry(entries)
+			if err != nil {
+				return nil, err
+			}
+			ret.orf = append(ret.orf, e)
+			entries = entries[n:]
+		}
+	}
+	return ret, nil
+}
+
+// parseORFEntry parses the IPv4 address prefix ORF entry at the start
+// of b, and returns it and its length.
+func parseORFEntry(b []byte) (orfEntry, int, error) {
+	e := orfEntry{
+		action: b[0] >> 6,
+		deny:   b[0]&0x20 != 0,
+	}
+	if e.action == orfRemoveAll {
+		return e, 1, nil
+	}
+	if len(b) < 8 {
+		return e, 0, fmt.Errorf("truncated address prefix ORF % x", b)
+	}
+	e.seq = binary.BigEndian.Uint32(b[1:5])
+	e.minLen, e.maxLen = int(b[5]), int(b[6])
+	bits := int(b[7])
+	n := bytesForBits(bits)
+	if bits > 32 || len(b) < 8+n || e.minLen > 32 || e.maxLen > 32 {
+		return e, 0, fmt.Errorf("malformed address prefix ORF % x", b)
+	}
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, b[8:8+n])
+	e.prefix = &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, 32)), Mask: net.CIDRMask(bits, 32)}
+	return e, 8 + n, nil
+}
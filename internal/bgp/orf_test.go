@@ -0,0 +1,252 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestORFFilter(t *testing.T) {
+	f := orfFilter{}.
+		apply(orfEntry{seq: 20, prefix: cidr("192.0.2.0/24"), maxLen: 32}).
+		apply(orfEntry{seq: 10, deny: true, prefix: cidr("192.0.2.128/25"), minLen: 32}).
+		apply(orfEntry{seq: 30, prefix: cidr("198.51.100.0/24")})
+
+	tests := []struct {
+		pfx  string
+		want bool
+	}{
+		{"192.0.2.10/32", true},
+		{"192.0.2.0/28", true},
+		{"192.0.2.200/32", false},
+		{"192.0.2.128/26", true},
+		{"198.51.100.0/24", true},
+		{"198.51.100.10/32", false},
+		{"203.0.113.10/32", false},
+		{"192.0.0.0/16", false},
+	}
+	for _, test := range tests {
+		if got := f.permits(cidr(test.pfx)); got != test.want {
+			t.Errorf("permits(%s) = %v, want %v", test.pfx, got, test.want)
+		}
+	}
+
+	f = f.apply(orfEntry{action: orfRemove, seq: 10, deny: true, prefix: cidr("192.0.2.128/25"), minLen: 32})
+	if !f.permits(cidr("192.0.2.200/32")) {
+		t.Error("removed entry still denies 192.0.2.200/32")
+	}
+	f = f.apply(orfEntry{action: orfRemoveAll})
+	if !f.permits(cidr("203.0.113.10/32")) {
+		t.Error("empty filter denies 203.0.113.10/32")
+	}
+}
+
+// routeRefreshBody returns the body of a ROUTE-REFRESH for IPv4
+// unicast with address prefix ORF entries.
+func routeRefreshBody(when uint8, entries ...[]byte) []byte {
+	b := []byte{0, afiIPv4, 0, safiUnicast}
+	if len(entries) == 0 {
+		return b
+	}
+	var orf []byte
+	for _, e := range entries {
+		orf = append(orf, e...)
+	}
+	b = append(b, when, orfTypePrefix, 0, 0)
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(orf)))
+	return append(b, orf...)
+}
+
+// orfEntryBytes encodes an address prefix ORF entry.
+func orfEntryBytes(action uint8, deny bool, seq uint32, pfx string, minLen, maxLen uint8) []byte {
+	b := []byte{action << 6}
+	if deny {
+		b[0] |= 0x20
+	}
+	if action == orfRemoveAll {
+		return b
+	}
+	n := cidr(pfx)
+	bits, _ := n.Mask.Size()
+	b = append(b, 0, 0, 0, 0, minLen, maxLen, byte(bits))
+	binary.BigEndian.PutUint32(b[1:5], seq)
+	return append(b, n.IP.To4()[:bytesForBits(bits)]...)
+}
+
+func TestReadRouteRefresh(t *testing.T) {
+	rr, err := readRouteRefresh(bytes.NewReader(routeRefreshBody(0)))
+	if err != nil {
+		t.Fatalf("reading plain ROUTE-REFRESH: %s", err)
+	}
+	if !rr.immediate || len(rr.orf) != 0 {
+		t.Errorf("wrong plain ROUTE-REFRESH %#v", rr)
+	}
+
+	rr, err = readRouteRefresh(bytes.NewReader(routeRefreshBody(refreshDefer,
+		orfEntryBytes(orfAdd, false, 5, "192.0.2.0/24", 0, 32),
+		orfEntryBytes(orfRemoveAll, false, 0, "", 0, 0),
+		orfEntryBytes(orfAdd, true, 10, "10.0.0.0/8", 24, 0),
+	)))
+	if err != nil {
+		t.Fatalf("reading ROUTE-REFRESH with ORFs: %s", err)
+	}
+	if rr.immediate {
+		t.Error("deferred ROUTE-REFRESH asks for immediate refresh")
+	}
+	if len(rr.orf) != 3 {
+		t.Fatalf("got %d ORF entries, want 3", len(rr.orf))
+	}
+	if e := rr.orf[0]; e.action != orfAdd || e.deny || e.seq != 5 || e.prefix.String() != "192.0.2.0/24" || e.minLen != 0 || e.maxLen != 32 {
+		t.Errorf("wrong first ORF entry %#v", e)
+	}
+	if rr.orf[1].action != orfRemoveAll {
+		t.Errorf("wrong second ORF entry %#v", rr.orf[1])
+	}
+	if e := rr.orf[2]; !e.deny || e.prefix.String() != "10.0.0.0/8" || e.minLen != 24 {
+		t.Errorf("wrong third ORF entry %#v", e)
+	}
+
+	if _, err := readRouteRefresh(bytes.NewReader(routeRefreshBody(refreshImmediate, []byte{0, 0, 0, 0, 1, 0, 32, 24, 192}))); err == nil {
+		t.Error("truncated ORF entry accepted")
+	}
+}
+
+func writeTestMessage(t *testing.T, w io.Writer, typ uint8, body []byte) {
+	msg := make([]byte, 19, 19+len(body))
+	for i := 0; i < 16; i++ {
+		msg[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(msg[16:18], uint16(19+len(body)))
+	msg[18] = typ
+	if _, err := w.Write(append(msg, body...)); err != nil {
+		t.Fatalf("writing message: %s", err)
+	}
+}
+
+// readTestUpdates reads n UPDATE messages, skipping keepalives, and
+// returns them sorted.
+func readTestUpdates(t *testing.T, r io.Reader, n int) []string {
+	var ret []string
+	for len(ret) < n {
+		var hdr [19]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			t.Fatalf("reading message: %s", err)
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(hdr[16:18]))
+		copy(msg, hdr[:])
+		if _, err := io.ReadFull(r, msg[19:]); err != nil {
+			t.Fatalf("reading message: %s", err)
+		}
+		if hdr[18] == 2 {
+			ret = append(ret, string(msg))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestSessionORF(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("listening for the session: %s", err)
+	}
+	defer ln.Close()
+
+	s, err := New(log.NewNopLogger(), SessionParameters{
+		Addr:     ln.Addr().String(),
+		ASN:      64500,
+		RouterID: net.ParseIP("10.0.0.1"),
+		PeerASN:  64501,
+		HoldTime: 90 * time.Second,
+		MyNode:   "test",
+	})
+	if err != nil {
+		t.Fatalf("creating session: %s", err)
+	}
+	defer s.Close()
+	in, out := &Advertisement{Prefix: cidr("192.0.2.10/32")}, &Advertisement{Prefix: cidr("198.51.100.10/32")}
+	if err := s.Set(in, out); err != nil {
+		t.Fatalf("setting advertisements: %s", err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("session didn't connect: %s", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatalf("setting session deadline: %s", err)
+	}
+	op, err := readOpen(conn)
+	if err != nil {
+		t.Fatalf("reading OPEN: %s", err)
+	}
+	if op.orfSend4 {
+		t.Error("session offers to send ORFs")
+	}
+	if err := sendOpen(conn, 64501, net.ParseIP("10.0.0.2"), 90*time.Second, []byte{3, 7, 0, afiIPv4, 0, safiUnicast, 1, orfTypePrefix, 2}); err != nil {
+		t.Fatalf("sending OPEN: %s", err)
+	}
+	if err := sendKeepalive(conn); err != nil {
+		t.Fatalf("sending KEEPALIVE: %s", err)
+	}
+
+	update := func(adv *Advertisement) string {
+		var b bytes.Buffer
+		if err := sendUpdate(&b, 64500, peeringExternal, true, net.ParseIP("127.0.0.1").To4(), nil, adv); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+	withdraw := func(adv *Advertisement) string {
+		var b bytes.Buffer
+		if err := sendWithdraw(&b, []*net.IPNet{adv.Prefix}); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	// The session waits for the ORFs, and only sends what they permit.
+	writeTestMessage(t, conn, msgRouteRefresh, routeRefreshBody(refreshImmediate, orfEntryBytes(orfAdd, false, 10, "192.0.2.0/24", 0, 32)))
+	got := readTestUpdates(t, conn, 2)
+	want := []string{update(in), withdraw(out)}
+	sort.Strings(want)
+	if !equalStrings(got, want) {
+		t.Errorf("wrong updates after ORF\ngot:  %x\nwant: %x", got, want)
+	}
+
+	// Removing the ORFs sends everything.
+	writeTestMessage(t, conn, msgRouteRefresh, routeRefreshBody(refreshImmediate, orfEntryBytes(orfRemoveAll, false, 0, "", 0, 0)))
+	got = readTestUpdates(t, conn, 2)
+	want = []string{update(in), update(out)}
+	sort.Strings(want)
+	if !equalStrings(got, want) {
+		t.Errorf("wrong updates after removing ORF\ngot:  %x\nwant: %x", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -38,13 +38,63 @@ var stats = metrics{
 	}, []string{
 		"peer",
 	}),
+
+	peerCapabilities: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp",
+		Name:      "peer_capability",
+		Help:      "Capabilities the BGP peer advertised in its last OPEN message (1 is advertised, 0 is not)",
+	}, []string{
+		"peer",
+		"capability",
+	}),
+
+	messagesSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp",
+		Name:      "messages_sent_total",
+		Help:      "Number of BGP messages sent, by message type",
+	}, []string{
+		"peer",
+		"type",
+	}),
+
+	messagesReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "bgp",
+		Name:      "messages_received_total",
+		Help:      "Number of BGP messages received, by message type",
+	}, []string{
+		"peer",
+		"type",
+	}),
 }
 
 type metrics struct {
-	sessionUp       *prometheus.GaugeVec
-	updatesSent     *prometheus.CounterVec
-	prefixes        *prometheus.GaugeVec
-	pendingPrefixes *prometheus.GaugeVec
+	sessionUp        *prometheus.GaugeVec
+	updatesSent      *prometheus.CounterVec
+	prefixes         *prometheus.GaugeVec
+	pendingPrefixes  *prometheus.GaugeVec
+	peerCapabilities *prometheus.GaugeVec
+	messagesSent     *prometheus.CounterVec
+	messagesReceived *prometheus.CounterVec
+}
+
+// messageTypeNames are the type labels of the message counters, by
+// message type.
+var messageTypeNames = map[uint8]string{
+	1:               "open",
+	2:               "update",
+	3:               "notification",
+	4:               "keepalive",
+	msgRouteRefresh: "route-refresh",
+}
+
+func messageTypeName(typ uint8) string {
+	if name, ok := messageTypeNames[typ]; ok {
+		return name
+	}
+	return "unknown"
 }
 
 func init() {
@@ -52,6 +102,9 @@ func init() {
 	prometheus.MustRegister(stats.updatesSent)
 	prometheus.MustRegister(stats.prefixes)
 	prometheus.MustRegister(stats.pendingPrefixes)
+	prometheus.MustRegister(stats.peerCapabilities)
+	prometheus.MustRegister(stats.messagesSent)
+	prometheus.MustRegister(stats.messagesReceived)
 }
 
 func (m *metrics) NewSession(addr string) {
@@ -59,6 +112,10 @@ func (m *metrics) NewSession(addr string) {
 	m.prefixes.WithLabelValues(addr).Set(0)
 	m.pendingPrefixes.WithLabelValues(addr).Set(0)
 	m.updatesSent.WithLabelValues(addr).Add(0) // just creates the metric
+	for _, name := range messageTypeNames {
+		m.messagesSent.WithLabelValues(addr, name).Add(0)
+		m.messagesReceived.WithLabelValues(addr, name).Add(0)
+	}
 }
 
 func (m *metrics) DeleteSession(addr string) {
@@ -66,6 +123,15 @@ func (m *metrics) DeleteSession(addr string) {
 	m.prefixes.DeleteLabelValues(addr)
 	m.pendingPrefixes.DeleteLabelValues(addr)
 	m.updatesSent.DeleteLabelValues(addr)
+	for _, name := range capabilityNames {
+		m.peerCapabilities.DeleteLabelValues(addr, name)
+	}
+	for _, name := range messageTypeNames {
+		m.messagesSent.DeleteLabelValues(addr, name)
+		m.messagesReceived.DeleteLabelValues(addr, name)
+	}
+	m.messagesSent.DeleteLabelValues(addr, "unknown")
+	m.messagesReceived.DeleteLabelValues(addr, "unknown")
 }
 
 func (m *metrics) SessionUp(addr string) {
@@ -80,6 +146,27 @@ func (m *metrics) SessionDown(addr string) {
 
 func (m *metrics) UpdateSent(addr string) {
 	m.updatesSent.WithLabelValues(addr).Inc()
+	m.MessageSent(addr, 2)
+}
+
+func (m *metrics) MessageSent(addr string, typ uint8) {
+	m.messagesSent.WithLabelValues(addr, messageTypeName(typ)).Inc()
+}
+
+func (m *metrics) MessageReceived(addr string, typ uint8) {
+	m.messagesReceived.WithLabelValues(addr, messageTypeName(typ)).Inc()
+}
+
+// PeerCapabilities records the capabilities the peer advertised in
+// its OPEN.
+func (m *metrics) PeerCapabilities(addr string, caps map[string]bool) {
+	for _, name := range capabilityNames {
+		v := 0.0
+		if caps[name] {
+			v = 1
+		}
+		m.peerCapabilities.WithLabelValues(addr, name).Set(v)
+	}
 }
 
 func (m *metrics) PendingPrefixes(addr string, n int) {
@@ -0,0 +1,186 @@
+// Package capture records bounded packet captures of the ARP, NDP and
+// BGP traffic of an address, in the pcap format, to debug the
+// announcements of a node, e.g. gratuitous ARPs that the switch never
+// sees.
+package capture // import "go.universe.tf/metallb/internal/capture"
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mdlayher/raw"
+)
+
+const (
+	// Frames are truncated to snapLen bytes in the capture, enough
+	// for the headers and a BGP message.
+	snapLen = 1600
+
+	etherTypeAll  = 0x0003 // ETH_P_ALL, all the frames, sent or received.
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	protoTCP    = 6
+	protoICMPv6 = 58
+	bgpPort     = 179
+)
+
+// Conn captures the frames of an interface.
+type Conn struct {
+	intf string
+	conn *raw.Conn
+}
+
+// Listen starts capturing the frames sent and received on ifi.
+func Listen(ifi *net.Interface) (*Conn, error) {
+	conn, err := raw.ListenPacket(ifi, etherTypeAll, nil)
+	if err != nil {
+		return nil, fmt.Errorf("opening packet socket on %q: %s", ifi.Name, err)
+	}
+	return &Conn{ifi.Name, conn}, nil
+}
+
+// Close stops capturing.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Capture writes to w, in the pcap format, the frames that are ARP or
+// NDP packets about ip, or BGP packets from or to ip, until it
+// captured maxPackets frames or ctx is done. It returns the number of
+// captured frames.
+func (c *Conn) Capture(ctx context.Context, ip net.IP, maxPackets int, w io.Writer) (int, error) {
+	pw, err := newWriter(w)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 65536)
+	n := 0
+	for n < maxPackets {
+		select {
+		case <-ctx.Done():
+			return n, nil
+		default:
+		}
+		// Wake up regularly to notice that ctx is done.
+		if err := c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+			return n, err
+		}
+		size, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return n, fmt.Errorf("reading from %q: %s", c.intf, err)
+		}
+		if !matches(buf[:size], ip) {
+			continue
+		}
+		if err := pw.writePacket(time.Now(), buf[:size]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// matches returns whether the Ethernet frame is an ARP or NDP packet
+// about ip, or a BGP packet from or to ip.
+func matches(frame []byte, ip net.IP) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	payload := frame[14:]
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		// Ethernet/IPv4 ARP: the sender and target protocol
+		// addresses are at 14 and 24.
+		if len(payload) < 28 || ip.To4() == nil {
+			return false
+		}
+		return net.IP(payload[14:18]).Equal(ip) || net.IP(payload[24:28]).Equal(ip)
+
+	case etherTypeIPv4:
+		if len(payload) < 20 || payload[0]>>4 != 4 {
+			return false
+		}
+		hdrLen := int(payload[0]&0x0f) * 4
+		if payload[9] != protoTCP || len(payload) < hdrLen+4 {
+			return false
+		}
+		src, dst := net.IP(payload[12:16]), net.IP(payload[16:20])
+		return (src.Equal(ip) || dst.Equal(ip)) && isBGP(payload[hdrLen:])
+
+	case etherTypeIPv6:
+		if len(payload) < 40 || payload[0]>>4 != 6 {
+			return false
+		}
+		src, dst, next := net.IP(payload[8:24]), net.IP(payload[24:40]), payload[40:]
+		switch payload[6] {
+		case protoTCP:
+			return (src.Equal(ip) || dst.Equal(ip)) && len(next) >= 4 && isBGP(next)
+		case protoICMPv6:
+			// Router and neighbor solicitations and advertisements,
+			// and redirects. Neighbor solicitations go to the
+			// solicited-node multicast address, so also look at the
+			// target address.
+			if len(next) < 1 || next[0] < 133 || next[0] > 137 {
+				return false
+			}
+			if src.Equal(ip) || dst.Equal(ip) {
+				return true
+			}
+			return (next[0] == 135 || next[0] == 136) && len(next) >= 24 && net.IP(next[8:24]).Equal(ip)
+		}
+	}
+	return false
+}
+
+// isBGP returns whether the TCP segment is from or to the BGP port.
+func isBGP(tcp []byte) bool {
+	return binary.BigEndian.Uint16(tcp[0:2]) == bgpPort || binary.BigEndian.Uint16(tcp[2:4]) == bgpPort
+}
+
+// writer writes packets in the pcap format.
+type writer struct {
+	w io.Writer
+}
+
+// newWriter writes the pcap file header for Ethernet frames to w.
+func newWriter(w io.Writer) (*writer, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	// Time zone and timestamp accuracy, always 0.
+	binary.LittleEndian.PutUint32(hdr[16:20], snapLen)
+	// LINKTYPE_ETHERNET.
+	binary.LittleEndian.PutUint32(hdr[20:24], 1)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &writer{w}, nil
+}
+
+// writePacket writes frame, seen at ts, truncated to the snap length.
+func (pw *writer) writePacket(ts time.Time, frame []byte) error {
+	data := frame
+	if len(data) > snapLen {
+		data = data[:snapLen]
+	}
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(len(frame)))
+	if _, err := pw.w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(data)
+	return err
+}
@@ -0,0 +1,110 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// frame returns an Ethernet frame of etherType carrying payload.
+func frame(etherType uint16, payload []byte) []byte {
+	ret := make([]byte, 14, 14+len(payload))
+	binary.BigEndian.PutUint16(ret[12:14], etherType)
+	return append(ret, payload...)
+}
+
+func arpPacket(sender, target string) []byte {
+	ret := make([]byte, 28)
+	copy(ret[14:18], net.ParseIP(sender).To4())
+	copy(ret[24:28], net.ParseIP(target).To4())
+	return frame(etherTypeARP, ret)
+}
+
+func ipv4Packet(src, dst string, proto byte, srcPort, dstPort uint16) []byte {
+	ret := make([]byte, 24)
+	ret[0] = 0x45
+	ret[9] = proto
+	copy(ret[12:16], net.ParseIP(src).To4())
+	copy(ret[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(ret[20:22], srcPort)
+	binary.BigEndian.PutUint16(ret[22:24], dstPort)
+	return frame(etherTypeIPv4, ret)
+}
+
+func ndpPacket(src, dst, target string, typ byte) []byte {
+	ret := make([]byte, 64)
+	ret[0] = 0x60
+	ret[6] = protoICMPv6
+	copy(ret[8:24], net.ParseIP(src))
+	copy(ret[24:40], net.ParseIP(dst))
+	ret[40] = typ
+	copy(ret[48:64], net.ParseIP(target))
+	return frame(etherTypeIPv6, ret)
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		desc  string
+		frame []byte
+		ip    string
+		want  bool
+	}{
+		{"gratuitous ARP", arpPacket("192.168.1.240", "192.168.1.240"), "192.168.1.240", true},
+		{"ARP request", arpPacket("192.168.1.1", "192.168.1.240"), "192.168.1.240", true},
+		{"other ARP", arpPacket("192.168.1.1", "192.168.1.2"), "192.168.1.240", false},
+		{"BGP to peer", ipv4Packet("10.0.0.2", "10.0.0.1", protoTCP, 40000, 179), "10.0.0.1", true},
+		{"BGP from peer", ipv4Packet("10.0.0.1", "10.0.0.2", protoTCP, 179, 40000), "10.0.0.1", true},
+		{"other TCP", ipv4Packet("10.0.0.1", "10.0.0.2", protoTCP, 443, 40000), "10.0.0.1", false},
+		{"BGP of other peer", ipv4Packet("10.0.0.3", "10.0.0.2", protoTCP, 179, 40000), "10.0.0.1", false},
+		{"neighbor solicitation", ndpPacket("fe80::1", "ff02::1:ff00:240", "2001:db8::240", 135), "2001:db8::240", true},
+		{"unsolicited neighbor advertisement", ndpPacket("fe80::2", "ff02::1", "2001:db8::240", 136), "2001:db8::240", true},
+		{"other neighbor solicitation", ndpPacket("fe80::1", "ff02::1:ff00:241", "2001:db8::241", 135), "2001:db8::240", false},
+		{"echo request", ndpPacket("2001:db8::1", "2001:db8::240", "::", 128), "2001:db8::240", false},
+		{"truncated", []byte{1, 2, 3}, "10.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := matches(test.frame, net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s: got match %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := arpPacket("192.168.1.240", "192.168.1.240")
+	if err := w.writePacket(time.Unix(1000, 5000), pkt); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, snapLen+100)
+	if err := w.writePacket(time.Unix(1001, 0), big); err != nil {
+		t.Fatal(err)
+	}
+
+	bs := buf.Bytes()
+	if got := binary.LittleEndian.Uint32(bs[0:4]); got != 0xa1b2c3d4 {
+		t.Fatalf("wrong magic %x", got)
+	}
+	if got := binary.LittleEndian.Uint32(bs[20:24]); got != 1 {
+		t.Fatalf("wrong link type %d", got)
+	}
+	rec := bs[24:]
+	if sec, usec := binary.LittleEndian.Uint32(rec[0:4]), binary.LittleEndian.Uint32(rec[4:8]); sec != 1000 || usec != 5 {
+		t.Fatalf("wrong timestamp %d.%06d", sec, usec)
+	}
+	if !bytes.Equal(rec[16:16+len(pkt)], pkt) {
+		t.Fatal("wrong packet data")
+	}
+	rec = rec[16+len(pkt):]
+	if incl, orig := binary.LittleEndian.Uint32(rec[8:12]), binary.LittleEndian.Uint32(rec[12:16]); incl != snapLen || orig != snapLen+100 {
+		t.Fatalf("got lengths %d/%d for a truncated packet, want %d/%d", incl, orig, snapLen, snapLen+100)
+	}
+	if len(rec) != 16+snapLen {
+		t.Fatalf("got %d bytes for a truncated packet, want %d", len(rec), 16+snapLen)
+	}
+}
@@ -32,21 +32,58 @@ import (
 // configFile is the configuration as parsed out of the ConfigMap,
 // without validation or useful high level types.
 type configFile struct {
+	BGPInstances   []bgpInstance `yaml:"bgp-instances"`
 	Peers          []peer
-	BGPCommunities map[string]string `yaml:"bgp-communities"`
-	Pools          []addressPool     `yaml:"address-pools"`
+	BGPCommunities map[string]string     `yaml:"bgp-communities"`
+	Pools          []addressPool         `yaml:"address-pools"`
+	StaticAds      []staticAdvertisement `yaml:"static-advertisements"`
+	StaticVIPs     []staticVIP           `yaml:"static-vips"`
+}
+
+type evpn struct {
+	VNI          uint32   `yaml:"vni"`
+	RD           string   `yaml:"route-distinguisher"`
+	RouteTargets []string `yaml:"route-targets"`
+	RouterMAC    string   `yaml:"router-mac"`
 }
 
 type peer struct {
-	MyASN         uint32         `yaml:"my-asn"`
-	ASN           uint32         `yaml:"peer-asn"`
-	Addr          string         `yaml:"peer-address"`
-	SrcAddr       string         `yaml:"source-address"`
-	Port          uint16         `yaml:"peer-port"`
-	HoldTime      string         `yaml:"hold-time"`
-	RouterID      string         `yaml:"router-id"`
-	NodeSelectors []nodeSelector `yaml:"node-selectors"`
-	Password      string         `yaml:"password"`
+	MyASN          uint32         `yaml:"my-asn"`
+	ASN            uint32         `yaml:"peer-asn"`
+	Addr           string         `yaml:"peer-address"`
+	AddrAnnotation string         `yaml:"peer-address-annotation"`
+	AddrGateway    string         `yaml:"peer-address-gateway-interface"`
+	AddrRange      string         `yaml:"peer-address-range"`
+	SrcAddr        string         `yaml:"source-address"`
+	SrcIface       string         `yaml:"source-interface"`
+	SrcAnnotation  string         `yaml:"source-address-annotation"`
+	Port           uint16         `yaml:"peer-port"`
+	HoldTime       string         `yaml:"hold-time"`
+	KeepaliveTime  string         `yaml:"keepalive-time"`
+	ConnectRetry   string         `yaml:"connect-retry-time"`
+	InitialBackoff string         `yaml:"initial-backoff"`
+	RouterID       string         `yaml:"router-id"`
+	RouterIDIface  string         `yaml:"router-id-interface"`
+	NextHop        string         `yaml:"next-hop"`
+	FlowSpec       bool           `yaml:"flowspec"`
+	EVPN           *evpn          `yaml:"evpn"`
+	NodeSelectors  []nodeSelector `yaml:"node-selectors"`
+	Password       string         `yaml:"password"`
+	Instance       string         `yaml:"bgp-instance"`
+	RouteReflector bool           `yaml:"route-reflector"`
+	ConfedID       uint32         `yaml:"confederation-id"`
+	ConfedMembers  []uint32       `yaml:"confederation-members"`
+}
+
+// bgpInstance is a logically separate BGP router on the nodes, with
+// its own local ASN and router ID, e.g. for each of two independent
+// routing domains the nodes are attached to.
+type bgpInstance struct {
+	Name          string
+	MyASN         uint32 `yaml:"my-asn"`
+	RouterID      string `yaml:"router-id"`
+	RouterIDIface string `yaml:"router-id-interface"`
+	VRF           string `yaml:"vrf"`
 }
 
 type nodeSelector struct {
@@ -64,15 +101,54 @@ type addressPool struct {
 	Protocol          Proto
 	Name              string
 	Addresses         []string
+	ExcludeRanges     []string           `yaml:"exclude-ranges"`
 	AvoidBuggyIPs     bool               `yaml:"avoid-buggy-ips"`
 	AutoAssign        *bool              `yaml:"auto-assign"`
+	IPMode            string             `yaml:"ip-mode"`
+	Weight            int                `yaml:"weight"`
 	BGPAdvertisements []bgpAdvertisement `yaml:"bgp-advertisements"`
+	// Let the services override the BGP advertisements with
+	// annotations.
+	AllowServiceOverrides bool `yaml:"allow-service-overrides"`
+	// Give each node an address of the pool, instead of services.
+	NodeLoopbacks bool `yaml:"node-loopbacks"`
+	// Announce with layer2 on these interfaces only, in addition to
+	// BGP for BGP pools.
+	Layer2Interfaces []string `yaml:"layer2-interfaces"`
+	// Only give addresses to services exposing these ports, as
+	// <protocol>/<port> or <protocol>/<first port>-<last port>.
+	AllowedPorts []string `yaml:"allowed-ports"`
+	// Free-form information about the pool, for the consumers of
+	// allocation events and exports.
+	Description    string `yaml:"description"`
+	ReverseDNSZone string `yaml:"reverse-dns-zone"`
+	Owner          string `yaml:"owner"`
 }
 
 type bgpAdvertisement struct {
-	AggregationLength *int `yaml:"aggregation-length"`
-	LocalPref         *uint32
-	Communities       []string
+	AggregationLength   *int `yaml:"aggregation-length"`
+	AggregationLengthV6 *int `yaml:"aggregation-length-v6"`
+	LocalPref           *uint32
+	Communities         []string
+	NextHop             string   `yaml:"next-hop"`
+	Peers               []string `yaml:"peers"`
+	Instances           []string `yaml:"bgp-instances"`
+	MaxAnnouncingNodes  int      `yaml:"max-announcing-nodes"`
+	LinkBandwidth       float32  `yaml:"link-bandwidth"`
+}
+
+type staticAdvertisement struct {
+	Prefix        string
+	LocalPref     *uint32
+	Communities   []string
+	NextHop       string         `yaml:"next-hop"`
+	Peers         []string       `yaml:"peers"`
+	NodeSelectors []nodeSelector `yaml:"node-selectors"`
+}
+
+type staticVIP struct {
+	Address string   `yaml:"address"`
+	Nodes   []string `yaml:"nodes"`
 }
 
 // Config is a parsed MetalLB configuration.
@@ -81,6 +157,12 @@ type Config struct {
 	Peers []*Peer
 	// Address pools from which to allocate load balancer IPs.
 	Pools map[string]*Pool
+	// Prefixes to advertise to BGP peers, independently of services.
+	StaticAdvertisements []*StaticAdvertisement
+	// Addresses to answer ARP and NDP for, independently of services.
+	StaticVIPs []*StaticVIP
+	// Aliases of BGP communities, by name.
+	BGPCommunities map[string]uint32
 }
 
 // Proto holds the protocol we are speaking.
@@ -98,31 +180,101 @@ type Peer struct {
 	MyASN uint32
 	// AS number to expect from the remote end of the session.
 	ASN uint32
-	// Address to dial when establishing the session.
+	// Address to dial when establishing the session. Nil for peers
+	// whose address depends on the node.
 	Addr net.IP
+	// If Addr is an IPv6 link-local address, the network interface
+	// it is reachable through, e.g. "eno1" for fe80::1%eno1. Empty
+	// if SrcInterface gives it.
+	AddrZone string
+	// If set, the annotation of the node that holds the address of
+	// the peer for that node, overriding Addr.
+	AddrAnnotation string
+	// If set, the peer is the gateway of the node's default route
+	// through this network interface, e.g. the top of rack switch.
+	AddrGatewayInterface string
+	// If set, the speaker doesn't dial the peer, but accepts sessions
+	// from any router in this range (BGP dynamic neighbors).
+	AddrRange *net.IPNet
 	// Source address to use when establishing the session.
 	SrcAddr net.IP
+	// If set, the session leaves through this network interface, and
+	// uses its address as the source address unless SrcAddr is set.
+	SrcInterface string
+	// If set, the annotation of the node that holds the source
+	// address to use on that node, overriding SrcAddr.
+	SrcAddrAnnotation string
 	// Port to dial when establishing the session.
 	Port uint16
 	// Requested BGP hold time, per RFC4271.
 	HoldTime time.Duration
+	// Interval between BGP keepalives. Zero means a third of the
+	// negotiated hold time.
+	KeepaliveTime time.Duration
+	// Delay before the first reconnection attempt after a session
+	// failure. Zero means the speaker's default.
+	InitialBackoff time.Duration
+	// Maximum delay between connection attempts, which back off
+	// exponentially from InitialBackoff. Zero means the speaker's
+	// default.
+	ConnectRetryTime time.Duration
 	// BGP router ID to advertise to the peer
 	RouterID net.IP
+	// If set, and RouterID is not, use the IPv4 address of this
+	// network interface as the router ID.
+	RouterIDInterface string
+	// Next-hop to advertise to the peer, instead of the local
+	// address of the session. May be nil.
+	NextHop net.IP
+	// Negotiate FlowSpec with the peer, and send it the FlowSpec rules
+	// requested by services.
+	FlowSpec bool
+	// If set, send the routes to the peer as EVPN IP prefix routes
+	// instead of IPv4 unicast routes.
+	EVPN *EVPN
 	// Only connect to this peer on nodes that match one of these
 	// selectors.
 	NodeSelectors []labels.Selector
 	// Authentication password for routers enforcing TCP MD5 authenticated sessions
 	Password string
+	// Name of the BGP instance the session belongs to, empty for
+	// peers outside of any instance.
+	Instance string
+	// If set, the Linux VRF device the session is bound to, so that
+	// it uses the VRF's routing table.
+	VRF string
+	// If set, the peer is an iBGP route reflector, and the node one of
+	// its clients.
+	RouteReflector bool
+	// If not zero, MyASN is a member AS of this confederation, whose
+	// other member ASes are ConfederationMembers. Peers outside of
+	// the confederation see it as a single AS.
+	ConfederationID      uint32
+	ConfederationMembers []uint32
 	// TODO: more BGP session settings
 }
 
+// EVPN is the configuration of the EVPN routes sent to a peer.
+type EVPN struct {
+	// VXLAN network identifier of the IP VRF the routes go in.
+	VNI uint32
+	// Route distinguisher, in its 8-byte encoding (RFC 4364). Zero
+	// means <router ID>:<VNI>.
+	RouteDistinguisher uint64
+	// Route targets, as 8-byte extended communities.
+	RouteTargets []uint64
+	// MAC address for the router's MAC extended community. May be
+	// nil.
+	RouterMAC net.HardwareAddr
+}
+
 // Pool is the configuration of an IP address pool.
 type Pool struct {
 	// Protocol for this pool.
 	Protocol Proto
 	// The addresses that are part of this pool, expressed as CIDR
-	// prefixes. config.Parse guarantees that these are
-	// non-overlapping, both within and between pools.
+	// prefixes, without the excluded ranges. config.Parse guarantees
+	// that these are non-overlapping, both within and between pools.
 	CIDR []*net.IPNet
 	// Some buggy consumer devices mistakenly drop IPv4 traffic for IP
 	// addresses ending in .0 or .255, due to poor implementations of
@@ -133,9 +285,59 @@ type Pool struct {
 	// If false, prevents IP addresses to be automatically assigned
 	// from this pool.
 	AutoAssign bool
+	// The ipMode to publish in the status of the services that get
+	// an IP from this pool, "VIP" or "Proxy". Empty leaves it to
+	// Kubernetes, which treats it as "VIP".
+	IPMode string
+	// Relative share of automatic allocations that this pool gets
+	// among the pools with a weight. Pools without a weight are only
+	// used once all weighted pools are exhausted.
+	Weight int
 	// When an IP is allocated from this pool, how should it be
 	// translated into BGP announcements?
 	BGPAdvertisements []*BGPAdvertisement
+	// If true, the services of this pool can override the
+	// aggregation length and communities of their BGP advertisements
+	// with annotations.
+	AllowServiceOverrides bool
+	// If true, the pool's addresses go to the nodes instead of
+	// services, one each, and every node advertises its own as a host
+	// route.
+	NodeLoopbacks bool
+	// If not empty, the pool's addresses are announced with layer2
+	// on these network interfaces only. BGP pools then announce them
+	// both with BGP and with layer2.
+	Layer2Interfaces []string
+	// If not empty, only services whose ports are all in these ranges
+	// can get an address from the pool.
+	AllowedPorts []PortRange
+	// What the pool is for, the reverse DNS zone of its addresses,
+	// and who owns it, as given by the operator. MetalLB only passes
+	// them on in allocation events and exports.
+	Description    string
+	ReverseDNSZone string
+	Owner          string
+}
+
+// PortRange is a range of ports of a protocol.
+type PortRange struct {
+	// "TCP", "UDP" or "SCTP", as in the ports of services.
+	Proto string
+	// The first and last ports of the range.
+	First, Last int
+}
+
+// Contains returns whether port of proto is in the range.
+func (r PortRange) Contains(proto string, port int) bool {
+	return proto == r.Proto && port >= r.First && port <= r.Last
+}
+
+// String returns the range as in the configuration.
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("%s/%d", r.Proto, r.First)
+	}
+	return fmt.Sprintf("%s/%d-%d", r.Proto, r.First, r.Last)
 }
 
 // BGPAdvertisement describes one translation from an IP address to a BGP advertisement.
@@ -144,11 +346,81 @@ type BGPAdvertisement struct {
 	// length. Optional, defaults to 32 (i.e. no aggregation) if not
 	// specified.
 	AggregationLength int
+	// The same as AggregationLength, for IPv6 addresses. Optional,
+	// defaults to 128.
+	AggregationLengthV6 int
 	// Value of the LOCAL_PREF BGP path attribute. Used only when
 	// advertising to IBGP peers (i.e. Peer.MyASN == Peer.ASN).
 	LocalPref uint32
 	// Value of the COMMUNITIES path attribute.
 	Communities map[uint32]bool
+	// Value of the NEXT_HOP path attribute. Overrides the next-hop
+	// of the peer if set.
+	NextHop net.IP
+	// Addresses of the peers to make this advertisement to. Empty
+	// means all peers.
+	Peers []net.IP
+	// Names of the BGP instances whose peers get this advertisement.
+	// Empty means all peers.
+	Instances []string
+	// Only make this advertisement from this many nodes, chosen
+	// deterministically per service. 0 means all nodes.
+	MaxAnnouncingNodes int
+	// Bandwidth, in bytes per second, to signal per ready local
+	// endpoint with the link bandwidth extended community, for
+	// services with the Local traffic policy. 0 means none.
+	LinkBandwidth float32
+}
+
+// StaticAdvertisement is a prefix advertised to BGP peers regardless
+// of services, e.g. an anycast address served outside of Kubernetes.
+type StaticAdvertisement struct {
+	// The prefix to advertise.
+	Prefix *net.IPNet
+	// Value of the LOCAL_PREF BGP path attribute. Used only when
+	// advertising to IBGP peers.
+	LocalPref uint32
+	// Value of the COMMUNITIES path attribute.
+	Communities map[uint32]bool
+	// Value of the NEXT_HOP path attribute. Overrides the next-hop
+	// of the peer if set.
+	NextHop net.IP
+	// Addresses of the peers to advertise the prefix to. Empty means
+	// all peers.
+	Peers []net.IP
+	// Only advertise the prefix from nodes that match one of these
+	// selectors.
+	NodeSelectors []labels.Selector
+}
+
+// StaticVIP is an address announced in layer2 mode regardless of
+// services, e.g. the address of a bastion host living on a node.
+type StaticVIP struct {
+	// The address to answer ARP and NDP requests for.
+	IP net.IP
+	// The nodes that may announce the address, in order of
+	// preference. Empty means any node, chosen like for a service.
+	Nodes []string
+}
+
+// parseNodeSelectors parses a list of node selectors. No selector
+// means all nodes.
+func parseNodeSelectors(sels []nodeSelector) ([]labels.Selector, error) {
+	// We use a non-pointer in the raw json object, so that if the
+	// user doesn't provide a node selector, we end up with an empty,
+	// but non-nil selector, which means "select everything".
+	if len(sels) == 0 {
+		return []labels.Selector{labels.Everything()}, nil
+	}
+	var ret []labels.Selector
+	for _, sel := range sels {
+		nodeSel, err := parseNodeSelector(&sel)
+		if err != nil {
+			return nil, fmt.Errorf("parsing node selector: %s", err)
+		}
+		ret = append(ret, nodeSel)
+	}
+	return ret, nil
 }
 
 func parseNodeSelector(ns *nodeSelector) (labels.Selector, error) {
@@ -191,19 +463,76 @@ func parseHoldTime(ht string) (time.Duration, error) {
 	return rounded, nil
 }
 
+// parseTimer parses an optional duration setting, rounded down to
+// the second. An empty string yields zero.
+func parseTimer(name, t string) (time.Duration, error) {
+	if t == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(t)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %s", name, t, err)
+	}
+	rounded := time.Duration(int(d.Seconds())) * time.Second
+	if rounded <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be at least 1s", name, t)
+	}
+	return rounded, nil
+}
+
 // Parse loads and validates a Config from bs.
 func Parse(bs []byte) (*Config, error) {
+	return ParseWithExpansions(bs, nil)
+}
+
+// ParseWithExpansions is Parse, with the extra addresses in
+// expansions, keyed by pool name, added to the address pools. The
+// expansions of pools that don't exist are ignored, so that removing
+// a pool doesn't invalidate the configuration.
+func ParseWithExpansions(bs []byte, expansions map[string][]string) (*Config, error) {
 	var raw configFile
 	if err := yaml.UnmarshalStrict(bs, &raw); err != nil {
 		return nil, fmt.Errorf("could not parse config: %s", err)
 	}
 
+	for name, addrs := range expansions {
+		for i := range raw.Pools {
+			if raw.Pools[i].Name == name {
+				raw.Pools[i].Addresses = append(raw.Pools[i].Addresses, addrs...)
+			}
+		}
+	}
+
+	instances := map[string]bgpInstance{}
+	for i, inst := range raw.BGPInstances {
+		if err := checkBGPInstance(inst); err != nil {
+			return nil, fmt.Errorf("parsing BGP instance #%d: %s", i+1, err)
+		}
+		if _, ok := instances[inst.Name]; ok {
+			return nil, fmt.Errorf("duplicate definition of BGP instance %q", inst.Name)
+		}
+		instances[inst.Name] = inst
+	}
+
 	cfg := &Config{Pools: map[string]*Pool{}}
 	for i, p := range raw.Peers {
+		vrf := ""
+		if p.Instance != "" {
+			inst, ok := instances[p.Instance]
+			if !ok {
+				return nil, fmt.Errorf("parsing peer #%d: unknown BGP instance %q", i+1, p.Instance)
+			}
+			var err error
+			if p, err = inheritInstance(p, inst); err != nil {
+				return nil, fmt.Errorf("parsing peer #%d: %s", i+1, err)
+			}
+			vrf = inst.VRF
+		}
 		peer, err := parsePeer(p)
 		if err != nil {
 			return nil, fmt.Errorf("parsing peer #%d: %s", i+1, err)
 		}
+		peer.Instance, peer.VRF = p.Instance, vrf
 		for _, ep := range cfg.Peers {
 			// TODO: Be smarter regarding conflicting peers. For example, two
 			// peers could have a different hold time but they'd still result
@@ -217,12 +546,20 @@ func Parse(bs []byte) (*Config, error) {
 
 	communities := map[string]uint32{}
 	for n, v := range raw.BGPCommunities {
+		// Communities are given as lists of aliases and
+		// <asn>:<community number>, comma-separated in annotations.
+		if n == "" || strings.ContainsAny(n, ":, \t") {
+			return nil, fmt.Errorf("invalid community alias %q, must be non-empty without colons, commas or spaces", n)
+		}
 		c, err := parseCommunity(v)
 		if err != nil {
 			return nil, fmt.Errorf("parsing community %q: %s", n, err)
 		}
 		communities[n] = c
 	}
+	if len(communities) > 0 {
+		cfg.BGPCommunities = communities
+	}
 
 	var allCIDRs []*net.IPNet
 	for i, p := range raw.Pools {
@@ -249,9 +586,85 @@ func Parse(bs []byte) (*Config, error) {
 		cfg.Pools[p.Name] = pool
 	}
 
+	for i, a := range raw.StaticAds {
+		ad, err := parseStaticAdvertisement(a, communities)
+		if err != nil {
+			return nil, fmt.Errorf("parsing static advertisement #%d: %s", i+1, err)
+		}
+		cfg.StaticAdvertisements = append(cfg.StaticAdvertisements, ad)
+	}
+
+	seenVIPs := map[string]bool{}
+	for i, v := range raw.StaticVIPs {
+		vip, err := parseStaticVIP(v, allCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("parsing static VIP #%d: %s", i+1, err)
+		}
+		if seenVIPs[vip.IP.String()] {
+			return nil, fmt.Errorf("duplicate definition of static VIP %q", v.Address)
+		}
+		seenVIPs[vip.IP.String()] = true
+		cfg.StaticVIPs = append(cfg.StaticVIPs, vip)
+	}
+
+	if err := checkPeerRefs(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkNextHops(cfg); err != nil {
+		return nil, err
+	}
+	if err := checkInstanceRefs(cfg, instances); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
+func checkBGPInstance(inst bgpInstance) error {
+	switch {
+	case inst.Name == "":
+		return errors.New("missing name")
+	case inst.MyASN == 0:
+		return errors.New("missing local ASN")
+	case inst.RouterID != "" && net.ParseIP(inst.RouterID) == nil:
+		return fmt.Errorf("invalid router ID %q", inst.RouterID)
+	case inst.RouterID != "" && inst.RouterIDIface != "":
+		return errors.New("router-id and router-id-interface are mutually exclusive")
+	}
+	return nil
+}
+
+// inheritInstance returns p with the local settings of its BGP
+// instance inst, which its own settings can't contradict.
+func inheritInstance(p peer, inst bgpInstance) (peer, error) {
+	switch {
+	case p.MyASN != 0 && p.MyASN != inst.MyASN:
+		return p, fmt.Errorf("my-asn %d differs from the my-asn %d of BGP instance %q", p.MyASN, inst.MyASN, inst.Name)
+	case p.RouterID != "" || p.RouterIDIface != "":
+		return p, fmt.Errorf("the router ID of the peers of BGP instance %q is set by the instance", inst.Name)
+	case inst.VRF != "" && p.AddrRange != "":
+		return p, fmt.Errorf("peer-address-range is not supported in BGP instance %q, which has a VRF", inst.Name)
+	}
+	p.MyASN = inst.MyASN
+	p.RouterID, p.RouterIDIface = inst.RouterID, inst.RouterIDIface
+	return p, nil
+}
+
+// checkInstanceRefs checks that all the BGP instances referenced by
+// advertisements are configured.
+func checkInstanceRefs(cfg *Config, instances map[string]bgpInstance) error {
+	for name, pool := range cfg.Pools {
+		for _, ad := range pool.BGPAdvertisements {
+			for _, inst := range ad.Instances {
+				if _, ok := instances[inst]; !ok {
+					return fmt.Errorf("address pool %q: BGP advertisement references unknown BGP instance %q", name, inst)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func parsePeer(p peer) (*Peer, error) {
 	if p.MyASN == 0 {
 		return nil, errors.New("missing local ASN")
@@ -259,14 +672,59 @@ func parsePeer(p peer) (*Peer, error) {
 	if p.ASN == 0 {
 		return nil, errors.New("missing peer ASN")
 	}
-	ip := net.ParseIP(p.Addr)
-	if ip == nil {
+	addr, zone := p.Addr, ""
+	if i := strings.LastIndex(addr, "%"); i >= 0 {
+		addr, zone = addr[:i], addr[i+1:]
+	}
+	ip := net.ParseIP(addr)
+	switch {
+	case p.Addr != "" && (ip == nil || strings.HasSuffix(p.Addr, "%")):
 		return nil, fmt.Errorf("invalid peer IP %q", p.Addr)
+	case ip != nil && zone != "" && !(ip.To4() == nil && ip.IsLinkLocalUnicast()):
+		return nil, fmt.Errorf("invalid peer IP %q: only IPv6 link-local addresses have an interface", p.Addr)
+	case ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast() && zone == "" && p.SrcIface == "":
+		return nil, fmt.Errorf("link-local peer IP %q needs an interface, e.g. %s%%eth0, or a source-interface", p.Addr, p.Addr)
+	case p.Addr != "" && p.AddrGateway != "":
+		return nil, errors.New("peer-address and peer-address-gateway-interface are mutually exclusive")
+	case p.AddrAnnotation != "" && p.AddrGateway != "":
+		return nil, errors.New("peer-address-annotation and peer-address-gateway-interface are mutually exclusive")
+	case p.AddrRange != "" && (p.Addr != "" || p.AddrAnnotation != "" || p.AddrGateway != ""):
+		return nil, errors.New("peer-address-range is mutually exclusive with the other peer addresses")
+	case p.AddrRange != "" && p.Password != "":
+		return nil, errors.New("password is not supported with peer-address-range")
+	case ip == nil && p.AddrAnnotation == "" && p.AddrGateway == "" && p.AddrRange == "":
+		return nil, errors.New("missing peer address")
+	}
+	var addrRange *net.IPNet
+	if p.AddrRange != "" {
+		_, n, err := net.ParseCIDR(p.AddrRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer address range %q: %s", p.AddrRange, err)
+		}
+		addrRange = n
 	}
 	holdTime, err := parseHoldTime(p.HoldTime)
 	if err != nil {
 		return nil, err
 	}
+	keepaliveTime, err := parseTimer("keepalive time", p.KeepaliveTime)
+	if err != nil {
+		return nil, err
+	}
+	if keepaliveTime != 0 && (holdTime == 0 || keepaliveTime >= holdTime) {
+		return nil, fmt.Errorf("invalid keepalive time %q: must be lower than the hold time", p.KeepaliveTime)
+	}
+	initialBackoff, err := parseTimer("initial backoff", p.InitialBackoff)
+	if err != nil {
+		return nil, err
+	}
+	connectRetryTime, err := parseTimer("connect retry time", p.ConnectRetry)
+	if err != nil {
+		return nil, err
+	}
+	if connectRetryTime != 0 && initialBackoff > connectRetryTime {
+		return nil, fmt.Errorf("invalid initial backoff %q: must not exceed the connect retry time", p.InitialBackoff)
+	}
 	port := uint16(179)
 	if p.Port != 0 {
 		port = p.Port
@@ -280,25 +738,47 @@ func parsePeer(p peer) (*Peer, error) {
 		if routerID == nil {
 			return nil, fmt.Errorf("invalid router ID %q", p.RouterID)
 		}
+		if p.RouterIDIface != "" {
+			return nil, errors.New("router-id and router-id-interface are mutually exclusive")
+		}
 	}
 	src := net.ParseIP(p.SrcAddr)
 	if p.SrcAddr != "" && src == nil {
 		return nil, fmt.Errorf("invalid source IP %q", p.SrcAddr)
 	}
+	if src != nil && p.SrcIface != "" {
+		return nil, errors.New("source-address and source-interface are mutually exclusive")
+	}
+	nextHop, err := parseNextHop(p.NextHop)
+	if err != nil {
+		return nil, err
+	}
+	if p.RouteReflector {
+		// The reflector identifies the routes of each client by its
+		// router ID (ORIGINATOR_ID, RFC 4456), so the nodes can't
+		// share one.
+		switch {
+		case p.MyASN != p.ASN:
+			return nil, errors.New("route-reflector needs an iBGP session, with my-asn equal to peer-asn")
+		case routerID != nil:
+			return nil, errors.New("route-reflector peers can't have a fixed router-id, the nodes need distinct router IDs")
+		}
+	}
 
-	// We use a non-pointer in the raw json object, so that if the
-	// user doesn't provide a node selector, we end up with an empty,
-	// but non-nil selector, which means "select everything".
-	var nodeSels []labels.Selector
-	if len(p.NodeSelectors) == 0 {
-		nodeSels = []labels.Selector{labels.Everything()}
-	} else {
-		for _, sel := range p.NodeSelectors {
-			nodeSel, err := parseNodeSelector(&sel)
-			if err != nil {
-				return nil, fmt.Errorf("parsing node selector: %s", err)
-			}
-			nodeSels = append(nodeSels, nodeSel)
+	confedMembers, err := parseConfederation(p)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeSels, err := parseNodeSelectors(p.NodeSelectors)
+	if err != nil {
+		return nil, err
+	}
+
+	var evpn *EVPN
+	if p.EVPN != nil {
+		if evpn, err = parseEVPN(*p.EVPN, p.MyASN); err != nil {
+			return nil, err
 		}
 	}
 
@@ -307,18 +787,93 @@ func parsePeer(p peer) (*Peer, error) {
 		password = p.Password
 	}
 	return &Peer{
-		MyASN:         p.MyASN,
-		ASN:           p.ASN,
-		Addr:          ip,
-		SrcAddr:       src,
-		Port:          port,
-		HoldTime:      holdTime,
-		RouterID:      routerID,
-		NodeSelectors: nodeSels,
-		Password:      password,
+		MyASN:                p.MyASN,
+		ASN:                  p.ASN,
+		Addr:                 ip,
+		AddrZone:             zone,
+		AddrAnnotation:       p.AddrAnnotation,
+		AddrGatewayInterface: p.AddrGateway,
+		AddrRange:            addrRange,
+		SrcAddr:              src,
+		SrcInterface:         p.SrcIface,
+		SrcAddrAnnotation:    p.SrcAnnotation,
+		Port:                 port,
+		HoldTime:             holdTime,
+		KeepaliveTime:        keepaliveTime,
+		InitialBackoff:       initialBackoff,
+		ConnectRetryTime:     connectRetryTime,
+		RouterID:             routerID,
+		RouterIDInterface:    p.RouterIDIface,
+		NextHop:              nextHop,
+		FlowSpec:             p.FlowSpec,
+		EVPN:                 evpn,
+		NodeSelectors:        nodeSels,
+		Password:             password,
+		RouteReflector:       p.RouteReflector,
+		ConfederationID:      p.ConfedID,
+		ConfederationMembers: confedMembers,
 	}, nil
 }
 
+// parseConfederation returns the other member ASes of the
+// confederation of p, if any.
+func parseConfederation(p peer) ([]uint32, error) {
+	if p.ConfedID == 0 {
+		if len(p.ConfedMembers) > 0 {
+			return nil, errors.New("confederation-members needs a confederation-id")
+		}
+		return nil, nil
+	}
+	switch {
+	case p.ConfedID == p.MyASN:
+		return nil, fmt.Errorf("confederation-id %d must differ from my-asn, which is the member AS", p.ConfedID)
+	case p.ConfedID == p.ASN:
+		return nil, fmt.Errorf("peer-asn %d is the confederation-id, peers inside the confederation must use their member AS", p.ASN)
+	}
+	var ret []uint32
+	seen := map[uint32]bool{}
+	for _, asn := range p.ConfedMembers {
+		switch {
+		case asn == 0 || asn == p.ConfedID:
+			return nil, fmt.Errorf("invalid confederation member AS %d", asn)
+		case seen[asn]:
+			return nil, fmt.Errorf("duplicate confederation member AS %d", asn)
+		}
+		seen[asn] = true
+		// The local member AS may be listed, as routers often require.
+		if asn != p.MyASN {
+			ret = append(ret, asn)
+		}
+	}
+	return ret, nil
+}
+
+// String identifies the peer in logs.
+func (p *Peer) String() string {
+	if p.Instance != "" {
+		// The same address may be a peer of several instances.
+		return fmt.Sprintf("%s in BGP instance %s", p.addrString(), p.Instance)
+	}
+	return p.addrString()
+}
+
+func (p *Peer) addrString() string {
+	switch {
+	case p.AddrAnnotation != "" && p.Addr != nil:
+		return fmt.Sprintf("%s (or node annotation %s)", p.Addr, p.AddrAnnotation)
+	case p.AddrAnnotation != "":
+		return fmt.Sprintf("node annotation %s", p.AddrAnnotation)
+	case p.AddrGatewayInterface != "":
+		return fmt.Sprintf("gateway on %s", p.AddrGatewayInterface)
+	case p.AddrRange != nil:
+		return fmt.Sprintf("range %s", p.AddrRange)
+	case p.AddrZone != "":
+		return p.Addr.String() + "%" + p.AddrZone
+	default:
+		return p.Addr.String()
+	}
+}
+
 func parseAddressPool(p addressPool, bgpCommunities map[string]uint32) (*Pool, error) {
 	if p.Name == "" {
 		return nil, errors.New("missing pool name")
@@ -334,6 +889,21 @@ func parseAddressPool(p addressPool, bgpCommunities map[string]uint32) (*Pool, e
 		ret.AutoAssign = *p.AutoAssign
 	}
 
+	switch p.IPMode {
+	case "", "VIP", "Proxy":
+		ret.IPMode = p.IPMode
+	default:
+		return nil, fmt.Errorf("invalid ip-mode %q, must be VIP or Proxy", p.IPMode)
+	}
+
+	if p.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight %d, must be positive", p.Weight)
+	}
+	if p.Weight > 0 && !ret.AutoAssign {
+		return nil, errors.New("weight set on a pool without auto-assign")
+	}
+	ret.Weight = p.Weight
+
 	if len(p.Addresses) == 0 {
 		return nil, errors.New("pool has no prefixes defined")
 	}
@@ -344,18 +914,76 @@ func parseAddressPool(p addressPool, bgpCommunities map[string]uint32) (*Pool, e
 		}
 		ret.CIDR = append(ret.CIDR, nets...)
 	}
+	for _, r := range p.ExcludeRanges {
+		nets, err := parseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid excluded range %q in pool %q: %s", r, p.Name, err)
+		}
+		for _, n := range nets {
+			cidrs, excluded := excludeCIDR(ret.CIDR, n)
+			if !excluded {
+				return nil, fmt.Errorf("excluded range %q is not in the addresses of pool %q", r, p.Name)
+			}
+			ret.CIDR = cidrs
+		}
+	}
+	if len(ret.CIDR) == 0 {
+		return nil, fmt.Errorf("pool %q has no addresses left after excluding its exclude-ranges", p.Name)
+	}
+	seenIfaces := map[string]bool{}
+	for _, i := range p.Layer2Interfaces {
+		switch {
+		case i == "":
+			return nil, errors.New("empty interface name in layer2-interfaces")
+		case seenIfaces[i]:
+			return nil, fmt.Errorf("duplicate interface %q in layer2-interfaces", i)
+		}
+		seenIfaces[i] = true
+	}
+	ret.Layer2Interfaces = p.Layer2Interfaces
+	for _, r := range p.AllowedPorts {
+		pr, err := parsePortRange(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed port %q in pool %q: %s", r, p.Name, err)
+		}
+		ret.AllowedPorts = append(ret.AllowedPorts, pr)
+	}
+	if z := strings.TrimSuffix(p.ReverseDNSZone, "."); z != "" && !strings.HasSuffix(z, ".in-addr.arpa") && !strings.HasSuffix(z, ".ip6.arpa") {
+		return nil, fmt.Errorf("invalid reverse-dns-zone %q in pool %q, must be in in-addr.arpa or ip6.arpa", p.ReverseDNSZone, p.Name)
+	}
+	ret.Description, ret.ReverseDNSZone, ret.Owner = p.Description, p.ReverseDNSZone, p.Owner
 
 	switch ret.Protocol {
 	case Layer2:
 		if len(p.BGPAdvertisements) > 0 {
 			return nil, errors.New("cannot have bgp-advertisements configuration element in a layer2 address pool")
 		}
+		if p.AllowServiceOverrides {
+			return nil, errors.New("cannot allow service overrides of BGP advertisements in a layer2 address pool")
+		}
+		if p.NodeLoopbacks {
+			return nil, errors.New("cannot advertise node loopbacks from a layer2 address pool")
+		}
 	case BGP:
 		ads, err := parseBGPAdvertisements(p.BGPAdvertisements, ret.CIDR, bgpCommunities)
 		if err != nil {
 			return nil, fmt.Errorf("parsing BGP communities: %s", err)
 		}
 		ret.BGPAdvertisements = ads
+		ret.AllowServiceOverrides = p.AllowServiceOverrides
+		if p.NodeLoopbacks {
+			if p.AutoAssign != nil && *p.AutoAssign {
+				return nil, errors.New("cannot auto-assign the addresses of a node loopbacks pool to services")
+			}
+			if p.Weight > 0 || p.AllowServiceOverrides || len(p.AllowedPorts) > 0 {
+				return nil, errors.New("cannot set service allocation options on a node loopbacks pool")
+			}
+			if len(p.Layer2Interfaces) > 0 {
+				return nil, errors.New("cannot announce node loopbacks with layer2")
+			}
+			ret.AutoAssign = false
+			ret.NodeLoopbacks = true
+		}
 	case "":
 		return nil, errors.New("address pool is missing the protocol field")
 	default:
@@ -369,9 +997,10 @@ func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communit
 	if len(ads) == 0 {
 		return []*BGPAdvertisement{
 			{
-				AggregationLength: 32,
-				LocalPref:         0,
-				Communities:       map[uint32]bool{},
+				AggregationLength:   32,
+				AggregationLengthV6: 128,
+				LocalPref:           0,
+				Communities:         map[uint32]bool{},
 			},
 		}, nil
 	}
@@ -379,21 +1008,32 @@ func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communit
 	var ret []*BGPAdvertisement
 	for _, rawAd := range ads {
 		ad := &BGPAdvertisement{
-			AggregationLength: 32,
-			LocalPref:         0,
-			Communities:       map[uint32]bool{},
+			AggregationLength:   32,
+			AggregationLengthV6: 128,
+			LocalPref:           0,
+			Communities:         map[uint32]bool{},
 		}
 
 		if rawAd.AggregationLength != nil {
 			ad.AggregationLength = *rawAd.AggregationLength
 		}
 		if ad.AggregationLength > 32 {
-			return nil, fmt.Errorf("invalid aggregation length %q", ad.AggregationLength)
+			return nil, fmt.Errorf("invalid aggregation length %d", ad.AggregationLength)
+		}
+		if rawAd.AggregationLengthV6 != nil {
+			ad.AggregationLengthV6 = *rawAd.AggregationLengthV6
+		}
+		if ad.AggregationLengthV6 > 128 {
+			return nil, fmt.Errorf("invalid IPv6 aggregation length %d", ad.AggregationLengthV6)
 		}
 		for _, cidr := range cidrs {
 			o, _ := cidr.Mask.Size()
-			if ad.AggregationLength < o {
-				return nil, fmt.Errorf("invalid aggregation length %d: prefix %q in this pool is more specific than the aggregation length", ad.AggregationLength, cidr)
+			length := ad.AggregationLength
+			if cidr.IP.To4() == nil {
+				length = ad.AggregationLengthV6
+			}
+			if length < o {
+				return nil, fmt.Errorf("invalid aggregation length %d: prefix %q in this pool is more specific than the aggregation length", length, cidr)
 			}
 		}
 
@@ -401,21 +1041,320 @@ func parseBGPAdvertisements(ads []bgpAdvertisement, cidrs []*net.IPNet, communit
 			ad.LocalPref = *rawAd.LocalPref
 		}
 
-		for _, c := range rawAd.Communities {
-			if v, ok := communities[c]; ok {
-				ad.Communities[v] = true
-			} else {
-				v, err := parseCommunity(c)
-				if err != nil {
-					return nil, fmt.Errorf("invalid community %q in BGP advertisement: %s", c, err)
+		if rawAd.MaxAnnouncingNodes < 0 {
+			return nil, fmt.Errorf("invalid max announcing nodes %d", rawAd.MaxAnnouncingNodes)
+		}
+		ad.MaxAnnouncingNodes = rawAd.MaxAnnouncingNodes
+
+		if rawAd.LinkBandwidth < 0 {
+			return nil, fmt.Errorf("invalid link bandwidth %v", rawAd.LinkBandwidth)
+		}
+		ad.LinkBandwidth = rawAd.LinkBandwidth
+
+		nextHop, err := parseNextHop(rawAd.NextHop)
+		if err != nil {
+			return nil, err
+		}
+		ad.NextHop = nextHop
+
+		if ad.Peers, err = parsePeerRefs(rawAd.Peers); err != nil {
+			return nil, err
+		}
+		ad.Instances = rawAd.Instances
+
+		ad.Communities, err = ParseCommunities(rawAd.Communities, communities)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, ad)
+	}
+
+	return ret, nil
+}
+
+// parsePeerRefs parses the peer addresses an advertisement is
+// restricted to.
+func parsePeerRefs(peers []string) ([]net.IP, error) {
+	var ret []net.IP
+	for _, p := range peers {
+		ip := net.ParseIP(p)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer address %q in BGP advertisement", p)
+		}
+		ret = append(ret, ip)
+	}
+	return ret, nil
+}
+
+// checkPeerRefs checks that all the peers referenced by
+// advertisements are configured.
+func checkPeerRefs(cfg *Config) error {
+	check := func(refs []net.IP) error {
+	ref:
+		for _, ip := range refs {
+			for _, p := range cfg.Peers {
+				// Peers with an address range are referenced by
+				// the range's network address.
+				if p.Addr.Equal(ip) || (p.AddrRange != nil && p.AddrRange.IP.Equal(ip)) {
+					continue ref
 				}
-				ad.Communities[v] = true
+			}
+			return fmt.Errorf("BGP advertisement references unknown peer %q", ip)
+		}
+		return nil
+	}
+	for name, pool := range cfg.Pools {
+		for _, ad := range pool.BGPAdvertisements {
+			if err := check(ad.Peers); err != nil {
+				return fmt.Errorf("address pool %q: %s", name, err)
 			}
 		}
+	}
+	for i, ad := range cfg.StaticAdvertisements {
+		if err := check(ad.Peers); err != nil {
+			return fmt.Errorf("static advertisement #%d: %s", i+1, err)
+		}
+	}
+	return nil
+}
 
-		ret = append(ret, ad)
+// checkNextHops returns an error if the IPv6 next hop of a BGP
+// advertisement of IPv4 addresses goes to IPv4 sessions, which don't
+// negotiate IPv6 next hops (RFC 8950) unless the peer's next-hop is
+// IPv6 too: the peers it references, or all the peers if it
+// references none.
+func checkNextHops(cfg *Config) error {
+	addr := func(p *Peer) net.IP {
+		if p.AddrRange != nil {
+			return p.AddrRange.IP
+		}
+		return p.Addr
+	}
+	ipv4Only := func(p *Peer) bool {
+		return addr(p).To4() != nil && (p.NextHop == nil || p.NextHop.To4() != nil)
+	}
+	for name, pool := range cfg.Pools {
+		hasIPv4 := false
+		for _, cidr := range pool.CIDR {
+			hasIPv4 = hasIPv4 || cidr.IP.To4() != nil
+		}
+		for _, ad := range pool.BGPAdvertisements {
+			if !hasIPv4 || ad.NextHop == nil || ad.NextHop.To4() != nil {
+				continue
+			}
+			usable := false
+			for _, p := range cfg.Peers {
+				referenced := false
+				for _, ip := range ad.Peers {
+					referenced = referenced || addr(p).Equal(ip)
+				}
+				if len(ad.Peers) > 0 && !referenced {
+					continue
+				}
+				switch {
+				case !ipv4Only(p):
+					usable = true
+				case len(ad.Peers) > 0:
+					return fmt.Errorf("address pool %q: IPv6 next-hop %s can't be sent to peer %s over IPv4, set an IPv6 next-hop on the peer", name, ad.NextHop, addr(p))
+				}
+			}
+			if !usable && len(cfg.Peers) > 0 {
+				return fmt.Errorf("address pool %q: IPv6 next-hop %s can't be sent to any peer, all the sessions are IPv4", name, ad.NextHop)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseCommunities parses a list of communities, given either as
+// aliases or in the <asn>:<community number> form.
+func ParseCommunities(raw []string, communities map[string]uint32) (map[uint32]bool, error) {
+	ret := map[uint32]bool{}
+	for _, c := range raw {
+		if v, ok := communities[c]; ok {
+			ret[v] = true
+		} else if !strings.Contains(c, ":") {
+			return nil, fmt.Errorf("unknown community alias %q", c)
+		} else {
+			v, err := parseCommunity(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid community %q: %s", c, err)
+			}
+			ret[v] = true
+		}
+	}
+	return ret, nil
+}
+
+func parseStaticAdvertisement(a staticAdvertisement, communities map[string]uint32) (*StaticAdvertisement, error) {
+	_, pfx, err := net.ParseCIDR(a.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %q", a.Prefix)
+	}
+	if pfx.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid prefix %q, must be IPv4", a.Prefix)
+	}
+	ret := &StaticAdvertisement{
+		Prefix: pfx,
+	}
+	if a.LocalPref != nil {
+		ret.LocalPref = *a.LocalPref
+	}
+	if ret.NextHop, err = parseNextHop(a.NextHop); err != nil {
+		return nil, err
+	}
+	if ret.Communities, err = ParseCommunities(a.Communities, communities); err != nil {
+		return nil, err
+	}
+	if ret.Peers, err = parsePeerRefs(a.Peers); err != nil {
+		return nil, err
+	}
+	if ret.NodeSelectors, err = parseNodeSelectors(a.NodeSelectors); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// parseStaticVIP parses a static VIP, which must not be in one of
+// cidrs, the address pools' ranges, since the controller could give
+// it to a service.
+func parseStaticVIP(v staticVIP, cidrs []*net.IPNet) (*StaticVIP, error) {
+	ip := net.ParseIP(v.Address)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", v.Address)
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return nil, fmt.Errorf("address %q is in the range %q of an address pool", v.Address, cidr)
+		}
+	}
+	ret := &StaticVIP{IP: ip}
+	seen := map[string]bool{}
+	for _, n := range v.Nodes {
+		if n == "" {
+			return nil, fmt.Errorf("empty node name for address %q", v.Address)
+		}
+		if seen[n] {
+			return nil, fmt.Errorf("duplicate node %q for address %q", n, v.Address)
+		}
+		seen[n] = true
+		ret.Nodes = append(ret.Nodes, n)
+	}
+	return ret, nil
+}
+
+// parseNextHop parses an optional BGP next-hop. IPv6 next-hops are
+// only used with peers that support them for IPv4 routes (RFC 8950).
+func parseNextHop(nh string) (net.IP, error) {
+	if nh == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(nh)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid next-hop %q, must be an IP address", nh)
+	}
+	return ip, nil
+}
+
+func parseEVPN(e evpn, myASN uint32) (*EVPN, error) {
+	if e.VNI == 0 || e.VNI >= 1<<24 {
+		return nil, fmt.Errorf("invalid EVPN VNI %d, must be between 1 and %d", e.VNI, 1<<24-1)
+	}
+	ret := &EVPN{VNI: e.VNI}
+	if e.RD != "" {
+		typ, v, err := parseAdminNumber(e.RD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route distinguisher %q: %s", e.RD, err)
+		}
+		ret.RouteDistinguisher = uint64(typ)<<48 | v
+	}
+	for _, rt := range e.RouteTargets {
+		typ, v, err := parseAdminNumber(rt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route target %q: %s", rt, err)
+		}
+		// Route target subtype of the 2-byte ASN, IPv4 and 4-byte
+		// ASN extended communities.
+		ret.RouteTargets = append(ret.RouteTargets, uint64(typ)<<56|0x02<<48|v)
+	}
+	if len(ret.RouteTargets) == 0 {
+		if myASN > 65535 {
+			return nil, errors.New("EVPN route-targets are required with a 4-byte local ASN")
+		}
+		ret.RouteTargets = []uint64{0x02<<48 | uint64(myASN)<<32 | uint64(e.VNI)}
+	}
+	if e.RouterMAC != "" {
+		mac, err := net.ParseMAC(e.RouterMAC)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid router MAC %q", e.RouterMAC)
+		}
+		ret.RouterMAC = mac
+	}
+	return ret, nil
+}
+
+// parseAdminNumber parses the <administrator>:<number> form of route
+// distinguishers and route targets. It returns the type of the
+// value, 0 for a 2-byte ASN, 1 for an IPv4 address and 2 for a 4-byte
+// ASN administrator, and the value in its 6-byte encoding.
+func parseAdminNumber(s string) (uint8, uint64, error) {
+	fs := strings.Split(s, ":")
+	if len(fs) != 2 {
+		return 0, 0, errors.New("must be <ASN or IPv4 address>:<number>")
+	}
+	if ip := net.ParseIP(fs[0]).To4(); ip != nil {
+		n, err := strconv.ParseUint(fs[1], 10, 16)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid number %q: %s", fs[1], err)
+		}
+		return 1, uint64(ip[0])<<40 | uint64(ip[1])<<32 | uint64(ip[2])<<24 | uint64(ip[3])<<16 | n, nil
+	}
+	asn, err := strconv.ParseUint(fs[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid ASN %q: %s", fs[0], err)
+	}
+	if asn <= 65535 {
+		n, err := strconv.ParseUint(fs[1], 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid number %q: %s", fs[1], err)
+		}
+		return 0, asn<<32 | n, nil
+	}
+	n, err := strconv.ParseUint(fs[1], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid number %q: %s", fs[1], err)
 	}
+	return 2, asn<<16 | n, nil
+}
 
+// parsePortRange parses a port range in the <protocol>/<port> or
+// <protocol>/<first port>-<last port> form.
+func parsePortRange(r string) (PortRange, error) {
+	fs := strings.Split(r, "/")
+	if len(fs) != 2 {
+		return PortRange{}, errors.New("must be <protocol>/<port> or <protocol>/<first port>-<last port>")
+	}
+	ret := PortRange{Proto: strings.ToUpper(fs[0])}
+	switch ret.Proto {
+	case "TCP", "UDP", "SCTP":
+	default:
+		return PortRange{}, fmt.Errorf("unknown protocol %q, must be TCP, UDP or SCTP", fs[0])
+	}
+	first, last := fs[1], fs[1]
+	if i := strings.Index(fs[1], "-"); i >= 0 {
+		first, last = fs[1][:i], fs[1][i+1:]
+	}
+	var err error
+	if ret.First, err = strconv.Atoi(first); err != nil || ret.First < 1 || ret.First > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %q, must be between 1 and 65535", first)
+	}
+	if ret.Last, err = strconv.Atoi(last); err != nil || ret.Last < 1 || ret.Last > 65535 {
+		return PortRange{}, fmt.Errorf("invalid port %q, must be between 1 and 65535", last)
+	}
+	if ret.First > ret.Last {
+		return PortRange{}, fmt.Errorf("first port %d is after last port %d", ret.First, ret.Last)
+	}
 	return ret, nil
 }
 
@@ -458,15 +1397,74 @@ func parseCIDR(cidr string) ([]*net.IPNet, error) {
 		return nil, fmt.Errorf("invalid IP range %q: invalid end IP %q", cidr, fs[1])
 	}
 
+	return summarize(start, end), nil
+}
+
+// excludeCIDR returns cidrs without the addresses of excl, and
+// whether any was removed. The remaining addresses of a CIDR that
+// excl overlaps are summarized into the fewest CIDRs, like ranges.
+func excludeCIDR(cidrs []*net.IPNet, excl *net.IPNet) ([]*net.IPNet, bool) {
 	var ret []*net.IPNet
-	for _, pfx := range ipaddr.Summarize(start, end) {
-		n := &net.IPNet{
-			IP:   pfx.IP,
-			Mask: pfx.Mask,
+	excluded := false
+	for _, cidr := range cidrs {
+		if !cidrsOverlap(cidr, excl) {
+			ret = append(ret, cidr)
+			continue
+		}
+		excluded = true
+		if cidrContainsCIDR(excl, cidr) {
+			continue
+		}
+		// excl is inside cidr, keep what's before and after it.
+		first, last := cidrFirstLast(cidr)
+		exclFirst, exclLast := cidrFirstLast(excl)
+		if !first.Equal(exclFirst) {
+			ret = append(ret, summarize(first, ipAdd(exclFirst, -1))...)
+		}
+		if !last.Equal(exclLast) {
+			ret = append(ret, summarize(ipAdd(exclLast, 1), last)...)
 		}
-		ret = append(ret, n)
 	}
-	return ret, nil
+	return ret, excluded
+}
+
+// cidrFirstLast returns the first and last addresses of n.
+func cidrFirstLast(n *net.IPNet) (net.IP, net.IP) {
+	c := ipaddr.NewCursor([]ipaddr.Prefix{*ipaddr.NewPrefix(n)})
+	return c.First().IP, c.Last().IP
+}
+
+// ipAdd returns the address after ip if delta is positive, the one
+// before it otherwise.
+func ipAdd(ip net.IP, delta int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+	for i := len(ret) - 1; i >= 0; i-- {
+		if delta > 0 {
+			ret[i]++
+			if ret[i] != 0 {
+				break
+			}
+		} else {
+			ret[i]--
+			if ret[i] != 0xff {
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// summarize returns the fewest CIDRs covering first to last.
+func summarize(first, last net.IP) []*net.IPNet {
+	var ret []*net.IPNet
+	for _, pfx := range ipaddr.Summarize(first, last) {
+		ret = append(ret, &net.IPNet{IP: pfx.IP, Mask: pfx.Mask})
+	}
+	return ret
 }
 
 func cidrsOverlap(a, b *net.IPNet) bool {
@@ -484,3 +1482,50 @@ func cidrContainsCIDR(outer, inner *net.IPNet) bool {
 	}
 	return false
 }
+
+// ChangedPools returns the names of the pools that differ between
+// old and new, i.e. pools that were added, removed or modified. A nil
+// old config is treated as having no pools.
+func ChangedPools(old, new *Config) map[string]bool {
+	ret := map[string]bool{}
+	var oldPools, newPools map[string]*Pool
+	if old != nil {
+		oldPools = old.Pools
+	}
+	if new != nil {
+		newPools = new.Pools
+	}
+	for n, p := range oldPools {
+		if !reflect.DeepEqual(p, newPools[n]) {
+			ret[n] = true
+		}
+	}
+	for n, p := range newPools {
+		if !reflect.DeepEqual(p, oldPools[n]) {
+			ret[n] = true
+		}
+	}
+	return ret
+}
+
+// OnlyPoolsChanged returns true if old and new differ at most in
+// their pools, so that ChangedPools tells all that changed.
+func OnlyPoolsChanged(old, new *Config) bool {
+	if old == nil || new == nil {
+		return old == new
+	}
+	o, n := *old, *new
+	o.Pools, n.Pools = nil, nil
+	return reflect.DeepEqual(o, n)
+}
+
+// OnlyPoolsAndCommunitiesChanged returns true if old and new differ
+// at most in their pools and BGP community aliases.
+func OnlyPoolsAndCommunitiesChanged(old, new *Config) bool {
+	if old == nil || new == nil {
+		return old == new
+	}
+	o, n := *old, *new
+	o.BGPCommunities, n.BGPCommunities = nil, nil
+	return OnlyPoolsChanged(&o, &n)
+}
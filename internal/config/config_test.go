@@ -53,8 +53,13 @@ peers:
   peer-address: 1.2.3.4
   peer-port: 1179
   hold-time: 180s
+  keepalive-time: 60s
+  connect-retry-time: 30s
+  initial-backoff: 2s
   router-id: 10.20.30.40
   source-address: 10.20.30.40
+  next-hop: 10.20.30.41
+  flowspec: true
 - my-asn: 100
   peer-asn: 200
   peer-address: 2.3.4.5
@@ -78,6 +83,8 @@ address-pools:
     localpref: 100
     communities: ["bar", "1234:2345"]
   - aggregation-length: 24
+    next-hop: 10.20.30.42
+  allow-service-overrides: true
 - name: pool2
   protocol: bgp
   addresses:
@@ -96,14 +103,19 @@ address-pools:
 			want: &Config{
 				Peers: []*Peer{
 					{
-						MyASN:         42,
-						ASN:           142,
-						Addr:          net.ParseIP("1.2.3.4"),
-						SrcAddr:       net.ParseIP("10.20.30.40"),
-						Port:          1179,
-						HoldTime:      180 * time.Second,
-						RouterID:      net.ParseIP("10.20.30.40"),
-						NodeSelectors: []labels.Selector{labels.Everything()},
+						MyASN:            42,
+						ASN:              142,
+						Addr:             net.ParseIP("1.2.3.4"),
+						SrcAddr:          net.ParseIP("10.20.30.40"),
+						Port:             1179,
+						HoldTime:         180 * time.Second,
+						KeepaliveTime:    60 * time.Second,
+						ConnectRetryTime: 30 * time.Second,
+						InitialBackoff:   2 * time.Second,
+						RouterID:         net.ParseIP("10.20.30.40"),
+						NextHop:          net.ParseIP("10.20.30.41"),
+						FlowSpec:         true,
+						NodeSelectors:    []labels.Selector{labels.Everything()},
 					},
 					{
 						MyASN:         100,
@@ -122,18 +134,22 @@ address-pools:
 						AutoAssign:    false,
 						BGPAdvertisements: []*BGPAdvertisement{
 							{
-								AggregationLength: 32,
-								LocalPref:         100,
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								LocalPref:           100,
 								Communities: map[uint32]bool{
 									0xfc0004d2: true,
 									0x04D20929: true,
 								},
 							},
 							{
-								AggregationLength: 24,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   24,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								NextHop:             net.ParseIP("10.20.30.42"),
 							},
 						},
+						AllowServiceOverrides: true,
 					},
 					"pool2": {
 						Protocol:   BGP,
@@ -141,8 +157,9 @@ address-pools:
 						AutoAssign: true,
 						BGPAdvertisements: []*BGPAdvertisement{
 							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
 							},
 						},
 					},
@@ -169,6 +186,7 @@ address-pools:
 						AutoAssign: true,
 					},
 				},
+				BGPCommunities: map[string]uint32{"bar": 0xfc0004d2},
 			},
 		},
 
@@ -206,70 +224,161 @@ peers:
 		},
 
 		{
-			desc: "invalid my-asn",
+			desc: "missing peer-address",
 			raw: `
 peers:
-- peer-asn: 42
-  peer-address: 1.2.3.4
+- my-asn: 42
+  peer-asn: 42
 `,
 		},
 
 		{
-			desc: "invalid peer-asn",
+			desc: "peer address from node annotation",
 			raw: `
 peers:
 - my-asn: 42
-  peer-address: 1.2.3.4
+  peer-asn: 42
+  peer-address-annotation: example.com/tor
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:          42,
+						ASN:            42,
+						AddrAnnotation: "example.com/tor",
+						Port:           179,
+						HoldTime:       90 * time.Second,
+						NodeSelectors:  []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid hold time (wrong format)",
+			desc: "peer address from gateway",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
-  peer-address: 1.2.3.4
-  hold-time: foo
+  peer-address-gateway-interface: eth1
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:                42,
+						ASN:                  42,
+						AddrGatewayInterface: "eth1",
+						Port:                 179,
+						HoldTime:             90 * time.Second,
+						NodeSelectors:        []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid hold time (too short)",
+			desc: "peer address and gateway",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
   peer-address: 1.2.3.4
-  hold-time: 1s
+  peer-address-gateway-interface: eth1
 `,
 		},
 
 		{
-			desc: "invalid router ID",
+			desc: "EVPN",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
-  peer-address: 1.2.3.4
-  router-id: oh god how do I BGP
+  peer-asn: 43
+  peer-address: 10.0.0.254
+  evpn:
+    vni: 10100
+    router-mac: 02:00:00:00:00:01
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 10.0.0.253
+  evpn:
+    vni: 10100
+    route-distinguisher: 10.0.0.1:5
+    route-targets: ["64500:100", "4200000000:7", "10.0.0.1:8"]
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           43,
+						Addr:          net.ParseIP("10.0.0.254"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						EVPN: &EVPN{
+							VNI:          10100,
+							RouteTargets: []uint64{0x0002002a00002774},
+							RouterMAC:    net.HardwareAddr{2, 0, 0, 0, 0, 1},
+						},
+					},
+					{
+						MyASN:         42,
+						ASN:           43,
+						Addr:          net.ParseIP("10.0.0.253"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						EVPN: &EVPN{
+							VNI:                10100,
+							RouteDistinguisher: 0x00010a0000010005,
+							RouteTargets:       []uint64{0x0002fbf400000064, 0x0202fa56ea000007, 0x01020a0000010008},
+						},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "EVPN without VNI",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address: 10.0.0.254
+  evpn:
+    route-targets: ["64500:100"]
 `,
 		},
 
 		{
-			desc: "empty node selector (select everything)",
+			desc: "EVPN with invalid route target",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
-  peer-address: 1.2.3.4
+  peer-asn: 43
+  peer-address: 10.0.0.254
+  evpn:
+    vni: 10100
+    route-targets: ["64500"]
+`,
+		},
+
+		{
+			desc: "dynamic neighbors",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address-range: 10.0.0.5/24
 `,
 			want: &Config{
 				Peers: []*Peer{
 					{
 						MyASN:         42,
-						ASN:           42,
-						Addr:          net.ParseIP("1.2.3.4"),
+						ASN:           43,
+						AddrRange:     ipnet("10.0.0.0/24"),
 						Port:          179,
 						HoldTime:      90 * time.Second,
 						NodeSelectors: []labels.Selector{labels.Everything()},
@@ -280,160 +389,320 @@ peers:
 		},
 
 		{
-			desc: "invalid label node selector shape",
+			desc: "route reflector",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
-  peer-address: 1.2.3.4
-  node-selectors:
-  - match-labels:
-      foo:
-        bar: baz
+  peer-address: 10.0.0.254
+  route-reflector: true
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:          42,
+						ASN:            42,
+						Addr:           net.ParseIP("10.0.0.254"),
+						Port:           179,
+						HoldTime:       90 * time.Second,
+						NodeSelectors:  []labels.Selector{labels.Everything()},
+						RouteReflector: true,
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
 		},
 
 		{
-			desc: "invalid expression node selector (missing key)",
+			desc: "eBGP route reflector",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
-  peer-address: 1.2.3.4
-  node-selectors:
-  - match-expressions:
-    - operator: In
-      values: [foo, bar]
+  peer-asn: 43
+  peer-address: 10.0.0.254
+  route-reflector: true
 `,
 		},
 
 		{
-			desc: "invalid expression node selector (missing operator)",
+			desc: "route reflector with fixed router ID",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
-  peer-address: 1.2.3.4
-  node-selectors:
-  - match-expressions:
-    - key: foo
-      values: [foo, bar]
+  peer-address: 10.0.0.254
+  router-id: 10.0.0.1
+  route-reflector: true
 `,
 		},
 
 		{
-			desc: "invalid expression node selector (invalid operator)",
+			desc: "confederation",
+			raw: `
+peers:
+- my-asn: 64512
+  peer-asn: 64513
+  peer-address: 10.0.0.254
+  confederation-id: 65000
+  confederation-members: [64512, 64513, 64514]
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:                64512,
+						ASN:                  64513,
+						Addr:                 net.ParseIP("10.0.0.254"),
+						Port:                 179,
+						HoldTime:             90 * time.Second,
+						NodeSelectors:        []labels.Selector{labels.Everything()},
+						ConfederationID:      65000,
+						ConfederationMembers: []uint32{64513, 64514},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "confederation members without confederation",
+			raw: `
+peers:
+- my-asn: 64512
+  peer-asn: 64513
+  peer-address: 10.0.0.254
+  confederation-members: [64513]
+`,
+		},
+
+		{
+			desc: "peer ASN is the confederation",
+			raw: `
+peers:
+- my-asn: 64512
+  peer-asn: 65000
+  peer-address: 10.0.0.254
+  confederation-id: 65000
+`,
+		},
+
+		{
+			desc: "dynamic neighbors with peer address",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
+  peer-asn: 43
+  peer-address: 10.0.0.1
+  peer-address-range: 10.0.0.0/24
+`,
+		},
+
+		{
+			desc: "dynamic neighbors with password",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address-range: 10.0.0.0/24
+  password: secret
+`,
+		},
+
+		{
+			desc: "invalid peer address range",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 43
+  peer-address-range: 10.0.0.0
+`,
+		},
+
+		{
+			desc: "invalid my-asn",
+			raw: `
+peers:
+- peer-asn: 42
   peer-address: 1.2.3.4
-  node-selectors:
-  - match-expressions:
-    - key: foo
-      operator: Surrounds
-      values: [foo, bar]
 `,
 		},
 
 		{
-			desc: "invalid router ID",
+			desc: "invalid peer-asn",
 			raw: `
 peers:
 - my-asn: 42
-  peer-asn: 42
   peer-address: 1.2.3.4
-  router-id: oh god how do I BGP
 `,
 		},
 
 		{
-			desc: "duplicate peers",
+			desc: "invalid hold time (wrong format)",
 			raw: `
 peers:
 - my-asn: 42
   peer-asn: 42
   peer-address: 1.2.3.4
+  hold-time: foo
+`,
+		},
+
+		{
+			desc: "invalid hold time (too short)",
+			raw: `
+peers:
 - my-asn: 42
   peer-asn: 42
   peer-address: 1.2.3.4
+  hold-time: 1s
 `,
 		},
 
 		{
-			desc: "no pool name",
+			desc: "invalid keepalive time (wrong format)",
 			raw: `
-address-pools:
--
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  keepalive-time: foo
 `,
 		},
 
 		{
-			desc: "address pool with no addresses",
+			desc: "invalid keepalive time (not lower than hold time)",
 			raw: `
-address-pools:
-- name: pool1
-  protocol: bgp
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  hold-time: 30s
+  keepalive-time: 30s
 `,
 		},
 
 		{
-			desc: "address pool with no protocol",
+			desc: "invalid initial backoff (exceeds connect retry time)",
 			raw: `
-address-pools:
-- name: pool1
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  connect-retry-time: 10s
+  initial-backoff: 20s
 `,
 		},
 
 		{
-			desc: "address pool with unknown protocol",
+			desc: "invalid peer next-hop",
 			raw: `
-address-pools:
-- name: pool1
-  protocol: babel
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  next-hop: 2001:db8::1::1
 `,
 		},
 
 		{
-			desc: "invalid pool CIDR",
+			desc: "IPv6 advertisement next-hop to an IPv4 peer",
 			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2001:db8::2
 address-pools:
-- name: pool1
+- name: pool
+  protocol: bgp
   addresses:
-  - 100.200.300.400/24
+  - 10.20.0.0/16
+  bgp-advertisements:
+  - next-hop: 2001:db8::1
+    peers: [1.2.3.4]
 `,
 		},
 
 		{
-			desc: "invalid pool CIDR prefix length",
+			desc: "IPv6 advertisement next-hop with only IPv4 peers",
 			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
 address-pools:
-- name: pool1
+- name: pool
+  protocol: bgp
   addresses:
-  - 1.2.3.0/33
+  - 10.20.0.0/16
+  bgp-advertisements:
+  - next-hop: 2001:db8::1
 `,
 		},
 
 		{
-			desc: "simple advertisement",
+			desc: "BGP instances",
 			raw: `
+bgp-instances:
+- name: fabric-a
+  my-asn: 64512
+  router-id: 10.0.0.1
+  vrf: red
+- name: fabric-b
+  my-asn: 64513
+  router-id-interface: lo
+peers:
+- peer-asn: 64500
+  peer-address: 169.254.0.1
+  bgp-instance: fabric-a
+- my-asn: 64513
+  peer-asn: 64501
+  peer-address: 169.254.0.1
+  bgp-instance: fabric-b
 address-pools:
 - name: pool1
   protocol: bgp
-  addresses: ["1.2.3.0/24"]
+  addresses:
+  - 10.20.0.0/16
   bgp-advertisements:
-  -
+  - bgp-instances: [fabric-a]
 `,
 			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         64512,
+						ASN:           64500,
+						Addr:          net.ParseIP("169.254.0.1"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						RouterID:      net.ParseIP("10.0.0.1"),
+						NodeSelectors: []labels.Selector{labels.Everything()},
+						Instance:      "fabric-a",
+						VRF:           "red",
+					},
+					{
+						MyASN:             64513,
+						ASN:               64501,
+						Addr:              net.ParseIP("169.254.0.1"),
+						Port:              179,
+						HoldTime:          90 * time.Second,
+						RouterIDInterface: "lo",
+						NodeSelectors:     []labels.Selector{labels.Everything()},
+						Instance:          "fabric-b",
+					},
+				},
 				Pools: map[string]*Pool{
 					"pool1": {
 						Protocol:   BGP,
+						CIDR:       []*net.IPNet{ipnet("10.20.0.0/16")},
 						AutoAssign: true,
-						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
 						BGPAdvertisements: []*BGPAdvertisement{
 							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								Instances:           []string{"fabric-a"},
 							},
 						},
 					},
@@ -442,28 +711,439 @@ address-pools:
 		},
 
 		{
-			desc: "advertisement with default BGP settings",
+			desc: "peer of unknown BGP instance",
 			raw: `
-address-pools:
-- name: pool1
-  addresses: ["1.2.3.0/24"]
-  protocol: bgp
+peers:
+- peer-asn: 64500
+  peer-address: 1.2.3.4
+  bgp-instance: fabric-a
 `,
-			want: &Config{
-				Pools: map[string]*Pool{
-					"pool1": {
-						Protocol:   BGP,
-						AutoAssign: true,
-						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
-						BGPAdvertisements: []*BGPAdvertisement{
-							{
-								AggregationLength: 32,
-								Communities:       map[uint32]bool{},
-							},
-						},
-					},
-				},
-			},
+		},
+
+		{
+			desc: "peer contradicting its BGP instance",
+			raw: `
+bgp-instances:
+- name: fabric-a
+  my-asn: 64512
+peers:
+- my-asn: 64513
+  peer-asn: 64500
+  peer-address: 1.2.3.4
+  bgp-instance: fabric-a
+`,
+		},
+
+		{
+			desc: "advertisement to unknown BGP instance",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/16
+  bgp-advertisements:
+  - bgp-instances: [fabric-a]
+`,
+		},
+
+		{
+			desc: "link-local peer",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: fe80::1%eno1
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           42,
+						Addr:          net.ParseIP("fe80::1"),
+						AddrZone:      "eno1",
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "link-local peer without interface",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: fe80::1
+`,
+		},
+
+		{
+			desc: "interface of a global peer address",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 2001:db8::1%eno1
+`,
+		},
+
+		{
+			desc: "invalid router ID",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  router-id: oh god how do I BGP
+`,
+		},
+
+		{
+			desc: "router ID from interface",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  router-id-interface: lo
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:             42,
+						ASN:               42,
+						Addr:              net.ParseIP("1.2.3.4"),
+						Port:              179,
+						HoldTime:          90 * time.Second,
+						RouterIDInterface: "lo",
+						NodeSelectors:     []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "router ID and router ID interface",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  router-id: 10.20.30.40
+  router-id-interface: lo
+`,
+		},
+
+		{
+			desc: "source interface and annotation",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  source-interface: vlan100
+  source-address-annotation: example.com/routing-ip
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:             42,
+						ASN:               42,
+						Addr:              net.ParseIP("1.2.3.4"),
+						Port:              179,
+						HoldTime:          90 * time.Second,
+						SrcInterface:      "vlan100",
+						SrcAddrAnnotation: "example.com/routing-ip",
+						NodeSelectors:     []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "source address and source interface",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  source-address: 10.0.0.5
+  source-interface: vlan100
+`,
+		},
+
+		{
+			desc: "empty node selector (select everything)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           42,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{},
+			},
+		},
+
+		{
+			desc: "invalid label node selector shape",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-labels:
+      foo:
+        bar: baz
+`,
+		},
+
+		{
+			desc: "invalid expression node selector (missing key)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-expressions:
+    - operator: In
+      values: [foo, bar]
+`,
+		},
+
+		{
+			desc: "invalid expression node selector (missing operator)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-expressions:
+    - key: foo
+      values: [foo, bar]
+`,
+		},
+
+		{
+			desc: "invalid expression node selector (invalid operator)",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  node-selectors:
+  - match-expressions:
+    - key: foo
+      operator: Surrounds
+      values: [foo, bar]
+`,
+		},
+
+		{
+			desc: "invalid router ID",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+  router-id: oh god how do I BGP
+`,
+		},
+
+		{
+			desc: "duplicate peers",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+`,
+		},
+
+		{
+			desc: "no pool name",
+			raw: `
+address-pools:
+-
+`,
+		},
+
+		{
+			desc: "address pool with no addresses",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+`,
+		},
+
+		{
+			desc: "address pool with no protocol",
+			raw: `
+address-pools:
+- name: pool1
+`,
+		},
+
+		{
+			desc: "address pool with unknown protocol",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: babel
+`,
+		},
+
+		{
+			desc: "invalid pool CIDR",
+			raw: `
+address-pools:
+- name: pool1
+  addresses:
+  - 100.200.300.400/24
+`,
+		},
+
+		{
+			desc: "invalid pool CIDR prefix length",
+			raw: `
+address-pools:
+- name: pool1
+  addresses:
+  - 1.2.3.0/33
+`,
+		},
+
+		{
+			desc: "pool with excluded ranges",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  exclude-ranges:
+  - 10.0.0.10-10.0.0.11
+  - 10.0.0.128/25
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR: []*net.IPNet{
+							ipnet("10.0.0.0/29"),
+							ipnet("10.0.0.8/31"),
+							ipnet("10.0.0.12/30"),
+							ipnet("10.0.0.16/28"),
+							ipnet("10.0.0.32/27"),
+							ipnet("10.0.0.64/26"),
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "excluded range outside the pool",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  exclude-ranges:
+  - 10.0.1.0/24
+`,
+		},
+
+		{
+			desc: "pool entirely excluded",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/24
+  exclude-ranges:
+  - 10.0.0.0/23
+`,
+		},
+
+		{
+			desc: "simple advertisement",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["1.2.3.0/24"]
+  bgp-advertisements:
+  -
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "advertisement with default BGP settings",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: bgp
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+							},
+						},
+					},
+				},
+			},
 		},
 
 		{
@@ -472,148 +1152,788 @@ address-pools:
 address-pools:
 - name: pool1
   protocol: bgp
-  bgp-advertisements:
-  - aggregation-length: 33
+  bgp-advertisements:
+  - aggregation-length: 33
+`,
+		},
+
+		{
+			desc: "bad aggregation length (incompatible with CIDR)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.30.40/24
+  - 1.2.3.0/28
+  bgp-advertisements:
+  - aggregation-length: 26
+`,
+		},
+
+		{
+			desc: "per-family aggregation length",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.30.0/24
+  - 2001:db8::/64
+  bgp-advertisements:
+  - communities: ["1234:1"]
+  - aggregation-length: 24
+    aggregation-length-v6: 64
+    communities: ["1234:2"]
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24"), ipnet("2001:db8::/64")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities: map[uint32]bool{
+									0x04D20001: true,
+								},
+							},
+							{
+								AggregationLength:   24,
+								AggregationLengthV6: 64,
+								Communities: map[uint32]bool{
+									0x04D20002: true,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "limited announcing nodes",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["10.20.30.0/24"]
+  bgp-advertisements:
+  - max-announcing-nodes: 16
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								MaxAnnouncingNodes:  16,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "link bandwidth",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["10.20.30.0/24"]
+  bgp-advertisements:
+  - link-bandwidth: 125000000
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								LinkBandwidth:       125000000,
+							},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "pool ipMode",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  ip-mode: Proxy
+  addresses: ["10.20.30.0/24"]
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						IPMode:     "Proxy",
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "BGP pool announced with layer2",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: bgp
+  layer2-interfaces: [eth1, vlan10]
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+							},
+						},
+						Layer2Interfaces: []string{"eth1", "vlan10"},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "duplicate layer2 interface",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: layer2
+  layer2-interfaces: [eth1, eth1]
+`,
+		},
+
+		{
+			desc: "pool allowed ports",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: layer2
+  allowed-ports: [TCP/80, tcp/443, UDP/30000-32767]
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("1.2.3.0/24")},
+						AllowedPorts: []PortRange{
+							{Proto: "TCP", First: 80, Last: 80},
+							{Proto: "TCP", First: 443, Last: 443},
+							{Proto: "UDP", First: 30000, Last: 32767},
+						},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "allowed port of unknown protocol",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: layer2
+  allowed-ports: [ICMP/80]
+`,
+		},
+
+		{
+			desc: "allowed port out of range",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: layer2
+  allowed-ports: [TCP/65536]
+`,
+		},
+
+		{
+			desc: "backwards allowed port range",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: layer2
+  allowed-ports: [TCP/443-80]
+`,
+		},
+
+		{
+			desc: "allowed ports on node loopbacks pool",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["1.2.3.0/24"]
+  protocol: bgp
+  node-loopbacks: true
+  allowed-ports: [TCP/80]
+`,
+		},
+
+		{
+			desc: "pool metadata",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["198.51.100.0/24"]
+  protocol: layer2
+  description: Internet-facing services
+  reverse-dns-zone: 100.51.198.in-addr.arpa.
+  owner: netops
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:       Layer2,
+						AutoAssign:     true,
+						CIDR:           []*net.IPNet{ipnet("198.51.100.0/24")},
+						Description:    "Internet-facing services",
+						ReverseDNSZone: "100.51.198.in-addr.arpa.",
+						Owner:          "netops",
+					},
+				},
+			},
+		},
+
+		{
+			desc: "reverse DNS zone outside the reverse trees",
+			raw: `
+address-pools:
+- name: pool1
+  addresses: ["198.51.100.0/24"]
+  protocol: layer2
+  reverse-dns-zone: example.com
+`,
+		},
+
+		{
+			desc: "bad pool ipMode",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  ip-mode: proxy
+  addresses: ["10.20.30.0/24"]
+`,
+		},
+
+		{
+			desc: "pool weight",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  weight: 80
+  addresses: ["10.20.30.0/24"]
+`,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   Layer2,
+						AutoAssign: true,
+						Weight:     80,
+						CIDR:       []*net.IPNet{ipnet("10.20.30.0/24")},
+					},
+				},
+			},
+		},
+
+		{
+			desc: "negative pool weight",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  weight: -1
+  addresses: ["10.20.30.0/24"]
+`,
+		},
+
+		{
+			desc: "weight without auto-assign",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: layer2
+  auto-assign: false
+  weight: 20
+  addresses: ["10.20.30.0/24"]
+`,
+		},
+
+		{
+			desc: "bad link bandwidth",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["10.20.30.0/24"]
+  bgp-advertisements:
+  - link-bandwidth: -1
+`,
+		},
+
+		{
+			desc: "bad max announcing nodes",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses: ["10.20.30.0/24"]
+  bgp-advertisements:
+  - max-announcing-nodes: -1
+`,
+		},
+
+		{
+			desc: "bad IPv6 aggregation length (too long)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - aggregation-length-v6: 129
+`,
+		},
+
+		{
+			desc: "bad IPv6 aggregation length (incompatible with CIDR)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 2001:db8::/64
+  bgp-advertisements:
+  - aggregation-length-v6: 48
+`,
+		},
+
+		{
+			desc: "bad advertisement next-hop",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/16
+  bgp-advertisements:
+  - next-hop: not-an-ip
+`,
+		},
+
+		{
+			desc: "bad community literal (wrong format)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["1234"]
+`,
+		},
+
+		{
+			desc: "bad community literal (asn part doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["99999999:1"]
+`,
+		},
+
+		{
+			desc: "bad community literal (community# part doesn't fit)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["1:99999999"]
+`,
+		},
+
+		{
+			desc: "bad community ref (unknown ref)",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad community ref (ref asn doesn't fit)",
+			raw: `
+bgp-communities:
+  flarb: 99999999:1
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "bad community ref (ref community# doesn't fit)",
+			raw: `
+bgp-communities:
+  flarb: 1:99999999
+address-pools:
+- name: pool1
+  protocol: bgp
+  bgp-advertisements:
+  - communities: ["flarb"]
+`,
+		},
+
+		{
+			desc: "community alias looking like a community",
+			raw: `
+bgp-communities:
+  "1:2": 65535:65281
+`,
+		},
+
+		{
+			desc: "community alias with a comma",
+			raw: `
+bgp-communities:
+  no-export,upstream: 65535:65281
+`,
+		},
+
+		{
+			desc: "unknown community alias in static advertisement",
+			raw: `
+bgp-communities:
+  no-export-upstream: 65535:65281
+static-advertisements:
+- prefix: 192.0.2.53/32
+  communities: ["no-export-downstream"]
+`,
+		},
+
+		{
+			desc: "duplicate pool definition",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+- name: pool1
+  protocol: bgp
+- name: pool2
+  protocol: bgp
+`,
+		},
+
+		{
+			desc: "duplicate CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+- name: pool2
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+`,
+		},
+
+		{
+			desc: "overlapping CIDRs",
+			raw: `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/8
+- name: pool2
+  protocol: bgp
+  addresses:
+  - 10.0.0.0/16
 `,
 		},
 
 		{
-			desc: "bad aggregation length (incompatible with CIDR)",
+			desc: "BGP advertisements in layer2 pool",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
+  protocol: layer2
   addresses:
-  - 10.20.30.40/24
-  - 1.2.3.0/28
+  - 10.0.0.0/16
   bgp-advertisements:
-  - aggregation-length: 26
+  - communities: ["flarb"]
 `,
 		},
 
 		{
-			desc: "bad community literal (wrong format)",
+			desc: "service overrides in layer2 pool",
 			raw: `
 address-pools:
 - name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["1234"]
+  protocol: layer2
+  addresses:
+  - 10.0.0.0/16
+  allow-service-overrides: true
 `,
 		},
 
 		{
-			desc: "bad community literal (asn part doesn't fit)",
+			desc: "node loopbacks pool",
 			raw: `
 address-pools:
-- name: pool1
+- name: loopbacks
   protocol: bgp
-  bgp-advertisements:
-  - communities: ["99999999:1"]
+  addresses:
+  - 10.255.0.0/24
+  node-loopbacks: true
 `,
+			want: &Config{
+				Pools: map[string]*Pool{
+					"loopbacks": {
+						Protocol: BGP,
+						CIDR:     []*net.IPNet{ipnet("10.255.0.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+							},
+						},
+						NodeLoopbacks: true,
+					},
+				},
+			},
 		},
 
 		{
-			desc: "bad community literal (community# part doesn't fit)",
+			desc: "auto-assigned node loopbacks pool",
 			raw: `
 address-pools:
-- name: pool1
+- name: loopbacks
   protocol: bgp
-  bgp-advertisements:
-  - communities: ["1:99999999"]
+  addresses:
+  - 10.255.0.0/24
+  auto-assign: true
+  node-loopbacks: true
 `,
 		},
 
 		{
-			desc: "bad community ref (unknown ref)",
+			desc: "node loopbacks in layer2 pool",
 			raw: `
 address-pools:
-- name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["flarb"]
+- name: loopbacks
+  protocol: layer2
+  addresses:
+  - 10.255.0.0/24
+  node-loopbacks: true
 `,
 		},
 
 		{
-			desc: "bad community ref (ref asn doesn't fit)",
+			desc: "static advertisement",
 			raw: `
 bgp-communities:
-  flarb: 99999999:1
-address-pools:
-- name: pool1
-  protocol: bgp
-  bgp-advertisements:
-  - communities: ["flarb"]
+  bar: 64512:1234
+static-advertisements:
+- prefix: 192.0.2.53/32
+  localpref: 100
+  communities: ["bar", "1234:2345"]
+  next-hop: 10.0.0.1
+  node-selectors:
+  - match-labels:
+      anycast: "true"
+- prefix: 198.51.100.0/24
 `,
+			want: &Config{
+				Pools: map[string]*Pool{},
+				StaticAdvertisements: []*StaticAdvertisement{
+					{
+						Prefix:    ipnet("192.0.2.53/32"),
+						LocalPref: 100,
+						Communities: map[uint32]bool{
+							0xfc0004d2: true,
+							0x04D20929: true,
+						},
+						NextHop:       net.ParseIP("10.0.0.1"),
+						NodeSelectors: []labels.Selector{selector("anycast=true")},
+					},
+					{
+						Prefix:        ipnet("198.51.100.0/24"),
+						Communities:   map[uint32]bool{},
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
+				BGPCommunities: map[string]uint32{"bar": 0xfc0004d2},
+			},
 		},
 
 		{
-			desc: "bad community ref (ref community# doesn't fit)",
+			desc: "static advertisement with IPv6 prefix",
 			raw: `
-bgp-communities:
-  flarb: 1:99999999
+static-advertisements:
+- prefix: 2001:db8::/64
+`,
+		},
+
+		{
+			desc: "advertisement restricted to peers",
+			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
 address-pools:
 - name: pool1
   protocol: bgp
+  addresses: ["10.0.0.0/24"]
   bgp-advertisements:
-  - communities: ["flarb"]
+  - peers: ["1.2.3.4"]
 `,
+			want: &Config{
+				Peers: []*Peer{
+					{
+						MyASN:         42,
+						ASN:           42,
+						Addr:          net.ParseIP("1.2.3.4"),
+						Port:          179,
+						HoldTime:      90 * time.Second,
+						NodeSelectors: []labels.Selector{labels.Everything()},
+					},
+				},
+				Pools: map[string]*Pool{
+					"pool1": {
+						Protocol:   BGP,
+						AutoAssign: true,
+						CIDR:       []*net.IPNet{ipnet("10.0.0.0/24")},
+						BGPAdvertisements: []*BGPAdvertisement{
+							{
+								AggregationLength:   32,
+								AggregationLengthV6: 128,
+								Communities:         map[uint32]bool{},
+								Peers:               []net.IP{net.ParseIP("1.2.3.4")},
+							},
+						},
+					},
+				},
+			},
 		},
 
 		{
-			desc: "duplicate pool definition",
+			desc: "advertisement restricted to unknown peer",
 			raw: `
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
 address-pools:
 - name: pool1
   protocol: bgp
-- name: pool1
-  protocol: bgp
-- name: pool2
-  protocol: bgp
+  addresses: ["10.0.0.0/24"]
+  bgp-advertisements:
+  - peers: ["1.2.3.5"]
 `,
 		},
 
 		{
-			desc: "duplicate CIDRs",
+			desc: "static VIPs",
 			raw: `
-address-pools:
-- name: pool1
-  protocol: bgp
-  addresses:
-  - 10.0.0.0/8
-- name: pool2
-  protocol: bgp
-  addresses:
-  - 10.0.0.0/8
+static-vips:
+- address: 192.168.1.250
+  nodes: [node-b, node-a]
+- address: fc00::250
 `,
+			want: &Config{
+				Pools: map[string]*Pool{},
+				StaticVIPs: []*StaticVIP{
+					{
+						IP:    net.ParseIP("192.168.1.250"),
+						Nodes: []string{"node-b", "node-a"},
+					},
+					{
+						IP: net.ParseIP("fc00::250"),
+					},
+				},
+			},
 		},
 
 		{
-			desc: "overlapping CIDRs",
+			desc: "duplicate static VIP",
 			raw: `
-address-pools:
-- name: pool1
-  protocol: bgp
-  addresses:
-  - 10.0.0.0/8
-- name: pool2
-  protocol: bgp
-  addresses:
-  - 10.0.0.0/16
+static-vips:
+- address: 192.168.1.250
+- address: 192.168.1.250
 `,
 		},
 
 		{
-			desc: "BGP advertisements in layer2 pool",
+			desc: "static VIP in an address pool",
 			raw: `
 address-pools:
 - name: pool1
   protocol: layer2
-  addresses:
-  - 10.0.0.0/16
-  bgp-advertisements:
-  - communities: ["flarb"]
+  addresses: ["192.168.1.0/24"]
+static-vips:
+- address: 192.168.1.250
+`,
+		},
+
+		{
+			desc: "static advertisement restricted to invalid peer",
+			raw: `
+static-advertisements:
+- prefix: 192.0.2.53/32
+  peers: ["flarb"]
+`,
+		},
+
+		{
+			desc: "static advertisement with bad community",
+			raw: `
+static-advertisements:
+- prefix: 192.0.2.53/32
+  communities: ["flarb"]
 `,
 		},
 	}
@@ -653,3 +1973,184 @@ address-pools:
 		})
 	}
 }
+
+func TestParseWithExpansions(t *testing.T) {
+	raw := `
+address-pools:
+- name: pool1
+  protocol: layer2
+  addresses: ["10.20.30.0/24"]
+- name: pool2
+  protocol: layer2
+  addresses: ["10.20.40.0/24"]
+`
+	cfg, err := ParseWithExpansions([]byte(raw), map[string][]string{
+		"pool1": {"10.20.31.0/24", "10.20.32.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("parsing config with expansions: %s", err)
+	}
+	want := []*net.IPNet{ipnet("10.20.30.0/24"), ipnet("10.20.31.0/24"), ipnet("10.20.32.0/24")}
+	if diff := cmp.Diff(want, cfg.Pools["pool1"].CIDR); diff != "" {
+		t.Errorf("wrong expanded pool (-want, +got)\n%s", diff)
+	}
+
+	cfg, err = ParseWithExpansions([]byte(raw), map[string][]string{"pool3": {"10.20.50.0/24"}})
+	if err != nil {
+		t.Errorf("expansion of an unknown pool rejected the config: %s", err)
+	} else if len(cfg.Pools) != 2 {
+		t.Errorf("expansion of an unknown pool created a pool: %v", cfg.Pools)
+	}
+	if _, err := ParseWithExpansions([]byte(raw), map[string][]string{"pool1": {"10.20.40.0/25"}}); err == nil {
+		t.Error("expansion overlapping another pool accepted")
+	}
+}
+
+func TestChangedPools(t *testing.T) {
+	parse := func(raw string) *Config {
+		cfg, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("parsing config: %s", err)
+		}
+		return cfg
+	}
+	base := parse(`
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/16
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.30.0.0/16
+`)
+
+	tests := []struct {
+		desc string
+		old  *Config
+		new  *Config
+		want map[string]bool
+	}{
+		{
+			desc: "no previous config",
+			old:  nil,
+			new:  base,
+			want: map[string]bool{"pool1": true, "pool2": true},
+		},
+		{
+			desc: "identical config",
+			old:  base,
+			new: parse(`
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/16
+- name: pool2
+  protocol: layer2
+  addresses:
+  - 10.30.0.0/16
+`),
+			want: map[string]bool{},
+		},
+		{
+			desc: "pool modified, added and removed",
+			old:  base,
+			new: parse(`
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/15
+- name: pool3
+  protocol: layer2
+  addresses:
+  - 10.40.0.0/16
+`),
+			want: map[string]bool{"pool1": true, "pool2": true, "pool3": true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := ChangedPools(test.old, test.new)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("wrong changed pools (-want, +got)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOnlyPoolsChanged(t *testing.T) {
+	parse := func(raw string) *Config {
+		cfg, err := Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("parsing config: %s", err)
+		}
+		return cfg
+	}
+	pools := `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/16
+`
+	base := parse(pools)
+	tests := []struct {
+		desc string
+		new  *Config
+		want bool
+	}{
+		{
+			desc: "identical config",
+			new:  parse(pools),
+			want: true,
+		},
+		{
+			desc: "pool modified",
+			new: parse(`
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/15
+`),
+			want: true,
+		},
+		{
+			desc: "peer added",
+			new: parse(`
+peers:
+- my-asn: 42
+  peer-asn: 42
+  peer-address: 1.2.3.4
+` + pools),
+		},
+		{
+			desc: "community alias added",
+			new: parse(`
+bgp-communities:
+  bar: 64512:1234
+` + pools),
+		},
+	}
+	for _, test := range tests {
+		if got := OnlyPoolsChanged(base, test.new); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+		// Only the community aliases differ between the two.
+		wantAliases := test.want || test.desc == "community alias added"
+		if got := OnlyPoolsAndCommunitiesChanged(base, test.new); got != wantAliases {
+			t.Errorf("%s: OnlyPoolsAndCommunitiesChanged got %v, want %v", test.desc, got, wantAliases)
+		}
+	}
+	if OnlyPoolsChanged(nil, base) || OnlyPoolsAndCommunitiesChanged(nil, base) {
+		t.Error("a first config only changed the pools")
+	}
+}
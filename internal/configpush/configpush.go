@@ -0,0 +1,411 @@
+// Package configpush distributes the config from the controller to
+// the speakers, so that only the controller watches the config
+// ConfigMap, and all the speakers apply the same snapshot of it.
+//
+// The controller serves the data of the last config it accepted,
+// numbered by a generation that increases with every change, within
+// an epoch that is new every time the controller starts. Speakers
+// long-poll it for the generations after the one they have, and
+// acknowledge each generation once they applied or rejected it.
+// Speakers with a generation of another epoch get the current config
+// right away.
+//
+// The config holds secrets, like the BGP passwords, so it is only
+// served over TLS, to the speakers that authenticate with their
+// ServiceAccount token.
+package configpush // import "go.universe.tf/metallb/internal/configpush"
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	configPath = "/v1/config"
+	ackPath    = "/v1/ack"
+	// How long a poll waits for a new generation, before returning
+	// the current one again.
+	pollTimeout = time.Minute
+	// How long the acks of a speaker that stopped polling count.
+	ackExpiry = 3 * pollTimeout
+)
+
+var (
+	generationGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "config_push",
+		Name:      "generation",
+		Help:      "Generation of the config the controller distributes to the speakers.",
+	})
+
+	acks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "config_push",
+		Name:      "speakers",
+		Help:      "Number of speakers that acknowledged the current config generation, by whether they accepted it.",
+	}, []string{
+		"result",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(generationGauge)
+	prometheus.MustRegister(acks)
+}
+
+// Snapshot is a generation of the config.
+type Snapshot struct {
+	// The epoch of the controller that numbered the generation.
+	Epoch      string `json:"epoch"`
+	Generation uint64 `json:"generation"`
+	// The data of the config ConfigMap.
+	Data map[string]string `json:"data"`
+}
+
+// Ack is a speaker's acknowledgement of a generation.
+type Ack struct {
+	Node       string `json:"node"`
+	Epoch      string `json:"epoch"`
+	Generation uint64 `json:"generation"`
+	// Why the speaker rejected the config, empty if it accepted it.
+	Error string `json:"error,omitempty"`
+}
+
+// An Authenticator authenticates the bearer token of a request, and
+// returns the node of the speaker that sent it, "" if the token
+// doesn't tell. It returns an error for the tokens of anyone else
+// than the speakers.
+type Authenticator func(ctx context.Context, token string) (node string, err error)
+
+// Server serves the config to the speakers.
+type Server struct {
+	l    log.Logger
+	auth Authenticator
+
+	mu       sync.Mutex
+	snapshot Snapshot
+	// Closed and replaced on every new generation, to wake up the
+	// polls.
+	changed chan struct{}
+	// The last ack of each speaker, and when the speaker last polled
+	// or acked.
+	acks map[string]Ack
+	seen map[string]time.Time
+}
+
+// NewServer creates a Server, with no config until Publish, in a new
+// epoch.
+func NewServer(l log.Logger) *Server {
+	return &Server{
+		l:        l,
+		snapshot: Snapshot{Epoch: newEpoch()},
+		changed:  make(chan struct{}),
+		acks:     map[string]Ack{},
+		seen:     map[string]time.Time{},
+	}
+}
+
+// newEpoch returns a random epoch, unique to this process.
+func newEpoch() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Still unique across the restarts of the controller.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Publish makes data, the data of the config ConfigMap, the next
+// generation, unless it is the current one.
+func (s *Server) Publish(data map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot.Generation > 0 && reflect.DeepEqual(data, s.snapshot.Data) {
+		return
+	}
+	s.snapshot = Snapshot{Epoch: s.snapshot.Epoch, Generation: s.snapshot.Generation + 1, Data: data}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	generationGauge.Set(float64(s.snapshot.Generation))
+	s.updateAcks()
+	level.Info(s.l).Log("event", "configPublished", "generation", s.snapshot.Generation, "msg", "distributing new config generation to speakers")
+}
+
+// ListenAndServeTLS serves the speakers that auth authenticates on
+// addr, with the TLS certificate and key in certFile and keyFile.
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string, auth Authenticator) error {
+	s.auth = auth
+	return http.ListenAndServeTLS(addr, certFile, keyFile, s)
+}
+
+// ServeHTTP serves the config and the acks to the authenticated
+// speakers.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	node, err := s.auth(r.Context(), token)
+	if err != nil {
+		level.Warn(s.l).Log("op", "authenticate", "remote", r.RemoteAddr, "error", err, "msg", "refusing config request of unauthenticated client")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == configPath && r.Method == http.MethodGet:
+		s.serveConfig(w, r, node)
+	case r.URL.Path == ackPath && r.Method == http.MethodPost:
+		s.serveAck(w, r, node)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveConfig returns the current config to the speaker of node, once
+// its generation is after the one the speaker has, or right away if
+// the speaker's generation is of another epoch.
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request, node string) {
+	q := r.URL.Query()
+	var after uint64
+	if v := q.Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid generation %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	epoch := q.Get("epoch")
+	if n := q.Get("node"); n != "" {
+		if node != "" && n != node {
+			http.Error(w, "poll for another node", http.StatusForbidden)
+			return
+		}
+		node = n
+	}
+
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		if node != "" {
+			s.seen[node] = time.Now()
+		}
+		snapshot, changed := s.snapshot, s.changed
+		s.mu.Unlock()
+		if snapshot.Generation > 0 && (snapshot.Epoch != epoch || snapshot.Generation != after) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(snapshot)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			// Nothing new, the speaker polls again.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveAck records the ack of a speaker, which must be the one of
+// node if it is known.
+func (s *Server) serveAck(w http.ResponseWriter, r *http.Request, node string) {
+	var ack Ack
+	if err := json.NewDecoder(r.Body).Decode(&ack); err != nil || ack.Node == "" {
+		http.Error(w, "invalid ack", http.StatusBadRequest)
+		return
+	}
+	if node != "" && ack.Node != node {
+		level.Warn(s.l).Log("op", "ackConfig", "node", node, "ackNode", ack.Node, "msg", "refusing ack for another node")
+		http.Error(w, "ack for another node", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acks[ack.Node] = ack
+	s.seen[ack.Node] = time.Now()
+	s.updateAcks()
+	if ack.Error != "" {
+		level.Error(s.l).Log("event", "configRejected", "node", ack.Node, "generation", ack.Generation, "error", ack.Error, "msg", "speaker rejected the config")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateAcks updates the ack metrics for the current generation,
+// forgetting the speakers that stopped polling, e.g. because their
+// node left the cluster.
+func (s *Server) updateAcks() {
+	for node, seen := range s.seen {
+		if time.Since(seen) > ackExpiry {
+			delete(s.seen, node)
+			delete(s.acks, node)
+		}
+	}
+	accepted, rejected := 0, 0
+	for _, ack := range s.acks {
+		switch {
+		case ack.Epoch != s.snapshot.Epoch || ack.Generation != s.snapshot.Generation:
+		case ack.Error == "":
+			accepted++
+		default:
+			rejected++
+		}
+	}
+	acks.WithLabelValues("accepted").Set(float64(accepted))
+	acks.WithLabelValues("rejected").Set(float64(rejected))
+}
+
+// Client fetches the config for a speaker.
+type Client struct {
+	l         log.Logger
+	server    string
+	node      string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewClient creates a Client fetching the config of the speaker of
+// node from server, the base URL of the controller's Server, which
+// must be https. It authenticates with the token in tokenFile, read
+// on every request as it rotates, and verifies the server with
+// tlsConfig.
+func NewClient(l log.Logger, server, node, tokenFile string, tlsConfig *tls.Config) (*Client, error) {
+	if !strings.HasPrefix(server, "https://") {
+		return nil, fmt.Errorf("config server %q is not an https URL", server)
+	}
+	return &Client{
+		l:         l,
+		server:    server,
+		node:      node,
+		tokenFile: tokenFile,
+		client: &http.Client{
+			Timeout:   pollTimeout + 10*time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// do sends req with the speaker's token.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	token, err := ioutil.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading token: %s", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return c.client.Do(req)
+}
+
+// Run passes every new generation of the config to push, until stopCh
+// is closed. push must call its ack function once the config is
+// processed, with why it was not accepted, nil if it was.
+func (c *Client) Run(push func(generation uint64, data map[string]string, ack func(error)), stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	var (
+		epoch      string
+		generation uint64
+	)
+	for ctx.Err() == nil {
+		snapshot, err := c.poll(ctx, epoch, generation)
+		if err != nil {
+			if ctx.Err() == nil {
+				level.Error(c.l).Log("op", "pollConfig", "error", err, "msg", "failed to fetch config from the controller, retrying")
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		if snapshot == nil {
+			continue
+		}
+		epoch, generation = snapshot.Epoch, snapshot.Generation
+		level.Info(c.l).Log("event", "configReceived", "epoch", epoch, "generation", generation, "msg", "received new config generation from the controller")
+		push(generation, snapshot.Data, func(err error) {
+			c.ack(ctx, snapshot.Epoch, snapshot.Generation, err)
+		})
+	}
+}
+
+// poll returns the first generation of the config after generation of
+// epoch, nil if there was none before the poll timed out.
+func (c *Client) poll(ctx context.Context, epoch string, generation uint64) (*Snapshot, error) {
+	q := url.Values{
+		"node":  {c.node},
+		"epoch": {epoch},
+		"after": {strconv.FormatUint(generation, 10)},
+	}
+	req, err := http.NewRequest(http.MethodGet, c.server+configPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("controller returned status %s", resp.Status)
+	}
+	var ret Snapshot
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("decoding config: %s", err)
+	}
+	return &ret, nil
+}
+
+// ack acknowledges generation of epoch to the controller. Failed acks
+// aren't retried, the next generation's will do.
+func (c *Client) ack(ctx context.Context, epoch string, generation uint64, cfgErr error) {
+	ack := Ack{Node: c.node, Epoch: epoch, Generation: generation}
+	if cfgErr != nil {
+		ack.Error = cfgErr.Error()
+	}
+	bs, err := json.Marshal(ack)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, c.server+ackPath, bytes.NewReader(bs))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.do(req.WithContext(ctx))
+	if err != nil {
+		level.Error(c.l).Log("op", "ackConfig", "error", err, "generation", generation, "msg", "failed to acknowledge config")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		level.Error(c.l).Log("op", "ackConfig", "error", resp.Status, "generation", generation, "msg", "controller refused the config acknowledgement")
+	}
+}
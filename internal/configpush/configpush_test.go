@@ -0,0 +1,281 @@
+package configpush
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// testAuth authenticates the token of node1's speaker.
+func testAuth(ctx context.Context, token string) (string, error) {
+	if token != "node1-token" {
+		return "", errors.New("unknown token")
+	}
+	return "node1", nil
+}
+
+func TestPush(t *testing.T) {
+	s := NewServer(log.NewNopLogger())
+	s.auth = testAuth
+	srv := httptest.NewTLSServer(s)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "configpush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(token, []byte("node1-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Publish(map[string]string{"config": "a"})
+	// Publishing the same data again is not a new generation.
+	s.Publish(map[string]string{"config": "a"})
+
+	type push struct {
+		generation uint64
+		data       string
+	}
+	pushes := make(chan push)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c, err := NewClient(log.NewNopLogger(), srv.URL, "node1", token, srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatalf("NewClient: %s", err)
+	}
+	go c.Run(func(generation uint64, data map[string]string, ack func(error)) {
+		if data["config"] == "b" {
+			ack(errors.New("invalid"))
+		} else {
+			ack(nil)
+		}
+		pushes <- push{generation, data["config"]}
+	}, stopCh)
+
+	wait := func(want push) {
+		t.Helper()
+		select {
+		case got := <-pushes:
+			if got != want {
+				t.Fatalf("got push %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for push %v", want)
+		}
+	}
+	wait(push{1, "a"})
+
+	// The poll waits for the next generation.
+	s.Publish(map[string]string{"config": "b"})
+	wait(push{2, "b"})
+
+	s.mu.Lock()
+	ack := s.acks["node1"]
+	s.mu.Unlock()
+	if ack.Generation != 2 || ack.Error != "invalid" {
+		t.Fatalf("got ack %+v, want generation 2 rejected", ack)
+	}
+
+	// A speaker that stopped polling, e.g. because its node left,
+	// no longer counts.
+	s.mu.Lock()
+	s.seen["node2"] = time.Now().Add(-2 * ackExpiry)
+	s.acks["node2"] = Ack{Node: "node2", Epoch: s.snapshot.Epoch, Generation: 2}
+	s.updateAcks()
+	_, ok := s.acks["node2"]
+	s.mu.Unlock()
+	if ok {
+		t.Fatal("kept the ack of a speaker that stopped polling")
+	}
+}
+
+// restartableServer serves with the Server of the current controller
+// process.
+type restartableServer struct {
+	mu sync.Mutex
+	s  *Server
+}
+
+func (r *restartableServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	s := r.s
+	r.mu.Unlock()
+	s.ServeHTTP(w, req)
+}
+
+func (r *restartableServer) restart() *Server {
+	s := NewServer(log.NewNopLogger())
+	s.auth = testAuth
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.s = s
+	return s
+}
+
+func TestServerRestart(t *testing.T) {
+	r := &restartableServer{}
+	s := r.restart()
+	srv := httptest.NewTLSServer(r)
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "configpush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(token, []byte("node1-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Publish(map[string]string{"config": "a"})
+	s.Publish(map[string]string{"config": "b"})
+
+	type push struct {
+		generation uint64
+		data       string
+	}
+	pushes := make(chan push)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c, err := NewClient(log.NewNopLogger(), srv.URL, "node1", token, srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	if err != nil {
+		t.Fatalf("NewClient: %s", err)
+	}
+	go c.Run(func(generation uint64, data map[string]string, ack func(error)) {
+		ack(nil)
+		pushes <- push{generation, data["config"]}
+	}, stopCh)
+
+	wait := func(want push) {
+		t.Helper()
+		select {
+		case got := <-pushes:
+			if got != want {
+				t.Fatalf("got push %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for push %v", want)
+		}
+	}
+	wait(push{2, "b"})
+
+	// The restarted controller numbers its configs from 1 again, the
+	// speaker still takes them.
+	s = r.restart()
+	s.Publish(map[string]string{"config": "c"})
+	// Wake up the poll waiting on the old server.
+	srv.CloseClientConnections()
+	wait(push{1, "c"})
+
+	s.mu.Lock()
+	ack := s.acks["node1"]
+	s.mu.Unlock()
+	if ack.Epoch != s.snapshot.Epoch || ack.Generation != 1 {
+		t.Fatalf("got ack %+v, want generation 1 of the new epoch", ack)
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	s := NewServer(log.NewNopLogger())
+	s.auth = testAuth
+	s.Publish(map[string]string{"config": "password: secret"})
+	srv := httptest.NewTLSServer(s)
+	defer srv.Close()
+
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{
+			desc:   "config without token",
+			method: http.MethodGet,
+			path:   configPath,
+			want:   http.StatusUnauthorized,
+		},
+		{
+			desc:   "config with unknown token",
+			method: http.MethodGet,
+			path:   configPath,
+			token:  "other",
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "config",
+			method: http.MethodGet,
+			path:   configPath,
+			token:  "node1-token",
+			want:   http.StatusOK,
+		},
+		{
+			desc:   "config for another node",
+			method: http.MethodGet,
+			path:   configPath + "?node=node2",
+			token:  "node1-token",
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "ack without token",
+			method: http.MethodPost,
+			path:   ackPath,
+			body:   `{"node": "node1", "generation": 1}`,
+			want:   http.StatusUnauthorized,
+		},
+		{
+			desc:   "ack for another node",
+			method: http.MethodPost,
+			path:   ackPath,
+			token:  "node1-token",
+			body:   `{"node": "node2", "generation": 1}`,
+			want:   http.StatusForbidden,
+		},
+		{
+			desc:   "ack",
+			method: http.MethodPost,
+			path:   ackPath,
+			token:  "node1-token",
+			body:   `{"node": "node1", "generation": 1}`,
+			want:   http.StatusNoContent,
+		},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, srv.URL+test.path, bytes.NewReader([]byte(test.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: %s", test.desc, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: got status %d, want %d", test.desc, resp.StatusCode, test.want)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.acks["node2"]; ok {
+		t.Error("recorded a forged ack")
+	}
+
+	if _, err := NewClient(log.NewNopLogger(), "http://controller:7473", "node1", "token", nil); err == nil {
+		t.Error("created a client of a plain HTTP server")
+	}
+}
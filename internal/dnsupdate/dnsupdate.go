@@ -0,0 +1,165 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dnsupdate publishes address records with RFC 2136 dynamic
+// DNS updates.
+package dnsupdate // import "go.universe.tf/metallb/internal/dnsupdate"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Config is the configuration of a Client.
+type Config struct {
+	// Server is the host:port of the primary DNS server of Zone.
+	Server string
+	// Zone holds the records.
+	Zone string
+	// TTL of the records.
+	TTL time.Duration
+	// TSIG key used to sign updates. If KeyName is empty, updates
+	// are not signed.
+	KeyName   string
+	Algorithm string
+	// Base64 encoded secret of the TSIG key.
+	Secret string
+	// Timeout of an update.
+	Timeout time.Duration
+}
+
+// Client sends dynamic DNS updates for a zone.
+type Client struct {
+	cfg    Config
+	client *dns.Client
+}
+
+// New returns a Client for cfg.
+func New(cfg Config) (*Client, error) {
+	if cfg.Server == "" {
+		return nil, errors.New("missing DNS server")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		cfg.Server = net.JoinHostPort(cfg.Server, "53")
+	}
+	if cfg.Zone == "" {
+		return nil, errors.New("missing DNS zone")
+	}
+	cfg.Zone = canonical(cfg.Zone)
+	if cfg.TTL <= 0 {
+		cfg.TTL = 5 * time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	c := &Client{
+		cfg:    cfg,
+		client: &dns.Client{Net: "tcp", Timeout: cfg.Timeout},
+	}
+	if cfg.KeyName != "" {
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("missing secret for TSIG key %q", cfg.KeyName)
+		}
+		c.cfg.KeyName = canonical(cfg.KeyName)
+		switch strings.ToLower(cfg.Algorithm) {
+		case "", "hmac-sha256":
+			c.cfg.Algorithm = dns.HmacSHA256
+		case "hmac-sha512":
+			c.cfg.Algorithm = dns.HmacSHA512
+		case "hmac-sha1":
+			c.cfg.Algorithm = dns.HmacSHA1
+		case "hmac-md5":
+			c.cfg.Algorithm = dns.HmacMD5
+		default:
+			return nil, fmt.Errorf("unsupported TSIG algorithm %q", cfg.Algorithm)
+		}
+		c.client.TsigSecret = map[string]string{c.cfg.KeyName: cfg.Secret}
+	}
+	return c, nil
+}
+
+// Zone returns the zone of the client, as a fully qualified name.
+func (c *Client) Zone() string {
+	return c.cfg.Zone
+}
+
+// Set replaces the address records of name with ip.
+func (c *Client) Set(name string, ip net.IP) error {
+	rr, err := c.record(name, ip)
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(c.cfg.Zone)
+	m.RemoveRRset([]dns.RR{rr})
+	m.Insert([]dns.RR{rr})
+	return c.send(m)
+}
+
+// Delete removes the address record of name pointing to ip, if any.
+func (c *Client) Delete(name string, ip net.IP) error {
+	rr, err := c.record(name, ip)
+	if err != nil {
+		return err
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(c.cfg.Zone)
+	m.Remove([]dns.RR{rr})
+	return c.send(m)
+}
+
+// record returns the A or AAAA record of name pointing to ip.
+func (c *Client) record(name string, ip net.IP) (dns.RR, error) {
+	name = canonical(name)
+	if !dns.IsSubDomain(c.cfg.Zone, name) {
+		return nil, fmt.Errorf("%q is not in zone %q", name, c.cfg.Zone)
+	}
+	hdr := dns.RR_Header{
+		Name:  name,
+		Class: dns.ClassINET,
+		Ttl:   uint32(c.cfg.TTL / time.Second),
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip4}, nil
+	}
+	if ip.To16() == nil {
+		return nil, fmt.Errorf("invalid IP %q", ip)
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+}
+
+func (c *Client) send(m *dns.Msg) error {
+	if c.cfg.KeyName != "" {
+		m.SetTsig(c.cfg.KeyName, c.cfg.Algorithm, 300, time.Now().Unix())
+	}
+	resp, _, err := c.client.Exchange(m, c.cfg.Server)
+	if err != nil {
+		return fmt.Errorf("sending DNS update to %s: %s", c.cfg.Server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update rejected by %s: %s", c.cfg.Server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// canonical returns name as a lowercase fully qualified name.
+func canonical(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
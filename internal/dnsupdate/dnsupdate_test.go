@@ -0,0 +1,140 @@
+package dnsupdate
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testSecret = "so6ZGir4GPAqINNh9U5c3A=="
+
+// testServer runs a DNS server on localhost that records the updates
+// it receives, and rejects the ones without a valid signature.
+func testServer(t *testing.T) (string, chan *dns.Msg) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	updates := make(chan *dns.Msg, 10)
+	srv := &dns.Server{
+		Listener:   l,
+		TsigSecret: map[string]string{"metallb.": testSecret},
+		// The default rejects updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			if req.IsTsig() == nil || w.TsigStatus() != nil {
+				resp.Rcode = dns.RcodeRefused
+			} else {
+				resp.SetTsig("metallb.", dns.HmacSHA256, 300, time.Now().Unix())
+				updates <- req
+			}
+			w.WriteMsg(resp)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return l.Addr().String(), updates
+}
+
+func TestUpdates(t *testing.T) {
+	addr, updates := testServer(t)
+	c, err := New(Config{
+		Server:  addr,
+		Zone:    "LB.Example.com",
+		TTL:     time.Minute,
+		KeyName: "metallb",
+		Secret:  testSecret,
+	})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	if err := c.Set("web.default.lb.example.com", net.ParseIP("192.168.1.1")); err != nil {
+		t.Fatalf("Set: %s", err)
+	}
+	m := <-updates
+	if m.Question[0].Name != "lb.example.com." {
+		t.Errorf("update for zone %q, want %q", m.Question[0].Name, "lb.example.com.")
+	}
+	if len(m.Ns) != 2 {
+		t.Fatalf("got %d update records, want 2: %v", len(m.Ns), m.Ns)
+	}
+	if m.Ns[0].Header().Class != dns.ClassANY || m.Ns[0].Header().Rrtype != dns.TypeA {
+		t.Errorf("first record doesn't delete the A RRset: %s", m.Ns[0])
+	}
+	a, ok := m.Ns[1].(*dns.A)
+	if !ok || a.Hdr.Name != "web.default.lb.example.com." || !a.A.Equal(net.ParseIP("192.168.1.1")) || a.Hdr.Ttl != 60 {
+		t.Errorf("wrong record added: %s", m.Ns[1])
+	}
+
+	if err := c.Delete("web.default.lb.example.com", net.ParseIP("2001:db8::1")); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	m = <-updates
+	if len(m.Ns) != 1 {
+		t.Fatalf("got %d update records, want 1: %v", len(m.Ns), m.Ns)
+	}
+	aaaa, ok := m.Ns[0].(*dns.AAAA)
+	if !ok || aaaa.Hdr.Class != dns.ClassNONE || !aaaa.AAAA.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("wrong record deleted: %s", m.Ns[0])
+	}
+
+	if err := c.Set("web.example.org", net.ParseIP("192.168.1.1")); err == nil {
+		t.Error("updating a name outside of the zone didn't fail")
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	addr, _ := testServer(t)
+	c, err := New(Config{
+		Server: addr,
+		Zone:   "lb.example.com",
+	})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if err := c.Set("web.default.lb.example.com", net.ParseIP("192.168.1.1")); err == nil {
+		t.Error("unsigned update accepted by a server that requires TSIG")
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		desc string
+		cfg  Config
+	}{
+		{
+			desc: "no server",
+			cfg:  Config{Zone: "lb.example.com"},
+		},
+		{
+			desc: "no zone",
+			cfg:  Config{Server: "192.168.1.53"},
+		},
+		{
+			desc: "no secret",
+			cfg:  Config{Server: "192.168.1.53", Zone: "lb.example.com", KeyName: "metallb"},
+		},
+		{
+			desc: "bad algorithm",
+			cfg:  Config{Server: "192.168.1.53", Zone: "lb.example.com", KeyName: "metallb", Secret: testSecret, Algorithm: "rot13"},
+		},
+	}
+	for _, test := range tests {
+		if _, err := New(test.cfg); err == nil {
+			t.Errorf("%s: New didn't fail", test.desc)
+		}
+	}
+
+	c, err := New(Config{Server: "192.168.1.53", Zone: "lb.example.com"})
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if c.cfg.Server != "192.168.1.53:53" {
+		t.Errorf("server without port not defaulted to port 53: %q", c.cfg.Server)
+	}
+}
@@ -0,0 +1,15 @@
+package k8s
+
+import v1 "k8s.io/api/core/v1"
+
+// loadBalancerClassAnnotation holds the load balancer class of a
+// service. The vendored Kubernetes API predates
+// spec.loadBalancerClass, so the class is read from this annotation
+// instead.
+const loadBalancerClassAnnotation = "metallb.universe.tf/loadbalancer-class"
+
+// LoadBalancerClass returns the load balancer class of svc, "" if it
+// doesn't request one.
+func LoadBalancerClass(svc *v1.Service) string {
+	return svc.Annotations[loadBalancerClassAnnotation]
+}
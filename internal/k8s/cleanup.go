@@ -0,0 +1,42 @@
+package k8s
+
+import (
+	"context"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ManagedServices returns the services of the load balancer class
+// lbClass whose status was written by this process.
+func (c *Client) ManagedServices(lbClass string) ([]*v1.Service, error) {
+	svcs, err := c.client.CoreV1().Services("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var ret []*v1.Service
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if LoadBalancerClass(svc) != lbClass {
+			continue
+		}
+		for _, f := range svc.ManagedFields {
+			if f.Manager == c.fieldManager {
+				ret = append(ret, svc)
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// ReleaseService removes the load balancer status and the conditions
+// this process set on svc.
+func (c *Client) ReleaseService(svc *v1.Service) error {
+	return c.applyStatus(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+		},
+	}, "")
+}
@@ -0,0 +1,75 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// configStatusAnnotation records on the config ConfigMap whether
+	// its content was accepted.
+	configStatusAnnotation = "metallb.universe.tf/config-status"
+	// configErrorAnnotation records why the config was rejected.
+	configErrorAnnotation = "metallb.universe.tf/config-error"
+)
+
+// configStatusAnnotations returns the status annotations describing
+// cfgErr, the error of the last config load, nil if it succeeded.
+func configStatusAnnotations(cfgErr error) map[string]string {
+	if cfgErr == nil {
+		return map[string]string{
+			configStatusAnnotation: "Accepted",
+		}
+	}
+	return map[string]string{
+		configStatusAnnotation: "Rejected",
+		configErrorAnnotation:  cfgErr.Error(),
+	}
+}
+
+// reportConfigStatus records on cm whether its config was accepted,
+// if the client was asked to. The ConfigMap is only written if the
+// recorded status changed, so that the update it triggers is a no-op.
+func (c *Client) reportConfigStatus(l log.Logger, cm *v1.ConfigMap, cfgErr error) {
+	if !c.reportConfig {
+		return
+	}
+	annotations := configStatusAnnotations(cfgErr)
+	if cm.Annotations[configStatusAnnotation] == annotations[configStatusAnnotation] && cm.Annotations[configErrorAnnotation] == annotations[configErrorAnnotation] {
+		return
+	}
+	if cfgErr != nil {
+		c.events.Eventf(cm, v1.EventTypeWarning, "ConfigRejected", "Configuration rejected: %s", cfgErr)
+	}
+
+	patch := &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        cm.Name,
+			Namespace:   cm.Namespace,
+			Annotations: annotations,
+		},
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		level.Error(l).Log("bug", "true", "error", err, "msg", "failed to serialize config status")
+		return
+	}
+	force := true
+	if _, err = c.client.CoreV1().ConfigMaps(cm.Namespace).Patch(context.TODO(), cm.Name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	}); err != nil {
+		level.Error(l).Log("op", "reportConfigStatus", "error", err, "msg", "failed to record config status")
+		updateErrors.Inc()
+	}
+}
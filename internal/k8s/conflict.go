@@ -0,0 +1,54 @@
+package k8s
+
+import (
+	"encoding/json"
+	"net"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ingressFields is the fieldsV1 form of status.loadBalancer.ingress.
+var ingressFields = []byte(`{"f:status":{"f:loadBalancer":{"f:ingress":{}}}}`)
+
+// ingressManager returns f, without the fields other than
+// status.loadBalancer.ingress, if f manages it, nil otherwise. The
+// service cache only keeps these entries, to detect other controllers
+// writing the status.
+func ingressManager(f metav1.ManagedFieldsEntry) *metav1.ManagedFieldsEntry {
+	if f.FieldsV1 == nil {
+		return nil
+	}
+	var fields struct {
+		Status struct {
+			LoadBalancer struct {
+				Ingress json.RawMessage `json:"f:ingress"`
+			} `json:"f:loadBalancer"`
+		} `json:"f:status"`
+	}
+	if err := json.Unmarshal(f.FieldsV1.Raw, &fields); err != nil || fields.Status.LoadBalancer.Ingress == nil {
+		return nil
+	}
+	f.FieldsV1 = &metav1.FieldsV1{Raw: ingressFields}
+	return &f
+}
+
+// StatusConflict returns a field manager other than self, the field
+// manager of this process, that manages the ingress status of svc
+// while it holds an IP other than ours, "" if there is none. Writers
+// that take the status over with an update rather than an apply
+// leave self without the ingress fields, so whether self still
+// manages them doesn't matter. It only considers the managedFields
+// entries the service cache keeps.
+func StatusConflict(svc *v1.Service, self string, ours net.IP) string {
+	ip := LoadBalancerIP(svc)
+	if ip == nil || ip.Equal(ours) {
+		return ""
+	}
+	for _, f := range svc.ManagedFields {
+		if f.Manager != self && ingressManager(f) != nil {
+			return f.Manager
+		}
+	}
+	return ""
+}
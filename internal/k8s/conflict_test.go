@@ -0,0 +1,96 @@
+package k8s
+
+import (
+	"net"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStatusConflict(t *testing.T) {
+	entry := func(manager string, op metav1.ManagedFieldsOperationType, fields string) metav1.ManagedFieldsEntry {
+		return metav1.ManagedFieldsEntry{
+			Manager:    manager,
+			Operation:  op,
+			APIVersion: "v1",
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+		}
+	}
+	var (
+		spec = entry("kubectl-client-side-apply", metav1.ManagedFieldsOperationUpdate,
+			`{"f:metadata":{"f:annotations":{".":{},"f:kubectl.kubernetes.io/last-applied-configuration":{}}},"f:spec":{"f:ports":{".":{},"k:{\"port\":80,\"protocol\":\"TCP\"}":{".":{},"f:port":{},"f:protocol":{}}},"f:type":{}}}`)
+		ours = entry("metallb-controller", metav1.ManagedFieldsOperationApply,
+			`{"f:status":{"f:loadBalancer":{"f:ingress":{}}}}`)
+		// After an update that overwrote the ingress, our apply only
+		// keeps the conditions.
+		oursOverwritten = entry("metallb-controller", metav1.ManagedFieldsOperationApply,
+			`{"f:status":{"f:conditions":{".":{},"k:{\"type\":\"metallb.universe.tf/ExtraPrefixesReserved\"}":{".":{},"f:type":{}}}}}`)
+		other = entry("other-lb", metav1.ManagedFieldsOperationUpdate,
+			`{"f:status":{"f:loadBalancer":{"f:ingress":{}}}}`)
+	)
+
+	tests := []struct {
+		desc   string
+		fields []metav1.ManagedFieldsEntry
+		ip     string
+		ours   net.IP
+		want   string
+	}{
+		{
+			desc:   "our status",
+			fields: []metav1.ManagedFieldsEntry{spec, ours},
+			ip:     "10.20.0.1",
+			ours:   net.ParseIP("10.20.0.1"),
+		},
+		{
+			desc:   "co-owned status",
+			fields: []metav1.ManagedFieldsEntry{spec, ours, other},
+			ip:     "10.20.0.1",
+			ours:   net.ParseIP("10.20.0.1"),
+		},
+		{
+			desc:   "overwritten by an update",
+			fields: []metav1.ManagedFieldsEntry{spec, oursOverwritten, other},
+			ip:     "10.30.0.1",
+			ours:   net.ParseIP("10.20.0.1"),
+			want:   "other-lb",
+		},
+		{
+			desc:   "overwritten while we still own the ingress",
+			fields: []metav1.ManagedFieldsEntry{spec, ours, other},
+			ip:     "10.30.0.1",
+			ours:   net.ParseIP("10.20.0.1"),
+			want:   "other-lb",
+		},
+		{
+			desc:   "overwritten, our IP released",
+			fields: []metav1.ManagedFieldsEntry{spec, other},
+			ip:     "10.30.0.1",
+			want:   "other-lb",
+		},
+		{
+			desc:   "status cleared",
+			fields: []metav1.ManagedFieldsEntry{spec},
+		},
+	}
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "web"},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+		}
+		if test.ip != "" {
+			svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: test.ip}}
+		}
+		// Like the service cache does.
+		for _, f := range test.fields {
+			if k := ingressManager(f); k != nil {
+				svc.ManagedFields = append(svc.ManagedFields, *k)
+			}
+		}
+		if got := StatusConflict(svc, "metallb-controller", test.ours); got != test.want {
+			t.Errorf("%s: got conflict with %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
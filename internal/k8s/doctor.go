@@ -0,0 +1,40 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+
+	"go.universe.tf/metallb/internal/config"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Config reads and parses the MetalLB configuration in the ConfigMap
+// namespace/name, like Run does.
+func (c *Client) Config(namespace, name string) (*config.Config, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return config.ParseWithExpansions([]byte(cm.Data["config"]), poolExpansions(cm.Data))
+}
+
+// Node returns the node name.
+func (c *Client) Node(name string) (*v1.Node, error) {
+	return c.client.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// KubeProxyConfig returns the configuration file of kube-proxy, as
+// deployed by kubeadm.
+func (c *Client) KubeProxyConfig() (string, error) {
+	cm, err := c.client.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), "kube-proxy", metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	conf, ok := cm.Data["config.conf"]
+	if !ok {
+		return "", fmt.Errorf("no config.conf in kube-system/kube-proxy")
+	}
+	return conf, nil
+}
@@ -27,3 +27,19 @@ func IsConditionReady(conditions discovery.EndpointConditions) bool {
 	}
 	return *conditions.Ready
 }
+
+// IsConditionServing tells if the conditions represent an endpoint able to
+// serve traffic, even while terminating. Clusters that don't report serving
+// leave it nil, in which case it is the same as ready.
+func IsConditionServing(conditions discovery.EndpointConditions) bool {
+	if conditions.Serving == nil {
+		return IsConditionReady(conditions)
+	}
+	return *conditions.Serving
+}
+
+// IsConditionTerminating tells if the conditions represent a terminating
+// endpoint, interpreting nil terminating as not terminating.
+func IsConditionTerminating(conditions discovery.EndpointConditions) bool {
+	return conditions.Terminating != nil && *conditions.Terminating
+}
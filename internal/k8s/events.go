@@ -0,0 +1,109 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// eventKey identifies identical events about a service.
+type eventKey struct {
+	svc     string
+	typ     string
+	reason  string
+	message string
+}
+
+type sentEvent struct {
+	at time.Time
+	// Repeats of the event suppressed since it was last sent.
+	suppressed int
+}
+
+// eventThrottle suppresses the repeats of an event about a service
+// within an interval of when it was last sent. Services stuck in the
+// same state, e.g. waiting for an IP, would otherwise produce the
+// same event every time they are reprocessed. A different event about
+// the service ends the repeats, so that a service going back to a
+// previous state, e.g. failing again after an allocation, reports it.
+type eventThrottle struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	sent map[eventKey]*sentEvent
+	// The last event recorded about each service.
+	last      map[string]eventKey
+	lastSweep time.Time
+}
+
+func newEventThrottle(interval time.Duration) *eventThrottle {
+	return &eventThrottle{
+		interval: interval,
+		sent:     map[eventKey]*sentEvent{},
+		last:     map[string]eventKey{},
+	}
+}
+
+// allow returns whether the event k can be sent at now, and if so,
+// how many of its repeats were suppressed since it was last sent.
+func (t *eventThrottle) allow(k eventKey, now time.Time) (bool, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Forget the events that weren't sent for a while, so that the
+	// events of deleted services don't pile up.
+	if now.Sub(t.lastSweep) >= t.interval {
+		for k, e := range t.sent {
+			if now.Sub(e.at) >= 2*t.interval {
+				delete(t.sent, k)
+			}
+		}
+		for svc, k := range t.last {
+			if t.sent[k] == nil {
+				delete(t.last, svc)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	if prev, ok := t.last[k.svc]; ok && prev != k {
+		delete(t.sent, prev)
+	}
+	t.last[k.svc] = k
+
+	e := t.sent[k]
+	if e == nil {
+		t.sent[k] = &sentEvent{at: now}
+		return true, 0
+	}
+	if now.Sub(e.at) < t.interval {
+		e.suppressed++
+		eventsSuppressed.WithLabelValues(k.reason).Inc()
+		return false, 0
+	}
+	suppressed := e.suppressed
+	e.at, e.suppressed = now, 0
+	return true, suppressed
+}
+
+// event sends an event about svc, with annotations if any, unless
+// the throttle suppresses it.
+func (c *Client) event(svc *v1.Service, annotations map[string]string, typ, reason, msg string, args ...interface{}) {
+	msg = fmt.Sprintf(msg, args...)
+	if c.eventThrottle != nil {
+		ok, suppressed := c.eventThrottle.allow(eventKey{svc.Namespace + "/" + svc.Name, typ, reason, msg}, time.Now())
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			msg = fmt.Sprintf("%s (%d identical events suppressed)", msg, suppressed)
+		}
+	}
+	if len(annotations) > 0 {
+		c.events.AnnotatedEventf(svc, annotations, typ, reason, "%s", msg)
+		return
+	}
+	c.events.Event(svc, typ, reason, msg)
+}
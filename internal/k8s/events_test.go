@@ -0,0 +1,86 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventThrottle(t *testing.T) {
+	start := time.Now()
+	throttle := newEventThrottle(time.Minute)
+	failed := eventKey{"ns/svc", "Warning", "AllocationFailed", "no available IPs"}
+	allocated := eventKey{"ns/svc", "Normal", "IPAllocated", "Assigned IP"}
+	other := eventKey{"ns/other", "Warning", "AllocationFailed", "no available IPs"}
+
+	tests := []struct {
+		desc           string
+		k              eventKey
+		after          time.Duration
+		want           bool
+		wantSuppressed int
+	}{
+		{
+			desc: "first event",
+			k:    failed,
+			want: true,
+		},
+		{
+			desc:  "repeat within the interval",
+			k:     failed,
+			after: 10 * time.Second,
+		},
+		{
+			desc:  "another repeat",
+			k:     failed,
+			after: 20 * time.Second,
+		},
+		{
+			desc:  "same event of another service",
+			k:     other,
+			after: 20 * time.Second,
+			want:  true,
+		},
+		{
+			desc:           "repeat after the interval",
+			k:              failed,
+			after:          time.Minute,
+			want:           true,
+			wantSuppressed: 2,
+		},
+		{
+			desc:  "different event",
+			k:     allocated,
+			after: time.Minute + 10*time.Second,
+			want:  true,
+		},
+		{
+			desc:  "back to the previous event",
+			k:     failed,
+			after: time.Minute + 20*time.Second,
+			want:  true,
+		},
+		{
+			desc:  "repeat of the previous event",
+			k:     failed,
+			after: time.Minute + 30*time.Second,
+		},
+		{
+			desc:  "back to the other event",
+			k:     allocated,
+			after: time.Minute + 40*time.Second,
+			want:  true,
+		},
+	}
+	for _, test := range tests {
+		got, suppressed := throttle.allow(test.k, start.Add(test.after))
+		if got != test.want || suppressed != test.wantSuppressed {
+			t.Errorf("%s: got %v, %d suppressed, want %v, %d suppressed", test.desc, got, suppressed, test.want, test.wantSuppressed)
+		}
+	}
+
+	// Old events are forgotten.
+	throttle.allow(allocated, start.Add(10*time.Minute))
+	if len(throttle.sent) != 1 || len(throttle.last) != 1 {
+		t.Errorf("old events not forgotten: %d events, %d services", len(throttle.sent), len(throttle.last))
+	}
+}
@@ -0,0 +1,38 @@
+package k8s
+
+import "strings"
+
+// poolExpansionKeyPrefix starts the keys of the config ConfigMap that
+// hold extra addresses for a pool, provisioned by an external system
+// when the pool was about to run out.
+const poolExpansionKeyPrefix = "expansion."
+
+// PoolExpansionKey returns the key of the config ConfigMap that holds
+// the extra addresses of pool.
+func PoolExpansionKey(pool string) string {
+	return poolExpansionKeyPrefix + pool
+}
+
+// poolExpansions returns the extra addresses of each pool found in
+// the data of the config ConfigMap. Addresses are separated by
+// whitespace or commas.
+func poolExpansions(data map[string]string) map[string][]string {
+	var ret map[string][]string
+	for k, v := range data {
+		if !strings.HasPrefix(k, poolExpansionKeyPrefix) {
+			continue
+		}
+		addrs := strings.FieldsFunc(v, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+		})
+		if len(addrs) == 0 {
+			continue
+		}
+		if ret == nil {
+			ret = map[string][]string{}
+		}
+		pool := strings.TrimPrefix(k, poolExpansionKeyPrefix)
+		ret[pool] = append(ret[pool], addrs...)
+	}
+	return ret
+}
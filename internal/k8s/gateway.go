@@ -0,0 +1,175 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+var gatewayResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1alpha1",
+	Resource: "gateways",
+}
+
+// Gateway is the subset of a Gateway API Gateway that MetalLB acts
+// on.
+type Gateway struct {
+	Namespace   string
+	Name        string
+	Annotations map[string]string
+	// Addresses requested in the Gateway's spec. MetalLB only
+	// allocates addresses to Gateways that request none.
+	SpecAddresses []string
+	// IP addresses currently published in the Gateway's status.
+	Addresses []string
+}
+
+type gwKey string
+
+// watchGateways sets up the informer for the Gateway API Gateways of
+// classes.
+func (c *Client) watchGateways(classes []string, gatewayChanged func(log.Logger, string, *Gateway) SyncState) {
+	gwHandlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(gwKey(key))
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(gwKey(key))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(gwKey(key))
+			}
+		},
+	}
+	gwWatcher := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return c.dynamic.Resource(gatewayResource).Namespace(v1.NamespaceAll).List(context.TODO(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return c.dynamic.Resource(gatewayResource).Namespace(v1.NamespaceAll).Watch(context.TODO(), opts)
+		},
+	}
+	c.gwIndexer, c.gwInformer = cache.NewIndexerInformer(stripManagedFields(gwWatcher), &unstructured.Unstructured{}, 0, gwHandlers, cache.Indexers{})
+
+	c.gatewayClasses = map[string]bool{}
+	for _, class := range classes {
+		c.gatewayClasses[class] = true
+	}
+	c.gatewayChanged = gatewayChanged
+	c.syncFuncs = append(c.syncFuncs, c.gwInformer.HasSynced)
+}
+
+// gatewayClass returns the class of u, a Gateway, "" if it has none.
+func gatewayClass(u *unstructured.Unstructured) string {
+	class, _, _ := unstructured.NestedString(u.Object, "spec", "gatewayClassName")
+	return class
+}
+
+// parseGateway extracts the fields MetalLB needs from a Gateway.
+func parseGateway(u *unstructured.Unstructured) (*Gateway, error) {
+	ret := &Gateway{
+		Namespace:   u.GetNamespace(),
+		Name:        u.GetName(),
+		Annotations: u.GetAnnotations(),
+	}
+
+	addrs, err := gatewayAddresses(u, "spec", "addresses")
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ret.SpecAddresses = append(ret.SpecAddresses, a.Value)
+	}
+
+	addrs, err = gatewayAddresses(u, "status", "addresses")
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if a.Type == "" || a.Type == "IPAddress" {
+			ret.Addresses = append(ret.Addresses, a.Value)
+		}
+	}
+
+	return ret, nil
+}
+
+type gatewayAddress struct {
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value"`
+}
+
+func gatewayAddresses(u *unstructured.Unstructured, fields ...string) ([]gatewayAddress, error) {
+	raw, found, err := unstructured.NestedSlice(u.Object, fields...)
+	if err != nil || !found {
+		return nil, err
+	}
+	var ret []gatewayAddress
+	for _, r := range raw {
+		m, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("malformed address %v", r)
+		}
+		t, _ := m["type"].(string)
+		v, _ := m["value"].(string)
+		ret = append(ret, gatewayAddress{Type: t, Value: v})
+	}
+	return ret, nil
+}
+
+// UpdateGatewayStatus publishes ips as the addresses of the
+// Gateway. An empty ips clears the addresses MetalLB set.
+func (c *Client) UpdateGatewayStatus(gw *Gateway, ips []string) error {
+	type status struct {
+		Addresses []gatewayAddress `json:"addresses"`
+	}
+	patch := struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Metadata   metav1.ObjectMeta `json:"metadata"`
+		Status     status            `json:"status"`
+	}{
+		APIVersion: gatewayResource.GroupVersion().String(),
+		Kind:       "Gateway",
+		Metadata: metav1.ObjectMeta{
+			Namespace: gw.Namespace,
+			Name:      gw.Name,
+		},
+		Status: status{
+			Addresses: []gatewayAddress{},
+		},
+	}
+	for _, ip := range ips {
+		patch.Status.Addresses = append(patch.Status.Addresses, gatewayAddress{Type: "IPAddress", Value: ip})
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.dynamic.Resource(gatewayResource).Namespace(gw.Namespace).Patch(context.TODO(), gw.Name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	}, "status")
+	return err
+}
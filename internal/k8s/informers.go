@@ -0,0 +1,156 @@
+package k8s
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// stripManagedFields wraps lw so that the objects it lists and
+// watches lose their managedFields before the informer caches them.
+// Nothing here reads them, and on clusters with many services and
+// endpoints they are often the bulk of the cache.
+func stripManagedFields(lw cache.ListerWatcher) cache.ListerWatcher {
+	return stripManagedFieldsExcept(lw, nil)
+}
+
+// stripManagedFieldsExcept is stripManagedFields, except that the
+// objects keep the managedFields entries that keep, if non-nil,
+// returns a replacement for.
+func stripManagedFieldsExcept(lw cache.ListerWatcher, keep func(metav1.ManagedFieldsEntry) *metav1.ManagedFieldsEntry) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			list, err := lw.List(opts)
+			if err != nil {
+				return nil, err
+			}
+			// The items of typed lists point into the list, so this
+			// strips the list in place.
+			items, err := meta.ExtractList(list)
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range items {
+				stripObject(obj, keep)
+			}
+			return list, nil
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.Watch(opts)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				stripObject(e.Object, keep)
+				return e, true
+			}), nil
+		},
+	}
+}
+
+func stripObject(obj runtime.Object, keep func(metav1.ManagedFieldsEntry) *metav1.ManagedFieldsEntry) {
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	var kept []metav1.ManagedFieldsEntry
+	if keep != nil {
+		for _, f := range m.GetManagedFields() {
+			if k := keep(f); k != nil {
+				kept = append(kept, *k)
+			}
+		}
+	}
+	m.SetManagedFields(kept)
+}
+
+// filterObjects wraps lw so that the informer only caches the objects
+// that keep returns true for. An object that stops being kept is
+// deleted from the cache, and the informer's handlers see it as
+// deleted.
+func filterObjects(lw cache.ListerWatcher, keep func(runtime.Object) bool) cache.ListerWatcher {
+	var (
+		mu sync.Mutex
+		// Keys of the objects the informer has cached.
+		cached = map[string]bool{}
+	)
+	return &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			list, err := lw.List(opts)
+			if err != nil {
+				return nil, err
+			}
+			items, err := meta.ExtractList(list)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			cached = map[string]bool{}
+			kept := make([]runtime.Object, 0, len(items))
+			for _, obj := range items {
+				if !keep(obj) {
+					continue
+				}
+				if key, err := cache.MetaNamespaceKeyFunc(obj); err == nil {
+					cached[key] = true
+				}
+				kept = append(kept, obj)
+			}
+			if err := meta.SetList(list, kept); err != nil {
+				return nil, err
+			}
+			return list, nil
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.Watch(opts)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				if e.Type != watch.Added && e.Type != watch.Modified && e.Type != watch.Deleted {
+					return e, true
+				}
+				key, err := cache.MetaNamespaceKeyFunc(e.Object)
+				if err != nil {
+					return e, true
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case e.Type == watch.Deleted:
+					if !cached[key] {
+						return e, false
+					}
+					delete(cached, key)
+				case keep(e.Object):
+					cached[key] = true
+				case cached[key]:
+					delete(cached, key)
+					e.Type = watch.Deleted
+				default:
+					return e, false
+				}
+				return e, true
+			}), nil
+		},
+	}
+}
+
+// loadBalancerService returns true for the services MetalLB manages:
+// LoadBalancer services, services that still have an ingress status
+// from when they were, which the controller must clear, and services
+// whose IP the controller holds.
+func loadBalancerService(obj runtime.Object) bool {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		return true
+	}
+	return svc.Spec.Type == v1.ServiceTypeLoadBalancer || len(svc.Status.LoadBalancer.Ingress) > 0 ||
+		meta.FindStatusCondition(svc.Status.Conditions, IPHeldCondition) != nil
+}
@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestLoadBalancerServiceFilter(t *testing.T) {
+	fw := watch.NewFake()
+	lw := filterObjects(&cache.ListWatch{
+		ListFunc: func(metav1.ListOptions) (runtime.Object, error) {
+			return &v1.ServiceList{}, nil
+		},
+		WatchFunc: func(metav1.ListOptions) (watch.Interface, error) {
+			return fw, nil
+		},
+	}, loadBalancerService)
+	if _, err := lw.List(metav1.ListOptions{}); err != nil {
+		t.Fatalf("List: %s", err)
+	}
+	w, err := lw.Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Watch: %s", err)
+	}
+	defer w.Stop()
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "web"},
+		Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "10.20.0.1"}}},
+		},
+	}
+	held := func() *v1.Service {
+		s := svc.DeepCopy()
+		s.Spec.Type = v1.ServiceTypeNodePort
+		s.Status.LoadBalancer = v1.LoadBalancerStatus{}
+		s.Status.Conditions = []metav1.Condition{{Type: IPHeldCondition, Status: metav1.ConditionTrue}}
+		return s
+	}()
+	released := held.DeepCopy()
+	released.Status.Conditions = nil
+
+	tests := []struct {
+		desc string
+		typ  watch.EventType
+		obj  *v1.Service
+		want watch.EventType
+	}{
+		{
+			desc: "LoadBalancer",
+			typ:  watch.Added,
+			obj:  svc,
+			want: watch.Added,
+		},
+		{
+			desc: "IP held",
+			typ:  watch.Modified,
+			obj:  held,
+			want: watch.Modified,
+		},
+		{
+			desc: "IP released",
+			typ:  watch.Modified,
+			obj:  released,
+			want: watch.Deleted,
+		},
+	}
+	for _, test := range tests {
+		go fw.Action(test.typ, test.obj)
+		e := <-w.ResultChan()
+		if e.Type != test.want {
+			t.Errorf("%s: got %s event, want %s", test.desc, e.Type, test.want)
+		}
+	}
+}
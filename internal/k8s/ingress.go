@@ -0,0 +1,119 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Annotation setting the class of Ingresses that predate
+// spec.ingressClassName.
+const legacyIngressClassAnnotation = "kubernetes.io/ingress.class"
+
+// Ingress is the subset of an Ingress that MetalLB acts on.
+type Ingress struct {
+	Namespace   string
+	Name        string
+	Annotations map[string]string
+	// IP addresses currently published in the Ingress's status.
+	Addresses []string
+}
+
+type ingKey string
+
+// watchIngresses sets up the informer for the Ingresses of classes.
+func (c *Client) watchIngresses(classes []string, ingressChanged func(log.Logger, string, *Ingress) SyncState) {
+	ingHandlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(ingKey(key))
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(ingKey(key))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(ingKey(key))
+			}
+		},
+	}
+	ingWatcher := cache.NewListWatchFromClient(c.client.NetworkingV1().RESTClient(), "ingresses", v1.NamespaceAll, fields.Everything())
+	c.ingIndexer, c.ingInformer = cache.NewIndexerInformer(stripManagedFields(ingWatcher), &networkingv1.Ingress{}, 0, ingHandlers, cache.Indexers{})
+
+	c.ingressClasses = map[string]bool{}
+	for _, class := range classes {
+		c.ingressClasses[class] = true
+	}
+	c.ingressChanged = ingressChanged
+	c.syncFuncs = append(c.syncFuncs, c.ingInformer.HasSynced)
+}
+
+// ingressClass returns the class of ing, "" if it has none.
+func ingressClass(ing *networkingv1.Ingress) string {
+	if ing.Spec.IngressClassName != nil {
+		return *ing.Spec.IngressClassName
+	}
+	return ing.Annotations[legacyIngressClassAnnotation]
+}
+
+// parseIngress extracts the fields MetalLB needs from an Ingress.
+func parseIngress(ing *networkingv1.Ingress) *Ingress {
+	ret := &Ingress{
+		Namespace:   ing.Namespace,
+		Name:        ing.Name,
+		Annotations: ing.Annotations,
+	}
+	for _, lbIng := range ing.Status.LoadBalancer.Ingress {
+		if lbIng.IP != "" {
+			ret.Addresses = append(ret.Addresses, lbIng.IP)
+		}
+	}
+	return ret
+}
+
+// UpdateIngressStatus publishes ips as the load balancer addresses of
+// the Ingress. An empty ips clears the addresses MetalLB set.
+func (c *Client) UpdateIngressStatus(ing *Ingress, ips []string) error {
+	patch := &networkingv1.Ingress{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: networkingv1.SchemeGroupVersion.String(),
+			Kind:       "Ingress",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: ing.Namespace,
+			Name:      ing.Name,
+		},
+		Status: networkingv1.IngressStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{},
+			},
+		},
+	}
+	for _, ip := range ips {
+		patch.Status.LoadBalancer.Ingress = append(patch.Status.LoadBalancer.Ingress, v1.LoadBalancerIngress{IP: ip})
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.client.NetworkingV1().Ingresses(ing.Namespace).Patch(context.TODO(), ing.Name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	}, "status")
+	return err
+}
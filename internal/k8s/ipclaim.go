@@ -0,0 +1,81 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var ipClaimResource = schema.GroupVersionResource{
+	Group:    "metallb.universe.tf",
+	Version:  "v1alpha1",
+	Resource: "ipclaims",
+}
+
+// ipClaimSpec is the spec of an IPClaim.
+type ipClaimSpec struct {
+	Service string `json:"service"`
+	IP      string `json:"ip"`
+	Pool    string `json:"pool"`
+}
+
+// ApplyIPClaim creates or updates the IPClaim of svc, which claims ip
+// from pool. The claim has the labels of the service, and is owned
+// by it. Admission webhooks rejecting the claim make it fail.
+func (c *Client) ApplyIPClaim(svc *v1.Service, ip, pool string) error {
+	patch := struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Metadata   metav1.ObjectMeta `json:"metadata"`
+		Spec       ipClaimSpec       `json:"spec"`
+	}{
+		APIVersion: ipClaimResource.GroupVersion().String(),
+		Kind:       "IPClaim",
+		Metadata: metav1.ObjectMeta{
+			Namespace: svc.Namespace,
+			Name:      svc.Name,
+			Labels:    svc.Labels,
+		},
+		Spec: ipClaimSpec{
+			Service: svc.Name,
+			IP:      ip,
+			Pool:    pool,
+		},
+	}
+	if svc.UID != "" {
+		// Claims go away with their service, even if it is deleted
+		// while the controller isn't running.
+		patch.Metadata.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Name:       svc.Name,
+			UID:        svc.UID,
+		}}
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.dynamic.Resource(ipClaimResource).Namespace(svc.Namespace).Patch(context.TODO(), svc.Name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	})
+	return err
+}
+
+// DeleteIPClaim deletes the IPClaim of the service namespace/name, if
+// it exists.
+func (c *Client) DeleteIPClaim(namespace, name string) error {
+	err := c.dynamic.Resource(ipClaimResource).Namespace(namespace).Delete(context.TODO(), name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"go.universe.tf/metallb/internal/config"
 
@@ -15,11 +20,18 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	v1 "k8s.io/api/core/v1"
 	discovery "k8s.io/api/discovery/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
@@ -32,9 +44,10 @@ import (
 type Client struct {
 	logger log.Logger
 
-	client *kubernetes.Clientset
-	events record.EventRecorder
-	queue  workqueue.RateLimitingInterface
+	client       *kubernetes.Clientset
+	events       record.EventRecorder
+	queue        workqueue.RateLimitingInterface
+	fieldManager string
 
 	svcIndexer     cache.Indexer
 	svcInformer    cache.Controller
@@ -46,13 +59,62 @@ type Client struct {
 	cmInformer     cache.Controller
 	nodeIndexer    cache.Indexer
 	nodeInformer   cache.Controller
+	gwIndexer      cache.Indexer
+	gwInformer     cache.Controller
+	ingIndexer     cache.Indexer
+	ingInformer    cache.Controller
+	nodesIndexer   cache.Indexer
+	nodesInformer  cache.Controller
+	nsIndexer      cache.Indexer
+	nsInformer     cache.Controller
+
+	dynamic  dynamic.Interface
+	metadata metadata.Interface
+
+	// Suppresses repeated events, nil if they are all sent.
+	eventThrottle *eventThrottle
 
 	syncFuncs []cache.InformerSynced
 
+	// The last configuration successfully applied by configChanged.
+	config *config.Config
+	// Whether to record on the config ConfigMap if its content was
+	// accepted.
+	reportConfig bool
+
+	// Service status writes waiting to be flushed, when status
+	// batching is enabled.
+	statusInterval time.Duration
+	statusMu       sync.Mutex
+	pendingStatus  map[string]*pendingStatus
+
+	// How often, and with how much jitter, to reprocess all the
+	// watched objects. No periodic resync if zero.
+	resyncPeriod time.Duration
+	resyncJitter float64
+
+	// When each service changed, for the services whose changes
+	// haven't been processed successfully yet.
+	changedMu sync.Mutex
+	changed   map[string]time.Time
+
 	serviceChanged func(log.Logger, string, *v1.Service, EpsOrSlices) SyncState
 	configChanged  func(log.Logger, *config.Config) SyncState
 	nodeChanged    func(log.Logger, *v1.Node) SyncState
+	gatewayChanged func(log.Logger, string, *Gateway) SyncState
+	ingressChanged func(log.Logger, string, *Ingress) SyncState
+	nodesChanged   func(log.Logger, string, *v1.Node) SyncState
+	configAccepted func(map[string]string)
 	synced         func(log.Logger)
+
+	// The last config passed to PushConfig, until it is processed.
+	pushedMu sync.Mutex
+	pushed   *pushedConfig
+
+	// The IngressClasses whose Ingresses are passed to ingressChanged.
+	ingressClasses map[string]bool
+	// The GatewayClasses whose Gateways are passed to gatewayChanged.
+	gatewayClasses map[string]bool
 }
 
 // SyncState is the result of calling synchronization callbacks.
@@ -81,11 +143,55 @@ type Config struct {
 	ReadEndpoints bool
 	Logger        log.Logger
 	Kubeconfig    string
+	// If non-zero, service status writes are batched and flushed to
+	// the cluster at this interval, instead of being written
+	// synchronously by UpdateStatus.
+	StatusBatchInterval time.Duration
+	// If non-zero, an event about a service is not sent again until
+	// this long after it was last sent. Repeats in between are
+	// counted in the next one.
+	EventInterval time.Duration
+	// If true, whether the config was accepted, and if not why, is
+	// recorded in annotations of the config ConfigMap. Only one
+	// process should report the config status.
+	ReportConfigStatus bool
+	// If non-zero, all the watched objects are reprocessed at this
+	// interval, lengthened by up to ResyncJitter of it, even if they
+	// didn't change. With jitter, the objects are also spread over
+	// that much time, instead of being reprocessed all at once.
+	ResyncPeriod time.Duration
+	ResyncJitter float64
+	// The initial and maximum delays before retrying the sync of an
+	// object that failed, doubling on each failure. Zero means the
+	// defaults, 5ms and 1000s.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
 
 	ServiceChanged func(log.Logger, string, *v1.Service, EpsOrSlices) SyncState
 	ConfigChanged  func(log.Logger, *config.Config) SyncState
 	NodeChanged    func(log.Logger, *v1.Node) SyncState
-	Synced         func(log.Logger)
+	// If true, ConfigChanged gets the configs passed to PushConfig,
+	// instead of the config ConfigMap's.
+	PushedConfig bool
+	// If set, called with the data of every config ConfigMap that
+	// ConfigChanged accepts.
+	ConfigAccepted func(map[string]string)
+	// If set, the Gateway API Gateways of GatewayClasses are watched
+	// as well. Gateways of other classes are passed as deleted. The
+	// Gateway CRDs must be installed in the cluster.
+	GatewayChanged func(log.Logger, string, *Gateway) SyncState
+	GatewayClasses []string
+	// If set, the Ingresses of IngressClasses are watched as well.
+	// Ingresses of other classes are passed as deleted.
+	IngressChanged func(log.Logger, string, *Ingress) SyncState
+	IngressClasses []string
+	// If set, all the nodes of the cluster are watched, unlike with
+	// NodeChanged, which only watches NodeName.
+	NodesChanged func(log.Logger, string, *v1.Node) SyncState
+	Synced       func(log.Logger)
+	// If true, namespaces are watched for their default address
+	// pool, see DefaultPool.
+	NamespaceDefaultPools bool
 }
 
 type svcKey string
@@ -122,18 +228,38 @@ func New(cfg *Config) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("creating Kubernetes client: %s", err)
 	}
+	dyn, err := dynamic.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating dynamic Kubernetes client: %s", err)
+	}
+	md, err := metadata.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("creating metadata Kubernetes client: %s", err)
+	}
 
 	broadcaster := record.NewBroadcaster()
 	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(clientset.CoreV1().RESTClient()).Events("")})
 	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: cfg.ProcessName})
 
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	queue := workqueue.NewRateLimitingQueue(newRateLimiter(cfg.RetryBackoff, cfg.MaxRetryBackoff))
 
 	c := &Client{
-		logger: cfg.Logger,
-		client: clientset,
-		events: recorder,
-		queue:  queue,
+		logger:         cfg.Logger,
+		client:         clientset,
+		dynamic:        dyn,
+		metadata:       md,
+		events:         recorder,
+		queue:          queue,
+		fieldManager:   cfg.ProcessName,
+		reportConfig:   cfg.ReportConfigStatus,
+		statusInterval: cfg.StatusBatchInterval,
+		pendingStatus:  map[string]*pendingStatus{},
+		resyncPeriod:   cfg.ResyncPeriod,
+		resyncJitter:   cfg.ResyncJitter,
+		changed:        map[string]time.Time{},
+	}
+	if cfg.EventInterval > 0 {
+		c.eventThrottle = newEventThrottle(cfg.EventInterval)
 	}
 
 	if cfg.ServiceChanged != nil {
@@ -141,12 +267,14 @@ func New(cfg *Config) (*Client, error) {
 			AddFunc: func(obj interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(obj)
 				if err == nil {
+					c.markChanged(key)
 					c.queue.Add(svcKey(key))
 				}
 			},
 			UpdateFunc: func(old interface{}, new interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(new)
 				if err == nil {
+					c.markChanged(key)
 					c.queue.Add(svcKey(key))
 				}
 			},
@@ -158,7 +286,7 @@ func New(cfg *Config) (*Client, error) {
 			},
 		}
 		svcWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "services", v1.NamespaceAll, fields.Everything())
-		c.svcIndexer, c.svcInformer = cache.NewIndexerInformer(svcWatcher, &v1.Service{}, 0, svcHandlers, cache.Indexers{})
+		c.svcIndexer, c.svcInformer = cache.NewIndexerInformer(filterObjects(stripManagedFieldsExcept(svcWatcher, ingressManager), loadBalancerService), &v1.Service{}, 0, svcHandlers, cache.Indexers{})
 
 		c.serviceChanged = cfg.ServiceChanged
 		c.syncFuncs = append(c.syncFuncs, c.svcInformer.HasSynced)
@@ -186,7 +314,7 @@ func New(cfg *Config) (*Client, error) {
 					},
 				}
 				epWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "endpoints", v1.NamespaceAll, fields.Everything())
-				c.epIndexer, c.epInformer = cache.NewIndexerInformer(epWatcher, &v1.Endpoints{}, 0, epHandlers, cache.Indexers{})
+				c.epIndexer, c.epInformer = cache.NewIndexerInformer(stripManagedFields(epWatcher), &v1.Endpoints{}, 0, epHandlers, cache.Indexers{})
 
 				c.syncFuncs = append(c.syncFuncs, c.epInformer.HasSynced)
 			} else {
@@ -233,7 +361,7 @@ func New(cfg *Config) (*Client, error) {
 					},
 				}
 				slicesWatcher := cache.NewListWatchFromClient(c.client.DiscoveryV1beta1().RESTClient(), "endpointslices", v1.NamespaceAll, fields.Everything())
-				c.slicesIndexer, c.slicesInformer = cache.NewIndexerInformer(slicesWatcher, &discovery.EndpointSlice{}, 0, slicesHandlers, cache.Indexers{
+				c.slicesIndexer, c.slicesInformer = cache.NewIndexerInformer(stripManagedFields(slicesWatcher), &discovery.EndpointSlice{}, 0, slicesHandlers, cache.Indexers{
 					slicesServiceIndexName: slicesServiceIndex,
 				})
 				c.syncFuncs = append(c.syncFuncs, c.slicesInformer.HasSynced)
@@ -241,7 +369,9 @@ func New(cfg *Config) (*Client, error) {
 		}
 	}
 
-	if cfg.ConfigChanged != nil {
+	if cfg.ConfigChanged != nil && cfg.PushedConfig {
+		c.configChanged = cfg.ConfigChanged
+	} else if cfg.ConfigChanged != nil {
 		cmHandlers := cache.ResourceEventHandlerFuncs{
 			AddFunc: func(obj interface{}) {
 				key, err := cache.MetaNamespaceKeyFunc(obj)
@@ -263,9 +393,10 @@ func New(cfg *Config) (*Client, error) {
 			},
 		}
 		cmWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "configmaps", cfg.ConfigMapNS, fields.OneTermEqualSelector("metadata.name", cfg.ConfigMapName))
-		c.cmIndexer, c.cmInformer = cache.NewIndexerInformer(cmWatcher, &v1.ConfigMap{}, 0, cmHandlers, cache.Indexers{})
+		c.cmIndexer, c.cmInformer = cache.NewIndexerInformer(stripManagedFields(cmWatcher), &v1.ConfigMap{}, 0, cmHandlers, cache.Indexers{})
 
 		c.configChanged = cfg.ConfigChanged
+		c.configAccepted = cfg.ConfigAccepted
 		c.syncFuncs = append(c.syncFuncs, c.cmInformer.HasSynced)
 	}
 
@@ -291,12 +422,28 @@ func New(cfg *Config) (*Client, error) {
 			},
 		}
 		nodeWatcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.OneTermEqualSelector("metadata.name", cfg.NodeName))
-		c.nodeIndexer, c.nodeInformer = cache.NewIndexerInformer(nodeWatcher, &v1.Node{}, 0, nodeHandlers, cache.Indexers{})
+		c.nodeIndexer, c.nodeInformer = cache.NewIndexerInformer(stripManagedFields(nodeWatcher), &v1.Node{}, 0, nodeHandlers, cache.Indexers{})
 
 		c.nodeChanged = cfg.NodeChanged
 		c.syncFuncs = append(c.syncFuncs, c.nodeInformer.HasSynced)
 	}
 
+	if cfg.GatewayChanged != nil {
+		c.watchGateways(cfg.GatewayClasses, cfg.GatewayChanged)
+	}
+
+	if cfg.IngressChanged != nil {
+		c.watchIngresses(cfg.IngressClasses, cfg.IngressChanged)
+	}
+
+	if cfg.NodesChanged != nil {
+		c.watchNodes(cfg.NodesChanged)
+	}
+
+	if cfg.NamespaceDefaultPools {
+		c.watchNamespaces()
+	}
+
 	if cfg.Synced != nil {
 		c.synced = cfg.Synced
 	}
@@ -367,6 +514,27 @@ func (c *Client) CreateMlSecret(namespace, controllerDeploymentName, secretName
 	return err
 }
 
+// WatchSecret watches the Secret name in namespace until stopCh is
+// closed, and calls changed with its data when it's created or
+// changes.
+func (c *Client) WatchSecret(namespace, name string, changed func(map[string][]byte), stopCh <-chan struct{}) {
+	lw := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "secrets", namespace, fields.OneTermEqualSelector("metadata.name", name))
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if s, ok := obj.(*v1.Secret); ok {
+				changed(s.Data)
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			if s, ok := new.(*v1.Secret); ok {
+				changed(s.Data)
+			}
+		},
+	}
+	_, informer := cache.NewInformer(stripManagedFields(lw), &v1.Secret{}, 0, handlers)
+	go informer.Run(stopCh)
+}
+
 // PodIPs returns the IPs of all the pods matched by the labels string.
 func (c *Client) PodIPs(namespace, labels string) ([]string, error) {
 	pl, err := c.client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labels})
@@ -398,6 +566,18 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 	if c.nodeInformer != nil {
 		go c.nodeInformer.Run(stopCh)
 	}
+	if c.gwInformer != nil {
+		go c.gwInformer.Run(stopCh)
+	}
+	if c.ingInformer != nil {
+		go c.ingInformer.Run(stopCh)
+	}
+	if c.nodesInformer != nil {
+		go c.nodesInformer.Run(stopCh)
+	}
+	if c.nsInformer != nil {
+		go c.nsInformer.Run(stopCh)
+	}
 
 	if !cache.WaitForCacheSync(stopCh, c.syncFuncs...) {
 		return errors.New("timed out waiting for cache sync")
@@ -405,6 +585,13 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 
 	c.queue.Add(synced(""))
 
+	if c.statusInterval > 0 {
+		go wait.Until(c.flushStatus, c.statusInterval, stopCh)
+	}
+	if c.resyncPeriod > 0 && stopCh != nil {
+		go c.resyncLoop(stopCh)
+	}
+
 	if stopCh != nil {
 		go func() {
 			<-stopCh
@@ -419,6 +606,11 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 		}
 		updates.Inc()
 		st := c.sync(key)
+		if k, ok := key.(svcKey); ok && st != SyncStateError {
+			c.changedMu.Lock()
+			delete(c.changed, string(k))
+			c.changedMu.Unlock()
+		}
 		switch st {
 		case SyncStateSuccess:
 			c.queue.Forget(key)
@@ -432,30 +624,323 @@ func (c *Client) Run(stopCh <-chan struct{}) error {
 	}
 }
 
-// ForceSync reprocess all watched services.
+// markChanged records that the service key changed, unless an
+// earlier change is still unprocessed.
+func (c *Client) markChanged(key string) {
+	c.changedMu.Lock()
+	defer c.changedMu.Unlock()
+	if _, ok := c.changed[key]; !ok {
+		c.changed[key] = time.Now()
+	}
+}
+
+// ChangedAt returns when the service key changed, for the earliest
+// change that the ServiceChanged callback hasn't processed
+// successfully yet. It returns the zero time if there is none.
+func (c *Client) ChangedAt(key string) time.Time {
+	c.changedMu.Lock()
+	defer c.changedMu.Unlock()
+	return c.changed[key]
+}
+
+// SyncAfter reprocesses the service key after d.
+func (c *Client) SyncAfter(key string, d time.Duration) {
+	c.queue.AddAfter(svcKey(key), d)
+}
+
+// ForceSync reprocess all watched services, gateways and ingresses.
 func (c *Client) ForceSync() {
 	if c.svcIndexer != nil {
 		for _, k := range c.svcIndexer.ListKeys() {
 			c.queue.AddRateLimited(svcKey(k))
 		}
 	}
+	c.forceSyncGateways()
+}
+
+// forceSyncGateways reprocesses all watched gateways and ingresses,
+// and the nodes watched for NodesChanged.
+func (c *Client) forceSyncGateways() {
+	if c.gwIndexer != nil {
+		for _, k := range c.gwIndexer.ListKeys() {
+			c.queue.AddRateLimited(gwKey(k))
+		}
+	}
+	if c.ingIndexer != nil {
+		for _, k := range c.ingIndexer.ListKeys() {
+			c.queue.AddRateLimited(ingKey(k))
+		}
+	}
+	if c.nodesIndexer != nil {
+		for _, k := range c.nodesIndexer.ListKeys() {
+			c.queue.AddRateLimited(nodesKey(k))
+		}
+	}
+}
+
+// forceSyncPools reprocesses the watched services that may be
+// affected by the pool changes between old and new, and by the BGP
+// community aliases changes. Other changes, e.g. to the peers,
+// reprocess everything.
+func (c *Client) forceSyncPools(l log.Logger, old, new *config.Config) {
+	if !config.OnlyPoolsAndCommunitiesChanged(old, new) {
+		level.Info(l).Log("event", "configDelta", "msg", "config changed outside of the address pools, reprocessing all services")
+		c.ForceSync()
+		return
+	}
+	// Services use the aliases in their annotations.
+	communities := !config.OnlyPoolsChanged(old, new)
+	changed := config.ChangedPools(old, new)
+	if len(changed) == 0 && !communities {
+		level.Debug(l).Log("event", "configDelta", "msg", "no address pool changed, not reprocessing services")
+		return
+	}
+	// Gateways are few, don't bother filtering them.
+	c.forceSyncGateways()
+	if c.svcIndexer == nil {
+		return
+	}
+
+	n := 0
+	for _, obj := range c.svcIndexer.List() {
+		svc, ok := obj.(*v1.Service)
+		if !ok {
+			continue
+		}
+		usesAliases := communities && svc.Annotations["metallb.universe.tf/bgp-communities"] != ""
+		if !usesAliases && !serviceUsesPools(svc, c.DefaultPool(svc.Namespace), changed, old, new) {
+			continue
+		}
+		key, err := cache.MetaNamespaceKeyFunc(svc)
+		if err != nil {
+			continue
+		}
+		c.queue.AddRateLimited(svcKey(key))
+		n++
+	}
+	level.Info(l).Log("event", "configDelta", "changedPools", len(changed), "services", n, "msg", "reprocessing services affected by config change")
+}
+
+// serviceUsesPools returns true if svc is a LoadBalancer that has no
+// usable IP yet, requests one of the changed pools, either itself or
+// through defaultPool, the default pool of its namespace, or holds an
+// IP that belongs to a changed pool (or to no pool) in any of cfgs.
+func serviceUsesPools(svc *v1.Service, defaultPool string, changed map[string]bool, cfgs ...*config.Config) bool {
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return false
+	}
+	requested := svc.Annotations["metallb.universe.tf/address-pool"]
+	if requested == "" {
+		requested = defaultPool
+	}
+	if changed[requested] {
+		return true
+	}
+	if len(svc.Status.LoadBalancer.Ingress) == 0 {
+		return true
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ip := net.ParseIP(ingress.IP)
+		if ip == nil {
+			return true
+		}
+		for _, cfg := range cfgs {
+			pool := poolFor(cfg.Pools, ip)
+			if pool == "" || changed[pool] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func poolFor(pools map[string]*config.Pool, ip net.IP) string {
+	for pname, p := range pools {
+		for _, cidr := range p.CIDR {
+			if cidr.Contains(ip) {
+				return pname
+			}
+		}
+	}
+	return ""
 }
 
 // UpdateStatus writes the protected "status" field of svc back into
-// the Kubernetes cluster.
-func (c *Client) UpdateStatus(svc *v1.Service) error {
-	_, err := c.client.CoreV1().Services(svc.Namespace).UpdateStatus(context.TODO(), svc, metav1.UpdateOptions{})
+// the Kubernetes cluster. If ipMode is not empty, it is published as
+// the ipMode of the load balancer ingress entries.
+//
+// When status batching is enabled, the write is only queued, and
+// UpdateStatus returns immediately. Failed batched writes cause the
+// service to be reprocessed.
+func (c *Client) UpdateStatus(svc *v1.Service, ipMode string) error {
+	if c.statusInterval == 0 {
+		return c.applyStatus(svc, ipMode)
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(svc)
+	if err != nil {
+		return err
+	}
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.pendingStatus[key] = &pendingStatus{svc.DeepCopy(), ipMode}
+	return nil
+}
+
+// pendingStatus is a batched service status write.
+type pendingStatus struct {
+	svc    *v1.Service
+	ipMode string
+}
+
+// applyStatus writes the load balancer status of svc using
+// server-side apply, so that MetalLB only ever owns
+// status.loadBalancer and never conflicts with other writers of the
+// service.
+func (c *Client) applyStatus(svc *v1.Service, ipMode string) error {
+	patch := &v1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: svc.Status.LoadBalancer,
+		},
+	}
+	// Only apply our own conditions, so that the apply doesn't take
+	// over the conditions set by others.
+	for _, cond := range svc.Status.Conditions {
+		if strings.HasPrefix(cond.Type, "metallb.universe.tf/") {
+			patch.Status.Conditions = append(patch.Status.Conditions, cond)
+		}
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if ipMode != "" {
+		if bs, err = withIPMode(bs, ipMode); err != nil {
+			return err
+		}
+	}
+	force := true
+	_, err = c.client.CoreV1().Services(svc.Namespace).Patch(context.TODO(), svc.Name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	}, "status")
 	return err
 }
 
+// ApplyConfigMap creates or replaces the data of the ConfigMap
+// namespace/name, using server-side apply.
+func (c *Client) ApplyConfigMap(namespace, name string, data map[string]string) error {
+	cm := &v1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Data: data,
+	}
+	bs, err := json.Marshal(cm)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = c.client.CoreV1().ConfigMaps(namespace).Patch(context.TODO(), name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	})
+	return err
+}
+
+// ConfigMapData returns the data of the ConfigMap namespace/name, nil
+// if it doesn't exist.
+func (c *Client) ConfigMapData(namespace, name string) (map[string]string, error) {
+	cm, err := c.client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// withIPMode sets the ipMode of all the ingress entries of the
+// service in patch. The vendored API types predate the field, so it
+// is added to the serialized patch.
+func withIPMode(patch []byte, ipMode string) ([]byte, error) {
+	u := &unstructured.Unstructured{}
+	if err := u.UnmarshalJSON(patch); err != nil {
+		return nil, err
+	}
+	ingress, _, err := unstructured.NestedSlice(u.Object, "status", "loadBalancer", "ingress")
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ingress {
+		if m, ok := i.(map[string]interface{}); ok {
+			m["ipMode"] = ipMode
+		}
+	}
+	if err := unstructured.SetNestedSlice(u.Object, ingress, "status", "loadBalancer", "ingress"); err != nil {
+		return nil, err
+	}
+	return u.MarshalJSON()
+}
+
+// flushStatus writes out all pending service status updates.
+func (c *Client) flushStatus() {
+	c.statusMu.Lock()
+	pending := c.pendingStatus
+	c.pendingStatus = map[string]*pendingStatus{}
+	c.statusMu.Unlock()
+
+	for key, p := range pending {
+		if err := c.applyStatus(p.svc, p.ipMode); err != nil {
+			level.Error(c.logger).Log("op", "updateServiceStatus", "service", key, "error", err, "msg", "failed to write batched service status, will retry")
+			updateErrors.Inc()
+			c.queue.AddRateLimited(svcKey(key))
+		}
+	}
+}
+
+// withPendingStatus returns svc with any not-yet-flushed status
+// applied, so that callers always observe their own writes.
+func (c *Client) withPendingStatus(key string, svc *v1.Service) *v1.Service {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	pending, ok := c.pendingStatus[key]
+	if !ok {
+		return svc
+	}
+	svc = svc.DeepCopy()
+	svc.Status = *pending.svc.Status.DeepCopy()
+	return svc
+}
+
 // Infof logs an informational event about svc to the Kubernetes cluster.
 func (c *Client) Infof(svc *v1.Service, kind, msg string, args ...interface{}) {
-	c.events.Eventf(svc, v1.EventTypeNormal, kind, msg, args...)
+	c.event(svc, nil, v1.EventTypeNormal, kind, msg, args...)
+}
+
+// AnnotatedInfof is Infof, with annotations on the event for its
+// consumers to read instead of parsing the message.
+func (c *Client) AnnotatedInfof(svc *v1.Service, annotations map[string]string, kind, msg string, args ...interface{}) {
+	c.event(svc, annotations, v1.EventTypeNormal, kind, msg, args...)
 }
 
 // Errorf logs an error event about svc to the Kubernetes cluster.
 func (c *Client) Errorf(svc *v1.Service, kind, msg string, args ...interface{}) {
-	c.events.Eventf(svc, v1.EventTypeWarning, kind, msg, args...)
+	c.event(svc, nil, v1.EventTypeWarning, kind, msg, args...)
 }
 
 func (c *Client) sync(key interface{}) SyncState {
@@ -470,6 +955,9 @@ func (c *Client) sync(key interface{}) SyncState {
 			return SyncStateError
 		}
 		if !exists {
+			c.statusMu.Lock()
+			delete(c.pendingStatus, string(k))
+			c.statusMu.Unlock()
 			return c.serviceChanged(l, string(k), nil, EpsOrSlices{})
 		}
 
@@ -507,7 +995,7 @@ func (c *Client) sync(key interface{}) SyncState {
 			}
 			epsOrSlices.Type = Slices
 		}
-		return c.serviceChanged(l, string(k), svc.(*v1.Service), epsOrSlices)
+		return c.serviceChanged(l, string(k), c.withPendingStatus(string(k), svc.(*v1.Service)), epsOrSlices)
 
 	case cmKey:
 		l := log.With(c.logger, "configmap", string(k))
@@ -521,29 +1009,24 @@ func (c *Client) sync(key interface{}) SyncState {
 			return c.configChanged(l, nil)
 		}
 
-		// Note that configs that we can read, but that fail parsing
-		// or validation, result in a "synced" state, because the
-		// config is not going to parse any better until the k8s
-		// object changes to fix the issue.
 		cm := cmi.(*v1.ConfigMap)
-		cfg, err := config.Parse([]byte(cm.Data["config"]))
-		if err != nil {
-			level.Error(l).Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
-			configStale.Set(1)
-			return SyncStateSuccess
+		st, err := c.loadConfig(l, cm.Data)
+		c.reportConfigStatus(l, cm, err)
+		if err == nil && c.configAccepted != nil {
+			c.configAccepted(cm.Data)
 		}
+		return st
 
-		st := c.configChanged(l, cfg)
-		if st == SyncStateError {
-			level.Error(l).Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
-			configStale.Set(1)
+	case pushKey:
+		c.pushedMu.Lock()
+		p := c.pushed
+		c.pushed = nil
+		c.pushedMu.Unlock()
+		if p == nil {
 			return SyncStateSuccess
 		}
-
-		configLoaded.Set(1)
-		configStale.Set(0)
-
-		level.Info(l).Log("event", "configLoaded", "msg", "config (re)loaded")
+		st, err := c.loadConfig(log.With(c.logger, "generation", p.generation), p.data)
+		p.ack(err)
 		return st
 
 	case nodeKey:
@@ -560,6 +1043,56 @@ func (c *Client) sync(key interface{}) SyncState {
 		node := n.(*v1.Node)
 		return c.nodeChanged(c.logger, node)
 
+	case gwKey:
+		l := log.With(c.logger, "gateway", string(k))
+		gwi, exists, err := c.gwIndexer.GetByKey(string(k))
+		if err != nil {
+			level.Error(l).Log("op", "getGateway", "error", err, "msg", "failed to get gateway")
+			return SyncStateError
+		}
+		if !exists {
+			return c.gatewayChanged(l, string(k), nil)
+		}
+		u := gwi.(*unstructured.Unstructured)
+		if !c.gatewayClasses[gatewayClass(u)] {
+			return c.gatewayChanged(l, string(k), nil)
+		}
+		gw, err := parseGateway(u)
+		if err != nil {
+			// Won't parse any better until the object changes.
+			level.Error(l).Log("op", "parseGateway", "error", err, "msg", "failed to parse gateway")
+			return SyncStateSuccess
+		}
+		return c.gatewayChanged(l, string(k), gw)
+
+	case ingKey:
+		l := log.With(c.logger, "ingress", string(k))
+		ingi, exists, err := c.ingIndexer.GetByKey(string(k))
+		if err != nil {
+			level.Error(l).Log("op", "getIngress", "error", err, "msg", "failed to get ingress")
+			return SyncStateError
+		}
+		if !exists {
+			return c.ingressChanged(l, string(k), nil)
+		}
+		ing := ingi.(*networkingv1.Ingress)
+		if !c.ingressClasses[ingressClass(ing)] {
+			return c.ingressChanged(l, string(k), nil)
+		}
+		return c.ingressChanged(l, string(k), parseIngress(ing))
+
+	case nodesKey:
+		l := log.With(c.logger, "node", string(k))
+		n, exists, err := c.nodesIndexer.GetByKey(string(k))
+		if err != nil {
+			level.Error(l).Log("op", "getNode", "error", err, "msg", "failed to get node")
+			return SyncStateError
+		}
+		if !exists {
+			return c.nodesChanged(l, string(k), nil)
+		}
+		return c.nodesChanged(l, string(k), n.(*v1.Node))
+
 	case synced:
 		if c.synced != nil {
 			c.synced(c.logger)
@@ -613,3 +1146,51 @@ func UseEndpointSlices(kubeClient kubernetes.Interface) bool {
 	}
 	return true
 }
+
+// loadConfig parses and applies the config in data, the data of a
+// config ConfigMap. It returns the state to return, and why the config
+// was not accepted, nil if it was.
+func (c *Client) loadConfig(l log.Logger, data map[string]string) (SyncState, error) {
+	// Note that configs that we can read, but that fail parsing
+	// or validation, result in a "synced" state, because the
+	// config is not going to parse any better until the k8s
+	// object changes to fix the issue.
+	expansions := poolExpansions(data)
+	cfg, err := config.ParseWithExpansions([]byte(data["config"]), expansions)
+	if err != nil {
+		level.Error(l).Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
+		configStale.Set(1)
+		configErrors.WithLabelValues("invalid").Inc()
+		return SyncStateSuccess, err
+	}
+	for pool := range expansions {
+		if cfg.Pools[pool] == nil {
+			level.Warn(l).Log("event", "configWarning", "pool", pool, "key", PoolExpansionKey(pool), "msg", "ignoring the expansion of an unknown address pool")
+		}
+	}
+
+	st := c.configChanged(l, cfg)
+	if st == SyncStateError {
+		err = fmt.Errorf("rejected by %s, see its logs for details", c.fieldManager)
+		level.Error(l).Log("event", "configStale", "error", err, "msg", "config (re)load failed, config marked stale")
+		configStale.Set(1)
+		configErrors.WithLabelValues("rejected").Inc()
+		return SyncStateSuccess, err
+	}
+
+	configLoaded.Set(1)
+	configStale.Set(0)
+
+	level.Info(l).Log("event", "configLoaded", "msg", "config (re)loaded")
+
+	// Once we have a baseline, only reprocess the services that
+	// the config delta can affect, rather than every service in
+	// the cluster.
+	prev := c.config
+	c.config = cfg
+	if st == SyncStateReprocessAll && prev != nil {
+		c.forceSyncPools(l, prev, cfg)
+		return SyncStateSuccess, nil
+	}
+	return st, nil
+}
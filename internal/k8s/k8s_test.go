@@ -0,0 +1,154 @@
+package k8s
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"go.universe.tf/metallb/internal/config"
+)
+
+func TestForceSyncPools(t *testing.T) {
+	parse := func(raw string) *config.Config {
+		cfg, err := config.Parse([]byte(raw))
+		if err != nil {
+			t.Fatalf("parsing config: %s", err)
+		}
+		return cfg
+	}
+	pools := `
+address-pools:
+- name: pool1
+  protocol: bgp
+  addresses:
+  - 10.20.0.0/24
+- name: pool2
+  protocol: bgp
+  addresses:
+  - 10.30.0.0/24
+`
+	svc := func(name, ip string, annotations map[string]string) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, Annotations: annotations},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer},
+			Status: v1.ServiceStatus{
+				LoadBalancer: v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: ip}}},
+			},
+		}
+	}
+	svcs := []*v1.Service{
+		svc("pool1", "10.20.0.1", nil),
+		svc("pool2", "10.30.0.1", nil),
+		svc("aliases", "10.30.0.2", map[string]string{"metallb.universe.tf/bgp-communities": "foo"}),
+	}
+
+	tests := []struct {
+		desc string
+		old  string
+		new  string
+		want []string
+	}{
+		{
+			desc: "no change",
+			old:  pools,
+			new:  pools,
+		},
+		{
+			desc: "pool changed",
+			old:  pools,
+			new:  pools + "  auto-assign: false\n",
+			want: []string{"ns/aliases", "ns/pool2"},
+		},
+		{
+			desc: "community alias changed",
+			old:  "bgp-communities:\n  foo: 64512:1\n" + pools,
+			new:  "bgp-communities:\n  foo: 64512:2\n" + pools,
+			want: []string{"ns/aliases"},
+		},
+		{
+			desc: "peer added",
+			old:  pools,
+			new:  "peers:\n- my-asn: 42\n  peer-asn: 42\n  peer-address: 1.2.3.4\n" + pools,
+			want: []string{"ns/aliases", "ns/pool1", "ns/pool2"},
+		},
+	}
+	for _, test := range tests {
+		c := &Client{
+			queue:      workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0)),
+			svcIndexer: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		}
+		for _, s := range svcs {
+			if err := c.svcIndexer.Add(s); err != nil {
+				t.Fatalf("adding service: %s", err)
+			}
+		}
+		c.forceSyncPools(log.NewNopLogger(), parse(test.old), parse(test.new))
+		var got []string
+		for c.queue.Len() > 0 {
+			k, _ := c.queue.Get()
+			got = append(got, string(k.(svcKey)))
+			c.queue.Done(k)
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: wrong services reprocessed (-want +got)\n%s", test.desc, diff)
+		}
+		c.queue.ShutDown()
+	}
+}
+
+func TestGatewayClasses(t *testing.T) {
+	gw := func(name, class string) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "gateway.networking.k8s.io/v1alpha1",
+			"kind":       "Gateway",
+			"metadata":   map[string]interface{}{"namespace": "ns", "name": name},
+			"spec":       map[string]interface{}{"gatewayClassName": class},
+		}}
+	}
+	var got map[string]*Gateway
+	c := &Client{
+		logger:         log.NewNopLogger(),
+		queue:          workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0)),
+		gwIndexer:      cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		gatewayClasses: map[string]bool{"metallb": true},
+		gatewayChanged: func(_ log.Logger, name string, gw *Gateway) SyncState {
+			got[name] = gw
+			return SyncStateSuccess
+		},
+	}
+	defer c.queue.ShutDown()
+	for _, u := range []*unstructured.Unstructured{gw("ours", "metallb"), gw("istio", "istio")} {
+		if err := c.gwIndexer.Add(u); err != nil {
+			t.Fatalf("adding gateway: %s", err)
+		}
+	}
+
+	got = map[string]*Gateway{}
+	for _, k := range []gwKey{"ns/ours", "ns/istio"} {
+		c.sync(k)
+	}
+	if got["ns/ours"] == nil {
+		t.Error("gateway of a watched class passed as deleted")
+	}
+	if gw, ok := got["ns/istio"]; !ok || gw != nil {
+		t.Errorf("gateway of another class passed as %v, want deleted", gw)
+	}
+
+	// A Gateway that moves to another class is passed as deleted.
+	if err := c.gwIndexer.Update(gw("ours", "contour")); err != nil {
+		t.Fatalf("updating gateway: %s", err)
+	}
+	got = map[string]*Gateway{}
+	c.sync(gwKey("ns/ours"))
+	if gw, ok := got["ns/ours"]; !ok || gw != nil {
+		t.Errorf("gateway moved to another class passed as %v, want deleted", gw)
+	}
+}
@@ -0,0 +1,97 @@
+package k8s
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IPFamily returns the primary IP family of svc, "" if it can't be
+// determined.
+//
+// The API server records it first in spec.ipFamilies, which older
+// clusters don't set. The family of the first cluster IP, as long as
+// it's an IP and not "None", is the same.
+func IPFamily(svc *v1.Service) v1.IPFamily {
+	if len(svc.Spec.IPFamilies) > 0 {
+		switch f := svc.Spec.IPFamilies[0]; f {
+		case v1.IPv4Protocol, v1.IPv6Protocol:
+			return f
+		}
+	}
+	clusterIP := svc.Spec.ClusterIP
+	if len(svc.Spec.ClusterIPs) > 0 {
+		clusterIP = svc.Spec.ClusterIPs[0]
+	}
+	ip := net.ParseIP(clusterIP)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() == nil:
+		return v1.IPv6Protocol
+	default:
+		return v1.IPv4Protocol
+	}
+}
+
+// LoadBalancerIP returns the IP MetalLB published in the load balancer
+// status of svc, nil if there is none.
+//
+// MetalLB publishes a single ingress entry, of the service's primary
+// IP family. Other writers, or an older MetalLB, may leave more
+// entries, in any order, so the IP is the first entry of the primary
+// family rather than the first entry, and the order of the entries
+// never changes it.
+func LoadBalancerIP(svc *v1.Service) net.IP {
+	family := IPFamily(svc)
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		ip := net.ParseIP(ingress.IP)
+		if ip == nil {
+			continue
+		}
+		if family == "" || (ip.To4() == nil) == (family == v1.IPv6Protocol) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// ExtraPrefixesCondition is the status condition in which the
+// controller publishes the extra prefixes it reserved for a service,
+// as a comma-separated list of CIDRs in the message. The speakers
+// only advertise those, never the annotation's request itself.
+const ExtraPrefixesCondition = "metallb.universe.tf/ExtraPrefixesReserved"
+
+// AddressBlockCondition is the status condition in which the
+// controller publishes the prefix it reserved for a service that
+// requests a whole prefix. The speakers advertise that prefix instead
+// of the service's IP.
+const AddressBlockCondition = "metallb.universe.tf/AddressBlockReserved"
+
+// IPHeldCondition is the status condition of a service that is no
+// longer a LoadBalancer, whose IP the controller holds for the type
+// change grace period. It keeps the service in the controller's
+// informer after its ingress status is cleared.
+const IPHeldCondition = "metallb.universe.tf/IPHeld"
+
+// ReservedPrefixes returns the prefixes listed in the condition cond
+// of svc, nil if it isn't true.
+func ReservedPrefixes(svc *v1.Service, cond string) ([]*net.IPNet, error) {
+	c := meta.FindStatusCondition(svc.Status.Conditions, cond)
+	if c == nil || c.Status != metav1.ConditionTrue || c.Message == "" {
+		return nil, nil
+	}
+	var ret []*net.IPNet
+	for _, s := range strings.Split(c.Message, ",") {
+		_, pfx, err := net.ParseCIDR(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q in condition %s: %s", s, cond, err)
+		}
+		ret = append(ret, pfx)
+	}
+	return ret, nil
+}
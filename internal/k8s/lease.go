@@ -0,0 +1,162 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	speakerLeasePrefix = "metallb-speaker-"
+	// Annotation of speaker Leases holding the state of the speaker's
+	// node, as gossiped with memberlist.
+	speakerLeaseStateAnnotation = "metallb.universe.tf/speaker-state"
+)
+
+// SpeakerLease is the Lease a speaker renews to tell the other
+// speakers that it is alive.
+type SpeakerLease struct {
+	Node     string
+	Duration time.Duration
+	// State of the speaker's node, opaque to the client.
+	State string
+	// The version of the Lease, which changes on every renewal.
+	ResourceVersion string
+}
+
+// RenewSpeakerLease creates or renews the Lease of the speaker of
+// lease.Node in namespace.
+func (c *Client) RenewSpeakerLease(namespace string, lease SpeakerLease) error {
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(lease.Duration / time.Second)
+	patch := coordinationv1.Lease{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: coordinationv1.SchemeGroupVersion.String(),
+			Kind:       "Lease",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      speakerLeasePrefix + lease.Node,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app":       "metallb",
+				"component": "speaker-lease",
+			},
+			Annotations: map[string]string{
+				speakerLeaseStateAnnotation: lease.State,
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &lease.Node,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &now,
+		},
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = c.client.CoordinationV1().Leases(namespace).Patch(context.TODO(), patch.Name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	})
+	return err
+}
+
+// ReleaseSpeakerLease deletes the Lease of node's speaker, so that
+// the other speakers take over its announcements right away.
+func (c *Client) ReleaseSpeakerLease(namespace, node string) error {
+	err := c.client.CoordinationV1().Leases(namespace).Delete(context.TODO(), speakerLeasePrefix+node, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// WatchSpeakerLeases watches the speaker Leases in namespace until
+// stopCh is closed, calling changed when one changes. It returns a
+// function listing the Leases.
+func (c *Client) WatchSpeakerLeases(namespace string, changed func(), stopCh <-chan struct{}) func() []SpeakerLease {
+	lw := cache.NewFilteredListWatchFromClient(c.client.CoordinationV1().RESTClient(), "leases", namespace, func(opts *metav1.ListOptions) {
+		opts.LabelSelector = "app=metallb,component=speaker-lease"
+		opts.FieldSelector = fields.Everything().String()
+	})
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { changed() },
+		UpdateFunc: func(interface{}, interface{}) { changed() },
+		DeleteFunc: func(interface{}) { changed() },
+	}
+	store, informer := cache.NewInformer(stripManagedFields(lw), &coordinationv1.Lease{}, 0, handlers)
+	go informer.Run(stopCh)
+
+	return func() []SpeakerLease {
+		var ret []SpeakerLease
+		for _, obj := range store.List() {
+			l, ok := obj.(*coordinationv1.Lease)
+			if !ok || !strings.HasPrefix(l.Name, speakerLeasePrefix) {
+				continue
+			}
+			lease := SpeakerLease{
+				Node:            strings.TrimPrefix(l.Name, speakerLeasePrefix),
+				State:           l.Annotations[speakerLeaseStateAnnotation],
+				ResourceVersion: l.ResourceVersion,
+			}
+			if l.Spec.HolderIdentity != nil {
+				lease.Node = *l.Spec.HolderIdentity
+			}
+			if l.Spec.LeaseDurationSeconds != nil {
+				lease.Duration = time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second
+			}
+			ret = append(ret, lease)
+		}
+		return ret
+	}
+}
+
+// nodeLeaseNamespace is the namespace of the Leases kubelets renew to
+// heartbeat their node.
+const nodeLeaseNamespace = "kube-node-lease"
+
+// NodeLease is the Lease a kubelet renews to heartbeat its node.
+type NodeLease struct {
+	Node string
+	// The version of the Lease, which changes on every renewal.
+	ResourceVersion string
+}
+
+// WatchNodeLeases watches the kubelets' node Leases until stopCh is
+// closed, calling changed when one changes. It returns a function
+// listing the Leases.
+func (c *Client) WatchNodeLeases(changed func(), stopCh <-chan struct{}) func() []NodeLease {
+	lw := cache.NewListWatchFromClient(c.client.CoordinationV1().RESTClient(), "leases", nodeLeaseNamespace, fields.Everything())
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { changed() },
+		UpdateFunc: func(interface{}, interface{}) { changed() },
+		DeleteFunc: func(interface{}) { changed() },
+	}
+	store, informer := cache.NewInformer(stripManagedFields(lw), &coordinationv1.Lease{}, 0, handlers)
+	go informer.Run(stopCh)
+
+	return func() []NodeLease {
+		var ret []NodeLease
+		for _, obj := range store.List() {
+			l, ok := obj.(*coordinationv1.Lease)
+			if !ok {
+				continue
+			}
+			ret = append(ret, NodeLease{
+				Node:            l.Name,
+				ResourceVersion: l.ResourceVersion,
+			})
+		}
+		return ret
+	}
+}
@@ -0,0 +1,79 @@
+package k8s
+
+import (
+	"context"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultPoolAnnotation sets the address pool of the LoadBalancer
+// services of a namespace that don't request one.
+const defaultPoolAnnotation = "metallb.universe.tf/default-address-pool"
+
+var namespaceResource = schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}
+
+// watchNamespaces sets up the informer for namespaces. Services are
+// reprocessed when the default pool of their namespace changes. Only
+// the namespaces' metadata is watched, as that's where the default
+// pool is.
+func (c *Client) watchNamespaces() {
+	nsHandlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ns, ok := obj.(*metav1.PartialObjectMetadata); ok && ns.Annotations[defaultPoolAnnotation] != "" {
+				c.syncNamespace(ns.Name)
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			oldNs, ok1 := old.(*metav1.PartialObjectMetadata)
+			newNs, ok2 := new.(*metav1.PartialObjectMetadata)
+			if ok1 && ok2 && oldNs.Annotations[defaultPoolAnnotation] != newNs.Annotations[defaultPoolAnnotation] {
+				c.syncNamespace(newNs.Name)
+			}
+		},
+	}
+	nsWatcher := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return c.metadata.Resource(namespaceResource).List(context.TODO(), opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return c.metadata.Resource(namespaceResource).Watch(context.TODO(), opts)
+		},
+	}
+	c.nsIndexer, c.nsInformer = cache.NewIndexerInformer(stripManagedFields(nsWatcher), &metav1.PartialObjectMetadata{}, 0, nsHandlers, cache.Indexers{})
+	c.syncFuncs = append(c.syncFuncs, c.nsInformer.HasSynced)
+}
+
+// syncNamespace reprocesses the services of namespace.
+func (c *Client) syncNamespace(namespace string) {
+	if c.svcIndexer == nil {
+		return
+	}
+	for _, k := range c.svcIndexer.ListKeys() {
+		if strings.HasPrefix(k, namespace+"/") {
+			c.queue.Add(svcKey(k))
+		}
+	}
+}
+
+// DefaultPool returns the address pool that the LoadBalancer services
+// of namespace get when they don't request one, "" if there is none
+// or namespaces aren't watched.
+func (c *Client) DefaultPool(namespace string) string {
+	if c.nsIndexer == nil {
+		return ""
+	}
+	obj, exists, err := c.nsIndexer.GetByKey(namespace)
+	if err != nil || !exists {
+		return ""
+	}
+	ns, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok {
+		return ""
+	}
+	return ns.Annotations[defaultPoolAnnotation]
+}
@@ -0,0 +1,80 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// nodesKey is the key of a node watched for NodesChanged, unlike
+// nodeKey, the key of the local node.
+type nodesKey string
+
+// watchNodes sets up the informer for all the nodes of the cluster.
+func (c *Client) watchNodes(nodesChanged func(log.Logger, string, *v1.Node) SyncState) {
+	handlers := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(nodesKey(key))
+			}
+		},
+		UpdateFunc: func(old interface{}, new interface{}) {
+			key, err := cache.MetaNamespaceKeyFunc(new)
+			if err == nil {
+				c.queue.Add(nodesKey(key))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err == nil {
+				c.queue.Add(nodesKey(key))
+			}
+		},
+	}
+	watcher := cache.NewListWatchFromClient(c.client.CoreV1().RESTClient(), "nodes", v1.NamespaceAll, fields.Everything())
+	c.nodesIndexer, c.nodesInformer = cache.NewIndexerInformer(stripManagedFields(watcher), &v1.Node{}, 0, handlers, cache.Indexers{})
+
+	c.nodesChanged = nodesChanged
+	c.syncFuncs = append(c.syncFuncs, c.nodesInformer.HasSynced)
+}
+
+// NodeLoopbackAnnotation records on a node the address of the node
+// loopbacks pool the controller gave it, which its speaker
+// advertises.
+const NodeLoopbackAnnotation = "metallb.universe.tf/loopback-address"
+
+// ApplyNodeLoopback records ip as the loopback address of the node
+// name. An empty ip removes it.
+func (c *Client) ApplyNodeLoopback(name, ip string) error {
+	patch := &v1.Node{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Node",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+	if ip != "" {
+		// Leaving the annotation out of the patch removes it, since
+		// we are its only manager.
+		patch.Annotations = map[string]string{NodeLoopbackAnnotation: ip}
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = c.client.CoreV1().Nodes().Patch(context.TODO(), name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	})
+	return err
+}
@@ -0,0 +1,23 @@
+package k8s
+
+// pushKey is the key of the config last passed to PushConfig.
+type pushKey string
+
+// pushedConfig is a config passed to PushConfig.
+type pushedConfig struct {
+	generation uint64
+	data       map[string]string
+	ack        func(error)
+}
+
+// PushConfig queues data, the data of a config ConfigMap, for
+// ConfigChanged, when the client was created with PushedConfig. ack
+// is called once the config was processed, with why it was not
+// accepted, nil if it was. A config pushed before the previous one
+// was processed replaces it, and the previous one is never acked.
+func (c *Client) PushConfig(generation uint64, data map[string]string, ack func(error)) {
+	c.pushedMu.Lock()
+	c.pushed = &pushedConfig{generation, data, ack}
+	c.pushedMu.Unlock()
+	c.queue.Add(pushKey(""))
+}
@@ -0,0 +1,85 @@
+package k8s
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Defaults of the backoff of the failed syncs, as in
+// workqueue.DefaultControllerRateLimiter.
+const (
+	defaultRetryBackoff    = 5 * time.Millisecond
+	defaultMaxRetryBackoff = 1000 * time.Second
+)
+
+// newRateLimiter returns the rate limiter of the work queue: failed
+// syncs of an object are retried with an exponential backoff from
+// base to max, and all the rate limited syncs share a 10 qps budget.
+func newRateLimiter(base, max time.Duration) workqueue.RateLimiter {
+	if base <= 0 {
+		base = defaultRetryBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxRetryBackoff
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(base, max),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// resyncLoop reprocesses all the watched objects every resyncPeriod,
+// lengthened by up to resyncJitter of it, until stopCh is closed. With
+// jitter, the objects are spread over that much time too, instead of
+// all getting queued at once.
+func (c *Client) resyncLoop(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(wait.Jitter(c.resyncPeriod, c.resyncJitter)):
+		}
+		spread := time.Duration(c.resyncJitter * float64(c.resyncPeriod))
+		level.Info(c.logger).Log("event", "resync", "spread", spread, "msg", "reprocessing all watched objects")
+		resyncs.Inc()
+		if spread <= 0 {
+			c.ForceSync()
+			continue
+		}
+		for _, k := range c.syncKeys() {
+			c.queue.AddAfter(k, time.Duration(rand.Int63n(int64(spread))))
+		}
+	}
+}
+
+// syncKeys returns the keys of all the watched services, gateways,
+// ingresses and nodes, as ForceSync queues them.
+func (c *Client) syncKeys() []interface{} {
+	var ret []interface{}
+	if c.svcIndexer != nil {
+		for _, k := range c.svcIndexer.ListKeys() {
+			ret = append(ret, svcKey(k))
+		}
+	}
+	if c.gwIndexer != nil {
+		for _, k := range c.gwIndexer.ListKeys() {
+			ret = append(ret, gwKey(k))
+		}
+	}
+	if c.ingIndexer != nil {
+		for _, k := range c.ingIndexer.ListKeys() {
+			ret = append(ret, ingKey(k))
+		}
+	}
+	if c.nodesIndexer != nil {
+		for _, k := range c.nodesIndexer.ListKeys() {
+			ret = append(ret, nodesKey(k))
+		}
+	}
+	return ret
+}
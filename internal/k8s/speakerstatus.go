@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var speakerStatusResource = schema.GroupVersionResource{
+	Group:    "metallb.universe.tf",
+	Version:  "v1alpha1",
+	Resource: "speakerstatuses",
+}
+
+// SpeakerServiceStatus is the state of a service on one speaker.
+type SpeakerServiceStatus struct {
+	Service   string `json:"service"`
+	IP        string `json:"ip,omitempty"`
+	Protocol  string `json:"protocol,omitempty"`
+	Announced bool   `json:"announced"`
+	// Interfaces (layer2) or peers (BGP) the service is announced
+	// through.
+	Via []string `json:"via,omitempty"`
+	// Why the service is not announced.
+	Reason string `json:"reason,omitempty"`
+}
+
+// UpdateSpeakerStatus publishes the state of the services on a
+// speaker, in the SpeakerStatus name.
+func (c *Client) UpdateSpeakerStatus(name string, services []SpeakerServiceStatus) error {
+	type status struct {
+		Services   []SpeakerServiceStatus `json:"services"`
+		LastUpdate metav1.Time            `json:"lastUpdate"`
+	}
+	patch := struct {
+		APIVersion string            `json:"apiVersion"`
+		Kind       string            `json:"kind"`
+		Metadata   metav1.ObjectMeta `json:"metadata"`
+		Status     status            `json:"status"`
+	}{
+		APIVersion: speakerStatusResource.GroupVersion().String(),
+		Kind:       "SpeakerStatus",
+		Metadata: metav1.ObjectMeta{
+			Name: name,
+		},
+		Status: status{
+			Services:   services,
+			LastUpdate: metav1.Now(),
+		},
+	}
+	if patch.Status.Services == nil {
+		patch.Status.Services = []SpeakerServiceStatus{}
+	}
+	bs, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	_, err = c.dynamic.Resource(speakerStatusResource).Patch(context.TODO(), name, types.ApplyPatchType, bs, metav1.PatchOptions{
+		FieldManager: c.fieldManager,
+		Force:        &force,
+	})
+	return err
+}
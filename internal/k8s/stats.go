@@ -30,6 +30,31 @@ var (
 		Name:      "config_stale_bool",
 		Help:      "1 if running on a stale configuration, because the latest config failed to load.",
 	})
+
+	resyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "resyncs_total",
+		Help:      "Number of periodic reprocessings of all the watched objects.",
+	})
+
+	eventsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "events_suppressed_total",
+		Help:      "Number of service events not sent because an identical event was sent recently.",
+	}, []string{
+		"reason",
+	})
+
+	configErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "metallb",
+		Subsystem: "k8s_client",
+		Name:      "config_errors_total",
+		Help:      "Number of configuration loads that failed, because the config was invalid or was rejected by the process.",
+	}, []string{
+		"reason",
+	})
 )
 
 func init() {
@@ -37,4 +62,7 @@ func init() {
 	prometheus.MustRegister(updateErrors)
 	prometheus.MustRegister(configLoaded)
 	prometheus.MustRegister(configStale)
+	prometheus.MustRegister(configErrors)
+	prometheus.MustRegister(eventsSuppressed)
+	prometheus.MustRegister(resyncs)
 }
@@ -0,0 +1,35 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodeNameExtra is the extra of the users authenticated with a bound
+// ServiceAccount token that holds the node of the token's pod.
+const nodeNameExtra = "authentication.kubernetes.io/node-name"
+
+// ReviewToken authenticates token with the apiserver, and returns the
+// name of its user, and the node of its pod for the bound
+// ServiceAccount tokens that tell it, "" otherwise.
+func (c *Client) ReviewToken(ctx context.Context, token string) (user string, node string, err error) {
+	review, err := c.client.AuthenticationV1().TokenReviews().Create(ctx, &authv1.TokenReview{
+		Spec: authv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", "", err
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return "", "", errors.New(review.Status.Error)
+		}
+		return "", "", errors.New("token not authenticated")
+	}
+	if nodes := review.Status.User.Extra[nodeNameExtra]; len(nodes) == 1 {
+		node = nodes[0]
+	}
+	return review.Status.User.Username, node, nil
+}
@@ -1,15 +1,19 @@
 package layer2
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/linkwatch"
 )
 
 // Announce is used to "announce" new IPs mapped to the node's MAC address.
@@ -21,26 +25,60 @@ type Announce struct {
 	ndps     map[int]*ndpResponder
 	ips      map[string]net.IP // svcName -> IP
 	ipRefcnt map[string]int    // ip.String() -> number of uses
+	// ip.String() -> number of uses on all the interfaces, which the
+	// XDP program answers for.
+	xdpRefcnt map[string]int
+	// svcName -> interfaces to answer on, for the services restricted
+	// to some interfaces.
+	ifaces map[string][]string
+	// Answers in the kernel ahead of the responders, if non-nil.
+	xdp *xdpResponder
+	// Where the interfaces to answer on come from.
+	intfs linkwatch.Interfaces
 
 	// This channel can block - do not write to it while holding the mutex
 	// to avoid deadlocking.
 	spamCh chan net.IP
 }
 
-// New returns an initialized Announce.
-func New(l log.Logger) (*Announce, error) {
+// New returns an initialized Announce, answering on the interfaces
+// of intfs, or of the system if nil.
+func New(l log.Logger, intfs linkwatch.Interfaces) (*Announce, error) {
+	return newAnnounce(l, intfs, nil), nil
+}
+
+// NewWithXDP returns an initialized Announce that answers requests in
+// the kernel, with an XDP program attached to each interface, and only
+// hands the requests the program can't answer to the userspace
+// responders.
+func NewWithXDP(l log.Logger, intfs linkwatch.Interfaces) (*Announce, error) {
+	x, err := newXDPResponder(l)
+	if err != nil {
+		return nil, fmt.Errorf("creating XDP responder: %s", err)
+	}
+	return newAnnounce(l, intfs, x), nil
+}
+
+func newAnnounce(l log.Logger, intfs linkwatch.Interfaces, x *xdpResponder) *Announce {
+	if intfs == nil {
+		intfs = linkwatch.System{}
+	}
 	ret := &Announce{
-		logger:   l,
-		arps:     map[int]*arpResponder{},
-		ndps:     map[int]*ndpResponder{},
-		ips:      map[string]net.IP{},
-		ipRefcnt: map[string]int{},
-		spamCh:   make(chan net.IP, 1024),
+		logger:    l,
+		arps:      map[int]*arpResponder{},
+		ndps:      map[int]*ndpResponder{},
+		ips:       map[string]net.IP{},
+		ipRefcnt:  map[string]int{},
+		xdpRefcnt: map[string]int{},
+		ifaces:    map[string][]string{},
+		spamCh:    make(chan net.IP, 1024),
+		xdp:       x,
+		intfs:     intfs,
 	}
 	go ret.interfaceScan()
 	go ret.spamLoop()
 
-	return ret, nil
+	return ret
 }
 
 func (a *Announce) interfaceScan() {
@@ -51,7 +89,7 @@ func (a *Announce) interfaceScan() {
 }
 
 func (a *Announce) updateInterfaces() {
-	ifs, err := net.Interfaces()
+	ifs, err := a.intfs.Interfaces()
 	if err != nil {
 		level.Error(a.logger).Log("op", "getInterfaces", "error", err, "msg", "couldn't list interfaces")
 		return
@@ -64,7 +102,7 @@ func (a *Announce) updateInterfaces() {
 	for _, intf := range ifs {
 		ifi := intf
 		l := log.With(a.logger, "interface", ifi.Name)
-		addrs, err := ifi.Addrs()
+		addrs, err := a.intfs.Addrs(&ifi)
 		if err != nil {
 			level.Error(l).Log("op", "getAddresses", "error", err, "msg", "couldn't get addresses for interface")
 			return
@@ -106,6 +144,14 @@ func (a *Announce) updateInterfaces() {
 				level.Error(l).Log("op", "createARPResponder", "error", err, "msg", "failed to create ARP responder")
 				return
 			}
+			for ip, n := range a.ipRefcnt {
+				if n == 0 {
+					continue
+				}
+				if err := resp.Watch(net.ParseIP(ip)); err != nil {
+					level.Error(l).Log("op", "watchARPRequests", "error", err, "ip", ip, "msg", "failed to filter ARP requests for IP")
+				}
+			}
 			a.arps[ifi.Index] = resp
 			level.Info(l).Log("event", "createARPResponder", "msg", "created ARP responder for interface")
 		}
@@ -118,6 +164,9 @@ func (a *Announce) updateInterfaces() {
 			a.ndps[ifi.Index] = resp
 			level.Info(l).Log("event", "createNDPResponder", "msg", "created NDP responder for interface")
 		}
+		if a.xdp != nil && (keepARP[ifi.Index] || keepNDP[ifi.Index]) {
+			a.xdp.attach(&ifi)
+		}
 	}
 
 	for i, client := range a.arps {
@@ -134,6 +183,18 @@ func (a *Announce) updateInterfaces() {
 			level.Info(a.logger).Log("interface", client.Interface(), "event", "deleteNDPResponder", "msg", "deleted NDP responder for interface")
 		}
 	}
+
+	if a.xdp != nil {
+		keep := map[int]bool{}
+		for i := range keepARP {
+			keep[i] = true
+		}
+		for i := range keepNDP {
+			keep[i] = true
+		}
+		a.xdp.detachAllBut(keep)
+		a.xdp.collectStats()
+	}
 }
 
 func (a *Announce) spamLoop() {
@@ -195,12 +256,18 @@ func (a *Announce) gratuitous(ip net.IP) error {
 	}
 	if ip.To4() != nil {
 		for _, client := range a.arps {
+			if !a.answersOn(client.Interface(), ip) {
+				continue
+			}
 			if err := client.Gratuitous(ip); err != nil {
 				return err
 			}
 		}
 	} else {
 		for _, client := range a.ndps {
+			if !a.answersOn(client.Interface(), ip) {
+				continue
+			}
 			if err := client.Gratuitous(ip); err != nil {
 				return err
 			}
@@ -209,30 +276,91 @@ func (a *Announce) gratuitous(ip net.IP) error {
 	return nil
 }
 
-func (a *Announce) shouldAnnounce(ip net.IP) dropReason {
+func (a *Announce) shouldAnnounce(intf string, ip net.IP) dropReason {
 	a.RLock()
 	defer a.RUnlock()
 	for _, i := range a.ips {
 		if i.Equal(ip) {
-			return dropReasonNone
+			if a.answersOn(intf, ip) {
+				return dropReasonNone
+			}
+			return dropReasonInterface
 		}
 	}
 	return dropReasonAnnounceIP
 }
 
-// SetBalancer adds ip to the set of announced addresses.
-func (a *Announce) SetBalancer(name string, ip net.IP) {
+// answersOn returns whether ip is announced on the interface intf,
+// by any of the services using it. a must be locked.
+func (a *Announce) answersOn(intf string, ip net.IP) bool {
+	for name, i := range a.ips {
+		if i.Equal(ip) && a.onInterface(name, intf) {
+			return true
+		}
+	}
+	return false
+}
+
+// onInterface returns whether the address announced under name is
+// answered for on the interface intf. a must be locked.
+func (a *Announce) onInterface(name, intf string) bool {
+	ifaces, ok := a.ifaces[name]
+	if !ok {
+		return true
+	}
+	for _, i := range ifaces {
+		if i == intf {
+			return true
+		}
+	}
+	return false
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetBalancer adds ip to the set of announced addresses. If
+// interfaces is not empty, ip is only announced on these interfaces.
+func (a *Announce) SetBalancer(name string, ip net.IP, interfaces []string) {
 	// Call doSpam at the end of the function without holding the lock
 	defer a.doSpam(ip)
 	a.Lock()
 	defer a.Unlock()
 
 	// Kubernetes may inform us that we should advertise this address multiple
-	// times, so just no-op any subsequent requests.
+	// times, so just no-op any subsequent requests, unless the
+	// interfaces changed with the config.
 	if _, ok := a.ips[name]; ok {
-		return
+		if equalStrings(a.ifaces[name], interfaces) {
+			return
+		}
+		a.deleteLocked(name)
 	}
 	a.ips[name] = ip
+	if len(interfaces) > 0 {
+		a.ifaces[name] = interfaces
+	}
+
+	// The XDP program answers on all the interfaces, so the
+	// addresses restricted to some are answered from userspace,
+	// unless another service uses them on all the interfaces.
+	if len(interfaces) == 0 {
+		a.xdpRefcnt[ip.String()]++
+		if a.xdp != nil && a.xdpRefcnt[ip.String()] == 1 {
+			if err := a.xdp.add(ip); err != nil {
+				level.Error(a.logger).Log("op", "setXDPResponder", "error", err, "ip", ip, "msg", "failed to add IP to XDP responder, answering from userspace only")
+			}
+		}
+	}
 
 	a.ipRefcnt[ip.String()]++
 	if a.ipRefcnt[ip.String()] > 1 {
@@ -240,7 +368,11 @@ func (a *Announce) SetBalancer(name string, ip net.IP) {
 		// else to do right now.
 		return
 	}
-
+	for _, client := range a.arps {
+		if err := client.Watch(ip); err != nil {
+			level.Error(a.logger).Log("op", "watchARPRequests", "error", err, "ip", ip, "msg", "failed to filter ARP requests for IP, ARP responder will not respond to requests for this address")
+		}
+	}
 	for _, client := range a.ndps {
 		if err := client.Watch(ip); err != nil {
 			level.Error(a.logger).Log("op", "watchMulticastGroup", "error", err, "ip", ip, "msg", "failed to watch NDP multicast group for IP, NDP responder will not respond to requests for this address")
@@ -252,12 +384,29 @@ func (a *Announce) SetBalancer(name string, ip net.IP) {
 func (a *Announce) DeleteBalancer(name string) {
 	a.Lock()
 	defer a.Unlock()
+	a.deleteLocked(name)
+}
 
+func (a *Announce) deleteLocked(name string) {
 	ip, ok := a.ips[name]
 	if !ok {
 		return
 	}
 	delete(a.ips, name)
+	_, restricted := a.ifaces[name]
+	delete(a.ifaces, name)
+
+	if !restricted {
+		a.xdpRefcnt[ip.String()]--
+		if a.xdpRefcnt[ip.String()] <= 0 {
+			delete(a.xdpRefcnt, ip.String())
+			if a.xdp != nil {
+				if err := a.xdp.remove(ip); err != nil {
+					level.Error(a.logger).Log("op", "setXDPResponder", "error", err, "ip", ip, "msg", "failed to remove IP from XDP responder")
+				}
+			}
+		}
+	}
 
 	a.ipRefcnt[ip.String()]--
 	if a.ipRefcnt[ip.String()] > 0 {
@@ -265,7 +414,11 @@ func (a *Announce) DeleteBalancer(name string) {
 		// more things.
 		return
 	}
-
+	for _, client := range a.arps {
+		if err := client.Unwatch(ip); err != nil {
+			level.Error(a.logger).Log("op", "unwatchARPRequests", "error", err, "ip", ip, "msg", "failed to stop filtering ARP requests for IP")
+		}
+	}
 	for _, client := range a.ndps {
 		if err := client.Unwatch(ip); err != nil {
 			level.Error(a.logger).Log("op", "unwatchMulticastGroup", "error", err, "ip", ip, "msg", "failed to unwatch NDP multicast group for IP")
@@ -274,6 +427,30 @@ func (a *Announce) DeleteBalancer(name string) {
 
 }
 
+// LinkUp refreshes the responders and re-sends gratuitous
+// announcements for all announced addresses, after the link of the
+// interface name came back up. Neighbors may have learned another
+// MAC for the addresses while the link was down.
+func (a *Announce) LinkUp(name string) {
+	a.updateInterfaces()
+
+	a.RLock()
+	ips := make([]net.IP, 0, len(a.ipRefcnt))
+	seen := map[string]bool{}
+	for _, ip := range a.ips {
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	a.RUnlock()
+
+	level.Info(a.logger).Log("event", "linkUp", "interface", name, "ips", len(ips), "msg", "re-announcing addresses after link up")
+	for _, ip := range ips {
+		a.doSpam(ip)
+	}
+}
+
 // AnnounceName returns true when we have an announcement under name.
 func (a *Announce) AnnounceName(name string) bool {
 	a.RLock()
@@ -282,6 +459,33 @@ func (a *Announce) AnnounceName(name string) bool {
 	return ok
 }
 
+// Interfaces returns the interfaces on which the address announced
+// under name is answered for, sorted.
+func (a *Announce) Interfaces(name string) []string {
+	a.RLock()
+	defer a.RUnlock()
+	ip, ok := a.ips[name]
+	if !ok {
+		return nil
+	}
+	var ret []string
+	if ip.To4() != nil {
+		for _, client := range a.arps {
+			if a.onInterface(name, client.Interface()) {
+				ret = append(ret, client.Interface())
+			}
+		}
+	} else {
+		for _, client := range a.ndps {
+			if a.onInterface(name, client.Interface()) {
+				ret = append(ret, client.Interface())
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 // dropReason is the reason why a layer2 protocol packet was not
 // responded to.
 type dropReason int
@@ -296,4 +500,6 @@ const (
 	dropReasonNoSourceLL
 	dropReasonEthernetDestination
 	dropReasonAnnounceIP
+	dropReasonInterface
+	dropReasonMalformed
 )
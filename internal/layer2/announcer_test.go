@@ -7,9 +7,10 @@ import (
 
 func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 	announce := &Announce{
-		ips:      map[string]net.IP{},
-		ipRefcnt: map[string]int{},
-		spamCh:   make(chan net.IP, 1),
+		ips:       map[string]net.IP{},
+		ipRefcnt:  map[string]int{},
+		xdpRefcnt: map[string]int{},
+		spamCh:    make(chan net.IP, 1),
 	}
 
 	services := []struct {
@@ -27,7 +28,7 @@ func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 	}
 
 	for _, service := range services {
-		announce.SetBalancer(service.name, service.ip)
+		announce.SetBalancer(service.name, service.ip, nil)
 		// We need to empty spamCh as spamLoop() is not started.
 		<-announce.spamCh
 
@@ -36,3 +37,84 @@ func Test_SetBalancer_AddsToAnnouncedServices(t *testing.T) {
 		}
 	}
 }
+
+func TestShouldAnnounceInterfaces(t *testing.T) {
+	announce := &Announce{
+		ips:       map[string]net.IP{},
+		ipRefcnt:  map[string]int{},
+		xdpRefcnt: map[string]int{},
+		ifaces:    map[string][]string{},
+		spamCh:    make(chan net.IP, 3),
+	}
+	announce.SetBalancer("all", net.IPv4(192, 168, 1, 20), nil)
+	announce.SetBalancer("eth1", net.IPv4(192, 168, 1, 21), []string{"eth1"})
+
+	tests := []struct {
+		intf string
+		ip   net.IP
+		want dropReason
+	}{
+		{"eth0", net.IPv4(192, 168, 1, 20), dropReasonNone},
+		{"eth1", net.IPv4(192, 168, 1, 20), dropReasonNone},
+		{"eth0", net.IPv4(192, 168, 1, 21), dropReasonInterface},
+		{"eth1", net.IPv4(192, 168, 1, 21), dropReasonNone},
+		{"eth1", net.IPv4(192, 168, 1, 22), dropReasonAnnounceIP},
+	}
+	for _, test := range tests {
+		if got := announce.shouldAnnounce(test.intf, test.ip); got != test.want {
+			t.Errorf("%s on %s: got drop reason %d, want %d", test.ip, test.intf, got, test.want)
+		}
+	}
+
+	// The interfaces follow the config.
+	announce.SetBalancer("eth1", net.IPv4(192, 168, 1, 21), []string{"eth0"})
+	if got := announce.shouldAnnounce("eth0", net.IPv4(192, 168, 1, 21)); got != dropReasonNone {
+		t.Errorf("address not announced on its new interface, got drop reason %d", got)
+	}
+	if got := announce.ipRefcnt["192.168.1.21"]; got != 1 {
+		t.Errorf("got refcount %d after changing interfaces, want 1", got)
+	}
+
+	announce.DeleteBalancer("eth1")
+	if _, ok := announce.ifaces["eth1"]; ok {
+		t.Error("interfaces of deleted balancer not forgotten")
+	}
+}
+
+func TestXDPRefcount(t *testing.T) {
+	announce := &Announce{
+		ips:       map[string]net.IP{},
+		ipRefcnt:  map[string]int{},
+		xdpRefcnt: map[string]int{},
+		ifaces:    map[string][]string{},
+		spamCh:    make(chan net.IP, 4),
+	}
+	ip := net.IPv4(192, 168, 1, 20)
+
+	// Shared between a service on all the interfaces, and one
+	// restricted to some.
+	announce.SetBalancer("all", ip, nil)
+	announce.SetBalancer("eth1", ip, []string{"eth1"})
+	if got := announce.xdpRefcnt[ip.String()]; got != 1 {
+		t.Errorf("got XDP refcount %d, want 1", got)
+	}
+	announce.DeleteBalancer("eth1")
+	if got := announce.xdpRefcnt[ip.String()]; got != 1 {
+		t.Errorf("got XDP refcount %d after deleting the restricted service, want 1", got)
+	}
+	announce.DeleteBalancer("all")
+	if _, ok := announce.xdpRefcnt[ip.String()]; ok {
+		t.Error("address still answered by XDP after deleting its services")
+	}
+
+	// The other way around.
+	announce.SetBalancer("eth1", ip, []string{"eth1"})
+	announce.SetBalancer("all", ip, nil)
+	if got := announce.xdpRefcnt[ip.String()]; got != 1 {
+		t.Errorf("got XDP refcount %d when added after the restricted service, want 1", got)
+	}
+	announce.DeleteBalancer("all")
+	if _, ok := announce.xdpRefcnt[ip.String()]; ok {
+		t.Error("address restricted to some interfaces still answered by XDP")
+	}
+}
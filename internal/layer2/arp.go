@@ -2,29 +2,61 @@ package layer2
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/mdlayher/arp"
 	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+	"golang.org/x/net/bpf"
 )
 
-type announceFunc func(net.IP) dropReason
+// The responder handles ARP for IPv4 over Ethernet only, in frames
+// laid out as the XDP program's.
+const (
+	arpOpRequest = 1
+	arpOpReply   = 2
+	// Past this many watched IPs, the socket filter lets through all
+	// the requests, to stay clear of the limits on its jumps.
+	maxFilteredIPs = 200
+)
+
+// arpHeaderBytes is the fixed ARP header for IPv4 over Ethernet.
+var arpHeaderBytes = []byte{0, 1, 8, 0, 6, 4}
+
+type announceFunc func(string, net.IP) dropReason
 
+// arpResponder answers the ARP requests for the watched IPs. It reads
+// and writes raw frames instead of going through arp.Client: the
+// socket filter only lets through the requests for the watched IPs,
+// and the replies are copies of a frame built once per IP, with the
+// requester's addresses patched in. Busy segments carry a lot of
+// broadcast ARP traffic that would otherwise all be parsed.
 type arpResponder struct {
 	logger       log.Logger
 	intf         string
 	hardwareAddr net.HardwareAddr
-	conn         *arp.Client
+	conn         net.PacketConn
 	closed       chan struct{}
 	announce     announceFunc
+
+	mu sync.Mutex
+	// Refcount of the watches of each IP, and its reply frame.
+	watched map[string]int
+	replies map[string][]byte
 }
 
 func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*arpResponder, error) {
-	client, err := arp.Dial(ifi)
+	filter, err := arpFilter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating ARP responder for %q: %s", ifi.Name, err)
+	}
+	conn, err := raw.ListenPacket(ifi, uint16(ethernet.EtherTypeARP), &raw.Config{Filter: filter})
 	if err != nil {
 		return nil, fmt.Errorf("creating ARP responder for %q: %s", ifi.Name, err)
 	}
@@ -33,9 +65,11 @@ func newARPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 		logger:       logger,
 		intf:         ifi.Name,
 		hardwareAddr: ifi.HardwareAddr,
-		conn:         client,
+		conn:         conn,
 		closed:       make(chan struct{}),
 		announce:     ann,
+		watched:      map[string]int{},
+		replies:      map[string][]byte{},
 	}
 	go ret.run()
 	return ret, nil
@@ -54,7 +88,21 @@ func (a *arpResponder) Gratuitous(ip net.IP) error {
 		if err != nil {
 			return fmt.Errorf("assembling %q gratuitous packet for %q: %s", op, ip, err)
 		}
-		if err = a.conn.WriteTo(pkt, ethernet.Broadcast); err != nil {
+		pb, err := pkt.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("assembling %q gratuitous packet for %q: %s", op, ip, err)
+		}
+		f := &ethernet.Frame{
+			Destination: ethernet.Broadcast,
+			Source:      a.hardwareAddr,
+			EtherType:   ethernet.EtherTypeARP,
+			Payload:     pb,
+		}
+		fb, err := f.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("assembling %q gratuitous packet for %q: %s", op, ip, err)
+		}
+		if _, err = a.conn.WriteTo(fb, &raw.Addr{HardwareAddr: ethernet.Broadcast}); err != nil {
 			return fmt.Errorf("writing %q gratuitous packet for %q: %s", op, ip, err)
 		}
 		stats.SentGratuitous(ip.String())
@@ -62,16 +110,135 @@ func (a *arpResponder) Gratuitous(ip net.IP) error {
 	return nil
 }
 
+// Watch makes the responder receive the requests for ip, and builds
+// its reply.
+func (a *arpResponder) Watch(ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.watched[ip4.String()]++
+	if a.watched[ip4.String()] > 1 {
+		return nil
+	}
+	a.replies[ip4.String()] = arpReplyTemplate(a.hardwareAddr, ip4)
+	return a.setFilter()
+}
+
+// Unwatch undoes Watch.
+func (a *arpResponder) Unwatch(ip net.IP) error {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.watched[ip4.String()]--
+	if a.watched[ip4.String()] > 0 {
+		return nil
+	}
+	delete(a.watched, ip4.String())
+	delete(a.replies, ip4.String())
+	return a.setFilter()
+}
+
+// setFilter updates the socket filter to the watched IPs. Connections
+// that can't take filters, in tests, get everything.
+func (a *arpResponder) setFilter() error {
+	c, ok := a.conn.(interface {
+		SetBPF([]bpf.RawInstruction) error
+	})
+	if !ok {
+		return nil
+	}
+	var ips []net.IP
+	for ip := range a.watched {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	filter, err := arpFilter(ips)
+	if err != nil {
+		return err
+	}
+	if err := c.SetBPF(filter); err != nil {
+		return fmt.Errorf("setting ARP socket filter: %s", err)
+	}
+	return nil
+}
+
+// arpFilter returns a socket filter accepting the ARP requests for
+// ips, or for any IP if there are too many of them to list.
+func arpFilter(ips []net.IP) ([]bpf.RawInstruction, error) {
+	prog := []bpf.Instruction{
+		bpf.LoadAbsolute{Off: arpOp, Size: 2},
+	}
+	if len(ips) > maxFilteredIPs {
+		prog = append(prog,
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: arpOpRequest, SkipTrue: 1},
+			bpf.RetConstant{Val: arpFrameSize},
+			bpf.RetConstant{Val: 0},
+		)
+		return bpf.Assemble(prog)
+	}
+	// Each IP jumps over the following ones and the drop to the
+	// accept.
+	prog = append(prog,
+		bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: arpOpRequest, SkipTrue: uint8(len(ips) + 1)},
+		bpf.LoadAbsolute{Off: arpTargetIP, Size: 4},
+	)
+	for i, ip := range ips {
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: binary.BigEndian.Uint32(ip.To4()), SkipTrue: uint8(len(ips) - i)})
+	}
+	prog = append(prog,
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: arpFrameSize},
+	)
+	return bpf.Assemble(prog)
+}
+
+// arpReplyTemplate returns the frame answering for ip from hwAddr,
+// without the requester's addresses.
+func arpReplyTemplate(hwAddr net.HardwareAddr, ip net.IP) []byte {
+	b := make([]byte, arpFrameSize)
+	copy(b[ethSrc:], hwAddr)
+	binary.BigEndian.PutUint16(b[ethType:], uint16(ethernet.EtherTypeARP))
+	copy(b[arpHeader:], arpHeaderBytes)
+	binary.BigEndian.PutUint16(b[arpOp:], arpOpReply)
+	copy(b[arpSenderHW:], hwAddr)
+	copy(b[arpSenderIP:], ip.To4())
+	return b
+}
+
+// reply returns the reply to a request from mac and ip for target.
+func (a *arpResponder) reply(target net.IP, mac net.HardwareAddr, ip net.IP) []byte {
+	a.mu.Lock()
+	tmpl := a.replies[target.String()]
+	a.mu.Unlock()
+	if tmpl == nil {
+		// The announcer can know the IP before the responder watches
+		// it.
+		tmpl = arpReplyTemplate(a.hardwareAddr, target)
+	}
+	b := make([]byte, len(tmpl))
+	copy(b, tmpl)
+	copy(b[ethDst:], mac)
+	copy(b[arpTargetHW:], mac)
+	copy(b[arpTargetIP:], ip)
+	return b
+}
+
 func (a *arpResponder) run() {
-	for a.processRequest() != dropReasonClosed {
+	buf := make([]byte, 128)
+	for a.processRequest(buf) != dropReasonClosed {
 	}
 }
 
-func (a *arpResponder) processRequest() dropReason {
-	pkt, eth, err := a.conn.Read()
+func (a *arpResponder) processRequest(buf []byte) dropReason {
+	n, _, err := a.conn.ReadFrom(buf)
 	if err != nil {
-		// ARP listener doesn't cleanly return EOF when closed, so we
-		// need to hook into the call to arpResponder.Close()
+		// The raw socket doesn't cleanly return EOF when closed, so
+		// we need to hook into the call to arpResponder.Close()
 		// independently.
 		select {
 		case <-a.closed:
@@ -83,29 +250,38 @@ func (a *arpResponder) processRequest() dropReason {
 		}
 		return dropReasonError
 	}
+	frame := buf[:n]
+	if n < arpFrameSize || binary.BigEndian.Uint16(frame[ethType:]) != uint16(ethernet.EtherTypeARP) || !bytes.Equal(frame[arpHeader:arpOp], arpHeaderBytes) {
+		return dropReasonMalformed
+	}
 
 	// Ignore ARP replies.
-	if pkt.Operation != arp.OperationRequest {
+	if binary.BigEndian.Uint16(frame[arpOp:]) != arpOpRequest {
 		return dropReasonARPReply
 	}
 
 	// Ignore ARP requests which are not broadcast or bound directly for this machine.
-	if !bytes.Equal(eth.Destination, ethernet.Broadcast) && !bytes.Equal(eth.Destination, a.hardwareAddr) {
+	dst := net.HardwareAddr(frame[ethDst:ethSrc])
+	if !bytes.Equal(dst, ethernet.Broadcast) && !bytes.Equal(dst, a.hardwareAddr) {
 		return dropReasonEthernetDestination
 	}
 
+	target := net.IP(frame[arpTargetIP : arpTargetIP+4])
+	senderMAC := net.HardwareAddr(frame[arpSenderHW:arpSenderIP])
+	senderIP := net.IP(frame[arpSenderIP:arpTargetHW])
+
 	// Ignore ARP requests that the announcer tells us to ignore.
-	if reason := a.announce(pkt.TargetIP); reason != dropReasonNone {
+	if reason := a.announce(a.intf, target); reason != dropReasonNone {
 		return reason
 	}
 
-	stats.GotRequest(pkt.TargetIP.String())
-	level.Debug(a.logger).Log("interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.hardwareAddr, "msg", "got ARP request for service IP, sending response")
+	stats.GotRequest(target.String())
+	level.Debug(a.logger).Log("interface", a.intf, "ip", target, "senderIP", senderIP, "senderMAC", senderMAC, "responseMAC", a.hardwareAddr, "msg", "got ARP request for service IP, sending response")
 
-	if err := a.conn.Reply(pkt, a.hardwareAddr, pkt.TargetIP); err != nil {
-		level.Error(a.logger).Log("op", "arpReply", "interface", a.intf, "ip", pkt.TargetIP, "senderIP", pkt.SenderIP, "senderMAC", pkt.SenderHardwareAddr, "responseMAC", a.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
+	if _, err := a.conn.WriteTo(a.reply(target, senderMAC, senderIP), &raw.Addr{HardwareAddr: senderMAC}); err != nil {
+		level.Error(a.logger).Log("op", "arpReply", "interface", a.intf, "ip", target, "senderIP", senderIP, "senderMAC", senderMAC, "responseMAC", a.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
 	} else {
-		stats.SentResponse(pkt.TargetIP.String())
+		stats.SentResponse(target.String())
 	}
 	return dropReasonNone
 }
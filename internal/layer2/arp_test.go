@@ -10,6 +10,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/mdlayher/arp"
 	"github.com/mdlayher/ethernet"
+	"golang.org/x/net/bpf"
 )
 
 func TestARPResponder(t *testing.T) {
@@ -42,7 +43,7 @@ func TestARPResponder(t *testing.T) {
 		},
 		{
 			name: "shouldAnnounce denies request",
-			shouldAnnounce: func(ip net.IP) dropReason {
+			shouldAnnounce: func(_ string, ip net.IP) dropReason {
 				if net.IPv4(192, 168, 1, 20).Equal(ip) {
 					return dropReasonNone
 				}
@@ -53,7 +54,7 @@ func TestARPResponder(t *testing.T) {
 		{
 			name:   "shouldAnnounce allows request",
 			arpTgt: net.IPv4(192, 168, 1, 20),
-			shouldAnnounce: func(ip net.IP) dropReason {
+			shouldAnnounce: func(_ string, ip net.IP) dropReason {
 				if net.IPv4(192, 168, 1, 20).Equal(ip) {
 					return dropReasonNone
 				}
@@ -67,7 +68,7 @@ func TestARPResponder(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			shouldAnnounce := tt.shouldAnnounce
 			if shouldAnnounce == nil {
-				shouldAnnounce = func(net.IP) dropReason {
+				shouldAnnounce = func(string, net.IP) dropReason {
 					return dropReasonNone
 				}
 			}
@@ -100,7 +101,7 @@ func TestARPResponder(t *testing.T) {
 
 			dropC := make(chan dropReason)
 			go func() {
-				dropC <- a.processRequest()
+				dropC <- a.processRequest(make([]byte, 128))
 			}()
 
 			// Send a packet to receiver goroutine.
@@ -116,6 +117,103 @@ func TestARPResponder(t *testing.T) {
 	}
 }
 
+func TestARPFilter(t *testing.T) {
+	mac := net.HardwareAddr{1, 2, 3, 4, 5, 6}
+	request := func(op arp.Operation, target net.IP) []byte {
+		pkt, err := arp.NewPacket(op, mac, net.IPv4(192, 168, 1, 1), ethernet.Broadcast, target)
+		if err != nil {
+			t.Fatalf("failed to make ARP packet: %s", err)
+		}
+		return mustMarshal(&ethernet.Frame{
+			Destination: ethernet.Broadcast,
+			Source:      mac,
+			EtherType:   ethernet.EtherTypeARP,
+			Payload:     mustMarshal(pkt),
+		})
+	}
+	watched := []net.IP{net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 20)}
+	many := make([]net.IP, maxFilteredIPs+1)
+	for i := range many {
+		many[i] = net.IPv4(10, 0, byte(i>>8), byte(i))
+	}
+
+	tests := []struct {
+		desc  string
+		ips   []net.IP
+		frame []byte
+		want  bool
+	}{
+		{"watched IP", watched, request(arp.OperationRequest, net.IPv4(192, 168, 1, 20)), true},
+		{"first watched IP", watched, request(arp.OperationRequest, net.IPv4(192, 168, 1, 10)), true},
+		{"other IP", watched, request(arp.OperationRequest, net.IPv4(192, 168, 1, 30)), false},
+		{"reply", watched, request(arp.OperationReply, net.IPv4(192, 168, 1, 10)), false},
+		{"no watched IP", nil, request(arp.OperationRequest, net.IPv4(192, 168, 1, 10)), false},
+		{"too many IPs to list", many, request(arp.OperationRequest, net.IPv4(192, 168, 1, 30)), true},
+		{"reply with too many IPs to list", many, request(arp.OperationReply, net.IPv4(192, 168, 1, 30)), false},
+	}
+	for _, test := range tests {
+		raw, err := arpFilter(test.ips)
+		if err != nil {
+			t.Fatalf("%s: assembling filter: %s", test.desc, err)
+		}
+		insns := make([]bpf.Instruction, len(raw))
+		for i, r := range raw {
+			insns[i] = r.Disassemble()
+		}
+		vm, err := bpf.NewVM(insns)
+		if err != nil {
+			t.Fatalf("%s: loading filter: %s", test.desc, err)
+		}
+		n, err := vm.Run(test.frame)
+		if err != nil {
+			t.Fatalf("%s: running filter: %s", test.desc, err)
+		}
+		if got := n > 0; got != test.want {
+			t.Errorf("%s: filter accepted the frame %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestARPReply(t *testing.T) {
+	a := &arpResponder{
+		hardwareAddr: net.HardwareAddr{6, 5, 4, 3, 2, 1},
+		watched:      map[string]int{},
+		replies:      map[string][]byte{},
+	}
+	ip := net.IPv4(192, 168, 1, 10)
+	if err := a.Watch(ip); err != nil {
+		t.Fatalf("Watch: %s", err)
+	}
+	senderMAC, senderIP := net.HardwareAddr{1, 2, 3, 4, 5, 6}, net.IPv4(192, 168, 1, 1).To4()
+	// Unwatched IPs get answered all the same.
+	for _, target := range []net.IP{ip.To4(), net.IPv4(192, 168, 1, 20).To4()} {
+		var f ethernet.Frame
+		if err := f.UnmarshalBinary(a.reply(target, senderMAC, senderIP)); err != nil {
+			t.Fatalf("reply for %s isn't an Ethernet frame: %s", target, err)
+		}
+		var pkt arp.Packet
+		if err := pkt.UnmarshalBinary(f.Payload); err != nil {
+			t.Fatalf("reply for %s isn't an ARP packet: %s", target, err)
+		}
+		want, err := arp.NewPacket(arp.OperationReply, a.hardwareAddr, target, senderMAC, senderIP)
+		if err != nil {
+			t.Fatalf("failed to make ARP packet: %s", err)
+		}
+		if diff := cmp.Diff(want, &pkt); diff != "" {
+			t.Errorf("wrong reply for %s (-want +got)\n%s", target, diff)
+		}
+		if f.Destination.String() != senderMAC.String() || f.Source.String() != a.hardwareAddr.String() {
+			t.Errorf("reply for %s sent from %s to %s, want from %s to %s", target, f.Source, f.Destination, a.hardwareAddr, senderMAC)
+		}
+	}
+	if err := a.Unwatch(ip); err != nil {
+		t.Fatalf("Unwatch: %s", err)
+	}
+	if len(a.replies) != 0 {
+		t.Errorf("replies %v left after unwatching", a.replies)
+	}
+}
+
 func mustMarshal(m encoding.BinaryMarshaler) []byte {
 	b, err := m.MarshalBinary()
 	if err != nil {
@@ -149,18 +247,14 @@ func newTestARP(t *testing.T, shouldAnnounce announceFunc) (*arpResponder, *net.
 			continue
 		}
 
-		var c *arp.Client
-		c, err = arp.New(&intf, pc)
-		if err != nil {
-			t.Fatalf("failed to create ARP client: %s", err)
-		}
-
 		a = &arpResponder{
 			logger:       log.NewNopLogger(),
 			hardwareAddr: intf.HardwareAddr,
-			conn:         c,
+			conn:         pc,
 			closed:       make(chan struct{}),
 			announce:     shouldAnnounce,
+			watched:      map[string]int{},
+			replies:      map[string][]byte{},
 		}
 	}
 
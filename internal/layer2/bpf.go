@@ -0,0 +1,313 @@
+package layer2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Just enough eBPF to run the XDP responder: an assembler for the
+// instructions it uses, and the bpf(2) commands to load it and manage
+// its maps.
+
+// Instruction classes, sizes, modes and operations.
+const (
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+	bpfLD    = 0x00
+
+	bpfW  = 0x00
+	bpfB  = 0x10
+	bpfDW = 0x18
+
+	bpfIMM  = 0x00
+	bpfMEM  = 0x60
+	bpfXADD = 0xc0
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD = 0x00
+	bpfOR  = 0x40
+	bpfAND = 0x50
+	bpfLSH = 0x60
+	bpfRSH = 0x70
+	bpfXOR = 0xa0
+	bpfMOV = 0xb0
+
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJNE  = 0x50
+	bpfJA   = 0x00
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+)
+
+// bpf(2) commands, and the constants they take.
+const (
+	bpfMapCreate     = 0
+	bpfMapLookupElem = 1
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfMapGetNextKey = 4
+	bpfProgLoad      = 5
+	bpfProgTestRun   = 10
+	bpfLinkCreate    = 28
+
+	bpfMapTypeHash   = 1
+	bpfProgTypeXDP   = 6
+	bpfAttachXDP     = 37
+	bpfFNoPrealloc   = 1
+	bpfPseudoMapFD   = 1
+	bpfFuncMapLookup = 1
+
+	xdpPass = 2
+	xdpTX   = 3
+)
+
+// nativeEndian is the byte order of the kernel, in which it reads
+// instructions.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+type bpfInsn struct {
+	op       uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	// Label of the jump target, resolved by assemble.
+	target string
+}
+
+// bpfAsm assembles an eBPF program.
+type bpfAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+}
+
+func (a *bpfAsm) emit(op, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{op: op, dst: dst, src: src, off: off, imm: imm})
+}
+
+// label names the next instruction.
+func (a *bpfAsm) label(name string) {
+	if a.labels == nil {
+		a.labels = map[string]int{}
+	}
+	a.labels[name] = len(a.insns)
+}
+
+// alu emits dst op= imm.
+func (a *bpfAsm) alu(op, dst uint8, imm int32) { a.emit(bpfALU64|op|bpfK, dst, 0, 0, imm) }
+
+// aluReg emits dst op= src.
+func (a *bpfAsm) aluReg(op, dst, src uint8) { a.emit(bpfALU64|op|bpfX, dst, src, 0, 0) }
+
+// ldxB loads the byte at src+off into dst.
+func (a *bpfAsm) ldxB(dst, src uint8, off int16) { a.emit(bpfLDX|bpfMEM|bpfB, dst, src, off, 0) }
+
+// ldxW loads the 32-bit word at src+off into dst.
+func (a *bpfAsm) ldxW(dst, src uint8, off int16) { a.emit(bpfLDX|bpfMEM|bpfW, dst, src, off, 0) }
+
+// stxB stores the low byte of src at dst+off.
+func (a *bpfAsm) stxB(dst uint8, off int16, src uint8) { a.emit(bpfSTX|bpfMEM|bpfB, dst, src, off, 0) }
+
+// stB stores the byte imm at dst+off.
+func (a *bpfAsm) stB(dst uint8, off int16, imm byte) {
+	a.emit(bpfST|bpfMEM|bpfB, dst, 0, off, int32(imm))
+}
+
+// xaddDW atomically adds src to the 64-bit word at dst+off.
+func (a *bpfAsm) xaddDW(dst uint8, off int16, src uint8) {
+	a.emit(bpfSTX|bpfXADD|bpfDW, dst, src, off, 0)
+}
+
+// jmp jumps to target if dst op imm.
+func (a *bpfAsm) jmp(op, dst uint8, imm int32, target string) {
+	a.insns = append(a.insns, bpfInsn{op: bpfJMP | op | bpfK, dst: dst, imm: imm, target: target})
+}
+
+// jmpReg jumps to target if dst op src.
+func (a *bpfAsm) jmpReg(op, dst, src uint8, target string) {
+	a.insns = append(a.insns, bpfInsn{op: bpfJMP | op | bpfX, dst: dst, src: src, target: target})
+}
+
+// ja jumps to target.
+func (a *bpfAsm) ja(target string) {
+	a.insns = append(a.insns, bpfInsn{op: bpfJMP | bpfJA, target: target})
+}
+
+// ldMap loads the map fd into dst.
+func (a *bpfAsm) ldMap(dst uint8, fd int) {
+	a.emit(bpfLD|bpfDW|bpfIMM, dst, bpfPseudoMapFD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+func (a *bpfAsm) call(fn int32) { a.emit(bpfJMP|bpfCALL, 0, 0, 0, fn) }
+
+func (a *bpfAsm) exit() { a.emit(bpfJMP|bpfEXIT, 0, 0, 0, 0) }
+
+// assemble resolves the jumps, and returns the program in the format
+// the kernel loads.
+func (a *bpfAsm) assemble() ([]byte, error) {
+	var buf bytes.Buffer
+	for pc, insn := range a.insns {
+		if insn.target != "" {
+			to, ok := a.labels[insn.target]
+			if !ok {
+				return nil, fmt.Errorf("undefined label %q", insn.target)
+			}
+			insn.off = int16(to - pc - 1)
+		}
+		regs := insn.dst | insn.src<<4
+		if nativeEndian == binary.BigEndian {
+			regs = insn.dst<<4 | insn.src
+		}
+		buf.WriteByte(insn.op)
+		buf.WriteByte(regs)
+		binary.Write(&buf, nativeEndian, insn.off) // nolint:errcheck
+		binary.Write(&buf, nativeEndian, insn.imm) // nolint:errcheck
+	}
+	return buf.Bytes(), nil
+}
+
+// bpfPtr is a pointer in a bpf(2) attribute, which are always 64
+// bits wide. The pointer goes in the first element, the second one,
+// on 32-bit platforms, is the zero upper half.
+type bpfPtr [8 / unsafe.Sizeof(uintptr(0))]unsafe.Pointer
+
+func newBPFPtr(b []byte) bpfPtr {
+	if len(b) == 0 {
+		return bpfPtr{}
+	}
+	return bpfPtr{unsafe.Pointer(&b[0])}
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// bpfMap is a BPF hash map.
+type bpfMap struct {
+	fd        int
+	keySize   int
+	valueSize int
+}
+
+func newBPFMap(keySize, valueSize, maxEntries int) (*bpfMap, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, flags uint32
+	}{bpfMapTypeHash, uint32(keySize), uint32(valueSize), uint32(maxEntries), bpfFNoPrealloc}
+	fd, err := bpfCall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("creating BPF map: %s", err)
+	}
+	return &bpfMap{fd, keySize, valueSize}, nil
+}
+
+type bpfMapElemAttr struct {
+	fd    uint32
+	_     uint32
+	key   bpfPtr
+	value bpfPtr
+	flags uint64
+}
+
+func (m *bpfMap) elem(cmd int, key, value []byte) error {
+	attr := bpfMapElemAttr{fd: uint32(m.fd), key: newBPFPtr(key), value: newBPFPtr(value)}
+	_, err := bpfCall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Lookup reads the value of key into value.
+func (m *bpfMap) Lookup(key, value []byte) error { return m.elem(bpfMapLookupElem, key, value) }
+
+// Put sets the value of key.
+func (m *bpfMap) Put(key, value []byte) error { return m.elem(bpfMapUpdateElem, key, value) }
+
+// Delete deletes key.
+func (m *bpfMap) Delete(key []byte) error { return m.elem(bpfMapDeleteElem, key, nil) }
+
+// Keys returns all the keys of the map.
+func (m *bpfMap) Keys() ([][]byte, error) {
+	var (
+		ret [][]byte
+		key []byte
+	)
+	for {
+		next := make([]byte, m.keySize)
+		if err := m.elem(bpfMapGetNextKey, key, next); err == unix.ENOENT {
+			return ret, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ret = append(ret, next)
+		key = next
+	}
+}
+
+// Close releases the map.
+func (m *bpfMap) Close() error { return unix.Close(m.fd) }
+
+// loadXDP loads an XDP program, and returns its fd.
+func loadXDP(insns []byte) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, 64*1024)
+	attr := struct {
+		progType, insnCnt  uint32
+		insns, license     bpfPtr
+		logLevel, logSize  uint32
+		logBuf             bpfPtr
+		kernVersion, flags uint32
+		name               [16]byte
+		ifindex            uint32
+		expectedAttachType uint32
+	}{
+		progType:           bpfProgTypeXDP,
+		insnCnt:            uint32(len(insns) / 8),
+		insns:              newBPFPtr(insns),
+		license:            newBPFPtr(license),
+		logLevel:           1,
+		logSize:            uint32(len(log)),
+		logBuf:             newBPFPtr(log),
+		expectedAttachType: bpfAttachXDP,
+	}
+	copy(attr.name[:], "metallb_l2")
+	fd, err := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return 0, fmt.Errorf("loading XDP program: %s: %s", err, log[:n])
+		}
+		return 0, fmt.Errorf("loading XDP program: %s", err)
+	}
+	return fd, nil
+}
+
+// attachXDP attaches the XDP program prog to the interface ifindex,
+// and returns the fd of the attachment. The program stays attached
+// until the fd is closed.
+func attachXDP(prog, ifindex int) (int, error) {
+	attr := struct {
+		progFD, ifindex, attachType, flags uint32
+	}{uint32(prog), uint32(ifindex), bpfAttachXDP, 0}
+	fd, err := bpfCall(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return 0, fmt.Errorf("attaching XDP program: %s", err)
+	}
+	return fd, nil
+}
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/mdlayher/ndp"
+	"golang.org/x/net/ipv6"
 )
 
 type ndpResponder struct {
@@ -20,6 +22,12 @@ type ndpResponder struct {
 	// Refcount of how many watchers for each solicited node
 	// multicast group.
 	solicitedNodeGroups map[string]int64
+
+	mu sync.Mutex
+	// Refcount of the watches of each IP, and the advertisement
+	// answering its solicitations.
+	watched map[string]int
+	adverts map[string]*ndp.NeighborAdvertisement
 }
 
 func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*ndpResponder, error) {
@@ -28,6 +36,15 @@ func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 	if err != nil {
 		return nil, fmt.Errorf("creating NDP responder for %q: %s", ifi.Name, err)
 	}
+	// Only neighbor solicitations concern the responder, leave the
+	// rest of the ICMPv6 traffic in the kernel.
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeNeighborSolicitation)
+	if err = conn.SetICMPFilter(&filter); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("creating NDP responder for %q: setting ICMPv6 filter: %s", ifi.Name, err)
+	}
 
 	ret := &ndpResponder{
 		logger:              logger,
@@ -37,6 +54,8 @@ func newNDPResponder(logger log.Logger, ifi *net.Interface, ann announceFunc) (*
 		closed:              make(chan struct{}),
 		announce:            ann,
 		solicitedNodeGroups: map[string]int64{},
+		watched:             map[string]int{},
+		adverts:             map[string]*ndp.NeighborAdvertisement{},
 	}
 	go ret.run()
 	return ret, nil
@@ -69,6 +88,13 @@ func (n *ndpResponder) Watch(ip net.IP) error {
 		}
 	}
 	n.solicitedNodeGroups[group.String()]++
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.watched[ip.String()]++
+	if n.watched[ip.String()] == 1 {
+		n.adverts[ip.String()] = n.advertisement(ip, false)
+	}
 	return nil
 }
 
@@ -80,6 +106,14 @@ func (n *ndpResponder) Unwatch(ip net.IP) error {
 	if err != nil {
 		return fmt.Errorf("looking up solicited node multicast group for %q: %s", ip, err)
 	}
+	n.mu.Lock()
+	n.watched[ip.String()]--
+	if n.watched[ip.String()] <= 0 {
+		delete(n.watched, ip.String())
+		delete(n.adverts, ip.String())
+	}
+	n.mu.Unlock()
+
 	n.solicitedNodeGroups[group.String()]--
 	if n.solicitedNodeGroups[group.String()] == 0 {
 		if err = n.conn.LeaveGroup(group); err != nil {
@@ -90,12 +124,13 @@ func (n *ndpResponder) Unwatch(ip net.IP) error {
 }
 
 func (n *ndpResponder) run() {
-	for n.processRequest() != dropReasonClosed {
+	buf := make([]byte, 1500)
+	for n.processRequest(buf) != dropReasonClosed {
 	}
 }
 
-func (n *ndpResponder) processRequest() dropReason {
-	msg, _, src, err := n.conn.ReadFrom()
+func (n *ndpResponder) processRequest(buf []byte) dropReason {
+	size, _, src, err := n.conn.ReadRaw(buf)
 	if err != nil {
 		select {
 		case <-n.closed:
@@ -107,6 +142,10 @@ func (n *ndpResponder) processRequest() dropReason {
 		}
 		return dropReasonError
 	}
+	msg, err := ndp.ParseMessage(buf[:size])
+	if err != nil {
+		return dropReasonMalformed
+	}
 
 	ns, ok := msg.(*ndp.NeighborSolicitation)
 	if !ok {
@@ -133,14 +172,20 @@ func (n *ndpResponder) processRequest() dropReason {
 	}
 
 	// Ignore NDP requests that the announcer tells us to ignore.
-	if reason := n.announce(ns.TargetAddress); reason != dropReasonNone {
+	if reason := n.announce(n.intf, ns.TargetAddress); reason != dropReasonNone {
 		return reason
 	}
 
 	stats.GotRequest(ns.TargetAddress.String())
 	level.Debug(n.logger).Log("interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", n.hardwareAddr, "msg", "got NDP request for service IP, sending response")
 
-	if err := n.advertise(src, ns.TargetAddress, false); err != nil {
+	n.mu.Lock()
+	m := n.adverts[ns.TargetAddress.String()]
+	n.mu.Unlock()
+	if m == nil {
+		m = n.advertisement(ns.TargetAddress, false)
+	}
+	if err := n.conn.WriteTo(m, nil, src); err != nil {
 		level.Error(n.logger).Log("op", "arpReply", "interface", n.intf, "ip", ns.TargetAddress, "senderIP", src, "senderLLAddr", nsLLAddr, "responseMAC", n.hardwareAddr, "error", err, "msg", "failed to send ARP reply")
 	} else {
 		stats.SentResponse(ns.TargetAddress.String())
@@ -149,7 +194,13 @@ func (n *ndpResponder) processRequest() dropReason {
 }
 
 func (n *ndpResponder) advertise(dst, target net.IP, gratuitous bool) error {
-	m := &ndp.NeighborAdvertisement{
+	return n.conn.WriteTo(n.advertisement(target, gratuitous), nil, dst)
+}
+
+// advertisement returns the advertisement of target from the
+// responder.
+func (n *ndpResponder) advertisement(target net.IP, gratuitous bool) *ndp.NeighborAdvertisement {
+	return &ndp.NeighborAdvertisement{
 		Solicited:     !gratuitous, // <Adam Jensen> I never asked for this...
 		Override:      gratuitous,  // Should clients replace existing cache entries
 		TargetAddress: target,
@@ -160,5 +211,4 @@ func (n *ndpResponder) advertise(dst, target net.IP, gratuitous bool) error {
 			},
 		},
 	}
-	return n.conn.WriteTo(m, nil, dst)
 }
@@ -0,0 +1,95 @@
+package layer2
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mdlayher/arp"
+	"github.com/mdlayher/ndp"
+)
+
+// Probe resolves ip with ARP or NDP, on the interface whose subnet
+// contains it, and returns an error if no host answers within
+// timeout.
+func Probe(ip net.IP, timeout time.Duration) error {
+	ifi, err := interfaceFor(ip)
+	if err != nil {
+		return err
+	}
+	if ip.To4() != nil {
+		return probeARP(ifi, ip, timeout)
+	}
+	return probeNDP(ifi, ip, timeout)
+}
+
+// interfaceFor returns the interface with a subnet containing ip.
+func interfaceFor(ip net.IP) (*net.Interface, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifs {
+		addrs, err := ifs[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.Contains(ip) {
+				return &ifs[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface on the subnet of %s", ip)
+}
+
+func probeARP(ifi *net.Interface, ip net.IP, timeout time.Duration) error {
+	c, err := arp.Dial(ifi)
+	if err != nil {
+		return fmt.Errorf("creating ARP client for %q: %s", ifi.Name, err)
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err := c.Resolve(ip); err != nil {
+		return fmt.Errorf("resolving %s on %q: %s", ip, ifi.Name, err)
+	}
+	return nil
+}
+
+func probeNDP(ifi *net.Interface, ip net.IP, timeout time.Duration) error {
+	c, _, err := ndp.Dial(ifi, ndp.LinkLocal)
+	if err != nil {
+		return fmt.Errorf("creating NDP client for %q: %s", ifi.Name, err)
+	}
+	defer c.Close()
+	group, err := ndp.SolicitedNodeMulticast(ip)
+	if err != nil {
+		return err
+	}
+	ns := &ndp.NeighborSolicitation{
+		TargetAddress: ip,
+		Options: []ndp.Option{
+			&ndp.LinkLayerAddress{
+				Direction: ndp.Source,
+				Addr:      ifi.HardwareAddr,
+			},
+		},
+	}
+	if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := c.WriteTo(ns, nil, group); err != nil {
+		return fmt.Errorf("soliciting %s on %q: %s", ip, ifi.Name, err)
+	}
+	for {
+		msg, _, _, err := c.ReadFrom()
+		if err != nil {
+			return fmt.Errorf("resolving %s on %q: %s", ip, ifi.Name, err)
+		}
+		if na, ok := msg.(*ndp.NeighborAdvertisement); ok && na.TargetAddress.Equal(ip) {
+			return nil
+		}
+	}
+}
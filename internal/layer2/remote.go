@@ -0,0 +1,263 @@
+package layer2
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Announcer answers ARP and NDP requests for the addresses of the
+// layer2 services. Announce implements it in the calling process,
+// RemoteAnnounce in a privileged helper process serving an Announce,
+// so that the speaker doesn't need raw sockets.
+type Announcer interface {
+	SetBalancer(name string, ip net.IP, interfaces []string)
+	DeleteBalancer(name string)
+	AnnounceName(name string) bool
+	Interfaces(name string) []string
+	LinkUp(name string)
+}
+
+// rpcName is the name under which Serve publishes the Announcer.
+const rpcName = "Layer2"
+
+// SetBalancerArgs are the arguments of the SetBalancer RPC.
+type SetBalancerArgs struct {
+	Name       string
+	IP         net.IP
+	Interfaces []string
+}
+
+// rpcAnnouncer exposes an Announcer with net/rpc.
+type rpcAnnouncer struct {
+	a Announcer
+
+	mu  sync.Mutex
+	ips map[string]SetBalancerArgs // svcName -> announcement, as set by clients
+}
+
+func (r *rpcAnnouncer) SetBalancer(args SetBalancerArgs, _ *bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLocked(args)
+	return nil
+}
+
+func (r *rpcAnnouncer) setLocked(args SetBalancerArgs) {
+	if old, ok := r.ips[args.Name]; ok && !old.IP.Equal(args.IP) {
+		// Announce ignores new IPs for known names.
+		r.a.DeleteBalancer(args.Name)
+	}
+	r.a.SetBalancer(args.Name, args.IP, args.Interfaces)
+	r.ips[args.Name] = args
+}
+
+func (r *rpcAnnouncer) DeleteBalancer(name string, _ *bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.a.DeleteBalancer(name)
+	delete(r.ips, name)
+	return nil
+}
+
+// Sync replaces all the announcements with ips, svcName ->
+// announcement.
+func (r *rpcAnnouncer) Sync(ips map[string]SetBalancerArgs, _ *bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range r.ips {
+		if _, ok := ips[name]; !ok {
+			r.a.DeleteBalancer(name)
+			delete(r.ips, name)
+		}
+	}
+	for _, args := range ips {
+		r.setLocked(args)
+	}
+	return nil
+}
+
+func (r *rpcAnnouncer) LinkUp(name string, _ *bool) error {
+	r.a.LinkUp(name)
+	return nil
+}
+
+func (r *rpcAnnouncer) Interfaces(name string, ret *[]string) error {
+	*ret = r.a.Interfaces(name)
+	return nil
+}
+
+func (r *rpcAnnouncer) Ping(_ bool, _ *bool) error {
+	return nil
+}
+
+// Serve serves a on ln, for RemoteAnnounce clients, until ln is
+// closed. It then closes the client connections.
+func Serve(l log.Logger, a Announcer, ln net.Listener) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName(rpcName, &rpcAnnouncer{a: a, ips: map[string]SetBalancerArgs{}}); err != nil {
+		return err
+	}
+	var (
+		mu    sync.Mutex
+		conns = map[net.Conn]bool{}
+	)
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		level.Info(l).Log("event", "responderClientConnected", "msg", "speaker connected to layer2 responder")
+		mu.Lock()
+		conns[conn] = true
+		mu.Unlock()
+		go func() {
+			srv.ServeConn(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+}
+
+// RemoteAnnounce is an Announcer served by another process with
+// Serve, on a unix socket. It remembers the announced addresses, and
+// resyncs them whenever it reconnects, so that either process can
+// restart without losing or leaking announcements.
+type RemoteAnnounce struct {
+	logger log.Logger
+	path   string
+
+	mu     sync.Mutex
+	client *rpc.Client
+	ips    map[string]SetBalancerArgs // svcName -> announcement
+}
+
+// NewRemote returns a RemoteAnnounce for the Announcer served on the
+// unix socket path. It connects lazily, and checks the connection
+// every pingInterval to restore the announcements of a restarted
+// server quickly.
+func NewRemote(l log.Logger, path string, pingInterval time.Duration) *RemoteAnnounce {
+	ret := &RemoteAnnounce{
+		logger: l,
+		path:   path,
+		ips:    map[string]SetBalancerArgs{},
+	}
+	if pingInterval > 0 {
+		go func() {
+			for {
+				if err := ret.call("Ping", true, new(bool)); err != nil {
+					level.Error(l).Log("op", "pingResponder", "error", err, "msg", "layer2 responder unreachable")
+				}
+				time.Sleep(pingInterval)
+			}
+		}()
+	}
+	return ret
+}
+
+// call calls method on the server, reconnecting once if the
+// connection broke. Must not be called with r.mu held.
+func (r *RemoteAnnounce) call(method string, args, reply interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.callLocked(method, args, reply)
+}
+
+func (r *RemoteAnnounce) callLocked(method string, args, reply interface{}) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if r.client == nil {
+			if err = r.connectLocked(); err != nil {
+				return err
+			}
+		}
+		err = r.client.Call(rpcName+"."+method, args, reply)
+		var serverErr rpc.ServerError
+		if err == nil || errors.As(err, &serverErr) {
+			return err
+		}
+		// The connection broke, e.g. because the server restarted.
+		r.client.Close()
+		r.client = nil
+	}
+	return err
+}
+
+// connectLocked connects to the server, and replaces its
+// announcements with ours.
+func (r *RemoteAnnounce) connectLocked() error {
+	client, err := rpc.Dial("unix", r.path)
+	if err != nil {
+		return err
+	}
+	if err := client.Call(rpcName+".Sync", r.ips, new(bool)); err != nil {
+		client.Close()
+		return err
+	}
+	r.client = client
+	level.Info(r.logger).Log("event", "responderConnected", "ips", len(r.ips), "msg", "connected to layer2 responder")
+	return nil
+}
+
+// SetBalancer adds ip to the set of announced addresses, on
+// interfaces if not empty.
+func (r *RemoteAnnounce) SetBalancer(name string, ip net.IP, interfaces []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	args := SetBalancerArgs{name, ip, interfaces}
+	r.ips[name] = args
+	if err := r.callLocked("SetBalancer", args, new(bool)); err != nil {
+		level.Error(r.logger).Log("op", "setBalancer", "error", err, "ip", ip, "msg", "failed to announce IP through layer2 responder, will retry on reconnect")
+	}
+}
+
+// DeleteBalancer deletes an address from the set of addresses we
+// should announce.
+func (r *RemoteAnnounce) DeleteBalancer(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ips, name)
+	if err := r.callLocked("DeleteBalancer", name, new(bool)); err != nil {
+		level.Error(r.logger).Log("op", "deleteBalancer", "error", err, "msg", "failed to withdraw IP through layer2 responder, will retry on reconnect")
+	}
+}
+
+// AnnounceName returns true when we have an announcement under name.
+func (r *RemoteAnnounce) AnnounceName(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.ips[name]
+	return ok
+}
+
+// Interfaces returns the interfaces on which the address announced
+// under name is answered for, sorted.
+func (r *RemoteAnnounce) Interfaces(name string) []string {
+	var ret []string
+	if err := r.call("Interfaces", name, &ret); err != nil {
+		level.Error(r.logger).Log("op", "interfaces", "error", err, "msg", "failed to get interfaces from layer2 responder")
+		return nil
+	}
+	return ret
+}
+
+// LinkUp makes the server re-announce all addresses after the link of
+// the interface name came back up.
+func (r *RemoteAnnounce) LinkUp(name string) {
+	if err := r.call("LinkUp", name, new(bool)); err != nil {
+		level.Error(r.logger).Log("op", "linkUp", "error", err, "msg", "failed to notify layer2 responder of link up")
+	}
+}
@@ -0,0 +1,155 @@
+package layer2
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeAnnouncer records the announced IPs, like Announce ignoring
+// new IPs for known names, but following their interfaces.
+type fakeAnnouncer struct {
+	sync.Mutex
+	ips     map[string]string
+	linksUp []string
+}
+
+func (f *fakeAnnouncer) SetBalancer(name string, ip net.IP, interfaces []string) {
+	f.Lock()
+	defer f.Unlock()
+	if old, ok := f.ips[name]; ok && strings.Fields(old)[0] != ip.String() {
+		return
+	}
+	f.ips[name] = ip.String()
+	if len(interfaces) > 0 {
+		f.ips[name] += " on " + strings.Join(interfaces, ",")
+	}
+}
+
+func (f *fakeAnnouncer) DeleteBalancer(name string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.ips, name)
+}
+
+func (f *fakeAnnouncer) AnnounceName(name string) bool {
+	f.Lock()
+	defer f.Unlock()
+	_, ok := f.ips[name]
+	return ok
+}
+
+func (f *fakeAnnouncer) Interfaces(name string) []string {
+	if !f.AnnounceName(name) {
+		return nil
+	}
+	return []string{"eth0"}
+}
+
+func (f *fakeAnnouncer) LinkUp(name string) {
+	f.Lock()
+	defer f.Unlock()
+	f.linksUp = append(f.linksUp, name)
+}
+
+func (f *fakeAnnouncer) state() map[string]string {
+	f.Lock()
+	defer f.Unlock()
+	ret := map[string]string{}
+	for k, v := range f.ips {
+		ret[k] = v
+	}
+	return ret
+}
+
+// serveFake serves a fakeAnnouncer on path, until the returned stop
+// function is called.
+func serveFake(t *testing.T, path string) (*fakeAnnouncer, func()) {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listening on %s: %s", path, err)
+	}
+	f := &fakeAnnouncer{ips: map[string]string{}}
+	done := make(chan struct{})
+	go func() {
+		Serve(log.NewNopLogger(), f, ln) // nolint:errcheck
+		close(done)
+	}()
+	return f, func() {
+		ln.Close()
+		<-done
+	}
+}
+
+func TestRemoteAnnounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "responder.sock")
+	f, stop := serveFake(t, path)
+
+	r := NewRemote(log.NewNopLogger(), path, 0)
+	r.SetBalancer("foo", net.ParseIP("192.168.1.20"), nil)
+	r.SetBalancer("bar", net.ParseIP("192.168.1.21"), nil)
+	r.DeleteBalancer("bar")
+	r.LinkUp("eth0")
+
+	if diff := cmp.Diff(map[string]string{"foo": "192.168.1.20"}, f.state()); diff != "" {
+		t.Errorf("wrong announcements (-want +got)\n%s", diff)
+	}
+	if !r.AnnounceName("foo") || r.AnnounceName("bar") {
+		t.Error("wrong AnnounceName")
+	}
+	if diff := cmp.Diff([]string{"eth0"}, r.Interfaces("foo")); diff != "" {
+		t.Errorf("wrong interfaces (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"eth0"}, f.linksUp); diff != "" {
+		t.Errorf("link up not forwarded (-want +got)\n%s", diff)
+	}
+
+	// The server restarts with no state, and gets it back when the
+	// client reconnects.
+	stop()
+	f, stop = serveFake(t, path)
+	defer stop()
+	r.SetBalancer("baz", net.ParseIP("192.168.1.22"), []string{"eth1"})
+	want := map[string]string{
+		"foo": "192.168.1.20",
+		"baz": "192.168.1.22 on eth1",
+	}
+	if diff := cmp.Diff(want, f.state()); diff != "" {
+		t.Errorf("announcements not restored after reconnect (-want +got)\n%s", diff)
+	}
+}
+
+func TestRPCAnnouncerSync(t *testing.T) {
+	f := &fakeAnnouncer{ips: map[string]string{}}
+	r := &rpcAnnouncer{a: f, ips: map[string]SetBalancerArgs{}}
+	for _, args := range []SetBalancerArgs{
+		{"foo", net.ParseIP("192.168.1.20"), nil},
+		{"bar", net.ParseIP("192.168.1.21"), nil},
+		{"qux", net.ParseIP("192.168.1.23"), nil},
+	} {
+		if err := r.SetBalancer(args, new(bool)); err != nil {
+			t.Fatalf("SetBalancer: %s", err)
+		}
+	}
+	err := r.Sync(map[string]SetBalancerArgs{
+		"foo": {"foo", net.ParseIP("192.168.1.30"), nil},
+		"baz": {"baz", net.ParseIP("192.168.1.22"), nil},
+		"qux": {"qux", net.ParseIP("192.168.1.23"), []string{"eth1"}},
+	}, new(bool))
+	if err != nil {
+		t.Fatalf("Sync: %s", err)
+	}
+	want := map[string]string{
+		"foo": "192.168.1.30",
+		"baz": "192.168.1.22",
+		"qux": "192.168.1.23 on eth1",
+	}
+	if diff := cmp.Diff(want, f.state()); diff != "" {
+		t.Errorf("wrong announcements after sync (-want +got)\n%s", diff)
+	}
+}
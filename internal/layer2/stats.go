@@ -51,6 +51,13 @@ func (m *metrics) SentResponse(addr string) {
 	m.out.WithLabelValues(addr).Add(1)
 }
 
+// AnsweredInKernel accounts n requests for addr answered by the XDP
+// responder.
+func (m *metrics) AnsweredInKernel(addr string, n uint64) {
+	m.in.WithLabelValues(addr).Add(float64(n))
+	m.out.WithLabelValues(addr).Add(float64(n))
+}
+
 func (m *metrics) SentGratuitous(addr string) {
 	m.gratuitous.WithLabelValues(addr).Add(1)
 }
@@ -0,0 +1,332 @@
+package layer2
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// Maximum number of addresses of each family the XDP responder
+// answers for.
+const xdpMaxAddrs = 65536
+
+// xdpResponder answers ARP requests and neighbor solicitations for the
+// announced addresses in the kernel, with an XDP program on each
+// interface, before they reach the userspace responders. It only
+// answers plain requests, and passes anything else, e.g. VLAN tagged
+// requests or solicitations without a source link-layer address, on
+// to the userspace responders.
+type xdpResponder struct {
+	logger log.Logger
+	// Announced addresses -> number of requests answered.
+	v4, v6 *bpfMap
+	// ifindex -> program attached to the interface.
+	attached map[int]*xdpAttachment
+	// Interfaces we failed to attach to, so that we only log it once.
+	failed map[int]bool
+	// Number of requests answered for each address, as of the last
+	// call to collectStats.
+	answered map[string]uint64
+}
+
+type xdpAttachment struct {
+	intf string
+	prog int
+	link int
+}
+
+func newXDPResponder(l log.Logger) (*xdpResponder, error) {
+	// Kernels before 5.11 charge BPF maps and programs against the
+	// locked memory limit.
+	if err := unix.Setrlimit(unix.RLIMIT_MEMLOCK, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}); err != nil {
+		level.Warn(l).Log("op", "createXDPResponder", "error", err, "msg", "failed to raise locked memory limit")
+	}
+	v4, err := newBPFMap(net.IPv4len, 8, xdpMaxAddrs)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := newBPFMap(net.IPv6len, 8, xdpMaxAddrs)
+	if err != nil {
+		v4.Close()
+		return nil, err
+	}
+	return &xdpResponder{
+		logger:   l,
+		v4:       v4,
+		v6:       v6,
+		attached: map[int]*xdpAttachment{},
+		failed:   map[int]bool{},
+		answered: map[string]uint64{},
+	}, nil
+}
+
+// attach attaches the responder to ifi, if it isn't already.
+func (x *xdpResponder) attach(ifi *net.Interface) {
+	if x.attached[ifi.Index] != nil || x.failed[ifi.Index] {
+		return
+	}
+	att, err := x.load(ifi)
+	if err != nil {
+		x.failed[ifi.Index] = true
+		level.Error(x.logger).Log("op", "createXDPResponder", "interface", ifi.Name, "error", err, "msg", "failed to attach XDP responder, answering from userspace only")
+		return
+	}
+	x.attached[ifi.Index] = att
+	level.Info(x.logger).Log("event", "createXDPResponder", "interface", ifi.Name, "msg", "attached XDP responder to interface")
+}
+
+func (x *xdpResponder) load(ifi *net.Interface) (*xdpAttachment, error) {
+	if len(ifi.HardwareAddr) != 6 {
+		return nil, fmt.Errorf("unsupported hardware address %q", ifi.HardwareAddr)
+	}
+	insns, err := xdpProgram(ifi.HardwareAddr, x.v4.fd, x.v6.fd)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := loadXDP(insns)
+	if err != nil {
+		return nil, err
+	}
+	link, err := attachXDP(prog, ifi.Index)
+	if err != nil {
+		unix.Close(prog)
+		return nil, err
+	}
+	return &xdpAttachment{ifi.Name, prog, link}, nil
+}
+
+// detachAllBut detaches the responder from the interfaces not in keep.
+func (x *xdpResponder) detachAllBut(keep map[int]bool) {
+	for i := range x.failed {
+		if !keep[i] {
+			delete(x.failed, i)
+		}
+	}
+	for i, att := range x.attached {
+		if keep[i] {
+			continue
+		}
+		unix.Close(att.link)
+		unix.Close(att.prog)
+		delete(x.attached, i)
+		level.Info(x.logger).Log("event", "deleteXDPResponder", "interface", att.intf, "msg", "detached XDP responder from interface")
+	}
+}
+
+func (x *xdpResponder) mapFor(ip net.IP) (*bpfMap, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return x.v4, ip4
+	}
+	return x.v6, ip.To16()
+}
+
+// add starts answering for ip.
+func (x *xdpResponder) add(ip net.IP) error {
+	m, key := x.mapFor(ip)
+	return m.Put(key, make([]byte, 8))
+}
+
+// remove stops answering for ip.
+func (x *xdpResponder) remove(ip net.IP) error {
+	m, key := x.mapFor(ip)
+	x.collect(m, key)
+	delete(x.answered, ip.String())
+	return m.Delete(key)
+}
+
+// collectStats accounts the requests answered in the kernel since the
+// last call.
+func (x *xdpResponder) collectStats() {
+	for _, m := range []*bpfMap{x.v4, x.v6} {
+		keys, err := m.Keys()
+		if err != nil {
+			level.Error(x.logger).Log("op", "collectXDPStats", "error", err, "msg", "failed to list addresses of XDP responder")
+			continue
+		}
+		for _, key := range keys {
+			x.collect(m, key)
+		}
+	}
+}
+
+func (x *xdpResponder) collect(m *bpfMap, key []byte) {
+	val := make([]byte, 8)
+	if err := m.Lookup(key, val); err != nil {
+		return
+	}
+	ip := net.IP(key).String()
+	n := nativeEndian.Uint64(val)
+	if n > x.answered[ip] {
+		stats.AnsweredInKernel(ip, n-x.answered[ip])
+	}
+	x.answered[ip] = n
+}
+
+// Offsets in the frames the XDP program answers.
+const (
+	ethDst  = 0
+	ethSrc  = 6
+	ethType = 12
+
+	arpHeader    = 14 // htype, ptype, hlen, plen
+	arpOp        = 20
+	arpSenderHW  = 22
+	arpSenderIP  = 28
+	arpTargetHW  = 32
+	arpTargetIP  = 38
+	arpFrameSize = 42
+
+	ip6Version    = 14
+	ip6PayloadLen = 18 // followed by next header, hop limit
+	ip6Src        = 22
+	ip6Dst        = 38
+	icmp6Type     = 54 // followed by code
+	icmp6Checksum = 56
+	icmp6Flags    = 58
+	nsTarget      = 62
+	nsOption      = 78 // type, length
+	nsOptionAddr  = 80
+	nsFrameSize   = 86
+)
+
+// xdpProgram returns an XDP program that turns the ARP requests and
+// neighbor solicitations for the addresses in the maps v4 and v6 into
+// replies from mac, sends them back out, and counts them in the maps.
+// It passes all other frames.
+//
+// It only handles neighbor solicitations with a source link-layer
+// address option and nothing else, which is what hosts send to
+// resolve an address.
+func xdpProgram(mac net.HardwareAddr, v4, v6 int) ([]byte, error) {
+	// r7 and r8 hold the start and end of the frame, and are
+	// preserved across calls. r2 and r3 are scratch.
+	var a bpfAsm
+	a.ldxW(7, 1, 0)
+	a.ldxW(8, 1, 4)
+
+	need := func(n int32) {
+		a.aluReg(bpfMOV, 2, 7)
+		a.alu(bpfADD, 2, n)
+		a.jmpReg(bpfJGT, 2, 8, "pass")
+	}
+	expect := func(off int16, want ...byte) {
+		for i, b := range want {
+			a.ldxB(2, 7, off+int16(i))
+			a.jmp(bpfJNE, 2, int32(b), "pass")
+		}
+	}
+	load16 := func(dst uint8, off int16) {
+		a.ldxB(dst, 7, off)
+		a.alu(bpfLSH, dst, 8)
+		a.ldxB(3, 7, off+1)
+		a.aluReg(bpfOR, dst, 3)
+	}
+	copyBytes := func(dst, src int16, n int) {
+		for i := int16(0); i < int16(n); i++ {
+			a.ldxB(2, 7, src+i)
+			a.stxB(7, dst+i, 2)
+		}
+	}
+	storeBytes := func(off int16, bs []byte) {
+		for i, b := range bs {
+			a.stB(7, off+int16(i), b)
+		}
+	}
+	// count looks up the address at off in the map, passes the frame
+	// if it's not there, and counts the request otherwise.
+	count := func(m int, off int16, n int) {
+		for i := int16(0); i < int16(n); i++ {
+			a.ldxB(2, 7, off+i)
+			a.stxB(10, -int16(n)+i, 2)
+		}
+		a.ldMap(1, m)
+		a.aluReg(bpfMOV, 2, 10)
+		a.alu(bpfADD, 2, -int32(n))
+		a.call(bpfFuncMapLookup)
+		a.jmp(bpfJEQ, 0, 0, "pass")
+		a.alu(bpfMOV, 1, 1)
+		a.xaddDW(0, 0, 1)
+	}
+	reply := func() {
+		a.alu(bpfMOV, 0, xdpTX)
+		a.exit()
+	}
+
+	need(ethType + 2)
+	load16(2, ethType)
+	a.jmp(bpfJEQ, 2, 0x0806, "arp")
+	a.jmp(bpfJEQ, 2, 0x86dd, "ndp")
+	a.label("pass")
+	a.alu(bpfMOV, 0, xdpPass)
+	a.exit()
+
+	// ARP requests for IPv4 over ethernet, broadcast or sent to us.
+	a.label("arp")
+	need(arpFrameSize)
+	expect(arpHeader, 0, 1, 8, 0, 6, 4, 0, 1)
+	for i := int16(0); i < 6; i++ {
+		a.ldxB(2, 7, ethDst+i)
+		a.jmp(bpfJNE, 2, 0xff, "arpUnicast")
+	}
+	a.ja("arpLookup")
+	a.label("arpUnicast")
+	expect(ethDst, mac...)
+	a.label("arpLookup")
+	count(v4, arpTargetIP, net.IPv4len)
+	copyBytes(arpTargetHW, arpSenderHW, 6)
+	copyBytes(ethDst, arpSenderHW, 6)
+	storeBytes(ethSrc, mac)
+	storeBytes(arpSenderHW, mac)
+	storeBytes(arpOp, []byte{0, 2})
+	for i := int16(0); i < net.IPv4len; i++ {
+		a.ldxB(2, 7, arpSenderIP+i)
+		a.ldxB(3, 7, arpTargetIP+i)
+		a.stxB(7, arpSenderIP+i, 3)
+		a.stxB(7, arpTargetIP+i, 2)
+	}
+	reply()
+
+	// Neighbor solicitations with only a source link-layer address
+	// option, and no extension headers.
+	a.label("ndp")
+	need(nsFrameSize)
+	a.ldxB(2, 7, ip6Version)
+	a.alu(bpfAND, 2, 0xf0)
+	a.jmp(bpfJNE, 2, 0x60, "pass")
+	expect(ip6PayloadLen, 0, nsFrameSize-icmp6Type, unix.IPPROTO_ICMPV6, 255)
+	expect(icmp6Type, 135, 0)
+	expect(nsOption, 1, 1)
+	count(v6, nsTarget, net.IPv6len)
+	copyBytes(ethDst, nsOptionAddr, 6)
+	storeBytes(ethSrc, mac)
+	copyBytes(ip6Dst, ip6Src, net.IPv6len)
+	copyBytes(ip6Src, nsTarget, net.IPv6len)
+	storeBytes(icmp6Type, []byte{136, 0, 0, 0})
+	// Solicited, not override, like the userspace responder.
+	storeBytes(icmp6Flags, []byte{0x40, 0, 0, 0})
+	storeBytes(nsOption, []byte{2, 1})
+	storeBytes(nsOptionAddr, mac)
+	// Checksum over the pseudo-header and the advertisement.
+	a.alu(bpfMOV, 9, (nsFrameSize-icmp6Type)+unix.IPPROTO_ICMPV6)
+	for off := int16(ip6Src); off < nsFrameSize; off += 2 {
+		load16(2, off)
+		a.aluReg(bpfADD, 9, 2)
+	}
+	for i := 0; i < 2; i++ {
+		a.aluReg(bpfMOV, 2, 9)
+		a.alu(bpfRSH, 2, 16)
+		a.alu(bpfAND, 9, 0xffff)
+		a.aluReg(bpfADD, 9, 2)
+	}
+	a.alu(bpfXOR, 9, 0xffff)
+	a.aluReg(bpfMOV, 2, 9)
+	a.alu(bpfRSH, 2, 8)
+	a.stxB(7, icmp6Checksum, 2)
+	a.stxB(7, icmp6Checksum+1, 9)
+	reply()
+
+	return a.assemble()
+}
@@ -0,0 +1,194 @@
+package layer2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"unsafe"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// runXDP runs the XDP program prog on frame, and returns its verdict
+// and the resulting frame.
+func runXDP(t *testing.T, prog int, frame []byte) (uint32, []byte) {
+	out := make([]byte, len(frame)+256)
+	attr := struct {
+		progFD, retval, sizeIn, sizeOut uint32
+		in, out                         bpfPtr
+		repeat, duration                uint32
+	}{
+		progFD:  uint32(prog),
+		sizeIn:  uint32(len(frame)),
+		sizeOut: uint32(len(out)),
+		in:      newBPFPtr(frame),
+		out:     newBPFPtr(out),
+		repeat:  1,
+	}
+	if _, err := bpfCall(bpfProgTestRun, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		t.Fatalf("running XDP program: %s", err)
+	}
+	return attr.retval, out[:attr.sizeOut]
+}
+
+// loadTestXDP loads the XDP program for mac, and skips the test if
+// the kernel or our privileges don't allow it.
+func loadTestXDP(t *testing.T, mac net.HardwareAddr) (*xdpResponder, int) {
+	x, err := newXDPResponder(log.NewNopLogger())
+	if err != nil {
+		t.Skipf("BPF unavailable: %s", err)
+	}
+	insns, err := xdpProgram(mac, x.v4.fd, x.v6.fd)
+	if err != nil {
+		t.Fatalf("assembling XDP program: %s", err)
+	}
+	prog, err := loadXDP(insns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unix.Close(prog)
+		x.v4.Close()
+		x.v6.Close()
+	})
+	return x, prog
+}
+
+func arpRequest(dst, sender net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	var b bytes.Buffer
+	b.Write(dst)
+	b.Write(sender)
+	b.Write([]byte{0x08, 0x06, 0, 1, 8, 0, 6, 4, 0, 1})
+	b.Write(sender)
+	b.Write(senderIP.To4())
+	b.Write(make([]byte, 6))
+	b.Write(targetIP.To4())
+	// Padding to the minimum ethernet frame size.
+	b.Write(make([]byte, 18))
+	return b.Bytes()
+}
+
+func neighborSolicitation(sender net.HardwareAddr, src, target net.IP) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0x33, 0x33, 0xff, target[13], target[14], target[15]})
+	b.Write(sender)
+	b.Write([]byte{0x86, 0xdd, 0x60, 0, 0, 0, 0, 32, 58, 255})
+	b.Write(src)
+	b.Write([]byte{0xff, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, target[13], target[14], target[15]})
+	b.Write([]byte{135, 0, 0, 0, 0, 0, 0, 0})
+	b.Write(target)
+	b.Write([]byte{1, 1})
+	b.Write(sender)
+	return b.Bytes()
+}
+
+// icmp6Sum returns the checksum of the ICMPv6 message in an IPv6
+// frame, which is 0 if it's valid.
+func icmp6Sum(frame []byte) uint16 {
+	msg := frame[icmp6Type:]
+	sum := uint32(len(msg)) + unix.IPPROTO_ICMPV6
+	for _, bs := range [][]byte{frame[ip6Src:icmp6Type], msg} {
+		for i := 0; i < len(bs); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(bs[i:]))
+		}
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func TestXDPResponder(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	peer := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	x, prog := loadTestXDP(t, mac)
+
+	vip4, vip6 := net.ParseIP("192.168.1.100"), net.ParseIP("fc00::100")
+	peer4, peer6 := net.ParseIP("192.168.1.2"), net.ParseIP("fe80::2")
+	for _, ip := range []net.IP{vip4, vip6} {
+		if err := x.add(ip); err != nil {
+			t.Fatalf("adding %s: %s", ip, err)
+		}
+	}
+
+	// ARP request for an announced address.
+	ret, got := runXDP(t, prog, arpRequest(net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, peer, peer4, vip4))
+	if ret != xdpTX {
+		t.Fatalf("ARP request for %s not answered, verdict %d", vip4, ret)
+	}
+	var want bytes.Buffer
+	want.Write(peer)
+	want.Write(mac)
+	want.Write([]byte{0x08, 0x06, 0, 1, 8, 0, 6, 4, 0, 2})
+	want.Write(mac)
+	want.Write(vip4.To4())
+	want.Write(peer)
+	want.Write(peer4.To4())
+	want.Write(make([]byte, 18))
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("wrong ARP reply\ngot:  %x\nwant: %x", got, want.Bytes())
+	}
+
+	// ARP requests sent to us are answered, to others or for other
+	// addresses are not.
+	if ret, _ := runXDP(t, prog, arpRequest(mac, peer, peer4, vip4)); ret != xdpTX {
+		t.Errorf("unicast ARP request not answered, verdict %d", ret)
+	}
+	if ret, _ := runXDP(t, prog, arpRequest(peer, peer, peer4, vip4)); ret != xdpPass {
+		t.Errorf("ARP request to another host answered, verdict %d", ret)
+	}
+	if ret, _ := runXDP(t, prog, arpRequest(mac, peer, peer4, net.ParseIP("192.168.1.101"))); ret != xdpPass {
+		t.Errorf("ARP request for unannounced address answered, verdict %d", ret)
+	}
+
+	// Neighbor solicitation for an announced address.
+	ns := neighborSolicitation(peer, peer6, vip6)
+	binary.BigEndian.PutUint16(ns[icmp6Checksum:], icmp6Sum(ns))
+	ret, got = runXDP(t, prog, ns)
+	if ret != xdpTX {
+		t.Fatalf("neighbor solicitation for %s not answered, verdict %d", vip6, ret)
+	}
+	want.Reset()
+	want.Write(peer)
+	want.Write(mac)
+	want.Write([]byte{0x86, 0xdd, 0x60, 0, 0, 0, 0, 32, 58, 255})
+	want.Write(vip6)
+	want.Write(peer6)
+	want.Write([]byte{136, 0, got[icmp6Checksum], got[icmp6Checksum+1], 0x40, 0, 0, 0})
+	want.Write(vip6)
+	want.Write([]byte{2, 1})
+	want.Write(mac)
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("wrong neighbor advertisement\ngot:  %x\nwant: %x", got, want.Bytes())
+	}
+	if sum := icmp6Sum(got); sum != 0 {
+		t.Errorf("wrong neighbor advertisement checksum %x", sum)
+	}
+
+	if ret, _ := runXDP(t, prog, neighborSolicitation(peer, peer6, net.ParseIP("fc00::101"))); ret != xdpPass {
+		t.Errorf("neighbor solicitation for unannounced address answered, verdict %d", ret)
+	}
+	// Solicitations without a source link-layer address go to the
+	// userspace responder.
+	if ret, _ := runXDP(t, prog, neighborSolicitation(peer, peer6, vip6)[:nsOption]); ret != xdpPass {
+		t.Errorf("neighbor solicitation without source address answered, verdict %d", ret)
+	}
+
+	// Answered requests are accounted, and withdrawn addresses are
+	// no longer answered.
+	x.collectStats()
+	if got := x.answered[vip4.String()]; got != 2 {
+		t.Errorf("got %d answered ARP requests, want 2", got)
+	}
+	if got := x.answered[vip6.String()]; got != 1 {
+		t.Errorf("got %d answered neighbor solicitations, want 1", got)
+	}
+	if err := x.remove(vip4); err != nil {
+		t.Fatalf("removing %s: %s", vip4, err)
+	}
+	if ret, _ := runXDP(t, prog, arpRequest(mac, peer, peer4, vip4)); ret != xdpPass {
+		t.Errorf("ARP request for withdrawn address answered, verdict %d", ret)
+	}
+}
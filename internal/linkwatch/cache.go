@@ -0,0 +1,282 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linkwatch
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/sys/unix"
+)
+
+// Interfaces lists the network interfaces of the node and their
+// addresses, like the functions of the net package of the same names.
+type Interfaces interface {
+	Interfaces() ([]net.Interface, error)
+	InterfaceByName(name string) (*net.Interface, error)
+	Addrs(ifi *net.Interface) ([]net.Addr, error)
+	InterfaceAddrs() ([]net.Addr, error)
+}
+
+// System is the Interfaces of the net package, which asks the kernel
+// on every call.
+type System struct{}
+
+func (System) Interfaces() ([]net.Interface, error) { return net.Interfaces() }
+
+func (System) InterfaceByName(name string) (*net.Interface, error) {
+	return net.InterfaceByName(name)
+}
+
+func (System) Addrs(ifi *net.Interface) ([]net.Addr, error) { return ifi.Addrs() }
+
+func (System) InterfaceAddrs() ([]net.Addr, error) { return net.InterfaceAddrs() }
+
+// Cache is the Interfaces of a copy of the kernel's interfaces and
+// addresses, kept up to date from its notifications. Listing the
+// addresses of an interface otherwise dumps those of the whole node,
+// which adds up on nodes with hundreds of interfaces, e.g. SR-IOV
+// virtual functions or the veths of many pods.
+type Cache struct {
+	mu    sync.RWMutex
+	links map[int]net.Interface
+	addrs map[int][]*net.IPNet
+}
+
+// NewCache returns a Cache, kept up to date until stopCh is closed.
+// It returns an error if it can't read the interfaces or subscribe to
+// their changes.
+func NewCache(l log.Logger, stopCh <-chan struct{}) (*Cache, error) {
+	fd, err := subscribe(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{}
+	if err := c.seed(); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	go receive(l, fd, stopCh, "cacheInterfaces", "interface", c.handle, c.seed)
+	return c, nil
+}
+
+// seed replaces the contents of the cache with the current
+// interfaces and addresses.
+func (c *Cache) seed() error {
+	var msgs []syscall.NetlinkMessage
+	for _, req := range []int{unix.RTM_GETLINK, unix.RTM_GETADDR} {
+		bs, err := syscall.NetlinkRIB(req, unix.AF_UNSPEC)
+		if err != nil {
+			return os.NewSyscallError("netlinkrib", err)
+		}
+		m, err := syscall.ParseNetlinkMessage(bs)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, m...)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.links, c.addrs = map[int]net.Interface{}, map[int][]*net.IPNet{}
+	c.apply(msgs)
+	return nil
+}
+
+// handle applies the link and address changes of msgs.
+func (c *Cache) handle(msgs []syscall.NetlinkMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apply(msgs)
+}
+
+func (c *Cache) apply(msgs []syscall.NetlinkMessage) {
+	for i := range msgs {
+		m := &msgs[i]
+		switch m.Header.Type {
+		case unix.RTM_NEWLINK:
+			if ifi, ok := parseLink(m); ok {
+				c.links[ifi.Index] = ifi
+			}
+		case unix.RTM_DELLINK:
+			if ifi, ok := parseLink(m); ok {
+				delete(c.links, ifi.Index)
+				delete(c.addrs, ifi.Index)
+			}
+		case unix.RTM_NEWADDR:
+			if index, addr, ok := parseAddr(m); ok {
+				c.addrs[index] = append(removeAddr(c.addrs[index], addr), addr)
+			}
+		case unix.RTM_DELADDR:
+			if index, addr, ok := parseAddr(m); ok {
+				c.addrs[index] = removeAddr(c.addrs[index], addr)
+				if len(c.addrs[index]) == 0 {
+					delete(c.addrs, index)
+				}
+			}
+		}
+	}
+}
+
+// removeAddr returns addrs without addr.
+func removeAddr(addrs []*net.IPNet, addr *net.IPNet) []*net.IPNet {
+	ret := addrs[:0]
+	for _, a := range addrs {
+		if !a.IP.Equal(addr.IP) || a.Mask.String() != addr.Mask.String() {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// Interfaces returns the interfaces, by index.
+func (c *Cache) Interfaces() ([]net.Interface, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ret := make([]net.Interface, 0, len(c.links))
+	for _, ifi := range c.links {
+		ret = append(ret, ifi)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Index < ret[j].Index })
+	return ret, nil
+}
+
+// InterfaceByName returns the interface name.
+func (c *Cache) InterfaceByName(name string) (*net.Interface, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, ifi := range c.links {
+		if ifi.Name == name {
+			ret := ifi
+			return &ret, nil
+		}
+	}
+	return nil, fmt.Errorf("no such network interface %q", name)
+}
+
+// Addrs returns the addresses of ifi.
+func (c *Cache) Addrs(ifi *net.Interface) ([]net.Addr, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	ret := make([]net.Addr, 0, len(c.addrs[ifi.Index]))
+	for _, a := range c.addrs[ifi.Index] {
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+// InterfaceAddrs returns the addresses of all the interfaces.
+func (c *Cache) InterfaceAddrs() ([]net.Addr, error) {
+	ifs, _ := c.Interfaces()
+	var ret []net.Addr
+	for i := range ifs {
+		addrs, _ := c.Addrs(&ifs[i])
+		ret = append(ret, addrs...)
+	}
+	return ret, nil
+}
+
+// parseLink returns the interface of the link message m.
+func parseLink(m *syscall.NetlinkMessage) (net.Interface, bool) {
+	if len(m.Data) < unix.SizeofIfInfomsg {
+		return net.Interface{}, false
+	}
+	info := (*unix.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+	ret := net.Interface{Index: int(info.Index), Flags: linkFlags(info.Flags)}
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return net.Interface{}, false
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case unix.IFLA_IFNAME:
+			ret.Name = strings.TrimRight(string(a.Value), "\x00")
+		case unix.IFLA_MTU:
+			if len(a.Value) >= 4 {
+				ret.MTU = int(*(*uint32)(unsafe.Pointer(&a.Value[0])))
+			}
+		case unix.IFLA_ADDRESS:
+			// Like the net package, ignore the all-zero addresses,
+			// and the IP addresses of tunnels.
+			if len(a.Value) == net.IPv4len || len(a.Value) == net.IPv6len {
+				continue
+			}
+			for _, b := range a.Value {
+				if b != 0 {
+					ret.HardwareAddr = append(net.HardwareAddr(nil), a.Value...)
+					break
+				}
+			}
+		}
+	}
+	return ret, true
+}
+
+func linkFlags(raw uint32) net.Flags {
+	var ret net.Flags
+	for _, f := range []struct {
+		raw  uint32
+		flag net.Flags
+	}{
+		{unix.IFF_UP, net.FlagUp},
+		{unix.IFF_BROADCAST, net.FlagBroadcast},
+		{unix.IFF_LOOPBACK, net.FlagLoopback},
+		{unix.IFF_POINTOPOINT, net.FlagPointToPoint},
+		{unix.IFF_MULTICAST, net.FlagMulticast},
+	} {
+		if raw&f.raw != 0 {
+			ret |= f.flag
+		}
+	}
+	return ret
+}
+
+// parseAddr returns the interface index and the address of the
+// address message m.
+func parseAddr(m *syscall.NetlinkMessage) (int, *net.IPNet, bool) {
+	if len(m.Data) < unix.SizeofIfAddrmsg {
+		return 0, nil, false
+	}
+	info := (*unix.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return 0, nil, false
+	}
+	// On point-to-point links, IFA_ADDRESS is the address of the
+	// other end, and IFA_LOCAL the interface's.
+	var addr, local []byte
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case unix.IFA_ADDRESS:
+			addr = a.Value
+		case unix.IFA_LOCAL:
+			local = a.Value
+		}
+	}
+	if local != nil {
+		addr = local
+	}
+	switch {
+	case info.Family == unix.AF_INET && len(addr) == net.IPv4len:
+		return int(info.Index), &net.IPNet{IP: net.IPv4(addr[0], addr[1], addr[2], addr[3]), Mask: net.CIDRMask(int(info.Prefixlen), 8*net.IPv4len)}, true
+	case info.Family == unix.AF_INET6 && len(addr) == net.IPv6len:
+		return int(info.Index), &net.IPNet{IP: append(net.IP(nil), addr...), Mask: net.CIDRMask(int(info.Prefixlen), 8*net.IPv6len)}, true
+	}
+	return 0, nil, false
+}
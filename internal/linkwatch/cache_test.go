@@ -0,0 +1,156 @@
+package linkwatch
+
+import (
+	"net"
+	"sort"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+// ipAddrMsg returns an address message adding or removing cidr on the
+// interface index.
+func ipAddrMsg(typ uint16, index uint32, cidr string) syscall.NetlinkMessage {
+	ip, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ones, _ := n.Mask.Size()
+	info := unix.IfAddrmsg{
+		Family:    unix.AF_INET6,
+		Prefixlen: uint8(ones),
+		Index:     index,
+	}
+	if ip.To4() != nil {
+		info.Family, ip = unix.AF_INET, ip.To4()
+	}
+	data := make([]byte, unix.SizeofIfAddrmsg)
+	copy(data, (*[unix.SizeofIfAddrmsg]byte)(unsafe.Pointer(&info))[:])
+
+	attr := make([]byte, unix.SizeofRtAttr+len(ip))
+	rta := (*unix.RtAttr)(unsafe.Pointer(&attr[0]))
+	rta.Len = uint16(len(attr))
+	rta.Type = unix.IFA_ADDRESS
+	copy(attr[unix.SizeofRtAttr:], ip)
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: typ},
+		Data:   append(data, attr...),
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := &Cache{links: map[int]net.Interface{}, addrs: map[int][]*net.IPNet{}}
+	addrs := func(index int) []string {
+		t.Helper()
+		as, err := c.Addrs(&net.Interface{Index: index})
+		if err != nil {
+			t.Fatalf("Addrs: %s", err)
+		}
+		var ret []string
+		for _, a := range as {
+			ret = append(ret, a.String())
+		}
+		return ret
+	}
+
+	c.handle([]syscall.NetlinkMessage{
+		linkMsg(unix.RTM_NEWLINK, 2, unix.IFF_UP|unix.IFF_BROADCAST, "eth1"),
+		linkMsg(unix.RTM_NEWLINK, 1, unix.IFF_UP|unix.IFF_BROADCAST, "eth0"),
+		ipAddrMsg(unix.RTM_NEWADDR, 1, "192.168.1.2/24"),
+		ipAddrMsg(unix.RTM_NEWADDR, 1, "2001:db8::2/64"),
+		ipAddrMsg(unix.RTM_NEWADDR, 2, "10.0.0.2/8"),
+	})
+	ifs, err := c.Interfaces()
+	if err != nil {
+		t.Fatalf("Interfaces: %s", err)
+	}
+	want := []net.Interface{
+		{Index: 1, Name: "eth0", Flags: net.FlagUp | net.FlagBroadcast},
+		{Index: 2, Name: "eth1", Flags: net.FlagUp | net.FlagBroadcast},
+	}
+	if diff := cmp.Diff(want, ifs); diff != "" {
+		t.Errorf("wrong interfaces (-want +got)\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"192.168.1.2/24", "2001:db8::2/64"}, addrs(1)); diff != "" {
+		t.Errorf("wrong eth0 addresses (-want +got)\n%s", diff)
+	}
+	if ifi, err := c.InterfaceByName("eth1"); err != nil || ifi.Index != 2 {
+		t.Errorf("InterfaceByName(eth1) = %v, %v, want index 2", ifi, err)
+	}
+	if _, err := c.InterfaceByName("eth2"); err == nil {
+		t.Error("InterfaceByName found an unknown interface")
+	}
+
+	// Repeated notifications don't duplicate addresses.
+	c.handle([]syscall.NetlinkMessage{
+		ipAddrMsg(unix.RTM_NEWADDR, 1, "192.168.1.2/24"),
+		ipAddrMsg(unix.RTM_DELADDR, 1, "2001:db8::2/64"),
+	})
+	if diff := cmp.Diff([]string{"192.168.1.2/24"}, addrs(1)); diff != "" {
+		t.Errorf("wrong eth0 addresses after changes (-want +got)\n%s", diff)
+	}
+
+	c.handle([]syscall.NetlinkMessage{linkMsg(unix.RTM_DELLINK, 2, 0, "eth1")})
+	if _, err := c.InterfaceByName("eth1"); err == nil {
+		t.Error("deleted interface still cached")
+	}
+	all, err := c.InterfaceAddrs()
+	if err != nil {
+		t.Fatalf("InterfaceAddrs: %s", err)
+	}
+	if len(all) != 1 || all[0].String() != "192.168.1.2/24" {
+		t.Errorf("got node addresses %v, want only 192.168.1.2/24", all)
+	}
+}
+
+// TestCacheSeed checks that the cache agrees with the net package on
+// the host running the test.
+func TestCacheSeed(t *testing.T) {
+	c := &Cache{}
+	if err := c.seed(); err != nil {
+		t.Skipf("can't dump the interfaces: %s", err)
+	}
+	want, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("listing interfaces: %s", err)
+	}
+	got, err := c.Interfaces()
+	if err != nil {
+		t.Fatalf("Interfaces: %s", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d interfaces, want %d", len(got), len(want))
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Index < want[j].Index })
+	for i := range want {
+		// The cache doesn't track FlagRunning.
+		want[i].Flags &= net.FlagUp | net.FlagBroadcast | net.FlagLoopback | net.FlagPointToPoint | net.FlagMulticast
+		if diff := cmp.Diff(want[i], got[i]); diff != "" {
+			t.Errorf("wrong interface %q (-want +got)\n%s", want[i].Name, diff)
+		}
+		wantAddrs, err := want[i].Addrs()
+		if err != nil {
+			t.Fatalf("listing addresses of %q: %s", want[i].Name, err)
+		}
+		gotAddrs, err := c.Addrs(&got[i])
+		if err != nil {
+			t.Fatalf("Addrs: %s", err)
+		}
+		if diff := cmp.Diff(addrStrings(wantAddrs), addrStrings(gotAddrs)); diff != "" {
+			t.Errorf("wrong addresses of %q (-want +got)\n%s", want[i].Name, diff)
+		}
+	}
+}
+
+func addrStrings(addrs []net.Addr) []string {
+	ret := []string{}
+	for _, a := range addrs {
+		ret = append(ret, a.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,215 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package linkwatch reports network interfaces whose link comes back
+// up, e.g. after a switch port flap, and changes of the node's
+// addresses, e.g. after DHCP renumbered it.
+package linkwatch // import "go.universe.tf/metallb/internal/linkwatch"
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// watcher tracks the link state of the interfaces.
+type watcher struct {
+	up map[int32]bool // interface index -> link up
+}
+
+// Watch calls up with the name of every interface whose link goes
+// from down to up, until stopCh is closed. It returns an error if
+// it can't subscribe to link changes.
+func Watch(l log.Logger, stopCh <-chan struct{}, up func(name string)) error {
+	fd, err := subscribe(unix.RTMGRP_LINK)
+	if err != nil {
+		return err
+	}
+	w := &watcher{up: map[int32]bool{}}
+	if err := w.seed(); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	go receive(l, fd, stopCh, "watchLinks", "link", func(msgs []syscall.NetlinkMessage) {
+		for _, name := range w.handle(msgs) {
+			level.Info(l).Log("event", "linkUp", "interface", name, "msg", "interface link came back up")
+			up(name)
+		}
+	}, func() error {
+		return w.seed()
+	})
+	return nil
+}
+
+// WatchAddrs calls changed every time an address is added to or
+// removed from an interface, until stopCh is closed. It returns an
+// error if it can't subscribe to address changes.
+func WatchAddrs(l log.Logger, stopCh <-chan struct{}, changed func()) error {
+	fd, err := subscribe(unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR)
+	if err != nil {
+		return err
+	}
+
+	go receive(l, fd, stopCh, "watchAddrs", "address", func(msgs []syscall.NetlinkMessage) {
+		if addrsChanged(msgs) {
+			level.Info(l).Log("event", "addressesChanged", "msg", "node addresses changed")
+			changed()
+		}
+	}, func() error {
+		// Some changes were lost, assume that there were some.
+		changed()
+		return nil
+	})
+	return nil
+}
+
+// subscribe opens a netlink socket receiving the route notifications
+// of groups.
+func subscribe(groups uint32) (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+		return -1, os.NewSyscallError("bind", err)
+	}
+	// Wake up regularly to notice stopCh closing.
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return -1, os.NewSyscallError("setsockopt", err)
+	}
+	return fd, nil
+}
+
+// receive passes the notifications read from fd to handle until
+// stopCh is closed, and calls resync when some were lost. It closes
+// fd when it returns.
+func receive(l log.Logger, fd int, stopCh <-chan struct{}, op, what string, handle func([]syscall.NetlinkMessage), resync func() error) {
+	defer unix.Close(fd)
+	buf := make([]byte, os.Getpagesize()*4)
+	for {
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		switch {
+		case err == unix.EAGAIN || err == unix.EINTR:
+			continue
+		case err == unix.ENOBUFS:
+			// We missed some changes, start over from the
+			// current state.
+			level.Warn(l).Log("op", op, "error", err, "msg", what+" change notifications lost, resyncing "+what+" state")
+			if err := resync(); err != nil {
+				level.Error(l).Log("op", op, "error", err, "msg", "failed to resync "+what+" state")
+			}
+			continue
+		case err != nil:
+			level.Error(l).Log("op", op, "error", err, "msg", "failed to read "+what+" changes, no longer watching them")
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			level.Error(l).Log("op", op, "error", err, "msg", "failed to parse "+what+" changes")
+			continue
+		}
+		handle(msgs)
+	}
+}
+
+// seed records the current link state of all interfaces.
+func (w *watcher) seed() error {
+	bs, err := syscall.NetlinkRIB(unix.RTM_GETLINK, unix.AF_UNSPEC)
+	if err != nil {
+		return os.NewSyscallError("netlinkrib", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(bs)
+	if err != nil {
+		return err
+	}
+	w.up = map[int32]bool{}
+	w.handle(msgs)
+	return nil
+}
+
+// handle updates the link state from msgs, and returns the names of
+// the interfaces whose link came up. Interfaces seen for the first
+// time aren't reported.
+func (w *watcher) handle(msgs []syscall.NetlinkMessage) []string {
+	var ret []string
+	for i := range msgs {
+		m := &msgs[i]
+		if len(m.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		info := (*unix.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+		switch m.Header.Type {
+		case unix.RTM_DELLINK:
+			delete(w.up, info.Index)
+		case unix.RTM_NEWLINK:
+			up := info.Flags&unix.IFF_UP != 0 && info.Flags&unix.IFF_LOWER_UP != 0
+			was, seen := w.up[info.Index]
+			w.up[info.Index] = up
+			if seen && !was && up {
+				ret = append(ret, ifName(m))
+			}
+		}
+	}
+	return ret
+}
+
+// addrsChanged returns true if msgs add or remove global addresses.
+// IPv6 addresses are only reported once duplicate address detection
+// let them be used.
+func addrsChanged(msgs []syscall.NetlinkMessage) bool {
+	for i := range msgs {
+		m := &msgs[i]
+		if len(m.Data) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		info := (*unix.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if info.Scope != unix.RT_SCOPE_UNIVERSE {
+			continue
+		}
+		switch m.Header.Type {
+		case unix.RTM_DELADDR:
+			return true
+		case unix.RTM_NEWADDR:
+			if info.Flags&unix.IFA_F_TENTATIVE == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ifName returns the interface name of the link message m.
+func ifName(m *syscall.NetlinkMessage) string {
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return ""
+	}
+	for _, a := range attrs {
+		if a.Attr.Type == unix.IFLA_IFNAME {
+			return strings.TrimRight(string(a.Value), "\x00")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,144 @@
+package linkwatch
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func linkMsg(typ uint16, index int32, flags uint32, name string) syscall.NetlinkMessage {
+	info := unix.IfInfomsg{
+		Index: index,
+		Flags: flags,
+	}
+	data := make([]byte, unix.SizeofIfInfomsg)
+	copy(data, (*[unix.SizeofIfInfomsg]byte)(unsafe.Pointer(&info))[:])
+
+	attr := make([]byte, unix.SizeofRtAttr+len(name)+1)
+	rta := (*unix.RtAttr)(unsafe.Pointer(&attr[0]))
+	rta.Len = uint16(len(attr))
+	rta.Type = unix.IFLA_IFNAME
+	copy(attr[unix.SizeofRtAttr:], name)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: typ},
+		Data:   append(data, attr...),
+	}
+}
+
+func TestHandle(t *testing.T) {
+	const up = unix.IFF_UP | unix.IFF_LOWER_UP
+	w := &watcher{up: map[int32]bool{}}
+
+	tests := []struct {
+		desc string
+		msgs []syscall.NetlinkMessage
+		want []string
+	}{
+		{
+			desc: "initial state",
+			msgs: []syscall.NetlinkMessage{
+				linkMsg(unix.RTM_NEWLINK, 1, up, "eth0"),
+				linkMsg(unix.RTM_NEWLINK, 2, unix.IFF_UP, "eth1"),
+			},
+		},
+		{
+			desc: "link already up changes",
+			msgs: []syscall.NetlinkMessage{
+				linkMsg(unix.RTM_NEWLINK, 1, up, "eth0"),
+			},
+		},
+		{
+			desc: "carrier comes up",
+			msgs: []syscall.NetlinkMessage{
+				linkMsg(unix.RTM_NEWLINK, 2, up, "eth1"),
+			},
+			want: []string{"eth1"},
+		},
+		{
+			desc: "link flaps",
+			msgs: []syscall.NetlinkMessage{
+				linkMsg(unix.RTM_NEWLINK, 1, unix.IFF_UP, "eth0"),
+				linkMsg(unix.RTM_NEWLINK, 1, up, "eth0"),
+			},
+			want: []string{"eth0"},
+		},
+		{
+			desc: "new interface",
+			msgs: []syscall.NetlinkMessage{
+				linkMsg(unix.RTM_NEWLINK, 3, up, "eth2"),
+			},
+		},
+		{
+			desc: "interface removed and recreated",
+			msgs: []syscall.NetlinkMessage{
+				linkMsg(unix.RTM_DELLINK, 3, 0, "eth2"),
+				linkMsg(unix.RTM_NEWLINK, 3, up, "eth2"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, w.handle(test.msgs)); diff != "" {
+			t.Errorf("%s: unexpected links up (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func addrMsg(typ uint16, scope, flags uint8) syscall.NetlinkMessage {
+	info := unix.IfAddrmsg{
+		Family: unix.AF_INET6,
+		Flags:  flags,
+		Scope:  scope,
+		Index:  1,
+	}
+	data := make([]byte, unix.SizeofIfAddrmsg)
+	copy(data, (*[unix.SizeofIfAddrmsg]byte)(unsafe.Pointer(&info))[:])
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: typ},
+		Data:   data,
+	}
+}
+
+func TestAddrsChanged(t *testing.T) {
+	tests := []struct {
+		desc string
+		msgs []syscall.NetlinkMessage
+		want bool
+	}{
+		{
+			desc: "address added",
+			msgs: []syscall.NetlinkMessage{addrMsg(unix.RTM_NEWADDR, unix.RT_SCOPE_UNIVERSE, 0)},
+			want: true,
+		},
+		{
+			desc: "address removed",
+			msgs: []syscall.NetlinkMessage{addrMsg(unix.RTM_DELADDR, unix.RT_SCOPE_UNIVERSE, 0)},
+			want: true,
+		},
+		{
+			desc: "tentative address",
+			msgs: []syscall.NetlinkMessage{addrMsg(unix.RTM_NEWADDR, unix.RT_SCOPE_UNIVERSE, unix.IFA_F_TENTATIVE)},
+		},
+		{
+			desc: "link-local address",
+			msgs: []syscall.NetlinkMessage{addrMsg(unix.RTM_NEWADDR, unix.RT_SCOPE_LINK, 0)},
+		},
+		{
+			desc: "link change",
+			msgs: []syscall.NetlinkMessage{linkMsg(unix.RTM_NEWLINK, 1, unix.IFF_UP, "eth0")},
+		},
+	}
+
+	for _, test := range tests {
+		if got := addrsChanged(test.msgs); got != test.want {
+			t.Errorf("%s: addrsChanged() = %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
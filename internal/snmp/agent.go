@@ -0,0 +1,312 @@
+// Package snmp implements a read-only SNMP v1 and v2c agent, for
+// monitoring systems that can't scrape Prometheus metrics.
+package snmp // import "go.universe.tf/metallb/internal/snmp"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Types of variable values, besides int (INTEGER), string (OCTET
+// STRING) and net.IP (IpAddress).
+type (
+	Counter32 uint32
+	Gauge32   uint32
+	TimeTicks uint32
+)
+
+// Var is a variable of the MIB, and its value.
+type Var struct {
+	OID   OID
+	Value interface{}
+}
+
+// SNMP versions, as they appear in messages.
+const (
+	version1  = 0
+	version2c = 1
+)
+
+// Error statuses of responses.
+const (
+	errNoSuchName  = 2
+	errNotWritable = 17
+)
+
+// maxRepetitions caps the repetitions of a GetBulk request, to keep
+// the response in a single datagram.
+const maxRepetitions = 50
+
+// Agent answers read requests with the variables of a MIB.
+type Agent struct {
+	Logger log.Logger
+	// Community that requests must present.
+	Community string
+	// MIB returns the variables the agent exports.
+	MIB func() []Var
+}
+
+// Serve answers the requests arriving on conn, until it's closed.
+func (a *Agent) Serve(conn net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		resp, err := a.handle(buf[:n])
+		if err != nil {
+			level.Debug(a.Logger).Log("op", "snmp", "client", addr, "error", err, "msg", "dropping invalid SNMP request")
+			continue
+		}
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			level.Error(a.Logger).Log("op", "snmp", "client", addr, "error", err, "msg", "failed to send SNMP response")
+		}
+	}
+}
+
+// handle returns the response to the SNMP message req, or nil if it
+// doesn't warrant one.
+func (a *Agent) handle(req []byte) ([]byte, error) {
+	msg, _, err := readExpect(req, tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	v, msg, err := readExpect(msg, tagInteger)
+	if err != nil {
+		return nil, err
+	}
+	version, err := decodeInt(v)
+	if err != nil {
+		return nil, err
+	}
+	if version != version1 && version != version2c {
+		return nil, fmt.Errorf("unsupported SNMP version %d", version)
+	}
+	community, msg, err := readExpect(msg, tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if string(community) != a.Community {
+		return nil, errors.New("wrong community")
+	}
+	pdu, pduBody, _, err := readTLV(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var ints [3]int64
+	for i := range ints {
+		if v, pduBody, err = readExpect(pduBody, tagInteger); err != nil {
+			return nil, err
+		}
+		if ints[i], err = decodeInt(v); err != nil {
+			return nil, err
+		}
+	}
+	var oids []OID
+	vbs, _, err := readExpect(pduBody, tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	for len(vbs) > 0 {
+		var vb []byte
+		if vb, vbs, err = readExpect(vbs, tagSequence); err != nil {
+			return nil, err
+		}
+		if v, _, err = readExpect(vb, tagOID); err != nil {
+			return nil, err
+		}
+		oid, err := decodeOID(v)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	mib := a.MIB()
+	sort.Slice(mib, func(i, j int) bool { return mib[i].OID.Compare(mib[j].OID) < 0 })
+	r := response{version: version, oids: oids}
+	switch pdu {
+	case pduGet:
+		for i, oid := range oids {
+			j := sort.Search(len(mib), func(j int) bool { return mib[j].OID.Compare(oid) >= 0 })
+			if j < len(mib) && mib[j].OID.Compare(oid) == 0 {
+				r.add(mib[j])
+			} else {
+				r.missing(i, oid, tagNoSuchObject)
+			}
+		}
+	case pduGetNext:
+		for i, oid := range oids {
+			if next, ok := getNext(mib, oid); ok {
+				r.add(next)
+			} else {
+				r.missing(i, oid, tagEndOfMIBView)
+			}
+		}
+	case pduGetBulk:
+		if version == version1 {
+			return nil, errors.New("GetBulk request in SNMP v1")
+		}
+		nonRepeaters, reps := int(ints[1]), int(ints[2])
+		if nonRepeaters < 0 {
+			nonRepeaters = 0
+		}
+		if nonRepeaters > len(oids) {
+			nonRepeaters = len(oids)
+		}
+		if reps > maxRepetitions {
+			reps = maxRepetitions
+		}
+		for i, oid := range oids[:nonRepeaters] {
+			if next, ok := getNext(mib, oid); ok {
+				r.add(next)
+			} else {
+				r.missing(i, oid, tagEndOfMIBView)
+			}
+		}
+		cur := append([]OID{}, oids[nonRepeaters:]...)
+		for rep := 0; rep < reps && len(cur) > 0; rep++ {
+			done := true
+			for i, oid := range cur {
+				if next, ok := getNext(mib, oid); ok {
+					r.add(next)
+					cur[i] = next.OID
+					done = false
+				} else {
+					r.missing(i, oid, tagEndOfMIBView)
+				}
+			}
+			if done {
+				break
+			}
+		}
+	case pduSet:
+		status := errNotWritable
+		if version == version1 {
+			status = errNoSuchName
+		}
+		r.fail(status, 0)
+	default:
+		return nil, fmt.Errorf("unsupported PDU type 0x%02x", pdu)
+	}
+	return r.encode(a.Community, ints[0])
+}
+
+// getNext returns the first variable of mib after oid.
+func getNext(mib []Var, oid OID) (Var, bool) {
+	j := sort.Search(len(mib), func(j int) bool { return mib[j].OID.Compare(oid) > 0 })
+	if j == len(mib) {
+		return Var{}, false
+	}
+	return mib[j], true
+}
+
+// response is the response to a request.
+type response struct {
+	version int64
+	// The variables of the request, returned as is by SNMP v1 errors.
+	oids []OID
+
+	vars        []Var
+	errStatus   int
+	errIndex    int
+	failed      bool
+	exceptionAt map[int]byte
+}
+
+func (r *response) add(v Var) {
+	r.vars = append(r.vars, v)
+}
+
+// missing records that the i-th variable of the request has no
+// value. SNMP v2c returns the exception tag in its place, SNMP v1
+// fails the whole request.
+func (r *response) missing(i int, oid OID, exception byte) {
+	if r.version == version1 {
+		r.fail(errNoSuchName, i+1)
+		return
+	}
+	if r.exceptionAt == nil {
+		r.exceptionAt = map[int]byte{}
+	}
+	r.exceptionAt[len(r.vars)] = exception
+	r.vars = append(r.vars, Var{OID: oid})
+}
+
+func (r *response) fail(status, index int) {
+	if r.failed {
+		return
+	}
+	r.failed, r.errStatus, r.errIndex = true, status, index
+}
+
+func (r *response) encode(community string, reqID int64) ([]byte, error) {
+	var vbs []byte
+	if r.failed {
+		for _, oid := range r.oids {
+			vb := appendTLV(nil, tagOID, encodeOID(oid))
+			vb = appendTLV(vb, tagNull, nil)
+			vbs = appendTLV(vbs, tagSequence, vb)
+		}
+	} else {
+		for i, v := range r.vars {
+			vb := appendTLV(nil, tagOID, encodeOID(v.OID))
+			if tag, ok := r.exceptionAt[i]; ok {
+				vb = appendTLV(vb, tag, nil)
+			} else {
+				val, err := encodeValue(v.Value)
+				if err != nil {
+					return nil, fmt.Errorf("encoding %s: %s", v.OID, err)
+				}
+				vb = append(vb, val...)
+			}
+			vbs = appendTLV(vbs, tagSequence, vb)
+		}
+	}
+	pdu := appendTLV(nil, tagInteger, encodeInt(reqID))
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(r.errStatus)))
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(r.errIndex)))
+	pdu = appendTLV(pdu, tagSequence, vbs)
+	msg := appendTLV(nil, tagInteger, encodeInt(r.version))
+	msg = appendTLV(msg, tagOctetString, []byte(community))
+	msg = appendTLV(msg, pduResponse, pdu)
+	return appendTLV(nil, tagSequence, msg), nil
+}
+
+// encodeValue returns the BER encoding of a variable's value.
+func encodeValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case int:
+		return appendTLV(nil, tagInteger, encodeInt(int64(v))), nil
+	case string:
+		return appendTLV(nil, tagOctetString, []byte(v)), nil
+	case []byte:
+		return appendTLV(nil, tagOctetString, v), nil
+	case net.IP:
+		ip := v.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("IpAddress %s is not IPv4", v)
+		}
+		return appendTLV(nil, tagIPAddress, ip), nil
+	case Counter32:
+		return appendTLV(nil, tagCounter32, encodeInt(int64(v))), nil
+	case Gauge32:
+		return appendTLV(nil, tagGauge32, encodeInt(int64(v))), nil
+	case TimeTicks:
+		return appendTLV(nil, tagTimeTicks, encodeInt(int64(v))), nil
+	case OID:
+		return appendTLV(nil, tagOID, encodeOID(v)), nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
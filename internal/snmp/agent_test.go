@@ -0,0 +1,197 @@
+package snmp
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func testAgent() *Agent {
+	return &Agent{
+		Logger:    log.NewNopLogger(),
+		Community: "public",
+		MIB: func() []Var {
+			return []Var{
+				{MustParseOID("1.3.6.1.2.1.15.2.0"), 64500},
+				{MustParseOID("1.3.6.1.2.1.15.1.0"), []byte{0x10}},
+				{MustParseOID("1.3.6.1.2.1.15.3.1.7.10.0.0.1"), net.ParseIP("10.0.0.1")},
+				{MustParseOID("1.3.6.1.2.1.15.3.1.11.10.0.0.1"), Counter32(300)},
+			}
+		},
+	}
+}
+
+// request encodes an SNMP request.
+func request(version int64, community string, pdu byte, a, b int64, oids ...string) []byte {
+	var vbs []byte
+	for _, o := range oids {
+		vb := appendTLV(nil, tagOID, encodeOID(MustParseOID(o)))
+		vb = appendTLV(vb, tagNull, nil)
+		vbs = appendTLV(vbs, tagSequence, vb)
+	}
+	body := appendTLV(nil, tagInteger, encodeInt(42))
+	body = appendTLV(body, tagInteger, encodeInt(a))
+	body = appendTLV(body, tagInteger, encodeInt(b))
+	body = appendTLV(body, tagSequence, vbs)
+	msg := appendTLV(nil, tagInteger, encodeInt(version))
+	msg = appendTLV(msg, tagOctetString, []byte(community))
+	msg = appendTLV(msg, pdu, body)
+	return appendTLV(nil, tagSequence, msg)
+}
+
+type testResponse struct {
+	ErrStatus, ErrIndex int64
+	// Variables, as OID=<hex BER value>.
+	Vars []string
+}
+
+func decodeResponse(t *testing.T, b []byte) testResponse {
+	msg, _, err := readExpect(b, tagSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err = readExpect(msg, tagInteger); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err = readExpect(msg, tagOctetString); err != nil {
+		t.Fatal(err)
+	}
+	pdu, _, err := readExpect(msg, pduResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ret testResponse
+	for i, p := range []*int64{new(int64), &ret.ErrStatus, &ret.ErrIndex} {
+		var v []byte
+		if v, pdu, err = readExpect(pdu, tagInteger); err != nil {
+			t.Fatal(err)
+		}
+		if *p, err = decodeInt(v); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && *p != 42 {
+			t.Errorf("wrong request ID %d", *p)
+		}
+	}
+	vbs, _, err := readExpect(pdu, tagSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(vbs) > 0 {
+		var vb, v []byte
+		if vb, vbs, err = readExpect(vbs, tagSequence); err != nil {
+			t.Fatal(err)
+		}
+		if v, vb, err = readExpect(vb, tagOID); err != nil {
+			t.Fatal(err)
+		}
+		oid, err := decodeOID(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret.Vars = append(ret.Vars, oid.String()+"="+hex.EncodeToString(vb))
+	}
+	return ret
+}
+
+func TestAgent(t *testing.T) {
+	tests := []struct {
+		desc string
+		req  []byte
+		want *testResponse
+	}{
+		{
+			// snmpget -v2c -c public localhost 1.3.6.1.2.1.15.2.0
+			desc: "net-snmp get",
+			req: []byte{
+				0x30, 0x26, 0x02, 0x01, 0x01, 0x04, 0x06, 'p', 'u', 'b', 'l', 'i', 'c',
+				0xa0, 0x19, 0x02, 0x01, 0x2a, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00,
+				0x30, 0x0e, 0x30, 0x0c, 0x06, 0x08, 0x2b, 0x06, 0x01, 0x02, 0x01, 0x0f, 0x02, 0x00, 0x05, 0x00,
+			},
+			want: &testResponse{Vars: []string{"1.3.6.1.2.1.15.2.0=020300fbf4"}},
+		},
+		{
+			desc: "get",
+			req:  request(version2c, "public", pduGet, 0, 0, "1.3.6.1.2.1.15.2.0", "1.3.6.1.2.1.15.3.1.7.10.0.0.1", "1.3.6.1.2.1.15.5.0"),
+			want: &testResponse{Vars: []string{
+				"1.3.6.1.2.1.15.2.0=020300fbf4",
+				"1.3.6.1.2.1.15.3.1.7.10.0.0.1=40040a000001",
+				"1.3.6.1.2.1.15.5.0=8000",
+			}},
+		},
+		{
+			desc: "get SNMP v1",
+			req:  request(version1, "public", pduGet, 0, 0, "1.3.6.1.2.1.15.2.0", "1.3.6.1.2.1.15.5.0"),
+			want: &testResponse{ErrStatus: errNoSuchName, ErrIndex: 2, Vars: []string{
+				"1.3.6.1.2.1.15.2.0=0500",
+				"1.3.6.1.2.1.15.5.0=0500",
+			}},
+		},
+		{
+			desc: "walk",
+			req:  request(version2c, "public", pduGetNext, 0, 0, "1.3.6.1.2.1.15", "1.3.6.1.2.1.15.3.1.7.10.0.0.1", "1.3.6.1.2.1.15.3.1.11.10.0.0.1"),
+			want: &testResponse{Vars: []string{
+				"1.3.6.1.2.1.15.1.0=040110",
+				"1.3.6.1.2.1.15.3.1.11.10.0.0.1=4102012c",
+				"1.3.6.1.2.1.15.3.1.11.10.0.0.1=8200",
+			}},
+		},
+		{
+			desc: "bulk",
+			req:  request(version2c, "public", pduGetBulk, 1, 3, "1.3.6.1.2.1.15.1.0", "1.3.6.1.2.1.15.2"),
+			want: &testResponse{Vars: []string{
+				"1.3.6.1.2.1.15.2.0=020300fbf4",
+				"1.3.6.1.2.1.15.2.0=020300fbf4",
+				"1.3.6.1.2.1.15.3.1.7.10.0.0.1=40040a000001",
+				"1.3.6.1.2.1.15.3.1.11.10.0.0.1=4102012c",
+			}},
+		},
+		{
+			desc: "set",
+			req:  request(version2c, "public", pduSet, 0, 0, "1.3.6.1.2.1.15.2.0"),
+			want: &testResponse{ErrStatus: errNotWritable, Vars: []string{"1.3.6.1.2.1.15.2.0=0500"}},
+		},
+		{
+			desc: "wrong community",
+			req:  request(version2c, "private", pduGet, 0, 0, "1.3.6.1.2.1.15.2.0"),
+		},
+	}
+	a := testAgent()
+	for _, test := range tests {
+		resp, err := a.handle(test.req)
+		if test.want == nil {
+			if resp != nil {
+				t.Errorf("%s: got a response to an invalid request", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.desc, err)
+			continue
+		}
+		if diff := cmp.Diff(*test.want, decodeResponse(t, resp)); diff != "" {
+			t.Errorf("%s: wrong response (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestOIDEncoding(t *testing.T) {
+	for _, s := range []string{"1.3.6.1.2.1.15", "1.3.6.1.4.1.9.9.187.1.2.4.1.6.10.0.0.1.1.1", "2.999.16384"} {
+		got, err := decodeOID(encodeOID(MustParseOID(s)))
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if got.String() != s {
+			t.Errorf("OID %s decoded as %s", s, got)
+		}
+	}
+	for n, want := range map[int64]string{0: "00", 127: "7f", 128: "0080", -1: "ff", -129: "ff7f", 64500: "00fbf4"} {
+		if got := hex.EncodeToString(encodeInt(n)); got != want {
+			t.Errorf("encodeInt(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package snmp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Just enough BER (X.690) to read and write SNMP messages.
+
+// ASN.1 and SNMP tags.
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+	tagIPAddress   = 0x40
+	tagCounter32   = 0x41
+	tagGauge32     = 0x42
+	tagTimeTicks   = 0x43
+
+	tagNoSuchObject = 0x80
+	tagEndOfMIBView = 0x82
+
+	pduGet      = 0xa0
+	pduGetNext  = 0xa1
+	pduResponse = 0xa2
+	pduSet      = 0xa3
+	pduGetBulk  = 0xa5
+)
+
+// OID is an object identifier.
+type OID []uint32
+
+// ParseOID parses an OID in dotted form, e.g. "1.3.6.1.2.1.15".
+func ParseOID(s string) (OID, error) {
+	var ret OID
+	for _, f := range strings.Split(strings.TrimPrefix(s, "."), ".") {
+		n, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		ret = append(ret, uint32(n))
+	}
+	if len(ret) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return ret, nil
+}
+
+// MustParseOID is like ParseOID, but panics if s is invalid.
+func MustParseOID(s string) OID {
+	ret, err := ParseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// Append returns o followed by the sub-identifiers subs, as a new
+// OID.
+func (o OID) Append(subs ...uint32) OID {
+	ret := make(OID, 0, len(o)+len(subs))
+	return append(append(ret, o...), subs...)
+}
+
+func (o OID) String() string {
+	fs := make([]string, len(o))
+	for i, n := range o {
+		fs[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(fs, ".")
+}
+
+// Compare returns -1, 0 or 1 if o sorts before, equal to or after p
+// in the lexicographic order of the MIB.
+func (o OID) Compare(p OID) int {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		switch {
+		case o[i] < p[i]:
+			return -1
+		case o[i] > p[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(p):
+		return -1
+	case len(o) > len(p):
+		return 1
+	}
+	return 0
+}
+
+var errTruncated = errors.New("truncated BER value")
+
+// readTLV splits the first BER value off b, and returns its tag, its
+// contents, and the rest of b.
+func readTLV(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errTruncated
+	}
+	tag, l, b := b[0], int(b[1]), b[2:]
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 3 || len(b) < n {
+			return 0, nil, nil, fmt.Errorf("unsupported BER length of %d bytes", n)
+		}
+		l = 0
+		for _, c := range b[:n] {
+			l = l<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if len(b) < l {
+		return 0, nil, nil, errTruncated
+	}
+	return tag, b[:l], b[l:], nil
+}
+
+// readExpect is readTLV, for a value that must have the given tag.
+func readExpect(b []byte, tag byte) ([]byte, []byte, error) {
+	t, v, rest, err := readTLV(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != tag {
+		return nil, nil, fmt.Errorf("unexpected BER tag 0x%02x, want 0x%02x", t, tag)
+	}
+	return v, rest, nil
+}
+
+func decodeInt(v []byte) (int64, error) {
+	if len(v) == 0 || len(v) > 8 {
+		return 0, fmt.Errorf("invalid BER integer of %d bytes", len(v))
+	}
+	ret := int64(int8(v[0]))
+	for _, c := range v[1:] {
+		ret = ret<<8 | int64(c)
+	}
+	return ret, nil
+}
+
+func decodeOID(v []byte) (OID, error) {
+	if len(v) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	var (
+		ret OID
+		n   uint32
+	)
+	for i, c := range v {
+		n = n<<7 | uint32(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(v)-1 {
+				return nil, errTruncated
+			}
+			continue
+		}
+		if ret == nil {
+			// The first two sub-identifiers share a byte.
+			if n < 80 {
+				ret = OID{n / 40, n % 40}
+			} else {
+				ret = OID{2, n - 80}
+			}
+		} else {
+			ret = append(ret, n)
+		}
+		n = 0
+	}
+	return ret, nil
+}
+
+// appendTLV appends the BER value with tag and contents v to b.
+func appendTLV(b []byte, tag byte, v []byte) []byte {
+	b = append(b, tag)
+	switch l := len(v); {
+	case l < 0x80:
+		b = append(b, byte(l))
+	case l <= 0xff:
+		b = append(b, 0x81, byte(l))
+	case l <= 0xffff:
+		b = append(b, 0x82, byte(l>>8), byte(l))
+	default:
+		b = append(b, 0x83, byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(b, v...)
+}
+
+// encodeInt returns the contents of the BER integer n.
+func encodeInt(n int64) []byte {
+	var ret []byte
+	for {
+		ret = append([]byte{byte(n)}, ret...)
+		// Stop once the remaining bits are the sign extension of the
+		// encoded ones.
+		if (n < 128 && n >= -128) || n == 0 {
+			return ret
+		}
+		n >>= 8
+	}
+}
+
+func encodeOID(o OID) []byte {
+	var ret []byte
+	subs := []uint32(o)
+	if len(subs) >= 2 {
+		subs = append([]uint32{subs[0]*40 + subs[1]}, subs[2:]...)
+	}
+	for _, n := range subs {
+		var enc []byte
+		for {
+			enc = append([]byte{byte(n & 0x7f)}, enc...)
+			n >>= 7
+			if n == 0 {
+				break
+			}
+		}
+		for i := 0; i < len(enc)-1; i++ {
+			enc[i] |= 0x80
+		}
+		ret = append(ret, enc...)
+	}
+	return ret
+}
@@ -0,0 +1,327 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speakerlist
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// LeaseList is a list of healthy speakers, like SpeakerList, that
+// finds out which speakers are alive from the Kubernetes Leases they
+// renew, instead of memberlist gossip. It only needs access to the
+// API server, at the cost of slower failure detection.
+type LeaseList struct {
+	l         log.Logger
+	client    *k8s.Client
+	stopCh    chan struct{}
+	node      string
+	namespace string
+	duration  time.Duration
+
+	// Lists the speaker Leases, nil until Start.
+	list      func() []k8s.SpeakerLease
+	changedCh chan struct{}
+	renewCh   chan struct{}
+
+	mu sync.Mutex
+	// Local node state published in its Lease.
+	state nodeState
+	// The speakers' Leases, by node.
+	leases map[string]*observedLease
+	// When the local Lease was last renewed. Until it is renewed
+	// once, all speakers are considered usable.
+	renewed time.Time
+	// The live speakers the last time the local Lease was fresh.
+	lastAlive map[string]*observedLease
+}
+
+// observedLease is a speaker Lease, and when we last saw it renewed.
+// The local clock decides when Leases expire, so that speakers
+// don't need synchronized clocks.
+type observedLease struct {
+	version  string
+	renewed  time.Time
+	duration time.Duration
+	state    nodeState
+}
+
+// NewLeaseList creates a LeaseList for the speaker of nodeName, whose
+// Lease in namespace lasts duration.
+func NewLeaseList(logger log.Logger, nodeName, namespace string, duration time.Duration, stopCh chan struct{}) *LeaseList {
+	return &LeaseList{
+		l:         logger,
+		stopCh:    stopCh,
+		node:      nodeName,
+		namespace: namespace,
+		duration:  duration,
+		changedCh: make(chan struct{}, 1),
+		renewCh:   make(chan struct{}, 1),
+		leases:    map[string]*observedLease{},
+		state:     nodeState{Since: time.Now().Unix()},
+	}
+}
+
+// Start starts renewing the local speaker's Lease, and watching the
+// Leases of the other speakers.
+func (ll *LeaseList) Start(client *k8s.Client) {
+	ll.client = client
+	ll.list = client.WatchSpeakerLeases(ll.namespace, func() {
+		select {
+		case ll.changedCh <- struct{}{}:
+		default:
+		}
+	}, ll.stopCh)
+	level.Info(ll.l).Log("op", "startup", "duration", ll.duration, "msg", "detecting dead nodes with speaker Leases")
+	go ll.run()
+}
+
+func (ll *LeaseList) run() {
+	ll.renew()
+	renew := time.NewTicker(ll.duration / 3)
+	defer renew.Stop()
+	// Leases expire without any event, look for them regularly.
+	expire := time.NewTicker(time.Second)
+	defer expire.Stop()
+
+	var states map[string]nodeState
+	stale := false
+	for {
+		select {
+		case <-ll.stopCh:
+			return
+		case <-renew.C:
+			ll.renew()
+		case <-ll.renewCh:
+			ll.renew()
+		case <-ll.changedCh:
+		case <-expire.C:
+		}
+		ll.observe(time.Now())
+		ll.mu.Lock()
+		fresh := ll.renewed.IsZero() || ll.fresh(time.Now())
+		ll.mu.Unlock()
+		if !fresh && !stale {
+			level.Warn(ll.l).Log("op", "memberDiscovery", "msg", "speaker Lease not renewed, keeping the last known speakers until it is")
+		}
+		stale = !fresh
+		if now := ll.states(); !sameStates(now, states) {
+			level.Info(ll.l).Log("op", "memberDiscovery", "speakers", len(now), "msg", "speakers changed - forcing sync")
+			states = now
+			ll.client.ForceSync()
+		}
+	}
+}
+
+// renew renews the local speaker's Lease.
+func (ll *LeaseList) renew() {
+	ll.mu.Lock()
+	bs, err := json.Marshal(ll.state)
+	ll.mu.Unlock()
+	if err != nil {
+		return
+	}
+	if err := ll.client.RenewSpeakerLease(ll.namespace, k8s.SpeakerLease{Node: ll.node, Duration: ll.duration, State: string(bs)}); err != nil {
+		level.Error(ll.l).Log("op", "renewLease", "error", err, "msg", "failed to renew the speaker Lease")
+		return
+	}
+	ll.mu.Lock()
+	ll.renewed = time.Now()
+	ll.mu.Unlock()
+}
+
+// observe records which Leases were renewed since the last call.
+func (ll *LeaseList) observe(now time.Time) {
+	leases := ll.list()
+
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	seen := map[string]bool{}
+	for _, l := range leases {
+		seen[l.Node] = true
+		o := ll.leases[l.Node]
+		if o == nil || o.version != l.ResourceVersion {
+			ll.leases[l.Node] = &observedLease{
+				version:  l.ResourceVersion,
+				renewed:  now,
+				duration: l.Duration,
+				state:    parseNodeMeta([]byte(l.State)),
+			}
+		}
+	}
+	for node := range ll.leases {
+		// Deleted Leases are released, the speaker left.
+		if !seen[node] {
+			delete(ll.leases, node)
+		}
+	}
+}
+
+// states returns the state of the nodes of the live speakers.
+func (ll *LeaseList) states() map[string]nodeState {
+	alive := ll.alive()
+	if alive == nil {
+		return nil
+	}
+	ret := map[string]nodeState{}
+	for node, l := range alive {
+		ret[node] = l.state
+	}
+	return ret
+}
+
+// alive returns the Leases that haven't expired.
+//
+// If the local Lease can't be renewed, the API server is likely
+// unreachable, and the other Leases look expired only because we
+// can't see them renewed. The Leases alive when the local Lease was
+// last fresh are returned instead, so that the speakers keep their
+// announcements rather than all withdrawing them.
+func (ll *LeaseList) alive() map[string]*observedLease {
+	return ll.aliveAt(time.Now())
+}
+
+func (ll *LeaseList) aliveAt(now time.Time) map[string]*observedLease {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if ll.renewed.IsZero() {
+		return nil
+	}
+	if !ll.fresh(now) {
+		return ll.lastAlive
+	}
+	ret := map[string]*observedLease{}
+	for node, l := range ll.leases {
+		if now.Sub(l.renewed) < l.duration {
+			ret[node] = l
+		}
+	}
+	ll.lastAlive = ret
+	return ret
+}
+
+// fresh returns whether the local Lease was renewed recently enough
+// to trust the expiry of the others at now. The Leases are renewed
+// every third of their duration, so two failed renewals in a row
+// make it stale before any Lease renewed at the same time as ours
+// expires.
+func (ll *LeaseList) fresh(now time.Time) bool {
+	return now.Sub(ll.renewed) < ll.duration/2
+}
+
+// UsableSpeakers returns a map of usable speaker nodes.
+func (ll *LeaseList) UsableSpeakers() map[string]bool {
+	alive := ll.alive()
+	if alive == nil {
+		return nil
+	}
+	ret := map[string]bool{}
+	for node, l := range alive {
+		ret[node] = !l.state.Draining
+	}
+	return ret
+}
+
+// Priorities returns the announcement priority of the speaker nodes,
+// lower is preferred.
+func (ll *LeaseList) Priorities() map[string]int {
+	alive := ll.alive()
+	if alive == nil {
+		return nil
+	}
+	ret := map[string]int{}
+	for node, l := range alive {
+		ret[node] = l.state.Priority
+	}
+	return ret
+}
+
+// StartTimes returns when the speakers started.
+func (ll *LeaseList) StartTimes() map[string]time.Time {
+	alive := ll.alive()
+	if alive == nil {
+		return nil
+	}
+	ret := map[string]time.Time{}
+	for node, l := range alive {
+		ret[node] = startTime(l.state)
+	}
+	return ret
+}
+
+// Rejoin does nothing, speakers don't need to discover each other.
+func (ll *LeaseList) Rejoin() {}
+
+// SetDraining tells the other speakers whether the local node is
+// being drained, so that they take over its announcements.
+func (ll *LeaseList) SetDraining(draining bool) {
+	ll.mu.Lock()
+	changed := ll.state.Draining != draining
+	ll.state.Draining = draining
+	ll.mu.Unlock()
+
+	if changed {
+		ll.triggerRenew()
+	}
+}
+
+// SetPriority tells the other speakers the announcement priority of
+// the local node.
+func (ll *LeaseList) SetPriority(priority int) {
+	ll.mu.Lock()
+	changed := ll.state.Priority != priority
+	ll.state.Priority = priority
+	ll.mu.Unlock()
+
+	if changed {
+		ll.triggerRenew()
+	}
+}
+
+// triggerRenew publishes changes of the local node's state right
+// away, instead of at the next renewal.
+func (ll *LeaseList) triggerRenew() {
+	select {
+	case ll.renewCh <- struct{}{}:
+	default:
+	}
+}
+
+// Stop releases the local speaker's Lease, so that the other speakers
+// take over its announcements without waiting for it to expire.
+func (ll *LeaseList) Stop() {
+	if ll.client == nil {
+		return
+	}
+	level.Info(ll.l).Log("op", "shutdown", "msg", "releasing speaker Lease")
+	err := ll.client.ReleaseSpeakerLease(ll.namespace, ll.node)
+	level.Info(ll.l).Log("op", "shutdown", "msg", "released speaker Lease", "error", err)
+}
+
+func sameStates(a, b map[string]nodeState) bool {
+	if (a == nil) != (b == nil) || len(a) != len(b) {
+		return false
+	}
+	for n, state := range a {
+		if s, ok := b[n]; !ok || s != state {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package speakerlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLeaseListAlive(t *testing.T) {
+	start := time.Now()
+	ll := NewLeaseList(log.NewNopLogger(), "a", "metallb-system", 15*time.Second, nil)
+	if ll.aliveAt(start) != nil {
+		t.Error("got live speakers before the local Lease was renewed")
+	}
+
+	ll.renewed = start
+	ll.leases = map[string]*observedLease{
+		"a": {renewed: start, duration: 15 * time.Second},
+		"b": {renewed: start, duration: 15 * time.Second},
+		"c": {renewed: start.Add(-14 * time.Second), duration: 15 * time.Second},
+	}
+	tests := []struct {
+		desc    string
+		renewed time.Time
+		at      time.Duration
+		want    []string
+	}{
+		{
+			desc:    "all renewed",
+			renewed: start,
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			desc:    "one expired",
+			renewed: start.Add(5 * time.Second),
+			at:      5 * time.Second,
+			want:    []string{"a", "b"},
+		},
+		{
+			desc:    "local Lease not renewed",
+			renewed: start.Add(5 * time.Second),
+			at:      20 * time.Second,
+			want:    []string{"a", "b"},
+		},
+		{
+			desc:    "local Lease renewed again",
+			renewed: start.Add(20 * time.Second),
+			at:      20 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		ll.renewed = test.renewed
+		alive := ll.aliveAt(start.Add(test.at))
+		if alive == nil {
+			t.Errorf("%s: got no live speakers", test.desc)
+			continue
+		}
+		if len(alive) != len(test.want) {
+			t.Errorf("%s: got %d live speakers, want %v", test.desc, len(alive), test.want)
+		}
+		for _, n := range test.want {
+			if alive[n] == nil {
+				t.Errorf("%s: speaker %q not alive", test.desc, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package speakerlist
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// speakers is a list of healthy speakers, a SpeakerList or a
+// LeaseList.
+type speakers interface {
+	UsableSpeakers() map[string]bool
+	Priorities() map[string]int
+	StartTimes() map[string]time.Time
+	Rejoin()
+	SetDraining(bool)
+	SetPriority(int)
+	Start(*k8s.Client)
+	Stop()
+}
+
+// NodeLeaseList wraps a list of healthy speakers, and makes the
+// speakers of nodes whose kubelet stopped renewing its node Lease
+// unusable. Kubelets renew their Lease every 10 seconds by default,
+// so this takes over the announcements of dead nodes well before
+// their Ready condition flips.
+type NodeLeaseList struct {
+	speakers
+
+	l       log.Logger
+	myNode  string
+	client  *k8s.Client
+	stopCh  chan struct{}
+	timeout time.Duration
+
+	// Lists the node Leases, nil until Start.
+	list      func() []k8s.NodeLease
+	changedCh chan struct{}
+
+	mu sync.Mutex
+	// The node Leases, by node. Only version and renewed are set.
+	leases map[string]*observedLease
+}
+
+// NewNodeLeaseList wraps speakers in a NodeLeaseList, which considers
+// nodes whose Lease wasn't renewed for timeout dead. myNode is the
+// node of this speaker.
+func NewNodeLeaseList(logger log.Logger, myNode string, speakers speakers, timeout time.Duration, stopCh chan struct{}) *NodeLeaseList {
+	return &NodeLeaseList{
+		speakers:  speakers,
+		l:         logger,
+		myNode:    myNode,
+		stopCh:    stopCh,
+		timeout:   timeout,
+		changedCh: make(chan struct{}, 1),
+		leases:    map[string]*observedLease{},
+	}
+}
+
+// Start starts the wrapped list, and watching the node Leases.
+func (nl *NodeLeaseList) Start(client *k8s.Client) {
+	nl.speakers.Start(client)
+	nl.client = client
+	nl.list = client.WatchNodeLeases(func() {
+		select {
+		case nl.changedCh <- struct{}{}:
+		default:
+		}
+	}, nl.stopCh)
+	level.Info(nl.l).Log("op", "startup", "timeout", nl.timeout, "msg", "detecting dead nodes with node Leases")
+	go nl.run()
+}
+
+func (nl *NodeLeaseList) run() {
+	// Leases go stale without any event, look for them regularly.
+	expire := time.NewTicker(time.Second)
+	defer expire.Stop()
+
+	var stale []string
+	for {
+		select {
+		case <-nl.stopCh:
+			return
+		case <-nl.changedCh:
+		case <-expire.C:
+		}
+		nl.observe(time.Now())
+		if now := nl.stale(time.Now()); !sameNodes(now, stale) {
+			level.Info(nl.l).Log("op", "memberDiscovery", "staleNodes", len(now), "nodes", now, "msg", "node Leases changed - forcing sync")
+			stale = now
+			nl.client.ForceSync()
+		}
+	}
+}
+
+// observe records which node Leases were renewed since the last call.
+func (nl *NodeLeaseList) observe(now time.Time) {
+	leases := nl.list()
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	seen := map[string]bool{}
+	for _, l := range leases {
+		seen[l.Node] = true
+		o := nl.leases[l.Node]
+		if o == nil || o.version != l.ResourceVersion {
+			nl.leases[l.Node] = &observedLease{
+				version: l.ResourceVersion,
+				renewed: now,
+			}
+		}
+	}
+	for node := range nl.leases {
+		// The node was deleted.
+		if !seen[node] {
+			delete(nl.leases, node)
+		}
+	}
+}
+
+// stale returns the sorted nodes whose Lease wasn't renewed for the
+// timeout at now. Leases stop changing for everyone when the watch or
+// the API server is down, so none is stale while the Lease of this
+// node is, which covers the case where they all are.
+func (nl *NodeLeaseList) stale(now time.Time) []string {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	if mine := nl.leases[nl.myNode]; mine == nil || now.Sub(mine.renewed) >= nl.timeout {
+		return nil
+	}
+	var ret []string
+	for node, l := range nl.leases {
+		if now.Sub(l.renewed) >= nl.timeout {
+			ret = append(ret, node)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// UsableSpeakers returns a map of usable speaker nodes, where the
+// speakers of nodes with a stale Lease aren't usable.
+func (nl *NodeLeaseList) UsableSpeakers() map[string]bool {
+	ret := nl.speakers.UsableSpeakers()
+	if ret == nil {
+		return nil
+	}
+	for _, node := range nl.stale(time.Now()) {
+		if _, ok := ret[node]; ok {
+			ret[node] = false
+		}
+	}
+	return ret
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package speakerlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// fakeSpeakers is a list of speakers that are all usable.
+type fakeSpeakers struct {
+	speakers
+	nodes []string
+}
+
+func (f *fakeSpeakers) UsableSpeakers() map[string]bool {
+	ret := map[string]bool{}
+	for _, n := range f.nodes {
+		ret[n] = true
+	}
+	return ret
+}
+
+func TestNodeLeaseListStale(t *testing.T) {
+	start := time.Now()
+	nl := NewNodeLeaseList(log.NewNopLogger(), "a", &fakeSpeakers{nodes: []string{"a", "b", "c"}}, 15*time.Second, nil)
+	versions := map[string]string{"a": "1", "b": "1", "c": "1"}
+	nl.list = func() []k8s.NodeLease {
+		var ret []k8s.NodeLease
+		for node, v := range versions {
+			ret = append(ret, k8s.NodeLease{Node: node, ResourceVersion: v})
+		}
+		return ret
+	}
+	nl.observe(start)
+
+	tests := []struct {
+		desc    string
+		renewed []string
+		at      time.Duration
+		want    map[string]bool
+	}{
+		{
+			desc: "all renewed",
+			want: map[string]bool{"a": true, "b": true, "c": true},
+		},
+		{
+			desc:    "one node failed",
+			renewed: []string{"a", "b"},
+			at:      10 * time.Second,
+			want:    map[string]bool{"a": true, "b": true, "c": true},
+		},
+		{
+			desc: "after the timeout",
+			at:   20 * time.Second,
+			want: map[string]bool{"a": true, "b": true, "c": false},
+		},
+		{
+			desc:    "own Lease stale",
+			renewed: []string{"b"},
+			at:      30 * time.Second,
+			want:    map[string]bool{"a": true, "b": true, "c": true},
+		},
+		{
+			desc:    "own Lease renewed again",
+			renewed: []string{"a"},
+			at:      35 * time.Second,
+			want:    map[string]bool{"a": true, "b": true, "c": false},
+		},
+		{
+			desc: "all Leases stale",
+			at:   60 * time.Second,
+			want: map[string]bool{"a": true, "b": true, "c": true},
+		},
+	}
+	for _, test := range tests {
+		for _, node := range test.renewed {
+			versions[node] += "1"
+		}
+		nl.observe(start.Add(test.at))
+		got := nl.speakers.UsableSpeakers()
+		for _, node := range nl.stale(start.Add(test.at)) {
+			got[node] = false
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: wrong usable speakers (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
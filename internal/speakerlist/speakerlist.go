@@ -13,8 +13,13 @@
 package speakerlist
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -40,18 +45,110 @@ type SpeakerList struct {
 
 	mlMux        sync.Mutex // Mutex for mlSpeakerIPs.
 	mlSpeakerIPs []string   // Speaker pod IPs.
+
+	// Keys encrypting the memberlist traffic, nil if it is not
+	// encrypted.
+	keyring *memberlist.Keyring
+	// The Secret holding the keys, watched to rotate them.
+	secretName string
+
+	meta *nodeMeta // Local node state gossiped to other speakers.
+}
+
+// drainingMeta is the memberlist node metadata of speakers whose node
+// is being drained.
+const drainingMeta = "draining"
+
+// nodeState is the state of a speaker's node, as gossiped to the
+// other speakers.
+type nodeState struct {
+	Draining bool `json:"draining,omitempty"`
+	Priority int  `json:"priority,omitempty"`
+	// When the speaker started, in seconds since the epoch.
+	Since int64 `json:"since,omitempty"`
+}
+
+// nodeMeta is a memberlist.Delegate that gossips the local node's
+// state.
+type nodeMeta struct {
+	mu    sync.Mutex
+	state nodeState
 }
 
+func (m *nodeMeta) NodeMeta(limit int) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.state.Priority == 0 && m.state.Since == 0 {
+		// The format older speakers understand.
+		if m.state.Draining {
+			return []byte(drainingMeta)
+		}
+		return nil
+	}
+	bs, err := json.Marshal(m.state)
+	if err != nil || len(bs) > limit {
+		return nil
+	}
+	return bs
+}
+
+// parseNodeMeta decodes the node state gossiped by a speaker.
+func parseNodeMeta(meta []byte) nodeState {
+	var ret nodeState
+	switch {
+	case len(meta) == 0:
+	case string(meta) == drainingMeta:
+		ret.Draining = true
+	default:
+		// Unparseable metadata, e.g. from a newer speaker, is
+		// treated as the default state.
+		_ = json.Unmarshal(meta, &ret)
+	}
+	return ret
+}
+
+func (m *nodeMeta) NotifyMsg([]byte)                           {}
+func (m *nodeMeta) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (m *nodeMeta) LocalState(join bool) []byte                { return nil }
+func (m *nodeMeta) MergeRemoteState(buf []byte, join bool)     {}
+
+// Config is the configuration of memberlist.
+type Config struct {
+	// Name of the speaker's node.
+	NodeName string
+	BindAddr string
+	BindPort string
+	// If set, memberlist listens on all addresses, and tells the
+	// other speakers to reach it at the address of this interface, so
+	// that the gossip goes through it.
+	BindInterface string
+	// Key encrypting the memberlist traffic.
+	Secret string
+	// If set, the Secret in Namespace holding the keys, which is
+	// watched to rotate them without restarting the speakers.
+	SecretName string
+	Namespace  string
+	// Labels of the speaker pods.
+	Labels string
+}
+
+// secretKeyField is the field of the memberlist Secret holding the
+// key that encrypts the traffic. Fields prefixed with it and a dash
+// hold keys that are only used to decrypt it.
+const secretKeyField = "secretkey"
+
 // New creates a new SpeakerList and returns a pointer to it.
-func New(logger log.Logger, nodeName, bindAddr, bindPort, secret, namespace, labels string, stopCh chan struct{}) (*SpeakerList, error) {
+func New(logger log.Logger, cfg Config, stopCh chan struct{}) (*SpeakerList, error) {
 	sl := SpeakerList{
-		l:         logger,
-		stopCh:    stopCh,
-		namespace: namespace,
-		labels:    labels,
+		l:          logger,
+		stopCh:     stopCh,
+		namespace:  cfg.Namespace,
+		labels:     cfg.Labels,
+		meta:       &nodeMeta{state: nodeState{Since: time.Now().Unix()}},
+		secretName: cfg.SecretName,
 	}
 
-	if labels == "" || bindAddr == "" {
+	if cfg.Labels == "" || (cfg.BindAddr == "" && cfg.BindInterface == "") {
 		level.Info(logger).Log("op", "startup", "msg", "not starting fast dead node detection (memberlist), need ml-bindaddr / ml-labels config")
 		return &sl, nil
 	}
@@ -60,10 +157,20 @@ func New(logger log.Logger, nodeName, bindAddr, bindPort, secret, namespace, lab
 
 	// mconfig.Name MUST be equal to the spec.nodeName field of the speaker pod as we match it
 	// against the nodeName field of Endpoint objects inside usableNodes().
-	mconfig.Name = nodeName
-	mconfig.BindAddr = bindAddr
-	if bindPort != "" {
-		mlport, err := strconv.Atoi(bindPort)
+	mconfig.Name = cfg.NodeName
+	mconfig.BindAddr = cfg.BindAddr
+	if cfg.BindInterface != "" {
+		addr, err := interfaceAddr(cfg.BindInterface)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "interface", cfg.BindInterface, "msg", "failed to get the memberlist interface address")
+			return nil, err
+		}
+		// The other speakers still join us through our pod IP.
+		mconfig.BindAddr = "0.0.0.0"
+		mconfig.AdvertiseAddr = addr.String()
+	}
+	if cfg.BindPort != "" {
+		mlport, err := strconv.Atoi(cfg.BindPort)
 		if err != nil {
 			level.Error(logger).Log("op", "startup", "error", "unable to parse ml-bindport", "msg", err)
 			return nil, err
@@ -72,11 +179,14 @@ func New(logger log.Logger, nodeName, bindAddr, bindPort, secret, namespace, lab
 		mconfig.AdvertisePort = mlport
 	}
 	mconfig.Logger = newMemberlistLogger(sl.l)
-	if secret == "" {
+	if cfg.Secret == "" {
 		level.Warn(logger).Log("op", "startup", "warning", "no ml-secret-key set, memberlist traffic will not be encrypted")
+		if cfg.SecretName != "" {
+			level.Warn(logger).Log("op", "startup", "warning", "memberlist traffic is not encrypted, not rotating its keys")
+			sl.secretName = ""
+		}
 	} else {
-		sha := sha256.New()
-		mconfig.SecretKey = sha.Sum([]byte(secret))[:16]
+		mconfig.SecretKey = memberlistKey(cfg.Secret)
 	}
 
 	// This channel is used by the Rejoin() method which runs on k8s node
@@ -89,6 +199,7 @@ func New(logger log.Logger, nodeName, bindAddr, bindPort, secret, namespace, lab
 	// TODO: See https://github.com/metallb/metallb/issues/716
 	sl.mlEventCh = make(chan memberlist.NodeEvent, 1024)
 	mconfig.Events = &memberlist.ChannelEventDelegate{Ch: sl.mlEventCh}
+	mconfig.Delegate = sl.meta
 
 	ml, err := memberlist.Create(mconfig)
 	if err != nil {
@@ -97,10 +208,94 @@ func New(logger log.Logger, nodeName, bindAddr, bindPort, secret, namespace, lab
 	}
 
 	sl.ml = ml
+	sl.keyring = mconfig.Keyring
 
 	return &sl, nil
 }
 
+// memberlistKey derives the AES-128 key encrypting the memberlist
+// traffic from a secret.
+func memberlistKey(secret string) []byte {
+	// This is not a hash of the secret, but all the speakers must
+	// derive the same key as the older ones.
+	sha := sha256.New()
+	return sha.Sum([]byte(secret))[:16]
+}
+
+// interfaceAddr returns the address of the named interface,
+// preferring IPv4.
+func interfaceAddr(name string) (net.IP, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ret net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if ret == nil {
+			ret = ipnet.IP
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("interface %q has no usable address", name)
+	}
+	return ret, nil
+}
+
+// setKeys installs the keys of the memberlist Secret, whose data is
+// data. Keys are installed before the primary key changes, so that
+// a key can be rotated without interruption by first adding it in a
+// secondary field, then making it the primary key once all the
+// speakers have it, and removing the old key last.
+func (sl *SpeakerList) setKeys(data map[string][]byte) {
+	secret := data[secretKeyField]
+	if len(secret) == 0 {
+		level.Error(sl.l).Log("op", "setKeys", "secret", sl.secretName, "msg", "memberlist secret has no "+secretKeyField+", not changing the keys")
+		return
+	}
+	primary := memberlistKey(string(secret))
+	keys := [][]byte{primary}
+	for field, secret := range data {
+		if strings.HasPrefix(field, secretKeyField+"-") && len(secret) > 0 {
+			keys = append(keys, memberlistKey(string(secret)))
+		}
+	}
+
+	for _, key := range keys {
+		if err := sl.keyring.AddKey(key); err != nil {
+			level.Error(sl.l).Log("op", "setKeys", "error", err, "msg", "failed to install memberlist key")
+			return
+		}
+	}
+	if err := sl.keyring.UseKey(primary); err != nil {
+		level.Error(sl.l).Log("op", "setKeys", "error", err, "msg", "failed to use memberlist key")
+		return
+	}
+	installed := append([][]byte(nil), sl.keyring.GetKeys()...)
+	for _, key := range installed {
+		keep := false
+		for _, k := range keys {
+			keep = keep || bytes.Equal(k, key)
+		}
+		if !keep {
+			if err := sl.keyring.RemoveKey(key); err != nil {
+				level.Error(sl.l).Log("op", "setKeys", "error", err, "msg", "failed to remove memberlist key")
+			}
+		}
+	}
+	level.Info(sl.l).Log("op", "setKeys", "keys", len(keys), "msg", "memberlist keys updated")
+}
+
 // Start initializes the SpeakerList. This functions must be called before using
 // other SpeakerList methods.
 func (sl *SpeakerList) Start(client *k8s.Client) {
@@ -145,6 +340,10 @@ func (sl *SpeakerList) Start(client *k8s.Client) {
 	// Update mlSpeakerIPs in the background.
 	go sl.updateSpeakerIPs()
 
+	if sl.secretName != "" {
+		client.WatchSecret(sl.namespace, sl.secretName, sl.setKeys, sl.stopCh)
+	}
+
 	go sl.memberlistWatchEvents()
 	go sl.joinMembers()
 }
@@ -281,11 +480,83 @@ func (sl *SpeakerList) UsableSpeakers() map[string]bool {
 	}
 	activeNodes := map[string]bool{}
 	for _, n := range sl.ml.Members() {
-		activeNodes[n.Name] = true
+		// Draining speakers are alive, but must not be elected.
+		activeNodes[n.Name] = !parseNodeMeta(n.Meta).Draining
 	}
 	return activeNodes
 }
 
+// Priorities returns the announcement priority of the speaker nodes,
+// lower is preferred.
+func (sl *SpeakerList) Priorities() map[string]int {
+	if sl.ml == nil {
+		return nil
+	}
+	ret := map[string]int{}
+	for _, n := range sl.ml.Members() {
+		ret[n.Name] = parseNodeMeta(n.Meta).Priority
+	}
+	return ret
+}
+
+// StartTimes returns when the speakers started. Speakers that don't
+// tell have the zero time.
+func (sl *SpeakerList) StartTimes() map[string]time.Time {
+	if sl.ml == nil {
+		return nil
+	}
+	ret := map[string]time.Time{}
+	for _, n := range sl.ml.Members() {
+		ret[n.Name] = startTime(parseNodeMeta(n.Meta))
+	}
+	return ret
+}
+
+// startTime returns when the speaker with state s started.
+func startTime(s nodeState) time.Time {
+	if s.Since == 0 {
+		return time.Time{}
+	}
+	return time.Unix(s.Since, 0)
+}
+
+// SetDraining tells the other speakers whether the local node is
+// being drained, so that they take over its announcements.
+func (sl *SpeakerList) SetDraining(draining bool) {
+	sl.meta.mu.Lock()
+	changed := sl.meta.state.Draining != draining
+	sl.meta.state.Draining = draining
+	sl.meta.mu.Unlock()
+
+	if changed {
+		sl.updateNode("setDraining")
+	}
+}
+
+// SetPriority tells the other speakers the announcement priority of
+// the local node.
+func (sl *SpeakerList) SetPriority(priority int) {
+	sl.meta.mu.Lock()
+	changed := sl.meta.state.Priority != priority
+	sl.meta.state.Priority = priority
+	sl.meta.mu.Unlock()
+
+	if changed {
+		sl.updateNode("setPriority")
+	}
+}
+
+// updateNode propagates changes of the local node's state to the
+// other speakers.
+func (sl *SpeakerList) updateNode(op string) {
+	if sl.ml == nil {
+		return
+	}
+	if err := sl.ml.UpdateNode(time.Second); err != nil {
+		level.Error(sl.l).Log("op", op, "error", err, "msg", "failed to propagate node state to other speakers")
+	}
+}
+
 // Stop stops the SpeakerList.
 func (sl *SpeakerList) Stop() {
 	if sl.ml == nil {
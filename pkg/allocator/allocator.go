@@ -0,0 +1,280 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package allocator hands out IP addresses from pools, with the same
+// logic as the MetalLB controller, for other programs to reuse.
+//
+// # Pools
+//
+// A Pool is a set of non-overlapping CIDR prefixes, which don't
+// overlap those of the other pools either. Addresses are only ever
+// allocated from the pools given to SetPools, which fails if the new
+// pools don't contain all the addresses already allocated. Pools with
+// AutoAssign set are used by Allocate, the others only when asked for
+// by name. Among them, pools with a Weight get a proportional share
+// of the allocations, at random, and the others are used once the
+// weighted ones are full.
+//
+// # Assign and Allocate
+//
+// Allocations are made to named consumers, e.g. the namespace/name of
+// a Kubernetes service. Assign gives a consumer a specific address,
+// and the Allocate functions pick a free one, from any pool, a given
+// pool, or a given subnet. Either replaces the previous allocation
+// of the consumer, and is a no-op if it already has that address.
+// Unassign frees it.
+//
+// # Sharing keys
+//
+// By default, an address goes to a single consumer. Consumers that
+// give the same non-empty sharing key, and the same backend key, can
+// share one, as long as the ports they use don't collide. MetalLB
+// uses the metallb.universe.tf/allow-shared-ip annotation of the
+// services as sharing key, and their selector as backend key when
+// their traffic must stay on the nodes of their endpoints, so that
+// services sharing an address are announced from the same nodes.
+//
+// An Allocator is not safe for concurrent use. It has the same
+// metallb_allocator_* metrics as the controller's, which are only
+// exported once the collector that Collector returns is registered,
+// so that several Allocators can live in one program.
+package allocator // import "go.universe.tf/metallb/pkg/allocator"
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/config"
+)
+
+// Pool is a named set of addresses to allocate from.
+type Pool struct {
+	// The addresses of the pool.
+	CIDRs []*net.IPNet
+	// If true, the IPv4 addresses ending in .0 or .255 are never
+	// allocated, for the sake of consumer devices that mistake them
+	// for broadcast addresses.
+	AvoidBuggyIPs bool
+	// If true, Allocate can pick addresses from this pool.
+	AutoAssign bool
+	// Relative share of the allocations of Allocate that this pool
+	// gets among the pools with a weight.
+	Weight int
+	// If not empty, only consumers whose ports are all in these
+	// ranges can get an address from the pool.
+	AllowedPorts []PortRange
+	// Free-form information about the pool, passed on in the
+	// allocations.
+	Description    string
+	ReverseDNSZone string
+	Owner          string
+}
+
+// PortRange is a range of ports of a protocol.
+type PortRange struct {
+	// "TCP", "UDP" or "SCTP".
+	Proto string
+	// The first and last ports of the range.
+	First, Last int
+}
+
+// Port is a port used by a consumer of an address.
+type Port struct {
+	// "TCP", "UDP" or "SCTP".
+	Proto string
+	Port  int
+}
+
+// String returns a text description of the port.
+func (p Port) String() string {
+	return fmt.Sprintf("%s/%d", p.Proto, p.Port)
+}
+
+// Allocation describes the address allocated to a consumer.
+type Allocation struct {
+	Service    string
+	IP         net.IP
+	Pool       string
+	Ports      []Port
+	SharingKey string
+	BackendKey string
+}
+
+// An Allocator tracks address pools and allocates addresses from
+// them.
+type Allocator struct {
+	a *allocator.Allocator
+}
+
+// New returns an Allocator managing no pools.
+func New() *Allocator {
+	return &Allocator{a: allocator.New()}
+}
+
+// SetPools replaces the pools of the allocator. It returns an error,
+// and keeps the current pools, if pools are invalid or don't contain
+// all the allocated addresses.
+func (a *Allocator) SetPools(pools map[string]*Pool) error {
+	cfg := map[string]*config.Pool{}
+	var all []*net.IPNet
+	for name, p := range pools {
+		if name == "" {
+			return errors.New("pool has no name")
+		}
+		if p == nil || len(p.CIDRs) == 0 {
+			return fmt.Errorf("pool %q has no addresses", name)
+		}
+		if p.Weight < 0 {
+			return fmt.Errorf("invalid weight %d for pool %q, must not be negative", p.Weight, name)
+		}
+		for _, cidr := range p.CIDRs {
+			for _, m := range all {
+				if cidr.Contains(m.IP) || m.Contains(cidr.IP) {
+					return fmt.Errorf("CIDR %q in pool %q overlaps with CIDR %q", cidr, name, m)
+				}
+			}
+			all = append(all, cidr)
+		}
+		c := &config.Pool{
+			CIDR:           p.CIDRs,
+			AvoidBuggyIPs:  p.AvoidBuggyIPs,
+			AutoAssign:     p.AutoAssign,
+			Weight:         p.Weight,
+			Description:    p.Description,
+			ReverseDNSZone: p.ReverseDNSZone,
+			Owner:          p.Owner,
+		}
+		for _, r := range p.AllowedPorts {
+			if err := checkPortRange(r); err != nil {
+				return fmt.Errorf("invalid allowed port range %s/%d-%d in pool %q: %s", r.Proto, r.First, r.Last, name, err)
+			}
+			c.AllowedPorts = append(c.AllowedPorts, config.PortRange(r))
+		}
+		cfg[name] = c
+	}
+	return a.a.SetPools(cfg)
+}
+
+// checkPortRange returns an error if r isn't a valid range.
+func checkPortRange(r PortRange) error {
+	switch r.Proto {
+	case "TCP", "UDP", "SCTP":
+	default:
+		return fmt.Errorf("unknown protocol %q, must be TCP, UDP or SCTP", r.Proto)
+	}
+	if r.First < 1 || r.Last > 65535 {
+		return errors.New("ports must be between 1 and 65535")
+	}
+	if r.First > r.Last {
+		return fmt.Errorf("first port %d is after last port %d", r.First, r.Last)
+	}
+	return nil
+}
+
+// Generation returns the number of changes to the allocations since
+// the allocator was created. Consumers can compare it to tell whether
+// the allocations changed.
+func (a *Allocator) Generation() uint64 {
+	return a.a.Generation()
+}
+
+// Assign assigns ip to svc, using ports, if ip is in a pool and
+// either free or shared with compatible keys and ports.
+func (a *Allocator) Assign(svc string, ip net.IP, ports []Port, sharingKey, backendKey string) error {
+	return a.a.Assign(svc, ip, internalPorts(ports), sharingKey, backendKey)
+}
+
+// Unassign frees the address of svc, and returns whether it had one.
+func (a *Allocator) Unassign(svc string) bool {
+	return a.a.Unassign(svc)
+}
+
+// Allocate assigns any available address of the pools with AutoAssign
+// to svc.
+func (a *Allocator) Allocate(svc string, isIPv6 bool, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	return a.a.Allocate(svc, isIPv6, internalPorts(ports), sharingKey, backendKey)
+}
+
+// AllocateFromPool assigns an available address of pool to svc.
+func (a *Allocator) AllocateFromPool(svc string, isIPv6 bool, pool string, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	return a.a.AllocateFromPool(svc, isIPv6, pool, internalPorts(ports), sharingKey, backendKey)
+}
+
+// AllocateFromSubnet assigns an available address of subnet to svc.
+// If pool isn't empty, subnet must be part of it.
+func (a *Allocator) AllocateFromSubnet(svc string, subnet *net.IPNet, pool string, ports []Port, sharingKey, backendKey string) (net.IP, error) {
+	return a.a.AllocateFromSubnet(svc, subnet, pool, internalPorts(ports), sharingKey, backendKey)
+}
+
+// IP returns the address allocated to svc, or nil if it has none.
+func (a *Allocator) IP(svc string) net.IP {
+	return a.a.IP(svc)
+}
+
+// Pool returns the pool of the address allocated to svc, or "" if it
+// has none.
+func (a *Allocator) Pool(svc string) string {
+	return a.a.Pool(svc)
+}
+
+// IPShared returns whether the address allocated to svc is also in
+// use by others.
+func (a *Allocator) IPShared(svc string) bool {
+	return a.a.IPShared(svc)
+}
+
+// Usage returns the number of addresses of pool in use, and the
+// number of addresses in the pool.
+func (a *Allocator) Usage(pool string) (inUse, capacity int64) {
+	return a.a.Usage(pool)
+}
+
+// Allocations returns all the allocated addresses, sorted by
+// consumer.
+func (a *Allocator) Allocations() []Allocation {
+	als := a.a.Allocations()
+	ret := make([]Allocation, 0, len(als))
+	for _, al := range als {
+		ports := make([]Port, 0, len(al.Ports))
+		for _, p := range al.Ports {
+			ports = append(ports, Port(p))
+		}
+		ret = append(ret, Allocation{
+			Service:    al.Service,
+			IP:         al.IP,
+			Pool:       al.Pool,
+			Ports:      ports,
+			SharingKey: al.SharingKey,
+			BackendKey: al.BackendKey,
+		})
+	}
+	return ret
+}
+
+func internalPorts(ports []Port) []allocator.Port {
+	ret := make([]allocator.Port, 0, len(ports))
+	for _, p := range ports {
+		ret = append(ret, allocator.Port(p))
+	}
+	return ret
+}
+
+// Collector returns a collector of the metallb_allocator_* metrics
+// of a, for the caller to register. It is safe to scrape while a is
+// in use.
+func (a *Allocator) Collector() prometheus.Collector {
+	return a.a.Collector()
+}
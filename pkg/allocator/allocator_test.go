@@ -0,0 +1,174 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func ipnet(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestSetPools(t *testing.T) {
+	tests := []struct {
+		desc    string
+		pools   map[string]*Pool
+		wantErr bool
+	}{
+		{
+			desc: "valid pools",
+			pools: map[string]*Pool{
+				"a": {CIDRs: []*net.IPNet{ipnet("10.0.0.0/24")}, AllowedPorts: []PortRange{{Proto: "TCP", First: 80, Last: 443}}},
+				"b": {CIDRs: []*net.IPNet{ipnet("10.0.1.0/24"), ipnet("2001:db8::/120")}, Weight: 2},
+			},
+		},
+		{
+			desc:    "no addresses",
+			pools:   map[string]*Pool{"a": {}},
+			wantErr: true,
+		},
+		{
+			desc: "overlap between pools",
+			pools: map[string]*Pool{
+				"a": {CIDRs: []*net.IPNet{ipnet("10.0.0.0/16")}},
+				"b": {CIDRs: []*net.IPNet{ipnet("10.0.1.0/24")}},
+			},
+			wantErr: true,
+		},
+		{
+			desc:    "overlap within a pool",
+			pools:   map[string]*Pool{"a": {CIDRs: []*net.IPNet{ipnet("10.0.0.0/24"), ipnet("10.0.0.128/25")}}},
+			wantErr: true,
+		},
+		{
+			desc:    "negative weight",
+			pools:   map[string]*Pool{"a": {CIDRs: []*net.IPNet{ipnet("10.0.0.0/24")}, Weight: -1}},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown protocol",
+			pools:   map[string]*Pool{"a": {CIDRs: []*net.IPNet{ipnet("10.0.0.0/24")}, AllowedPorts: []PortRange{{Proto: "tcp", First: 80, Last: 80}}}},
+			wantErr: true,
+		},
+		{
+			desc:    "reversed port range",
+			pools:   map[string]*Pool{"a": {CIDRs: []*net.IPNet{ipnet("10.0.0.0/24")}, AllowedPorts: []PortRange{{Proto: "TCP", First: 443, Last: 80}}}},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		err := New().SetPools(test.pools)
+		if test.wantErr != (err != nil) {
+			t.Errorf("%s: got error %v, want error: %v", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	a := New()
+	if err := a.SetPools(map[string]*Pool{
+		"auto":   {CIDRs: []*net.IPNet{ipnet("10.0.0.0/31")}, AutoAssign: true, Owner: "dns"},
+		"manual": {CIDRs: []*net.IPNet{ipnet("10.0.1.0/24")}, AllowedPorts: []PortRange{{Proto: "UDP", First: 53, Last: 53}}},
+	}); err != nil {
+		t.Fatalf("SetPools: %s", err)
+	}
+	dns := []Port{{Proto: "UDP", Port: 53}}
+
+	ip, err := a.Allocate("ns/a", false, dns, "key", "")
+	if err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+	if a.Pool("ns/a") != "auto" {
+		t.Errorf("ns/a got an address of pool %q, want auto", a.Pool("ns/a"))
+	}
+	// Sharing needs the same keys and distinct ports.
+	if err := a.Assign("ns/b", ip, []Port{{Proto: "TCP", Port: 53}}, "key", ""); err != nil {
+		t.Errorf("sharing with the same keys failed: %s", err)
+	}
+	if !a.IPShared("ns/a") {
+		t.Error("ns/a doesn't share its address")
+	}
+	if err := a.Assign("ns/c", ip, []Port{{Proto: "TCP", Port: 80}}, "other", ""); err == nil {
+		t.Error("shared an address with a different sharing key")
+	}
+	if err := a.Assign("ns/c", ip, dns, "key", ""); err == nil {
+		t.Error("shared an address with colliding ports")
+	}
+
+	// The pools without AutoAssign are only used when asked for, and
+	// enforce their allowed ports.
+	if _, err := a.Allocate("ns/c", false, nil, "", ""); err != nil {
+		t.Fatalf("Allocate the last address: %s", err)
+	}
+	if _, err := a.Allocate("ns/d", false, nil, "", ""); err == nil {
+		t.Error("allocated from a pool without AutoAssign")
+	}
+	if _, err := a.AllocateFromPool("ns/d", false, "manual", []Port{{Proto: "TCP", Port: 80}}, "", ""); err == nil {
+		t.Error("allocated ports that the pool doesn't allow")
+	}
+	if _, err := a.AllocateFromSubnet("ns/d", ipnet("10.0.1.64/26"), "manual", dns, "", ""); err != nil {
+		t.Fatalf("AllocateFromSubnet: %s", err)
+	}
+	if inUse, capacity := a.Usage("manual"); inUse != 1 || capacity != 256 {
+		t.Errorf("manual pool usage is %d/%d, want 1/256", inUse, capacity)
+	}
+
+	want := []Allocation{
+		{Service: "ns/a", IP: net.ParseIP("10.0.0.0").To4(), Pool: "auto", Ports: dns, SharingKey: "key"},
+		{Service: "ns/b", IP: net.ParseIP("10.0.0.0").To4(), Pool: "auto", Ports: []Port{{Proto: "TCP", Port: 53}}, SharingKey: "key"},
+		{Service: "ns/c", IP: net.ParseIP("10.0.0.1").To4(), Pool: "auto", Ports: []Port{}},
+		{Service: "ns/d", IP: net.ParseIP("10.0.1.64").To4(), Pool: "manual", Ports: dns},
+	}
+	if diff := cmp.Diff(want, a.Allocations()); diff != "" {
+		t.Errorf("wrong allocations (-want +got)\n%s", diff)
+	}
+
+	// Pools that don't hold the allocated addresses are refused.
+	gen := a.Generation()
+	if err := a.SetPools(map[string]*Pool{"manual": {CIDRs: []*net.IPNet{ipnet("10.0.1.0/24")}}}); err == nil {
+		t.Error("dropped a pool with allocated addresses")
+	}
+	if !a.Unassign("ns/a") || a.Unassign("ns/a") {
+		t.Error("Unassign didn't report the freed address once")
+	}
+	if a.IP("ns/a") != nil || a.Generation() == gen {
+		t.Error("Unassign didn't free the address")
+	}
+}
+
+func TestCollector(t *testing.T) {
+	// Allocators don't share their metrics, so each can be registered
+	// in a registry of its own.
+	var regs []*prometheus.Registry
+	for _, cidr := range []string{"10.0.0.0/30", "10.0.1.0/29"} {
+		a := New()
+		if err := a.SetPools(map[string]*Pool{"pool": {CIDRs: []*net.IPNet{ipnet(cidr)}}}); err != nil {
+			t.Fatalf("SetPools: %s", err)
+		}
+		reg := prometheus.NewPedanticRegistry()
+		if err := reg.Register(a.Collector()); err != nil {
+			t.Fatalf("Register: %s", err)
+		}
+		regs = append(regs, reg)
+	}
+	for i, want := range []int{4, 8} {
+		err := testutil.GatherAndCompare(regs[i], strings.NewReader(fmt.Sprintf(`
+# HELP metallb_allocator_addresses_total Number of usable IP addresses, per pool
+# TYPE metallb_allocator_addresses_total gauge
+metallb_allocator_addresses_total{pool="pool"} %d
+`, want)), "metallb_allocator_addresses_total")
+		if err != nil {
+			t.Errorf("allocator %d: %s", i, err)
+		}
+	}
+}
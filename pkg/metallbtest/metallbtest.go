@@ -0,0 +1,378 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metallbtest simulates MetalLB in memory, for the tests of
+// platforms built on it: given a configuration, nodes and services,
+// it tells which IPs the controller would assign to the services, and
+// which BGP advertisements the speakers would send to which peers,
+// without a cluster or routers.
+//
+// A Cluster uses MetalLB's configuration parser and allocator, and
+// mirrors the controller and speakers for the common cases: address
+// pool and subnet requests, spec.loadBalancerIP, shared IPs, the BGP
+// advertisements of the pools, peer node selectors, and the
+// externalTrafficPolicy of the services. Services with MetalLB
+// annotations it doesn't simulate, e.g. address blocks or
+// advertisement overrides, or with a load balancer class, are refused
+// rather than given an answer that could be wrong, and so are
+// configurations with static advertisements, or BGP advertisements
+// limited to some announcing nodes or signaling link bandwidth.
+//
+// The Kubernetes API, the default pools of the namespaces and layer2
+// announcements aren't simulated. End to end behavior is for the e2e
+// tests.
+package metallbtest // import "go.universe.tf/metallb/pkg/metallbtest"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"go.universe.tf/metallb/internal/allocator"
+	"go.universe.tf/metallb/internal/allocator/k8salloc"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// supportedAnnotations are the MetalLB service annotations a Cluster
+// simulates, or that change neither the allocation nor the
+// advertisements. Any other MetalLB annotation, including those added
+// to MetalLB later, may change them in ways a Cluster doesn't model.
+var supportedAnnotations = map[string]bool{
+	"metallb.universe.tf/address-pool":        true,
+	"metallb.universe.tf/address-pool-subnet": true,
+	"metallb.universe.tf/allow-shared-ip":     true,
+	"metallb.universe.tf/hostname":            true,
+}
+
+// Advertisement is a BGP advertisement of a service's IP that a node
+// sends to a peer.
+type Advertisement struct {
+	// Namespaced name of the service.
+	Service string
+	// Address of the peer.
+	Peer        net.IP
+	Prefix      *net.IPNet
+	LocalPref   uint32
+	Communities []uint32
+	// Next hop set by the pool's advertisement, nil for the node's
+	// address.
+	NextHop net.IP
+	// The speakers send the announce priority of their node as the
+	// MED. Simulated nodes have none, so it is always 0.
+	MED uint32
+}
+
+// Cluster is a simulated cluster running MetalLB.
+type Cluster struct {
+	cfg   *config.Config
+	ips   *allocator.Allocator
+	nodes map[string]labels.Set
+	svcs  map[string]*v1.Service
+	// Nodes with ready endpoints, for the services that set them.
+	eps map[string][]string
+}
+
+// New returns a Cluster without nodes or services, running MetalLB
+// with the configuration cfg, in the format of MetalLB's ConfigMap.
+func New(cfg string) (*Cluster, error) {
+	c := &Cluster{
+		ips:   allocator.New(),
+		nodes: map[string]labels.Set{},
+		svcs:  map[string]*v1.Service{},
+		eps:   map[string][]string{},
+	}
+	if err := c.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetConfig changes the configuration of MetalLB to cfg. Like the
+// controller, it returns an error, and keeps the current
+// configuration, if the new one doesn't hold the assigned IPs.
+func (c *Cluster) SetConfig(cfg string) error {
+	parsed, err := config.Parse([]byte(cfg))
+	if err != nil {
+		return err
+	}
+	if err := simulated(parsed); err != nil {
+		return err
+	}
+	if err := c.ips.SetPools(parsed.Pools); err != nil {
+		return err
+	}
+	c.cfg = parsed
+	return nil
+}
+
+// simulated returns an error if cfg uses a BGP feature that changes
+// the advertisements in ways a Cluster doesn't model.
+func simulated(cfg *config.Config) error {
+	if len(cfg.StaticAdvertisements) > 0 {
+		return errors.New("static-advertisements are not simulated")
+	}
+	names := make([]string, 0, len(cfg.Pools))
+	for n := range cfg.Pools {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		for _, ad := range cfg.Pools[n].BGPAdvertisements {
+			// The speakers pick the announcing nodes from their
+			// memberlist.
+			if ad.MaxAnnouncingNodes > 0 {
+				return fmt.Errorf("pool %q: max-announcing-nodes is not simulated", n)
+			}
+			if ad.LinkBandwidth > 0 {
+				return fmt.Errorf("pool %q: link-bandwidth is not simulated", n)
+			}
+		}
+	}
+	return nil
+}
+
+// AddNode adds or replaces the node name, with labels.
+func (c *Cluster) AddNode(name string, nodeLabels map[string]string) {
+	c.nodes[name] = labels.Set(nodeLabels)
+}
+
+// DeleteNode removes the node name.
+func (c *Cluster) DeleteNode(name string) {
+	delete(c.nodes, name)
+}
+
+// SetEndpoints sets the nodes with ready endpoints of the service
+// key, as namespace/name. Services without endpoints set have ready
+// endpoints on every node.
+func (c *Cluster) SetEndpoints(key string, nodes ...string) {
+	c.eps[key] = append([]string{}, nodes...)
+}
+
+// Apply creates or updates svc, and returns it with the load balancer
+// status the controller would give it. Like the controller, it frees
+// the IP of the service if it can't allocate one. Services without
+// ipFamilies or a cluster IP get an IPv4 address.
+func (c *Cluster) Apply(svc *v1.Service) (*v1.Service, error) {
+	key := svc.Namespace + "/" + svc.Name
+	svc = svc.DeepCopy()
+	svc.Status.LoadBalancer = v1.LoadBalancerStatus{}
+	// Like the controller, which only manages the services without a
+	// class, or with its own.
+	if class := k8s.LoadBalancerClass(svc); class != "" {
+		return nil, fmt.Errorf("service %q: load balancer class %q is not simulated", key, class)
+	}
+	for _, a := range sortedKeys(svc.Annotations) {
+		if strings.HasPrefix(a, "metallb.universe.tf/") && !supportedAnnotations[a] {
+			return nil, fmt.Errorf("service %q: annotation %s is not simulated", key, a)
+		}
+	}
+
+	c.svcs[key] = svc
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		c.ips.Unassign(key)
+		return svc.DeepCopy(), nil
+	}
+	ip, err := c.allocate(key, svc)
+	if err != nil {
+		c.ips.Unassign(key)
+		return svc.DeepCopy(), err
+	}
+	svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: ip.String()}}
+	return svc.DeepCopy(), nil
+}
+
+// Delete deletes the service key, as namespace/name.
+func (c *Cluster) Delete(key string) {
+	c.ips.Unassign(key)
+	delete(c.svcs, key)
+	delete(c.eps, key)
+}
+
+// Pool returns the pool of the IP assigned to the service key, ""
+// if it has none.
+func (c *Cluster) Pool(key string) string {
+	return c.ips.Pool(key)
+}
+
+// allocate returns the IP of svc, named key, allocated like the
+// controller's allocateIP.
+func (c *Cluster) allocate(key string, svc *v1.Service) (net.IP, error) {
+	isIPv6 := k8s.IPFamily(svc) == v1.IPv6Protocol
+	ports, sharingKey, backendKey := k8salloc.Ports(svc), k8salloc.SharingKey(svc), k8salloc.BackendKey(svc)
+	desiredPool := svc.Annotations["metallb.universe.tf/address-pool"]
+
+	if svc.Spec.LoadBalancerIP != "" {
+		ip := net.ParseIP(svc.Spec.LoadBalancerIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid spec.loadBalancerIP %q", svc.Spec.LoadBalancerIP)
+		}
+		if (ip.To4() == nil) != isIPv6 {
+			return nil, fmt.Errorf("requested spec.loadBalancerIP %q does not match the ipFamily of the service", svc.Spec.LoadBalancerIP)
+		}
+		if err := c.ips.Assign(key, ip, ports, sharingKey, backendKey); err != nil {
+			return nil, err
+		}
+		return ip, nil
+	}
+
+	// The controller moves services whose IP is no longer in the
+	// pool they ask for.
+	if current := c.ips.Pool(key); current != "" && desiredPool != "" && current != desiredPool {
+		c.ips.Unassign(key)
+	}
+	if s := svc.Annotations["metallb.universe.tf/address-pool-subnet"]; s != "" {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metallb.universe.tf/address-pool-subnet %q", s)
+		}
+		if (subnet.IP.To4() == nil) != isIPv6 {
+			return nil, fmt.Errorf("requested subnet %q does not match the ipFamily of the service", subnet)
+		}
+		return c.ips.AllocateFromSubnet(key, subnet, desiredPool, ports, sharingKey, backendKey)
+	}
+	if desiredPool != "" {
+		return c.ips.AllocateFromPool(key, isIPv6, desiredPool, ports, sharingKey, backendKey)
+	}
+	return c.ips.Allocate(key, isIPv6, ports, sharingKey, backendKey)
+}
+
+// announces returns whether node announces the service key, svc.
+func (c *Cluster) announces(node, key string, svc *v1.Service) bool {
+	eps, ok := c.eps[key]
+	if !ok {
+		return true
+	}
+	if svc.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		return len(eps) > 0
+	}
+	for _, n := range eps {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Advertisements returns the BGP advertisements of the services that
+// node sends to its peers, sorted by peer and prefix, like the
+// speaker's SetBalancer. Only the peers with a fixed address are
+// simulated.
+func (c *Cluster) Advertisements(node string) ([]Advertisement, error) {
+	nodeLabels, ok := c.nodes[node]
+	if !ok {
+		return nil, fmt.Errorf("unknown node %q", node)
+	}
+	var ret []Advertisement
+	for _, p := range c.cfg.Peers {
+		if p.Addr == nil || !matchesAny(p.NodeSelectors, nodeLabels) {
+			continue
+		}
+		for key, svc := range c.svcs {
+			lbIP := c.ips.IP(key)
+			pool := c.cfg.Pools[c.ips.Pool(key)]
+			if lbIP == nil || pool == nil || pool.Protocol != config.BGP || !c.announces(node, key, svc) {
+				continue
+			}
+			for _, adCfg := range pool.BGPAdvertisements {
+				if !advertisesTo(adCfg, p) {
+					continue
+				}
+				m := net.CIDRMask(adCfg.AggregationLength, 32)
+				if lbIP.To4() == nil {
+					m = net.CIDRMask(adCfg.AggregationLengthV6, 128)
+				}
+				ad := Advertisement{
+					Service:   key,
+					Peer:      p.Addr,
+					Prefix:    &net.IPNet{IP: lbIP.Mask(m), Mask: m},
+					LocalPref: adCfg.LocalPref,
+					NextHop:   adCfg.NextHop,
+				}
+				for comm := range adCfg.Communities {
+					ad.Communities = append(ad.Communities, comm)
+				}
+				sort.Slice(ad.Communities, func(i, j int) bool { return ad.Communities[i] < ad.Communities[j] })
+				ret = append(ret, ad)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if c := bytes.Compare(ret[i].Peer.To16(), ret[j].Peer.To16()); c != 0 {
+			return c < 0
+		}
+		if c := bytes.Compare(ret[i].Prefix.IP.To16(), ret[j].Prefix.IP.To16()); c != 0 {
+			return c < 0
+		}
+		if li, lj := prefixLen(ret[i].Prefix), prefixLen(ret[j].Prefix); li != lj {
+			return li < lj
+		}
+		return ret[i].Service < ret[j].Service
+	})
+	return ret, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func prefixLen(n *net.IPNet) int {
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// matchesAny returns whether any of sels matches set.
+func matchesAny(sels []labels.Selector, set labels.Set) bool {
+	for _, s := range sels {
+		if s.Matches(set) {
+			return true
+		}
+	}
+	return false
+}
+
+// advertisesTo returns whether the advertisements of ad go to p, like
+// the speaker's advertisement.advertisesTo.
+func advertisesTo(ad *config.BGPAdvertisement, p *config.Peer) bool {
+	if len(ad.Instances) > 0 {
+		found := false
+		for _, inst := range ad.Instances {
+			if inst == p.Instance {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(ad.Peers) == 0 {
+		return true
+	}
+	for _, ip := range ad.Peers {
+		if ip.Equal(p.Addr) {
+			return true
+		}
+	}
+	return false
+}
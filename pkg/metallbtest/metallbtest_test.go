@@ -0,0 +1,314 @@
+package metallbtest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testConfig = `
+peers:
+- my-asn: 64500
+  peer-asn: 64501
+  peer-address: 10.0.0.1
+- my-asn: 64500
+  peer-asn: 64502
+  peer-address: 10.0.0.2
+  node-selectors:
+  - match-labels:
+      rack: a
+bgp-communities:
+  edge: 64500:100
+address-pools:
+- name: public
+  protocol: bgp
+  addresses:
+  - 192.168.10.0/30
+  bgp-advertisements:
+  - aggregation-length: 32
+    localpref: 100
+    communities: ["edge"]
+  - aggregation-length: 30
+    peers: [10.0.0.2]
+- name: internal
+  protocol: bgp
+  auto-assign: false
+  addresses:
+  - 172.16.0.0/24
+- name: l2
+  protocol: layer2
+  auto-assign: false
+  addresses:
+  - 192.168.20.0/24
+`
+
+func service(name string, annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80}},
+		},
+	}
+}
+
+func ipnet(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestAllocation(t *testing.T) {
+	c, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	tests := []struct {
+		desc     string
+		svc      *v1.Service
+		wantIP   string
+		wantPool string
+		wantErr  bool
+	}{
+		{
+			desc:     "automatic",
+			svc:      service("web", nil),
+			wantIP:   "192.168.10.0",
+			wantPool: "public",
+		},
+		{
+			desc:     "requested pool",
+			svc:      service("db", map[string]string{"metallb.universe.tf/address-pool": "internal"}),
+			wantIP:   "172.16.0.0",
+			wantPool: "internal",
+		},
+		{
+			desc:     "requested subnet",
+			svc:      service("cache", map[string]string{"metallb.universe.tf/address-pool-subnet": "172.16.0.128/25"}),
+			wantIP:   "172.16.0.128",
+			wantPool: "internal",
+		},
+		{
+			desc:    "IP in use",
+			svc:     &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "copy"}, Spec: v1.ServiceSpec{Type: v1.ServiceTypeLoadBalancer, LoadBalancerIP: "192.168.10.0"}},
+			wantErr: true,
+		},
+		{
+			desc:     "shared IP with a hostname",
+			svc:      service("api", map[string]string{"metallb.universe.tf/allow-shared-ip": "api", "metallb.universe.tf/hostname": "api.example.com"}),
+			wantIP:   "192.168.10.1",
+			wantPool: "public",
+		},
+		{
+			desc:    "unsimulated annotation",
+			svc:     service("block", map[string]string{"metallb.universe.tf/address-block": "frontend/30"}),
+			wantErr: true,
+		},
+		{
+			desc:    "ignored service",
+			svc:     service("ignored", map[string]string{"metallb.universe.tf/ignore": "true"}),
+			wantErr: true,
+		},
+		{
+			desc:    "announcements disabled",
+			svc:     service("quiet", map[string]string{"metallb.universe.tf/announce-disabled": "true"}),
+			wantErr: true,
+		},
+		{
+			desc:    "limited announcing nodes",
+			svc:     service("few", map[string]string{"metallb.universe.tf/max-announcing-nodes": "2"}),
+			wantErr: true,
+		},
+		{
+			desc:    "load balancer class",
+			svc:     service("other", map[string]string{"metallb.universe.tf/loadbalancer-class": "example.com/lb"}),
+			wantErr: true,
+		},
+		{
+			desc:    "annotation of a later MetalLB",
+			svc:     service("future", map[string]string{"metallb.universe.tf/not-yet-invented": "x"}),
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		svc, err := c.Apply(test.svc)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: Apply succeeded, want error", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Apply: %s", test.desc, err)
+			continue
+		}
+		key := test.svc.Namespace + "/" + test.svc.Name
+		if len(svc.Status.LoadBalancer.Ingress) != 1 || svc.Status.LoadBalancer.Ingress[0].IP != test.wantIP {
+			t.Errorf("%s: got ingress %v, want %s", test.desc, svc.Status.LoadBalancer.Ingress, test.wantIP)
+		}
+		if got := c.Pool(key); got != test.wantPool {
+			t.Errorf("%s: got pool %q, want %q", test.desc, got, test.wantPool)
+		}
+	}
+
+	// Configurations that drop assigned IPs are refused.
+	if err := c.SetConfig(`
+address-pools:
+- name: public
+  protocol: bgp
+  addresses:
+  - 192.168.10.0/30
+`); err == nil {
+		t.Error("SetConfig dropped the internal pool with assigned IPs")
+	}
+	c.Delete("default/db")
+	c.Delete("default/cache")
+	if c.Pool("default/db") != "" {
+		t.Error("deleted service still has an IP")
+	}
+}
+
+func TestAdvertisements(t *testing.T) {
+	c, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	c.AddNode("node-a", map[string]string{"rack": "a"})
+	c.AddNode("node-b", map[string]string{"rack": "b"})
+
+	local := service("local", nil)
+	local.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	for _, svc := range []*v1.Service{
+		service("web", nil),
+		local,
+		service("arp", map[string]string{"metallb.universe.tf/address-pool": "l2"}),
+	} {
+		if _, err := c.Apply(svc); err != nil {
+			t.Fatalf("Apply %q: %s", svc.Name, err)
+		}
+	}
+	c.SetEndpoints("default/local", "node-b")
+
+	tests := []struct {
+		node string
+		want []Advertisement
+	}{
+		{
+			node: "node-a",
+			want: []Advertisement{
+				{Service: "default/web", Peer: net.ParseIP("10.0.0.1"), Prefix: ipnet("192.168.10.0/32"), LocalPref: 100, Communities: []uint32{64500<<16 | 100}},
+				{Service: "default/web", Peer: net.ParseIP("10.0.0.2"), Prefix: ipnet("192.168.10.0/30")},
+				{Service: "default/web", Peer: net.ParseIP("10.0.0.2"), Prefix: ipnet("192.168.10.0/32"), LocalPref: 100, Communities: []uint32{64500<<16 | 100}},
+			},
+		},
+		{
+			node: "node-b",
+			want: []Advertisement{
+				{Service: "default/web", Peer: net.ParseIP("10.0.0.1"), Prefix: ipnet("192.168.10.0/32"), LocalPref: 100, Communities: []uint32{64500<<16 | 100}},
+				{Service: "default/local", Peer: net.ParseIP("10.0.0.1"), Prefix: ipnet("192.168.10.1/32"), LocalPref: 100, Communities: []uint32{64500<<16 | 100}},
+			},
+		},
+	}
+	for _, test := range tests {
+		got, err := c.Advertisements(test.node)
+		if err != nil {
+			t.Fatalf("Advertisements(%q): %s", test.node, err)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("wrong advertisements of %q (-want +got)\n%s", test.node, diff)
+		}
+	}
+	if _, err := c.Advertisements("node-c"); err == nil {
+		t.Error("got the advertisements of an unknown node")
+	}
+}
+
+func TestUnsimulatedConfig(t *testing.T) {
+	c, err := New(testConfig)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	c.AddNode("node-a", map[string]string{"rack": "a"})
+	if _, err := c.Apply(service("web", nil)); err != nil {
+		t.Fatalf("Apply: %s", err)
+	}
+	want, err := c.Advertisements("node-a")
+	if err != nil {
+		t.Fatalf("Advertisements: %s", err)
+	}
+
+	tests := []struct {
+		desc string
+		cfg  string
+	}{
+		{
+			desc: "max announcing nodes",
+			cfg: `
+peers:
+- my-asn: 64500
+  peer-asn: 64501
+  peer-address: 10.0.0.1
+address-pools:
+- name: public
+  protocol: bgp
+  addresses:
+  - 192.168.10.0/30
+  bgp-advertisements:
+  - max-announcing-nodes: 2
+`,
+		},
+		{
+			desc: "link bandwidth",
+			cfg: `
+peers:
+- my-asn: 64500
+  peer-asn: 64501
+  peer-address: 10.0.0.1
+address-pools:
+- name: public
+  protocol: bgp
+  addresses:
+  - 192.168.10.0/30
+  bgp-advertisements:
+  - link-bandwidth: 1000000
+`,
+		},
+		{
+			desc: "static advertisements",
+			cfg: `
+peers:
+- my-asn: 64500
+  peer-asn: 64501
+  peer-address: 10.0.0.1
+address-pools:
+- name: public
+  protocol: bgp
+  addresses:
+  - 192.168.10.0/30
+static-advertisements:
+- prefix: 10.100.0.0/24
+`,
+		},
+	}
+	for _, test := range tests {
+		if _, err := New(test.cfg); err == nil {
+			t.Errorf("%s: New accepted a config it doesn't simulate", test.desc)
+		}
+		if err := c.SetConfig(test.cfg); err == nil {
+			t.Errorf("%s: SetConfig accepted a config it doesn't simulate", test.desc)
+		}
+		// The cluster keeps running on its config.
+		got, err := c.Advertisements("node-a")
+		if err != nil {
+			t.Fatalf("%s: Advertisements: %s", test.desc, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: advertisements changed (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
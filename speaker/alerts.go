@@ -0,0 +1,96 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"go.universe.tf/metallb/internal/alert"
+)
+
+// How long all the BGP sessions of the node must be down before
+// alerting, so that a restart of the speaker or of the routers
+// doesn't.
+const bgpSessionsDownDelay = time.Minute
+
+// alerter fires and resolves alerts.
+type alerter interface {
+	Set(l log.Logger, a alert.Alert, firing bool)
+}
+
+// notAnnouncedAlert is the alert about no node announcing the
+// service name.
+func notAnnouncedAlert(name, ip string) alert.Alert {
+	return alert.Alert{
+		Name:    "MetalLBServiceNotAnnounced",
+		Labels:  map[string]string{"service": name},
+		Summary: fmt.Sprintf("no node announces service %q, its IP %s is unreachable", name, ip),
+	}
+}
+
+// bgpSessionsDownAlert is the alert about all the BGP sessions of node
+// being down.
+func bgpSessionsDownAlert(node string) alert.Alert {
+	return alert.Alert{
+		Name:    "MetalLBBGPSessionsDown",
+		Labels:  map[string]string{"node": node},
+		Summary: fmt.Sprintf("all the BGP sessions of node %q are down, it announces no service", node),
+	}
+}
+
+// watchBGPSessions alerts while all the BGP sessions of the node, as
+// reported by the session metrics of g, are down, until stopCh is
+// closed.
+func (c *controller) watchBGPSessions(l log.Logger, g prometheus.Gatherer, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	var downSince time.Time
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		if !allSessionsDown(g) {
+			downSince = time.Time{}
+		} else if downSince.IsZero() {
+			downSince = now
+		}
+		firing := !downSince.IsZero() && now.Sub(downSince) >= bgpSessionsDownDelay
+		c.alerts.Set(l, bgpSessionsDownAlert(c.myNode), firing)
+	}
+}
+
+// allSessionsDown returns whether the node has BGP sessions, and all
+// of them are down.
+func allSessionsDown(g prometheus.Gatherer) bool {
+	families, _ := g.Gather()
+	sessions := 0
+	for _, f := range families {
+		if f.GetName() != "metallb_bgp_session_up" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			sessions++
+			if m.GetGauge().GetValue() > 0 {
+				return false
+			}
+		}
+	}
+	return sessions > 0
+}
@@ -15,17 +15,24 @@
 package main
 
 import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"go.universe.tf/metallb/internal/bgp"
 	"go.universe.tf/metallb/internal/config"
 	"go.universe.tf/metallb/internal/k8s"
+	"go.universe.tf/metallb/internal/linkwatch"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 
@@ -35,18 +42,90 @@ import (
 
 type peer struct {
 	cfg *config.Peer
-	bgp session
+	bgp bgp.BackendSession
+	// Address the session dials, which depends on the node for some
+	// peers.
+	addr net.IP
 }
 
 type bgpController struct {
 	logger     log.Logger
 	myNode     string
 	nodeLabels labels.Set
-	peers      []*peer
-	svcAds     map[string][]*bgp.Advertisement
+	// Router ID set by the node's annotation, if any.
+	nodeRouterID net.IP
+	// Annotations of the node, for the peers that take their source
+	// address from one.
+	nodeAnnotations map[string]string
+	// Announcement priority of the node, sent as the MED of its
+	// advertisements.
+	priority int
+	// peersMu guards changes to peers and their sessions against
+	// LinkUp and the SNMP agent, which don't run on the Kubernetes
+	// client goroutine.
+	peersMu   sync.Mutex
+	peers     []*peer
+	svcAds    map[string][]*advertisement
+	staticAds []*config.StaticAdvertisement
+	// The node loopbacks pools, and the address the controller gave
+	// this node in one of them, if any.
+	loopbackPools []*config.Pool
+	loopback      net.IP
+	// Used to pick the announcing nodes of services that limit
+	// them. May be nil.
+	sList SpeakerList
+	// Position of this node in each service's ordering of candidate
+	// announcing nodes, -1 if unknown.
+	svcRank map[string]int
+	// Aliases of BGP communities, which service annotations can use.
+	communities map[string]uint32
+	// The node's interfaces and addresses, or the system's if nil.
+	intfs linkwatch.Interfaces
+	// Debounces the local endpoints of Local traffic policy
+	// services. May be nil.
+	localEps *endpointHysteresis
+}
+
+// advertisement is a BGP advertisement, along with the peers that
+// should receive it.
+type advertisement struct {
+	*bgp.Advertisement
+	// Addresses of the peers to advertise to. Empty means all peers.
+	peers []net.IP
+	// BGP instances whose peers to advertise to. Empty means all
+	// peers.
+	instances []string
+}
+
+// advertisesTo returns true if ad should be sent to p.
+func (ad *advertisement) advertisesTo(p *peer) bool {
+	if len(ad.instances) > 0 {
+		found := false
+		for _, inst := range ad.instances {
+			if inst == p.cfg.Instance {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(ad.peers) == 0 {
+		return true
+	}
+	for _, ip := range ad.peers {
+		if ip.Equal(p.addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *bgpController) SetConfig(l log.Logger, cfg *config.Config) error {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+
 	newPeers := make([]*peer, 0, len(cfg.Peers))
 newPeers:
 	for _, p := range cfg.Peers {
@@ -73,21 +152,43 @@ newPeers:
 		if p == nil {
 			continue
 		}
-		level.Info(l).Log("event", "peerRemoved", "peer", p.cfg.Addr, "reason", "removedFromConfig", "msg", "peer deconfigured, closing BGP session")
+		level.Info(l).Log("event", "peerRemoved", "peer", p.cfg, "reason", "removedFromConfig", "msg", "peer deconfigured, closing BGP session")
 		if p.bgp != nil {
 			if err := p.bgp.Close(); err != nil {
-				level.Error(l).Log("op", "setConfig", "error", err, "peer", p.cfg.Addr, "msg", "failed to shut down BGP session")
+				level.Error(l).Log("op", "setConfig", "error", err, "peer", p.cfg, "msg", "failed to shut down BGP session")
 			}
 		}
 	}
 
-	return c.syncPeers(l)
+	c.staticAds = cfg.StaticAdvertisements
+	c.loopbackPools = nil
+	for _, pool := range cfg.Pools {
+		if pool.NodeLoopbacks {
+			c.loopbackPools = append(c.loopbackPools, pool)
+		}
+	}
+	c.communities = cfg.BGPCommunities
+	if err := c.syncPeers(l); err != nil {
+		return err
+	}
+	return c.updateAds()
 }
 
 // hasHealthyEndpoint return true if this node has at least one healthy endpoint.
 // It only checks nodes matching the given filterNode function.
 func hasHealthyEndpoint(eps k8s.EpsOrSlices, filterNode func(*string) bool) bool {
+	return healthyEndpoints(eps, filterNode) > 0
+}
+
+// healthyEndpoints returns the number of healthy endpoints, only
+// counting nodes matching the given filterNode function. Like
+// kube-proxy, if none is ready, endpoints that still serve while their
+// pod terminates gracefully count as healthy, so that the routes stay
+// up until the last of them goes away.
+func healthyEndpoints(eps k8s.EpsOrSlices, filterNode func(*string) bool) int {
 	ready := map[string]bool{}
+	// Only EndpointSlices tell terminating endpoints apart.
+	terminating := map[string]bool{}
 	switch eps.Type {
 	case k8s.Eps:
 		for _, subset := range eps.EpVal.Subsets {
@@ -122,19 +223,25 @@ func hasHealthyEndpoint(eps k8s.EpsOrSlices, filterNode func(*string) bool) bool
 					}
 					if !k8s.IsConditionReady(ep.Conditions) {
 						ready[addr] = false
+						if k8s.IsConditionServing(ep.Conditions) && k8s.IsConditionTerminating(ep.Conditions) {
+							terminating[addr] = true
+						}
 					}
 				}
 			}
 		}
 	}
 
+	n := 0
 	for _, r := range ready {
 		if r {
-			// At least one fully healthy endpoint on this machine.
-			return true
+			n++
 		}
 	}
-	return false
+	if n == 0 {
+		return len(terminating)
+	}
+	return n
 }
 
 func (c *bgpController) ShouldAnnounce(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices) string {
@@ -150,14 +257,137 @@ func (c *bgpController) ShouldAnnounce(l log.Logger, name string, svc *v1.Servic
 		return false
 	}
 
-	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal && !hasHealthyEndpoint(eps, filterNode) {
-		return "noLocalEndpoints"
-	} else if !hasHealthyEndpoint(eps, func(toFilter *string) bool { return false }) {
-		return "noEndpoints"
+	if pinned := pinnedNodes(svc); pinned != nil && !pinnedTo(pinned, c.myNode) {
+		return "notPinned"
+	}
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		if !c.localReady(name, hasHealthyEndpoint(eps, filterNode)) {
+			return "noLocalEndpoints"
+		}
+	} else {
+		if c.localEps != nil {
+			c.localEps.forget(name)
+		}
+		if !hasHealthyEndpoint(eps, func(toFilter *string) bool { return false }) {
+			return "noEndpoints"
+		}
+	}
+
+	rank := c.announcingRank(name, svc, eps)
+	c.svcRank[name] = rank
+	max, err := maxAnnouncingNodes(svc)
+	if err != nil {
+		level.Error(l).Log("op", "shouldAnnounce", "error", err, "msg", "ignoring invalid max announcing nodes annotation")
+	} else if max > 0 && rank < 0 {
+		level.Warn(l).Log("op", "shouldAnnounce", "msg", "cannot limit announcing nodes without fast dead node detection, announcing from all nodes")
+	} else if max > 0 && rank >= max {
+		return "notSelected"
 	}
 	return ""
 }
 
+// localReady returns whether the service name is announced as having
+// local endpoints, given whether it has some now, after hysteresis.
+func (c *bgpController) localReady(name string, hasEndpoints bool) bool {
+	if c.localEps == nil {
+		return hasEndpoints
+	}
+	return c.localEps.ready(name, hasEndpoints, time.Now())
+}
+
+// announcingRank returns the position of this node in the
+// deterministic ordering of the nodes that may announce the service,
+// or -1 if the candidate nodes are unknown.
+func (c *bgpController) announcingRank(name string, svc *v1.Service, eps k8s.EpsOrSlices) int {
+	nodes := c.candidates(name, svc, eps)
+	if nodes == nil {
+		return -1
+	}
+	for i, n := range nodes {
+		if n == c.myNode {
+			return i
+		}
+	}
+	// Not a candidate, e.g. because the node is draining.
+	return len(nodes)
+}
+
+// candidates returns the deterministic ordering of the nodes that may
+// announce the service, or nil if they are unknown.
+//
+// Candidates are the nodes with ready endpoints with the Local
+// traffic policy, or all live speakers with the Cluster traffic
+// policy, which requires memberlist. Services pinned to nodes only
+// have those nodes as candidates, in their order of preference.
+func (c *bgpController) candidates(name string, svc *v1.Service, eps k8s.EpsOrSlices) []string {
+	var (
+		speakers   map[string]bool
+		priorities map[string]int
+	)
+	if c.sList != nil {
+		speakers = c.sList.UsableSpeakers()
+		priorities = c.sList.Priorities()
+	}
+
+	var nodes []string
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		nodes = usableNodes(eps, speakers)
+	} else {
+		if speakers == nil {
+			return nil
+		}
+		for n, ok := range speakers {
+			if ok {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+
+	if pinned := pinnedNodes(svc); pinned != nil {
+		nodes = pinNodes(nodes, pinned)
+	} else {
+		sortNodes(nodes, name, priorities)
+	}
+	if nodes == nil {
+		// Known, there are none.
+		return []string{}
+	}
+	return nodes
+}
+
+// Owners returns the nodes announcing the service, sorted, or nil if
+// they are unknown.
+func (c *bgpController) Owners(name string, svc *v1.Service, eps k8s.EpsOrSlices) []string {
+	if !hasHealthyEndpoint(eps, func(toFilter *string) bool { return false }) {
+		return []string{}
+	}
+	nodes := c.candidates(name, svc, eps)
+	if nodes == nil {
+		return nil
+	}
+	if max, err := maxAnnouncingNodes(svc); err == nil && max > 0 && max < len(nodes) {
+		nodes = nodes[:max]
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+const maxAnnouncingNodesAnnotation = "metallb.universe.tf/max-announcing-nodes"
+
+// maxAnnouncingNodes returns the number of nodes svc's annotation
+// limits its announcement to, or 0 for no limit.
+func maxAnnouncingNodes(svc *v1.Service) (int, error) {
+	a := svc.Annotations[maxAnnouncingNodesAnnotation]
+	if a == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(a)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid max announcing nodes %q", a)
+	}
+	return n, nil
+}
+
 // Called when either the peer list or node labels have changed,
 // implying that the set of running BGP sessions may need tweaking.
 func (c *bgpController) syncPeers(l log.Logger) error {
@@ -175,29 +405,96 @@ func (c *bgpController) syncPeers(l log.Logger) error {
 				break
 			}
 		}
+		reason := "filteredByNodeSelector"
+		var addr net.IP
+		if shouldRun {
+			var err error
+			if addr, err = c.peerAddrFor(p.cfg); err != nil {
+				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg, "msg", "failed to determine BGP peer address")
+				errs++
+				continue
+			}
+			if addr == nil {
+				shouldRun = false
+				reason = "noPeerAddress"
+			}
+		}
+		if p.bgp != nil && shouldRun && !addr.Equal(p.addr) {
+			level.Info(l).Log("event", "peerAddressChanged", "peer", p.cfg, "oldAddress", p.addr, "newAddress", addr, "msg", "peer address changed, resetting BGP session")
+			if err := p.bgp.Close(); err != nil {
+				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg, "msg", "failed to shut down BGP session")
+			}
+			p.bgp = nil
+		}
 
 		// Now, compare current state to intended state, and correct.
 		if p.bgp != nil && !shouldRun {
 			// Oops, session is running but shouldn't be. Shut it down.
-			level.Info(l).Log("event", "peerRemoved", "peer", p.cfg.Addr, "reason", "filteredByNodeSelector", "msg", "peer deconfigured, closing BGP session")
+			level.Info(l).Log("event", "peerRemoved", "peer", p.cfg, "reason", reason, "msg", "peer deconfigured, closing BGP session")
 			if err := p.bgp.Close(); err != nil {
-				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg.Addr, "msg", "failed to shut down BGP session")
+				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg, "msg", "failed to shut down BGP session")
 			}
 			p.bgp = nil
 		} else if p.bgp == nil && shouldRun {
 			// Session doesn't exist, but should be running. Create
 			// it.
-			level.Info(l).Log("event", "peerAdded", "peer", p.cfg.Addr, "msg", "peer configured, starting BGP session")
-			var routerID net.IP
-			if p.cfg.RouterID != nil {
-				routerID = p.cfg.RouterID
+			level.Info(l).Log("event", "peerAdded", "peer", p.cfg, "address", addr, "msg", "peer configured, starting BGP session")
+			routerID, err := c.routerIDFor(p.cfg)
+			if err != nil {
+				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg, "msg", "failed to determine BGP router ID")
+				errs++
+				continue
+			}
+			srcAddr, err := c.srcAddrFor(p.cfg, addr)
+			if err != nil {
+				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg, "msg", "failed to determine BGP source address")
+				errs++
+				continue
+			}
+			params := bgp.SessionParameters{
+				Addr:                 net.JoinHostPort(peerHost(p.cfg, addr), strconv.Itoa(int(p.cfg.Port))),
+				SrcAddr:              srcAddr,
+				SrcInterface:         bindInterface(p.cfg),
+				ASN:                  p.cfg.MyASN,
+				RouterID:             routerID,
+				NextHop:              p.cfg.NextHop,
+				PeerASN:              p.cfg.ASN,
+				HoldTime:             p.cfg.HoldTime,
+				KeepaliveTime:        p.cfg.KeepaliveTime,
+				InitialBackoff:       p.cfg.InitialBackoff,
+				ConnectRetryTime:     p.cfg.ConnectRetryTime,
+				FlowSpec:             p.cfg.FlowSpec,
+				Password:             p.cfg.Password,
+				MyNode:               c.myNode,
+				RouteReflector:       p.cfg.RouteReflector,
+				ConfederationID:      p.cfg.ConfederationID,
+				ConfederationMembers: p.cfg.ConfederationMembers,
+			}
+			if e := p.cfg.EVPN; e != nil {
+				params.EVPN = &bgp.EVPN{
+					VNI:                e.VNI,
+					RouteDistinguisher: e.RouteDistinguisher,
+					RouteTargets:       e.RouteTargets,
+					RouterMAC:          e.RouterMAC,
+				}
+			}
+			if p.cfg.AddrRange != nil {
+				// Dynamic neighbors dial us, on the source address if
+				// there's one.
+				host := ""
+				if srcAddr != nil {
+					host = srcAddr.String()
+				}
+				params.Addr = net.JoinHostPort(host, strconv.Itoa(int(p.cfg.Port)))
+				params.PeerRange = p.cfg.AddrRange
 			}
-			s, err := newBGP(c.logger, net.JoinHostPort(p.cfg.Addr.String(), strconv.Itoa(int(p.cfg.Port))), p.cfg.SrcAddr, p.cfg.MyASN, routerID, p.cfg.ASN, p.cfg.HoldTime, p.cfg.Password, c.myNode)
+			s, err := newBGP(c.logger, params)
 			if err != nil {
-				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg.Addr, "msg", "failed to create BGP session")
+				level.Error(l).Log("op", "syncPeers", "error", err, "peer", p.cfg, "msg", "failed to create BGP session")
 				errs++
 			} else {
 				p.bgp = s
+				p.addr = addr
 				needUpdateAds = true
 			}
 		}
@@ -215,22 +512,101 @@ func (c *bgpController) syncPeers(l log.Logger) error {
 	return nil
 }
 
-func (c *bgpController) SetBalancer(l log.Logger, name string, lbIP net.IP, pool *config.Pool) error {
+func (c *bgpController) SetBalancer(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices, lbIP net.IP, pool *config.Pool) error {
 	c.svcAds[name] = nil
+	rank, ok := c.svcRank[name]
+	if !ok {
+		rank = -1
+	}
+	// Weight of this node for the link bandwidth community, only
+	// meaningful when the node only forwards to local endpoints.
+	localEps := 0
+	if svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal {
+		localEps = healthyEndpoints(eps, func(toFilter *string) bool {
+			return toFilter == nil || *toFilter != c.myNode
+		})
+	}
+	extra, err := extraPrefixes(svc, pool)
+	if err != nil {
+		// Like a bad FlowSpec request, this doesn't affect the
+		// service's own IP.
+		level.Error(l).Log("op", "setBalancer", "error", err, "msg", "ignoring invalid extra prefixes")
+	}
+	localPref, err := localPrefOverride(svc)
+	if err != nil {
+		level.Error(l).Log("op", "setBalancer", "error", err, "msg", "ignoring invalid local preference annotation")
+	}
+	override, err := adOverrides(svc, pool, lbIP, c.communities)
+	if err != nil {
+		level.Error(l).Log("op", "setBalancer", "error", err, "msg", "ignoring BGP advertisement override annotations")
+	}
+	prefixLen, err := allocatedPrefixLength(svc, pool, lbIP)
+	if err != nil {
+		level.Error(l).Log("op", "setBalancer", "error", err, "msg", "ignoring invalid address prefix length annotation")
+	}
 	for _, adCfg := range pool.BGPAdvertisements {
+		if adCfg.MaxAnnouncingNodes > 0 && rank >= adCfg.MaxAnnouncingNodes {
+			continue
+		}
 		m := net.CIDRMask(adCfg.AggregationLength, 32)
+		if lbIP.To4() == nil {
+			m = net.CIDRMask(adCfg.AggregationLengthV6, 128)
+		}
+		if override.aggregationLength != nil {
+			m = net.CIDRMask(*override.aggregationLength, len(m)*8)
+		}
+		if prefixLen != nil {
+			// The whole prefix belongs to the service.
+			m = net.CIDRMask(*prefixLen, len(m)*8)
+		}
 		ad := &bgp.Advertisement{
 			Prefix: &net.IPNet{
 				IP:   lbIP.Mask(m),
 				Mask: m,
 			},
-			LocalPref: adCfg.LocalPref,
+			MED:           uint32(c.priority),
+			LocalPref:     adCfg.LocalPref,
+			NextHop:       adCfg.NextHop,
+			LinkBandwidth: adCfg.LinkBandwidth * float32(localEps),
+		}
+		if localPref != nil {
+			ad.LocalPref = *localPref
+		}
+		communities := adCfg.Communities
+		if override.communities != nil {
+			communities = override.communities
 		}
-		for comm := range adCfg.Communities {
+		for comm := range communities {
 			ad.Communities = append(ad.Communities, comm)
 		}
 		sort.Slice(ad.Communities, func(i, j int) bool { return ad.Communities[i] < ad.Communities[j] })
-		c.svcAds[name] = append(c.svcAds[name], ad)
+		c.svcAds[name] = append(c.svcAds[name], &advertisement{ad, adCfg.Peers, adCfg.Instances})
+		for _, pfx := range extra {
+			// Extra prefixes share the attributes of the service's
+			// advertisement, but are never aggregated.
+			extraAd := *ad
+			extraAd.Prefix = pfx
+			c.svcAds[name] = append(c.svcAds[name], &advertisement{&extraAd, adCfg.Peers, adCfg.Instances})
+		}
+	}
+
+	fs, err := flowSpecAction(svc)
+	if err != nil {
+		// Don't fail the whole announcement over a bad mitigation
+		// request, the unicast routes are still good.
+		level.Error(l).Log("op", "setBalancer", "error", err, "msg", "ignoring invalid FlowSpec annotation")
+	} else if fs != nil && lbIP.To4() == nil {
+		level.Error(l).Log("op", "setBalancer", "msg", "ignoring FlowSpec annotation, FlowSpec rules are only sent for IPv4 addresses")
+	} else if fs != nil {
+		c.svcAds[name] = append(c.svcAds[name], &advertisement{
+			Advertisement: &bgp.Advertisement{
+				Prefix: &net.IPNet{
+					IP:   lbIP.To4(),
+					Mask: net.CIDRMask(32, 32),
+				},
+				FlowSpec: fs,
+			},
+		})
 	}
 
 	if err := c.updateAds(); err != nil {
@@ -242,8 +618,192 @@ func (c *bgpController) SetBalancer(l log.Logger, name string, lbIP net.IP, pool
 	return nil
 }
 
+// flowSpecAction returns the FlowSpec action requested by svc's
+// flowspec annotation, or nil if the service requests none.
+//
+// The annotation is either "discard", or "rate-limit:<bytes/sec>".
+func flowSpecAction(svc *v1.Service) (*bgp.FlowSpecAction, error) {
+	if svc == nil {
+		return nil, nil
+	}
+	a := svc.Annotations[flowSpecAnnotation]
+	switch {
+	case a == "":
+		return nil, nil
+	case a == "discard":
+		return &bgp.FlowSpecAction{}, nil
+	case strings.HasPrefix(a, "rate-limit:"):
+		rate, err := strconv.ParseFloat(strings.TrimPrefix(a, "rate-limit:"), 32)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid FlowSpec rate limit %q", a)
+		}
+		return &bgp.FlowSpecAction{RateLimit: float32(rate)}, nil
+	default:
+		return nil, fmt.Errorf("unknown FlowSpec action %q", a)
+	}
+}
+
+// flowSpecAnnotation requests a FlowSpec rule for the service's IP,
+// to mitigate attacks upstream of the cluster.
+const flowSpecAnnotation = "metallb.universe.tf/flowspec-action"
+
+// localPrefAnnotation overrides the LOCAL_PREF of the service's
+// advertisements to iBGP peers, e.g. to prefer the site where the
+// service is primary.
+const localPrefAnnotation = "metallb.universe.tf/bgp-local-pref"
+
+// localPrefOverride returns the local preference requested by svc's
+// annotation, or nil if the service uses its pool's.
+func localPrefOverride(svc *v1.Service) (*uint32, error) {
+	if svc == nil || svc.Annotations[localPrefAnnotation] == "" {
+		return nil, nil
+	}
+	a := svc.Annotations[localPrefAnnotation]
+	lp, err := strconv.ParseUint(a, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local preference %q", a)
+	}
+	ret := uint32(lp)
+	return &ret, nil
+}
+
+// aggregationLengthAnnotation and communitiesAnnotation override the
+// aggregation length and the communities of all the BGP
+// advertisements of the service's pool, if the pool allows it.
+const (
+	aggregationLengthAnnotation = "metallb.universe.tf/bgp-aggregation-length"
+	communitiesAnnotation       = "metallb.universe.tf/bgp-communities"
+)
+
+// adOverride holds the attributes of a service's advertisements that
+// override its pool's. Nil fields aren't overridden.
+type adOverride struct {
+	aggregationLength *int
+	communities       map[uint32]bool
+}
+
+// adOverrides returns the overrides requested by svc's annotations
+// for its advertisements of lbIP, from pool. The communities may be
+// aliases in communities.
+func adOverrides(svc *v1.Service, pool *config.Pool, lbIP net.IP, communities map[string]uint32) (adOverride, error) {
+	var ret adOverride
+	if svc == nil {
+		return ret, nil
+	}
+	agg, comms := svc.Annotations[aggregationLengthAnnotation], svc.Annotations[communitiesAnnotation]
+	if agg == "" && comms == "" {
+		return ret, nil
+	}
+	if !pool.AllowServiceOverrides {
+		return ret, errors.New("the service's address pool doesn't allow overriding its BGP advertisements")
+	}
+
+	if agg != "" {
+		bits := 32
+		if lbIP.To4() == nil {
+			bits = 128
+		}
+		n, err := strconv.Atoi(agg)
+		if err != nil || n < 0 || n > bits {
+			return adOverride{}, fmt.Errorf("invalid aggregation length %q", agg)
+		}
+		if err := checkPrefixInPool(pool, lbIP, n); err != nil {
+			return adOverride{}, fmt.Errorf("aggregation length %d is %s", n, err)
+		}
+		ret.aggregationLength = &n
+	}
+
+	if comms != "" {
+		var raw []string
+		for _, c := range strings.Split(comms, ",") {
+			raw = append(raw, strings.TrimSpace(c))
+		}
+		parsed, err := config.ParseCommunities(raw, communities)
+		if err != nil {
+			return adOverride{}, err
+		}
+		ret.communities = parsed
+	}
+	return ret, nil
+}
+
+// checkPrefixInPool returns an error if the prefix of length n holding
+// lbIP is shorter than the pool's prefix holding it. Like the pool's,
+// advertised prefixes can't attract traffic for addresses outside of
+// the pool.
+func checkPrefixInPool(pool *config.Pool, lbIP net.IP, n int) error {
+	for _, cidr := range pool.CIDR {
+		if o, _ := cidr.Mask.Size(); cidr.Contains(lbIP) && n < o {
+			return fmt.Errorf("shorter than the prefix %s of the pool", cidr)
+		}
+	}
+	return nil
+}
+
+// allocatedPrefixLength returns the length of the prefix allocated to
+// svc, from its pool, nil if it was allocated a single IP. Only the
+// prefix the controller reserved for svc, as requested by its address
+// prefix length annotation, is advertised, so that a service can't
+// attract the traffic of other services' addresses.
+func allocatedPrefixLength(svc *v1.Service, pool *config.Pool, lbIP net.IP) (*int, error) {
+	if svc == nil {
+		return nil, nil
+	}
+	prefixes, err := k8s.ReservedPrefixes(svc, k8s.AddressBlockCondition)
+	if err != nil || len(prefixes) == 0 {
+		return nil, err
+	}
+	pfx := prefixes[0]
+	if len(prefixes) > 1 || !pfx.Contains(lbIP) {
+		return nil, fmt.Errorf("address block %q doesn't hold the service's IP", pfx)
+	}
+	n, _ := pfx.Mask.Size()
+	if err := checkPrefixInPool(pool, lbIP, n); err != nil {
+		return nil, fmt.Errorf("address block %s is %s", pfx, err)
+	}
+	return &n, nil
+}
+
+// extraPrefixesAnnotation lists prefixes to advertise along with the
+// service's IP, for services that own a whole prefix.
+const extraPrefixesAnnotation = "metallb.universe.tf/extra-prefixes"
+
+// extraPrefixes returns the extra prefixes of svc. Only the prefixes
+// the controller reserved for svc, as requested by its extra prefixes
+// annotation, are advertised, so that a service can't attract the
+// traffic of other services' addresses. They must be within pool,
+// too.
+func extraPrefixes(svc *v1.Service, pool *config.Pool) ([]*net.IPNet, error) {
+	if svc == nil {
+		return nil, nil
+	}
+	prefixes, err := k8s.ReservedPrefixes(svc, k8s.ExtraPrefixesCondition)
+	if err != nil {
+		return nil, err
+	}
+	for _, pfx := range prefixes {
+		if !poolContains(pool, pfx) {
+			return nil, fmt.Errorf("extra prefix %q is not within the service's address pool", pfx)
+		}
+	}
+	return prefixes, nil
+}
+
+// poolContains returns true if pfx is entirely within one of the
+// CIDRs of pool.
+func poolContains(pool *config.Pool, pfx *net.IPNet) bool {
+	pfxOnes, pfxBits := pfx.Mask.Size()
+	for _, cidr := range pool.CIDR {
+		ones, bits := cidr.Mask.Size()
+		if bits == pfxBits && ones <= pfxOnes && cidr.Contains(pfx.IP) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *bgpController) updateAds() error {
-	var allAds []*bgp.Advertisement
+	var allAds []*advertisement
 	for _, ads := range c.svcAds {
 		// This list might contain duplicates, but that's fine,
 		// they'll get compacted by the session code when it's
@@ -253,18 +813,90 @@ func (c *bgpController) updateAds() error {
 		// and detecting conflicting advertisements.
 		allAds = append(allAds, ads...)
 	}
+	allAds = append(allAds, c.staticAdvertisements()...)
+	allAds = append(allAds, c.loopbackAdvertisements()...)
 	for _, peer := range c.peers {
 		if peer.bgp == nil {
 			continue
 		}
-		if err := peer.bgp.Set(allAds...); err != nil {
+		var ads []*bgp.Advertisement
+		for _, ad := range allAds {
+			if ad.advertisesTo(peer) {
+				ads = append(ads, ad.Advertisement)
+			}
+		}
+		if err := peer.bgp.Set(ads...); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// staticAdvertisements returns the configured static advertisements
+// that this node should make.
+func (c *bgpController) staticAdvertisements() []*advertisement {
+	var ret []*advertisement
+	for _, sa := range c.staticAds {
+		match := false
+		for _, ns := range sa.NodeSelectors {
+			if ns.Matches(c.nodeLabels) {
+				match = true
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		ad := &bgp.Advertisement{
+			Prefix:    sa.Prefix,
+			LocalPref: sa.LocalPref,
+			NextHop:   sa.NextHop,
+		}
+		for comm := range sa.Communities {
+			ad.Communities = append(ad.Communities, comm)
+		}
+		sort.Slice(ad.Communities, func(i, j int) bool { return ad.Communities[i] < ad.Communities[j] })
+		ret = append(ret, &advertisement{ad, sa.Peers, nil})
+	}
+	return ret
+}
+
+// loopbackAdvertisements returns the advertisements of the host route
+// of the node's loopback address, following the BGP advertisements of
+// its pool, if it has one.
+func (c *bgpController) loopbackAdvertisements() []*advertisement {
+	if c.loopback == nil {
+		return nil
+	}
+	m := net.CIDRMask(32, 32)
+	if c.loopback.To4() == nil {
+		m = net.CIDRMask(128, 128)
+	}
+	pfx := &net.IPNet{IP: c.loopback, Mask: m}
+	for _, pool := range c.loopbackPools {
+		if !poolContains(pool, pfx) {
+			continue
+		}
+		var ret []*advertisement
+		for _, adCfg := range pool.BGPAdvertisements {
+			ad := &bgp.Advertisement{
+				Prefix:    pfx,
+				LocalPref: adCfg.LocalPref,
+				NextHop:   adCfg.NextHop,
+			}
+			for comm := range adCfg.Communities {
+				ad.Communities = append(ad.Communities, comm)
+			}
+			sort.Slice(ad.Communities, func(i, j int) bool { return ad.Communities[i] < ad.Communities[j] })
+			ret = append(ret, &advertisement{ad, adCfg.Peers, adCfg.Instances})
+		}
+		return ret
+	}
+	return nil
+}
+
 func (c *bgpController) DeleteBalancer(l log.Logger, name, reason string) error {
+	delete(c.svcRank, name)
 	if _, ok := c.svcAds[name]; !ok {
 		return nil
 	}
@@ -272,26 +904,336 @@ func (c *bgpController) DeleteBalancer(l log.Logger, name, reason string) error
 	return c.updateAds()
 }
 
-type session interface {
-	io.Closer
-	Set(advs ...*bgp.Advertisement) error
+// AnnouncedVia returns the addresses of the peers that receive the
+// advertisements of the service.
+func (c *bgpController) AnnouncedVia(name string) []string {
+	var ret []string
+	for _, peer := range c.peers {
+		if peer.bgp == nil {
+			continue
+		}
+		for _, ad := range c.svcAds[name] {
+			if ad.advertisesTo(peer) {
+				if peer.cfg.AddrRange != nil {
+					ret = append(ret, peer.cfg.AddrRange.String())
+				} else {
+					ret = append(ret, peer.addr.String())
+				}
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// LinkUp makes the sessions that went down, possibly because of the
+// link flap, reconnect right away.
+func (c *bgpController) LinkUp(l log.Logger, name string) {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	for _, p := range c.peers {
+		if p.bgp != nil {
+			p.bgp.Reconnect()
+		}
+	}
+}
+
+// AddrsChanged resets the sessions established from an address the
+// node no longer has, so that they reconnect from its new address and
+// advertise it as next hop, and retries the sessions that are down.
+func (c *bgpController) AddrsChanged(l log.Logger) {
+	addrs, err := c.interfaces().InterfaceAddrs()
+	if err != nil {
+		level.Error(l).Log("op", "addrsChanged", "error", err, "msg", "failed to list the node's addresses")
+		return
+	}
+	isLocal := func(ip net.IP) bool {
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	for _, p := range c.peers {
+		if p.bgp != nil {
+			p.bgp.AddrsChanged(isLocal)
+		}
+	}
 }
 
 func (c *bgpController) SetNode(l log.Logger, node *v1.Node) error {
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+
+	// Errors are logged by the controller. Advertisements pick up a
+	// changed priority when the controller reprocesses services.
+	c.priority, _ = nodePriority(node)
+
+	var routerID net.IP
+	if a := node.Annotations[routerIDAnnotation]; a != "" {
+		if routerID = net.ParseIP(a).To4(); routerID == nil {
+			level.Error(l).Log("op", "setNode", "error", fmt.Sprintf("invalid router ID %q", a), "msg", "ignoring invalid router ID annotation")
+		}
+	}
+	routerIDChanged := !routerID.Equal(c.nodeRouterID)
+	c.nodeRouterID = routerID
+	if routerIDChanged {
+		// The router ID can't change on a live session, restart the
+		// affected ones.
+		level.Info(l).Log("event", "routerIDChanged", "routerID", routerID, "msg", "node router ID changed, resetting BGP sessions")
+		for _, p := range c.peers {
+			if p.bgp == nil || p.cfg.RouterID != nil {
+				continue
+			}
+			if err := p.bgp.Close(); err != nil {
+				level.Error(l).Log("op", "setNode", "error", err, "peer", p.cfg, "msg", "failed to shut down BGP session")
+			}
+			p.bgp = nil
+		}
+	}
+
+	// Likewise for the source addresses that come from the node's
+	// annotations. Sessions whose peer address comes from the node's
+	// annotations are reset by syncPeers.
+	annotationsChanged := false
+	for _, p := range c.peers {
+		if key := p.cfg.AddrAnnotation; key != "" && c.nodeAnnotations[key] != node.Annotations[key] {
+			annotationsChanged = true
+		}
+		key := p.cfg.SrcAddrAnnotation
+		if key == "" || c.nodeAnnotations[key] == node.Annotations[key] {
+			continue
+		}
+		annotationsChanged = true
+		if p.bgp == nil {
+			continue
+		}
+		level.Info(l).Log("event", "sourceAddressChanged", "peer", p.cfg, "sourceAddress", node.Annotations[key], "msg", "node source address changed, resetting BGP session")
+		if err := p.bgp.Close(); err != nil {
+			level.Error(l).Log("op", "setNode", "error", err, "peer", p.cfg, "msg", "failed to shut down BGP session")
+		}
+		p.bgp = nil
+	}
+	c.nodeAnnotations = node.Annotations
+
+	var loopback net.IP
+	if a := node.Annotations[k8s.NodeLoopbackAnnotation]; a != "" {
+		if loopback = net.ParseIP(a); loopback == nil {
+			level.Error(l).Log("op", "setNode", "error", fmt.Sprintf("invalid loopback address %q", a), "msg", "ignoring invalid loopback address annotation")
+		}
+	}
+	loopbackChanged := !loopback.Equal(c.loopback)
+	if loopbackChanged {
+		level.Info(l).Log("event", "loopbackChanged", "ip", loopback, "msg", "node loopback address changed")
+		c.loopback = loopback
+	}
+
 	nodeLabels := node.Labels
 	if nodeLabels == nil {
 		nodeLabels = map[string]string{}
 	}
 	ns := labels.Set(nodeLabels)
-	if c.nodeLabels != nil && labels.Equals(c.nodeLabels, ns) {
+	if !routerIDChanged && !annotationsChanged && !loopbackChanged && c.nodeLabels != nil && labels.Equals(c.nodeLabels, ns) {
 		// Node labels unchanged, no action required.
 		return nil
 	}
 	c.nodeLabels = ns
 	level.Info(l).Log("event", "nodeLabelsChanged", "msg", "Node labels changed, resyncing BGP peers")
-	return c.syncPeers(l)
+	if err := c.syncPeers(l); err != nil {
+		return err
+	}
+	// Static advertisements may select on node labels too.
+	return c.updateAds()
+}
+
+// routerIDAnnotation sets the BGP router ID of a node.
+const routerIDAnnotation = "metallb.universe.tf/bgp-router-id"
+
+// routerIDFor returns the router ID to use for sessions to peer p,
+// or nil to let the session pick one from its local address.
+func (c *bgpController) routerIDFor(p *config.Peer) (net.IP, error) {
+	switch {
+	case p.RouterID != nil:
+		return p.RouterID, nil
+	case c.nodeRouterID != nil:
+		return c.nodeRouterID, nil
+	case p.RouterIDInterface != "":
+		return interfaceIPv4(c.interfaces(), p.RouterIDInterface)
+	default:
+		return nil, nil
+	}
+}
+
+// peerAddrFor returns the address of peer p for this node, or nil if
+// the peer has none here. For dynamic neighbors, it's the network
+// address of their range.
+func (c *bgpController) peerAddrFor(p *config.Peer) (net.IP, error) {
+	if p.AddrRange != nil {
+		return p.AddrRange.IP, nil
+	}
+	if a := c.nodeAnnotations[p.AddrAnnotation]; p.AddrAnnotation != "" && a != "" {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer address %q in node annotation %q", a, p.AddrAnnotation)
+		}
+		return ip, nil
+	}
+	if p.AddrGatewayInterface != "" {
+		return interfaceGateway(p.AddrGatewayInterface)
+	}
+	return p.Addr, nil
+}
+
+// bindInterface returns the network device p's session is bound
+// to: its source interface, or else the VRF of its BGP instance.
+func bindInterface(p *config.Peer) string {
+	if p.SrcInterface != "" {
+		return p.SrcInterface
+	}
+	return p.VRF
+}
+
+// peerHost returns the host part of the address to dial peer p at
+// addr. IPv6 link-local addresses are scoped to the interface they
+// are reachable through: the peer's, the one whose gateway the peer
+// is, or the one the session leaves through.
+func peerHost(p *config.Peer, addr net.IP) string {
+	if addr.To4() != nil || !addr.IsLinkLocalUnicast() {
+		return addr.String()
+	}
+	zone := p.AddrZone
+	if zone == "" {
+		zone = p.AddrGatewayInterface
+	}
+	if zone == "" {
+		zone = p.SrcInterface
+	}
+	if zone == "" {
+		return addr.String()
+	}
+	return addr.String() + "%" + zone
 }
 
-var newBGP = func(logger log.Logger, addr string, srcAddr net.IP, myASN uint32, routerID net.IP, asn uint32, hold time.Duration, password string, myNode string) (session, error) {
-	return bgp.New(logger, addr, srcAddr, myASN, routerID, asn, hold, password, myNode)
+// srcAddrFor returns the source address to use for sessions to peer
+// p at addr, or nil to let the kernel pick one.
+func (c *bgpController) srcAddrFor(p *config.Peer, addr net.IP) (net.IP, error) {
+	if a := c.nodeAnnotations[p.SrcAddrAnnotation]; p.SrcAddrAnnotation != "" && a != "" {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source address %q in node annotation %q", a, p.SrcAddrAnnotation)
+		}
+		return ip, nil
+	}
+	switch {
+	case p.SrcAddr != nil:
+		return p.SrcAddr, nil
+	case p.SrcInterface != "":
+		return interfaceAddr(c.interfaces(), p.SrcInterface, addr.To4() != nil)
+	default:
+		return nil, nil
+	}
+}
+
+func (c *bgpController) interfaces() linkwatch.Interfaces {
+	if c.intfs == nil {
+		return linkwatch.System{}
+	}
+	return c.intfs
+}
+
+// interfaceIPv4 returns the first IPv4 address of the named network
+// interface.
+func interfaceIPv4(intfs linkwatch.Interfaces, name string) (net.IP, error) {
+	return interfaceAddr(intfs, name, true)
 }
+
+// interfaceAddr returns the first IPv4, or global IPv6, address of
+// the named network interface.
+func interfaceAddr(intfs linkwatch.Interfaces, name string, ipv4 bool) (net.IP, error) {
+	ifi, err := intfs.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := intfs.Addrs(ifi)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipv4 && ipn.IP.To4() != nil {
+			return ipn.IP.To4(), nil
+		}
+		if !ipv4 && ipn.IP.To4() == nil && ipn.IP.IsGlobalUnicast() {
+			return ipn.IP, nil
+		}
+	}
+	if ipv4 {
+		return nil, fmt.Errorf("interface %q has no IPv4 address", name)
+	}
+	return nil, fmt.Errorf("interface %q has no global IPv6 address", name)
+}
+
+// Routing tables of the kernel.
+var (
+	procNetRoute     = "/proc/net/route"
+	procNetIPv6Route = "/proc/net/ipv6_route"
+)
+
+// interfaceGateway returns the gateway of the default route through
+// the named network interface, preferring IPv4.
+func interfaceGateway(name string) (net.IP, error) {
+	// Fields are the interface, destination, gateway, flags, refcount,
+	// use, metric and mask, with the addresses in hex in host byte
+	// order, i.e. little endian on the platforms we build for.
+	bs, err := ioutil.ReadFile(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(bs), "\n")[1:] {
+		f := strings.Fields(line)
+		if len(f) < 8 || f[0] != name || f[1] != "00000000" || f[7] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(f[2], 16, 32)
+		if err != nil || gw == 0 {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return ip, nil
+	}
+
+	// Fields are the destination and its length, the source and its
+	// length, the next hop, metric, refcount, use, flags and
+	// interface, with the addresses in hex in network byte order.
+	// Link-local gateways need a zone we can't dial, skip them.
+	bs, err = ioutil.ReadFile(procNetIPv6Route)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 10 || f[9] != name || f[1] != "00" {
+			continue
+		}
+		gw, err := hex.DecodeString(f[4])
+		if err != nil || len(gw) != net.IPv6len {
+			continue
+		}
+		if ip := net.IP(gw); ip.IsGlobalUnicast() {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("no default gateway on interface %q", name)
+}
+
+// newBGP starts BGP sessions, using the backend selected on the
+// command line.
+var newBGP = bgp.Native.NewSession
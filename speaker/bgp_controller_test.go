@@ -3,8 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -94,12 +97,17 @@ type fakeBGP struct {
 	sync.Mutex
 	// peer IP -> advertisements
 	gotAds map[string][]*bgp.Advertisement
+	params map[string]bgp.SessionParameters
+	// peer IP -> number of reconnection requests
+	reconnects map[string]int
+	addrChecks map[string]int
 }
 
-func (f *fakeBGP) New(_ log.Logger, addr string, _ net.IP, _ uint32, _ net.IP, _ uint32, _ time.Duration, _, _ string) (session, error) {
+func (f *fakeBGP) New(_ log.Logger, p bgp.SessionParameters) (bgp.BackendSession, error) {
 	f.Lock()
 	defer f.Unlock()
 
+	addr := p.Addr
 	if _, ok := f.gotAds[addr]; ok {
 		f.t.Errorf("Tried to create already existing BGP session to %q", addr)
 		return nil, errors.New("invariant violation")
@@ -107,6 +115,10 @@ func (f *fakeBGP) New(_ log.Logger, addr string, _ net.IP, _ uint32, _ net.IP, _
 	// Nil because we haven't programmed any routes for it yet, but
 	// the key now exists in the map.
 	f.gotAds[addr] = nil
+	if f.params == nil {
+		f.params = map[string]bgp.SessionParameters{}
+	}
+	f.params[addr] = p
 	return &fakeSession{
 		f:    f,
 		addr: addr,
@@ -155,6 +167,24 @@ func (f *fakeSession) Close() error {
 	return nil
 }
 
+func (f *fakeSession) Reconnect() {
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.f.reconnects == nil {
+		f.f.reconnects = map[string]int{}
+	}
+	f.f.reconnects[f.addr]++
+}
+
+func (f *fakeSession) AddrsChanged(func(net.IP) bool) {
+	f.f.Lock()
+	defer f.f.Unlock()
+	if f.f.addrChecks == nil {
+		f.f.addrChecks = map[string]int{}
+	}
+	f.f.addrChecks[f.addr]++
+}
+
 func (f *fakeSession) Set(ads ...*bgp.Advertisement) error {
 	f.f.Lock()
 	defer f.f.Unlock()
@@ -172,15 +202,28 @@ func (f *fakeSession) Set(ads ...*bgp.Advertisement) error {
 // to do to k8s.
 type testK8S struct {
 	loggedWarning bool
+	infos         []string
+	speakerStatus []k8s.SpeakerServiceStatus
+	changedAt     time.Time
 	t             *testing.T
 }
 
-func (s *testK8S) UpdateStatus(svc *v1.Service) error {
+func (s *testK8S) UpdateSpeakerStatus(name string, services []k8s.SpeakerServiceStatus) error {
+	s.speakerStatus = services
+	return nil
+}
+
+func (s *testK8S) ChangedAt(key string) time.Time {
+	return s.changedAt
+}
+
+func (s *testK8S) UpdateStatus(svc *v1.Service, ipMode string) error {
 	panic("never called")
 }
 
 func (s *testK8S) Infof(_ *v1.Service, evtType string, msg string, args ...interface{}) {
 	s.t.Logf("k8s Info event %q: %s", evtType, fmt.Sprintf(msg, args...))
+	s.infos = append(s.infos, evtType+": "+fmt.Sprintf(msg, args...))
 }
 
 func (s *testK8S) Errorf(_ *v1.Service, evtType string, msg string, args ...interface{}) {
@@ -330,6 +373,145 @@ func TestBGPSpeaker(t *testing.T) {
 			},
 		},
 
+		{
+			desc:     "LB ignored by MetalLB",
+			balancer: "test1",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/ignore": "true",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:                  "LoadBalancer",
+					ExternalTrafficPolicy: "Cluster",
+				},
+				Status: statusAssigned("10.20.30.1"),
+			},
+			eps: k8s.EpsOrSlices{
+				EpVal: &v1.Endpoints{
+					Subsets: []v1.EndpointSubset{
+						{
+							Addresses: []v1.EndpointAddress{
+								{
+									IP:       "2.3.4.5",
+									NodeName: strptr("iris"),
+								},
+							},
+						},
+					},
+				},
+				Type: k8s.Eps,
+			},
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+
+		{
+			desc:     "LB announcement disabled",
+			balancer: "test1",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/announce-disabled": "true",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:                  "LoadBalancer",
+					ExternalTrafficPolicy: "Cluster",
+				},
+				Status: statusAssigned("10.20.30.1"),
+			},
+			eps: k8s.EpsOrSlices{
+				EpVal: &v1.Endpoints{
+					Subsets: []v1.EndpointSubset{
+						{
+							Addresses: []v1.EndpointAddress{
+								{
+									IP:       "2.3.4.5",
+									NodeName: strptr("iris"),
+								},
+							},
+						},
+					},
+				},
+				Type: k8s.Eps,
+			},
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+
+		{
+			desc:     "LB no longer ignored",
+			balancer: "test1",
+			svc: &v1.Service{
+				Spec: v1.ServiceSpec{
+					Type:                  "LoadBalancer",
+					ExternalTrafficPolicy: "Cluster",
+				},
+				Status: statusAssigned("10.20.30.1"),
+			},
+			eps: k8s.EpsOrSlices{
+				EpVal: &v1.Endpoints{
+					Subsets: []v1.EndpointSubset{
+						{
+							Addresses: []v1.EndpointAddress{
+								{
+									IP:       "2.3.4.5",
+									NodeName: strptr("iris"),
+								},
+							},
+						},
+					},
+				},
+				Type: k8s.Eps,
+			},
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix: ipnet("10.20.30.1/32"),
+					},
+				},
+			},
+		},
+
+		{
+			desc:     "LB of another load balancer class",
+			balancer: "test1",
+			svc: &v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						"metallb.universe.tf/loadbalancer-class": "example.com/internal",
+					},
+				},
+				Spec: v1.ServiceSpec{
+					Type:                  "LoadBalancer",
+					ExternalTrafficPolicy: "Cluster",
+				},
+				Status: statusAssigned("10.20.30.1"),
+			},
+			eps: k8s.EpsOrSlices{
+				EpVal: &v1.Endpoints{
+					Subsets: []v1.EndpointSubset{
+						{
+							Addresses: []v1.EndpointAddress{
+								{
+									IP:       "2.3.4.5",
+									NodeName: strptr("iris"),
+								},
+							},
+						},
+					},
+				},
+				Type: k8s.Eps,
+			},
+			wantAds: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+
 		{
 			desc:     "LB switches to local traffic policy, endpoint isn't on our node",
 			balancer: "test1",
@@ -1908,3 +2090,2074 @@ func TestNodeSelectors(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeDrain(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	announced := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+	withdrawn := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": nil,
+	}
+
+	tests := []struct {
+		desc    string
+		node    *v1.Node
+		wantSt  k8s.SyncState
+		wantAds map[string][]*bgp.Advertisement
+	}{
+		{
+			desc:    "Node in service",
+			node:    &v1.Node{},
+			wantSt:  k8s.SyncStateSuccess,
+			wantAds: announced,
+		},
+		{
+			desc: "Node cordoned",
+			node: &v1.Node{
+				Spec: v1.NodeSpec{Unschedulable: true},
+			},
+			wantSt:  k8s.SyncStateReprocessAll,
+			wantAds: withdrawn,
+		},
+		{
+			desc:    "Node uncordoned",
+			node:    &v1.Node{},
+			wantSt:  k8s.SyncStateReprocessAll,
+			wantAds: announced,
+		},
+		{
+			desc: "Node annotated for maintenance",
+			node: &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						maintenanceAnnotation: "true",
+					},
+				},
+			},
+			wantSt:  k8s.SyncStateReprocessAll,
+			wantAds: withdrawn,
+		},
+	}
+
+	for _, test := range tests {
+		if st := c.SetNode(l, test.node); st != test.wantSt {
+			t.Errorf("%q: SetNode returned %v, want %v", test.desc, st, test.wantSt)
+		}
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Errorf("%q: SetBalancer failed", test.desc)
+		}
+
+		gotAds := b.Ads()
+		sortAds(test.wantAds)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.wantAds, gotAds); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+
+	if c.SetNode(l, &v1.Node{}) == k8s.SyncStateError {
+		t.Errorf("SetNode failed")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Errorf("SetBalancer failed")
+	}
+	c.Shutdown(l, 0)
+	if diff := cmp.Diff(withdrawn, b.Ads()); diff != "" {
+		t.Errorf("unexpected advertisement state after shutdown (-want +got)\n%s", diff)
+	}
+}
+
+// TestDrainDelayGossip checks that the other speakers only learn that
+// the node drains once it withdraws its announcements.
+func TestDrainDelayGossip(t *testing.T) {
+	sl := &fakeSpeakerList{speakers: map[string]bool{}}
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+		SList:         sl,
+		DrainDelay:    time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	l := log.NewNopLogger()
+	cordoned := &v1.Node{Spec: v1.NodeSpec{Unschedulable: true}}
+
+	c.SetNode(l, cordoned)
+	if sl.draining {
+		t.Error("draining gossiped before the drain delay")
+	}
+	c.drained(c.drainGen)
+	if !sl.draining {
+		t.Error("draining not gossiped after the drain delay")
+	}
+
+	c.SetNode(l, &v1.Node{})
+	if sl.draining {
+		t.Error("draining still gossiped after uncordoning")
+	}
+	c.SetNode(l, cordoned)
+	gen := c.drainGen
+	c.SetNode(l, &v1.Node{})
+	c.drained(gen)
+	if sl.draining {
+		t.Error("drain delay of an uncordoned node gossiped draining")
+	}
+}
+
+// TestNotReadyGossip checks that the other speakers see a node waiting
+// for its networking as draining, so that they don't elect it.
+func TestNotReadyGossip(t *testing.T) {
+	sl := &fakeSpeakerList{speakers: map[string]bool{}}
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+		SList:         sl,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	l := log.NewNopLogger()
+
+	c.setNotReady(true)
+	if !sl.draining {
+		t.Error("not ready node not gossiped as draining")
+	}
+	c.SetNode(l, &v1.Node{Spec: v1.NodeSpec{Unschedulable: true}})
+	c.setNotReady(false)
+	if !sl.draining {
+		t.Error("readiness hid the drain of a cordoned node")
+	}
+	c.SetNode(l, &v1.Node{})
+	if sl.draining {
+		t.Error("ready and uncordoned node still gossiped as draining")
+	}
+}
+
+func TestStaticAdvertisements(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		StaticAdvertisements: []*config.StaticAdvertisement{
+			{
+				Prefix:        ipnet("192.0.2.0/24"),
+				Communities:   map[uint32]bool{2: true, 1: true},
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Prefix:        ipnet("192.0.2.53/32"),
+				LocalPref:     100,
+				NodeSelectors: []labels.Selector{mustSelector("anycast=true")},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	want := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix:      ipnet("192.0.2.0/24"),
+				Communities: []uint32{1, 2},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, b.Ads()); diff != "" {
+		t.Errorf("unexpected advertisement state (-want +got)\n%s", diff)
+	}
+
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"anycast": "true"},
+		},
+	}
+	if c.SetNode(l, node) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+	want["1.2.3.4:0"] = append(want["1.2.3.4:0"], &bgp.Advertisement{
+		Prefix:    ipnet("192.0.2.53/32"),
+		LocalPref: 100,
+	})
+	gotAds := b.Ads()
+	sortAds(want)
+	sortAds(gotAds)
+	if diff := cmp.Diff(want, gotAds); diff != "" {
+		t.Errorf("unexpected advertisement state (-want +got)\n%s", diff)
+	}
+}
+
+func TestNodeLoopback(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"loopbacks": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.255.0.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 24,
+						Communities:       map[uint32]bool{1: true},
+					},
+				},
+				NodeLoopbacks: true,
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	tests := []struct {
+		desc     string
+		loopback string
+		want     []*bgp.Advertisement
+	}{
+		{
+			desc:     "loopback address",
+			loopback: "10.255.0.3",
+			want: []*bgp.Advertisement{
+				{
+					Prefix:      ipnet("10.255.0.3/32"),
+					Communities: []uint32{1},
+				},
+			},
+		},
+		{
+			desc:     "address outside of the loopbacks pool",
+			loopback: "10.20.30.1",
+		},
+		{
+			desc: "no loopback address",
+		},
+	}
+	for _, test := range tests {
+		node := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{k8s.NodeLoopbackAnnotation: test.loopback},
+			},
+		}
+		if c.SetNode(l, node) == k8s.SyncStateError {
+			t.Fatalf("%q: SetNode failed", test.desc)
+		}
+		want := map[string][]*bgp.Advertisement{
+			"1.2.3.4:0": test.want,
+		}
+		if diff := cmp.Diff(want, b.Ads()); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestAdvertisementPeers(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"public": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						Peers:             []net.IP{net.ParseIP("1.2.3.4")},
+					},
+					{
+						AggregationLength: 24,
+						Peers:             []net.IP{net.ParseIP("1.2.3.5")},
+					},
+				},
+			},
+		},
+		StaticAdvertisements: []*config.StaticAdvertisement{
+			{
+				Prefix:        ipnet("192.0.2.0/24"),
+				Peers:         []net.IP{net.ParseIP("1.2.3.5")},
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer failed")
+	}
+
+	want := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+		"1.2.3.5:0": {
+			{
+				Prefix: ipnet("10.20.30.0/24"),
+			},
+			{
+				Prefix: ipnet("192.0.2.0/24"),
+			},
+		},
+	}
+	gotAds := b.Ads()
+	sortAds(want)
+	sortAds(gotAds)
+	if diff := cmp.Diff(want, gotAds); diff != "" {
+		t.Errorf("unexpected advertisement state (-want +got)\n%s", diff)
+	}
+}
+
+func TestRouterID(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:          net.ParseIP("1.2.3.5"),
+				RouterID:      net.ParseIP("10.0.0.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		want       map[string]string
+	}{
+		{
+			desc: "No annotation, implicit router ID",
+			want: map[string]string{
+				"1.2.3.4:0": "<nil>",
+				"1.2.3.5:0": "10.0.0.5",
+			},
+		},
+		{
+			desc:       "Node annotation",
+			annotation: "10.0.0.1",
+			want: map[string]string{
+				"1.2.3.4:0": "10.0.0.1",
+				"1.2.3.5:0": "10.0.0.5",
+			},
+		},
+		{
+			desc:       "Changed node annotation",
+			annotation: "10.0.0.2",
+			want: map[string]string{
+				"1.2.3.4:0": "10.0.0.2",
+				"1.2.3.5:0": "10.0.0.5",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		node := &v1.Node{}
+		if test.annotation != "" {
+			node.Annotations = map[string]string{routerIDAnnotation: test.annotation}
+		}
+		if c.SetNode(l, node) == k8s.SyncStateError {
+			t.Errorf("%q: SetNode failed", test.desc)
+		}
+		got := map[string]string{}
+		for addr, p := range b.params {
+			got[addr] = p.RouterID.String()
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: unexpected router IDs (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				SrcAddr:       net.ParseIP("10.0.0.5"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:              net.ParseIP("1.2.3.5"),
+				SrcAddr:           net.ParseIP("10.0.0.5"),
+				SrcAddrAnnotation: "example.com/routing-ip",
+				NodeSelectors:     []labels.Selector{labels.Everything()},
+			},
+			{
+				Addr:          net.ParseIP("127.0.0.2"),
+				SrcInterface:  "lo",
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		want       map[string]string
+	}{
+		{
+			desc: "No annotation",
+			want: map[string]string{
+				"1.2.3.4:0":   "10.0.0.5",
+				"1.2.3.5:0":   "10.0.0.5",
+				"127.0.0.2:0": "127.0.0.1 lo",
+			},
+		},
+		{
+			desc:       "Node annotation",
+			annotation: "10.1.0.1",
+			want: map[string]string{
+				"1.2.3.4:0":   "10.0.0.5",
+				"1.2.3.5:0":   "10.1.0.1",
+				"127.0.0.2:0": "127.0.0.1 lo",
+			},
+		},
+		{
+			desc:       "Changed node annotation",
+			annotation: "10.1.0.2",
+			want: map[string]string{
+				"1.2.3.4:0":   "10.0.0.5",
+				"1.2.3.5:0":   "10.1.0.2",
+				"127.0.0.2:0": "127.0.0.1 lo",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		node := &v1.Node{}
+		if test.annotation != "" {
+			node.Annotations = map[string]string{"example.com/routing-ip": test.annotation}
+		}
+		if c.SetNode(l, node) == k8s.SyncStateError {
+			t.Errorf("%q: SetNode failed", test.desc)
+		}
+		got := map[string]string{}
+		for addr, p := range b.params {
+			got[addr] = strings.TrimSpace(p.SrcAddr.String() + " " + p.SrcInterface)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: unexpected source addresses (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestPeerAddress(t *testing.T) {
+	routes := filepath.Join(t.TempDir(), "route")
+	err := ioutil.WriteFile(routes, []byte(`Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0100000A	0003	0	0	0	00000000	0	0	0
+eth0	0000000A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth1	00000000	01C8A8C0	0003	0	0	100	00000000	0	0	0
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { procNetRoute = old }(procNetRoute)
+	procNetRoute = routes
+
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				AddrAnnotation: "example.com/tor",
+				NodeSelectors:  []labels.Selector{labels.Everything()},
+			},
+			{
+				AddrGatewayInterface: "eth1",
+				NodeSelectors:        []labels.Selector{labels.Everything()},
+			},
+			{
+				AddrRange:     ipnet("10.2.0.0/24"),
+				SrcAddr:       net.ParseIP("10.2.0.100"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	// Dynamic neighbors listen on the source address.
+	if p := b.params["10.2.0.100:0"]; p.PeerRange.String() != "10.2.0.0/24" {
+		t.Errorf("dynamic neighbor session has peer range %s, want 10.2.0.0/24", p.PeerRange)
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		want       []string
+	}{
+		{
+			desc: "No annotation",
+			want: []string{"10.2.0.100:0", "192.168.200.1:0"},
+		},
+		{
+			desc:       "Node annotation",
+			annotation: "10.1.0.1",
+			want:       []string{"10.1.0.1:0", "10.2.0.100:0", "192.168.200.1:0"},
+		},
+		{
+			desc:       "Changed node annotation",
+			annotation: "10.1.0.2",
+			want:       []string{"10.1.0.2:0", "10.2.0.100:0", "192.168.200.1:0"},
+		},
+		{
+			desc: "Removed node annotation",
+			want: []string{"10.2.0.100:0", "192.168.200.1:0"},
+		},
+	}
+
+	for _, test := range tests {
+		node := &v1.Node{}
+		if test.annotation != "" {
+			node.Annotations = map[string]string{"example.com/tor": test.annotation}
+		}
+		if c.SetNode(l, node) == k8s.SyncStateError {
+			t.Errorf("%q: SetNode failed", test.desc)
+		}
+		var got []string
+		for addr := range b.Ads() {
+			got = append(got, addr)
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%q: unexpected sessions (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24"), ipnet("2001:db8::/64")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength:   32,
+						AggregationLengthV6: 128,
+						Communities:         map[uint32]bool{0x04D20001: true},
+					},
+					{
+						AggregationLength:   24,
+						AggregationLengthV6: 64,
+						Communities:         map[uint32]bool{0x04D20002: true},
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	for name, ip := range map[string]string{"test1": "10.20.30.1", "test2": "10.20.30.2", "test3": "2001:db8::1"} {
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned(ip),
+		}
+		if c.SetBalancer(l, name, svc, eps) == k8s.SyncStateError {
+			t.Fatalf("SetBalancer %q failed", name)
+		}
+	}
+
+	want := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix:      ipnet("10.20.30.1/32"),
+				Communities: []uint32{0x04D20001},
+			},
+			{
+				Prefix:      ipnet("10.20.30.2/32"),
+				Communities: []uint32{0x04D20001},
+			},
+			{
+				Prefix:      ipnet("10.20.30.0/24"),
+				Communities: []uint32{0x04D20002},
+			},
+			{
+				Prefix:      ipnet("10.20.30.0/24"),
+				Communities: []uint32{0x04D20002},
+			},
+			{
+				Prefix:      ipnet("2001:db8::1/128"),
+				Communities: []uint32{0x04D20001},
+			},
+			{
+				Prefix:      ipnet("2001:db8::/64"),
+				Communities: []uint32{0x04D20002},
+			},
+		},
+	}
+	gotAds := b.Ads()
+	sortAds(want)
+	sortAds(gotAds)
+	if diff := cmp.Diff(want, gotAds); diff != "" {
+		t.Errorf("unexpected advertisement state (-want +got)\n%s", diff)
+	}
+
+	// The aggregate stays as long as one service in it remains.
+	if c.SetBalancer(l, "test1", nil, k8s.EpsOrSlices{}) == k8s.SyncStateError {
+		t.Fatalf("SetBalancer test1 failed")
+	}
+	want = map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix:      ipnet("10.20.30.2/32"),
+				Communities: []uint32{0x04D20001},
+			},
+			{
+				Prefix:      ipnet("10.20.30.0/24"),
+				Communities: []uint32{0x04D20002},
+			},
+			{
+				Prefix:      ipnet("2001:db8::1/128"),
+				Communities: []uint32{0x04D20001},
+			},
+			{
+				Prefix:      ipnet("2001:db8::/64"),
+				Communities: []uint32{0x04D20002},
+			},
+		},
+	}
+	gotAds = b.Ads()
+	sortAds(want)
+	sortAds(gotAds)
+	if diff := cmp.Diff(want, gotAds); diff != "" {
+		t.Errorf("unexpected advertisement state after deletion (-want +got)\n%s", diff)
+	}
+}
+
+func TestMaxAnnouncingNodes(t *testing.T) {
+	l := log.NewNopLogger()
+	nodes := []string{"iris", "pandora", "hera", "zeus"}
+	sl := &fakeSpeakerList{speakers: map[string]bool{}}
+	for _, n := range nodes {
+		sl.speakers[n] = true
+	}
+
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+					{
+						AggregationLength:  24,
+						MaxAnnouncingNodes: 1,
+					},
+				},
+			},
+		},
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		// Number of nodes announcing the /32 and the /24.
+		wantHost, wantAggregate int
+	}{
+		{
+			desc:          "No service limit",
+			wantHost:      4,
+			wantAggregate: 1,
+		},
+		{
+			desc:          "Service limited to 2 nodes",
+			annotation:    "2",
+			wantHost:      2,
+			wantAggregate: 1,
+		},
+		{
+			desc:          "Invalid annotation",
+			annotation:    "zero",
+			wantHost:      4,
+			wantAggregate: 1,
+		},
+	}
+
+	for _, test := range tests {
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned("10.20.30.1"),
+		}
+		if test.annotation != "" {
+			svc.Annotations = map[string]string{maxAnnouncingNodesAnnotation: test.annotation}
+		}
+
+		gotHost, gotAggregate := 0, 0
+		for _, n := range nodes {
+			b := &fakeBGP{
+				t:      t,
+				gotAds: map[string][]*bgp.Advertisement{},
+			}
+			newBGP = b.New
+			c, err := newController(controllerConfig{
+				MyNode:        n,
+				SList:         sl,
+				DisableLayer2: true,
+			})
+			if err != nil {
+				t.Fatalf("creating controller: %s", err)
+			}
+			c.client = &testK8S{t: t}
+			if c.SetConfig(l, cfg) == k8s.SyncStateError {
+				t.Fatalf("SetConfig failed")
+			}
+			if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+				t.Fatalf("%q: SetBalancer failed", test.desc)
+			}
+			for _, ad := range b.Ads()["1.2.3.4:0"] {
+				if ones, _ := ad.Prefix.Mask.Size(); ones == 32 {
+					gotHost++
+				} else {
+					gotAggregate++
+				}
+			}
+		}
+		if gotHost != test.wantHost {
+			t.Errorf("%q: got %d nodes announcing the host route, want %d", test.desc, gotHost, test.wantHost)
+		}
+		if gotAggregate != test.wantAggregate {
+			t.Errorf("%q: got %d nodes announcing the aggregate, want %d", test.desc, gotAggregate, test.wantAggregate)
+		}
+	}
+}
+
+func TestLinkBandwidth(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						LinkBandwidth:     1000,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("pandora"),
+						},
+						{
+							IP:       "2.3.4.6",
+							NodeName: strptr("pandora"),
+						},
+						{
+							IP:       "2.3.4.7",
+							NodeName: strptr("iris"),
+						},
+					},
+					NotReadyAddresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.8",
+							NodeName: strptr("pandora"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	tests := []struct {
+		desc   string
+		policy v1.ServiceExternalTrafficPolicyType
+		want   float32
+	}{
+		{
+			desc:   "Local policy, weighted by ready local endpoints",
+			policy: v1.ServiceExternalTrafficPolicyTypeLocal,
+			want:   2000,
+		},
+		{
+			desc:   "Cluster policy, no link bandwidth",
+			policy: v1.ServiceExternalTrafficPolicyTypeCluster,
+			want:   0,
+		},
+	}
+
+	for _, test := range tests {
+		svc := &v1.Service{
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: test.policy,
+			},
+			Status: statusAssigned("10.20.30.1"),
+		}
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%q: SetBalancer failed", test.desc)
+		}
+		want := map[string][]*bgp.Advertisement{
+			"1.2.3.4:0": {
+				{
+					Prefix:        ipnet("10.20.30.1/32"),
+					LinkBandwidth: test.want,
+				},
+			},
+		}
+		if diff := cmp.Diff(want, b.Ads()); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestNodePriority(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		wantState  k8s.SyncState
+		wantMED    uint32
+	}{
+		{
+			desc:      "No priority",
+			wantState: k8s.SyncStateSuccess,
+			wantMED:   0,
+		},
+		{
+			desc:       "Priority set",
+			annotation: "100",
+			wantState:  k8s.SyncStateReprocessAll,
+			wantMED:    100,
+		},
+		{
+			desc:       "Priority unchanged",
+			annotation: "100",
+			wantState:  k8s.SyncStateSuccess,
+			wantMED:    100,
+		},
+		{
+			desc:       "Invalid priority",
+			annotation: "-1",
+			wantState:  k8s.SyncStateReprocessAll,
+			wantMED:    0,
+		},
+	}
+
+	for _, test := range tests {
+		node := &v1.Node{}
+		if test.annotation != "" {
+			node.Annotations = map[string]string{priorityAnnotation: test.annotation}
+		}
+		if st := c.SetNode(l, node); st != test.wantState {
+			t.Errorf("%q: SetNode returned %v, want %v", test.desc, st, test.wantState)
+		}
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%q: SetBalancer failed", test.desc)
+		}
+		want := map[string][]*bgp.Advertisement{
+			"1.2.3.4:0": {
+				{
+					Prefix: ipnet("10.20.30.1/32"),
+					MED:    test.wantMED,
+				},
+			},
+		}
+		if diff := cmp.Diff(want, b.Ads()); diff != "" {
+			t.Errorf("%q: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestSpeakerStatus(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	k := &testK8S{t: t}
+	c.client = k
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	if c.SetNode(l, &v1.Node{}) == k8s.SyncStateError {
+		t.Fatalf("SetNode failed")
+	}
+
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	announced := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	local := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Local",
+		},
+		Status: statusAssigned("10.20.30.2"),
+	}
+	if c.SetBalancer(l, "default/announced", announced, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if c.SetBalancer(l, "default/local", local, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+
+	c.PublishStatus(l)
+	want := []k8s.SpeakerServiceStatus{
+		{
+			Service:   "default/announced",
+			IP:        "10.20.30.1",
+			Protocol:  "bgp",
+			Announced: true,
+			Via:       []string{"1.2.3.4"},
+		},
+		{
+			Service: "default/local",
+			Reason:  "noLocalEndpoints",
+		},
+	}
+	if diff := cmp.Diff(want, k.speakerStatus); diff != "" {
+		t.Errorf("wrong speaker status (-want +got)\n%s", diff)
+	}
+
+	// Nothing changed, nothing to publish.
+	k.speakerStatus = nil
+	if c.SetBalancer(l, "default/announced", announced, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	c.PublishStatus(l)
+	if k.speakerStatus != nil {
+		t.Errorf("published an unchanged speaker status")
+	}
+
+	if c.SetBalancer(l, "default/local", nil, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	c.PublishStatus(l)
+	if diff := cmp.Diff(want[:1], k.speakerStatus); diff != "" {
+		t.Errorf("wrong speaker status after deletion (-want +got)\n%s", diff)
+	}
+}
+
+func TestSpeakerStatusName(t *testing.T) {
+	tests := []struct {
+		node, class, want string
+	}{
+		{"iris", "", "iris"},
+		{"iris", "example.com/Internal", "iris.example.com-internal"},
+	}
+	for _, test := range tests {
+		if got := speakerStatusName(test.node, test.class); got != test.want {
+			t.Errorf("speakerStatusName(%q, %q) = %q, want %q", test.node, test.class, got, test.want)
+		}
+	}
+}
+
+func TestLinkUpReconnects(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	c.LinkUp(l, "eth0")
+	if diff := cmp.Diff(map[string]int{"1.2.3.4:0": 1}, b.reconnects); diff != "" {
+		t.Errorf("unexpected reconnections (-want +got)\n%s", diff)
+	}
+
+	c.AddrsChanged(l)
+	if diff := cmp.Diff(map[string]int{"1.2.3.4:0": 1}, b.addrChecks); diff != "" {
+		t.Errorf("unexpected address change notifications (-want +got)\n%s", diff)
+	}
+}
+
+func TestExtraPrefixes(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						LocalPref:         100,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	healthy := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	unhealthy := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					NotReadyAddresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		// The extra prefixes the controller reserved.
+		reserved string
+		eps      k8s.EpsOrSlices
+		want     map[string][]*bgp.Advertisement
+	}{
+		{
+			desc:       "extra prefixes advertised with the service",
+			annotation: "10.20.30.16/28, 10.20.30.128/30",
+			reserved:   "10.20.30.16/28,10.20.30.128/30",
+			eps:        healthy,
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 100,
+					},
+					{
+						Prefix:    ipnet("10.20.30.16/28"),
+						LocalPref: 100,
+					},
+					{
+						Prefix:    ipnet("10.20.30.128/30"),
+						LocalPref: 100,
+					},
+				},
+			},
+		},
+		{
+			desc:       "extra prefixes withdrawn without ready endpoints",
+			annotation: "10.20.30.16/28, 10.20.30.128/30",
+			reserved:   "10.20.30.16/28,10.20.30.128/30",
+			eps:        unhealthy,
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": nil,
+			},
+		},
+		{
+			desc:       "extra prefixes not reserved by the controller",
+			annotation: "10.20.30.16/28",
+			eps:        healthy,
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 100,
+					},
+				},
+			},
+		},
+		{
+			desc:       "extra prefix outside the pool",
+			annotation: "10.20.30.16/28,10.20.0.0/16",
+			reserved:   "10.20.30.16/28,10.20.0.0/16",
+			eps:        healthy,
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 100,
+					},
+				},
+			},
+		},
+		{
+			desc:       "invalid extra prefix",
+			annotation: "SIP media",
+			reserved:   "SIP media",
+			eps:        healthy,
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 100,
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					extraPrefixesAnnotation: test.annotation,
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned("10.20.30.1"),
+		}
+		if test.reserved != "" {
+			svc.Status.Conditions = []metav1.Condition{{
+				Type:    k8s.ExtraPrefixesCondition,
+				Status:  metav1.ConditionTrue,
+				Reason:  "Reserved",
+				Message: test.reserved,
+			}}
+		}
+		if c.SetBalancer(l, "test1", svc, test.eps) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		gotAds := b.Ads()
+		sortAds(test.want)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.want, gotAds); diff != "" {
+			t.Errorf("%s: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestLocalPrefOverride(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						LocalPref:         100,
+					},
+					{
+						AggregationLength: 24,
+						LocalPref:         50,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	tests := []struct {
+		desc       string
+		annotation string
+		want       map[string][]*bgp.Advertisement
+	}{
+		{
+			desc: "pool local preference",
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 100,
+					},
+					{
+						Prefix:    ipnet("10.20.30.0/24"),
+						LocalPref: 50,
+					},
+				},
+			},
+		},
+		{
+			desc:       "service overrides local preference",
+			annotation: "200",
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 200,
+					},
+					{
+						Prefix:    ipnet("10.20.30.0/24"),
+						LocalPref: 200,
+					},
+				},
+			},
+		},
+		{
+			desc:       "invalid local preference",
+			annotation: "primary",
+			want: map[string][]*bgp.Advertisement{
+				"1.2.3.4:0": {
+					{
+						Prefix:    ipnet("10.20.30.1/32"),
+						LocalPref: 100,
+					},
+					{
+						Prefix:    ipnet("10.20.30.0/24"),
+						LocalPref: 50,
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					localPrefAnnotation: test.annotation,
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned("10.20.30.1"),
+		}
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		gotAds := b.Ads()
+		sortAds(test.want)
+		sortAds(gotAds)
+		if diff := cmp.Diff(test.want, gotAds); diff != "" {
+			t.Errorf("%s: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestAdOverrides(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						Communities:       map[uint32]bool{1234: true},
+					},
+				},
+				AllowServiceOverrides: true,
+			},
+			"strict": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.40.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+						Communities:       map[uint32]bool{1234: true},
+					},
+				},
+			},
+			"v6": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("2001:db8::/64")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLengthV6: 128,
+						Communities:         map[uint32]bool{1234: true},
+					},
+				},
+			},
+		},
+		BGPCommunities: map[string]uint32{"no-export": 0xffffff01},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	tests := []struct {
+		desc         string
+		ip           string
+		aggregation  string
+		communities  string
+		prefixLength string
+		// The address block the controller reserved.
+		block string
+		want  *bgp.Advertisement
+	}{
+		{
+			desc: "pool attributes",
+			ip:   "10.20.30.1",
+			want: &bgp.Advertisement{Prefix: ipnet("10.20.30.1/32"), Communities: []uint32{1234}},
+		},
+		{
+			desc:        "service overrides",
+			ip:          "10.20.30.1",
+			aggregation: "28",
+			communities: "no-export, 64512:1",
+			want:        &bgp.Advertisement{Prefix: ipnet("10.20.30.0/28"), Communities: []uint32{0xfc000001, 0xffffff01}},
+		},
+		{
+			desc:        "aggregation beyond the pool",
+			ip:          "10.20.30.1",
+			aggregation: "16",
+			communities: "no-export",
+			want:        &bgp.Advertisement{Prefix: ipnet("10.20.30.1/32"), Communities: []uint32{1234}},
+		},
+		{
+			desc:        "invalid community",
+			ip:          "10.20.30.1",
+			communities: "everywhere",
+			want:        &bgp.Advertisement{Prefix: ipnet("10.20.30.1/32"), Communities: []uint32{1234}},
+		},
+		{
+			desc:        "pool without overrides",
+			ip:          "10.20.40.1",
+			aggregation: "28",
+			want:        &bgp.Advertisement{Prefix: ipnet("10.20.40.1/32"), Communities: []uint32{1234}},
+		},
+		{
+			desc:         "allocated prefix",
+			ip:           "10.20.40.2",
+			prefixLength: "31",
+			block:        "10.20.40.2/31",
+			want:         &bgp.Advertisement{Prefix: ipnet("10.20.40.2/31"), Communities: []uint32{1234}},
+		},
+		{
+			desc:         "allocated IPv6 prefix",
+			ip:           "2001:db8::10",
+			prefixLength: "124",
+			block:        "2001:db8::10/124",
+			want:         &bgp.Advertisement{Prefix: ipnet("2001:db8::10/124"), Communities: []uint32{1234}},
+		},
+		{
+			desc:         "prefix not reserved by the controller",
+			ip:           "10.20.40.2",
+			prefixLength: "24",
+			want:         &bgp.Advertisement{Prefix: ipnet("10.20.40.2/32"), Communities: []uint32{1234}},
+		},
+		{
+			desc:         "allocated prefix beyond the pool",
+			ip:           "10.20.40.2",
+			prefixLength: "16",
+			block:        "10.20.0.0/16",
+			want:         &bgp.Advertisement{Prefix: ipnet("10.20.40.2/32"), Communities: []uint32{1234}},
+		},
+		{
+			desc:         "allocated prefix without the IP",
+			ip:           "10.20.40.2",
+			prefixLength: "31",
+			block:        "10.20.40.4/31",
+			want:         &bgp.Advertisement{Prefix: ipnet("10.20.40.2/32"), Communities: []uint32{1234}},
+		},
+	}
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					aggregationLengthAnnotation:                 test.aggregation,
+					communitiesAnnotation:                       test.communities,
+					"metallb.universe.tf/address-prefix-length": test.prefixLength,
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type:                  "LoadBalancer",
+				ExternalTrafficPolicy: "Cluster",
+			},
+			Status: statusAssigned(test.ip),
+		}
+		if test.block != "" {
+			svc.Status.Conditions = []metav1.Condition{{
+				Type:    k8s.AddressBlockCondition,
+				Status:  metav1.ConditionTrue,
+				Reason:  "Reserved",
+				Message: test.block,
+			}}
+		}
+		if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+			t.Fatalf("%s: SetBalancer failed", test.desc)
+		}
+		want := map[string][]*bgp.Advertisement{"1.2.3.4:0": {test.want}}
+		if diff := cmp.Diff(want, b.Ads()); diff != "" {
+			t.Errorf("%s: unexpected advertisement state (-want +got)\n%s", test.desc, diff)
+		}
+	}
+}
+
+func TestPeerHost(t *testing.T) {
+	tests := []struct {
+		desc string
+		peer *config.Peer
+		addr string
+		want string
+	}{
+		{
+			desc: "IPv4",
+			peer: &config.Peer{SrcInterface: "eno1"},
+			addr: "1.2.3.4",
+			want: "1.2.3.4",
+		},
+		{
+			desc: "global IPv6",
+			peer: &config.Peer{SrcInterface: "eno1"},
+			addr: "2001:db8::1",
+			want: "2001:db8::1",
+		},
+		{
+			desc: "link-local with zone",
+			peer: &config.Peer{AddrZone: "eno1", SrcInterface: "eno2"},
+			addr: "fe80::1",
+			want: "fe80::1%eno1",
+		},
+		{
+			desc: "link-local gateway",
+			peer: &config.Peer{AddrGatewayInterface: "eno1"},
+			addr: "fe80::1",
+			want: "fe80::1%eno1",
+		},
+		{
+			desc: "link-local from source interface",
+			peer: &config.Peer{SrcInterface: "eno2"},
+			addr: "fe80::1",
+			want: "fe80::1%eno2",
+		},
+	}
+	for _, test := range tests {
+		if got := peerHost(test.peer, net.ParseIP(test.addr)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestAdvertisesToInstances(t *testing.T) {
+	peerA := &peer{cfg: &config.Peer{Instance: "fabric-a", VRF: "red"}, addr: net.ParseIP("169.254.0.1")}
+	peerB := &peer{cfg: &config.Peer{Instance: "fabric-b", SrcInterface: "eno2"}, addr: net.ParseIP("169.254.0.1")}
+	peerC := &peer{cfg: &config.Peer{}, addr: net.ParseIP("1.2.3.4")}
+
+	tests := []struct {
+		desc string
+		ad   *advertisement
+		want []bool
+	}{
+		{
+			desc: "all peers",
+			ad:   &advertisement{},
+			want: []bool{true, true, true},
+		},
+		{
+			desc: "one instance",
+			ad:   &advertisement{instances: []string{"fabric-a"}},
+			want: []bool{true, false, false},
+		},
+		{
+			desc: "one address",
+			ad:   &advertisement{peers: []net.IP{net.ParseIP("169.254.0.1")}},
+			want: []bool{true, true, false},
+		},
+		{
+			desc: "one address of one instance",
+			ad:   &advertisement{peers: []net.IP{net.ParseIP("169.254.0.1")}, instances: []string{"fabric-b"}},
+			want: []bool{false, true, false},
+		},
+	}
+	for _, test := range tests {
+		var got []bool
+		for _, p := range []*peer{peerA, peerB, peerC} {
+			got = append(got, test.ad.advertisesTo(p))
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: unexpected peers (-want +got)\n%s", test.desc, diff)
+		}
+	}
+
+	// Sessions are bound to their VRF, unless they have a source
+	// interface, which is in the VRF.
+	if got := bindInterface(peerA.cfg); got != "red" {
+		t.Errorf("session bound to %q, want the VRF red", got)
+	}
+	if got := bindInterface(peerB.cfg); got != "eno2" {
+		t.Errorf("session bound to %q, want the source interface eno2", got)
+	}
+}
+
+func TestHealthyEndpointsTerminating(t *testing.T) {
+	endpoint := func(addr, node string, ready, serving, terminating bool) discovery.Endpoint {
+		return discovery.Endpoint{
+			Addresses: []string{addr},
+			Topology: map[string]string{
+				"kubernetes.io/hostname": node,
+			},
+			Conditions: discovery.EndpointConditions{
+				Ready:       boolPtr(ready),
+				Serving:     boolPtr(serving),
+				Terminating: boolPtr(terminating),
+			},
+		}
+	}
+	filterNode := func(toFilter *string) bool {
+		return toFilter == nil || *toFilter != "pandora"
+	}
+
+	tests := []struct {
+		desc      string
+		endpoints []discovery.Endpoint
+		want      int
+	}{
+		{
+			desc: "ready endpoints only",
+			endpoints: []discovery.Endpoint{
+				endpoint("2.3.4.5", "pandora", true, true, false),
+				endpoint("2.3.4.6", "pandora", false, true, true),
+			},
+			want: 1,
+		},
+		{
+			desc: "terminating but serving",
+			endpoints: []discovery.Endpoint{
+				endpoint("2.3.4.5", "pandora", false, true, true),
+				endpoint("2.3.4.6", "pandora", false, true, true),
+				endpoint("2.3.4.7", "iris", true, true, false),
+			},
+			want: 2,
+		},
+		{
+			desc: "terminating and not serving",
+			endpoints: []discovery.Endpoint{
+				endpoint("2.3.4.5", "pandora", false, false, true),
+			},
+			want: 0,
+		},
+		{
+			desc: "not ready, not terminating",
+			endpoints: []discovery.Endpoint{
+				endpoint("2.3.4.5", "pandora", false, true, false),
+			},
+			want: 0,
+		},
+		{
+			desc: "terminating elsewhere",
+			endpoints: []discovery.Endpoint{
+				endpoint("2.3.4.5", "iris", false, true, true),
+			},
+			want: 0,
+		},
+	}
+
+	for _, test := range tests {
+		eps := k8s.EpsOrSlices{
+			SlicesVal: []*discovery.EndpointSlice{{Endpoints: test.endpoints}},
+			Type:      k8s.Slices,
+		}
+		if got := healthyEndpoints(eps, filterNode); got != test.want {
+			t.Errorf("%s: got %d healthy endpoints, want %d", test.desc, got, test.want)
+		}
+	}
+}
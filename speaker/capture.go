@@ -0,0 +1,135 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/capture"
+)
+
+const (
+	maxCaptureDuration = 5 * time.Minute
+	maxCapturePackets  = 100000
+)
+
+// captureHandler serves packet captures of the ARP, NDP and BGP
+// traffic of a VIP or a BGP peer, on the interface of the node given
+// by the interface parameter, for the duration parameter or until
+// packets packets were captured. Only one capture runs at a time.
+type captureHandler struct {
+	l      log.Logger
+	myNode string
+	// Holds a token while a capture runs.
+	running chan struct{}
+}
+
+// serveCaptures serves the packet captures on addr, which must be a
+// loopback address: captures show the traffic of the node, so only
+// those who can exec or port-forward into the speaker's pod may get
+// them.
+func serveCaptures(l log.Logger, addr, myNode string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%q is not a loopback address", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/capture", newCaptureHandler(l, myNode))
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			level.Error(l).Log("op", "capture", "error", err, "msg", "stopped serving packet captures")
+		}
+	}()
+	return nil
+}
+
+func newCaptureHandler(l log.Logger, myNode string) *captureHandler {
+	return &captureHandler{
+		l:       l,
+		myNode:  myNode,
+		running: make(chan struct{}, 1),
+	}
+}
+
+func (h *captureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ip := net.ParseIP(q.Get("ip"))
+	if ip == nil {
+		http.Error(w, fmt.Sprintf("invalid ip %q, must be the VIP or the BGP peer address to capture the traffic of", q.Get("ip")), http.StatusBadRequest)
+		return
+	}
+	ifi, err := net.InterfaceByName(q.Get("interface"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid interface %q: %s", q.Get("interface"), err), http.StatusBadRequest)
+		return
+	}
+	duration := 30 * time.Second
+	if v := q.Get("duration"); v != "" {
+		if duration, err = time.ParseDuration(v); err != nil || duration <= 0 || duration > maxCaptureDuration {
+			http.Error(w, fmt.Sprintf("invalid duration %q, must be positive and at most %s", v, maxCaptureDuration), http.StatusBadRequest)
+			return
+		}
+	}
+	packets := 1000
+	if v := q.Get("packets"); v != "" {
+		if packets, err = strconv.Atoi(v); err != nil || packets <= 0 || packets > maxCapturePackets {
+			http.Error(w, fmt.Sprintf("invalid packets %q, must be positive and at most %d", v, maxCapturePackets), http.StatusBadRequest)
+			return
+		}
+	}
+
+	select {
+	case h.running <- struct{}{}:
+		defer func() { <-h.running }()
+	default:
+		http.Error(w, "a capture is already running", http.StatusConflict)
+		return
+	}
+
+	l := log.With(h.l, "op", "capture", "interface", ifi.Name, "ip", ip)
+	conn, err := capture.Listen(ifi)
+	if err != nil {
+		level.Error(l).Log("error", err, "msg", "failed to start packet capture")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	level.Info(l).Log("duration", duration, "packets", packets, "msg", "starting packet capture")
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("metallb-%s-%s.pcap", h.myNode, ip)))
+	ctx, cancel := context.WithTimeout(r.Context(), duration)
+	defer cancel()
+	n, err := conn.Capture(ctx, ip, packets, w)
+	if err != nil {
+		// The capture is sent as it goes, so it is just cut short.
+		level.Error(l).Log("error", err, "captured", n, "msg", "packet capture failed")
+		return
+	}
+	level.Info(l).Log("captured", n, "msg", "packet capture done")
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestServeCapturesLoopbackOnly(t *testing.T) {
+	for _, addr := range []string{":7475", "0.0.0.0:7475", "192.168.1.1:7475", "localhost"} {
+		if err := serveCaptures(log.NewNopLogger(), addr, "node1"); err == nil {
+			t.Errorf("serving captures on %q", addr)
+		}
+	}
+	if err := serveCaptures(log.NewNopLogger(), "127.0.0.1:0", "node1"); err != nil {
+		t.Errorf("serving captures on a loopback address: %s", err)
+	}
+}
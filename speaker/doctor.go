@@ -0,0 +1,331 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+
+	"gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Severities of the findings of the diagnostics.
+const (
+	findingOK      = "OK"
+	findingWarning = "WARNING"
+	findingError   = "ERROR"
+)
+
+// A finding is the outcome of a diagnostics check, and how to fix it.
+type finding struct {
+	severity string
+	check    string
+	msg      string
+	fix      string
+}
+
+// doctorInput is the state of the cluster and of the node that the
+// diagnostics check.
+type doctorInput struct {
+	config *config.Config
+	// The node the diagnostics run on. Nil if it couldn't be read.
+	node *v1.Node
+	// The addresses of the node's interfaces, by interface name.
+	addrs map[string][]*net.IPNet
+	// Whether the speaker can answer ARP and NDP, either itself with
+	// CAP_NET_RAW, or through a layer2 responder helper.
+	netRaw bool
+	// kube-proxy's configuration file, or why it couldn't be read.
+	kubeProxy    string
+	kubeProxyErr error
+	// Memberlist addresses of the speakers, if memberlist is enabled.
+	speakers []string
+	// dial opens and closes a TCP connection to addr.
+	dial func(addr string) error
+}
+
+// diagnose checks in for common misconfigurations.
+func diagnose(in doctorInput) []finding {
+	layer2 := false
+	for _, p := range in.config.Pools {
+		layer2 = layer2 || p.Protocol == config.Layer2
+	}
+	var ret []finding
+	if layer2 {
+		ret = append(ret, checkNetRaw(in), checkStrictARP(in))
+	}
+	ret = append(ret, checkPoolAddresses(in)...)
+	ret = append(ret, checkPeers(in)...)
+	ret = append(ret, checkMemberlist(in)...)
+	return ret
+}
+
+func checkNetRaw(in doctorInput) finding {
+	if !in.netRaw {
+		return finding{findingError, "capabilities", "the speaker lacks CAP_NET_RAW, so it can't answer ARP and NDP requests for layer2 pools",
+			"add NET_RAW to the capabilities of the speaker container, or run the layer2 responder helper (--layer2-responder)"}
+	}
+	return finding{findingOK, "capabilities", "the speaker can answer ARP and NDP requests", ""}
+}
+
+func checkStrictARP(in doctorInput) finding {
+	if in.kubeProxyErr != nil {
+		return finding{findingWarning, "strictARP", fmt.Sprintf("couldn't read the kube-proxy configuration: %s", in.kubeProxyErr),
+			"if kube-proxy runs in IPVS mode, check that ipvs.strictARP is true in its configuration"}
+	}
+	var kp struct {
+		Mode string `yaml:"mode"`
+		IPVS struct {
+			StrictARP bool `yaml:"strictARP"`
+		} `yaml:"ipvs"`
+	}
+	if err := yaml.Unmarshal([]byte(in.kubeProxy), &kp); err != nil {
+		return finding{findingWarning, "strictARP", fmt.Sprintf("couldn't parse the kube-proxy configuration: %s", err),
+			"if kube-proxy runs in IPVS mode, check that ipvs.strictARP is true in its configuration"}
+	}
+	if kp.Mode == "ipvs" && !kp.IPVS.StrictARP {
+		return finding{findingError, "strictARP", "kube-proxy runs in IPVS mode without strictARP, so every node answers ARP requests for layer2 services",
+			"set ipvs.strictARP to true in the kube-system/kube-proxy ConfigMap, and restart kube-proxy"}
+	}
+	return finding{findingOK, "strictARP", "kube-proxy doesn't answer ARP requests for services", ""}
+}
+
+// checkPoolAddresses checks that no pool hands out the node's own
+// addresses, and that layer2 pools are on a subnet of the node.
+func checkPoolAddresses(in doctorInput) []finding {
+	names := make([]string, 0, len(in.config.Pools))
+	for name := range in.config.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ret []finding
+	for _, name := range names {
+		p := in.config.Pools[name]
+		for _, cidr := range p.CIDR {
+			onSubnet := false
+			for intf, addrs := range in.addrs {
+				for _, addr := range addrs {
+					if cidr.Contains(addr.IP) {
+						ret = append(ret, finding{findingError, "pools", fmt.Sprintf("pool %q contains %s, the address of %s on this node", name, addr.IP, intf),
+							fmt.Sprintf("remove %s from the addresses of pool %q", addr.IP, name)})
+					}
+					if addr.Contains(cidr.IP) {
+						onSubnet = true
+					}
+				}
+			}
+			if p.Protocol == config.Layer2 && !onSubnet {
+				ret = append(ret, finding{findingWarning, "pools", fmt.Sprintf("layer2 pool %q has addresses in %s, which is not on any subnet of this node, so only routers that route it to the node can reach them", name, cidr),
+					"use addresses from the subnet of the node's interfaces for layer2 pools, or announce this range with BGP"})
+			}
+		}
+	}
+	if len(ret) == 0 {
+		ret = append(ret, finding{findingOK, "pools", "the address pools don't conflict with the node's addresses", ""})
+	}
+	return ret
+}
+
+// checkPeers checks that the BGP peers of the node accept
+// connections.
+func checkPeers(in doctorInput) []finding {
+	var ret []finding
+	for _, p := range in.config.Peers {
+		if !peerSelects(p, in.node) || p.AddrRange != nil {
+			// Dynamic neighbors dial us, there's nothing to check.
+			continue
+		}
+		ip := p.Addr
+		if in.node != nil && p.AddrAnnotation != "" && in.node.Annotations[p.AddrAnnotation] != "" {
+			ip = net.ParseIP(in.node.Annotations[p.AddrAnnotation])
+		} else if p.AddrGatewayInterface != "" {
+			ip, _ = interfaceGateway(p.AddrGatewayInterface)
+		}
+		if ip == nil {
+			ret = append(ret, finding{findingWarning, "peers", fmt.Sprintf("BGP peer %s has no address on this node", p),
+				"check the node annotation or default route that gives the peer's address"})
+			continue
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(p.Port)))
+		err := in.dial(addr)
+		switch {
+		case err == nil:
+			ret = append(ret, finding{findingOK, "peers", fmt.Sprintf("BGP peer %s accepts connections", addr), ""})
+		case p.Password != "":
+			// Peers requiring TCP MD5 drop the connections we open
+			// without it.
+			ret = append(ret, finding{findingWarning, "peers", fmt.Sprintf("BGP peer %s didn't accept a connection without TCP MD5 authentication: %s", addr, err),
+				fmt.Sprintf("check that the peer is configured for this node, and that no firewall blocks TCP port %d", p.Port)})
+		default:
+			ret = append(ret, finding{findingError, "peers", fmt.Sprintf("BGP peer %s is unreachable: %s", addr, err),
+				fmt.Sprintf("check that the peer is configured for this node, and that no firewall blocks TCP port %d", p.Port)})
+		}
+	}
+	return ret
+}
+
+// peerSelects returns true if the peer p sessions with node. All
+// peers do if the node is unknown.
+func peerSelects(p *config.Peer, node *v1.Node) bool {
+	if node == nil {
+		return true
+	}
+	for _, ns := range p.NodeSelectors {
+		if ns.Matches(labels.Set(node.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMemberlist checks that the other speakers can be reached on
+// their memberlist port.
+func checkMemberlist(in doctorInput) []finding {
+	var ret []finding
+	for _, addr := range in.speakers {
+		if err := in.dial(addr); err != nil {
+			_, port, _ := net.SplitHostPort(addr)
+			ret = append(ret, finding{findingError, "memberlist", fmt.Sprintf("speaker %s is unreachable: %s", addr, err),
+				fmt.Sprintf("allow TCP and UDP port %s between the nodes, so that speakers quickly detect node failures", port)})
+		}
+	}
+	if len(ret) == 0 && len(in.speakers) > 0 {
+		ret = append(ret, finding{findingOK, "memberlist", fmt.Sprintf("all %d speakers are reachable", len(in.speakers)), ""})
+	}
+	return ret
+}
+
+// printFindings prints the findings, and returns the number of errors.
+func printFindings(w io.Writer, findings []finding) int {
+	errs := 0
+	for _, f := range findings {
+		fmt.Fprintf(w, "%-8s %s: %s\n", f.severity, f.check, f.msg)
+		if f.fix != "" {
+			fmt.Fprintf(w, "%-8s fix: %s\n", "", f.fix)
+		}
+		if f.severity == findingError {
+			errs++
+		}
+	}
+	return errs
+}
+
+// doctorArgs are the speaker flags the diagnostics need.
+type doctorArgs struct {
+	kubeconfig      string
+	namespace       string
+	configMap       string
+	node            string
+	layer2Responder string
+	mlLabels        string
+	mlPort          string
+}
+
+// runDoctor runs the diagnostics on this node, prints the findings to
+// stdout, and returns the exit status of the speaker: 1 if something
+// is wrong, 0 otherwise.
+func runDoctor(args doctorArgs) int {
+	client, err := k8s.New(&k8s.Config{
+		ProcessName: "metallb-speaker",
+		Kubeconfig:  args.kubeconfig,
+	})
+	if err != nil {
+		fmt.Printf("failed to create k8s client: %s\n", err)
+		return 1
+	}
+	in := doctorInput{
+		addrs:  map[string][]*net.IPNet{},
+		netRaw: args.layer2Responder != "" || hasNetRaw(),
+		dial: func(addr string) error {
+			conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	}
+	if in.config, err = client.Config(args.namespace, args.configMap); err != nil {
+		fmt.Printf("failed to read the configuration in %s/%s: %s\n", args.namespace, args.configMap, err)
+		return 1
+	}
+	if in.node, err = client.Node(args.node); err != nil {
+		fmt.Printf("failed to read node %s, checking all BGP peers: %s\n", args.node, err)
+		in.node = nil
+	}
+	ifs, err := net.Interfaces()
+	if err != nil {
+		fmt.Printf("failed to list the node's interfaces: %s\n", err)
+		return 1
+	}
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				in.addrs[ifi.Name] = append(in.addrs[ifi.Name], ipnet)
+			}
+		}
+	}
+	in.kubeProxy, in.kubeProxyErr = client.KubeProxyConfig()
+	if args.mlLabels != "" {
+		port := args.mlPort
+		if port == "" {
+			port = "7946"
+		}
+		ips, err := client.PodIPs(args.namespace, args.mlLabels)
+		if err != nil {
+			fmt.Printf("failed to list the speakers, not checking memberlist: %s\n", err)
+		}
+		for _, ip := range ips {
+			in.speakers = append(in.speakers, net.JoinHostPort(ip, port))
+		}
+	}
+
+	if printFindings(os.Stdout, diagnose(in)) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// hasNetRaw returns true if the process has CAP_NET_RAW.
+func hasNetRaw() bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if !strings.HasPrefix(s.Text(), "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(s.Text(), "CapEff:")), 16, 64)
+		// CAP_NET_RAW is capability 13.
+		return err == nil && caps&(1<<13) != 0
+	}
+	return false
+}
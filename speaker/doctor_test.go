@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"go.universe.tf/metallb/internal/config"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestDiagnose(t *testing.T) {
+	reachable := map[string]bool{"1.2.3.4:179": true, "10.0.0.2:7946": true}
+	in := doctorInput{
+		config: &config.Config{
+			Pools: map[string]*config.Pool{
+				"l2": {
+					Protocol: config.Layer2,
+					CIDR:     []*net.IPNet{ipnet("10.0.0.0/28")},
+				},
+				"remote": {
+					Protocol: config.Layer2,
+					CIDR:     []*net.IPNet{ipnet("192.168.0.0/24")},
+				},
+			},
+			Peers: []*config.Peer{
+				{
+					Addr:          net.ParseIP("1.2.3.4"),
+					Port:          179,
+					NodeSelectors: []labels.Selector{labels.Everything()},
+				},
+				{
+					Addr:          net.ParseIP("1.2.3.5"),
+					Port:          179,
+					NodeSelectors: []labels.Selector{labels.Everything()},
+				},
+				{
+					Addr:          net.ParseIP("1.2.3.6"),
+					Port:          179,
+					NodeSelectors: []labels.Selector{mustSelector("rack=b")},
+				},
+			},
+		},
+		node: &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{"rack": "a"},
+			},
+		},
+		addrs: map[string][]*net.IPNet{
+			"eth0": {{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}},
+		},
+		kubeProxy: "mode: ipvs\nipvs:\n  strictARP: false\n",
+		speakers:  []string{"10.0.0.2:7946", "10.0.0.3:7946"},
+		dial: func(addr string) error {
+			if !reachable[addr] {
+				return errors.New("connection refused")
+			}
+			return nil
+		},
+	}
+	got := map[string][]string{}
+	for _, f := range diagnose(in) {
+		got[f.check] = append(got[f.check], f.severity+" "+f.msg)
+	}
+	want := map[string][]string{
+		"capabilities": {"ERROR the speaker lacks CAP_NET_RAW, so it can't answer ARP and NDP requests for layer2 pools"},
+		"strictARP":    {"ERROR kube-proxy runs in IPVS mode without strictARP, so every node answers ARP requests for layer2 services"},
+		"pools": {
+			`ERROR pool "l2" contains 10.0.0.1, the address of eth0 on this node`,
+			`WARNING layer2 pool "remote" has addresses in 192.168.0.0/24, which is not on any subnet of this node, so only routers that route it to the node can reach them`,
+		},
+		"peers": {
+			"OK BGP peer 1.2.3.4:179 accepts connections",
+			"ERROR BGP peer 1.2.3.5:179 is unreachable: connection refused",
+		},
+		"memberlist": {"ERROR speaker 10.0.0.3:7946 is unreachable: connection refused"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong findings (-want +got)\n%s", diff)
+	}
+
+	in.netRaw = true
+	in.kubeProxy = "mode: ipvs\nipvs:\n  strictARP: true\n"
+	in.config.Pools = map[string]*config.Pool{
+		"l2": {
+			Protocol: config.Layer2,
+			CIDR:     []*net.IPNet{ipnet("10.0.0.128/28")},
+		},
+	}
+	in.config.Peers = in.config.Peers[:1]
+	in.speakers = in.speakers[:1]
+	var out bytes.Buffer
+	if errs := printFindings(&out, diagnose(in)); errs != 0 {
+		t.Errorf("got %d errors for a healthy setup:\n%s", errs, out.String())
+	}
+	if n := strings.Count(out.String(), "OK "); n != 5 {
+		t.Errorf("got %d passed checks, want 5:\n%s", n, out.String())
+	}
+}
@@ -0,0 +1,97 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// SetGateway announces the address MetalLB allocated to a Gateway API
+// Gateway.
+//
+// A Gateway has no endpoints of its own, its traffic is handled by
+// whatever the Gateway implementation runs on the nodes. So it is
+// announced like a service with the Cluster traffic policy: over BGP
+// from every node, and over layer 2 from one healthy speaker.
+func (c *controller) SetGateway(l log.Logger, name string, gw *k8s.Gateway) k8s.SyncState {
+	key := "gateway:" + name
+	if gw == nil || len(gw.SpecAddresses) > 0 || len(gw.Addresses) != 1 {
+		return c.deleteBalancer(l, key, "noIPAllocated")
+	}
+	return c.setNodeBalancer(l, key, metav1.ObjectMeta{Namespace: gw.Namespace, Name: gw.Name, Annotations: gw.Annotations}, gw.Addresses[0])
+}
+
+// setNodeBalancer announces ip, the address MetalLB allocated to key,
+// an object whose traffic is handled on the nodes, like a service
+// with the Cluster traffic policy.
+func (c *controller) setNodeBalancer(l log.Logger, key string, meta metav1.ObjectMeta, ip string) k8s.SyncState {
+	if c.config == nil {
+		level.Debug(l).Log("event", "noConfig", "msg", "not processing, still waiting for config")
+		return k8s.SyncStateSuccess
+	}
+
+	nodes := []string{c.myNode}
+	if parsed := net.ParseIP(ip); parsed != nil {
+		if pool := c.config.Pools[poolFor(c.config.Pools, parsed)]; pool != nil && pool.Protocol == config.Layer2 {
+			if c.sList == nil || c.sList.UsableSpeakers() == nil {
+				level.Error(l).Log("op", "setBalancer", "error", "memberlist disabled", "msg", "layer2 addresses of objects other than services need fast dead node detection to elect an announcing node")
+				return c.deleteBalancer(l, key, "noSpeakerList")
+			}
+			nodes = nil
+			for n, ok := range c.sList.UsableSpeakers() {
+				if ok {
+					nodes = append(nodes, n)
+				}
+			}
+		}
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: meta,
+		Spec: v1.ServiceSpec{
+			Type:                  v1.ServiceTypeLoadBalancer,
+			ExternalTrafficPolicy: v1.ServiceExternalTrafficPolicyTypeCluster,
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{{IP: ip}},
+			},
+		},
+	}
+	eps := &v1.Endpoints{Subsets: []v1.EndpointSubset{{}}}
+	for i := range nodes {
+		eps.Subsets[0].Addresses = append(eps.Subsets[0].Addresses, v1.EndpointAddress{NodeName: &nodes[i]})
+	}
+
+	st, _ := c.setBalancer(l, key, svc, k8s.EpsOrSlices{EpVal: eps, Type: k8s.Eps})
+	return st
+}
+
+// SetIngress announces the address MetalLB allocated to an Ingress of
+// the watched IngressClasses. Like a Gateway, its traffic is handled
+// by the ingress controller running on the nodes.
+func (c *controller) SetIngress(l log.Logger, name string, ing *k8s.Ingress) k8s.SyncState {
+	key := "ingress:" + name
+	if ing == nil || len(ing.Addresses) != 1 {
+		return c.deleteBalancer(l, key, "noIPAllocated")
+	}
+	return c.setNodeBalancer(l, key, metav1.ObjectMeta{Namespace: ing.Namespace, Name: ing.Name, Annotations: ing.Annotations}, ing.Addresses[0])
+}
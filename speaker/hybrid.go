@@ -0,0 +1,125 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// hybrid is the protocol of the services of BGP pools with layer2
+// interfaces, which are announced both ways.
+const hybrid config.Proto = "bgp+layer2"
+
+// hybridController announces services with BGP, and with layer2 on
+// the interfaces of their pool. Each protocol decides on its own
+// whether the node announces the service: BGP from all the nodes with
+// endpoints, layer2 from the node that wins the election.
+//
+// The BGP and layer2 controllers are configured on their own, so the
+// methods that don't concern a service do nothing.
+type hybridController struct {
+	bgp, layer2 Protocol
+	// The reasons not to announce each service with BGP,
+	// respectively layer2, from the last ShouldAnnounce.
+	bgpReason, layer2Reason map[string]string
+}
+
+func newHybridController(bgp, layer2 Protocol) *hybridController {
+	return &hybridController{
+		bgp:          bgp,
+		layer2:       layer2,
+		bgpReason:    map[string]string{},
+		layer2Reason: map[string]string{},
+	}
+}
+
+func (c *hybridController) SetConfig(log.Logger, *config.Config) error { return nil }
+func (c *hybridController) SetNode(log.Logger, *v1.Node) error         { return nil }
+func (c *hybridController) LinkUp(log.Logger, string)                  {}
+func (c *hybridController) AddrsChanged(log.Logger)                    {}
+
+// ShouldAnnounce returns why the service isn't announced with either
+// protocol, BGP's reason if neither announces it.
+func (c *hybridController) ShouldAnnounce(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices) string {
+	c.bgpReason[name] = c.bgp.ShouldAnnounce(l, name, svc, eps)
+	c.layer2Reason[name] = c.layer2.ShouldAnnounce(l, name, svc, eps)
+	if c.bgpReason[name] == "" || c.layer2Reason[name] == "" {
+		return ""
+	}
+	return c.bgpReason[name]
+}
+
+// SetBalancer announces the service with the protocols that should,
+// and withdraws it from the others.
+func (c *hybridController) SetBalancer(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices, lbIP net.IP, pool *config.Pool) error {
+	for _, p := range []struct {
+		proto  config.Proto
+		h      Protocol
+		reason string
+	}{
+		{config.BGP, c.bgp, c.bgpReason[name]},
+		{config.Layer2, c.layer2, c.layer2Reason[name]},
+	} {
+		var err error
+		if p.reason == "" {
+			err = p.h.SetBalancer(log.With(l, "via", p.proto), name, svc, eps, lbIP, pool)
+		} else {
+			err = p.h.DeleteBalancer(log.With(l, "via", p.proto), name, p.reason)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *hybridController) DeleteBalancer(l log.Logger, name, reason string) error {
+	delete(c.bgpReason, name)
+	delete(c.layer2Reason, name)
+	if err := c.bgp.DeleteBalancer(l, name, reason); err != nil {
+		return err
+	}
+	return c.layer2.DeleteBalancer(l, name, reason)
+}
+
+// AnnouncedVia returns the BGP peers, then the interfaces, the
+// service is announced to.
+func (c *hybridController) AnnouncedVia(name string) []string {
+	return append(c.bgp.AnnouncedVia(name), c.layer2.AnnouncedVia(name)...)
+}
+
+// Owners returns the nodes announcing the service with either
+// protocol.
+func (c *hybridController) Owners(name string, svc *v1.Service, eps k8s.EpsOrSlices) []string {
+	bgp, layer2 := c.bgp.Owners(name, svc, eps), c.layer2.Owners(name, svc, eps)
+	if bgp == nil || layer2 == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, n := range append(bgp, layer2...) {
+		if !seen[n] {
+			seen[n] = true
+			ret = append(ret, n)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
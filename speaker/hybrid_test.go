@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// fakeProtocol announces services unless told why not to.
+type fakeProtocol struct {
+	reason    string
+	owners    []string
+	announced map[string]bool
+}
+
+func (p *fakeProtocol) SetConfig(log.Logger, *config.Config) error { return nil }
+func (p *fakeProtocol) SetNode(log.Logger, *v1.Node) error         { return nil }
+func (p *fakeProtocol) LinkUp(log.Logger, string)                  {}
+func (p *fakeProtocol) AddrsChanged(log.Logger)                    {}
+func (p *fakeProtocol) AnnouncedVia(string) []string               { return nil }
+
+func (p *fakeProtocol) ShouldAnnounce(log.Logger, string, *v1.Service, k8s.EpsOrSlices) string {
+	return p.reason
+}
+
+func (p *fakeProtocol) SetBalancer(_ log.Logger, name string, _ *v1.Service, _ k8s.EpsOrSlices, _ net.IP, _ *config.Pool) error {
+	p.announced[name] = true
+	return nil
+}
+
+func (p *fakeProtocol) DeleteBalancer(_ log.Logger, name, _ string) error {
+	delete(p.announced, name)
+	return nil
+}
+
+func (p *fakeProtocol) Owners(string, *v1.Service, k8s.EpsOrSlices) []string {
+	return p.owners
+}
+
+func TestHybridController(t *testing.T) {
+	l := log.NewNopLogger()
+	bgp := &fakeProtocol{owners: []string{"nodeA", "nodeB"}, announced: map[string]bool{}}
+	layer2 := &fakeProtocol{reason: "notOwner", owners: []string{"nodeB"}, announced: map[string]bool{}}
+	c := newHybridController(bgp, layer2)
+	svc, eps, ip := &v1.Service{}, k8s.EpsOrSlices{}, net.ParseIP("10.20.30.1")
+
+	announce := func() string {
+		t.Helper()
+		reason := c.ShouldAnnounce(l, "test1", svc, eps)
+		if reason == "" {
+			if err := c.SetBalancer(l, "test1", svc, eps, ip, &config.Pool{}); err != nil {
+				t.Fatalf("SetBalancer: %s", err)
+			}
+		}
+		return reason
+	}
+
+	// BGP announces on its own.
+	if reason := announce(); reason != "" {
+		t.Fatalf("service not announced: %s", reason)
+	}
+	if !bgp.announced["test1"] || layer2.announced["test1"] {
+		t.Fatalf("got BGP announcement %v and layer2 announcement %v, want only BGP", bgp.announced["test1"], layer2.announced["test1"])
+	}
+
+	// The node wins the layer2 election, and loses its endpoints.
+	bgp.reason, layer2.reason = "noLocalEndpoints", ""
+	if reason := announce(); reason != "" {
+		t.Fatalf("service not announced: %s", reason)
+	}
+	if bgp.announced["test1"] || !layer2.announced["test1"] {
+		t.Fatalf("got BGP announcement %v and layer2 announcement %v, want only layer2", bgp.announced["test1"], layer2.announced["test1"])
+	}
+
+	layer2.reason = "notOwner"
+	if reason := announce(); reason != "noLocalEndpoints" {
+		t.Fatalf("got reason %q, want BGP's", reason)
+	}
+
+	if got, want := c.Owners("test1", svc, eps), []string{"nodeA", "nodeB"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got owners %v, want %v", got, want)
+	}
+	bgp.owners = nil
+	if got := c.Owners("test1", svc, eps); got != nil {
+		t.Errorf("got owners %v, want unknown", got)
+	}
+
+	bgp.announced["test1"], layer2.announced["test1"] = true, true
+	if err := c.DeleteBalancer(l, "test1", "serviceDeleted"); err != nil {
+		t.Fatalf("DeleteBalancer: %s", err)
+	}
+	if bgp.announced["test1"] || layer2.announced["test1"] {
+		t.Error("service still announced after deletion")
+	}
+}
@@ -0,0 +1,100 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// endpointHysteresis debounces the transitions of the local
+// endpoints of services with the Local traffic policy, so that a pod
+// restart doesn't withdraw and re-advertise the service's routes.
+// The node keeps announcing a service for withdrawDelay after its
+// last local endpoint became unready, and waits for advertiseDelay
+// after one became ready before announcing it again.
+type endpointHysteresis struct {
+	withdrawDelay  time.Duration
+	advertiseDelay time.Duration
+	// Reprocesses a service after a delay, so that pending
+	// transitions take effect. May be nil.
+	syncAfter func(string, time.Duration)
+
+	mu       sync.Mutex
+	services map[string]*localEndpoints
+}
+
+type localEndpoints struct {
+	// Whether the service is announced as having local endpoints.
+	ready bool
+	// When the local endpoints started to disagree with ready, zero
+	// if they agree.
+	changedAt time.Time
+}
+
+func newEndpointHysteresis(withdrawDelay, advertiseDelay time.Duration) *endpointHysteresis {
+	return &endpointHysteresis{
+		withdrawDelay:  withdrawDelay,
+		advertiseDelay: advertiseDelay,
+		services:       map[string]*localEndpoints{},
+	}
+}
+
+// ready returns whether the service name is to be announced as having
+// local endpoints at now, given whether it has some, and schedules
+// its reprocessing when a pending transition takes effect. The first
+// state seen for a service takes effect right away.
+func (h *endpointHysteresis) ready(name string, hasEndpoints bool, now time.Time) bool {
+	ready, wait := h.transition(name, hasEndpoints, now)
+	if wait > 0 && h.syncAfter != nil {
+		h.syncAfter(name, wait)
+	}
+	return ready
+}
+
+// transition returns ready's answer, and how long until a pending
+// transition takes effect, 0 if none is pending.
+func (h *endpointHysteresis) transition(name string, hasEndpoints bool, now time.Time) (bool, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.services[name]
+	if s == nil {
+		h.services[name] = &localEndpoints{ready: hasEndpoints}
+		return hasEndpoints, 0
+	}
+	if s.ready == hasEndpoints {
+		s.changedAt = time.Time{}
+		return s.ready, 0
+	}
+
+	delay := h.advertiseDelay
+	if s.ready {
+		delay = h.withdrawDelay
+	}
+	if s.changedAt.IsZero() {
+		s.changedAt = now
+	}
+	if elapsed := now.Sub(s.changedAt); elapsed < delay {
+		return s.ready, delay - elapsed
+	}
+	s.ready, s.changedAt = hasEndpoints, time.Time{}
+	return s.ready, 0
+}
+
+// forget drops the state of the service name.
+func (h *endpointHysteresis) forget(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.services, name)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpointHysteresis(t *testing.T) {
+	var scheduled time.Duration
+	h := newEndpointHysteresis(10*time.Second, 30*time.Second)
+	h.syncAfter = func(name string, d time.Duration) {
+		if name != "svc" {
+			t.Errorf("scheduled sync of %q, want svc", name)
+		}
+		scheduled = d
+	}
+
+	start := time.Now()
+	tests := []struct {
+		desc          string
+		at            time.Duration
+		hasEndpoints  bool
+		want          bool
+		wantScheduled time.Duration
+	}{
+		{
+			desc:         "first state",
+			hasEndpoints: true,
+			want:         true,
+		},
+		{
+			desc: "endpoint unready",
+			at:   1 * time.Second,
+			want: true,
+			// Withdrawn at 11s.
+			wantScheduled: 10 * time.Second,
+		},
+		{
+			desc:          "still unready",
+			at:            5 * time.Second,
+			want:          true,
+			wantScheduled: 6 * time.Second,
+		},
+		{
+			desc:         "back before the withdraw delay",
+			at:           6 * time.Second,
+			hasEndpoints: true,
+			want:         true,
+		},
+		{
+			desc:          "unready again",
+			at:            7 * time.Second,
+			want:          true,
+			wantScheduled: 10 * time.Second,
+		},
+		{
+			desc: "withdrawn after the delay",
+			at:   17 * time.Second,
+			want: false,
+		},
+		{
+			desc:          "endpoint ready",
+			at:            20 * time.Second,
+			hasEndpoints:  true,
+			want:          false,
+			wantScheduled: 30 * time.Second,
+		},
+		{
+			desc:         "advertised after the delay",
+			at:           50 * time.Second,
+			hasEndpoints: true,
+			want:         true,
+		},
+	}
+	for _, test := range tests {
+		scheduled = 0
+		if got := h.ready("svc", test.hasEndpoints, start.Add(test.at)); got != test.want {
+			t.Errorf("%s: got ready %v, want %v", test.desc, got, test.want)
+		}
+		if scheduled != test.wantScheduled {
+			t.Errorf("%s: scheduled sync in %s, want %s", test.desc, scheduled, test.wantScheduled)
+		}
+	}
+
+	// Forgotten services start over.
+	h.forget("svc")
+	if !h.ready("svc", true, start.Add(51*time.Second)) {
+		t.Error("forgotten service not ready right away")
+	}
+}
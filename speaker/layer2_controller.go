@@ -19,6 +19,8 @@ import (
 	"crypto/sha256"
 	"net"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/go-kit/kit/log"
 	"go.universe.tf/metallb/internal/config"
@@ -28,9 +30,15 @@ import (
 )
 
 type layer2Controller struct {
-	announcer *layer2.Announce
+	announcer layer2.Announcer
 	myNode    string
 	sList     SpeakerList
+
+	// The nodes announcing the sticky services, as this speaker last
+	// saw them, "" for the services it stopped announcing when it
+	// drained.
+	stickyMu     sync.Mutex
+	stickyOwners map[string]string
 }
 
 func (c *layer2Controller) SetConfig(log.Logger, *config.Config) error {
@@ -93,18 +101,171 @@ func usableNodes(eps k8s.EpsOrSlices, speakers map[string]bool) []string {
 	return ret
 }
 
-func (c *layer2Controller) ShouldAnnounce(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices) string {
-	nodes := usableNodes(eps, c.sList.UsableSpeakers())
-	// Sort the slice by the hash of node + service name. This
-	// produces an ordering of ready nodes that is unique to this
-	// service.
+// sortNodes sorts nodes by priority, lower first, then by the hash
+// of node + service name. This produces an ordering of nodes that is
+// unique to the service, and prefers the nodes with the lowest
+// priority. priorities may be nil.
+func sortNodes(nodes []string, name string, priorities map[string]int) {
 	sort.Slice(nodes, func(i, j int) bool {
+		if pi, pj := priorities[nodes[i]], priorities[nodes[j]]; pi != pj {
+			return pi < pj
+		}
 		hi := sha256.Sum256([]byte(nodes[i] + "#" + name))
 		hj := sha256.Sum256([]byte(nodes[j] + "#" + name))
 
 		return bytes.Compare(hi[:], hj[:]) < 0
 	})
+}
+
+// pinnedNodesAnnotation pins the announcement of a service to a
+// comma-separated list of node names, in order of preference.
+const pinnedNodesAnnotation = "metallb.universe.tf/pinned-nodes"
+
+// pinnedNodes returns the nodes svc's announcement is pinned to, in
+// order of preference, or nil if it isn't pinned.
+func pinnedNodes(svc *v1.Service) []string {
+	var ret []string
+	for _, n := range strings.Split(svc.Annotations[pinnedNodesAnnotation], ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// pinNodes returns the nodes that are in pinned, in the order of
+// pinned.
+func pinNodes(nodes []string, pinned []string) []string {
+	have := map[string]bool{}
+	for _, n := range nodes {
+		have[n] = true
+	}
+	var ret []string
+	for _, n := range pinned {
+		if have[n] {
+			ret = append(ret, n)
+			have[n] = false
+		}
+	}
+	return ret
+}
+
+// pinnedTo returns true if node is one of the nodes in pinned.
+func pinnedTo(pinned []string, node string) bool {
+	for _, n := range pinned {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// failbackAnnotation sets what happens when a node that failed comes
+// back: with failbackPreempt, the default, it takes the service back
+// from the node that took over, with failbackSticky, the service
+// stays where it is until its node fails.
+const failbackAnnotation = "metallb.universe.tf/layer2-failback"
+
+const (
+	failbackPreempt = "preempt"
+	failbackSticky  = "sticky"
+)
+
+// candidates returns the nodes that may announce the service, the
+// owner first, then the nodes that take over in order when it fails.
+func (c *layer2Controller) candidates(name string, svc *v1.Service, eps k8s.EpsOrSlices) []string {
+	nodes := usableNodes(eps, c.sList.UsableSpeakers())
+	if pinned := pinnedNodes(svc); pinned != nil {
+		// The pinned nodes' order overrides priorities.
+		nodes = pinNodes(nodes, pinned)
+	} else {
+		sortNodes(nodes, name, c.sList.Priorities())
+	}
+	if svc.Annotations[failbackAnnotation] == failbackSticky {
+		nodes = c.stick(name, svc, nodes)
+	} else {
+		c.unstick(name)
+	}
+	return nodes
+}
 
+// stick moves the node that announces the sticky service name first
+// in nodes, as long as it may announce it, and records the new owner
+// otherwise.
+func (c *layer2Controller) stick(name string, svc *v1.Service, nodes []string) []string {
+	c.stickyMu.Lock()
+	defer c.stickyMu.Unlock()
+	owner, ok := c.stickyOwners[name]
+	if !ok {
+		// This speaker doesn't know the owner, so it restarted since
+		// the service was created, and so did the other nodes that
+		// started after the service: the service failed over from
+		// them if they announced it.
+		startTimes := c.sList.StartTimes()
+		created := svc.CreationTimestamp.Time
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return !startTimes[nodes[i]].After(created) && startTimes[nodes[j]].After(created)
+		})
+	}
+	if ok && owner == "" {
+		// The other nodes elected the next one without this one.
+		for _, n := range nodes {
+			if n != c.myNode {
+				owner = n
+				break
+			}
+		}
+	}
+	if ok {
+		for i, n := range nodes {
+			if n == owner {
+				copy(nodes[1:i+1], nodes[:i])
+				nodes[0] = owner
+				break
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return nodes
+	}
+	if c.stickyOwners == nil {
+		c.stickyOwners = map[string]string{}
+	}
+	c.stickyOwners[name] = nodes[0]
+	return nodes
+}
+
+// unstick forgets the owner of the service name.
+func (c *layer2Controller) unstick(name string) {
+	c.stickyMu.Lock()
+	defer c.stickyMu.Unlock()
+	delete(c.stickyOwners, name)
+}
+
+// giveUp records that this node stopped announcing the sticky service
+// name for a reason of its own, so that it doesn't take it back when
+// it can announce again.
+func (c *layer2Controller) giveUp(name string) {
+	c.stickyMu.Lock()
+	defer c.stickyMu.Unlock()
+	if owner, ok := c.stickyOwners[name]; ok && owner == c.myNode {
+		c.stickyOwners[name] = ""
+	}
+}
+
+// forgetSticky forgets the owner of the deleted service name.
+func (c *controller) forgetSticky(name string) {
+	if l2, ok := c.protocols[config.Layer2].(*layer2Controller); ok {
+		l2.unstick(name)
+	}
+}
+
+func (c *layer2Controller) ShouldAnnounce(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices) string {
+	if pinned := pinnedNodes(svc); pinned != nil && !pinnedTo(pinned, c.myNode) {
+		return "notPinned"
+	}
+
+	nodes := c.candidates(name, svc, eps)
 	// Are we first in the list? If so, we win and should announce.
 	if len(nodes) > 0 && nodes[0] == c.myNode {
 		return ""
@@ -114,12 +275,24 @@ func (c *layer2Controller) ShouldAnnounce(l log.Logger, name string, svc *v1.Ser
 	return "notOwner"
 }
 
-func (c *layer2Controller) SetBalancer(l log.Logger, name string, lbIP net.IP, pool *config.Pool) error {
-	c.announcer.SetBalancer(name, lbIP)
+// Owners returns the node announcing the service, if any.
+func (c *layer2Controller) Owners(name string, svc *v1.Service, eps k8s.EpsOrSlices) []string {
+	nodes := c.candidates(name, svc, eps)
+	if len(nodes) == 0 {
+		return []string{}
+	}
+	return nodes[:1]
+}
+
+func (c *layer2Controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices, lbIP net.IP, pool *config.Pool) error {
+	c.announcer.SetBalancer(name, lbIP, pool.Layer2Interfaces)
 	return nil
 }
 
 func (c *layer2Controller) DeleteBalancer(l log.Logger, name, reason string) error {
+	if reason == "nodeDraining" || reason == "networkNotReady" {
+		c.giveUp(name)
+	}
 	if !c.announcer.AnnounceName(name) {
 		return nil
 	}
@@ -127,6 +300,18 @@ func (c *layer2Controller) DeleteBalancer(l log.Logger, name, reason string) err
 	return nil
 }
 
+func (c *layer2Controller) AnnouncedVia(name string) []string {
+	return c.announcer.Interfaces(name)
+}
+
+func (c *layer2Controller) LinkUp(l log.Logger, name string) {
+	c.announcer.LinkUp(name)
+}
+
+// AddrsChanged does nothing, the announcer picks up the interfaces'
+// new addresses when it rescans them.
+func (c *layer2Controller) AddrsChanged(log.Logger) {}
+
 func (c *layer2Controller) SetNode(log.Logger, *v1.Node) error {
 	c.sList.Rejoin()
 	return nil
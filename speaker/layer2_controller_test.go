@@ -5,6 +5,7 @@ import (
 	"os"
 	"sort"
 	"testing"
+	"time"
 
 	"go.universe.tf/metallb/internal/config"
 	"go.universe.tf/metallb/internal/k8s"
@@ -12,18 +13,34 @@ import (
 	"github.com/go-kit/kit/log"
 	v1 "k8s.io/api/core/v1"
 	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type fakeSpeakerList struct {
-	speakers map[string]bool
+	speakers   map[string]bool
+	priorities map[string]int
+	startTimes map[string]time.Time
+	draining   bool
 }
 
 func (sl *fakeSpeakerList) UsableSpeakers() map[string]bool {
 	return sl.speakers
 }
 
+func (sl *fakeSpeakerList) Priorities() map[string]int {
+	return sl.priorities
+}
+
+func (sl *fakeSpeakerList) StartTimes() map[string]time.Time {
+	return sl.startTimes
+}
+
 func (sl *fakeSpeakerList) Rejoin() {}
 
+func (sl *fakeSpeakerList) SetDraining(draining bool) { sl.draining = draining }
+
+func (sl *fakeSpeakerList) SetPriority(int) {}
+
 func compareUseableNodesReturnedValue(a, b []string) bool {
 	if &a == &b {
 		return true
@@ -2184,3 +2201,240 @@ func TestShouldAnnounceEPSlices(t *testing.T) {
 func boolPtr(b bool) *bool {
 	return &b
 }
+
+func TestShouldAnnouncePriority(t *testing.T) {
+	fakeSL := &fakeSpeakerList{
+		speakers: map[string]bool{
+			"iris1": true,
+			"iris2": true,
+		},
+		priorities: map[string]int{
+			"iris1": 10,
+			"iris2": 0,
+		},
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris1"),
+						},
+						{
+							IP:       "2.3.4.15",
+							NodeName: strptr("iris2"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+	}
+
+	c1 := &layer2Controller{myNode: "iris1", sList: fakeSL}
+	c2 := &layer2Controller{myNode: "iris2", sList: fakeSL}
+	l := log.NewNopLogger()
+	for _, name := range []string{"test1", "test2", "test3", "test4"} {
+		if got := c1.ShouldAnnounce(l, name, svc, eps); got != "notOwner" {
+			t.Errorf("%q: lower priority node announces, got %q", name, got)
+		}
+		if got := c2.ShouldAnnounce(l, name, svc, eps); got != "" {
+			t.Errorf("%q: higher priority node doesn't announce, got %q", name, got)
+		}
+	}
+
+	// The lower priority node takes over when the preferred one
+	// fails.
+	fakeSL.speakers["iris2"] = false
+	if got := c1.ShouldAnnounce(l, "test1", svc, eps); got != "" {
+		t.Errorf("lower priority node doesn't take over, got %q", got)
+	}
+}
+
+func TestShouldAnnouncePinned(t *testing.T) {
+	fakeSL := &fakeSpeakerList{
+		speakers: map[string]bool{
+			"iris1": true,
+			"iris2": true,
+			"iris3": true,
+		},
+		priorities: map[string]int{
+			"iris2": 10,
+		},
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris1"),
+						},
+						{
+							IP:       "2.3.4.15",
+							NodeName: strptr("iris2"),
+						},
+						{
+							IP:       "2.3.4.25",
+							NodeName: strptr("iris3"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				pinnedNodesAnnotation: "iris2, iris1",
+			},
+		},
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+	}
+
+	l := log.NewNopLogger()
+	want := map[string]string{
+		"iris1": "notOwner",
+		// The pinned order overrides priorities.
+		"iris2": "",
+		"iris3": "notPinned",
+	}
+	for node, reason := range want {
+		c := &layer2Controller{myNode: node, sList: fakeSL}
+		if got := c.ShouldAnnounce(l, "test1", svc, eps); got != reason {
+			t.Errorf("%s: ShouldAnnounce() = %q, want %q", node, got, reason)
+		}
+	}
+
+	// The secondary node takes over when the primary fails, other
+	// nodes never do.
+	fakeSL.speakers["iris2"] = false
+	want = map[string]string{
+		"iris1": "",
+		"iris3": "notPinned",
+	}
+	for node, reason := range want {
+		c := &layer2Controller{myNode: node, sList: fakeSL}
+		if got := c.ShouldAnnounce(l, "test1", svc, eps); got != reason {
+			t.Errorf("%s after failover: ShouldAnnounce() = %q, want %q", node, got, reason)
+		}
+	}
+}
+
+func TestShouldAnnounceFailback(t *testing.T) {
+	now := time.Now()
+	fakeSL := &fakeSpeakerList{
+		speakers: map[string]bool{
+			"iris1": true,
+			"iris2": true,
+		},
+		priorities: map[string]int{
+			"iris1": 0,
+			"iris2": 10,
+		},
+		startTimes: map[string]time.Time{
+			"iris1": now.Add(-time.Hour),
+			"iris2": now.Add(-2 * time.Hour),
+		},
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris1"),
+						},
+						{
+							IP:       "2.3.4.15",
+							NodeName: strptr("iris2"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			CreationTimestamp: metav1.NewTime(now.Add(-90 * time.Minute)),
+		},
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+	}
+
+	// iris1 came back after a failure, so its speaker started after
+	// the service was created. By default, it takes the service back.
+	l := log.NewNopLogger()
+	c1 := &layer2Controller{myNode: "iris1", sList: fakeSL}
+	c2 := &layer2Controller{myNode: "iris2", sList: fakeSL}
+	if got := c1.ShouldAnnounce(l, "test1", svc, eps); got != "" {
+		t.Errorf("preferred node doesn't preempt, got %q", got)
+	}
+	if got := c2.ShouldAnnounce(l, "test1", svc, eps); got != "notOwner" {
+		t.Errorf("node that took over keeps announcing, got %q", got)
+	}
+
+	// Sticky services stay on the node that took over, which the
+	// restarted node doesn't know.
+	svc.Annotations = map[string]string{failbackAnnotation: failbackSticky}
+	if got := c1.ShouldAnnounce(l, "test1", svc, eps); got != "notOwner" {
+		t.Errorf("returning node preempts sticky service, got %q", got)
+	}
+	if got := c2.ShouldAnnounce(l, "test1", svc, eps); got != "" {
+		t.Errorf("node that took over drops sticky service, got %q", got)
+	}
+
+	// Until it fails.
+	fakeSL.speakers["iris2"] = false
+	if got := c1.ShouldAnnounce(l, "test1", svc, eps); got != "" {
+		t.Errorf("returning node doesn't take over sticky service, got %q", got)
+	}
+
+	// iris2 comes back from maintenance without restarting: it
+	// drained, so it doesn't take the service back either.
+	c2.giveUp("test1")
+	fakeSL.speakers["iris2"] = true
+	if got := c1.ShouldAnnounce(l, "test1", svc, eps); got != "" {
+		t.Errorf("owner drops sticky service after maintenance of the other node, got %q", got)
+	}
+	if got := c2.ShouldAnnounce(l, "test1", svc, eps); got != "notOwner" {
+		t.Errorf("node back from maintenance preempts sticky service, got %q", got)
+	}
+
+	// Services created after the speakers started use the usual
+	// order, with priorities.
+	svc2 := svc.DeepCopy()
+	svc2.CreationTimestamp = metav1.NewTime(now)
+	if got := c1.ShouldAnnounce(l, "test2", svc2, eps); got != "" {
+		t.Errorf("preferred node doesn't announce new sticky service, got %q", got)
+	}
+	if got := c2.ShouldAnnounce(l, "test2", svc2, eps); got != "notOwner" {
+		t.Errorf("node with lower priority announces new sticky service, got %q", got)
+	}
+
+	// Preempting services forget their owner.
+	delete(svc.Annotations, failbackAnnotation)
+	if got := c2.ShouldAnnounce(l, "test1", svc, eps); got != "notOwner" {
+		t.Errorf("node with lower priority announces preempting service, got %q", got)
+	}
+	if _, ok := c2.stickyOwners["test1"]; ok {
+		t.Error("owner of preempting service still recorded")
+	}
+}
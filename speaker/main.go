@@ -15,19 +15,27 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"go.universe.tf/metallb/internal/alert"
 	"go.universe.tf/metallb/internal/bgp"
 	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/configpush"
 	"go.universe.tf/metallb/internal/k8s"
 	"go.universe.tf/metallb/internal/layer2"
+	"go.universe.tf/metallb/internal/linkwatch"
 	"go.universe.tf/metallb/internal/logging"
 	"go.universe.tf/metallb/internal/speakerlist"
 	"go.universe.tf/metallb/internal/version"
@@ -50,28 +58,77 @@ var announcing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 	"ip",
 })
 
+var announcementLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "metallb",
+	Subsystem: "speaker",
+	Name:      "announcement_latency_seconds",
+	Help:      "Time from a service change to the first announcement of its new IP from this node.",
+	Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+}, []string{
+	"protocol",
+})
+
 // Service offers methods to mutate a Kubernetes service object.
 type service interface {
-	UpdateStatus(svc *v1.Service) error
+	ChangedAt(key string) time.Time
+	UpdateStatus(svc *v1.Service, ipMode string) error
 	Infof(svc *v1.Service, desc, msg string, args ...interface{})
 	Errorf(svc *v1.Service, desc, msg string, args ...interface{})
+	UpdateSpeakerStatus(name string, services []k8s.SpeakerServiceStatus) error
 }
 
 func main() {
 	prometheus.MustRegister(announcing)
+	prometheus.MustRegister(announcementLatency)
+	prometheus.MustRegister(selfTestOwner)
+	prometheus.MustRegister(selfTestSuccess)
+	prometheus.MustRegister(selfTestDuration)
 
 	var (
-		config     = flag.String("config", "config", "Kubernetes ConfigMap containing MetalLB's configuration")
-		namespace  = flag.String("namespace", os.Getenv("METALLB_NAMESPACE"), "config file and speakers namespace")
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file (only needed when running outside of k8s)")
-		host       = flag.String("host", os.Getenv("METALLB_HOST"), "HTTP host address")
-		mlBindAddr = flag.String("ml-bindaddr", os.Getenv("METALLB_ML_BIND_ADDR"), "Bind addr for MemberList (fast dead node detection)")
-		mlBindPort = flag.String("ml-bindport", os.Getenv("METALLB_ML_BIND_PORT"), "Bind port for MemberList (fast dead node detection)")
-		mlLabels   = flag.String("ml-labels", os.Getenv("METALLB_ML_LABELS"), "Labels to match the speakers (for MemberList / fast dead node detection)")
-		mlSecret   = flag.String("ml-secret-key", os.Getenv("METALLB_ML_SECRET_KEY"), "Secret key for MemberList (fast dead node detection)")
-		myNode     = flag.String("node-name", os.Getenv("METALLB_NODE_NAME"), "name of this Kubernetes node (spec.nodeName)")
-		port       = flag.Int("port", 7472, "HTTP listening port")
-		logLevel   = flag.String("log-level", "info", fmt.Sprintf("log level. must be one of: [%s]", strings.Join(logging.Levels, ", ")))
+		config        = flag.String("config", "config", "Kubernetes ConfigMap containing MetalLB's configuration")
+		namespace     = flag.String("namespace", os.Getenv("METALLB_NAMESPACE"), "config file and speakers namespace")
+		kubeconfig    = flag.String("kubeconfig", "", "absolute path to the kubeconfig file (only needed when running outside of k8s)")
+		host          = flag.String("host", os.Getenv("METALLB_HOST"), "HTTP host address")
+		mlBindAddr    = flag.String("ml-bindaddr", os.Getenv("METALLB_ML_BIND_ADDR"), "Bind addr for MemberList (fast dead node detection)")
+		mlBindPort    = flag.String("ml-bindport", os.Getenv("METALLB_ML_BIND_PORT"), "Bind port for MemberList (fast dead node detection)")
+		mlLabels      = flag.String("ml-labels", os.Getenv("METALLB_ML_LABELS"), "Labels to match the speakers (for MemberList / fast dead node detection)")
+		mlSecret      = flag.String("ml-secret-key", os.Getenv("METALLB_ML_SECRET_KEY"), "Secret key for MemberList (fast dead node detection)")
+		mlSecretName  = flag.String("ml-secret-name", os.Getenv("METALLB_ML_SECRET_NAME"), "if set, watch this Secret holding the MemberList keys, and rotate them when it changes")
+		mlBindIntf    = flag.String("ml-bind-interface", os.Getenv("METALLB_ML_BIND_INTERFACE"), "if set, MemberList gossips through the address of this interface, and listens on all addresses")
+		myNode        = flag.String("node-name", os.Getenv("METALLB_NODE_NAME"), "name of this Kubernetes node (spec.nodeName)")
+		port          = flag.Int("port", 7472, "HTTP listening port")
+		logLevel      = flag.String("log-level", "info", fmt.Sprintf("log level. must be one of: [%s]", strings.Join(logging.Levels, ", ")))
+		shutdownGrace = flag.Duration("shutdown-grace-period", 0, "how long to keep running after withdrawing all announcements on shutdown, so that in-flight connections can drain")
+		gwClasses     = flag.String("gateway-classes", "", "comma-separated GatewayClasses whose Gateways' addresses are announced, like the controller's --gateway-classes")
+		ingClasses    = flag.String("ingress-classes", "", "comma-separated IngressClasses whose Ingresses' addresses are announced, like the controller's --ingress-classes")
+		statusPeriod  = flag.Duration("speaker-status-interval", 0, "if non-zero, publish the SpeakerStatus of this node at this interval")
+		drainDelay    = flag.Duration("node-drain-delay", 0, "how long the node must stay cordoned, or annotated with "+maintenanceAnnotation+", before withdrawing its announcements")
+		readyChecks   = flag.String("readiness-checks", "", "comma-separated checks that must pass before the first announcements: node-network, kube-proxy")
+		kubeProxyURL  = flag.String("kube-proxy-healthz", "http://localhost:10256/healthz", "health endpoint of kube-proxy, for the kube-proxy readiness check")
+		readyTimeout  = flag.Duration("readiness-timeout", 5*time.Minute, "how long to wait for the readiness checks before announcing anyway, 0 to wait forever")
+		watchLinks    = flag.Bool("watch-links", true, "re-announce services right away when a network interface link comes back up, and follow the node's address changes")
+		bgpBackend    = flag.String("bgp-backend", "native", "BGP implementation to use")
+		lbClass       = flag.String("lb-class", "", "only announce the services of this load balancer class, instead of the services without one")
+		l2Responder   = flag.String("layer2-responder", "", "unix socket of a layer2 responder helper, to answer ARP and NDP without raw socket privileges in the speaker")
+		serveL2       = flag.String("serve-layer2-responder", "", "run as the layer2 responder helper, listening on this unix socket, instead of as a speaker")
+		selfTestPool  = flag.String("self-test-pool", "", "if set, continuously test the layer2 announcements with a canary IP from this pool")
+		selfTestEvery = flag.Duration("self-test-interval", 30*time.Second, "interval between two rounds of the self-test")
+		doctor        = flag.Bool("doctor", false, "check this node and the configuration for common problems, print the findings and exit")
+		snmpAddr      = flag.String("snmp-address", "", "if set, serve the state of the BGP sessions over SNMP on this UDP address, e.g. :161")
+		snmpCommunity = flag.String("snmp-community", os.Getenv("METALLB_SNMP_COMMUNITY"), "SNMP community that requests must present, public if empty")
+		leaseDuration = flag.Duration("speaker-lease-duration", 0, "if non-zero, detect dead nodes with Kubernetes Leases of this duration that the speakers renew, instead of memberlist")
+		nodeLeaseWait = flag.Duration("node-lease-timeout", 0, "if non-zero, consider nodes whose kubelet didn't renew their node Lease for this long dead, and take over their announcements")
+		eventInterval = flag.Duration("event-interval", 5*time.Minute, "minimum interval between two identical events about a service, unless a different event about it comes in between, 0 to send them all")
+		l2XDP         = flag.Bool("layer2-xdp", false, "answer ARP and NDP requests in the kernel with XDP (requires Linux 5.9+, and the BPF and NET_ADMIN capabilities)")
+		withdrawDelay = flag.Duration("local-withdraw-delay", 0, "how long to keep announcing a service with the Local traffic policy over BGP after the node's last local endpoint becomes unready")
+		advertDelay   = flag.Duration("local-advertise-delay", 0, "how long a local endpoint must be ready before announcing a service with the Local traffic policy over BGP again")
+		configServer  = flag.String("config-server", "", "if set, get the config from the controller's --config-distribution-address at this https URL, e.g. https://metallb-controller:7473, instead of watching the config ConfigMap")
+		configCA      = flag.String("config-server-ca", "", "CA certificate file to verify --config-server with, instead of the system's CAs")
+		alertWebhook  = flag.String("alert-webhook", "", "if set, send alerts about critical conditions, e.g. all the BGP sessions of the node down, to this URL")
+		alertFormat   = flag.String("alert-format", alert.FormatGeneric, "format of the alerts sent to --alert-webhook: generic, or alertmanager to send them to the Alertmanager v2 API")
+		captureAddr   = flag.String("debug-capture-address", "", "if set, serve packet captures of the ARP, NDP and BGP traffic of an address on /debug/capture of this loopback address, e.g. localhost:7475, for debugging")
+		ownerHook     = flag.String("owner-change-webhook", "", "if set, POST the changes of the nodes announcing a service to this URL, as JSON")
+		datapath      = flag.String("datapath", datapathKubeProxy, "how the nodes deliver the traffic of the services to their endpoints: kube-proxy, cilium, or nodeport if only through node ports, to refuse announcing the services without node ports it can't deliver")
 	)
 	flag.Parse()
 
@@ -83,6 +140,14 @@ func main() {
 
 	level.Info(logger).Log("version", version.Version(), "commit", version.CommitHash(), "branch", version.Branch(), "goversion", version.GoString(), "msg", "MetalLB speaker starting "+version.String())
 
+	if *serveL2 != "" {
+		if err := serveLayer2Responder(logger, *serveL2, *l2XDP); err != nil {
+			level.Error(logger).Log("op", "layer2Responder", "error", err, "msg", "layer2 responder failed")
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *namespace == "" {
 		bs, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 		if err != nil {
@@ -97,6 +162,31 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *doctor {
+		os.Exit(runDoctor(doctorArgs{
+			kubeconfig:      *kubeconfig,
+			namespace:       *namespace,
+			configMap:       *config,
+			node:            *myNode,
+			layer2Responder: *l2Responder,
+			mlLabels:        *mlLabels,
+			mlPort:          *mlBindPort,
+		}))
+	}
+
+	if err := checkDatapath(*datapath); err != nil {
+		level.Error(logger).Log("op", "startup", "error", err, "msg", "invalid datapath")
+		os.Exit(1)
+	}
+
+	backend, err := bgp.Lookup(*bgpBackend)
+	if err != nil {
+		level.Error(logger).Log("op", "startup", "error", err, "msg", "invalid BGP backend")
+		os.Exit(1)
+	}
+	newBGP = backend.NewSession
+	level.Info(logger).Log("op", "startup", "bgpBackend", backend.Name(), "msg", "using BGP backend")
+
 	stopCh := make(chan struct{})
 	go func() {
 		c1 := make(chan os.Signal, 1)
@@ -108,23 +198,75 @@ func main() {
 	}()
 	defer level.Info(logger).Log("op", "shutdown", "msg", "done")
 
-	sList, err := speakerlist.New(logger, *myNode, *mlBindAddr, *mlBindPort, *mlSecret, *namespace, *mlLabels, stopCh)
-	if err != nil {
-		os.Exit(1)
+	var sList runnableSpeakerList
+	if *leaseDuration > 0 {
+		sList = speakerlist.NewLeaseList(logger, *myNode, *namespace, *leaseDuration, stopCh)
+	} else {
+		ml, err := speakerlist.New(logger, speakerlist.Config{
+			NodeName:      *myNode,
+			BindAddr:      *mlBindAddr,
+			BindPort:      *mlBindPort,
+			BindInterface: *mlBindIntf,
+			Secret:        *mlSecret,
+			SecretName:    *mlSecretName,
+			Namespace:     *namespace,
+			Labels:        *mlLabels,
+		}, stopCh)
+		if err != nil {
+			os.Exit(1)
+		}
+		sList = ml
+	}
+	if *nodeLeaseWait > 0 {
+		sList = speakerlist.NewNodeLeaseList(logger, *myNode, sList, *nodeLeaseWait, stopCh)
+	}
+
+	// Follow the interfaces and addresses from their notifications
+	// instead of listing them every time they're needed.
+	var intfs linkwatch.Interfaces
+	if *watchLinks {
+		cache, err := linkwatch.NewCache(logger, stopCh)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to cache network interfaces, listing them every time")
+		} else {
+			intfs = cache
+		}
 	}
 
 	// Setup all clients and speakers, config decides what is being done runtime.
 	ctrl, err := newController(controllerConfig{
-		MyNode: *myNode,
-		Logger: logger,
-		SList:  sList,
+		MyNode:     *myNode,
+		Logger:     logger,
+		SList:      sList,
+		DrainDelay: *drainDelay,
+
+		LocalWithdrawDelay:  *withdrawDelay,
+		LocalAdvertiseDelay: *advertDelay,
+
+		LoadBalancerClass: *lbClass,
+		Layer2Responder:   *l2Responder,
+		Layer2XDP:         *l2XDP,
+		Datapath:          *datapath,
+		Interfaces:        intfs,
 	})
 	if err != nil {
 		level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to create MetalLB controller")
 		os.Exit(1)
 	}
+	if *ownerHook != "" {
+		ctrl.ownerWebhook = newOwnerWebhook(logger, *ownerHook, stopCh)
+	}
+	if *alertWebhook != "" {
+		sink, err := alert.New(logger, *alertWebhook, *alertFormat, *myNode, stopCh)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "invalid alert configuration")
+			os.Exit(1)
+		}
+		ctrl.alerts = sink
+		go ctrl.watchBGPSessions(logger, prometheus.DefaultGatherer, stopCh)
+	}
 
-	client, err := k8s.New(&k8s.Config{
+	cfg := &k8s.Config{
 		ProcessName:   "metallb-speaker",
 		ConfigMapName: *config,
 		ConfigMapNS:   *namespace,
@@ -135,23 +277,109 @@ func main() {
 		MetricsHost:   *host,
 		MetricsPort:   *port,
 		ReadEndpoints: true,
+		EventInterval: *eventInterval,
 
 		ServiceChanged: ctrl.SetBalancer,
 		ConfigChanged:  ctrl.SetConfig,
 		NodeChanged:    ctrl.SetNode,
-	})
+	}
+	if *gwClasses != "" {
+		cfg.GatewayChanged = ctrl.SetGateway
+		cfg.GatewayClasses = strings.Split(*gwClasses, ",")
+	}
+	if *ingClasses != "" {
+		cfg.IngressChanged = ctrl.SetIngress
+		cfg.IngressClasses = strings.Split(*ingClasses, ",")
+	}
+	cfg.PushedConfig = *configServer != ""
+	client, err := k8s.New(cfg)
 	if err != nil {
 		level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to create k8s client")
 		os.Exit(1)
 	}
 	ctrl.client = client
+	ctrl.forceSync = client.ForceSync
+	ctrl.localEps.syncAfter = client.SyncAfter
+
+	if *configServer != "" {
+		tlsConfig, err := configServerTLS(*configCA)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to load the config server CA")
+			os.Exit(1)
+		}
+		pushClient, err := configpush.NewClient(logger, strings.TrimSuffix(*configServer, "/"), *myNode, serviceAccountToken, tlsConfig)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "invalid config server")
+			os.Exit(1)
+		}
+		go pushClient.Run(client.PushConfig, stopCh)
+	}
+
+	if *readyChecks != "" {
+		r, err := newNetworkReadiness(strings.Split(*readyChecks, ","), *kubeProxyURL, *readyTimeout)
+		if err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "invalid readiness checks")
+			os.Exit(1)
+		}
+		ctrl.readiness = r
+		ctrl.setNotReady(true)
+		go r.Run(logger, stopCh, func() {
+			ctrl.setNotReady(false)
+			client.ForceSync()
+		})
+	}
 
 	sList.Start(client)
 	defer sList.Stop()
 
+	if *watchLinks {
+		if err := linkwatch.Watch(logger, stopCh, func(name string) { ctrl.LinkUp(logger, name) }); err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to watch link changes, not re-announcing on link up")
+		}
+		if err := linkwatch.WatchAddrs(logger, stopCh, func() { ctrl.AddrsChanged(logger) }); err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to watch address changes, BGP sessions won't follow node renumbering")
+		}
+	}
+
+	if *selfTestPool != "" {
+		ctrl.startSelfTest(logger, *selfTestPool, *selfTestEvery, stopCh)
+	}
+	ctrl.startStaticVIPs(logger, stopCh)
+
+	if *captureAddr != "" {
+		if err := serveCaptures(logger, *captureAddr, *myNode); err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to serve packet captures")
+			os.Exit(1)
+		}
+	}
+
+	if *snmpAddr != "" {
+		if err := ctrl.startSNMP(logger, *snmpAddr, *snmpCommunity, stopCh); err != nil {
+			level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to start the SNMP agent")
+			os.Exit(1)
+		}
+	}
+
+	if *statusPeriod > 0 {
+		go func() {
+			ticker := time.NewTicker(*statusPeriod)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopCh:
+					return
+				case <-ticker.C:
+					ctrl.PublishStatus(logger)
+				}
+			}
+		}()
+	}
+
 	if err := client.Run(stopCh); err != nil {
 		level.Error(logger).Log("op", "startup", "error", err, "msg", "failed to run k8s client")
 	}
+
+	ctrl.Shutdown(logger, *shutdownGrace)
 }
 
 type controller struct {
@@ -163,56 +391,214 @@ type controller struct {
 	protocols map[config.Proto]Protocol
 	announced map[string]config.Proto // service name -> protocol advertising it
 	svcIP     map[string]net.IP       // service name -> assigned IP
+
+	// Node drain handling. drainingSince is zero when the node is
+	// not cordoned or under maintenance.
+	sList         SpeakerList
+	drainDelay    time.Duration
+	drainingSince time.Time
+	forceSync     func()
+	// drainMu guards the draining state of sList against the drain
+	// delay timers, which drainGen invalidates when the node comes
+	// back in service, and against the readiness checks. The other
+	// speakers see the node as draining while it drains or isn't
+	// ready yet.
+	drainMu       sync.Mutex
+	drainGen      uint64
+	drainGossiped bool
+	notReady      bool
+
+	// Announcement priority of the node, lower is preferred.
+	priority int
+
+	// Holds back announcements until node networking is ready, if
+	// non-nil.
+	readiness *networkReadiness
+
+	// What the node does with each service, for its SpeakerStatus.
+	status speakerStatus
+
+	// The load balancer class of the services this instance
+	// announces, "" for the services that don't request one.
+	lbClass string
+
+	// Announces or probes the self-test canary, if non-nil.
+	selfTest *selfTest
+	// Announces the static VIPs, nil without layer2 mode.
+	staticVIPs *staticVIPs
+
+	// The nodes announcing each service, as last seen, and where to
+	// report their changes besides events, if non-nil.
+	owners       map[string][]string
+	ownerWebhook *ownerWebhook
+	// Where to send alerts, if non-nil.
+	alerts alerter
+
+	// Debounces the local endpoints of Local traffic policy services
+	// for BGP.
+	localEps *endpointHysteresis
+
+	// How the node delivers the traffic of the services.
+	datapath string
 }
 
 type controllerConfig struct {
 	MyNode string
 	Logger log.Logger
 	SList  SpeakerList
+	// How long the node must be cordoned or under maintenance before
+	// its announcements are withdrawn.
+	DrainDelay time.Duration
+	// Only announce the services of this load balancer class.
+	LoadBalancerClass string
+	// Unix socket of the layer2 responder helper. If empty, the
+	// speaker answers ARP and NDP itself.
+	Layer2Responder string
+	// Answer ARP and NDP in the kernel, with XDP.
+	Layer2XDP bool
+	// How the node delivers the traffic of the services, one of the
+	// datapath constants. Empty means kube-proxy.
+	Datapath string
+	// The node's interfaces and addresses. Nil means asking the
+	// kernel every time.
+	Interfaces linkwatch.Interfaces
+	// How long to keep announcing a Local traffic policy service over
+	// BGP after its last local endpoint becomes unready, and to wait
+	// before announcing it again after one becomes ready.
+	LocalWithdrawDelay  time.Duration
+	LocalAdvertiseDelay time.Duration
 
 	// For testing only, and will be removed in a future release.
 	// See: https://github.com/metallb/metallb/issues/152.
 	DisableLayer2 bool
 }
 
+// serviceAccountToken is the token file of the speaker's
+// ServiceAccount, with which it authenticates to the config server.
+const serviceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// configServerTLS returns the TLS config verifying the config server
+// with the CA certificate in caFile, or with the system's CAs if it is
+// empty.
+func configServerTLS(caFile string) (*tls.Config, error) {
+	if caFile == "" {
+		return &tls.Config{}, nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// newLayer2 returns a layer2 announcer on the interfaces of intfs,
+// answering in the kernel if xdp is true.
+func newLayer2(l log.Logger, xdp bool, intfs linkwatch.Interfaces) (*layer2.Announce, error) {
+	if xdp {
+		return layer2.NewWithXDP(l, intfs)
+	}
+	return layer2.New(l, intfs)
+}
+
 func newController(cfg controllerConfig) (*controller, error) {
+	localEps := newEndpointHysteresis(cfg.LocalWithdrawDelay, cfg.LocalAdvertiseDelay)
 	protocols := map[config.Proto]Protocol{
 		config.BGP: &bgpController{
-			logger: cfg.Logger,
-			myNode: cfg.MyNode,
-			svcAds: make(map[string][]*bgp.Advertisement),
+			logger:   cfg.Logger,
+			myNode:   cfg.MyNode,
+			svcAds:   make(map[string][]*advertisement),
+			sList:    cfg.SList,
+			svcRank:  map[string]int{},
+			localEps: localEps,
+			intfs:    cfg.Interfaces,
 		},
 	}
 
 	if !cfg.DisableLayer2 {
-		a, err := layer2.New(cfg.Logger)
-		if err != nil {
-			return nil, fmt.Errorf("making layer2 announcer: %s", err)
+		var a layer2.Announcer
+		if cfg.Layer2Responder != "" {
+			a = layer2.NewRemote(cfg.Logger, cfg.Layer2Responder, 5*time.Second)
+		} else {
+			l2, err := newLayer2(cfg.Logger, cfg.Layer2XDP, cfg.Interfaces)
+			if err != nil {
+				return nil, fmt.Errorf("making layer2 announcer: %s", err)
+			}
+			a = l2
 		}
 		protocols[config.Layer2] = &layer2Controller{
 			announcer: a,
 			myNode:    cfg.MyNode,
 			sList:     cfg.SList,
 		}
+		protocols[hybrid] = newHybridController(protocols[config.BGP], protocols[config.Layer2])
 	}
 
 	ret := &controller{
-		myNode:    cfg.MyNode,
-		protocols: protocols,
-		announced: map[string]config.Proto{},
-		svcIP:     map[string]net.IP{},
+		myNode:     cfg.MyNode,
+		protocols:  protocols,
+		announced:  map[string]config.Proto{},
+		svcIP:      map[string]net.IP{},
+		owners:     map[string][]string{},
+		sList:      cfg.SList,
+		drainDelay: cfg.DrainDelay,
+		lbClass:    cfg.LoadBalancerClass,
+		localEps:   localEps,
+		datapath:   cfg.Datapath,
 	}
 
 	return ret, nil
 }
 
 func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices) k8s.SyncState {
+	prevIP := c.svcIP[name]
+	st, announced := c.setBalancer(l, name, svc, eps)
+	if announced {
+		c.client.Infof(svc, "nodeAssigned", "announcing from node %q", c.myNode)
+		if changed := c.client.ChangedAt(name); !changed.IsZero() && !prevIP.Equal(c.svcIP[name]) {
+			announcementLatency.WithLabelValues(string(c.announced[name])).Observe(time.Since(changed).Seconds())
+		}
+	}
+	return st
+}
+
+// setBalancer converges the announcement of a balancer, returning
+// true if this node announces it.
+func (c *controller) setBalancer(l log.Logger, name string, svc *v1.Service, eps k8s.EpsOrSlices) (k8s.SyncState, bool) {
 	if svc == nil {
-		return c.deleteBalancer(l, name, "serviceDeleted")
+		c.status.clear(name)
+		c.forgetOwners(l, name)
+		c.forgetSticky(name)
+		c.localEps.forget(name)
+		return c.deleteBalancer(l, name, "serviceDeleted"), false
 	}
 
 	if svc.Spec.Type != "LoadBalancer" {
-		return c.deleteBalancer(l, name, "notLoadBalancer")
+		c.status.clear(name)
+		c.forgetOwners(l, name)
+		c.forgetSticky(name)
+		c.localEps.forget(name)
+		return c.deleteBalancer(l, name, "notLoadBalancer"), false
+	}
+
+	if k8s.LoadBalancerClass(svc) != c.lbClass {
+		// Announced by another MetalLB instance, if any.
+		c.status.clear(name)
+		c.forgetOwners(l, name)
+		c.forgetSticky(name)
+		c.localEps.forget(name)
+		return c.deleteBalancer(l, name, "otherLoadBalancerClass"), false
+	}
+
+	if svc.Annotations[ignoreAnnotation] == "true" {
+		return c.deleteBalancer(l, name, "ignored"), false
+	}
+
+	if svc.Annotations[announceDisabledAnnotation] == "true" {
+		return c.deleteBalancer(l, name, "announceDisabled"), false
 	}
 
 	level.Debug(l).Log("event", "startUpdate", "msg", "start of service update")
@@ -220,17 +606,25 @@ func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps
 
 	if c.config == nil {
 		level.Debug(l).Log("event", "noConfig", "msg", "not processing, still waiting for config")
-		return k8s.SyncStateSuccess
+		return k8s.SyncStateSuccess, false
+	}
+
+	if c.readiness != nil && !c.readiness.Ready() {
+		return c.deleteBalancer(l, name, "networkNotReady"), false
+	}
+
+	if c.draining() {
+		return c.deleteBalancer(l, name, "nodeDraining"), false
 	}
 
-	if len(svc.Status.LoadBalancer.Ingress) != 1 {
-		return c.deleteBalancer(l, name, "noIPAllocated")
+	if len(svc.Status.LoadBalancer.Ingress) == 0 {
+		return c.deleteBalancer(l, name, "noIPAllocated"), false
 	}
 
-	lbIP := net.ParseIP(svc.Status.LoadBalancer.Ingress[0].IP)
+	lbIP := k8s.LoadBalancerIP(svc)
 	if lbIP == nil {
 		level.Error(l).Log("op", "setBalancer", "error", fmt.Sprintf("invalid LoadBalancer IP %q", svc.Status.LoadBalancer.Ingress[0].IP), "msg", "invalid IP allocated by controller")
-		return c.deleteBalancer(l, name, "invalidIP")
+		return c.deleteBalancer(l, name, "invalidIP"), false
 	}
 
 	l = log.With(l, "ip", lbIP)
@@ -238,62 +632,79 @@ func (c *controller) SetBalancer(l log.Logger, name string, svc *v1.Service, eps
 	poolName := poolFor(c.config.Pools, lbIP)
 	if poolName == "" {
 		level.Error(l).Log("op", "setBalancer", "error", "assigned IP not allowed by config", "msg", "IP allocated by controller not allowed by config")
-		return c.deleteBalancer(l, name, "ipNotAllowed")
+		return c.deleteBalancer(l, name, "ipNotAllowed"), false
 	}
 
 	l = log.With(l, "pool", poolName)
 	pool := c.config.Pools[poolName]
 	if pool == nil {
 		level.Error(l).Log("bug", "true", "msg", "internal error: allocated IP has no matching address pool")
-		return c.deleteBalancer(l, name, "internalError")
+		return c.deleteBalancer(l, name, "internalError"), false
 	}
 
-	if proto, ok := c.announced[name]; ok && proto != pool.Protocol {
+	proto := c.protocolFor(pool)
+	if announced, ok := c.announced[name]; ok && announced != proto {
 		if st := c.deleteBalancer(l, name, "protocolChanged"); st == k8s.SyncStateError {
-			return st
+			return st, false
 		}
 	}
 
 	if svcIP, ok := c.svcIP[name]; ok && !lbIP.Equal(svcIP) {
 		if st := c.deleteBalancer(l, name, "loadBalancerIPChanged"); st == k8s.SyncStateError {
-			return st
+			return st, false
 		}
 	}
 
-	l = log.With(l, "protocol", pool.Protocol)
-	handler := c.protocols[pool.Protocol]
+	if reason := missingNodePorts(c.datapath, svc, pool); reason != "" {
+		level.Warn(l).Log("op", "setBalancer", "datapath", c.datapath, "reason", reason, "msg", "service has no node ports, which the datapath needs to deliver its traffic, not announcing")
+		return c.deleteBalancer(l, name, reason), false
+	}
+
+	l = log.With(l, "protocol", proto)
+	handler := c.protocols[proto]
 	if handler == nil {
 		level.Error(l).Log("bug", "true", "msg", "internal error: unknown balancer protocol!")
-		return c.deleteBalancer(l, name, "internalError")
+		return c.deleteBalancer(l, name, "internalError"), false
 	}
 
+	c.trackOwners(l, name, svc, lbIP.String(), string(proto), handler.Owners(name, svc, eps))
+
 	if deleteReason := handler.ShouldAnnounce(l, name, svc, eps); deleteReason != "" {
-		return c.deleteBalancer(l, name, deleteReason)
+		return c.deleteBalancer(l, name, deleteReason), false
 	}
 
-	if err := handler.SetBalancer(l, name, lbIP, pool); err != nil {
+	if err := handler.SetBalancer(l, name, svc, eps, lbIP, pool); err != nil {
 		level.Error(l).Log("op", "setBalancer", "error", err, "msg", "failed to announce service")
-		return k8s.SyncStateError
+		return k8s.SyncStateError, false
 	}
 
 	if c.announced[name] == "" {
-		c.announced[name] = pool.Protocol
+		c.announced[name] = proto
 		c.svcIP[name] = lbIP
 	}
 
 	announcing.With(prometheus.Labels{
-		"protocol": string(pool.Protocol),
+		"protocol": string(proto),
 		"service":  name,
 		"node":     c.myNode,
 		"ip":       lbIP.String(),
 	}).Set(1)
 	level.Info(l).Log("event", "serviceAnnounced", "msg", "service has IP, announcing")
-	c.client.Infof(svc, "nodeAssigned", "announcing from node %q", c.myNode)
+	c.status.set(name, k8s.SpeakerServiceStatus{
+		IP:        lbIP.String(),
+		Protocol:  string(proto),
+		Announced: true,
+		Via:       handler.AnnouncedVia(name),
+	})
 
-	return k8s.SyncStateSuccess
+	return k8s.SyncStateSuccess, true
 }
 
 func (c *controller) deleteBalancer(l log.Logger, name, reason string) k8s.SyncState {
+	if reason != "serviceDeleted" && reason != "notLoadBalancer" {
+		c.status.set(name, k8s.SpeakerServiceStatus{Reason: reason})
+	}
+
 	proto, ok := c.announced[name]
 	if !ok {
 		return k8s.SyncStateSuccess
@@ -318,6 +729,16 @@ func (c *controller) deleteBalancer(l log.Logger, name, reason string) k8s.SyncS
 	return k8s.SyncStateSuccess
 }
 
+// protocolFor returns the protocol announcing the services of pool:
+// its own, or both BGP and layer2 for the BGP pools with layer2
+// interfaces, unless layer2 is disabled.
+func (c *controller) protocolFor(pool *config.Pool) config.Proto {
+	if pool.Protocol == config.BGP && len(pool.Layer2Interfaces) > 0 && c.protocols[hybrid] != nil {
+		return hybrid
+	}
+	return pool.Protocol
+}
+
 func poolFor(pools map[string]*config.Pool, ip net.IP) string {
 	for pname, p := range pools {
 		for _, cidr := range p.CIDR {
@@ -353,31 +774,219 @@ func (c *controller) SetConfig(l log.Logger, cfg *config.Config) k8s.SyncState {
 	}
 
 	c.config = cfg
+	if c.selfTest != nil {
+		c.selfTest.SetConfig(l, cfg)
+	}
+	if c.staticVIPs != nil {
+		c.staticVIPs.SetConfig(cfg)
+	}
 
 	return k8s.SyncStateReprocessAll
 }
 
+// LinkUp re-announces the services after the link of the interface
+// name came back up, so that neighbors that learned other paths to
+// their addresses in the meantime switch back to this node. Unlike
+// the other methods, it is called by the link watcher goroutine.
+func (c *controller) LinkUp(l log.Logger, name string) {
+	for _, handler := range c.protocols {
+		handler.LinkUp(l, name)
+	}
+}
+
+// AddrsChanged lets the protocols follow the node's address changes,
+// e.g. after DHCP renumbered it. Like LinkUp, it is called by the
+// link watcher goroutine.
+func (c *controller) AddrsChanged(l log.Logger) {
+	for _, handler := range c.protocols {
+		handler.AddrsChanged(l)
+	}
+}
+
 func (c *controller) SetNode(l log.Logger, node *v1.Node) k8s.SyncState {
+	if c.readiness != nil {
+		c.readiness.SetNode(node)
+	}
+
 	for proto, handler := range c.protocols {
 		if err := handler.SetNode(l, node); err != nil {
 			level.Error(l).Log("op", "setNode", "error", err, "protocol", proto, "msg", "failed to propagate node info to protocol handler")
 			return k8s.SyncStateError
 		}
 	}
+
+	priority, err := nodePriority(node)
+	if err != nil {
+		level.Error(l).Log("op", "setNode", "error", err, "msg", "ignoring invalid node priority")
+	}
+	priorityChanged := priority != c.priority
+	if priorityChanged {
+		level.Info(l).Log("event", "nodePriorityChanged", "priority", priority, "msg", "node announcement priority changed")
+		c.priority = priority
+		if c.sList != nil {
+			c.sList.SetPriority(priority)
+		}
+	}
+
+	maintenance := node.Spec.Unschedulable || node.Annotations[maintenanceAnnotation] == "true"
+	switch {
+	case maintenance && c.drainingSince.IsZero():
+		level.Info(l).Log("event", "nodeDraining", "delay", c.drainDelay, "msg", "node cordoned or under maintenance, withdrawing announcements")
+		c.drainingSince = time.Now()
+		if c.drainDelay > 0 {
+			// The other nodes take over as soon as they learn that
+			// this one drains, so only tell them once it stops
+			// announcing.
+			gen := c.drainGen
+			time.AfterFunc(c.drainDelay, func() { c.drained(gen) })
+			return k8s.SyncStateSuccess
+		}
+		c.setDraining(true)
+		return k8s.SyncStateReprocessAll
+	case !maintenance && !c.drainingSince.IsZero():
+		level.Info(l).Log("event", "nodeUndrained", "msg", "node back in service, resuming announcements")
+		c.drainingSince = time.Time{}
+		c.drainMu.Lock()
+		c.drainGen++
+		c.drainMu.Unlock()
+		c.setDraining(false)
+		return k8s.SyncStateReprocessAll
+	}
+	if priorityChanged {
+		// BGP advertisements carry the priority.
+		return k8s.SyncStateReprocessAll
+	}
 	return k8s.SyncStateSuccess
 }
 
+// priorityAnnotation sets the announcement priority of a node. Nodes
+// with lower values are preferred to announce services.
+const priorityAnnotation = "metallb.universe.tf/announce-priority"
+
+// nodePriority returns the announcement priority of node, 0 if it
+// has none.
+func nodePriority(node *v1.Node) (int, error) {
+	a := node.Annotations[priorityAnnotation]
+	if a == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseUint(a, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid announce priority %q", a)
+	}
+	return int(p), nil
+}
+
+// Shutdown explicitly withdraws all announcements, then waits for
+// gracePeriod so that peers converge away from this node while it
+// still forwards in-flight connections.
+//
+// Must not be called concurrently with the k8s client callbacks.
+func (c *controller) Shutdown(l log.Logger, gracePeriod time.Duration) {
+	level.Info(l).Log("op", "shutdown", "gracePeriod", gracePeriod, "msg", "withdrawing all announcements")
+	c.setDraining(true)
+	for name := range c.announced {
+		if st := c.deleteBalancer(log.With(l, "service", name), name, "shutdown"); st == k8s.SyncStateError {
+			level.Error(l).Log("op", "shutdown", "service", name, "msg", "failed to withdraw service announcement")
+		}
+	}
+	time.Sleep(gracePeriod)
+}
+
+// ignoreAnnotation makes MetalLB leave a service alone, so that
+// another implementation can announce it.
+const ignoreAnnotation = "metallb.universe.tf/ignore"
+
+// announceDisabledAnnotation stops the announcement of a service,
+// while the controller keeps its IP allocated.
+const announceDisabledAnnotation = "metallb.universe.tf/announce-disabled"
+
+// maintenanceAnnotation marks a node as under maintenance. Like
+// cordoning, it makes the speaker withdraw the node's announcements.
+const maintenanceAnnotation = "metallb.universe.tf/maintenance"
+
+// setDraining tells the other speakers whether this node drains.
+func (c *controller) setDraining(draining bool) {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	c.drainGossiped = draining
+	c.gossipDraining()
+}
+
+// setNotReady tells the other speakers whether this node waits for
+// its networking, so that they don't elect it to announce services
+// it doesn't announce yet.
+func (c *controller) setNotReady(notReady bool) {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	c.notReady = notReady
+	c.gossipDraining()
+}
+
+// gossipDraining publishes the draining state of the node to the
+// other speakers. drainMu must be held.
+func (c *controller) gossipDraining() {
+	if c.sList != nil {
+		c.sList.SetDraining(c.drainGossiped || c.notReady)
+	}
+}
+
+// drained ends the drain delay started at generation gen: it tells
+// the other speakers that the node drains, at the same time as it
+// withdraws its own announcements, unless the node came back in
+// service in the meantime.
+func (c *controller) drained(gen uint64) {
+	c.drainMu.Lock()
+	if gen != c.drainGen {
+		c.drainMu.Unlock()
+		return
+	}
+	c.drainGossiped = true
+	c.gossipDraining()
+	c.drainMu.Unlock()
+	if c.forceSync != nil {
+		c.forceSync()
+	}
+}
+
+// draining returns true if the node has been cordoned or under
+// maintenance for longer than the drain delay.
+func (c *controller) draining() bool {
+	return !c.drainingSince.IsZero() && time.Since(c.drainingSince) >= c.drainDelay
+}
+
 // A Protocol can advertise an IP address.
 type Protocol interface {
 	SetConfig(log.Logger, *config.Config) error
 	ShouldAnnounce(log.Logger, string, *v1.Service, k8s.EpsOrSlices) string
-	SetBalancer(log.Logger, string, net.IP, *config.Pool) error
+	SetBalancer(log.Logger, string, *v1.Service, k8s.EpsOrSlices, net.IP, *config.Pool) error
 	DeleteBalancer(log.Logger, string, string) error
 	SetNode(log.Logger, *v1.Node) error
+	// Where the service is announced: interfaces or peers.
+	AnnouncedVia(string) []string
+	// The link of the named interface came back up.
+	LinkUp(log.Logger, string)
+	// The addresses of the node changed.
+	AddrsChanged(log.Logger)
+	// The nodes announcing the service, as this node sees them,
+	// sorted. Nil if they are unknown.
+	Owners(string, *v1.Service, k8s.EpsOrSlices) []string
 }
 
 // Speakerlist represents a list of healthy speakers.
 type SpeakerList interface {
 	UsableSpeakers() map[string]bool
+	Priorities() map[string]int
+	StartTimes() map[string]time.Time
 	Rejoin()
+	SetDraining(bool)
+	SetPriority(int)
+}
+
+// runnableSpeakerList is a SpeakerList that main starts and stops:
+// memberlist, or speaker Leases.
+type runnableSpeakerList interface {
+	SpeakerList
+	Start(*k8s.Client)
+	Stop()
 }
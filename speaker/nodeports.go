@@ -0,0 +1,72 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/config"
+)
+
+// The datapaths delivering the traffic of the announced addresses to
+// the endpoints, as given by --datapath.
+const (
+	// kube-proxy, in iptables or IPVS mode, which handles the
+	// LoadBalancer IPs themselves.
+	datapathKubeProxy = "kube-proxy"
+	// Cilium's kube-proxy replacement, which does too.
+	datapathCilium = "cilium"
+	// A datapath that only reaches services through their node
+	// ports, e.g. a proxy on the nodes forwarding the addresses to
+	// them.
+	datapathNodePort = "nodeport"
+)
+
+// checkDatapath returns an error if datapath is unknown.
+func checkDatapath(datapath string) error {
+	switch datapath {
+	case datapathKubeProxy, datapathCilium, datapathNodePort:
+		return nil
+	}
+	return fmt.Errorf("unknown datapath %q, must be one of %s, %s, %s", datapath, datapathKubeProxy, datapathCilium, datapathNodePort)
+}
+
+// missingNodePorts returns the reason not to announce svc, from pool,
+// when its traffic can't reach the endpoints because it has no node
+// ports (spec.allocateLoadBalancerNodePorts false) and datapath needs
+// them, or "" if it can.
+func missingNodePorts(datapath string, svc *v1.Service, pool *config.Pool) string {
+	if svc.Spec.AllocateLoadBalancerNodePorts == nil || *svc.Spec.AllocateLoadBalancerNodePorts {
+		return ""
+	}
+	// Node ports allocated before they were disabled are kept.
+	allocated := true
+	for _, p := range svc.Spec.Ports {
+		if p.NodePort == 0 {
+			allocated = false
+		}
+	}
+	switch {
+	case allocated:
+		return ""
+	case datapath == datapathNodePort:
+		return "noNodePorts"
+	case pool.IPMode == "Proxy":
+		// kube-proxy leaves the addresses of the Proxy ipMode to the
+		// load balancer, which can only forward to the node ports.
+		return "noNodePortsForProxy"
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/config"
+)
+
+func TestMissingNodePorts(t *testing.T) {
+	no, yes := false, true
+	svc := func(allocate *bool, nodePort int32) *v1.Service {
+		return &v1.Service{
+			Spec: v1.ServiceSpec{
+				AllocateLoadBalancerNodePorts: allocate,
+				Ports:                         []v1.ServicePort{{Port: 80, NodePort: nodePort}},
+			},
+		}
+	}
+	tests := []struct {
+		desc     string
+		datapath string
+		svc      *v1.Service
+		pool     *config.Pool
+		want     string
+	}{
+		{
+			desc:     "node ports by default",
+			datapath: datapathNodePort,
+			svc:      svc(nil, 30080),
+			pool:     &config.Pool{},
+		},
+		{
+			desc:     "node ports allocated",
+			datapath: datapathNodePort,
+			svc:      svc(&yes, 30080),
+			pool:     &config.Pool{},
+		},
+		{
+			desc:     "kube-proxy without node ports",
+			datapath: datapathKubeProxy,
+			svc:      svc(&no, 0),
+			pool:     &config.Pool{},
+		},
+		{
+			desc:     "node port datapath without node ports",
+			datapath: datapathNodePort,
+			svc:      svc(&no, 0),
+			pool:     &config.Pool{},
+			want:     "noNodePorts",
+		},
+		{
+			desc:     "node ports kept after disabling them",
+			datapath: datapathNodePort,
+			svc:      svc(&no, 30080),
+			pool:     &config.Pool{},
+		},
+		{
+			desc:     "Proxy ipMode without node ports",
+			datapath: datapathCilium,
+			svc:      svc(&no, 0),
+			pool:     &config.Pool{IPMode: "Proxy"},
+			want:     "noNodePortsForProxy",
+		},
+	}
+	for _, test := range tests {
+		if got := missingNodePorts(test.datapath, test.svc, test.pool); got != test.want {
+			t.Errorf("%s: got reason %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
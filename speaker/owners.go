@@ -0,0 +1,193 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ownerChange is a change of the nodes announcing a service, as sent
+// to the owner change webhook.
+type ownerChange struct {
+	Service  string    `json:"service"`
+	Protocol string    `json:"protocol"`
+	IP       string    `json:"ip"`
+	OldNodes []string  `json:"oldNodes"`
+	NewNodes []string  `json:"newNodes"`
+	Time     time.Time `json:"time"`
+}
+
+// ownerWebhook posts owner changes to a URL, in the background so
+// that a slow receiver doesn't hold back announcements.
+type ownerWebhook struct {
+	url    string
+	client *http.Client
+	queue  chan ownerChange
+}
+
+func newOwnerWebhook(l log.Logger, url string, stopCh <-chan struct{}) *ownerWebhook {
+	w := &ownerWebhook{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan ownerChange, 100),
+	}
+	go w.run(l, stopCh)
+	return w
+}
+
+// notify queues ch for posting, dropping it if the queue is full.
+func (w *ownerWebhook) notify(l log.Logger, ch ownerChange) {
+	select {
+	case w.queue <- ch:
+	default:
+		level.Error(l).Log("op", "ownerWebhook", "error", "queue full", "msg", "dropped owner change notification")
+	}
+}
+
+func (w *ownerWebhook) run(l log.Logger, stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case ch := <-w.queue:
+			if err := w.post(ch); err != nil {
+				level.Error(l).Log("op", "ownerWebhook", "service", ch.Service, "error", err, "msg", "failed to post owner change notification")
+			}
+		}
+	}
+}
+
+func (w *ownerWebhook) post(ch ownerChange) error {
+	bs, err := json.Marshal(ch)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// trackOwners records the nodes announcing the service name, as
+// reported by its protocol handler, and reports their changes with
+// an event and the webhook. owners is nil if they are unknown.
+//
+// All the speakers see the change, but only one reports it, see
+// ownerReporter.
+func (c *controller) trackOwners(l log.Logger, name string, svc *v1.Service, ip string, proto string, owners []string) {
+	prev, known := c.owners[name]
+	if owners == nil {
+		c.forgetOwners(l, name)
+		return
+	}
+	c.owners[name] = owners
+	if c.alerts != nil && len(owners) > 0 {
+		// The speaker that fired the alert may not be the one that
+		// sees the service announced again first, so all of them
+		// resolve it.
+		c.alerts.Set(l, notAnnouncedAlert(name, ip), false)
+	}
+	if !known || sameNodes(prev, owners) {
+		return
+	}
+
+	if c.ownerReporter(prev, owners) != c.myNode {
+		return
+	}
+	level.Info(l).Log("event", "ownerChanged", "oldNodes", strings.Join(prev, ","), "newNodes", strings.Join(owners, ","), "msg", "announcing nodes changed")
+	c.client.Infof(svc, "ownerChanged", "announcing nodes changed from %s to %s", nodeList(prev), nodeList(owners))
+	if c.ownerWebhook != nil {
+		c.ownerWebhook.notify(l, ownerChange{
+			Service:  name,
+			Protocol: proto,
+			IP:       ip,
+			OldNodes: prev,
+			NewNodes: owners,
+			Time:     time.Now(),
+		})
+	}
+	if c.alerts != nil && len(owners) == 0 {
+		c.alerts.Set(l, notAnnouncedAlert(name, ip), true)
+	}
+}
+
+// ownerReporter returns the node that reports the change of the
+// owners of a service from prev to owners: the first previous owner
+// that is still alive, or else the first new owner, or else the first
+// previous one if no node announces the service anymore.
+//
+// The previous owners go first because they know the history of the
+// service, while a new owner may have just started, e.g. when the
+// service fails back to a restarted node, and not know whom it takes
+// over from.
+func (c *controller) ownerReporter(prev, owners []string) string {
+	if c.sList != nil {
+		if alive := c.sList.UsableSpeakers(); alive != nil {
+			for _, n := range prev {
+				if _, ok := alive[n]; ok {
+					return n
+				}
+			}
+		}
+	}
+	if len(owners) > 0 {
+		return owners[0]
+	}
+	if len(prev) > 0 {
+		return prev[0]
+	}
+	return ""
+}
+
+// forgetOwners drops the nodes announcing the service name, and
+// resolves its alert, once it isn't announced anymore or unknown.
+func (c *controller) forgetOwners(l log.Logger, name string) {
+	delete(c.owners, name)
+	if c.alerts != nil {
+		c.alerts.Set(l, notAnnouncedAlert(name, ""), false)
+	}
+}
+
+func sameNodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeList formats nodes for events.
+func nodeList(nodes []string) string {
+	if len(nodes) == 0 {
+		return "no node"
+	}
+	return fmt.Sprintf("%q", strings.Join(nodes, ","))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+
+	"go.universe.tf/metallb/internal/alert"
+)
+
+type fakeAlerter struct {
+	firing map[string]bool
+}
+
+func (f *fakeAlerter) Set(_ log.Logger, a alert.Alert, firing bool) {
+	f.firing[a.Name+"/"+a.Labels["service"]] = firing
+}
+
+func TestTrackOwners(t *testing.T) {
+	got := make(chan ownerChange, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ch ownerChange
+		if err := json.NewDecoder(r.Body).Decode(&ch); err != nil {
+			t.Errorf("decoding notification: %s", err)
+		}
+		got <- ch
+	}))
+	defer srv.Close()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	l := log.NewNopLogger()
+	k := &testK8S{t: t}
+	c := &controller{
+		myNode:       "iris2",
+		client:       k,
+		owners:       map[string][]string{},
+		ownerWebhook: newOwnerWebhook(l, srv.URL, stopCh),
+	}
+	a := &fakeAlerter{firing: map[string]bool{}}
+	c.alerts = a
+	svc := &v1.Service{}
+	sList := &fakeSpeakerList{}
+	c.sList = sList
+
+	steps := []struct {
+		desc   string
+		owners []string
+		// The live speakers, nil if unknown.
+		alive map[string]bool
+		want  []string
+		alert bool
+	}{
+		{
+			desc:   "first sight",
+			owners: []string{"iris1"},
+		},
+		{
+			desc:   "unchanged",
+			owners: []string{"iris1"},
+		},
+		{
+			desc:   "failover to this node",
+			owners: []string{"iris2"},
+			want:   []string{`ownerChanged: announcing nodes changed from "iris1" to "iris2"`},
+		},
+		{
+			desc:   "failback, reported by the new owner",
+			owners: []string{"iris1"},
+		},
+		{
+			desc:   "failover to this node again",
+			owners: []string{"iris2"},
+			alive:  map[string]bool{"iris2": true},
+			want:   []string{`ownerChanged: announcing nodes changed from "iris1" to "iris2"`},
+		},
+		{
+			desc:   "failback to a restarted node, reported by the previous owner",
+			owners: []string{"iris1"},
+			alive:  map[string]bool{"iris1": true, "iris2": true},
+			want:   []string{`ownerChanged: announcing nodes changed from "iris2" to "iris1"`},
+		},
+		{
+			desc:   "unknown owners",
+			owners: nil,
+		},
+		{
+			desc:   "known again",
+			owners: []string{"iris2", "iris3"},
+		},
+		{
+			desc:   "no owner left",
+			owners: []string{},
+			want:   []string{`ownerChanged: announcing nodes changed from "iris2,iris3" to no node`},
+			alert:  true,
+		},
+		{
+			desc:   "announced again, by another node",
+			owners: []string{"iris1"},
+		},
+	}
+	for _, step := range steps {
+		k.infos = nil
+		sList.speakers = step.alive
+		c.trackOwners(l, "test1", svc, "10.20.30.1", "layer2", step.owners)
+		if diff := cmp.Diff(step.want, k.infos); diff != "" {
+			t.Errorf("%s: unexpected events (-want +got)\n%s", step.desc, diff)
+		}
+		if got := a.firing["MetalLBServiceNotAnnounced/test1"]; got != step.alert {
+			t.Errorf("%s: got not announced alert firing %v, want %v", step.desc, got, step.alert)
+		}
+	}
+
+	for _, want := range []ownerChange{
+		{Service: "test1", Protocol: "layer2", IP: "10.20.30.1", OldNodes: []string{"iris1"}, NewNodes: []string{"iris2"}},
+		{Service: "test1", Protocol: "layer2", IP: "10.20.30.1", OldNodes: []string{"iris1"}, NewNodes: []string{"iris2"}},
+		{Service: "test1", Protocol: "layer2", IP: "10.20.30.1", OldNodes: []string{"iris2"}, NewNodes: []string{"iris1"}},
+		{Service: "test1", Protocol: "layer2", IP: "10.20.30.1", OldNodes: []string{"iris2", "iris3"}, NewNodes: []string{}},
+	} {
+		select {
+		case ch := <-got:
+			ch.Time = time.Time{}
+			if diff := cmp.Diff(want, ch); diff != "" {
+				t.Errorf("unexpected notification (-want +got)\n%s", diff)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("webhook not notified")
+		}
+	}
+}
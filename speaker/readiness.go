@@ -0,0 +1,156 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	v1 "k8s.io/api/core/v1"
+)
+
+// networkReadiness holds back the first announcements of the speaker
+// until the node can forward the traffic they attract. Once all its
+// checks pass, or the timeout expires, it stays ready.
+type networkReadiness struct {
+	checks  []readinessCheck
+	timeout time.Duration
+
+	mu    sync.Mutex
+	ready bool
+	node  *v1.Node
+}
+
+// A readinessCheck returns an error if the node can't forward
+// traffic yet.
+type readinessCheck struct {
+	name  string
+	check func(node *v1.Node) error
+}
+
+// newNetworkReadiness returns a networkReadiness running the named
+// checks. kubeProxyURL is the health endpoint of kube-proxy.
+func newNetworkReadiness(names []string, kubeProxyURL string, timeout time.Duration) (*networkReadiness, error) {
+	r := &networkReadiness{timeout: timeout}
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "node-network":
+			r.checks = append(r.checks, readinessCheck{"node-network", checkNodeNetwork})
+		case "kube-proxy":
+			client := &http.Client{Timeout: 2 * time.Second}
+			r.checks = append(r.checks, readinessCheck{"kube-proxy", func(*v1.Node) error {
+				return checkHealthz(client, kubeProxyURL)
+			}})
+		default:
+			return nil, fmt.Errorf("unknown readiness check %q, must be one of: node-network, kube-proxy", name)
+		}
+	}
+	return r, nil
+}
+
+// Ready returns true if the speaker can announce services.
+func (r *networkReadiness) Ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
+
+// SetNode records the latest state of the speaker's node.
+func (r *networkReadiness) SetNode(node *v1.Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.node = node
+}
+
+// check runs all the checks, and returns the first failure.
+func (r *networkReadiness) check() error {
+	r.mu.Lock()
+	node := r.node
+	r.mu.Unlock()
+	for _, c := range r.checks {
+		if err := c.check(node); err != nil {
+			return fmt.Errorf("%s: %s", c.name, err)
+		}
+	}
+	return nil
+}
+
+// Run polls the checks until they all pass or the timeout expires,
+// then marks the speaker ready and calls done.
+func (r *networkReadiness) Run(l log.Logger, stopCh <-chan struct{}, done func()) {
+	deadline := time.Now().Add(r.timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		err := r.check()
+		if err == nil {
+			level.Info(l).Log("event", "networkReady", "msg", "node networking ready, starting announcements")
+			break
+		}
+		if r.timeout > 0 && time.Now().After(deadline) {
+			level.Warn(l).Log("event", "networkReady", "error", err, "msg", "node networking still not ready, starting announcements anyway")
+			break
+		}
+		level.Debug(l).Log("event", "networkNotReady", "error", err, "msg", "waiting for node networking")
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	r.mu.Lock()
+	r.ready = true
+	r.mu.Unlock()
+	done()
+}
+
+// checkNodeNetwork checks that the node is Ready, and that its
+// network plugin didn't flag the network as unavailable.
+func checkNodeNetwork(node *v1.Node) error {
+	if node == nil {
+		return errors.New("node not seen yet")
+	}
+	ready := false
+	for _, c := range node.Status.Conditions {
+		switch {
+		case c.Type == v1.NodeNetworkUnavailable && c.Status == v1.ConditionTrue:
+			return fmt.Errorf("node network unavailable: %s", c.Message)
+		case c.Type == v1.NodeReady:
+			ready = c.Status == v1.ConditionTrue
+		}
+	}
+	if !ready {
+		return errors.New("node not ready")
+	}
+	return nil
+}
+
+// checkHealthz checks that the health endpoint at url is healthy.
+func checkHealthz(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
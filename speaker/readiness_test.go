@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.universe.tf/metallb/internal/bgp"
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/k8s"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func nodeWithConditions(conds ...v1.NodeCondition) *v1.Node {
+	return &v1.Node{
+		Status: v1.NodeStatus{
+			Conditions: conds,
+		},
+	}
+}
+
+func TestCheckNodeNetwork(t *testing.T) {
+	tests := []struct {
+		desc    string
+		node    *v1.Node
+		wantErr bool
+	}{
+		{
+			desc:    "node not seen yet",
+			wantErr: true,
+		},
+		{
+			desc:    "no conditions",
+			node:    nodeWithConditions(),
+			wantErr: true,
+		},
+		{
+			desc: "node not ready",
+			node: nodeWithConditions(
+				v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionFalse},
+			),
+			wantErr: true,
+		},
+		{
+			desc: "network unavailable",
+			node: nodeWithConditions(
+				v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue},
+				v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue},
+			),
+			wantErr: true,
+		},
+		{
+			desc: "node ready",
+			node: nodeWithConditions(
+				v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionFalse},
+				v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue},
+			),
+		},
+	}
+	for _, test := range tests {
+		if err := checkNodeNetwork(test.node); (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestCheckHealthz(t *testing.T) {
+	healthy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	r, err := newNetworkReadiness([]string{"kube-proxy"}, srv.URL, 0)
+	if err != nil {
+		t.Fatalf("newNetworkReadiness: %s", err)
+	}
+	if err := r.check(); err != nil {
+		t.Errorf("healthy kube-proxy failed the check: %s", err)
+	}
+	healthy = false
+	if err := r.check(); err == nil {
+		t.Error("unhealthy kube-proxy passed the check")
+	}
+
+	if _, err := newNetworkReadiness([]string{"cni"}, srv.URL, 0); err == nil {
+		t.Error("unknown readiness check accepted")
+	}
+}
+
+func TestNetworkReadiness(t *testing.T) {
+	b := &fakeBGP{
+		t:      t,
+		gotAds: map[string][]*bgp.Advertisement{},
+	}
+	newBGP = b.New
+	c, err := newController(controllerConfig{
+		MyNode:        "pandora",
+		DisableLayer2: true,
+	})
+	if err != nil {
+		t.Fatalf("creating controller: %s", err)
+	}
+	c.client = &testK8S{t: t}
+	c.readiness, err = newNetworkReadiness([]string{"node-network"}, "", time.Minute)
+	if err != nil {
+		t.Fatalf("newNetworkReadiness: %s", err)
+	}
+
+	l := log.NewNopLogger()
+	cfg := &config.Config{
+		Peers: []*config.Peer{
+			{
+				Addr:          net.ParseIP("1.2.3.4"),
+				NodeSelectors: []labels.Selector{labels.Everything()},
+			},
+		},
+		Pools: map[string]*config.Pool{
+			"default": {
+				Protocol: config.BGP,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.0/24")},
+				BGPAdvertisements: []*config.BGPAdvertisement{
+					{
+						AggregationLength: 32,
+					},
+				},
+			},
+		},
+	}
+	if c.SetConfig(l, cfg) == k8s.SyncStateError {
+		t.Fatalf("SetConfig failed")
+	}
+	svc := &v1.Service{
+		Spec: v1.ServiceSpec{
+			Type:                  "LoadBalancer",
+			ExternalTrafficPolicy: "Cluster",
+		},
+		Status: statusAssigned("10.20.30.1"),
+	}
+	eps := k8s.EpsOrSlices{
+		EpVal: &v1.Endpoints{
+			Subsets: []v1.EndpointSubset{
+				{
+					Addresses: []v1.EndpointAddress{
+						{
+							IP:       "2.3.4.5",
+							NodeName: strptr("iris"),
+						},
+					},
+				},
+			},
+		},
+		Type: k8s.Eps,
+	}
+
+	if c.SetNode(l, nodeWithConditions(v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionFalse})) == k8s.SyncStateError {
+		t.Fatal("SetNode failed")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	if diff := cmp.Diff(map[string][]*bgp.Advertisement{"1.2.3.4:0": nil}, b.Ads()); diff != "" {
+		t.Errorf("announced before node networking was ready (-want +got)\n%s", diff)
+	}
+
+	if c.SetNode(l, nodeWithConditions(v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue})) == k8s.SyncStateError {
+		t.Fatal("SetNode failed")
+	}
+	synced := false
+	c.readiness.Run(l, nil, func() { synced = true })
+	if !synced {
+		t.Fatal("readiness didn't ask to reprocess services once ready")
+	}
+	if c.SetBalancer(l, "test1", svc, eps) == k8s.SyncStateError {
+		t.Fatal("SetBalancer failed")
+	}
+	want := map[string][]*bgp.Advertisement{
+		"1.2.3.4:0": {
+			{
+				Prefix: ipnet("10.20.30.1/32"),
+			},
+		},
+	}
+	if diff := cmp.Diff(want, b.Ads()); diff != "" {
+		t.Errorf("unexpected advertisement state once ready (-want +got)\n%s", diff)
+	}
+}
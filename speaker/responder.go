@@ -0,0 +1,82 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/layer2"
+	"go.universe.tf/metallb/internal/linkwatch"
+)
+
+// serveLayer2Responder runs the layer2 responder helper: it answers
+// ARP and NDP for the IPs the speaker connected on path asks for, so
+// that only the helper needs raw socket privileges. It returns on
+// SIGINT or SIGTERM. If xdp is true, it answers in the kernel.
+func serveLayer2Responder(l log.Logger, path string, xdp bool) error {
+	cacheStop := make(chan struct{})
+	defer close(cacheStop)
+	var intfs linkwatch.Interfaces
+	if cache, err := linkwatch.NewCache(l, cacheStop); err != nil {
+		level.Error(l).Log("op", "startup", "error", err, "msg", "failed to cache network interfaces, listing them every time")
+	} else {
+		intfs = cache
+	}
+
+	a, err := newLayer2(l, xdp, intfs)
+	if err != nil {
+		return fmt.Errorf("making layer2 announcer: %s", err)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing stale socket %q: %s", path, err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	// The speaker runs as a different, unprivileged user. The socket
+	// lives in a volume private to the pod.
+	if err := os.Chmod(path, 0666); err != nil {
+		ln.Close()
+		return fmt.Errorf("setting socket permissions: %s", err)
+	}
+
+	stopCh := make(chan struct{})
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+		<-c
+		signal.Stop(c)
+		close(stopCh)
+		ln.Close()
+	}()
+
+	level.Info(l).Log("op", "layer2Responder", "socket", path, "msg", "serving layer2 responder")
+	if err := layer2.Serve(l, a, ln); err != nil {
+		select {
+		case <-stopCh:
+		default:
+			return err
+		}
+	}
+	level.Info(l).Log("op", "shutdown", "msg", "layer2 responder stopped")
+	return nil
+}
@@ -0,0 +1,183 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/layer2"
+)
+
+var (
+	selfTestOwner = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "speaker",
+		Name:      "self_test_owner",
+		Help:      "1 if this node announces the self-test canary IP.",
+	})
+	selfTestSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "metallb",
+		Subsystem: "speaker",
+		Name:      "self_test_success",
+		Help:      "1 if the last probe of the self-test canary IP from this node succeeded, 0 if it failed.",
+	})
+	selfTestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "metallb",
+		Subsystem: "speaker",
+		Name:      "self_test_probe_duration_seconds",
+		Help:      "Time taken by the probes of the self-test canary IP from this node.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	})
+)
+
+// selfTestName is the name the self-test canary is announced and
+// elected under.
+const selfTestName = "metallb-system/self-test"
+
+// selfTest continuously tests the layer2 announcements end to end:
+// one speaker, elected like for a service, announces a canary IP
+// from the test pool, and all the others probe it from their node.
+type selfTest struct {
+	pool      string
+	myNode    string
+	sList     SpeakerList
+	announcer layer2.Announcer
+	// probe returns an error if ip doesn't resolve.
+	probe func(ip net.IP) error
+
+	mu     sync.Mutex
+	canary net.IP
+	// The canary this node announces, if any.
+	announced net.IP
+}
+
+// SetConfig picks the canary from the test pool of cfg.
+func (s *selfTest) SetConfig(l log.Logger, cfg *config.Config) {
+	var canary net.IP
+	switch p := cfg.Pools[s.pool]; {
+	case p == nil:
+		level.Error(l).Log("op", "selfTest", "pool", s.pool, "msg", "self-test pool not found, not running the self-test")
+	case p.Protocol != config.Layer2:
+		level.Error(l).Log("op", "selfTest", "pool", s.pool, "msg", "self-test pool is not a layer2 pool, not running the self-test")
+	default:
+		canary = p.CIDR[0].IP
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canary = canary
+}
+
+// Run runs the self-test every interval, until stopCh is closed.
+func (s *selfTest) Run(l log.Logger, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			s.withdraw()
+			return
+		case <-ticker.C:
+			s.check(l)
+		}
+	}
+}
+
+// owner returns the speaker elected to announce the canary.
+func (s *selfTest) owner() string {
+	var nodes []string
+	for node, ready := range s.sList.UsableSpeakers() {
+		if ready {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return ""
+	}
+	sortNodes(nodes, selfTestName, s.sList.Priorities())
+	return nodes[0]
+}
+
+// check runs one round of the self-test.
+func (s *selfTest) check(l log.Logger) {
+	s.mu.Lock()
+	canary := s.canary
+	s.mu.Unlock()
+	owner := s.owner()
+	if canary == nil || owner != s.myNode || !canary.Equal(s.announced) {
+		s.withdraw()
+	}
+	if canary == nil {
+		return
+	}
+
+	switch owner {
+	case "":
+		level.Warn(l).Log("op", "selfTest", "msg", "no usable speakers to announce the canary, self-test requires memberlist")
+	case s.myNode:
+		// The owner doesn't probe, its last probe is stale.
+		selfTestOwner.Set(1)
+		selfTestSuccess.Set(0)
+		if s.announced == nil {
+			s.announcer.SetBalancer(selfTestName, canary, nil)
+			s.announced = canary
+			level.Info(l).Log("event", "selfTestOwner", "ip", canary, "msg", "announcing self-test canary")
+		}
+	default:
+		selfTestOwner.Set(0)
+		start := time.Now()
+		err := s.probe(canary)
+		selfTestDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			selfTestSuccess.Set(0)
+			level.Error(l).Log("op", "selfTest", "ip", canary, "owner", owner, "error", err, "msg", "self-test canary unreachable")
+			return
+		}
+		selfTestSuccess.Set(1)
+		level.Debug(l).Log("event", "selfTestPassed", "ip", canary, "owner", owner, "msg", "self-test canary reachable")
+	}
+}
+
+// withdraw stops announcing the canary, if this node does.
+func (s *selfTest) withdraw() {
+	if s.announced == nil {
+		return
+	}
+	s.announcer.DeleteBalancer(selfTestName)
+	s.announced = nil
+}
+
+// startSelfTest runs the self-test on the test pool every interval,
+// until stopCh is closed.
+func (c *controller) startSelfTest(l log.Logger, pool string, interval time.Duration, stopCh <-chan struct{}) {
+	l2, ok := c.protocols[config.Layer2].(*layer2Controller)
+	if !ok {
+		return
+	}
+	c.selfTest = &selfTest{
+		pool:      pool,
+		myNode:    c.myNode,
+		sList:     c.sList,
+		announcer: l2.announcer,
+		probe: func(ip net.IP) error {
+			return layer2.Probe(ip, 3*time.Second)
+		},
+	}
+	go c.selfTest.Run(l, interval, stopCh)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"go.universe.tf/metallb/internal/config"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeAnnouncer struct {
+	ips map[string]net.IP
+}
+
+func (a *fakeAnnouncer) SetBalancer(name string, ip net.IP, _ []string) { a.ips[name] = ip }
+func (a *fakeAnnouncer) DeleteBalancer(name string)                     { delete(a.ips, name) }
+func (a *fakeAnnouncer) LinkUp(string)                                  {}
+func (a *fakeAnnouncer) Interfaces(string) []string                     { return nil }
+func (a *fakeAnnouncer) AnnounceName(name string) bool {
+	_, ok := a.ips[name]
+	return ok
+}
+
+func TestSelfTest(t *testing.T) {
+	l := log.NewNopLogger()
+	sList := &fakeSpeakerList{
+		speakers:   map[string]bool{"iris": true, "pandora": true},
+		priorities: map[string]int{"iris": 0, "pandora": 1},
+	}
+	var (
+		probed   []string
+		probeErr error
+	)
+	newTest := func(node string) (*selfTest, *fakeAnnouncer) {
+		a := &fakeAnnouncer{ips: map[string]net.IP{}}
+		return &selfTest{
+			pool:      "test",
+			myNode:    node,
+			sList:     sList,
+			announcer: a,
+			probe: func(ip net.IP) error {
+				probed = append(probed, node+" "+ip.String())
+				return probeErr
+			},
+		}, a
+	}
+	iris, irisAnn := newTest("iris")
+	pandora, pandoraAnn := newTest("pandora")
+	cfg := &config.Config{
+		Pools: map[string]*config.Pool{
+			"test": {
+				Protocol: config.Layer2,
+				CIDR:     []*net.IPNet{ipnet("10.20.30.40/32")},
+			},
+		},
+	}
+	iris.SetConfig(l, cfg)
+	pandora.SetConfig(l, cfg)
+
+	// The speakers share the metrics here, so the success is read
+	// right after each of them runs.
+	check := func(desc string, wantIris, wantPandora map[string]net.IP, wantProbed []string, wantIrisSuccess, wantPandoraSuccess float64) {
+		t.Helper()
+		probed = nil
+		iris.check(l)
+		irisSuccess := testutil.ToFloat64(selfTestSuccess)
+		pandora.check(l)
+		pandoraSuccess := testutil.ToFloat64(selfTestSuccess)
+		if diff := cmp.Diff(wantIris, irisAnn.ips); diff != "" {
+			t.Errorf("%s: wrong announcements of iris (-want +got)\n%s", desc, diff)
+		}
+		if diff := cmp.Diff(wantPandora, pandoraAnn.ips); diff != "" {
+			t.Errorf("%s: wrong announcements of pandora (-want +got)\n%s", desc, diff)
+		}
+		if diff := cmp.Diff(wantProbed, probed); diff != "" {
+			t.Errorf("%s: wrong probes (-want +got)\n%s", desc, diff)
+		}
+		if wantProbed != nil && (irisSuccess != wantIrisSuccess || pandoraSuccess != wantPandoraSuccess) {
+			t.Errorf("%s: got self-test success %v on iris and %v on pandora, want %v and %v", desc, irisSuccess, pandoraSuccess, wantIrisSuccess, wantPandoraSuccess)
+		}
+	}
+
+	canary := map[string]net.IP{selfTestName: net.ParseIP("10.20.30.40")}
+	none := map[string]net.IP{}
+	check("iris owns the canary", canary, none, []string{"pandora 10.20.30.40"}, 0, 1)
+
+	probeErr = errors.New("timeout")
+	check("canary unreachable", canary, none, []string{"pandora 10.20.30.40"}, 0, 0)
+
+	probeErr = nil
+	sList.priorities = map[string]int{"iris": 1, "pandora": 0}
+	// The new owner doesn't keep the success of its last probe.
+	check("pandora takes over", none, canary, []string{"iris 10.20.30.40"}, 1, 0)
+
+	cfg.Pools["test"].Protocol = config.BGP
+	iris.SetConfig(l, cfg)
+	pandora.SetConfig(l, cfg)
+	check("BGP test pool", none, none, nil, 0, 0)
+}
@@ -0,0 +1,182 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/snmp"
+)
+
+// Objects of BGP4-MIB (RFC 4273) and CISCO-BGP4-MIB exported over
+// SNMP.
+var (
+	oidBGPVersion = snmp.MustParseOID("1.3.6.1.2.1.15.1.0")
+	oidBGPLocalAS = snmp.MustParseOID("1.3.6.1.2.1.15.2.0")
+	// Columns of bgpPeerEntry, indexed by the peer's address.
+	oidBGPPeerEntry = snmp.MustParseOID("1.3.6.1.2.1.15.3.1")
+	// cbgpPeerAdvertisedPrefixes, indexed by the peer's address, AFI
+	// and SAFI.
+	oidAdvertisedPrefixes = snmp.MustParseOID("1.3.6.1.4.1.9.9.187.1.2.4.1.6")
+)
+
+const (
+	bgpPeerState             = 2
+	bgpPeerAdminStatus       = 3
+	bgpPeerNegotiatedVersion = 4
+	bgpPeerRemoteAddr        = 7
+	bgpPeerRemotePort        = 8
+	bgpPeerRemoteAs          = 9
+	bgpPeerOutUpdates        = 11
+
+	bgpStateConnect     = 2
+	bgpStateEstablished = 6
+	bgpAdminStart       = 2
+
+	// AS_TRANS (RFC 6793), in place of 4-byte ASNs, which BGP4-MIB
+	// can't represent.
+	asTrans = 23456
+)
+
+// startSNMP runs an SNMP agent exporting the state of the BGP
+// sessions on addr, until stopCh is closed.
+func (c *controller) startSNMP(l log.Logger, addr, community string, stopCh <-chan struct{}) error {
+	b := c.protocols[config.BGP].(*bgpController)
+	if community == "" {
+		community = "public"
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	a := &snmp.Agent{
+		Logger:    l,
+		Community: community,
+		MIB:       func() []snmp.Var { return b.snmpMIB(prometheus.DefaultGatherer) },
+	}
+	go func() {
+		<-stopCh
+		conn.Close()
+	}()
+	go func() {
+		if err := a.Serve(conn); err != nil {
+			level.Info(l).Log("op", "snmp", "error", err, "msg", "SNMP agent stopped")
+		}
+	}()
+	return nil
+}
+
+// snmpMIB returns the SNMP view of the BGP sessions, from their
+// metrics in g. Only the sessions with IPv4 peers are included, as
+// BGP4-MIB has no room for IPv6 addresses.
+func (c *bgpController) snmpMIB(g prometheus.Gatherer) []snmp.Var {
+	type session struct {
+		up, updates, prefixes float64
+	}
+	sessions := map[string]*session{}
+	families, _ := g.Gather()
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var addr string
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "peer" {
+					addr = lp.GetValue()
+				}
+			}
+			if addr == "" {
+				continue
+			}
+			s := sessions[addr]
+			if s == nil {
+				s = &session{}
+				sessions[addr] = s
+			}
+			switch f.GetName() {
+			case "metallb_bgp_session_up":
+				s.up = m.GetGauge().GetValue()
+			case "metallb_bgp_updates_total":
+				s.updates = m.GetCounter().GetValue()
+			case "metallb_bgp_announced_prefixes_total":
+				s.prefixes = m.GetGauge().GetValue()
+			}
+		}
+	}
+
+	c.peersMu.Lock()
+	defer c.peersMu.Unlock()
+	ret := []snmp.Var{{OID: oidBGPVersion, Value: []byte{0x10}}}
+	if len(c.peers) > 0 {
+		ret = append(ret, snmp.Var{OID: oidBGPLocalAS, Value: mibASN(c.peers[0].cfg.MyASN)})
+	}
+	seen := map[string]bool{}
+	for addr, s := range sessions {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host).To4()
+		portNum, err := strconv.Atoi(port)
+		if ip == nil || err != nil || seen[ip.String()] {
+			continue
+		}
+		p := c.peerFor(ip)
+		if p == nil {
+			continue
+		}
+		seen[ip.String()] = true
+		idx := []uint32{uint32(ip[0]), uint32(ip[1]), uint32(ip[2]), uint32(ip[3])}
+		state, version := bgpStateConnect, 0
+		if s.up == 1 {
+			state, version = bgpStateEstablished, 4
+		}
+		entry := func(col uint32, v interface{}) {
+			ret = append(ret, snmp.Var{OID: oidBGPPeerEntry.Append(col).Append(idx...), Value: v})
+		}
+		entry(bgpPeerState, state)
+		entry(bgpPeerAdminStatus, bgpAdminStart)
+		entry(bgpPeerNegotiatedVersion, version)
+		entry(bgpPeerRemoteAddr, ip)
+		entry(bgpPeerRemotePort, portNum)
+		entry(bgpPeerRemoteAs, mibASN(p.cfg.ASN))
+		entry(bgpPeerOutUpdates, snmp.Counter32(s.updates))
+		ret = append(ret, snmp.Var{OID: oidAdvertisedPrefixes.Append(idx...).Append(1, 1), Value: snmp.Gauge32(s.prefixes)})
+	}
+	return ret
+}
+
+// peerFor returns the peer that has a session with ip, nil if none.
+// c.peersMu must be held.
+func (c *bgpController) peerFor(ip net.IP) *peer {
+	for _, p := range c.peers {
+		if p.bgp == nil {
+			continue
+		}
+		if p.addr.Equal(ip) || (p.cfg.AddrRange != nil && p.cfg.AddrRange.Contains(ip)) {
+			return p
+		}
+	}
+	return nil
+}
+
+func mibASN(asn uint32) int {
+	if asn > 65535 {
+		return asTrans
+	}
+	return int(asn)
+}
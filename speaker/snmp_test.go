@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/snmp"
+)
+
+func TestSNMPMIB(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "metallb_bgp_session_up"}, []string{"peer"})
+	updates := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "metallb_bgp_updates_total"}, []string{"peer"})
+	prefixes := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "metallb_bgp_announced_prefixes_total"}, []string{"peer"})
+	reg.MustRegister(up, updates, prefixes)
+
+	up.WithLabelValues("10.0.0.1:179").Set(1)
+	updates.WithLabelValues("10.0.0.1:179").Add(12)
+	prefixes.WithLabelValues("10.0.0.1:179").Set(3)
+	// Down session.
+	up.WithLabelValues("10.0.0.2:179").Set(0)
+	// Dynamic neighbor, with a 4-byte ASN.
+	up.WithLabelValues("10.1.0.7:43210").Set(1)
+	// IPv6 peers don't fit in BGP4-MIB.
+	up.WithLabelValues("[2001:db8::1]:179").Set(1)
+
+	b := &fakeBGP{t: t}
+	sess := &fakeSession{f: b}
+	c := &bgpController{
+		peers: []*peer{
+			{cfg: &config.Peer{MyASN: 64500, ASN: 64501}, addr: net.ParseIP("10.0.0.1"), bgp: sess},
+			{cfg: &config.Peer{MyASN: 64500, ASN: 64502}, addr: net.ParseIP("10.0.0.2"), bgp: sess},
+			{cfg: &config.Peer{MyASN: 64500, ASN: 4200000000, AddrRange: ipnet("10.1.0.0/24")}, addr: net.ParseIP("10.1.0.0"), bgp: sess},
+			{cfg: &config.Peer{MyASN: 64500, ASN: 64503}, addr: net.ParseIP("2001:db8::1"), bgp: sess},
+		},
+	}
+
+	got := map[string]interface{}{}
+	for _, v := range c.snmpMIB(reg) {
+		got[v.OID.String()] = v.Value
+	}
+	want := map[string]interface{}{
+		"1.3.6.1.2.1.15.1.0": []byte{0x10},
+		"1.3.6.1.2.1.15.2.0": 64500,
+
+		"1.3.6.1.2.1.15.3.1.2.10.0.0.1":              6,
+		"1.3.6.1.2.1.15.3.1.3.10.0.0.1":              2,
+		"1.3.6.1.2.1.15.3.1.4.10.0.0.1":              4,
+		"1.3.6.1.2.1.15.3.1.7.10.0.0.1":              net.ParseIP("10.0.0.1").To4(),
+		"1.3.6.1.2.1.15.3.1.8.10.0.0.1":              179,
+		"1.3.6.1.2.1.15.3.1.9.10.0.0.1":              64501,
+		"1.3.6.1.2.1.15.3.1.11.10.0.0.1":             snmp.Counter32(12),
+		"1.3.6.1.4.1.9.9.187.1.2.4.1.6.10.0.0.1.1.1": snmp.Gauge32(3),
+		"1.3.6.1.2.1.15.3.1.2.10.0.0.2":              2,
+		"1.3.6.1.2.1.15.3.1.3.10.0.0.2":              2,
+		"1.3.6.1.2.1.15.3.1.4.10.0.0.2":              0,
+		"1.3.6.1.2.1.15.3.1.7.10.0.0.2":              net.ParseIP("10.0.0.2").To4(),
+		"1.3.6.1.2.1.15.3.1.8.10.0.0.2":              179,
+		"1.3.6.1.2.1.15.3.1.9.10.0.0.2":              64502,
+		"1.3.6.1.2.1.15.3.1.11.10.0.0.2":             snmp.Counter32(0),
+		"1.3.6.1.4.1.9.9.187.1.2.4.1.6.10.0.0.2.1.1": snmp.Gauge32(0),
+		"1.3.6.1.2.1.15.3.1.2.10.1.0.7":              6,
+		"1.3.6.1.2.1.15.3.1.3.10.1.0.7":              2,
+		"1.3.6.1.2.1.15.3.1.4.10.1.0.7":              4,
+		"1.3.6.1.2.1.15.3.1.7.10.1.0.7":              net.ParseIP("10.1.0.7").To4(),
+		"1.3.6.1.2.1.15.3.1.8.10.1.0.7":              43210,
+		"1.3.6.1.2.1.15.3.1.9.10.1.0.7":              23456,
+		"1.3.6.1.2.1.15.3.1.11.10.1.0.7":             snmp.Counter32(0),
+		"1.3.6.1.4.1.9.9.187.1.2.4.1.6.10.1.0.7.1.1": snmp.Gauge32(0),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("wrong MIB (-want +got)\n%s", diff)
+	}
+}
@@ -0,0 +1,163 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/config"
+	"go.universe.tf/metallb/internal/layer2"
+)
+
+// staticVIPs announces the static VIPs of the config in layer2 mode:
+// for each of them, one speaker, the first usable of its nodes, or
+// elected like for a service if it has none, answers ARP and NDP.
+type staticVIPs struct {
+	myNode    string
+	sList     SpeakerList
+	announcer layer2.Announcer
+	// Wakes up Run when the config changes.
+	changed chan struct{}
+
+	mu   sync.Mutex
+	vips []*config.StaticVIP
+	// The VIPs this node announces, by announcement name.
+	announced map[string]net.IP
+}
+
+func newStaticVIPs(myNode string, sList SpeakerList, announcer layer2.Announcer) *staticVIPs {
+	return &staticVIPs{
+		myNode:    myNode,
+		sList:     sList,
+		announcer: announcer,
+		changed:   make(chan struct{}, 1),
+		announced: map[string]net.IP{},
+	}
+}
+
+// staticVIPName returns the announcement name of a static VIP,
+// distinct from any service name.
+func staticVIPName(ip net.IP) string {
+	return "static-vip/" + ip.String()
+}
+
+// SetConfig picks the static VIPs of cfg.
+func (s *staticVIPs) SetConfig(cfg *config.Config) {
+	s.mu.Lock()
+	s.vips = cfg.StaticVIPs
+	s.mu.Unlock()
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run keeps the announcements of the static VIPs up to date with the
+// config and the usable speakers, until stopCh is closed.
+func (s *staticVIPs) Run(l log.Logger, stopCh <-chan struct{}) {
+	// The usable speakers change without any event, re-elect the
+	// owners regularly.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			s.withdrawAll()
+			return
+		case <-s.changed:
+		case <-ticker.C:
+		}
+		s.sync(l)
+	}
+}
+
+// owner returns the speaker elected to announce vip, "" if none is.
+func (s *staticVIPs) owner(vip *config.StaticVIP, speakers map[string]bool) string {
+	if len(vip.Nodes) > 0 {
+		for _, n := range vip.Nodes {
+			// Without a list of speakers, the first node is assumed
+			// to be up.
+			if speakers == nil || speakers[n] {
+				return n
+			}
+		}
+		return ""
+	}
+
+	var nodes []string
+	for node, ready := range speakers {
+		if ready {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return ""
+	}
+	sortNodes(nodes, staticVIPName(vip.IP), s.sList.Priorities())
+	return nodes[0]
+}
+
+// sync announces the static VIPs this node owns, and withdraws the
+// others.
+func (s *staticVIPs) sync(l log.Logger) {
+	speakers := s.sList.UsableSpeakers()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want := map[string]net.IP{}
+	for _, vip := range s.vips {
+		if s.owner(vip, speakers) == s.myNode {
+			want[staticVIPName(vip.IP)] = vip.IP
+		}
+	}
+	for name, ip := range s.announced {
+		if want[name] == nil {
+			s.announcer.DeleteBalancer(name)
+			delete(s.announced, name)
+			level.Info(l).Log("event", "staticVIPWithdrawn", "ip", ip, "msg", "withdrawn static VIP")
+		}
+	}
+	for name, ip := range want {
+		if s.announced[name] == nil {
+			s.announcer.SetBalancer(name, ip, nil)
+			s.announced[name] = ip
+			level.Info(l).Log("event", "staticVIPAnnounced", "ip", ip, "msg", "announcing static VIP")
+		}
+	}
+}
+
+// withdrawAll stops announcing all the static VIPs.
+func (s *staticVIPs) withdrawAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.announced {
+		s.announcer.DeleteBalancer(name)
+		delete(s.announced, name)
+	}
+}
+
+// startStaticVIPs announces the static VIPs of the config, if the
+// speaker runs layer2 mode, until stopCh is closed.
+func (c *controller) startStaticVIPs(l log.Logger, stopCh <-chan struct{}) {
+	l2, ok := c.protocols[config.Layer2].(*layer2Controller)
+	if !ok {
+		return
+	}
+	c.staticVIPs = newStaticVIPs(c.myNode, c.sList, l2.announcer)
+	go c.staticVIPs.Run(l, stopCh)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"go.universe.tf/metallb/internal/config"
+
+	"github.com/go-kit/kit/log"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestStaticVIPs(t *testing.T) {
+	l := log.NewNopLogger()
+	sList := &fakeSpeakerList{
+		speakers:   map[string]bool{"iris": true, "pandora": true},
+		priorities: map[string]int{"iris": 0, "pandora": 1},
+	}
+	newVIPs := func(node string) (*staticVIPs, *fakeAnnouncer) {
+		a := &fakeAnnouncer{ips: map[string]net.IP{}}
+		return newStaticVIPs(node, sList, a), a
+	}
+	iris, irisAnn := newVIPs("iris")
+	pandora, pandoraAnn := newVIPs("pandora")
+
+	pinned := net.ParseIP("10.20.30.1")
+	elected := net.ParseIP("10.20.30.2")
+	cfg := &config.Config{
+		StaticVIPs: []*config.StaticVIP{
+			{IP: pinned, Nodes: []string{"pandora", "iris"}},
+			{IP: elected},
+		},
+	}
+	iris.SetConfig(cfg)
+	pandora.SetConfig(cfg)
+
+	check := func(desc string, wantIris, wantPandora map[string]net.IP) {
+		t.Helper()
+		iris.sync(l)
+		pandora.sync(l)
+		if diff := cmp.Diff(wantIris, irisAnn.ips); diff != "" {
+			t.Errorf("%s: wrong announcements of iris (-want +got)\n%s", desc, diff)
+		}
+		if diff := cmp.Diff(wantPandora, pandoraAnn.ips); diff != "" {
+			t.Errorf("%s: wrong announcements of pandora (-want +got)\n%s", desc, diff)
+		}
+	}
+
+	// The pinned VIP follows its nodes' order, the other one the
+	// priorities.
+	check("all up",
+		map[string]net.IP{"static-vip/10.20.30.2": elected},
+		map[string]net.IP{"static-vip/10.20.30.1": pinned})
+
+	sList.speakers = map[string]bool{"iris": true, "pandora": false}
+	check("pandora draining",
+		map[string]net.IP{"static-vip/10.20.30.1": pinned, "static-vip/10.20.30.2": elected},
+		map[string]net.IP{})
+
+	sList.speakers = map[string]bool{"pandora": true}
+	check("iris down",
+		map[string]net.IP{},
+		map[string]net.IP{"static-vip/10.20.30.1": pinned, "static-vip/10.20.30.2": elected})
+
+	iris.SetConfig(&config.Config{})
+	pandora.SetConfig(&config.Config{})
+	check("removed from config", map[string]net.IP{}, map[string]net.IP{})
+}
@@ -0,0 +1,107 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"go.universe.tf/metallb/internal/k8s"
+)
+
+// speakerStatus tracks the state of the services on this node, for
+// publication in the node's SpeakerStatus.
+type speakerStatus struct {
+	sync.Mutex
+	services map[string]k8s.SpeakerServiceStatus
+	dirty    bool
+}
+
+// set records the state of the service name.
+func (s *speakerStatus) set(name string, st k8s.SpeakerServiceStatus) {
+	s.Lock()
+	defer s.Unlock()
+	st.Service = name
+	if old, ok := s.services[name]; ok && reflect.DeepEqual(old, st) {
+		return
+	}
+	if s.services == nil {
+		s.services = map[string]k8s.SpeakerServiceStatus{}
+	}
+	s.services[name] = st
+	s.dirty = true
+}
+
+// clear forgets the service name.
+func (s *speakerStatus) clear(name string) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.services[name]; !ok {
+		return
+	}
+	delete(s.services, name)
+	s.dirty = true
+}
+
+// speakerStatusName returns the name of the SpeakerStatus of the
+// speaker of node announcing the services of lbClass. Instances
+// other than the default one add their class, so that they don't
+// overwrite each other's status.
+func speakerStatusName(node, lbClass string) string {
+	if lbClass == "" {
+		return node
+	}
+	class := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, lbClass)
+	return node + "." + class
+}
+
+// PublishStatus publishes the node's SpeakerStatus, if it changed
+// since the last successful publication.
+func (c *controller) PublishStatus(l log.Logger) {
+	s := &c.status
+	s.Lock()
+	if !s.dirty {
+		s.Unlock()
+		return
+	}
+	services := make([]k8s.SpeakerServiceStatus, 0, len(s.services))
+	for _, st := range s.services {
+		services = append(services, st)
+	}
+	s.dirty = false
+	s.Unlock()
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Service < services[j].Service
+	})
+	if err := c.client.UpdateSpeakerStatus(speakerStatusName(c.myNode, c.lbClass), services); err != nil {
+		level.Error(l).Log("op", "publishStatus", "error", err, "msg", "failed to publish speaker status")
+		s.Lock()
+		s.dirty = true
+		s.Unlock()
+	}
+}